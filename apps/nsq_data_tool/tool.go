@@ -29,15 +29,21 @@ var (
 	searchMode         = flag.String("search_mode", "count", "the view start of mode. (count|id|timestamp|virtual_offset|check_channels|check_topics)")
 	viewStart          = flag.Int64("view_start", 0, "the start count of message.")
 	viewStartID        = flag.Int64("view_start_id", 0, "the start id of message.")
-	viewStartTimestamp = flag.Int64("view_start_timestamp", 0, "the start timestamp of message.")
+	viewStartTimestamp = flag.Int64("view_start_timestamp", 0, "the start timestamp (in seconds) of message.")
 	viewOffset         = flag.Int64("view_offset", 0, "the virtual offset of the queue")
 	viewCnt            = flag.Int("view_cnt", 1, "the total count need to be viewed. should less than 1,000,000")
 	viewCh             = flag.String("view_channel", "", "channel detail need to view")
 	logLevel           = flag.Int("level", 3, "log level")
 	//TODO: add ext ver for decode message
-	isExt = flag.Bool("ext", false, "is there extension for message ")
+	isExt              = flag.Bool("ext", false, "is there extension for message ")
+	encryptKeyringFile = flag.String("encrypt_keyring_file", "", "the keyring file to decrypt the data if the encryption at rest is enabled on nsqd")
 )
 
+type timeIndexSearcher interface {
+	SetTimeIndexInterval(time.Duration)
+	SearchTimeIndex(int64) (nsqd.BackendOffset, int64, error)
+}
+
 func getBackendName(topicName string, part int) string {
 	backendName := nsqd.GetTopicFullName(topicName, part)
 	return backendName
@@ -212,6 +218,14 @@ func main() {
 		log.Fatal("--view_cnt is too large")
 	}
 
+	if *encryptKeyringFile != "" {
+		kr, err := nsqd.LoadEncryptKeyring(*encryptKeyringFile, 0)
+		if err != nil {
+			log.Fatalf("loading keyring %v failed: %v\n", *encryptKeyringFile, err)
+		}
+		nsqd.SetEncryptKeyring(kr)
+	}
+
 	topicDataPath := path.Join(*dataPath, *topic)
 	topicCommitLogPath := consistence.GetTopicPartitionBasePath(*dataPath, *topic, *partition)
 	tpLogMgr, err := consistence.InitTopicCommitLogMgr(*topic, *partition, topicCommitLogPath, 0)
@@ -269,6 +283,9 @@ func main() {
 	// we need to search in the ordered log data.
 	searchOffset := int64(0)
 	searchLogIndexStart := int64(0)
+	// the position searched from the time index
+	tsQueueOffset := nsqd.BackendOffset(0)
+	tsQueueCnt := int64(0)
 	if *searchMode == "count" {
 		searchLogIndexStart, searchOffset, _, err = tpLogMgr.SearchLogDataByMsgCnt(*viewStart)
 		if err != nil {
@@ -284,6 +301,22 @@ func main() {
 		if err != nil {
 			log.Fatalln(err)
 		}
+	} else if *searchMode == "timestamp" {
+		searcher, ok := backendWriter.(timeIndexSearcher)
+		if !ok {
+			log.Fatalln("time index not supported")
+		}
+		// the index will be loaded from the index files or rebuilt in memory
+		searcher.SetTimeIndexInterval(nsqd.NewOptions().QueueTimeIndexInterval)
+		tsQueueOffset, tsQueueCnt, err = searcher.SearchTimeIndex(*viewStartTimestamp * int64(time.Second))
+		if err != nil {
+			log.Fatalln(err)
+		}
+		log.Printf("time index searched at: %v:%v\n", tsQueueOffset, tsQueueCnt)
+		searchLogIndexStart, searchOffset, _, err = tpLogMgr.SearchLogDataByMsgOffset(int64(tsQueueOffset))
+		if err != nil {
+			log.Fatalln(err)
+		}
 	} else {
 		log.Fatalln("not supported search mode")
 	}
@@ -315,22 +348,28 @@ func main() {
 		}
 		backendReader := nsqd.NewDiskQueueSnapshot(backendName, topicDataPath, backendWriter.GetQueueReadEnd())
 		backendReader.SetQueueStart(backendWriter.GetQueueReadStart())
-		if queueOffset == 0 {
+		if *searchMode == "timestamp" {
+			backendReader.SeekTo(tsQueueOffset, tsQueueCnt)
+		} else if queueOffset == 0 {
 			backendReader.SeekTo(nsqd.BackendOffset(queueOffset), 0)
 		} else {
 			backendReader.SeekTo(nsqd.BackendOffset(queueOffset), logData.MsgCnt-1)
 		}
 		cnt := *viewCnt
 		for cnt > 0 {
-			cnt--
 			ret := backendReader.ReadOne()
 			if ret.Err != nil {
 				log.Fatalf("read data error: %v", ret)
 				return
 			}
 
-			fmt.Printf("%v:%v:%v:%v, string: %v\n", ret.Offset, ret.MovedSize, ret.CurCnt, ret.Data, string(ret.Data))
 			msg, err := nsqd.DecodeMessage(ret.Data, *isExt)
+			if err == nil && *searchMode == "timestamp" && msg.Timestamp < *viewStartTimestamp*int64(time.Second) {
+				// skip the older messages between the index entries
+				continue
+			}
+			cnt--
+			fmt.Printf("%v:%v:%v:%v, string: %v\n", ret.Offset, ret.MovedSize, ret.CurCnt, ret.Data, string(ret.Data))
 			if err != nil {
 				log.Fatalf("decode data error: %v", err)
 				continue
@@ -0,0 +1,78 @@
+// nsq_leadership_migrate copy the cluster leadership data from etcd v2 to etcd v3,
+// all the nsqd and nsqlookupd in the cluster should be stopped while migrating.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/youzan/nsq/consistence"
+	"github.com/youzan/nsq/internal/levellogger"
+	"github.com/youzan/nsq/internal/version"
+)
+
+var (
+	showVersion = flag.Bool("version", false, "print version string")
+
+	v2Addresses = flag.String("v2_addresses", "", "the etcd v2 addresses, separated by comma")
+	v3Addresses = flag.String("v3_addresses", "", "the etcd v3 addresses, separated by comma")
+	username    = flag.String("username", "", "the username of etcd")
+	password    = flag.String("password", "", "the password of etcd")
+	v3Username  = flag.String("v3_username", "", "the username of etcd v3, the same as username if empty")
+	v3Password  = flag.String("v3_password", "", "the password of etcd v3, the same as password if empty")
+	rootDir     = flag.String("leadership_root_dir", "", "the cluster leadership root dir, the same as cluster-leadership-root-dir of nsqd and nsqlookupd")
+	dryRun      = flag.Bool("dry_run", false, "only print the keys to be migrated")
+	logLevel    = flag.Int("level", 2, "log level")
+)
+
+func main() {
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Printf("nsq_leadership_migrate v%s\n", version.Binary)
+		return
+	}
+	consistence.SetCoordLogger(levellogger.NewSimpleLog(), int32(*logLevel))
+
+	if *v2Addresses == "" {
+		log.Fatal("--v2_addresses is required")
+	}
+	if *v3Addresses == "" && !*dryRun {
+		log.Fatal("--v3_addresses is required")
+	}
+	if *rootDir != "" {
+		consistence.NSQ_ROOT_DIR = *rootDir
+	}
+	if *v3Username == "" {
+		*v3Username = *username
+	}
+	if *v3Password == "" {
+		*v3Password = *password
+	}
+
+	v2, err := consistence.NewEClient(*v2Addresses, *username, *password)
+	if err != nil {
+		log.Fatalf("init etcd v2 client failed: %v", err)
+	}
+	var v3 *consistence.EtcdV3Client
+	if *v3Addresses != "" {
+		v3, err = consistence.NewEV3Client(*v3Addresses, *v3Username, *v3Password)
+		if err != nil {
+			log.Fatalf("init etcd v3 client failed: %v", err)
+		}
+		defer v3.Close()
+	}
+	keys, err := consistence.MigrateLeadershipToV3(v2, v3, *dryRun)
+	if err != nil {
+		log.Fatalf("migrate failed: %v", err)
+	}
+	for _, k := range keys {
+		fmt.Println(k)
+	}
+	if *dryRun {
+		log.Printf("%v keys will be migrated", len(keys))
+	} else {
+		log.Printf("%v keys migrated", len(keys))
+	}
+}
@@ -90,6 +90,8 @@ func nsqdFlagSet(opts *nsqd.Options) *flag.FlagSet {
 	flagSet.String("cluster-leadership-username", opts.ClusterLeadershipUsername, "cluster leadership server username for nsq")
 	flagSet.String("cluster-leadership-password", opts.ClusterLeadershipPassword, "cluster leadership server password for nsq")
 	flagSet.String("cluster-leadership-root-dir", opts.ClusterLeadershipRootDir, "cluster leadership server root dir for nsq")
+	flagSet.String("cluster-leadership-backend", opts.ClusterLeadershipBackend, "cluster leadership backend: etcd (v2 api) or etcdv3")
+	flagSet.String("zone", opts.Zone, "the rack or zone label of this node, the replicas of a topic partition will be spread across the zones")
 
 	flagSet.String("https-address", opts.HTTPSAddress, "<addr>:<port> to listen on for HTTPS clients")
 	flagSet.String("http-address", opts.HTTPAddress, "<addr>:<port> to listen on for HTTP clients")
@@ -110,6 +112,25 @@ func nsqdFlagSet(opts *nsqd.Options) *flag.FlagSet {
 	flagSet.Int64("max-bytes-per-file", opts.MaxBytesPerFile, "number of bytes per diskqueue file before rolling")
 	flagSet.Int64("sync-every", opts.SyncEvery, "number of messages per diskqueue fsync")
 	flagSet.Duration("sync-timeout", opts.SyncTimeout, "duration of time per diskqueue fsync")
+	flagSet.Bool("queue-record-checksum", opts.QueueRecordChecksum, "write the crc32c checksum for each diskqueue record (should be the same on all the nodes in the cluster)")
+	flagSet.Duration("queue-time-index-interval", opts.QueueTimeIndexInterval, "the interval of the sparse time index for topic data used to seek by timestamp (0 to disable)")
+	flagSet.String("archive-type", opts.ArchiveType, "the tiered storage type (local, s3) for the cleaned topic data, empty to disable")
+	flagSet.String("archive-path", opts.ArchivePath, "the root directory of the local archive")
+	flagSet.String("archive-s3-endpoint", opts.ArchiveS3Endpoint, "the endpoint of the S3 compatible archive, such as http://127.0.0.1:9000")
+	flagSet.String("archive-s3-bucket", opts.ArchiveS3Bucket, "the bucket of the S3 compatible archive")
+	flagSet.String("archive-s3-region", opts.ArchiveS3Region, "the region of the S3 compatible archive (default us-east-1)")
+	flagSet.String("archive-s3-access-key", opts.ArchiveS3AccessKey, "the access key of the S3 compatible archive")
+	flagSet.String("archive-s3-secret-key", opts.ArchiveS3SecretKey, "the secret key of the S3 compatible archive")
+	flagSet.Int("archive-cache-segments", opts.ArchiveCacheSegments, "max number of the archived segments cached on local disk for each topic partition")
+	flagSet.String("encrypt-keyring-file", opts.EncryptKeyringFile, "the keyring file to encrypt the topic data, commit logs and delayed queue on disk, empty to disable (should be the same on all the nodes in the cluster)")
+	flagSet.Int("encrypt-active-key-id", opts.EncryptActiveKeyID, "the key id in the keyring used to encrypt the new data (0 to use the largest key id)")
+	flagSet.String("zstd-dict-dir", opts.ZstdDictDir, "the directory of the zstd dictionaries (*.dict trained by zstd --train) used by the zstd compressed topics, empty to disable (should be the same on all the nodes in the cluster)")
+	flagSet.Int("zstd-active-dict-id", opts.ZstdActiveDictID, "the dictionary id used to compress the new data (0 to use the largest dictionary id)")
+	flagSet.Duration("compact-tombstone-retention", opts.CompactTombstoneRetention, "the duration to keep the tombstone of the compacted topic")
+	flagSet.String("delay-queue-engine", opts.DelayQueueEngine, "the delayed queue store engine (bolt, wheel), the existing store is converted while opening if changed")
+	flagSet.Int64("zero-copy-min-size", opts.ZeroCopyMinSize, "the message body not less than the size is sent to the consumer from the topic segment file directly (sendfile for the plain tcp consumer), 0 to disable")
+	flagSet.Int64("catchup-rate-limit", opts.CatchupRateLimit, "max bytes per second of the data sent to all the replicas catching up from this node, 0 to disable")
+	flagSet.Int64("catchup-topic-rate-limit", opts.CatchupTopicRateLimit, "max bytes per second of the catchup data sent for each topic partition, 0 to disable")
 
 	// msg and command options
 	flagSet.String("msg-timeout", opts.MsgTimeout.String(), "duration to wait before auto-requeing a message")
@@ -117,6 +138,7 @@ func nsqdFlagSet(opts *nsqd.Options) *flag.FlagSet {
 	flagSet.Int64("max-msg-size", opts.MaxMsgSize, "maximum size of a single message in bytes")
 	flagSet.Duration("max-req-timeout", opts.MaxReqTimeout, "maximum requeuing timeout for a message")
 	flagSet.Duration("req-to-end-threshold", opts.ReqToEndThreshold, "duration threshold for requeue message to queue end")
+	flagSet.Int("dedup-window-size", opts.DedupWindowSize, "the number of recent messages with the producer sequence or dedup key kept for deduplication in each topic partition, 0 to disable")
 	// remove, deprecated
 	flagSet.Int64("max-message-size", opts.MaxMsgSize, "(deprecated use --max-msg-size) maximum size of a single message in bytes")
 	flagSet.Int64("max-body-size", opts.MaxBodySize, "maximum size of a single command body")
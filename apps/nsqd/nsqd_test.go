@@ -2,6 +2,7 @@ package main
 
 import (
 	"crypto/tls"
+	"io/ioutil"
 	"os"
 	"testing"
 
@@ -26,6 +27,12 @@ func TestConfigFlagParsing(t *testing.T) {
 	cfg.Validate()
 
 	options.Resolve(opts, flagSet, cfg)
+	tmpDir, err := ioutil.TempDir("", "nsq-test-")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	opts.DataPath = tmpDir
 	nsqd.New(opts)
 
 	if opts.TLSMinVersion != tls.VersionTLS10 {
@@ -39,6 +39,9 @@ var (
 	clusterLeadershipPassword  = flagSet.String("cluster-leadership-password", "", " the cluster leadership server password")
 	clusterLeadershipRootDir   = flagSet.String("cluster-leadership-root-dir", "", " the cluster leadership server root dir")
 	clusterID                  = flagSet.String("cluster-id", "nsq-clusterid-test-only", "the cluster id used for separating different nsq cluster.")
+	clusterLeadershipBackend   = flagSet.String("cluster-leadership-backend", "etcd", "the cluster leadership backend: etcd (v2 api), etcdv3 or raft (embedded in nsqlookupd and the cluster-leadership-addresses are the raft members)")
+	raftNodeID                 = flagSet.Int("raft-node-id", 0, "the raft member id of this lookupd (the index start from 1 in cluster-leadership-addresses) for the raft leadership backend")
+	raftDataPath               = flagSet.String("raft-data-path", "", "the data dir of the raft leadership backend")
 
 	inactiveProducerTimeout  = flagSet.Duration("inactive-producer-timeout", 60*time.Second, "duration of time a producer will remain in the active list since its last ping")
 	nsqdPingTimeout          = flagSet.Duration("nsqd-ping-timeout", 15*time.Second, "duration of nsqd ping timeout, should be at least twice as the nsqd ping interval")
@@ -46,6 +49,7 @@ var (
 	logLevel                 = flagSet.Int("log-level", 1, "log verbose level")
 	logDir                   = flagSet.String("log-dir", "", "directory for log file")
 	allowWriteWithNoChannels = flagSet.Bool("allow-write-with-nochannels", false, "allow write to topic with no channels")
+	preferredLeaderRestore   = flagSet.Bool("preferred-leader-restore", false, "move the topic leaders back to the preferred leader in background")
 	balanceInterval          = app.StringArray{}
 )
 
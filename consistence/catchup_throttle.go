@@ -0,0 +1,164 @@
+package consistence
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+var (
+	// the max time to wait in one rpc call for throttling, should be less than the rpc timeout
+	catchupThrottleMaxWait = RPC_TIMEOUT / 2
+	// the window to measure the current catchup rate
+	catchupRateWindow = time.Second
+)
+
+// while throttled, the data pulled at one time is limited to the bytes allowed in
+// 1/catchupPullSlices second, so the wait in each rpc call will be short.
+const catchupPullSlices = 4
+
+// catchupThrottle limits the bytes rate of the catchup data sent to the replicas
+// and measures the current rate.
+type catchupThrottle struct {
+	sync.Mutex
+	// the time the reserved bytes will be all sent under the limit
+	next        time.Time
+	windowStart time.Time
+	windowBytes int64
+	lastRate    int64
+	waited      time.Duration
+}
+
+func (ct *catchupThrottle) updateRateNoLock(now time.Time) {
+	elapsed := now.Sub(ct.windowStart)
+	if elapsed < catchupRateWindow {
+		return
+	}
+	ct.lastRate = ct.windowBytes * int64(time.Second) / int64(elapsed)
+	ct.windowStart = now
+	ct.windowBytes = 0
+}
+
+// reserve the bytes to be sent and return the duration to wait before sending,
+// the limit is the max bytes per second, 0 means no limit.
+func (ct *catchupThrottle) reserve(n int64, limit int64, now time.Time) time.Duration {
+	ct.Lock()
+	defer ct.Unlock()
+	ct.updateRateNoLock(now)
+	ct.windowBytes += n
+	if limit <= 0 {
+		ct.next = now
+		return 0
+	}
+	start := ct.next
+	if start.Before(now) {
+		start = now
+	}
+	// avoid the wait growing too long if too many replicas catching up at the same time
+	if start.Sub(now) > catchupThrottleMaxWait {
+		start = now.Add(catchupThrottleMaxWait)
+	}
+	ct.next = start.Add(time.Duration(n * int64(time.Second) / limit))
+	wait := start.Sub(now)
+	ct.waited += wait
+	return wait
+}
+
+// return the bytes per second sent in the last window
+func (ct *catchupThrottle) currentRate(now time.Time) int64 {
+	ct.Lock()
+	defer ct.Unlock()
+	ct.updateRateNoLock(now)
+	return ct.lastRate
+}
+
+func (ct *catchupThrottle) waitedTime() time.Duration {
+	ct.Lock()
+	defer ct.Unlock()
+	return ct.waited
+}
+
+// the max bytes pulled at one time for catchup under the limits
+func getCatchupPullMaxBytes(nodeLimit int64, topicLimit int64) int32 {
+	maxBytes := int64(MAX_LOG_PULL_BYTES)
+	for _, l := range []int64{nodeLimit, topicLimit} {
+		if l > 0 && l/catchupPullSlices < maxBytes {
+			maxBytes = l / catchupPullSlices
+		}
+	}
+	return int32(maxBytes)
+}
+
+func (ncoord *NsqdCoordinator) getCatchupRateLimits() (int64, int64) {
+	if ncoord.localNsqd == nil {
+		return 0, 0
+	}
+	opts := ncoord.localNsqd.GetOpts()
+	return opts.CatchupRateLimit, opts.CatchupTopicRateLimit
+}
+
+// wait for the node and topic catchup rate limit before sending the catchup data
+func (ncoord *NsqdCoordinator) throttleCatchup(tc *TopicCoordinator, n int64) {
+	nodeLimit, topicLimit := ncoord.getCatchupRateLimits()
+	now := time.Now()
+	wait := ncoord.catchupThrottle.reserve(n, nodeLimit, now)
+	if tc != nil {
+		topicWait := tc.catchupThrottle.reserve(n, topicLimit, now)
+		if topicWait > wait {
+			wait = topicWait
+		}
+	}
+	if wait <= 0 {
+		return
+	}
+	select {
+	case <-ncoord.stopChan:
+	case <-time.After(wait):
+	}
+}
+
+func (ncoord *NsqdCoordinator) getCatchupThrottleStat() *CatchupThrottleStat {
+	nodeLimit, topicLimit := ncoord.getCatchupRateLimits()
+	return &CatchupThrottleStat{
+		RateLimit:      nodeLimit,
+		TopicRateLimit: topicLimit,
+		CurrentRate:    ncoord.catchupThrottle.currentRate(time.Now()),
+		WaitedMs:       int64(ncoord.catchupThrottle.waitedTime() / time.Millisecond),
+	}
+}
+
+// catchupThrottledWriter write the data in the slices allowed by the catchup rate limits and
+// wait for the limits before each slice, so the limits apply to the data actually sent.
+type catchupThrottledWriter struct {
+	ncoord *NsqdCoordinator
+	tc     *TopicCoordinator
+	w      io.Writer
+}
+
+func (tw *catchupThrottledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := int(getCatchupPullMaxBytes(tw.ncoord.getCatchupRateLimits()))
+		if n > len(p) {
+			n = len(p)
+		}
+		tw.ncoord.throttleCatchup(tw.tc, int64(n))
+		wn, err := tw.w.Write(p[:n])
+		written += wn
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// NewCatchupThrottledWriter return the writer to stream the full sync data of the topic
+// partition (such as the delayed queue backup) to the replica under the catchup rate limits.
+func (ncoord *NsqdCoordinator) NewCatchupThrottledWriter(topic string, partition int, w io.Writer) (io.Writer, error) {
+	tc, coordErr := ncoord.getTopicCoord(topic, partition)
+	if coordErr != nil {
+		return nil, coordErr.ToErrorType()
+	}
+	return &catchupThrottledWriter{ncoord: ncoord, tc: tc, w: w}, nil
+}
@@ -36,6 +36,7 @@ var (
 	ErrCommitLogSegmentSizeInvalid   = errors.New("commit log segment size is invalid")
 	ErrCommitLogLessThanSegmentStart = errors.New("commit log read index is less than segment start")
 	ErrCommitLogCleanKeepMin         = errors.New("commit log clean should keep some data")
+	ErrCommitLogSealMissing          = errors.New("commit log seal of the encrypted log is missing")
 )
 
 var LOGROTATE_NUM = 500000
@@ -121,12 +122,12 @@ func getCommitLogCountFromFile(path string, start int64) (int64, error) {
 	return fsize / int64(GetLogDataSize()), nil
 }
 
-func getCommitLogFromFile(file *os.File, offset int64) (*CommitLogData, error) {
+func getCommitLogFromFile(file *os.File, sealFile *os.File, offset int64) (*CommitLogData, error) {
 	if (offset % int64(GetLogDataSize())) != 0 {
 		return nil, ErrCommitLogOffsetInvalid
 	}
 	b := bytes.NewBuffer(make([]byte, GetLogDataSize()))
-	n, err := file.ReadAt(b.Bytes(), offset)
+	n, err := readCommitLogAt(file, sealFile, b.Bytes(), offset)
 	if err != nil {
 		if err == io.EOF {
 			if n == 0 {
@@ -147,7 +148,7 @@ func getCommitLogFromFile(file *os.File, offset int64) (*CommitLogData, error) {
 
 }
 
-func getLastCommitLogDataFromFile(file *os.File) (*CommitLogData, int64, error) {
+func getLastCommitLogDataFromFile(file *os.File, sealFile *os.File) (*CommitLogData, int64, error) {
 	s, err := file.Stat()
 	if err != nil {
 		return nil, 0, err
@@ -161,7 +162,7 @@ func getLastCommitLogDataFromFile(file *os.File) (*CommitLogData, int64, error)
 	}
 	num := fsize / int64(GetLogDataSize())
 	roundOffset := (num - 1) * int64(GetLogDataSize())
-	l, err := getCommitLogFromFile(file, roundOffset)
+	l, err := getCommitLogFromFile(file, sealFile, roundOffset)
 	if err != nil {
 		coordLog.Infof("load file error: %v", err)
 		return nil, 0, err
@@ -175,10 +176,17 @@ func getLastCommitLogData(path string, startIndex int64) (*CommitLogData, int64,
 		return nil, 0, err
 	}
 	defer tmpFile.Close()
-	return getLastCommitLogDataFromFile(tmpFile)
+	sealFile, err := openCommitLogSeal(tmpFile.Name())
+	if err != nil {
+		return nil, 0, err
+	}
+	if sealFile != nil {
+		defer sealFile.Close()
+	}
+	return getLastCommitLogDataFromFile(tmpFile, sealFile)
 }
 
-func getCommitLogListFromFile(file *os.File, offset int64, num int) ([]CommitLogData, error) {
+func getCommitLogListFromFile(file *os.File, sealFile *os.File, offset int64, num int) ([]CommitLogData, error) {
 	f, err := file.Stat()
 	if err != nil {
 		return nil, err
@@ -203,7 +211,7 @@ func getCommitLogListFromFile(file *os.File, offset int64, num int) ([]CommitLog
 		readToEnd = true
 	}
 	b := bytes.NewBuffer(make([]byte, needRead))
-	n, err := file.ReadAt(b.Bytes(), offset)
+	n, err := readCommitLogAt(file, sealFile, b.Bytes(), offset)
 	if err != nil {
 		if err != io.EOF {
 			return nil, err
@@ -228,7 +236,7 @@ func getCommitLogListFromFile(file *os.File, offset int64, num int) ([]CommitLog
 	return logList, err
 }
 
-func truncateFileToOffset(file *os.File, fileStartOffset int64, offset int64) (*CommitLogData, error) {
+func truncateFileToOffset(file *os.File, sealFile *os.File, fileStartOffset int64, offset int64) (*CommitLogData, error) {
 	if offset > 0 && offset < int64(GetLogDataSize()) {
 		return nil, ErrCommitLogOffsetInvalid
 	}
@@ -236,6 +244,9 @@ func truncateFileToOffset(file *os.File, fileStartOffset int64, offset int64) (*
 		return nil, ErrCommitLogLessThanSegmentStart
 	}
 	err := file.Truncate(offset)
+	if err == nil {
+		err = truncateCommitLogSeal(file.Name(), offset)
+	}
 	if err != nil {
 		s, _ := file.Stat()
 		coordLog.Infof("truncate file %v failed: %v, offset:%v, %v ", file, err, offset, s)
@@ -245,7 +256,7 @@ func truncateFileToOffset(file *os.File, fileStartOffset int64, offset int64) (*
 		return nil, ErrCommitLogEOF
 	}
 	b := bytes.NewBuffer(make([]byte, GetLogDataSize()))
-	n, err := file.ReadAt(b.Bytes(), offset-int64(GetLogDataSize()))
+	n, err := readCommitLogAt(file, sealFile, b.Bytes(), offset-int64(GetLogDataSize()))
 	if err != nil {
 		return nil, err
 	}
@@ -274,17 +285,20 @@ type LogStartInfo struct {
 }
 
 type TopicCommitLogMgr struct {
-	topic        string
-	partition    int
-	nLogID       int64
-	pLogID       int64
-	path         string
-	bufSize      int
-	appender     *os.File
-	bufAppender  *bufio.Writer
-	currentStart int64
-	currentCount int32
-	logStartInfo LogStartInfo
+	topic       string
+	partition   int
+	nLogID      int64
+	pLogID      int64
+	path        string
+	bufSize     int
+	appender    *os.File
+	bufAppender *bufio.Writer
+	// the seal file of the current commit log if the encryption is enabled
+	sealAppender    *os.File
+	bufSealAppender *bufio.Writer
+	currentStart    int64
+	currentCount    int32
+	logStartInfo    LogStartInfo
 	sync.Mutex
 }
 
@@ -327,6 +341,13 @@ func InitTopicCommitLogMgrWithFixMode(t string, p int, basepath string, commitBu
 	if err != nil {
 		return nil, err
 	}
+	for i := mgr.logStartInfo.SegmentStartIndex; i < mgr.currentStart; i++ {
+		err = checkCommitLogSeal(getSegmentFilename(mgr.path, i))
+		if err != nil {
+			mgr.closeAppenderNoLock(false)
+			return nil, err
+		}
+	}
 	//load meta
 	err = mgr.loadCommitLogMeta(fixMode)
 	if err != nil {
@@ -502,7 +523,7 @@ func (self *TopicCommitLogMgr) prepareAppender(path string) error {
 			self.bufAppender.Reset(self.appender)
 		}
 	}
-	return nil
+	return self.prepareSealAppender(path)
 }
 
 func (self *TopicCommitLogMgr) getAppenderForWrite() io.Writer {
@@ -516,16 +537,15 @@ func (self *TopicCommitLogMgr) MoveTo(newBase string) error {
 	self.Lock()
 	defer self.Unlock()
 	self.flushCommitLogsNoLock()
-	self.appender.Sync()
-	self.appender.Close()
+	self.closeAppenderNoLock(true)
 	newPath := GetTopicPartitionLogPath(newBase, self.topic, self.partition)
 	coordLog.Infof("rename the topic %v commit log to :%v", self.topic, newPath)
-	err := util.AtomicRename(self.path, newPath)
+	err := renameCommitLogFile(self.path, newPath)
 	if err != nil {
 		coordLog.Infof("rename the topic %v commit log failed :%v", self.topic, err)
 	}
 	for i := int64(0); i < self.currentStart; i++ {
-		util.AtomicRename(getSegmentFilename(self.path, int64(i)), getSegmentFilename(newPath, int64(i)))
+		renameCommitLogFile(getSegmentFilename(self.path, int64(i)), getSegmentFilename(newPath, int64(i)))
 	}
 	err = util.AtomicRename(self.path+".current", newPath+".current")
 	if err != nil {
@@ -623,15 +643,14 @@ func (self *TopicCommitLogMgr) ResetLogWithStart(newStart LogStartInfo) error {
 	defer self.Unlock()
 
 	self.flushCommitLogsNoLock()
-	self.appender.Sync()
-	self.appender.Close()
-	err := os.Remove(self.path)
+	self.closeAppenderNoLock(true)
+	err := removeCommitLogFile(self.path)
 	if err != nil {
 		coordLog.Warningf("failed to remove the commit log for topic: %v", self.path)
 	}
 	for i := int64(0); i < self.currentStart; i++ {
 		fn := getSegmentFilename(self.path, int64(i))
-		os.Remove(fn)
+		removeCommitLogFile(fn)
 		coordLog.Infof("commit log removed: %v", fn)
 	}
 	os.Remove(self.path + ".current")
@@ -665,6 +684,25 @@ func (self *TopicCommitLogMgr) GetLogStartInfo() (*LogStartInfo, *CommitLogData,
 	return &logStart, l, err
 }
 
+// GetClosedSegmentFiles return the closed segment files from the log start to the end index (not included),
+// which will be removed after the log cleaned to the end index.
+func (self *TopicCommitLogMgr) GetClosedSegmentFiles(endIndex int64) []string {
+	self.Lock()
+	defer self.Unlock()
+	if endIndex > self.currentStart {
+		endIndex = self.currentStart
+	}
+	files := make([]string, 0)
+	for i := self.logStartInfo.SegmentStartIndex; i < endIndex; i++ {
+		fName := getSegmentFilename(self.path, i)
+		files = append(files, fName)
+		if _, err := os.Stat(getCommitLogSealFilename(fName)); err == nil {
+			files = append(files, getCommitLogSealFilename(fName))
+		}
+	}
+	return files
+}
+
 func (self *TopicCommitLogMgr) GetCurrentStart() int64 {
 	self.Lock()
 	tmp := atomic.LoadInt64(&self.currentStart)
@@ -675,14 +713,13 @@ func (self *TopicCommitLogMgr) GetCurrentStart() int64 {
 func (self *TopicCommitLogMgr) Delete() {
 	self.Lock()
 	self.flushCommitLogsNoLock()
-	self.appender.Sync()
-	self.appender.Close()
-	err := os.Remove(self.path)
+	self.closeAppenderNoLock(true)
+	err := removeCommitLogFile(self.path)
 	if err != nil && !os.IsNotExist(err) {
 		coordLog.Warningf("failed to remove the commit log for topic: %v", self.path)
 	}
 	for i := int64(0); i < self.currentStart; i++ {
-		os.Remove(getSegmentFilename(self.path, int64(i)))
+		removeCommitLogFile(getSegmentFilename(self.path, int64(i)))
 	}
 	os.Remove(self.path + ".current")
 	os.Remove(self.path + ".start")
@@ -692,8 +729,7 @@ func (self *TopicCommitLogMgr) Delete() {
 func (self *TopicCommitLogMgr) Close() {
 	self.Lock()
 	self.flushCommitLogsNoLock()
-	self.appender.Sync()
-	self.appender.Close()
+	self.closeAppenderNoLock(true)
 	self.saveCurrentStart(true)
 	self.saveLogSegStartInfo()
 	self.Unlock()
@@ -729,6 +765,20 @@ func (self *TopicCommitLogMgr) NextID() uint64 {
 func (self *TopicCommitLogMgr) Reset(id uint64) {
 }
 
+// make sure the next id is larger than the given id, used while the message id
+// is not generated by local (such as the messages mirrored from other cluster).
+func (self *TopicCommitLogMgr) updateNextID(id int64) {
+	for {
+		old := atomic.LoadInt64(&self.nLogID)
+		if old > id {
+			return
+		}
+		if atomic.CompareAndSwapInt64(&self.nLogID, old, id+1) {
+			return
+		}
+	}
+}
+
 func (self *TopicCommitLogMgr) GetCurrentEnd() (int64, int64) {
 	self.Lock()
 	defer self.Unlock()
@@ -842,7 +892,7 @@ func (self *TopicCommitLogMgr) CleanOldData(fileIndex int64, fileOffset int64) e
 		// keep the previous file to read the last commit log
 		if int64(i) < fileIndex-1 {
 			fName := getSegmentFilename(self.path, int64(i))
-			err = os.Remove(fName)
+			err = removeCommitLogFile(fName)
 			if err != nil {
 				if !os.IsNotExist(err) {
 					coordLog.Warningf("clean commit segment %v failed: %v", fName, err)
@@ -879,14 +929,13 @@ func (self *TopicCommitLogMgr) TruncateToOffsetV2(startIndex int64, offset int64
 		self.currentCount = int32(offset / int64(GetLogDataSize()))
 		self.saveCurrentStart(true)
 
-		self.appender.Sync()
-		self.appender.Close()
-		os.Remove(self.path)
+		self.closeAppenderNoLock(true)
+		removeCommitLogFile(self.path)
 		for i := startIndex + 1; i < oldStart; i++ {
-			os.Remove(getSegmentFilename(self.path, int64(i)))
+			removeCommitLogFile(getSegmentFilename(self.path, int64(i)))
 		}
 
-		err := util.AtomicRename(getSegmentFilename(self.path, startIndex), self.path)
+		err := renameCommitLogFile(getSegmentFilename(self.path, startIndex), self.path)
 		if err != nil {
 			coordLog.Infof("rename file failed: %v, %v", startIndex, err)
 			return nil, err
@@ -901,7 +950,7 @@ func (self *TopicCommitLogMgr) TruncateToOffsetV2(startIndex int64, offset int64
 }
 
 func (self *TopicCommitLogMgr) truncateToOffset(startOffset int64, offset int64) (*CommitLogData, error) {
-	l, err := truncateFileToOffset(self.appender, startOffset, offset)
+	l, err := truncateFileToOffset(self.appender, self.sealAppender, startOffset, offset)
 	self.currentCount = int32(offset / int64(GetLogDataSize()))
 	coordLog.Infof("truncate commit log to: %v, %v", self.currentStart, self.currentCount)
 	if err != nil {
@@ -1007,7 +1056,7 @@ func (self *TopicCommitLogMgr) getCommitLogFromOffsetV2(start int64, offset int6
 	} else {
 		if start == self.currentStart {
 			self.flushCommitLogsNoLock()
-			return getCommitLogFromFile(self.appender, offset)
+			return getCommitLogFromFile(self.appender, self.sealAppender, offset)
 		}
 		logs, err := self.getCommitLogsV2(start, offset, 1)
 		if err != nil {
@@ -1032,7 +1081,7 @@ func (self *TopicCommitLogMgr) GetLastCommitLogDataOnSegment(index int64) (int64
 	defer self.Unlock()
 	if self.currentStart == index {
 		self.flushCommitLogsNoLock()
-		l, readOffset, err := getLastCommitLogDataFromFile(self.appender)
+		l, readOffset, err := getLastCommitLogDataFromFile(self.appender, self.sealAppender)
 		return readOffset, l, err
 	} else if index > self.currentStart {
 		return 0, nil, ErrCommitLogOutofBound
@@ -1074,7 +1123,7 @@ func (self *TopicCommitLogMgr) GetLastCommitLogOffsetV2() (int64, int64, *Commit
 	num := fsize / int64(GetLogDataSize())
 	roundOffset := (num - 1) * int64(GetLogDataSize())
 	for {
-		l, err := getCommitLogFromFile(self.appender, roundOffset)
+		l, err := getCommitLogFromFile(self.appender, self.sealAppender, roundOffset)
 		if err != nil {
 			return self.currentStart, 0, nil, err
 		}
@@ -1128,13 +1177,10 @@ func (self *TopicCommitLogMgr) AppendCommitLogWithSync(l *CommitLogData, slave b
 	fsync := !slave && useFsync
 	if self.currentCount >= int32(LOGROTATE_NUM) {
 		self.flushCommitLogsNoLock()
-		if fsync {
-			self.appender.Sync()
-		}
-		self.appender.Close()
+		self.closeAppenderNoLock(fsync)
 		cost1 = time.Since(start)
 		newName := getSegmentFilename(self.path, self.currentStart)
-		err := util.AtomicRename(self.path, newName)
+		err := renameCommitLogFile(self.path, newName)
 		if err != nil {
 			coordLog.Errorf("rotate file %v to %v failed: %v", self.path, newName, err)
 			return err
@@ -1153,7 +1199,7 @@ func (self *TopicCommitLogMgr) AppendCommitLogWithSync(l *CommitLogData, slave b
 			return err
 		}
 	}
-	err := binary.Write(self.getAppenderForWrite(), binary.BigEndian, *l)
+	err := self.writeLogData(l)
 	if err != nil {
 		return err
 	}
@@ -1181,6 +1227,9 @@ func (self *TopicCommitLogMgr) updateBufferSize(bs int) {
 	self.flushCommitLogsNoLock()
 	if self.bufSize > 0 {
 		self.bufAppender = bufio.NewWriterSize(self.appender, self.bufSize*64)
+		if self.sealAppender != nil {
+			self.bufSealAppender = bufio.NewWriterSize(self.sealAppender, self.bufSize*64)
+		}
 	}
 	self.Unlock()
 }
@@ -1195,7 +1244,12 @@ func (self *TopicCommitLogMgr) flushCommitLogsNoLock() {
 	if self.bufAppender == nil {
 		return
 	}
-	err := self.bufAppender.Flush()
+	// flush the seals first to make sure the encrypted log data always has the seal
+	err := self.flushSealNoLock()
+	if err != nil {
+		coordLog.Errorf("topic %v commit log flush seal file error: %v", self.path, err)
+	}
+	err = self.bufAppender.Flush()
 	if err != nil {
 		coordLog.Errorf("topic %v commit log flush file error: %v", self.path, err)
 	}
@@ -1217,7 +1271,7 @@ func (self *TopicCommitLogMgr) getCommitLogsV2(startIndex int64, startOffset int
 	}
 	self.flushCommitLogsNoLock()
 	if startIndex == self.currentStart {
-		return getCommitLogListFromFile(self.appender, startOffset, num)
+		return getCommitLogListFromFile(self.appender, self.sealAppender, startOffset, num)
 	}
 
 	var totalLogs []CommitLogData
@@ -1232,10 +1286,18 @@ func (self *TopicCommitLogMgr) getCommitLogsV2(startIndex int64, startOffset int
 				coordLog.Warningf("read logs from %v error : %v", readIndex, fileErr)
 				return totalLogs, fileErr
 			}
-			loglist, err = getCommitLogListFromFile(tmpFile, readOffset, num-len(totalLogs))
+			sealFile, sealErr := openCommitLogSeal(tmpFile.Name())
+			if sealErr != nil {
+				tmpFile.Close()
+				return totalLogs, sealErr
+			}
+			loglist, err = getCommitLogListFromFile(tmpFile, sealFile, readOffset, num-len(totalLogs))
 			tmpFile.Close()
+			if sealFile != nil {
+				sealFile.Close()
+			}
 		} else {
-			loglist, err = getCommitLogListFromFile(self.appender, readOffset, num-len(totalLogs))
+			loglist, err = getCommitLogListFromFile(self.appender, self.sealAppender, readOffset, num-len(totalLogs))
 		}
 		if err == ErrCommitLogEOF {
 			//coordLog.Debugf("read %v to end: %v logs", readIndex, len(loglist))
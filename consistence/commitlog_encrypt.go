@@ -0,0 +1,281 @@
+package consistence
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+
+	"github.com/youzan/nsq/internal/util"
+	"github.com/youzan/nsq/nsqd"
+)
+
+// The commit log entry has the fixed size, so the encrypted entry keeps the same size
+// in the commit log file, and the key id, nonce and tag of each entry is kept in the seal
+// file (the commit log file name with the seal suffix) at the same index.
+// The zero key id in the seal file means the entry is not encrypted, which is written
+// before the encryption enabled.
+const (
+	commitLogSealSuffix = ".enc"
+	commitLogSealSize   = nsqd.EncryptOverhead
+)
+
+func getCommitLogSealFilename(name string) string {
+	return name + commitLogSealSuffix
+}
+
+// sealCommitLogData encrypt the log data in place and return the seal of the data.
+func sealCommitLogData(kr *nsqd.EncryptKeyring, data []byte) ([]byte, error) {
+	seal := make([]byte, commitLogSealSize)
+	if kr == nil {
+		return seal, nil
+	}
+	sealed, err := kr.Seal(nil, data, nil)
+	if err != nil {
+		return nil, err
+	}
+	copy(seal, sealed[:nsqd.EncryptSealHeadLen])
+	copy(seal[nsqd.EncryptSealHeadLen:], sealed[len(sealed)-nsqd.EncryptTagLen:])
+	copy(data, sealed[nsqd.EncryptSealHeadLen:len(sealed)-nsqd.EncryptTagLen])
+	return seal, nil
+}
+
+// openCommitLogData decrypt the log data in place using the seal.
+func openCommitLogData(kr *nsqd.EncryptKeyring, data []byte, seal []byte) error {
+	if binary.BigEndian.Uint32(seal[:nsqd.EncryptKeyIDLen]) == 0 {
+		return nil
+	}
+	sealed := make([]byte, 0, len(data)+len(seal))
+	sealed = append(sealed, seal[:nsqd.EncryptSealHeadLen]...)
+	sealed = append(sealed, data...)
+	sealed = append(sealed, seal[nsqd.EncryptSealHeadLen:]...)
+	plain, err := kr.Open(sealed, nil)
+	if err != nil {
+		return err
+	}
+	copy(data, plain)
+	return nil
+}
+
+// openCommitLogSeal open the seal file of the commit log for read, nil if the commit log
+// is never encrypted.
+func openCommitLogSeal(name string) (*os.File, error) {
+	f, err := os.Open(getCommitLogSealFilename(name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return f, err
+}
+
+// readCommitLogAt is the same as ReadAt of the commit log file, and the log entries read
+// will be decrypted using the seal file if encrypted. The offset should be aligned to the log entry.
+func readCommitLogAt(file *os.File, sealFile *os.File, buf []byte, offset int64) (int, error) {
+	n, err := file.ReadAt(buf, offset)
+	kr := nsqd.GetEncryptKeyring()
+	cnt := n / GetLogDataSize()
+	if kr == nil || cnt == 0 || sealFile == nil {
+		return n, err
+	}
+	seals := make([]byte, cnt*commitLogSealSize)
+	sn, sealErr := sealFile.ReadAt(seals, offset/int64(GetLogDataSize())*commitLogSealSize)
+	if sealErr != nil && sealErr != io.EOF {
+		return 0, sealErr
+	}
+	// the seal is always written before the log data, so the missing seal means corrupted
+	if sn != len(seals) {
+		coordLog.Errorf("commit log %v seal missing at %v, read %v seals for %v logs",
+			file.Name(), offset, sn/commitLogSealSize, cnt)
+		return 0, ErrCommitLogSealMissing
+	}
+	for i := 0; i < cnt; i++ {
+		sealErr = openCommitLogData(kr, buf[i*GetLogDataSize():(i+1)*GetLogDataSize()],
+			seals[i*commitLogSealSize:(i+1)*commitLogSealSize])
+		if sealErr != nil {
+			coordLog.Errorf("commit log %v decrypt at %v failed: %v", file.Name(), offset+int64(i*GetLogDataSize()), sealErr)
+			return 0, sealErr
+		}
+	}
+	return n, err
+}
+
+func truncateCommitLogSeal(name string, offset int64) error {
+	err := os.Truncate(getCommitLogSealFilename(name), offset/int64(GetLogDataSize())*commitLogSealSize)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// checkCommitLogSeal return error if the commit log file is encrypted but the keyring is not loaded
+func checkCommitLogSeal(name string) error {
+	if nsqd.GetEncryptKeyring() != nil {
+		return nil
+	}
+	if _, err := os.Stat(getCommitLogSealFilename(name)); err == nil {
+		coordLog.Errorf("commit log %v is encrypted but the keyring is not loaded", name)
+		return nsqd.ErrEncryptKeyringNotLoaded
+	}
+	return nil
+}
+
+func renameCommitLogFile(oldName string, newName string) error {
+	err := util.AtomicRename(oldName, newName)
+	if err != nil {
+		return err
+	}
+	err = util.AtomicRename(getCommitLogSealFilename(oldName), getCommitLogSealFilename(newName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func removeCommitLogFile(name string) error {
+	err := os.Remove(name)
+	sealErr := os.Remove(getCommitLogSealFilename(name))
+	if err == nil && sealErr != nil && !os.IsNotExist(sealErr) {
+		return sealErr
+	}
+	return err
+}
+
+// createCommitLogSeal create the seal file for the commit log written before the encryption
+// enabled, the zero seals of the existing log entries are synced before the seal file visible,
+// so all the entries without the seal in the existing seal file are the encrypted ones.
+func createCommitLogSeal(path string, logCnt int64) error {
+	tmpName := getCommitLogSealFilename(path) + ".tmp"
+	f, err := os.OpenFile(tmpName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(make([]byte, logCnt*commitLogSealSize))
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err == nil {
+		err = util.AtomicRename(tmpName, getCommitLogSealFilename(path))
+	}
+	if err != nil {
+		os.Remove(tmpName)
+	}
+	return err
+}
+
+// prepareSealAppender open the seal file for the current commit log if the encryption
+// is enabled, it should be called after the commit log appender opened.
+func (self *TopicCommitLogMgr) prepareSealAppender(path string) error {
+	self.sealAppender = nil
+	if nsqd.GetEncryptKeyring() == nil {
+		return checkCommitLogSeal(path)
+	}
+	logStat, err := self.appender.Stat()
+	if err != nil {
+		return err
+	}
+	logCnt := logStat.Size() / int64(GetLogDataSize())
+	if _, err = os.Stat(getCommitLogSealFilename(path)); os.IsNotExist(err) {
+		err = createCommitLogSeal(path, logCnt)
+	}
+	if err != nil {
+		coordLog.Errorf("create topic %v commit log seal file error: %v", path, err)
+		return err
+	}
+	f, err := os.OpenFile(getCommitLogSealFilename(path), os.O_APPEND|os.O_RDWR, 0644)
+	if err != nil {
+		coordLog.Errorf("open topic %v commit log seal file error: %v", path, err)
+		return err
+	}
+	sealStat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	// the seals may be more if the log is not flushed before crash, and the logs may be more
+	// if the seals are not synced before crash. The log entries without the seal are encrypted
+	// and can not be read anymore, so the commit log is truncated to the last sealed entry and
+	// the topic data will be fixed to the commit log while loading the topic.
+	sealCnt := sealStat.Size() / commitLogSealSize
+	if sealCnt < logCnt {
+		coordLog.Warningf("topic %v commit log truncated from %v to %v since the seals missing", path, logCnt, sealCnt)
+		err = self.appender.Truncate(sealCnt * int64(GetLogDataSize()))
+		logCnt = sealCnt
+	}
+	if err == nil && sealStat.Size() != logCnt*commitLogSealSize {
+		coordLog.Infof("topic %v commit log seal size %v fixed to %v", path, sealStat.Size(), logCnt*commitLogSealSize)
+		err = f.Truncate(logCnt * commitLogSealSize)
+	}
+	if err != nil {
+		f.Close()
+		coordLog.Errorf("fix topic %v commit log seal file error: %v", path, err)
+		return err
+	}
+	self.sealAppender = f
+	if self.bufSize > 0 {
+		if self.bufSealAppender == nil {
+			self.bufSealAppender = bufio.NewWriterSize(self.sealAppender, self.bufSize*64)
+		} else {
+			self.bufSealAppender.Reset(self.sealAppender)
+		}
+	}
+	return nil
+}
+
+func (self *TopicCommitLogMgr) getSealAppenderForWrite() io.Writer {
+	if self.bufSize > 0 && self.bufSealAppender != nil {
+		return self.bufSealAppender
+	}
+	return self.sealAppender
+}
+
+func (self *TopicCommitLogMgr) flushSealNoLock() error {
+	if self.sealAppender == nil || self.bufSealAppender == nil {
+		return nil
+	}
+	return self.bufSealAppender.Flush()
+}
+
+func (self *TopicCommitLogMgr) writeLogData(l *CommitLogData) error {
+	if self.sealAppender == nil {
+		return binary.Write(self.getAppenderForWrite(), binary.BigEndian, *l)
+	}
+	var b bytes.Buffer
+	err := binary.Write(&b, binary.BigEndian, *l)
+	if err != nil {
+		return err
+	}
+	data := b.Bytes()
+	seal, err := sealCommitLogData(nsqd.GetEncryptKeyring(), data)
+	if err != nil {
+		return err
+	}
+	_, err = self.getSealAppenderForWrite().Write(seal)
+	if err != nil {
+		return err
+	}
+	w := self.getAppenderForWrite()
+	// the seal should be written before the log data, so the encrypted log data will
+	// never be read without the seal.
+	if bw, ok := w.(*bufio.Writer); !ok || bw.Available() < len(data) {
+		err = self.flushSealNoLock()
+		if err != nil {
+			return err
+		}
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func (self *TopicCommitLogMgr) closeAppenderNoLock(fsync bool) {
+	if self.sealAppender != nil {
+		if fsync {
+			self.sealAppender.Sync()
+		}
+		self.sealAppender.Close()
+	}
+	if fsync {
+		self.appender.Sync()
+	}
+	self.appender.Close()
+}
@@ -1,6 +1,9 @@
 package consistence
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
@@ -11,6 +14,7 @@ import (
 
 	"github.com/youzan/nsq/internal/levellogger"
 	"github.com/youzan/nsq/internal/test"
+	"github.com/youzan/nsq/nsqd"
 )
 
 func newTestLogger(tbl test.TbLog) levellogger.Logger {
@@ -1579,6 +1583,111 @@ func TestCommitLogMoveToAndDelete(t *testing.T) {
 
 }
 
+func TestCommitLogEncrypt(t *testing.T) {
+	oldRotate := LOGROTATE_NUM
+	LOGROTATE_NUM = 10
+	defer func() {
+		LOGROTATE_NUM = oldRotate
+	}()
+	logName := "test_log_encrypt" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	defer nsqd.SetEncryptKeyring(nil)
+	coordLog.Logger = newTestLogger(t)
+	coordLog.SetLevel(4)
+	logMgr, err := InitTopicCommitLogMgr(logName, 0, tmpDir, 4)
+	test.Nil(t, err)
+
+	appendLogs := func(start int, num int) {
+		for i := start; i < start+num; i++ {
+			var logData CommitLogData
+			logData.LogID = int64(logMgr.NextID())
+			logData.LastMsgLogID = logData.LogID
+			logData.Epoch = 1
+			logData.MsgOffset = int64(i * 10)
+			logData.MsgCnt = int64(i + 1)
+			logData.MsgNum = 1
+			err := logMgr.AppendCommitLog(&logData, false)
+			test.Nil(t, err)
+		}
+	}
+	checkLogs := func(num int) {
+		logs, err := logMgr.GetCommitLogsV2(0, 0, num+1)
+		test.Equal(t, ErrCommitLogEOF, err)
+		test.Equal(t, num, len(logs))
+		for i, l := range logs {
+			test.Equal(t, int64(i+1), l.MsgCnt)
+			test.Equal(t, int64(i*10), l.MsgOffset)
+		}
+	}
+	// the logs written before the encryption enabled should be readable
+	appendLogs(0, 5)
+	logMgr.Close()
+	kr, err := nsqd.ParseEncryptKeyring([]byte("1 "+base64.StdEncoding.EncodeToString(make([]byte, 32))), 0)
+	test.Nil(t, err)
+	nsqd.SetEncryptKeyring(kr)
+	logMgr, err = InitTopicCommitLogMgr(logName, 0, tmpDir, 4)
+	test.Nil(t, err)
+	appendLogs(5, 20)
+	checkLogs(25)
+	test.Equal(t, int64(2), logMgr.GetCurrentStart())
+	files := logMgr.GetClosedSegmentFiles(2)
+	test.Equal(t, 4, len(files))
+	test.Equal(t, getCommitLogSealFilename(getSegmentFilename(logMgr.path, 1)), files[3])
+
+	// the encrypted log on disk should not be the same as the plain
+	logMgr.FlushCommitLogs()
+	l, err := logMgr.GetCommitLogFromOffsetV2(2, 0)
+	test.Nil(t, err)
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, *l)
+	data, err := ioutil.ReadFile(logMgr.path)
+	test.Nil(t, err)
+	test.Equal(t, 5*GetLogDataSize(), len(data))
+	test.NotEqual(t, b.Bytes(), data[:GetLogDataSize()])
+	sealData, err := ioutil.ReadFile(getCommitLogSealFilename(logMgr.path))
+	test.Nil(t, err)
+	test.Equal(t, 5*commitLogSealSize, len(sealData))
+
+	_, err = logMgr.TruncateToOffsetV2(1, int64(3*GetLogDataSize()))
+	test.Nil(t, err)
+	checkLogs(13)
+	sealData, err = ioutil.ReadFile(getCommitLogSealFilename(logMgr.path))
+	test.Nil(t, err)
+	test.Equal(t, 3*commitLogSealSize, len(sealData))
+	logMgr.Close()
+	logMgr, err = InitTopicCommitLogMgr(logName, 0, tmpDir, 4)
+	test.Nil(t, err)
+	appendLogs(13, 2)
+	checkLogs(15)
+	logMgr.Close()
+
+	// the encrypted logs without the seal (the seals not synced before crash) should never be read as plain
+	err = os.Truncate(getCommitLogSealFilename(logMgr.path), 3*commitLogSealSize)
+	test.Nil(t, err)
+	logFile, err := os.Open(logMgr.path)
+	test.Nil(t, err)
+	sealFile, err := openCommitLogSeal(logMgr.path)
+	test.Nil(t, err)
+	_, err = readCommitLogAt(logFile, sealFile, make([]byte, 5*GetLogDataSize()), 0)
+	test.Equal(t, ErrCommitLogSealMissing, err)
+	logFile.Close()
+	sealFile.Close()
+	// the logs without the seal should be truncated while loading
+	logMgr, err = InitTopicCommitLogMgr(logName, 0, tmpDir, 4)
+	test.Nil(t, err)
+	checkLogs(13)
+	appendLogs(13, 2)
+	checkLogs(15)
+	logMgr.Close()
+
+	// the encrypted commit log can not be loaded without the keyring
+	nsqd.SetEncryptKeyring(nil)
+	_, err = InitTopicCommitLogMgr(logName, 0, tmpDir, 4)
+	test.Equal(t, nsqd.ErrEncryptKeyringNotLoaded, err)
+}
+
 func BenchmarkCommitLogWrite64(b *testing.B) {
 	benchmarkCommitLogWriteWithSyncN(b, false, 64)
 }
@@ -173,6 +173,8 @@ var (
 	ErrTopicISRNotEnough                  = NewCoordErrWithCode("topic isr nodes not enough", CoordTmpErr, RpcCommonErr)
 	ErrClusterChanged                     = NewCoordErrWithCode("cluster changed ", CoordTmpErr, RpcNoErr)
 	ErrTopicMissingDelayedLog             = NewCoordErrWithCode("topic missing delayed queue log", CoordLocalErr, RpcNoErr)
+	ErrTopicPartitionShrinking            = NewCoordErrWithCode("topic partition is not writable while shrinking", CoordClusterNoRetryWriteErr, RpcNoErr)
+	ErrTopicMirrorReadOnly                = NewCoordErrWithCode("topic is read only while mirroring from remote cluster", CoordClusterNoRetryWriteErr, RpcNoErr)
 
 	ErrRpcMethodUnknown           = NewCoordErrWithCode("rpc method unknown", CoordClusterErr, RpcCommonErr)
 	ErrPubArgError                = NewCoordErr("pub argument error", CoordCommonErr)
@@ -181,6 +183,8 @@ var (
 	ErrTopicArgError              = NewCoordErr("topic argument error", CoordCommonErr)
 	ErrOperationExpired           = NewCoordErr("operation has expired since wait too long", CoordCommonErr)
 	ErrCatchupRunningBusy         = NewCoordErr("too much running catchup", CoordCommonErr)
+	ErrEncryptKeyringMismatch     = NewCoordErr("encryption keys of the leader are missing", CoordCommonErr)
+	ErrZstdDictMismatch           = NewCoordErr("zstd dictionaries of the leader are missing", CoordCommonErr)
 
 	ErrMissingTopicLog                     = NewCoordErr("missing topic log ", CoordLocalErr)
 	ErrLocalTopicPartitionMismatch         = NewCoordErr("local topic partition not match", CoordLocalErr)
@@ -196,6 +200,7 @@ var (
 	ErrLocalChannelSkipFailed              = NewCoordErr("local channel skip/unskip failed", CoordLocalErr)
 	ErrLocalChannelSkipZanTestFailed       = NewCoordErr("local channel skip/unskip zan test failed", CoordLocalErr)
 	ErrLocalDelayedQueueMissing            = NewCoordErr("local delayed queue is missing", CoordLocalErr)
+	ErrLocalWriteSkipped                   = NewCoordErr("local write skipped since the message is duplicated", CoordLocalErr)
 )
 
 func GenNsqdNodeID(n *NsqdNodeInfo, extra string) string {
@@ -0,0 +1,415 @@
+package consistence
+
+import (
+	"errors"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	ErrConsumerGroupNotFound       = errors.New("consumer group not found")
+	ErrConsumerGroupMemberNotFound = errors.New("consumer group member not found, need rejoin")
+	ErrConsumerGroupNotOwner       = errors.New("the partition is not owned by the consumer in current generation")
+)
+
+var defaultGroupSessionTimeout = time.Second * 30
+
+type ConsumerGroupMemberInfo struct {
+	ID            string `json:"id"`
+	Hostname      string `json:"hostname"`
+	Partitions    []int  `json:"partitions"`
+	LastHeartbeat int64  `json:"last_heartbeat"`
+}
+
+type ConsumerGroupInfo struct {
+	Topic        string                    `json:"topic"`
+	Channel      string                    `json:"channel"`
+	Generation   int64                     `json:"generation"`
+	PartitionNum int                       `json:"partition_num"`
+	Members      []ConsumerGroupMemberInfo `json:"members"`
+}
+
+// ConsumerGroupAssignment is the partitions assigned to the member in the generation.
+// The member should stop consuming the partitions not assigned any more while the generation changed,
+// and subscribe the new assigned partitions with the new generation.
+type ConsumerGroupAssignment struct {
+	MemberID   string `json:"member_id"`
+	Generation int64  `json:"generation"`
+	Partitions []int  `json:"partitions"`
+}
+
+type groupMember struct {
+	id            string
+	hostname      string
+	lastHeartbeat time.Time
+}
+
+type consumerGroup struct {
+	topic        string
+	channel      string
+	generation   int64
+	partitionNum int
+	members      map[string]*groupMember
+	// partition -> member id
+	owners []string
+}
+
+// rebalance assign the partitions to the sorted members in round-robin, the generation
+// will be increased so the consumers can be fenced by the generation.
+func (g *consumerGroup) rebalance() {
+	g.generation++
+	ids := make([]string, 0, len(g.members))
+	for id := range g.members {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	g.owners = make([]string, g.partitionNum)
+	if len(ids) == 0 {
+		return
+	}
+	for pid := 0; pid < g.partitionNum; pid++ {
+		g.owners[pid] = ids[pid%len(ids)]
+	}
+}
+
+func (g *consumerGroup) assignedPartitions(memberID string) []int {
+	parts := make([]int, 0)
+	for pid, owner := range g.owners {
+		if owner == memberID {
+			parts = append(parts, pid)
+		}
+	}
+	return parts
+}
+
+func (g *consumerGroup) clone() *consumerGroup {
+	c := *g
+	c.members = make(map[string]*groupMember, len(g.members))
+	for id, m := range g.members {
+		cm := *m
+		c.members[id] = &cm
+	}
+	c.owners = append([]string(nil), g.owners...)
+	return &c
+}
+
+func (g *consumerGroup) info() ConsumerGroupInfo {
+	info := ConsumerGroupInfo{
+		Topic:        g.topic,
+		Channel:      g.channel,
+		Generation:   g.generation,
+		PartitionNum: g.partitionNum,
+		Members:      make([]ConsumerGroupMemberInfo, 0, len(g.members)),
+	}
+	for _, m := range g.members {
+		info.Members = append(info.Members, ConsumerGroupMemberInfo{
+			ID:            m.id,
+			Hostname:      m.hostname,
+			Partitions:    g.assignedPartitions(m.id),
+			LastHeartbeat: m.lastHeartbeat.Unix(),
+		})
+	}
+	sort.Slice(info.Members, func(i, j int) bool {
+		return info.Members[i].ID < info.Members[j].ID
+	})
+	return info
+}
+
+// restore the group from the saved info, the heartbeat of the members will be
+// renewed so they have a whole session to heartbeat to the new leader.
+func newConsumerGroupFromInfo(info ConsumerGroupInfo, now time.Time) *consumerGroup {
+	g := &consumerGroup{
+		topic:        info.Topic,
+		channel:      info.Channel,
+		generation:   info.Generation,
+		partitionNum: info.PartitionNum,
+		members:      make(map[string]*groupMember, len(info.Members)),
+		owners:       make([]string, info.PartitionNum),
+	}
+	for _, m := range info.Members {
+		g.members[m.ID] = &groupMember{
+			id:            m.ID,
+			hostname:      m.Hostname,
+			lastHeartbeat: now,
+		}
+		for _, pid := range m.Partitions {
+			if pid >= 0 && pid < len(g.owners) {
+				g.owners[pid] = m.ID
+			}
+		}
+	}
+	return g
+}
+
+func (g *consumerGroup) assignment(memberID string) ConsumerGroupAssignment {
+	return ConsumerGroupAssignment{
+		MemberID:   memberID,
+		Generation: g.generation,
+		Partitions: g.assignedPartitions(memberID),
+	}
+}
+
+// remove the members without heartbeat in session timeout, return true if any member removed.
+func (g *consumerGroup) expireMembers(now time.Time, timeout time.Duration) bool {
+	changed := false
+	for id, m := range g.members {
+		if now.Sub(m.lastHeartbeat) > timeout {
+			coordLog.Infof("consumer group %v-%v member %v expired", g.topic, g.channel, id)
+			delete(g.members, id)
+			changed = true
+		}
+	}
+	return changed
+}
+
+// consumerGroupStore is used to save the consumer groups, so the generation and the assignment
+// can be kept after the nsqlookupd leader changed.
+type consumerGroupStore interface {
+	GetAllConsumerGroups() ([]ConsumerGroupInfo, error)
+	UpdateConsumerGroup(group *ConsumerGroupInfo) error
+	DeleteConsumerGroup(topic string, channel string) error
+}
+
+// consumerGroupMgr coordinate the membership of the consumer groups for the topic channel on the
+// nsqlookupd leader. The group is saved to the store before any change of the members or the
+// assignment is visible, and will be loaded from the store after the leader changed.
+type consumerGroupMgr struct {
+	sync.Mutex
+	groups         map[string]*consumerGroup
+	sessionTimeout time.Duration
+	store          consumerGroupStore
+	loaded         bool
+}
+
+func newConsumerGroupMgr(sessionTimeout time.Duration, store consumerGroupStore) *consumerGroupMgr {
+	return &consumerGroupMgr{
+		groups:         make(map[string]*consumerGroup),
+		sessionTimeout: sessionTimeout,
+		store:          store,
+	}
+}
+
+func (mgr *consumerGroupMgr) setStore(store consumerGroupStore) {
+	mgr.Lock()
+	mgr.store = store
+	mgr.loaded = false
+	mgr.Unlock()
+}
+
+func getGroupKey(topic string, channel string) string {
+	return topic + ":" + channel
+}
+
+func genGroupMemberID(hostname string) string {
+	return hostname + "-" + strconv.FormatInt(time.Now().UnixNano(), 36) + "-" + strconv.Itoa(rand.Intn(10000))
+}
+
+func (mgr *consumerGroupMgr) loadNoLock(now time.Time) error {
+	if mgr.loaded {
+		return nil
+	}
+	groups := make(map[string]*consumerGroup)
+	if mgr.store != nil {
+		infos, err := mgr.store.GetAllConsumerGroups()
+		if err != nil {
+			coordLog.Warningf("failed to load consumer groups: %v", err)
+			return err
+		}
+		for _, info := range infos {
+			groups[getGroupKey(info.Topic, info.Channel)] = newConsumerGroupFromInfo(info, now)
+		}
+		coordLog.Infof("loaded consumer groups: %v", len(groups))
+	}
+	mgr.groups = groups
+	mgr.loaded = true
+	return nil
+}
+
+// commit the changed group to the store, the group will be deleted if no members.
+// The old group will be restored if failed, and nil old means the group is new.
+func (mgr *consumerGroupMgr) commitNoLock(g *consumerGroup, old *consumerGroup) error {
+	key := getGroupKey(g.topic, g.channel)
+	var err error
+	if mgr.store != nil {
+		if len(g.members) == 0 {
+			err = mgr.store.DeleteConsumerGroup(g.topic, g.channel)
+		} else {
+			info := g.info()
+			err = mgr.store.UpdateConsumerGroup(&info)
+		}
+	}
+	if err != nil {
+		coordLog.Warningf("failed to save consumer group %v: %v", key, err)
+		if old == nil {
+			delete(mgr.groups, key)
+		} else {
+			mgr.groups[key] = old
+		}
+		return err
+	}
+	if len(g.members) == 0 {
+		delete(mgr.groups, key)
+	} else {
+		mgr.groups[key] = g
+	}
+	return nil
+}
+
+// get the group and remove the expired members, the group will be rebalanced if the
+// members or the partition number changed. Nil will be returned if the group not exist.
+func (mgr *consumerGroupMgr) getGroupNoLock(topic string, channel string, partitionNum int, now time.Time) (*consumerGroup, error) {
+	if err := mgr.loadNoLock(now); err != nil {
+		return nil, err
+	}
+	g, ok := mgr.groups[getGroupKey(topic, channel)]
+	if !ok {
+		return nil, nil
+	}
+	g = g.clone()
+	changed := g.expireMembers(now, mgr.sessionTimeout)
+	if partitionNum > 0 && partitionNum != g.partitionNum {
+		coordLog.Infof("consumer group %v-%v partition changed from %v to %v", topic, channel, g.partitionNum, partitionNum)
+		g.partitionNum = partitionNum
+		changed = true
+	}
+	if !changed {
+		// keep the heartbeat updated in place
+		return mgr.groups[getGroupKey(topic, channel)], nil
+	}
+	g.rebalance()
+	err := mgr.commitNoLock(g, mgr.groups[getGroupKey(topic, channel)])
+	if err != nil {
+		return nil, err
+	}
+	if len(g.members) == 0 {
+		return nil, nil
+	}
+	return g, nil
+}
+
+func (mgr *consumerGroupMgr) join(topic string, channel string, partitionNum int,
+	memberID string, hostname string) (ConsumerGroupAssignment, error) {
+	mgr.Lock()
+	defer mgr.Unlock()
+	now := time.Now()
+	old, err := mgr.getGroupNoLock(topic, channel, partitionNum, now)
+	if err != nil {
+		return ConsumerGroupAssignment{}, err
+	}
+	var g *consumerGroup
+	if old == nil {
+		g = &consumerGroup{
+			topic:        topic,
+			channel:      channel,
+			partitionNum: partitionNum,
+			members:      make(map[string]*groupMember),
+		}
+	} else {
+		if m, ok := old.members[memberID]; ok {
+			// rejoin from the same member will not trigger rebalance
+			m.lastHeartbeat = now
+			return old.assignment(memberID), nil
+		}
+		g = old.clone()
+	}
+	if memberID == "" {
+		memberID = genGroupMemberID(hostname)
+	}
+	g.members[memberID] = &groupMember{
+		id:            memberID,
+		hostname:      hostname,
+		lastHeartbeat: now,
+	}
+	g.rebalance()
+	err = mgr.commitNoLock(g, old)
+	if err != nil {
+		return ConsumerGroupAssignment{}, err
+	}
+	coordLog.Infof("consumer group %v-%v member %v joined, generation: %v", topic, channel, memberID, g.generation)
+	return g.assignment(memberID), nil
+}
+
+func (mgr *consumerGroupMgr) heartbeat(topic string, channel string, partitionNum int,
+	memberID string) (ConsumerGroupAssignment, error) {
+	mgr.Lock()
+	defer mgr.Unlock()
+	now := time.Now()
+	g, err := mgr.getGroupNoLock(topic, channel, partitionNum, now)
+	if err != nil {
+		return ConsumerGroupAssignment{}, err
+	}
+	if g == nil {
+		return ConsumerGroupAssignment{}, ErrConsumerGroupMemberNotFound
+	}
+	m, ok := g.members[memberID]
+	if !ok {
+		return ConsumerGroupAssignment{}, ErrConsumerGroupMemberNotFound
+	}
+	m.lastHeartbeat = now
+	return g.assignment(memberID), nil
+}
+
+func (mgr *consumerGroupMgr) leave(topic string, channel string, memberID string) error {
+	mgr.Lock()
+	defer mgr.Unlock()
+	old, err := mgr.getGroupNoLock(topic, channel, 0, time.Now())
+	if err != nil {
+		return err
+	}
+	if old == nil {
+		return ErrConsumerGroupMemberNotFound
+	}
+	if _, ok := old.members[memberID]; !ok {
+		return ErrConsumerGroupMemberNotFound
+	}
+	g := old.clone()
+	delete(g.members, memberID)
+	g.rebalance()
+	err = mgr.commitNoLock(g, old)
+	if err != nil {
+		return err
+	}
+	coordLog.Infof("consumer group %v-%v member %v left", topic, channel, memberID)
+	return nil
+}
+
+// getPartitionOwner return the member id owned the partition and the current generation.
+func (mgr *consumerGroupMgr) getPartitionOwner(topic string, channel string, partition int) (string, int64, error) {
+	mgr.Lock()
+	defer mgr.Unlock()
+	g, err := mgr.getGroupNoLock(topic, channel, 0, time.Now())
+	if err != nil {
+		return "", 0, err
+	}
+	if g == nil {
+		return "", 0, ErrConsumerGroupNotFound
+	}
+	if partition < 0 || partition >= len(g.owners) {
+		return "", g.generation, nil
+	}
+	return g.owners[partition], g.generation, nil
+}
+
+func (mgr *consumerGroupMgr) getGroupInfo(topic string, channel string) (ConsumerGroupInfo, error) {
+	mgr.Lock()
+	defer mgr.Unlock()
+	g, err := mgr.getGroupNoLock(topic, channel, 0, time.Now())
+	if err != nil {
+		return ConsumerGroupInfo{}, err
+	}
+	if g == nil {
+		return ConsumerGroupInfo{}, ErrConsumerGroupNotFound
+	}
+	return g.info(), nil
+}
+
+// reset clear the groups in memory, the groups will be loaded from the store while used again.
+func (mgr *consumerGroupMgr) reset() {
+	mgr.Lock()
+	mgr.groups = make(map[string]*consumerGroup)
+	mgr.loaded = false
+	mgr.Unlock()
+}
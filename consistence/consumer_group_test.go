@@ -0,0 +1,176 @@
+package consistence
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/youzan/nsq/internal/test"
+)
+
+func TestConsumerGroupRebalance(t *testing.T) {
+	mgr := newConsumerGroupMgr(time.Second, nil)
+	a1, err := mgr.join("test-group", "ch", 4, "m1", "host1")
+	test.Nil(t, err)
+	test.Equal(t, "m1", a1.MemberID)
+	test.Equal(t, int64(1), a1.Generation)
+	test.Equal(t, []int{0, 1, 2, 3}, a1.Partitions)
+
+	a2, err := mgr.join("test-group", "ch", 4, "m2", "host2")
+	test.Nil(t, err)
+	test.Equal(t, int64(2), a2.Generation)
+	test.Equal(t, []int{1, 3}, a2.Partitions)
+	// rejoin from the same member should not change the generation
+	a1, err = mgr.join("test-group", "ch", 4, "m1", "host1")
+	test.Nil(t, err)
+	test.Equal(t, int64(2), a1.Generation)
+	test.Equal(t, []int{0, 2}, a1.Partitions)
+
+	owner, gen, err := mgr.getPartitionOwner("test-group", "ch", 3)
+	test.Nil(t, err)
+	test.Equal(t, "m2", owner)
+	test.Equal(t, int64(2), gen)
+	_, _, err = mgr.getPartitionOwner("test-group", "ch2", 3)
+	test.Equal(t, ErrConsumerGroupNotFound, err)
+
+	// the partition number changed
+	a2, err = mgr.heartbeat("test-group", "ch", 6, "m2")
+	test.Nil(t, err)
+	test.Equal(t, int64(3), a2.Generation)
+	test.Equal(t, []int{1, 3, 5}, a2.Partitions)
+
+	// generated member id
+	a3, err := mgr.join("test-group", "ch", 6, "", "host3")
+	test.Nil(t, err)
+	test.NotEqual(t, "", a3.MemberID)
+	test.Equal(t, int64(4), a3.Generation)
+	test.Equal(t, 2, len(a3.Partitions))
+	info, err := mgr.getGroupInfo("test-group", "ch")
+	test.Nil(t, err)
+	test.Equal(t, 3, len(info.Members))
+	test.Equal(t, 6, info.PartitionNum)
+
+	err = mgr.leave("test-group", "ch", a3.MemberID)
+	test.Nil(t, err)
+	a1, err = mgr.heartbeat("test-group", "ch", 6, "m1")
+	test.Nil(t, err)
+	test.Equal(t, int64(5), a1.Generation)
+	test.Equal(t, []int{0, 2, 4}, a1.Partitions)
+	err = mgr.leave("test-group", "ch", a3.MemberID)
+	test.Equal(t, ErrConsumerGroupMemberNotFound, err)
+}
+
+func TestConsumerGroupMemberExpire(t *testing.T) {
+	mgr := newConsumerGroupMgr(time.Millisecond*100, nil)
+	mgr.join("test-group", "ch", 2, "m1", "host1")
+	mgr.join("test-group", "ch", 2, "m2", "host2")
+	time.Sleep(time.Millisecond * 60)
+	_, err := mgr.heartbeat("test-group", "ch", 2, "m1")
+	test.Nil(t, err)
+	time.Sleep(time.Millisecond * 60)
+	a1, err := mgr.heartbeat("test-group", "ch", 2, "m1")
+	test.Nil(t, err)
+	test.Equal(t, int64(3), a1.Generation)
+	test.Equal(t, []int{0, 1}, a1.Partitions)
+	_, err = mgr.heartbeat("test-group", "ch", 2, "m2")
+	test.Equal(t, ErrConsumerGroupMemberNotFound, err)
+
+	// the group is removed after all the members expired
+	time.Sleep(time.Millisecond * 150)
+	_, err = mgr.getGroupInfo("test-group", "ch")
+	test.Equal(t, ErrConsumerGroupNotFound, err)
+}
+
+type failedConsumerGroupStore struct {
+	consumerGroupStore
+}
+
+func (s *failedConsumerGroupStore) UpdateConsumerGroup(group *ConsumerGroupInfo) error {
+	return errors.New("update failed")
+}
+
+func TestConsumerGroupLoadFromStore(t *testing.T) {
+	store := NewFakeNsqlookupLeadership()
+	mgr := newConsumerGroupMgr(time.Second, store)
+	_, err := mgr.join("test-group", "ch", 4, "m1", "host1")
+	test.Nil(t, err)
+	a2, err := mgr.join("test-group", "ch", 4, "m2", "host2")
+	test.Nil(t, err)
+
+	// the new leader should continue with the saved generation and assignment
+	newMgr := newConsumerGroupMgr(time.Second, store)
+	owner, gen, err := newMgr.getPartitionOwner("test-group", "ch", 1)
+	test.Nil(t, err)
+	test.Equal(t, "m2", owner)
+	test.Equal(t, a2.Generation, gen)
+	a2, err = newMgr.heartbeat("test-group", "ch", 4, "m2")
+	test.Nil(t, err)
+	test.Equal(t, gen, a2.Generation)
+	test.Equal(t, []int{1, 3}, a2.Partitions)
+
+	// the change should not be visible if failed to save
+	newMgr.store = &failedConsumerGroupStore{consumerGroupStore: store}
+	_, err = newMgr.join("test-group", "ch", 4, "m3", "host3")
+	test.NotNil(t, err)
+	info, err := newMgr.getGroupInfo("test-group", "ch")
+	test.Nil(t, err)
+	test.Equal(t, gen, info.Generation)
+	test.Equal(t, 2, len(info.Members))
+
+	// the group is deleted from the store after all the members left
+	newMgr.store = store
+	test.Nil(t, newMgr.leave("test-group", "ch", "m1"))
+	test.Nil(t, newMgr.leave("test-group", "ch", "m2"))
+	groups, err := store.GetAllConsumerGroups()
+	test.Nil(t, err)
+	test.Equal(t, 0, len(groups))
+}
+
+func TestNsqdCoordCheckConsumerGroupOwner(t *testing.T) {
+	fakeLookupProxy, _ := NewFakeLookupRemoteProxy("127.0.0.1", 0)
+	nsqdCoord := NewNsqdCoordinator("test-cluster", "127.0.0.1", "0", "0", "0", "", "", nil)
+	nsqdCoord.lookupRemoteCreateFunc = func(addr string, to time.Duration) (INsqlookupRemoteProxy, error) {
+		return fakeLookupProxy, nil
+	}
+	nsqdCoord.lookupLeader = NsqLookupdNodeInfo{NodeIP: "127.0.0.1", RpcPort: "0"}
+
+	// no group, only allow the consumer without member
+	test.Nil(t, nsqdCoord.CheckConsumerGroupOwner("test-group", 0, "ch", "", 0))
+	test.Equal(t, ErrConsumerGroupNotFound, nsqdCoord.CheckConsumerGroupOwner("test-group", 0, "ch", "m1", 1))
+
+	groupMgr := fakeLookupProxy.(*fakeLookupRemoteProxy).groupMgr
+	groupMgr.join("test-group", "ch", 2, "m1", "host1")
+	test.Nil(t, nsqdCoord.CheckConsumerGroupOwner("test-group", 0, "ch", "m1", 1))
+	test.Equal(t, ErrConsumerGroupNotOwner, nsqdCoord.CheckConsumerGroupOwner("test-group", 0, "ch", "", 0))
+	a2, _ := groupMgr.join("test-group", "ch", 2, "m2", "host2")
+	test.Equal(t, []int{1}, a2.Partitions)
+	// the old generation should be rejected
+	test.Equal(t, ErrConsumerGroupNotOwner, nsqdCoord.CheckConsumerGroupOwner("test-group", 1, "ch", "m1", 1))
+	test.Equal(t, ErrConsumerGroupNotOwner, nsqdCoord.CheckConsumerGroupOwner("test-group", 0, "ch", "m1", 1))
+	test.Nil(t, nsqdCoord.CheckConsumerGroupOwner("test-group", 0, "ch", "m1", a2.Generation))
+	test.Nil(t, nsqdCoord.CheckConsumerGroupOwner("test-group", 1, "ch", "m2", a2.Generation))
+	test.Equal(t, ErrConsumerGroupNotOwner, nsqdCoord.CheckConsumerGroupOwner("test-group", 1, "ch", "m1", a2.Generation))
+
+	// the subscribed old owner should be fenced by the cached owner after the new owner checked
+	a3, _ := groupMgr.join("test-group", "ch", 2, "m3", "host3")
+	test.Equal(t, ErrConsumerGroupNotOwner, nsqdCoord.CheckConsumerGroupOwner("test-group", 1, "ch", "m2", a2.Generation))
+	test.Equal(t, ErrConsumerGroupNotOwner, nsqdCoord.CheckConsumerGroupOwnerCached("test-group", 1, "ch", "m2", a2.Generation))
+	owner, _, _ := groupMgr.getPartitionOwner("test-group", "ch", 1)
+	test.Nil(t, nsqdCoord.CheckConsumerGroupOwnerCached("test-group", 1, "ch", owner, a3.Generation))
+
+	// the cached owners should be removed after the channel or topic removed
+	cached := func(part int, ch string) bool {
+		_, ok := nsqdCoord.groupOwners.Load(getTopicPartitionChannelKey("test-group", part, ch))
+		return ok
+	}
+	nsqdCoord.CheckConsumerGroupOwner("test-group", 1, "ch2", "", 0)
+	test.Equal(t, true, cached(0, "ch"))
+	test.Equal(t, true, cached(1, "ch"))
+	test.Equal(t, true, cached(1, "ch2"))
+	nsqdCoord.ForgetConsumerGroupOwner("test-group", 1, "ch")
+	test.Equal(t, false, cached(1, "ch"))
+	test.Equal(t, true, cached(1, "ch2"))
+	nsqdCoord.forgetTopicGroupOwners("test-group", 1)
+	test.Equal(t, false, cached(1, "ch2"))
+	test.Equal(t, true, cached(0, "ch"))
+}
@@ -602,13 +602,22 @@ func (self *NsqdCoordRpcServer) GetTopicStats(topic string) *NodeTopicStats {
 		if ts.IsLeader || coordData.GetLeader() == self.nsqdCoord.myNode.GetID() {
 			stat.TopicLeaderDataSize[ts.TopicFullName] += (ts.BackendDepth-ts.BackendStart)/1024/1024 + 1
 			chList := stat.ChannelList[ts.TopicFullName]
+			pending := int64(ts.DelayedPubCount)
 			for _, chStat := range ts.Channels {
 				if protocol.IsEphemeral(chStat.ChannelName) {
 					continue
 				}
 				stat.ChannelDepthData[ts.TopicFullName] += chStat.DepthSize/1024/1024 + 1
 				chList = append(chList, chStat.ChannelName)
+				if chStat.Skipped {
+					continue
+				}
+				pending += chStat.Depth + int64(chStat.DelayedQueueCount)
+				if ts.MessageCount > chStat.MessageCount {
+					pending += int64(ts.MessageCount - chStat.MessageCount)
+				}
 			}
+			stat.PendingMsgCnt[ts.TopicFullName] = pending
 			stat.ChannelList[ts.TopicFullName] = chList
 			stat.ChannelMetas[ts.TopicFullName] = localTopic.GetChannelMeta()
 			stat.ChannelNum[ts.TopicFullName] = len(chList)
@@ -666,6 +675,13 @@ type RpcChannelState struct {
 	ZanTestSkipped int
 }
 
+type RpcChannelDeadLetter struct {
+	RpcTopicData
+	Channel         string
+	MaxAttempts     uint16
+	DeadLetterTopic string
+}
+
 type RpcChannelOffsetArg struct {
 	RpcTopicData
 	Channel string
@@ -812,6 +828,22 @@ func (self *NsqdCoordRpcServer) UpdateChannelState(state *RpcChannelState) *Coor
 	return &ret
 }
 
+func (self *NsqdCoordRpcServer) UpdateChannelDeadLetter(state *RpcChannelDeadLetter) *CoordErr {
+	var ret CoordErr
+	defer coordErrStats.incCoordErr(&ret)
+	tc, err := self.nsqdCoord.checkWriteForRpcCall(state.RpcTopicData)
+	if err != nil {
+		ret = *err
+		return &ret
+	}
+	err = self.nsqdCoord.updateChannelDeadLetterOnSlave(tc.GetData(), state.Channel, state.MaxAttempts, state.DeadLetterTopic)
+	if err != nil {
+		ret = *err
+		return &ret
+	}
+	return &ret
+}
+
 func (self *NsqdCoordRpcServer) UpdateChannelOffset(info *RpcChannelOffsetArg) *CoordErr {
 	var ret CoordErr
 	defer coordErrStats.incCoordErr(&ret)
@@ -989,6 +1021,18 @@ func (self *NsqdCoordRpcServer) GetLastCommitLogID(req *RpcCommitLogReq) (int64,
 	return ret, nil
 }
 
+// GetEncryptKeyFingerprint return the fingerprint of the encryption keyring on this node, the
+// node joining the isr should have the same keys as the leader.
+func (self *NsqdCoordRpcServer) GetEncryptKeyFingerprint(req string) (string, error) {
+	return nsqd.GetEncryptKeyring().KeyFingerprint(), nil
+}
+
+// GetZstdDictFingerprint return the fingerprint of the zstd dictionaries on this node, the
+// node joining the isr should have all the dictionaries of the leader.
+func (self *NsqdCoordRpcServer) GetZstdDictFingerprint(req string) (string, error) {
+	return nsqd.GetZstdDicts().DictFingerprint(), nil
+}
+
 func (self *NsqdCoordRpcServer) GetLastDelayedQueueCommitLogID(req *RpcCommitLogReq) (int64, error) {
 	var ret int64
 	tc, err := self.nsqdCoord.getTopicCoordData(req.TopicName, req.TopicPartition)
@@ -1212,6 +1256,9 @@ func (self *NsqdCoordRpcServer) GetBackupedDelayedQueue(req *RpcGetBackupedDQReq
 		nsqd.NsqLogger().Logf("failed to backup delayed queue for topic %v: %v", topicName, err)
 		return &ret, err
 	}
+	// the rpc is only used if the leader has no http port (the test nodes), the whole backup
+	// is sent in one response so it can not be throttled. The replicas pull the backup by
+	// the http api which streams it under the catchup rate limits.
 	ret.Buffer = buf.Bytes()
 	return &ret, nil
 }
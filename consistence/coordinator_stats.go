@@ -139,10 +139,22 @@ type TopicCoordStat struct {
 	Partition    int           `json:"partition"`
 	ISRStats     []ISRStat     `json:"isr_stats"`
 	CatchupStats []CatchupStat `json:"catchup_stats"`
+	// only the leader of the mirror topic has the mirror stat
+	MirrorStat *TopicMirrorStat `json:"mirror_stat,omitempty"`
+	// the bytes per second of the catchup data sent to the replicas
+	CatchupRate int64 `json:"catchup_rate"`
+}
+
+type CatchupThrottleStat struct {
+	RateLimit      int64 `json:"rate_limit"`
+	TopicRateLimit int64 `json:"topic_rate_limit"`
+	CurrentRate    int64 `json:"current_rate"`
+	WaitedMs       int64 `json:"waited_ms"`
 }
 
 type CoordStats struct {
 	RpcStats        *gorpc.ConnStats `json:"rpc_stats"`
 	ErrStats        CoordErrStatsData
-	TopicCoordStats []TopicCoordStat `json:"topic_coord_stats"`
+	CatchupThrottle *CatchupThrottleStat `json:"catchup_throttle"`
+	TopicCoordStats []TopicCoordStat     `json:"topic_coord_stats"`
 }
@@ -155,6 +155,8 @@ type NodeTopicStats struct {
 	ChannelList            map[string][]string
 	ChannelMetas           map[string][]nsqd.ChannelMetaInfo
 	ChannelOffsets         map[string][]WrapChannelConsumerOffset
+	// the messages count not consumed by all the channels (include the delayed) on the leader.
+	PendingMsgCnt map[string]int64
 }
 
 func getNodeNameList(nodes []NodeTopicStats) []string {
@@ -184,6 +186,7 @@ func NewNodeTopicStats(nid string, cap int, cpus int) *NodeTopicStats {
 		ChannelList:            make(map[string][]string),
 		ChannelMetas:           make(map[string][]nsqd.ChannelMetaInfo),
 		ChannelOffsets:         make(map[string][]WrapChannelConsumerOffset),
+		PendingMsgCnt:          make(map[string]int64, cap),
 		NodeCPUs:               cpus,
 	}
 }
@@ -643,6 +646,9 @@ func (dpm *DataPlacement) DoBalance(monitorChan chan struct{}) {
 			if moved {
 				continue
 			}
+			if dpm.rebalanceTopicZones(monitorChan) {
+				continue
+			}
 
 			currentNodes := dpm.lookupCoord.getCurrentNodes()
 			nodeTopicStats = dpm.getLeaderSortedNodeTopicStats(currentNodes, nodeTopicStats)
@@ -1067,7 +1073,7 @@ func (dpm *DataPlacement) tryMoveTopicPartition(monitorChan chan struct{}, srcNo
 			// just notify to allow restart and wait ready
 			dpm.lookupCoord.notifyCatchupTopicMetaInfo(topicInfo)
 		} else {
-			excludeNodes, commonErr := dpm.getExcludeNodesForTopic(topicInfo, true)
+			excludeNodes, commonErr := dpm.getExcludeNodesForTopic(topicInfo, true, currentNodes, fromNode)
 			if commonErr != nil {
 				return ErrLeadershipServerUnstable.ToErrorType()
 			}
@@ -1147,6 +1153,15 @@ func (dpm *DataPlacement) addToCatchupAndWaitISRReady(monitorChan chan struct{},
 		}
 	}
 	if tryAllNodes || len(addTryFirstNodes) == 0 {
+		// the nodes keeping the isr spread across zones are tried first
+		nz := newNodeZones(dpm.lookupCoord.getCurrentNodes())
+		remainISR := make([]string, 0, len(topicInfo.ISR))
+		for _, nid := range topicInfo.ISR {
+			if nid != fromNode {
+				remainISR = append(remainISR, nid)
+			}
+		}
+		unbalancedNodes := make([]string, 0)
 		for index, s := range sortedNodes {
 			if !tryAllNodes {
 				if index >= len(sortedNodes)-2 ||
@@ -1157,10 +1172,13 @@ func (dpm *DataPlacement) addToCatchupAndWaitISRReady(monitorChan chan struct{},
 			}
 			if FindSlice(topicInfo.ISR, s) != -1 {
 				// filter
+			} else if !nz.isBalancedToAdd(remainISR, s, topicInfo.Replica) {
+				unbalancedNodes = append(unbalancedNodes, s)
 			} else {
 				filteredNodes = append(filteredNodes, s)
 			}
 		}
+		filteredNodes = append(filteredNodes, unbalancedNodes...)
 	}
 	for {
 		if currentSelect >= len(filteredNodes) {
@@ -1192,7 +1210,7 @@ func (dpm *DataPlacement) addToCatchupAndWaitISRReadyForMultiPartTopic(monitorCh
 	partitionNodes, err := dpm.getRebalancedMultiTopicPartitionsFromNameList(
 		topicInfo.Name,
 		topicInfo.PartitionNum,
-		topicInfo.Replica, nodeNameList)
+		topicInfo.Replica, nodeNameList, newNodeZones(dpm.lookupCoord.getCurrentNodes()))
 	if err != nil {
 		return err
 	}
@@ -1260,7 +1278,10 @@ func (dpm *DataPlacement) getBalancedTopNTopicISR(topicInfo *TopicPartitionMetaI
 	return isr, nil
 }
 
-func (dpm *DataPlacement) getExcludeNodesForTopic(topicInfo *TopicPartitionMetaInfo, checkMulti bool) (map[string]struct{}, error) {
+// get the nodes which can not be used to add new replica for the topic partition, the removingNode is the
+// replica which will be removed after the new replica added.
+func (dpm *DataPlacement) getExcludeNodesForTopic(topicInfo *TopicPartitionMetaInfo, checkMulti bool,
+	currentNodes map[string]NsqdNodeInfo, removingNode string) (map[string]struct{}, error) {
 	excludeNodes := make(map[string]struct{})
 	excludeNodes[topicInfo.Leader] = struct{}{}
 	for _, v := range topicInfo.ISR {
@@ -1269,6 +1290,31 @@ func (dpm *DataPlacement) getExcludeNodesForTopic(topicInfo *TopicPartitionMetaI
 	for _, v := range topicInfo.CatchupList {
 		excludeNodes[v] = struct{}{}
 	}
+	// exclude the nodes which will make all the replicas in the same zone
+	nz := newNodeZones(currentNodes)
+	if nz.enabled() {
+		replicas := make([]string, 0, len(topicInfo.ISR)+len(topicInfo.CatchupList))
+		for _, v := range topicInfo.ISR {
+			if v != removingNode {
+				replicas = append(replicas, v)
+			}
+		}
+		for _, v := range topicInfo.CatchupList {
+			if v != removingNode && FindSlice(replicas, v) == -1 {
+				replicas = append(replicas, v)
+			}
+		}
+		for nid := range currentNodes {
+			if _, ok := excludeNodes[nid]; ok {
+				continue
+			}
+			if !nz.canAdd(replicas, nid, topicInfo.Replica) {
+				coordLog.Debugf("node %v excluded for topic %v since all replicas %v will be in the same zone",
+					nid, topicInfo.GetTopicDesp(), replicas)
+				excludeNodes[nid] = struct{}{}
+			}
+		}
+	}
 	// exclude other partition node with the same topic
 	meta, _, err := dpm.lookupCoord.leadership.GetTopicMetaInfo(topicInfo.Name)
 	if err != nil {
@@ -1339,8 +1385,9 @@ func (dpm *DataPlacement) allocNodeForTopic(topicInfo *TopicPartitionMetaInfo, c
 	// collect the nsqd data, check if any node has the topic data already.
 	var chosenNode NsqdNodeInfo
 	var chosenStat *NodeTopicStats
+	chosenBalanced := false
 
-	excludeNodes, commonErr := dpm.getExcludeNodesForTopic(topicInfo, topicInfo.AllowMulti())
+	excludeNodes, commonErr := dpm.getExcludeNodesForTopic(topicInfo, topicInfo.AllowMulti(), currentNodes, "")
 	if commonErr != nil {
 		return nil, commonErr
 	}
@@ -1353,6 +1400,11 @@ func (dpm *DataPlacement) allocNodeForTopic(topicInfo *TopicPartitionMetaInfo, c
 	if nid != "" {
 		chosenNode = currentNodes[nid]
 	} else {
+		// the node keeping the replicas spread across zones is preferred
+		nz := newNodeZones(currentNodes)
+		replicas := make([]string, 0, len(topicInfo.ISR)+len(topicInfo.CatchupList))
+		replicas = append(replicas, topicInfo.ISR...)
+		replicas = append(replicas, topicInfo.CatchupList...)
 		for nodeID, nodeInfo := range currentNodes {
 			if _, ok := excludeNodes[nodeID]; ok {
 				continue
@@ -1362,12 +1414,14 @@ func (dpm *DataPlacement) allocNodeForTopic(topicInfo *TopicPartitionMetaInfo, c
 				coordLog.Infof("failed to get topic status for this node: %v", nodeInfo)
 				continue
 			}
-			if chosenNode.ID == "" {
+			balanced := nz.isBalancedToAdd(replicas, nodeID, topicInfo.Replica)
+			if chosenNode.ID == "" || (balanced && !chosenBalanced) {
 				chosenNode = nodeInfo
 				chosenStat = topicStat
+				chosenBalanced = balanced
 				continue
 			}
-			if topicStat.SlaveLessLoader(chosenStat) {
+			if balanced == chosenBalanced && topicStat.SlaveLessLoader(chosenStat) {
 				chosenNode = nodeInfo
 				chosenStat = topicStat
 			}
@@ -1501,12 +1555,12 @@ func (dpm *DataPlacement) allocTopicLeaderAndISR(topicName string, multi bool, c
 		p++
 	}
 	p = 0
-	currentSelect = 0
 	slaveSort := func(l, r *NodeTopicStats) bool {
 		return l.SlaveLessLoader(r)
 	}
 	By(slaveSort).Sort(nodeTopicStats)
 
+	nz := newNodeZones(currentNodes)
 	isrlist := make([][]string, partitionNum)
 	for p < partitionNum {
 		isr := make([]string, 0, replica)
@@ -1516,31 +1570,39 @@ func (dpm *DataPlacement) allocTopicLeaderAndISR(topicName string, multi bool, c
 		} else if elem, ok := existPart[p]; ok {
 			isr = elem.ISR
 		} else {
-			for {
-				if currentSelect >= len(nodeTopicStats) {
-					coordLog.Infof("not enough nodes for slaves")
-					return nil, nil, ErrBalanceNodeUnavailable
-				}
-				nodeInfo := nodeTopicStats[currentSelect]
-				currentSelect++
-				if nodeInfo.NodeID == leaders[p] {
-					coordLog.Infof("ignore for leader node: %v", nodeInfo.NodeID)
-					continue
-				}
-				if _, ok := existSlaves[nodeInfo.NodeID]; ok {
-					coordLog.Infof("ignore for exist slave node: %v", nodeInfo.NodeID)
-					continue
+			for len(isr) < replica {
+				// choose the least loader node which keep the isr spread across zones,
+				// if no such node, choose the one not making all the isr in the same zone
+				chosen := ""
+				fallback := ""
+				for _, nodeInfo := range nodeTopicStats {
+					if nodeInfo.NodeID == leaders[p] {
+						continue
+					}
+					if _, ok := existSlaves[nodeInfo.NodeID]; ok {
+						continue
+					}
+					// TODO: should slave can be used for other leader?
+					if _, ok := existLeaders[nodeInfo.NodeID]; ok {
+						continue
+					}
+					if nz.isBalancedToAdd(isr, nodeInfo.NodeID, replica) {
+						chosen = nodeInfo.NodeID
+						break
+					}
+					if fallback == "" && nz.canAdd(isr, nodeInfo.NodeID, replica) {
+						fallback = nodeInfo.NodeID
+					}
 				}
-				// TODO: should slave can be used for other leader?
-				if _, ok := existLeaders[nodeInfo.NodeID]; ok {
-					coordLog.Infof("ignore for exist other leader(different partition) node: %v", nodeInfo.NodeID)
-					continue
+				if chosen == "" {
+					chosen = fallback
 				}
-				existSlaves[nodeInfo.NodeID] = struct{}{}
-				isr = append(isr, nodeInfo.NodeID)
-				if len(isr) >= replica {
-					break
+				if chosen == "" {
+					coordLog.Infof("not enough nodes for slaves, current isr: %v", isr)
+					return nil, nil, ErrBalanceNodeUnavailable
 				}
+				existSlaves[chosen] = struct{}{}
+				isr = append(isr, chosen)
 			}
 		}
 		isrlist[p] = isr
@@ -1608,6 +1670,12 @@ func (dpm *DataPlacement) prepareCandidateNodesForNewLeader(topicInfo *TopicPart
 func (dpm *DataPlacement) chooseNewLeaderFromISR(topicInfo *TopicPartitionMetaInfo, currentNodes map[string]NsqdNodeInfo) (string, int64, *CoordErr) {
 	newestReplicas, newestLogID := dpm.prepareCandidateNodesForNewLeader(topicInfo, currentNodes)
 	newLeader := ""
+	// the preferred leader is always chosen if it has the newest data
+	preferred := topicInfo.GetPreferredLeader()
+	if preferred != "" && FindSlice(newestReplicas, preferred) != -1 {
+		coordLog.Infof("topic %v new leader %v found with commit id: %v as the preferred leader", topicInfo.GetTopicDesp(), preferred, newestLogID)
+		return preferred, newestLogID, nil
+	}
 	if len(newestReplicas) == 1 {
 		newLeader = newestReplicas[0]
 		coordLog.Infof("topic %v new leader %v found with commit id: %v in only one candidate", topicInfo.GetTopicDesp(), newLeader, newestLogID)
@@ -1622,9 +1690,10 @@ func (dpm *DataPlacement) chooseNewLeaderFromISR(topicInfo *TopicPartitionMetaIn
 		} else {
 			// choose another leader in ISR list, and add new node to ISR
 			// list.
-			// select the least load factor node
+			// select the least load factor node in the zone with the least leaders of this topic
+			candidates := dpm.filterLeaderCandidatesByZone(topicInfo, currentNodes, newestReplicas)
 			minLF := float64(math.MaxInt64)
-			for _, replica := range newestReplicas {
+			for _, replica := range candidates {
 				stat, err := dpm.lookupCoord.getNsqdTopicStat(currentNodes[replica])
 				if err != nil {
 					coordLog.Infof("ignore node %v while choose new leader : %v", replica, topicInfo.GetTopicDesp())
@@ -1647,6 +1716,39 @@ func (dpm *DataPlacement) chooseNewLeaderFromISR(topicInfo *TopicPartitionMetaIn
 	return newLeader, newestLogID, nil
 }
 
+// filter the leader candidates to spread the leaders of the topic partitions across the zones.
+func (dpm *DataPlacement) filterLeaderCandidatesByZone(topicInfo *TopicPartitionMetaInfo,
+	currentNodes map[string]NsqdNodeInfo, candidates []string) []string {
+	nz := newNodeZones(currentNodes)
+	if !nz.enabled() || len(candidates) < 2 {
+		return candidates
+	}
+	zoneLeaders := make(map[string]int)
+	for i := 0; i < topicInfo.PartitionNum; i++ {
+		if i == topicInfo.Partition {
+			continue
+		}
+		tmpInfo, err := dpm.lookupCoord.leadership.GetTopicInfo(topicInfo.Name, i)
+		if err != nil {
+			continue
+		}
+		zoneLeaders[nz.getZone(tmpInfo.Leader)]++
+	}
+	minCnt := math.MaxInt32
+	filtered := make([]string, 0, len(candidates))
+	for _, nid := range candidates {
+		cnt := zoneLeaders[nz.getZone(nid)]
+		if cnt < minCnt {
+			minCnt = cnt
+			filtered = filtered[:0]
+		}
+		if cnt == minCnt {
+			filtered = append(filtered, nid)
+		}
+	}
+	return filtered
+}
+
 func (dpm *DataPlacement) chooseNewLeaderFromISRForTopN(topicInfo *TopicPartitionMetaInfo,
 	sortedTopics LFListT,
 	topicList []TopicPartitionMetaInfo,
@@ -2201,6 +2303,10 @@ func (dpm *DataPlacement) balanceTopicToExpectedISR(monitorChan chan struct{}, t
 	if len(expectedISR) == 0 {
 		return false, false, nil
 	}
+	if len(expectedISR) >= topicInfo.Replica && newNodeZones(dpm.lookupCoord.getCurrentNodes()).isSingleZone(expectedISR) {
+		coordLog.Infof("topic %v expected isr %v is in the same zone, ignore balance", topicInfo.GetTopicDesp(), expectedISR)
+		return false, false, nil
+	}
 	moveNodes := make([]string, 0)
 	for _, nid := range topicInfo.ISR {
 		found := false
@@ -2331,6 +2437,78 @@ func (dpm *DataPlacement) rebalanceMultiPartTopic(monitorChan chan struct{}) (bo
 	return moved, isAllBalanced
 }
 
+// move a replica of the topic partition to other zone if all the isr nodes are in the same zone,
+// this may happen if the zone labels changed or the nodes in other zones were not available
+// while allocating. Only one partition is moved once.
+func (dpm *DataPlacement) rebalanceTopicZones(monitorChan chan struct{}) bool {
+	currentNodes := dpm.lookupCoord.getCurrentNodes()
+	nz := newNodeZones(currentNodes)
+	if !nz.enabled() {
+		return false
+	}
+	if !atomic.CompareAndSwapInt32(&dpm.lookupCoord.balanceWaiting, 0, 1) {
+		coordLog.Infof("another balance is running, should wait")
+		return false
+	}
+	defer atomic.StoreInt32(&dpm.lookupCoord.balanceWaiting, 0)
+	topicList, err := dpm.lookupCoord.leadership.ScanTopics()
+	if err != nil {
+		coordLog.Infof("scan topics error: %v", err)
+		return false
+	}
+	for _, topicInfo := range topicList {
+		// the multi part topic is balanced by the zone aware expected isr
+		if topicInfo.AllowMulti() {
+			continue
+		}
+		if len(topicInfo.ISR) < topicInfo.Replica || len(topicInfo.CatchupList) > 0 || !nz.isSingleZone(topicInfo.ISR) {
+			continue
+		}
+		select {
+		case <-monitorChan:
+			return false
+		default:
+		}
+		if !dpm.lookupCoord.IsClusterStable() || !dpm.lookupCoord.IsMineLeader() {
+			return false
+		}
+		fromNode := ""
+		for _, nid := range topicInfo.ISR {
+			if nid != topicInfo.Leader {
+				fromNode = nid
+				break
+			}
+		}
+		zone := nz.getZone(topicInfo.Leader)
+		candidateStats := make([]NodeTopicStats, 0)
+		for nid, n := range currentNodes {
+			if nz.getZone(nid) == zone {
+				continue
+			}
+			stat, err := dpm.lookupCoord.getNsqdTopicStat(n)
+			if err != nil {
+				continue
+			}
+			candidateStats = append(candidateStats, *stat)
+		}
+		if fromNode == "" || len(candidateStats) == 0 {
+			continue
+		}
+		By(func(l, r *NodeTopicStats) bool {
+			return l.SlaveLessLoader(r)
+		}).Sort(candidateStats)
+		coordLog.Infof("topic %v isr %v is in the same zone %v, try move %v to other zone",
+			topicInfo.GetTopicDesp(), topicInfo.ISR, zone, fromNode)
+		err = dpm.addToCatchupAndWaitISRReady(monitorChan, false, fromNode, topicInfo.Name, topicInfo.Partition,
+			getNodeNameList(candidateStats), nil, false)
+		if err != nil {
+			coordLog.Infof("topic %v move replica to other zone failed: %v", topicInfo.GetTopicDesp(), err)
+		}
+		return true
+	}
+	return false
+}
+
 type SortableStrings []string
 
 func (s SortableStrings) Less(l, r int) bool {
@@ -2388,16 +2566,22 @@ func (dpm *DataPlacement) getRebalancedMultiTopicPartitions(
 	for nid := range currentNodes {
 		nodeNameList = append(nodeNameList, nid)
 	}
-	return dpm.getRebalancedMultiTopicPartitionsFromNameList(topicName, partitionNum, replica, nodeNameList)
+	return dpm.getRebalancedMultiTopicPartitionsFromNameList(topicName, partitionNum, replica, nodeNameList,
+		newNodeZones(currentNodes))
 }
+
+// if the nodes have zone labels, the sorted nodes will be interleaved by zones so the
+// adjacent nodes are in the different zones, and the partition with all the replicas in
+// the same zone will replace the last follower with the next node in other zone.
 func (dpm *DataPlacement) getRebalancedMultiTopicPartitionsFromNameList(
 	topicName string,
 	partitionNum int, replica int,
-	nodeNameList SortableStrings) ([][]string, error) {
+	nodeNameList SortableStrings, nz *nodeZones) ([][]string, error) {
 	if len(nodeNameList) < replica {
 		return nil, ErrBalanceNodeUnavailable
 	}
 	sort.Sort(nodeNameList)
+	sortedNodes := nz.interleave(nodeNameList)
 	partitionNodes := make([][]string, partitionNum)
 	selectIndex := int(murmur3.Sum32([]byte(topicName)))
 	if selectIndex < 0 {
@@ -2407,7 +2591,16 @@ func (dpm *DataPlacement) getRebalancedMultiTopicPartitionsFromNameList(
 		nlist := make([]string, replica)
 		partitionNodes[i] = nlist
 		for j := 0; j < replica; j++ {
-			nlist[j] = nodeNameList[(selectIndex+j)%len(nodeNameList)]
+			nlist[j] = sortedNodes[(selectIndex+j)%len(sortedNodes)]
+		}
+		if nz.isSingleZone(nlist) {
+			for j := replica; j < len(sortedNodes); j++ {
+				nid := sortedNodes[(selectIndex+j)%len(sortedNodes)]
+				if nz.getZone(nid) != nz.getZone(nlist[0]) {
+					nlist[replica-1] = nid
+					break
+				}
+			}
 		}
 		selectIndex++
 	}
@@ -0,0 +1,139 @@
+package consistence
+
+import (
+	"sort"
+)
+
+// nodeZones is the rack/zone label of the current nodes used by the zone aware placement.
+// The replicas of a partition should be spread across the zones as evenly as possible,
+// and all the replicas should never be placed in the same zone while more zones are available.
+// The node without the zone label is not limited by the zone.
+type nodeZones struct {
+	zones   map[string]string
+	zoneNum int
+}
+
+func newNodeZones(currentNodes map[string]NsqdNodeInfo) *nodeZones {
+	nz := &nodeZones{
+		zones: make(map[string]string, len(currentNodes)),
+	}
+	zoneSet := make(map[string]struct{})
+	for nid, n := range currentNodes {
+		if n.Zone == "" {
+			continue
+		}
+		nz.zones[nid] = n.Zone
+		zoneSet[n.Zone] = struct{}{}
+	}
+	nz.zoneNum = len(zoneSet)
+	return nz
+}
+
+// the zone is ignored if only one zone in cluster
+func (nz *nodeZones) enabled() bool {
+	return nz != nil && nz.zoneNum > 1
+}
+
+func (nz *nodeZones) getZone(nid string) string {
+	if nz == nil {
+		return ""
+	}
+	return nz.zones[nid]
+}
+
+// max replicas of a partition allowed in the same zone
+func (nz *nodeZones) maxPerZone(replica int) int {
+	if !nz.enabled() {
+		return replica
+	}
+	return (replica + nz.zoneNum - 1) / nz.zoneNum
+}
+
+func (nz *nodeZones) countInZone(nodes []string, zone string) int {
+	cnt := 0
+	for _, nid := range nodes {
+		if nz.getZone(nid) == zone {
+			cnt++
+		}
+	}
+	return cnt
+}
+
+// isBalancedToAdd check whether the replicas are still spread evenly across the zones after the node added.
+func (nz *nodeZones) isBalancedToAdd(replicas []string, nid string, replica int) bool {
+	zone := nz.getZone(nid)
+	if !nz.enabled() || zone == "" {
+		return true
+	}
+	return nz.countInZone(replicas, zone) < nz.maxPerZone(replica)
+}
+
+// isSingleZone check whether all the replicas are in the same zone while more zones are available.
+func (nz *nodeZones) isSingleZone(replicas []string) bool {
+	if !nz.enabled() || len(replicas) < 2 {
+		return false
+	}
+	zone := nz.getZone(replicas[0])
+	if zone == "" {
+		return false
+	}
+	for _, nid := range replicas[1:] {
+		if nz.getZone(nid) != zone {
+			return false
+		}
+	}
+	return true
+}
+
+// canAdd check whether the node can be added to the replicas without putting
+// all the replicas of the partition in the same zone.
+func (nz *nodeZones) canAdd(replicas []string, nid string, replica int) bool {
+	if len(replicas)+1 < replica {
+		// still have chance to add node from other zone
+		return true
+	}
+	newReplicas := make([]string, 0, len(replicas)+1)
+	newReplicas = append(newReplicas, replicas...)
+	newReplicas = append(newReplicas, nid)
+	return !nz.isSingleZone(newReplicas)
+}
+
+// interleave reorder the sorted nodes so the adjacent nodes are in the different
+// zones if possible. Each zone is spread across the whole list in proportion to its
+// nodes, and the order in the same zone is kept.
+func (nz *nodeZones) interleave(sortedNodes []string) []string {
+	if !nz.enabled() {
+		return sortedNodes
+	}
+	zoneNodes := make(map[string][]string)
+	for _, nid := range sortedNodes {
+		z := nz.getZone(nid)
+		zoneNodes[z] = append(zoneNodes[z], nid)
+	}
+	type spreadPos struct {
+		nid   string
+		zone  string
+		index int
+		total int
+	}
+	posList := make([]spreadPos, 0, len(sortedNodes))
+	for z, nodes := range zoneNodes {
+		for i, nid := range nodes {
+			posList = append(posList, spreadPos{nid: nid, zone: z, index: i, total: len(nodes)})
+		}
+	}
+	sort.Slice(posList, func(i, j int) bool {
+		// compare (2*index+1)/(2*total) to place the node in the middle of its slot
+		l := (2*posList[i].index + 1) * posList[j].total
+		r := (2*posList[j].index + 1) * posList[i].total
+		if l != r {
+			return l < r
+		}
+		return posList[i].zone < posList[j].zone
+	})
+	ret := make([]string, 0, len(posList))
+	for _, p := range posList {
+		ret = append(ret, p.nid)
+	}
+	return ret
+}
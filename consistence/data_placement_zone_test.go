@@ -0,0 +1,102 @@
+package consistence
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/youzan/nsq/internal/test"
+)
+
+func newTestZoneNodes(zoneNodes map[string]int) map[string]NsqdNodeInfo {
+	nodes := make(map[string]NsqdNodeInfo)
+	for zone, num := range zoneNodes {
+		for i := 0; i < num; i++ {
+			nid := zone + "-node" + strconv.Itoa(i)
+			nodes[nid] = NsqdNodeInfo{ID: nid, Zone: zone}
+		}
+	}
+	return nodes
+}
+
+func TestNodeZonesCheck(t *testing.T) {
+	nz := newNodeZones(newTestZoneNodes(map[string]int{"za": 3, "zb": 2, "zc": 1}))
+	test.Equal(t, true, nz.enabled())
+	test.Equal(t, 3, nz.zoneNum)
+	test.Equal(t, 1, nz.maxPerZone(2))
+	test.Equal(t, 1, nz.maxPerZone(3))
+	test.Equal(t, 2, nz.maxPerZone(4))
+
+	isr := []string{"za-node0"}
+	test.Equal(t, false, nz.isBalancedToAdd(isr, "za-node1", 3))
+	test.Equal(t, true, nz.isBalancedToAdd(isr, "zb-node0", 3))
+	// not balanced but still can be added since the last replica can be in other zone
+	test.Equal(t, true, nz.canAdd(isr, "za-node1", 3))
+	isr = append(isr, "za-node1")
+	test.Equal(t, true, nz.isSingleZone(isr))
+	test.Equal(t, false, nz.canAdd(isr, "za-node2", 3))
+	test.Equal(t, true, nz.canAdd(isr, "zc-node0", 3))
+	test.Equal(t, false, nz.canAdd([]string{"za-node0"}, "za-node1", 2))
+
+	// the node without zone label is not limited
+	test.Equal(t, true, nz.isBalancedToAdd(isr, "nozone", 3))
+	test.Equal(t, false, nz.isSingleZone([]string{"za-node0", "nozone"}))
+
+	single := newNodeZones(newTestZoneNodes(map[string]int{"za": 3}))
+	test.Equal(t, false, single.enabled())
+	test.Equal(t, true, single.canAdd([]string{"za-node0"}, "za-node1", 2))
+	test.Equal(t, false, single.isSingleZone([]string{"za-node0", "za-node1"}))
+}
+
+func TestNodeZonesInterleave(t *testing.T) {
+	nodes := newTestZoneNodes(map[string]int{"za": 3, "zb": 3, "zc": 3})
+	nz := newNodeZones(nodes)
+	nameList := make(SortableStrings, 0)
+	for nid := range nodes {
+		nameList = append(nameList, nid)
+	}
+	dpm := &DataPlacement{}
+	partitionNodes, err := dpm.getRebalancedMultiTopicPartitionsFromNameList("test-zone", 9, 3, nameList, nz)
+	test.Nil(t, err)
+	for _, isr := range partitionNodes {
+		zones := make(map[string]bool)
+		for _, nid := range isr {
+			zones[nz.getZone(nid)] = true
+		}
+		test.Equal(t, 3, len(zones))
+	}
+	// the leaders should be even across nodes
+	leaders := make(map[string]int)
+	for _, isr := range partitionNodes {
+		leaders[isr[0]]++
+	}
+	test.Equal(t, 9, len(leaders))
+
+	// unbalanced zones should never put all the replicas in one zone
+	nodes = newTestZoneNodes(map[string]int{"za": 4, "zb": 1})
+	nz = newNodeZones(nodes)
+	nameList = nameList[:0]
+	for nid := range nodes {
+		nameList = append(nameList, nid)
+	}
+	partitionNodes, err = dpm.getRebalancedMultiTopicPartitionsFromNameList("test-zone", 10, 2, nameList, nz)
+	test.Nil(t, err)
+	for _, isr := range partitionNodes {
+		test.Equal(t, 2, len(isr))
+		test.NotEqual(t, isr[0], isr[1])
+		test.Equal(t, false, nz.isSingleZone(isr))
+	}
+
+	// no zone should keep the sorted order
+	nodes = newTestZoneNodes(map[string]int{"": 4})
+	nz = newNodeZones(nodes)
+	test.Equal(t, false, nz.enabled())
+	nameList = SortableStrings{"-node3", "-node1", "-node0", "-node2"}
+	partitionNodes, err = dpm.getRebalancedMultiTopicPartitionsFromNameList("test-zone", 4, 2, nameList, nz)
+	test.Nil(t, err)
+	test.Equal(t, SortableStrings{"-node0", "-node1", "-node2", "-node3"}, nameList)
+	for _, isr := range partitionNodes {
+		i0, _ := strconv.Atoi(isr[0][len("-node"):])
+		i1, _ := strconv.Atoi(isr[1][len("-node"):])
+		test.Equal(t, (i0+1)%4, i1)
+	}
+}
@@ -0,0 +1,390 @@
+package consistence
+
+import (
+	"errors"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.etcd.io/etcd/clientv3"
+	"go.etcd.io/etcd/mvcc/mvccpb"
+	"golang.org/x/net/context"
+)
+
+const (
+	LeadershipBackendEtcdV3 = "etcdv3"
+	// the key under the root dir to save the newest etcd v2 index while
+	// migrating the leadership data from v2 to v3, all the epochs read from v3 will add this base,
+	// so the epoch will never go back after migration.
+	NSQ_V2_EPOCH_BASE = "EtcdV2EpochBase"
+)
+
+const (
+	etcdV3DialTimeout    = time.Second * 5
+	etcdV3RequestTimeout = time.Second * 5
+)
+
+var ErrKeyCompareFailed = errors.New("Key compare failed")
+
+// EtcdV3Client wrap the etcd v3 client to provide the similar operations as the v2 client.
+// Since there is no dir in v3, the dir in v2 is saved as the key with empty value, and the
+// children of the dir can be got by the prefix (dir + "/").
+type EtcdV3Client struct {
+	client    *clientv3.Client
+	epochBase int64
+}
+
+func NewEV3Client(host, userName, pwd string) (*EtcdV3Client, error) {
+	machines := strings.Split(host, ",")
+	initEtcdPeers(machines)
+	cfg := clientv3.Config{
+		Endpoints:   machines,
+		DialTimeout: etcdV3DialTimeout,
+		Username:    userName,
+		Password:    pwd,
+	}
+	c, err := clientv3.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &EtcdV3Client{
+		client: c,
+	}, nil
+}
+
+func (self *EtcdV3Client) Close() error {
+	return self.client.Close()
+}
+
+// LoadEpochBase should be called after the NSQ_ROOT_DIR is set and before any epoch is used.
+func (self *EtcdV3Client) LoadEpochBase() error {
+	kv, err := self.Get(etcdV3EpochBasePath(), true)
+	if err != nil {
+		if err == ErrKeyNotFound {
+			self.epochBase = 0
+			return nil
+		}
+		return err
+	}
+	base, err := strconv.ParseInt(string(kv.Value), 10, 64)
+	if err != nil {
+		return err
+	}
+	self.epochBase = base
+	return nil
+}
+
+func (self *EtcdV3Client) ToEpoch(rev int64) EpochType {
+	return EpochType(rev + self.epochBase)
+}
+
+func (self *EtcdV3Client) ToRevision(epoch EpochType) int64 {
+	return int64(epoch) - self.epochBase
+}
+
+func (self *EtcdV3Client) Get(key string, newest bool) (*mvccpb.KeyValue, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdV3RequestTimeout)
+	defer cancel()
+	var opts []clientv3.OpOption
+	if !newest {
+		opts = append(opts, clientv3.WithSerializable())
+	}
+	rsp, err := self.client.Get(ctx, key, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if len(rsp.Kvs) == 0 {
+		return nil, ErrKeyNotFound
+	}
+	return rsp.Kvs[0], nil
+}
+
+// GetWithRevision get the key and the revision of the cluster while reading, the revision
+// is returned even the key is not found, so it can be used to watch the key.
+func (self *EtcdV3Client) GetWithRevision(key string) (*mvccpb.KeyValue, int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdV3RequestTimeout)
+	defer cancel()
+	rsp, err := self.client.Get(ctx, key, clientv3.WithSerializable())
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(rsp.Kvs) == 0 {
+		return nil, rsp.Header.Revision, ErrKeyNotFound
+	}
+	return rsp.Kvs[0], rsp.Header.Revision, nil
+}
+
+// GetChildren get all the keys under the dir, return the revision of the cluster while reading
+func (self *EtcdV3Client) GetChildren(dir string, newest bool) ([]*mvccpb.KeyValue, int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdV3RequestTimeout)
+	defer cancel()
+	opts := []clientv3.OpOption{clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend)}
+	if !newest {
+		opts = append(opts, clientv3.WithSerializable())
+	}
+	rsp, err := self.client.Get(ctx, etcdV3DirPrefix(dir), opts...)
+	if err != nil {
+		return nil, 0, err
+	}
+	return rsp.Kvs, rsp.Header.Revision, nil
+}
+
+// IsExist check the key or any key under the key as dir exist.
+func (self *EtcdV3Client) IsExist(key string) (bool, error) {
+	_, err := self.Get(key, false)
+	if err == nil {
+		return true, nil
+	}
+	if err != ErrKeyNotFound {
+		return false, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), etcdV3RequestTimeout)
+	defer cancel()
+	rsp, err := self.client.Get(ctx, etcdV3DirPrefix(key), clientv3.WithPrefix(), clientv3.WithCountOnly(), clientv3.WithSerializable())
+	if err != nil {
+		return false, err
+	}
+	return rsp.Count > 0, nil
+}
+
+// Create the key only if not exist, return the modify revision of the new key
+func (self *EtcdV3Client) Create(key string, value string, lease clientv3.LeaseID) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdV3RequestTimeout)
+	defer cancel()
+	rsp, err := self.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, value, clientv3.WithLease(lease))).
+		Commit()
+	if err != nil {
+		return 0, err
+	}
+	if !rsp.Succeeded {
+		return 0, ErrKeyAlreadyExist
+	}
+	return rsp.Header.Revision, nil
+}
+
+// CreateIfNotExist create the key or return the exist one, return the value and
+// the modify revision in etcd. The returned bool is true if the key is created by this call.
+func (self *EtcdV3Client) CreateIfNotExist(key string, value string, lease clientv3.LeaseID) (*mvccpb.KeyValue, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdV3RequestTimeout)
+	defer cancel()
+	rsp, err := self.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, value, clientv3.WithLease(lease))).
+		Else(clientv3.OpGet(key)).
+		Commit()
+	if err != nil {
+		return nil, false, err
+	}
+	if rsp.Succeeded {
+		return &mvccpb.KeyValue{
+			Key:            []byte(key),
+			Value:          []byte(value),
+			CreateRevision: rsp.Header.Revision,
+			ModRevision:    rsp.Header.Revision,
+			Lease:          int64(lease),
+		}, true, nil
+	}
+	kvs := rsp.Responses[0].GetResponseRange().Kvs
+	if len(kvs) == 0 {
+		// deleted just now
+		return nil, false, ErrKeyNotFound
+	}
+	return kvs[0], false, nil
+}
+
+func (self *EtcdV3Client) Put(key string, value string, lease clientv3.LeaseID) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdV3RequestTimeout)
+	defer cancel()
+	rsp, err := self.client.Put(ctx, key, value, clientv3.WithLease(lease))
+	if err != nil {
+		return 0, err
+	}
+	return rsp.Header.Revision, nil
+}
+
+// CompareAndSwap put the new value only if the modify revision of the key is not changed.
+func (self *EtcdV3Client) CompareAndSwap(key string, value string, modRev int64) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdV3RequestTimeout)
+	defer cancel()
+	rsp, err := self.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", modRev)).
+		Then(clientv3.OpPut(key, value)).
+		Commit()
+	if err != nil {
+		return 0, err
+	}
+	if !rsp.Succeeded {
+		return 0, ErrKeyCompareFailed
+	}
+	return rsp.Header.Revision, nil
+}
+
+// CompareValueAndSwap put the new value with the lease only if the value of the key is not changed.
+func (self *EtcdV3Client) CompareValueAndSwap(key string, value string, prevValue string, lease clientv3.LeaseID) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdV3RequestTimeout)
+	defer cancel()
+	rsp, err := self.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.Value(key), "=", prevValue)).
+		Then(clientv3.OpPut(key, value, clientv3.WithLease(lease))).
+		Commit()
+	if err != nil {
+		return 0, err
+	}
+	if !rsp.Succeeded {
+		return 0, ErrKeyCompareFailed
+	}
+	return rsp.Header.Revision, nil
+}
+
+// CompareAndDelete delete the key only if the value is not changed.
+func (self *EtcdV3Client) CompareAndDelete(key string, prevValue string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdV3RequestTimeout)
+	defer cancel()
+	rsp, err := self.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), ">", 0)).
+		Then(clientv3.OpTxn(
+			[]clientv3.Cmp{clientv3.Compare(clientv3.Value(key), "=", prevValue)},
+			[]clientv3.Op{clientv3.OpDelete(key)},
+			nil)).
+		Commit()
+	if err != nil {
+		return err
+	}
+	if !rsp.Succeeded {
+		return ErrKeyNotFound
+	}
+	if !rsp.Responses[0].GetResponseTxn().Succeeded {
+		return ErrKeyCompareFailed
+	}
+	return nil
+}
+
+func (self *EtcdV3Client) Delete(key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdV3RequestTimeout)
+	defer cancel()
+	rsp, err := self.client.Delete(ctx, key)
+	if err != nil {
+		return err
+	}
+	if rsp.Deleted == 0 {
+		return ErrKeyNotFound
+	}
+	return nil
+}
+
+// DeleteDir delete the dir key and all the keys under it in one transaction.
+func (self *EtcdV3Client) DeleteDir(dir string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdV3RequestTimeout)
+	defer cancel()
+	rsp, err := self.client.Txn(ctx).
+		Then(clientv3.OpDelete(dir), clientv3.OpDelete(etcdV3DirPrefix(dir), clientv3.WithPrefix())).
+		Commit()
+	if err != nil {
+		return 0, err
+	}
+	var deleted int64
+	for _, r := range rsp.Responses {
+		deleted += r.GetResponseDeleteRange().Deleted
+	}
+	return deleted, nil
+}
+
+// PutWithKeepAlive put the key attached to a new lease and keep the lease alive until the
+// stop channel is closed, the key will be put again with a new lease if the lease is lost.
+func (self *EtcdV3Client) PutWithKeepAlive(key string, value string, ttl int64, stopC <-chan bool) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	kaCh, err := self.putWithNewLease(ctx, key, value, ttl)
+	if err != nil {
+		cancel()
+		return err
+	}
+	go func() {
+		defer cancel()
+		for {
+			select {
+			case <-stopC:
+				return
+			case _, ok := <-kaCh:
+				if ok {
+					continue
+				}
+				coordLog.Errorf("lease of key %v is lost, try put again", key)
+				for {
+					kaCh, err = self.putWithNewLease(ctx, key, value, ttl)
+					if err == nil {
+						break
+					}
+					coordLog.Errorf("put key %v error: %s", key, err.Error())
+					select {
+					case <-stopC:
+						return
+					case <-time.After(time.Second * time.Duration(ETCD_TTL/10)):
+					}
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+func (self *EtcdV3Client) putWithNewLease(ctx context.Context, key string, value string, ttl int64) (<-chan *clientv3.LeaseKeepAliveResponse, error) {
+	leaseID, kaCh, err := self.GrantKeepAlive(ctx, ttl)
+	if err != nil {
+		return nil, err
+	}
+	_, err = self.Put(key, value, leaseID)
+	if err != nil {
+		self.Revoke(leaseID)
+		return nil, err
+	}
+	return kaCh, nil
+}
+
+// GrantKeepAlive grant a new lease with the ttl in seconds and keep it alive until the context is done.
+// The returned channel will be closed if the lease is expired or the keepalive is stopped.
+func (self *EtcdV3Client) GrantKeepAlive(ctx context.Context, ttl int64) (clientv3.LeaseID, <-chan *clientv3.LeaseKeepAliveResponse, error) {
+	gctx, cancel := context.WithTimeout(ctx, etcdV3RequestTimeout)
+	defer cancel()
+	rsp, err := self.client.Grant(gctx, ttl)
+	if err != nil {
+		return clientv3.NoLease, nil, err
+	}
+	ch, err := self.client.KeepAlive(ctx, rsp.ID)
+	if err != nil {
+		self.Revoke(rsp.ID)
+		return clientv3.NoLease, nil, err
+	}
+	return rsp.ID, ch, nil
+}
+
+// Revoke the lease and all the keys attached to the lease will be deleted.
+func (self *EtcdV3Client) Revoke(lease clientv3.LeaseID) error {
+	if lease == clientv3.NoLease {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), etcdV3RequestTimeout)
+	defer cancel()
+	_, err := self.client.Revoke(ctx, lease)
+	return err
+}
+
+// Watch the key from the revision, watch all the keys under it if isDir.
+func (self *EtcdV3Client) Watch(ctx context.Context, key string, rev int64, isDir bool) clientv3.WatchChan {
+	opts := []clientv3.OpOption{clientv3.WithRev(rev)}
+	if isDir {
+		key = etcdV3DirPrefix(key)
+		opts = append(opts, clientv3.WithPrefix())
+	}
+	return self.client.Watch(clientv3.WithRequireLeader(ctx), key, opts...)
+}
+
+func etcdV3DirPrefix(dir string) string {
+	return strings.TrimSuffix(dir, "/") + "/"
+}
+
+func etcdV3EpochBasePath() string {
+	return path.Join("/", NSQ_ROOT_DIR, NSQ_V2_EPOCH_BASE)
+}
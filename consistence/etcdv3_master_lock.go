@@ -0,0 +1,272 @@
+// description: Utility to perform master election/failover using etcd v3 lease.
+package consistence
+
+import (
+	"sync"
+	"time"
+
+	"go.etcd.io/etcd/clientv3"
+	"golang.org/x/net/context"
+)
+
+// EtcdV3Lock hold the lock key with the lease, the key will be deleted by etcd if the lease
+// is expired, and the others watching the key will try to acquire it.
+type EtcdV3Lock struct {
+	sync.Mutex
+
+	client    *EtcdV3Client
+	name      string
+	id        string
+	ttl       int64
+	enable    bool
+	master    string
+	ifHolding bool
+	leaseID   clientv3.LeaseID
+
+	ctx         context.Context
+	cancel      context.CancelFunc
+	eventsChan  chan *MasterEvent
+	stoppedChan chan bool
+}
+
+func NewEtcdV3Master(etcdClient *EtcdV3Client, name, value string, ttl int64) Master {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &EtcdV3Lock{
+		client:      etcdClient,
+		name:        name,
+		id:          value,
+		ttl:         ttl,
+		ctx:         ctx,
+		cancel:      cancel,
+		eventsChan:  make(chan *MasterEvent, 1),
+		stoppedChan: make(chan bool, 1),
+	}
+}
+
+func (self *EtcdV3Lock) Start() {
+	coordLog.Infof("[EtcdV3Lock][Start] start to acquire lock[%s] value[%s].", self.name, self.id)
+	self.Lock()
+	if self.enable {
+		self.Unlock()
+		return
+	}
+	self.enable = true
+	self.Unlock()
+
+	go self.acquire()
+}
+
+func (self *EtcdV3Lock) Stop() {
+	coordLog.Infof("[EtcdV3Lock][Stop] stop acquire lock[%s].", self.name)
+	self.Lock()
+	enabled := self.enable
+	self.enable = false
+	self.Unlock()
+
+	self.cancel()
+	if enabled {
+		// wait for acquire to finish
+		<-self.stoppedChan
+	} else {
+		self.stopAcquire()
+	}
+}
+
+func (self *EtcdV3Lock) GetEventsChan() <-chan *MasterEvent {
+	return self.eventsChan
+}
+
+func (self *EtcdV3Lock) GetKey() string {
+	return self.name
+}
+
+func (self *EtcdV3Lock) GetMaster() string {
+	self.Lock()
+	defer self.Unlock()
+	return self.master
+}
+
+func (self *EtcdV3Lock) TryAcquire() error {
+	leaseID, kaCh, err := self.client.GrantKeepAlive(self.ctx, self.ttl)
+	if err != nil {
+		coordLog.Errorf("[EtcdV3Lock][TryAcquire] grant lease for lock[%s] error: %s", self.name, err.Error())
+		return err
+	}
+	_, err = self.client.Create(self.name, self.id, leaseID)
+	if err != nil {
+		coordLog.Errorf("[EtcdV3Lock][TryAcquire] etcd create lock[%s] error: %s", self.name, err.Error())
+		self.client.Revoke(leaseID)
+		return err
+	}
+	coordLog.Infof("[EtcdV3Lock][TryAcquire] acquire lock: %s", self.name)
+	self.Lock()
+	self.leaseID = leaseID
+	self.ifHolding = true
+	self.master = self.id
+	self.Unlock()
+	go func() {
+		for range kaCh {
+		}
+	}()
+	return nil
+}
+
+func (self *EtcdV3Lock) acquire() {
+	var kaCh <-chan *clientv3.LeaseKeepAliveResponse
+	for {
+		if self.ctx.Err() != nil {
+			self.stopAcquire()
+			self.stoppedChan <- true
+			return
+		}
+		if self.leaseID == clientv3.NoLease {
+			leaseID, ch, err := self.client.GrantKeepAlive(self.ctx, self.ttl)
+			if err != nil {
+				coordLog.Errorf("[EtcdV3Lock][acquire] grant lease for lock[%s] error: %s", self.name, err.Error())
+				self.sleepRetry()
+				continue
+			}
+			self.Lock()
+			self.leaseID = leaseID
+			self.Unlock()
+			kaCh = ch
+		}
+
+		kv, _, err := self.client.CreateIfNotExist(self.name, self.id, self.leaseID)
+		if err != nil {
+			coordLog.Errorf("[EtcdV3Lock][acquire] etcd create lock[%s] error: %s", self.name, err.Error())
+			self.sleepRetry()
+			continue
+		}
+		if string(kv.Value) == self.id && clientv3.LeaseID(kv.Lease) != self.leaseID {
+			// the lock is hold by us with the old lease (maybe restarted quickly), take over it
+			// with the new lease to keep it alive.
+			rev, err := self.client.CompareValueAndSwap(self.name, self.id, self.id, self.leaseID)
+			if err != nil {
+				coordLog.Errorf("[EtcdV3Lock][acquire] take over lock[%s] error: %s", self.name, err.Error())
+				self.sleepRetry()
+				continue
+			}
+			kv.ModRevision = rev
+		}
+		if !self.processValue(string(kv.Value), kv.ModRevision) {
+			continue
+		}
+
+		if !self.watch(kv.ModRevision+1, kaCh) {
+			continue
+		}
+	}
+}
+
+// watch the lock key until the key is deleted or the lease is lost,
+// return false if stopped while notify the events.
+func (self *EtcdV3Lock) watch(rev int64, kaCh <-chan *clientv3.LeaseKeepAliveResponse) bool {
+	ctx, cancel := context.WithCancel(self.ctx)
+	defer cancel()
+	watcher := self.client.Watch(ctx, self.name, rev, false)
+	for {
+		select {
+		case <-self.ctx.Done():
+			coordLog.Infof("[EtcdV3Lock][acquire] watch lock[%s] stop by user.", self.name)
+			return true
+		case _, ok := <-kaCh:
+			if ok {
+				continue
+			}
+			coordLog.Errorf("[EtcdV3Lock][acquire] lease of lock[%s] is lost", self.name)
+			self.Lock()
+			self.leaseID = clientv3.NoLease
+			self.Unlock()
+			if self.ctx.Err() != nil {
+				return true
+			}
+			return self.processValue("", rev)
+		case wrsp, ok := <-watcher:
+			if !ok {
+				return true
+			}
+			if err := wrsp.Err(); err != nil {
+				coordLog.Errorf("[EtcdV3Lock][acquire] failed to watch lock[%s] error: %s", self.name, err.Error())
+				self.sleepRetry()
+				return true
+			}
+			for _, ev := range wrsp.Events {
+				if ev.Type == clientv3.EventTypeDelete {
+					return self.processValue("", ev.Kv.ModRevision)
+				}
+				if !self.processValue(string(ev.Kv.Value), ev.Kv.ModRevision) {
+					return false
+				}
+			}
+		}
+	}
+}
+
+func (self *EtcdV3Lock) sleepRetry() {
+	select {
+	case <-self.ctx.Done():
+	case <-time.After(RETRY_SLEEP * time.Millisecond):
+	}
+}
+
+func (self *EtcdV3Lock) sendEvent(e *MasterEvent) bool {
+	select {
+	case self.eventsChan <- e:
+		return true
+	case <-self.ctx.Done():
+		return false
+	}
+}
+
+// return false if stopped while sending the events
+func (self *EtcdV3Lock) processValue(value string, modRev int64) bool {
+	epoch := uint64(self.client.ToEpoch(modRev))
+	if value == self.id {
+		if !self.ifHolding {
+			coordLog.Infof("[EtcdV3Lock][processValue] acquire lock: %s", self.name)
+			self.ifHolding = true
+			if !self.sendEvent(&MasterEvent{Type: MASTER_ADD, Master: self.id, ModifiedIndex: epoch}) {
+				return false
+			}
+		}
+	} else {
+		if self.ifHolding {
+			coordLog.Errorf("[EtcdV3Lock][processValue] lost lock: %s", self.name)
+			self.ifHolding = false
+			if !self.sendEvent(&MasterEvent{Type: MASTER_DELETE}) {
+				return false
+			}
+		}
+		if self.GetMaster() != value {
+			coordLog.Infof("[EtcdV3Lock][processValue] modify lock[%s] to master[%s]", self.name, value)
+			if !self.sendEvent(&MasterEvent{Type: MASTER_MODIFY, Master: value, ModifiedIndex: epoch}) {
+				return false
+			}
+		}
+	}
+	self.Lock()
+	self.master = value
+	self.Unlock()
+	return true
+}
+
+func (self *EtcdV3Lock) stopAcquire() {
+	self.Lock()
+	leaseID := self.leaseID
+	self.leaseID = clientv3.NoLease
+	self.master = ""
+	holding := self.ifHolding
+	self.ifHolding = false
+	self.Unlock()
+	if leaseID != clientv3.NoLease {
+		if holding {
+			coordLog.Infof("[EtcdV3Lock][stopAcquire] delete lock: %s", self.name)
+		}
+		// the lock key attached to the lease will be deleted while revoking
+		err := self.client.Revoke(leaseID)
+		if err != nil {
+			coordLog.Errorf("[EtcdV3Lock][stopAcquire] failed to revoke lease of lock: %s error: %s", self.name, err.Error())
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package consistence
+
+import (
+	"errors"
+	"path"
+	"strconv"
+
+	"github.com/coreos/etcd/client"
+	"go.etcd.io/etcd/clientv3"
+	"golang.org/x/net/context"
+)
+
+const etcdV3MigrateBatch = 64
+
+var ErrEtcdV3NotEmpty = errors.New("the leadership data already exist in etcd v3")
+
+// MigrateLeadershipToV3 copy all the leadership data under the NSQ_ROOT_DIR from etcd v2 to v3.
+// The dir is saved as the key with empty value and the keys with ttl (the registered nodes and
+// the lookup leader session) are ignored since they will be registered again by the nodes.
+// The newest etcd index of v2 is saved as the epoch base to make sure the epoch will
+// never go back after migrated. All the nsqd and nsqlookupd should be stopped while migrating.
+// Return the keys which should be migrated.
+func MigrateLeadershipToV3(v2 *EtcdClient, v3 *EtcdV3Client, dryRun bool) ([]string, error) {
+	root := path.Join("/", NSQ_ROOT_DIR)
+	rsp, err := v2.GetNewest(root, true, true)
+	if err != nil {
+		return nil, err
+	}
+	kvs := make([]*client.Node, 0)
+	collectMigrateNodes(rsp.Node, &kvs)
+	keys := make([]string, 0, len(kvs))
+	for _, n := range kvs {
+		keys = append(keys, n.Key)
+	}
+	coordLog.Infof("migrate %v keys from etcd v2 to v3 with epoch base: %v", len(keys), rsp.Index)
+	if dryRun {
+		return keys, nil
+	}
+
+	exist, err := v3.IsExist(root)
+	if err != nil {
+		return nil, err
+	}
+	if exist {
+		return nil, ErrEtcdV3NotEmpty
+	}
+	ops := make([]clientv3.Op, 0, etcdV3MigrateBatch)
+	// the epoch base is put first so the migrated keys will never be used without it
+	ops = append(ops, clientv3.OpPut(etcdV3EpochBasePath(), strconv.FormatUint(rsp.Index, 10)))
+	for _, n := range kvs {
+		ops = append(ops, clientv3.OpPut(n.Key, n.Value))
+		if len(ops) >= etcdV3MigrateBatch {
+			if err := commitMigrateOps(v3, ops); err != nil {
+				return nil, err
+			}
+			ops = ops[:0]
+		}
+	}
+	if err := commitMigrateOps(v3, ops); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func collectMigrateNodes(n *client.Node, kvs *[]*client.Node) {
+	if n.TTL > 0 || n.Expiration != nil {
+		return
+	}
+	*kvs = append(*kvs, n)
+	for _, child := range n.Nodes {
+		collectMigrateNodes(child, kvs)
+	}
+}
+
+func commitMigrateOps(v3 *EtcdV3Client, ops []clientv3.Op) error {
+	if len(ops) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), etcdV3RequestTimeout)
+	defer cancel()
+	_, err := v3.client.Txn(ctx).Then(ops...).Commit()
+	return err
+}
@@ -0,0 +1,333 @@
+package consistence
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/youzan/nsq/internal/test"
+	"go.etcd.io/etcd/embed"
+)
+
+func startTestEtcdV3(t *testing.T, dir string) (*embed.Etcd, string) {
+	test.Nil(t, os.MkdirAll(dir, 0700))
+	cfg := embed.NewConfig()
+	cfg.Dir = dir
+	cfg.Logger = "zap"
+	cfg.LogOutputs = []string{path.Join(dir, "etcd.log")}
+	clientURL, _ := url.Parse("http://" + getFreeTestAddr(t))
+	peerURL, _ := url.Parse("http://" + getFreeTestAddr(t))
+	cfg.LCUrls = []url.URL{*clientURL}
+	cfg.ACUrls = []url.URL{*clientURL}
+	cfg.LPUrls = []url.URL{*peerURL}
+	cfg.APUrls = []url.URL{*peerURL}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+	e, err := embed.StartEtcd(cfg)
+	test.Nil(t, err)
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(time.Second * 10):
+		e.Close()
+		t.Fatal("etcd v3 start timeout")
+	}
+	return e, clientURL.String()
+}
+
+func TestEtcdV3Leadership(t *testing.T) {
+	coordLog.Logger = newTestLogger(t)
+	tmpDir, err := ioutil.TempDir("", "etcdv3-test")
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	e, addr := startTestEtcdV3(t, tmpDir)
+	defer e.Close()
+	clusterID := "test-nsq-cluster-unit-test-etcdv3"
+
+	nodeMgr, err := NewNsqdEtcdV3Mgr(addr, "", "")
+	test.Nil(t, err)
+	nodeMgr.InitClusterID(clusterID)
+	nodeInfo := &NsqdNodeInfo{
+		ID:      "n-1",
+		NodeIP:  "127.0.0.1",
+		TcpPort: "2222",
+		RpcPort: "2223",
+	}
+	test.Nil(t, nodeMgr.RegisterNsqd(nodeInfo))
+
+	lookupdMgr, err := NewNsqLookupdEtcdV3Mgr(addr, "", "")
+	test.Nil(t, err)
+	lookupdMgr.InitClusterID(clusterID)
+	defer lookupdMgr.Stop()
+	lookupdInfo := &NsqLookupdNodeInfo{
+		ID:       "l-1",
+		NodeIP:   "127.0.0.1",
+		HttpPort: "8090",
+	}
+	test.Nil(t, lookupdMgr.Register(lookupdInfo))
+	defer lookupdMgr.Unregister(lookupdInfo)
+	clusterEpoch, err := lookupdMgr.GetClusterEpoch()
+	test.Nil(t, err)
+	test.NotEqual(t, EpochType(0), clusterEpoch)
+	lookupList, err := nodeMgr.GetAllLookupdNodes()
+	test.Nil(t, err)
+	test.Equal(t, 1, len(lookupList))
+
+	stop := make(chan struct{})
+	nsqdsCh := make(chan []NsqdNodeInfo, 1)
+	go lookupdMgr.WatchNsqdNodes(nsqdsCh, stop)
+	nsqds := <-nsqdsCh
+	test.Equal(t, 1, len(nsqds))
+	test.Equal(t, nodeInfo.ID, nsqds[0].ID)
+	nodeInfo2 := &NsqdNodeInfo{
+		ID:     "n-2",
+		NodeIP: "127.0.0.2",
+	}
+	nodeMgr2, err := NewNsqdEtcdV3Mgr(addr, "", "")
+	test.Nil(t, err)
+	nodeMgr2.InitClusterID(clusterID)
+	test.Nil(t, nodeMgr2.RegisterNsqd(nodeInfo2))
+	select {
+	case nsqds = <-nsqdsCh:
+		test.Equal(t, 2, len(nsqds))
+	case <-time.After(time.Second * 10):
+		t.Fatal("watch nsqd nodes timeout")
+	}
+	test.Nil(t, nodeMgr2.UnregisterNsqd(nodeInfo2))
+	select {
+	case nsqds = <-nsqdsCh:
+		test.Equal(t, 1, len(nsqds))
+	case <-time.After(time.Second * 10):
+		t.Fatal("watch nsqd nodes timeout")
+	}
+
+	lookupLeaderCh := make(chan *NsqLookupdNodeInfo, 1)
+	lookupdMgr.AcquireAndWatchLeader(lookupLeaderCh, stop)
+	select {
+	case leader := <-lookupLeaderCh:
+		test.Equal(t, lookupdInfo.ID, leader.ID)
+	case <-time.After(time.Second * 10):
+		t.Fatal("acquire lookup leader timeout")
+	}
+	nodeLeaderCh := make(chan *NsqLookupdNodeInfo, 1)
+	go nodeMgr.WatchLookupdLeader(nodeLeaderCh, stop)
+	select {
+	case leader := <-nodeLeaderCh:
+		test.Equal(t, lookupdInfo.ID, leader.ID)
+	case <-time.After(time.Second * 10):
+		t.Fatal("watch lookup leader timeout")
+	}
+
+	topicName := "etcdv3-topic"
+	partition := 0
+	exist, err := lookupdMgr.IsExistTopic(topicName)
+	test.Nil(t, err)
+	test.Equal(t, false, exist)
+	test.Nil(t, lookupdMgr.CreateTopic(topicName, &TopicMetaInfo{PartitionNum: 1, Replica: 1}))
+	test.Equal(t, ErrKeyAlreadyExist, lookupdMgr.CreateTopic(topicName, &TopicMetaInfo{PartitionNum: 1, Replica: 1}))
+	exist, err = lookupdMgr.IsExistTopic(topicName)
+	test.Nil(t, err)
+	test.Equal(t, true, exist)
+	test.Nil(t, lookupdMgr.CreateTopicPartition(topicName, partition))
+	test.Equal(t, ErrKeyAlreadyExist, lookupdMgr.CreateTopicPartition(topicName, partition))
+	exist, err = lookupdMgr.IsExistTopicPartition(topicName, partition)
+	test.Nil(t, err)
+	test.Equal(t, true, exist)
+
+	replicaInfo := &TopicPartitionReplicaInfo{
+		Leader: nodeInfo.GetID(),
+		ISR:    []string{nodeInfo.GetID()},
+	}
+	test.Nil(t, lookupdMgr.UpdateTopicNodeInfo(topicName, partition, replicaInfo, 0))
+	test.Equal(t, ErrKeyAlreadyExist, lookupdMgr.UpdateTopicNodeInfo(topicName, partition, replicaInfo, 0))
+	oldEpoch := replicaInfo.Epoch
+	replicaInfo.ISR = append(replicaInfo.ISR, "n-2")
+	test.Nil(t, lookupdMgr.UpdateTopicNodeInfo(topicName, partition, replicaInfo, oldEpoch))
+	test.Equal(t, true, replicaInfo.Epoch > oldEpoch)
+	// the epoch mismatch should fail
+	test.Equal(t, ErrKeyCompareFailed, lookupdMgr.UpdateTopicNodeInfo(topicName, partition, replicaInfo, oldEpoch))
+
+	topicInfo, err := nodeMgr.GetTopicInfo(topicName, partition)
+	test.Nil(t, err)
+	test.Equal(t, nodeInfo.GetID(), topicInfo.Leader)
+	test.Equal(t, 2, len(topicInfo.ISR))
+	test.Equal(t, replicaInfo.Epoch, topicInfo.Epoch)
+	topics, err := lookupdMgr.ScanTopics()
+	test.Nil(t, err)
+	test.Equal(t, 1, len(topics))
+	test.Equal(t, replicaInfo.Epoch, topics[0].Epoch)
+	test.Equal(t, 1, topics[0].PartitionNum)
+
+	meta, metaEpoch, err := lookupdMgr.GetTopicMetaInfo(topicName)
+	test.Nil(t, err)
+	meta.RetentionDay = 3
+	test.Nil(t, lookupdMgr.UpdateTopicMetaInfo(topicName, &meta, metaEpoch))
+	test.Equal(t, ErrKeyCompareFailed, lookupdMgr.UpdateTopicMetaInfo(topicName, &meta, metaEpoch))
+	meta, _, err = lookupdMgr.GetTopicMetaInfo(topicName)
+	test.Nil(t, err)
+	test.Equal(t, int32(3), meta.RetentionDay)
+
+	test.Nil(t, nodeMgr.AcquireTopicLeader(topicName, partition, nodeInfo, topicInfo.Epoch))
+	test.Equal(t, ErrKeyAlreadyExist, nodeMgr2.AcquireTopicLeader(topicName, partition, nodeInfo2, topicInfo.Epoch))
+	session, err := lookupdMgr.GetTopicLeaderSession(topicName, partition)
+	test.Nil(t, err)
+	test.Equal(t, nodeInfo.GetID(), session.LeaderNode.GetID())
+	test.Nil(t, nodeMgr.ReleaseTopicLeader(topicName, partition, session))
+	_, err = nodeMgr.GetTopicLeaderSession(topicName, partition)
+	test.Equal(t, ErrKeyNotFound, err)
+
+	test.Nil(t, lookupdMgr.DeleteTopic(topicName, partition))
+	exist, err = lookupdMgr.IsExistTopicPartition(topicName, partition)
+	test.Nil(t, err)
+	test.Equal(t, false, exist)
+	test.Nil(t, lookupdMgr.DeleteWholeTopic(topicName))
+	exist, err = lookupdMgr.IsExistTopic(topicName)
+	test.Nil(t, err)
+	test.Equal(t, false, exist)
+
+	// the lookup leader should be released after stopped
+	close(stop)
+	for range nsqdsCh {
+	}
+	for range lookupLeaderCh {
+	}
+	for range nodeLeaderCh {
+	}
+	_, err = lookupdMgr.client.Get(lookupdMgr.leaderSessionPath, true)
+	test.Equal(t, ErrKeyNotFound, err)
+	test.Nil(t, nodeMgr.UnregisterNsqd(nodeInfo))
+}
+
+func TestEtcdV3LeaderFailover(t *testing.T) {
+	coordLog.Logger = newTestLogger(t)
+	tmpDir, err := ioutil.TempDir("", "etcdv3-test")
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	e, addr := startTestEtcdV3(t, tmpDir)
+	defer e.Close()
+	clusterID := "test-nsq-cluster-unit-test-etcdv3-failover"
+
+	lookupdInfos := []*NsqLookupdNodeInfo{
+		{ID: "l-1", NodeIP: "127.0.0.1"},
+		{ID: "l-2", NodeIP: "127.0.0.2"},
+	}
+	var leaderChs []chan *NsqLookupdNodeInfo
+	var stops []chan struct{}
+	for _, info := range lookupdInfos {
+		mgr, err := NewNsqLookupdEtcdV3Mgr(addr, "", "")
+		test.Nil(t, err)
+		mgr.InitClusterID(clusterID)
+		defer mgr.Stop()
+		test.Nil(t, mgr.Register(info))
+		defer mgr.Unregister(info)
+		ch := make(chan *NsqLookupdNodeInfo, 1)
+		stop := make(chan struct{})
+		mgr.AcquireAndWatchLeader(ch, stop)
+		leaderChs = append(leaderChs, ch)
+		stops = append(stops, stop)
+		select {
+		case leader := <-ch:
+			test.Equal(t, "l-1", leader.ID)
+		case <-time.After(time.Second * 10):
+			t.Fatal("acquire lookup leader timeout")
+		}
+	}
+	close(stops[0])
+	for range leaderChs[0] {
+	}
+	timeout := time.After(time.Second * 10)
+	for {
+		select {
+		case leader := <-leaderChs[1]:
+			if leader.ID == "" {
+				continue
+			}
+			test.Equal(t, "l-2", leader.ID)
+		case <-timeout:
+			t.Fatal("lookup leader failover timeout")
+		}
+		break
+	}
+	close(stops[1])
+	for range leaderChs[1] {
+	}
+}
+
+func TestEtcdV3MigrateFromV2(t *testing.T) {
+	coordLog.Logger = newTestLogger(t)
+	tmpDir, err := ioutil.TempDir("", "etcdv3-test")
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	stores := startTestRaftStores(t, path.Join(tmpDir, "raft"), 1)
+	defer stores[0].Stop()
+	e, addr := startTestEtcdV3(t, path.Join(tmpDir, "etcdv3"))
+	defer e.Close()
+	clusterID := "test-nsq-cluster-unit-test-etcdv3-migrate"
+
+	v2Mgr, err := NewNsqLookupdEtcdMgr(stores[0].Addresses(), "", "")
+	test.Nil(t, err)
+	v2Mgr.InitClusterID(clusterID)
+	lookupdInfo := &NsqLookupdNodeInfo{ID: "l-1", NodeIP: "127.0.0.1"}
+	test.Nil(t, v2Mgr.Register(lookupdInfo))
+	defer func() {
+		v2Mgr.Unregister(lookupdInfo)
+		v2Mgr.Stop()
+		// wait the refreshing in progress done before the store stopped
+		time.Sleep(time.Second)
+	}()
+	topicName := "migrate-topic"
+	test.Nil(t, v2Mgr.CreateTopic(topicName, &TopicMetaInfo{PartitionNum: 2, Replica: 1}))
+	for i := 0; i < 2; i++ {
+		test.Nil(t, v2Mgr.CreateTopicPartition(topicName, i))
+		test.Nil(t, v2Mgr.UpdateTopicNodeInfo(topicName, i, &TopicPartitionReplicaInfo{
+			Leader: "n-1",
+			ISR:    []string{"n-1"},
+		}, 0))
+	}
+	v2Topics, err := v2Mgr.ScanTopics()
+	test.Nil(t, err)
+	test.Equal(t, 2, len(v2Topics))
+
+	v2Client, err := NewEClient(stores[0].Addresses(), "", "")
+	test.Nil(t, err)
+	v3Client, err := NewEV3Client(addr, "", "")
+	test.Nil(t, err)
+	defer v3Client.Close()
+	keys, err := MigrateLeadershipToV3(v2Client, nil, true)
+	test.Nil(t, err)
+	for _, k := range keys {
+		// the registered node with ttl should be ignored
+		test.NotEqual(t, v2Mgr.createLookupdPath(lookupdInfo), k)
+	}
+	migrated, err := MigrateLeadershipToV3(v2Client, v3Client, false)
+	test.Nil(t, err)
+	test.Equal(t, keys, migrated)
+	_, err = MigrateLeadershipToV3(v2Client, v3Client, false)
+	test.Equal(t, ErrEtcdV3NotEmpty, err)
+
+	v3Mgr, err := NewNsqLookupdEtcdV3Mgr(addr, "", "")
+	test.Nil(t, err)
+	v3Mgr.InitClusterID(clusterID)
+	defer v3Mgr.Stop()
+	_, err = v3Mgr.GetClusterEpoch()
+	test.Nil(t, err)
+	v3Topics, err := v3Mgr.ScanTopics()
+	test.Nil(t, err)
+	test.Equal(t, 2, len(v3Topics))
+	for _, v2t := range v2Topics {
+		v3t, err := v3Mgr.GetTopicInfo(topicName, v2t.Partition)
+		test.Nil(t, err)
+		test.Equal(t, v2t.Leader, v3t.Leader)
+		test.Equal(t, v2t.ISR, v3t.ISR)
+		test.Equal(t, v2t.PartitionNum, v3t.PartitionNum)
+		// the epoch should never go back after migrated
+		test.Equal(t, true, v3t.Epoch > v2t.Epoch)
+		exist, err := v3Mgr.IsExistTopicPartition(topicName, v2t.Partition)
+		test.Nil(t, err)
+		test.Equal(t, true, exist)
+		test.Equal(t, ErrKeyAlreadyExist, v3Mgr.CreateTopicPartition(topicName, v2t.Partition))
+		v3t.ISR = append(v3t.ISR, "n-2")
+		test.Nil(t, v3Mgr.UpdateTopicNodeInfo(topicName, v2t.Partition, &v3t.TopicPartitionReplicaInfo, v3t.Epoch))
+	}
+}
@@ -43,6 +43,9 @@ type NsqdNodeInfo struct {
 	TcpPort  string
 	RpcPort  string
 	HttpPort string
+	// the rack or zone label of the node, the replicas of a partition
+	// will be spread across the different zones.
+	Zone string `json:",omitempty"`
 }
 
 func (self *NsqdNodeInfo) GetID() string {
@@ -84,17 +87,45 @@ type TopicMetaInfo struct {
 	MultiPart bool
 	//used for message ext
 	Ext bool
+	// the min replicas (include leader) in isr should be synced before the write is
+	// acknowledged to producer, the write will be rejected if the isr is less than it.
+	// 0 means no limit and depends on the ack mode of producer.
+	MinInSync int `json:",omitempty"`
+	// the compression (snappy or zstd) for the topic data, empty means no compression.
+	Compression string `json:",omitempty"`
+	// keep only the newest message of each compact key (in the json ext header) in the old data,
+	// the topic should be ext.
+	Compact bool `json:",omitempty"`
+	// the target partition number while shrinking, the partitions not less than it will be
+	// removed after all the channels consumed them. 0 means not shrinking.
+	ShrinkTo int `json:",omitempty"`
+	// the http addresses (comma separated) of the lookupd in the remote cluster, the topic
+	// will mirror the same topic from the remote cluster and the producer writes are not allowed.
+	MirrorFrom string `json:",omitempty"`
 }
 
 func (tmi *TopicMetaInfo) AllowMulti() bool {
 	return tmi.OrderedMulti || tmi.MultiPart
 }
 
+// IsPartitionShrinking return true if the partition is not writable while the topic is shrinking.
+// All the partitions of the ordered topic are not writable until the shrink is done, since the
+// partition of the sharding key will be changed.
+func (tmi *TopicMetaInfo) IsPartitionShrinking(pid int) bool {
+	if tmi.ShrinkTo <= 0 {
+		return false
+	}
+	return tmi.OrderedMulti || pid >= tmi.ShrinkTo
+}
+
 type TopicPartitionReplicaInfo struct {
 	Leader      string
 	ISR         []string
 	CatchupList []string
 	Channels    []string
+	// the leader assigned while the partition replicas allocated, leadership will be
+	// moved back to the preferred leader after it is back in isr.
+	PreferredLeader string `json:",omitempty"`
 	// this is only used for write operation
 	// if this changed during write, mean the current write should be abort
 	EpochForWrite EpochType
@@ -103,12 +134,13 @@ type TopicPartitionReplicaInfo struct {
 
 func (self *TopicPartitionReplicaInfo) Copy() *TopicPartitionReplicaInfo {
 	n := &TopicPartitionReplicaInfo{
-		Leader:        self.Leader,
-		ISR:           make([]string, len(self.ISR)),
-		CatchupList:   make([]string, len(self.CatchupList)),
-		Channels:      make([]string, len(self.Channels)),
-		EpochForWrite: self.EpochForWrite,
-		Epoch:         self.Epoch,
+		Leader:          self.Leader,
+		ISR:             make([]string, len(self.ISR)),
+		CatchupList:     make([]string, len(self.CatchupList)),
+		Channels:        make([]string, len(self.Channels)),
+		PreferredLeader: self.PreferredLeader,
+		EpochForWrite:   self.EpochForWrite,
+		Epoch:           self.Epoch,
 	}
 	copy(n.ISR, self.ISR)
 	copy(n.CatchupList, self.CatchupList)
@@ -116,6 +148,23 @@ func (self *TopicPartitionReplicaInfo) Copy() *TopicPartitionReplicaInfo {
 	return n
 }
 
+// GetPreferredLeader return the preferred leader of the partition, the first replica in
+// the assigned isr order is used for the old partition without the preferred leader.
+// Empty will be returned if the preferred leader is removed from both the isr and catchup list.
+func (self *TopicPartitionReplicaInfo) GetPreferredLeader() string {
+	if self.PreferredLeader == "" {
+		if len(self.ISR) > 0 {
+			return self.ISR[0]
+		}
+		return ""
+	}
+	if FindSlice(self.ISR, self.PreferredLeader) == -1 &&
+		FindSlice(self.CatchupList, self.PreferredLeader) == -1 {
+		return ""
+	}
+	return self.PreferredLeader
+}
+
 type TopicPartitionMetaInfo struct {
 	Name      string
 	Partition int
@@ -214,6 +263,18 @@ type NSQLookupdLeadership interface {
 	ReleaseTopicLeader(topic string, partition int, session *TopicLeaderSession) error
 	// get topic meta info map with passing topics slice
 	GetTopicsMetaInfoMap(topics []string) (map[string]TopicMetaInfo, error)
+	// get the partition reassignment plan of the cluster, the epoch in plan should be set,
+	// if not exist should return ErrKeyNotFound as error
+	GetReassignPlan() (*ReassignPlan, error)
+	// save the reassignment plan, should do check-and-set with the old epoch and create
+	// the plan if old epoch is 0. The epoch in plan should be updated to the new epoch.
+	UpdateReassignPlan(plan *ReassignPlan, oldGen EpochType) error
+	// the consumer groups are saved while the members or assignment changed, so the
+	// new lookupd leader can continue with the same generation.
+	GetAllConsumerGroups() ([]ConsumerGroupInfo, error)
+	UpdateConsumerGroup(group *ConsumerGroupInfo) error
+	// should return nil if the group not exist
+	DeleteConsumerGroup(topic string, channel string) error
 }
 
 type NSQDLeadership interface {
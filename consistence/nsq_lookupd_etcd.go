@@ -69,6 +69,7 @@ type NsqLookupdEtcdMgr struct {
 	nodeValue         string
 
 	refreshStopCh        chan bool
+	refreshWg            sync.WaitGroup
 	watchTopicsStopCh    chan bool
 	watchNsqdNodesStopCh chan bool
 
@@ -111,6 +112,7 @@ func (self *NsqLookupdEtcdMgr) Register(value *NsqLookupdNodeInfo) error {
 	}
 	if self.refreshStopCh != nil {
 		close(self.refreshStopCh)
+		self.refreshWg.Wait()
 	}
 
 	self.leaderStr = string(valueB)
@@ -122,12 +124,14 @@ func (self *NsqLookupdEtcdMgr) Register(value *NsqLookupdNodeInfo) error {
 	}
 	self.refreshStopCh = make(chan bool, 1)
 	// start to refresh
+	self.refreshWg.Add(1)
 	go self.refresh(self.refreshStopCh)
 
 	return nil
 }
 
 func (self *NsqLookupdEtcdMgr) refresh(stopC <-chan bool) {
+	defer self.refreshWg.Done()
 	for {
 		select {
 		case <-stopC:
@@ -146,10 +150,11 @@ func (self *NsqLookupdEtcdMgr) refresh(stopC <-chan bool) {
 }
 
 func (self *NsqLookupdEtcdMgr) Unregister(value *NsqLookupdNodeInfo) error {
-	// stop to refresh
+	// stop to refresh and wait the refreshing in progress done
 	if self.refreshStopCh != nil {
 		close(self.refreshStopCh)
 		self.refreshStopCh = nil
+		self.refreshWg.Wait()
 	}
 
 	_, err := self.client.Delete(self.createLookupdPath(value), false)
@@ -211,7 +216,7 @@ func (self *NsqLookupdEtcdMgr) GetAllLookupdNodes() ([]NsqLookupdNodeInfo, error
 
 func (self *NsqLookupdEtcdMgr) AcquireAndWatchLeader(leader chan *NsqLookupdNodeInfo, stop chan struct{}) {
 	master := NewMaster(self.client, self.leaderSessionPath, self.leaderStr, ETCD_TTL)
-	go self.processMasterEvents(master, leader, stop)
+	go processLookupdMasterEvents(master, leader, stop)
 	master.Start()
 }
 
@@ -241,7 +246,7 @@ func (self *NsqLookupdEtcdMgr) GetTopicsMetaInfoMap(topics []string) (map[string
 	return topicMetaInfoCache, nil
 }
 
-func (self *NsqLookupdEtcdMgr) processMasterEvents(master Master, leader chan *NsqLookupdNodeInfo, stop chan struct{}) {
+func processLookupdMasterEvents(master Master, leader chan *NsqLookupdNodeInfo, stop chan struct{}) {
 	for {
 		select {
 		case e := <-master.GetEventsChan():
@@ -832,6 +837,81 @@ func (self *NsqLookupdEtcdMgr) ReleaseTopicLeader(topic string, partition int, s
 	return err
 }
 
+func (self *NsqLookupdEtcdMgr) GetReassignPlan() (*ReassignPlan, error) {
+	rsp, err := self.client.GetNewest(self.createReassignPlanPath(), false, false)
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			return nil, ErrKeyNotFound
+		}
+		return nil, err
+	}
+	var plan ReassignPlan
+	err = json.Unmarshal([]byte(rsp.Node.Value), &plan)
+	if err != nil {
+		return nil, err
+	}
+	plan.Epoch = EpochType(rsp.Node.ModifiedIndex)
+	return &plan, nil
+}
+
+func (self *NsqLookupdEtcdMgr) UpdateReassignPlan(plan *ReassignPlan, oldGen EpochType) error {
+	value, err := json.Marshal(plan)
+	if err != nil {
+		return err
+	}
+	var rsp *client.Response
+	if oldGen == 0 {
+		rsp, err = self.client.Create(self.createReassignPlanPath(), string(value), 0)
+		if err != nil && IsEtcdNodeExist(err) {
+			return ErrKeyAlreadyExist
+		}
+	} else {
+		rsp, err = self.client.CompareAndSwap(self.createReassignPlanPath(), string(value), 0, "", uint64(oldGen))
+	}
+	if err != nil {
+		return err
+	}
+	plan.Epoch = EpochType(rsp.Node.ModifiedIndex)
+	return nil
+}
+
+func (self *NsqLookupdEtcdMgr) GetAllConsumerGroups() ([]ConsumerGroupInfo, error) {
+	rsp, err := self.client.GetNewest(self.createConsumerGroupRootPath(), false, false)
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	groups := make([]ConsumerGroupInfo, 0, len(rsp.Node.Nodes))
+	for _, node := range rsp.Node.Nodes {
+		var group ConsumerGroupInfo
+		if err = json.Unmarshal([]byte(node.Value), &group); err != nil {
+			coordLog.Warningf("consumer group %v invalid: %v", node.Key, err)
+			continue
+		}
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
+func (self *NsqLookupdEtcdMgr) UpdateConsumerGroup(group *ConsumerGroupInfo) error {
+	value, err := json.Marshal(group)
+	if err != nil {
+		return err
+	}
+	_, err = self.client.Set(self.createConsumerGroupPath(group.Topic, group.Channel), string(value), 0)
+	return err
+}
+
+func (self *NsqLookupdEtcdMgr) DeleteConsumerGroup(topic string, channel string) error {
+	_, err := self.client.Delete(self.createConsumerGroupPath(topic, channel), false)
+	if err != nil && client.IsKeyNotFound(err) {
+		return nil
+	}
+	return err
+}
+
 func (self *NsqLookupdEtcdMgr) createClusterPath() string {
 	return path.Join("/", NSQ_ROOT_DIR, self.clusterID)
 }
@@ -848,6 +928,18 @@ func (self *NsqLookupdEtcdMgr) createLookupdLeaderPath() string {
 	return path.Join("/", NSQ_ROOT_DIR, self.clusterID, NSQ_LOOKUPD_DIR, NSQ_LOOKUPD_LEADER_SESSION)
 }
 
+func (self *NsqLookupdEtcdMgr) createReassignPlanPath() string {
+	return path.Join("/", NSQ_ROOT_DIR, self.clusterID, NSQ_LOOKUPD_DIR, NSQ_LOOKUPD_REASSIGN_PLAN)
+}
+
+func (self *NsqLookupdEtcdMgr) createConsumerGroupRootPath() string {
+	return path.Join("/", NSQ_ROOT_DIR, self.clusterID, NSQ_LOOKUPD_DIR, NSQ_LOOKUPD_CONSUMER_GROUP)
+}
+
+func (self *NsqLookupdEtcdMgr) createConsumerGroupPath(topic string, channel string) string {
+	return path.Join(self.createConsumerGroupRootPath(), getGroupKey(topic, channel))
+}
+
 func (self *NsqLookupdEtcdMgr) createNsqdRootPath() string {
 	return path.Join("/", NSQ_ROOT_DIR, self.clusterID, NSQ_NODE_DIR)
 }
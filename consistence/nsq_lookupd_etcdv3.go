@@ -0,0 +1,816 @@
+package consistence
+
+import (
+	"encoding/json"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"go.etcd.io/etcd/clientv3"
+	"go.etcd.io/etcd/mvcc/mvccpb"
+	"golang.org/x/net/context"
+)
+
+// NsqLookupdEtcdV3Mgr is the same as NsqLookupdEtcdMgr but using the etcd v3 api,
+// the keys in v3 is the same as the path in v2 and the epoch is the modify revision of the key.
+type NsqLookupdEtcdV3Mgr struct {
+	tmiMutex sync.RWMutex
+	cache    *lru.ARCCache
+
+	client            *EtcdV3Client
+	clusterID         string
+	topicRoot         string
+	clusterPath       string
+	leaderSessionPath string
+	leaderStr         string
+	lookupdRootPath   string
+	topicMetaInfos    []TopicPartitionMetaInfo
+	topicMetaMap      map[string]TopicMetaInfo
+	ifTopicChanged    int32
+	ifTopicScanning   int32
+	nodeInfo          *NsqLookupdNodeInfo
+	nodeKey           string
+	nodeValue         string
+
+	refreshStopCh        chan bool
+	watchTopicsStopCh    chan bool
+	watchNsqdNodesStopCh chan bool
+	wg                   sync.WaitGroup
+
+	topicReplicasMap map[string]map[int]TopicPartitionReplicaInfo
+}
+
+func NewNsqLookupdEtcdV3Mgr(host, username, pwd string) (*NsqLookupdEtcdV3Mgr, error) {
+	client, err := NewEV3Client(host, username, pwd)
+	if err != nil {
+		return nil, err
+	}
+	err = client.LoadEpochBase()
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	c, _ := lru.NewARC(10000)
+	return &NsqLookupdEtcdV3Mgr{
+		client:               client,
+		ifTopicChanged:       1,
+		ifTopicScanning:      0,
+		watchTopicsStopCh:    make(chan bool, 1),
+		watchNsqdNodesStopCh: make(chan bool, 1),
+		topicMetaMap:         make(map[string]TopicMetaInfo),
+		topicReplicasMap:     make(map[string]map[int]TopicPartitionReplicaInfo),
+		cache:                c,
+	}, nil
+}
+
+func (self *NsqLookupdEtcdV3Mgr) InitClusterID(id string) {
+	self.clusterID = id
+	self.topicRoot = self.createTopicRootPath()
+	self.clusterPath = self.createClusterPath()
+	self.leaderSessionPath = self.createLookupdLeaderPath()
+	self.lookupdRootPath = self.createLookupdRootPath()
+	self.wg.Add(1)
+	go func() {
+		defer self.wg.Done()
+		self.watchTopics()
+	}()
+}
+
+func (self *NsqLookupdEtcdV3Mgr) Register(value *NsqLookupdNodeInfo) error {
+	self.nodeInfo = value
+	valueB, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	if self.refreshStopCh != nil {
+		close(self.refreshStopCh)
+		self.refreshStopCh = nil
+	}
+	// the cluster dir in v2 is used as the cluster epoch, so we create it as an empty key
+	_, _, err = self.client.CreateIfNotExist(self.clusterPath, "", clientv3.NoLease)
+	if err != nil && err != ErrKeyNotFound {
+		return err
+	}
+
+	self.leaderStr = string(valueB)
+	self.nodeKey = self.createLookupdPath(value)
+	self.nodeValue = string(valueB)
+	refreshStopCh := make(chan bool, 1)
+	err = self.client.PutWithKeepAlive(self.nodeKey, self.nodeValue, ETCD_TTL, refreshStopCh)
+	if err != nil {
+		return err
+	}
+	self.refreshStopCh = refreshStopCh
+	return nil
+}
+
+func (self *NsqLookupdEtcdV3Mgr) Unregister(value *NsqLookupdNodeInfo) error {
+	// stop to keepalive
+	if self.refreshStopCh != nil {
+		close(self.refreshStopCh)
+		self.refreshStopCh = nil
+	}
+
+	err := self.client.Delete(self.createLookupdPath(value))
+	if err != nil {
+		coordLog.Warningf("cluser[%v] node[%v] unregister failed: %v", self.clusterID, value, err)
+		return err
+	}
+	return nil
+}
+
+func (self *NsqLookupdEtcdV3Mgr) Stop() {
+	if self.watchNsqdNodesStopCh != nil {
+		close(self.watchNsqdNodesStopCh)
+	}
+	if self.watchTopicsStopCh != nil {
+		close(self.watchTopicsStopCh)
+	}
+	self.wg.Wait()
+}
+
+func (self *NsqLookupdEtcdV3Mgr) GetClusterEpoch() (EpochType, error) {
+	kv, err := self.client.Get(self.clusterPath, false)
+	if err != nil {
+		return 0, err
+	}
+	return self.client.ToEpoch(kv.ModRevision), nil
+}
+
+func (self *NsqLookupdEtcdV3Mgr) GetAllLookupdNodes() ([]NsqLookupdNodeInfo, error) {
+	tn := time.Now()
+	cv, ok := getCacheValue(self.cache, self.lookupdRootPath, tn)
+	if ok {
+		return cv.([]NsqLookupdNodeInfo), nil
+	}
+	kvs, _, err := self.client.GetChildren(self.lookupdRootPath, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(kvs) == 0 {
+		return nil, ErrKeyNotFound
+	}
+	lookupdNodeList := make([]NsqLookupdNodeInfo, 0)
+	for _, kv := range kvs {
+		var nodeInfo NsqLookupdNodeInfo
+		if err = json.Unmarshal(kv.Value, &nodeInfo); err != nil {
+			continue
+		}
+		lookupdNodeList = append(lookupdNodeList, nodeInfo)
+	}
+	putCacheValue(self.cache, self.lookupdRootPath, lookupdNodeList, tn, time.Second)
+	return lookupdNodeList, nil
+}
+
+func (self *NsqLookupdEtcdV3Mgr) AcquireAndWatchLeader(leader chan *NsqLookupdNodeInfo, stop chan struct{}) {
+	master := NewEtcdV3Master(self.client, self.leaderSessionPath, self.leaderStr, ETCD_TTL)
+	go processLookupdMasterEvents(master, leader, stop)
+	master.Start()
+}
+
+func (self *NsqLookupdEtcdV3Mgr) GetTopicsMetaInfoMap(topics []string) (map[string]TopicMetaInfo, error) {
+	topicMetaInfoCache := make(map[string]TopicMetaInfo)
+	if atomic.LoadInt32(&self.ifTopicChanged) == 1 {
+		for _, topic := range topics {
+			topicMeta, _, err := self.GetTopicMetaInfo(topic)
+			if err != nil {
+				return nil, err
+			}
+			topicMetaInfoCache[topic] = topicMeta
+		}
+	} else {
+		self.tmiMutex.RLock()
+		defer self.tmiMutex.RUnlock()
+		for _, topic := range topics {
+			topicMeta, exist := self.topicMetaMap[topic]
+			if !exist {
+				topicMetaInfoCache[topic] = TopicMetaInfo{}
+			} else {
+				topicMetaInfoCache[topic] = topicMeta
+			}
+		}
+	}
+	return topicMetaInfoCache, nil
+}
+
+func (self *NsqLookupdEtcdV3Mgr) GetNsqdNodes() ([]NsqdNodeInfo, error) {
+	nodes, _, err := self.getNsqdNodes(false)
+	return nodes, err
+}
+
+func (self *NsqLookupdEtcdV3Mgr) WatchNsqdNodes(nsqds chan []NsqdNodeInfo, stop chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-self.watchNsqdNodesStopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	key := self.createNsqdRootPath()
+	nsqdNodes, rev, err := self.getNsqdNodes(false)
+	for err != nil {
+		coordLog.Errorf("key[%s] getNsqdNodes error: %s", key, err.Error())
+		select {
+		case <-ctx.Done():
+			close(nsqds)
+			return
+		case <-time.After(time.Second):
+		}
+		nsqdNodes, rev, err = self.getNsqdNodes(true)
+	}
+	for {
+		select {
+		case nsqds <- nsqdNodes:
+		case <-ctx.Done():
+			close(nsqds)
+			return
+		}
+		watcher := self.client.Watch(ctx, key, rev+1, true)
+		for wrsp := range watcher {
+			if wrsp.Err() != nil {
+				coordLog.Errorf("watcher key[%s] error: %s", key, wrsp.Err().Error())
+				break
+			}
+			rev = wrsp.Header.Revision
+			nsqdNodes, _, err = self.getNsqdNodes(true)
+			if err != nil {
+				coordLog.Errorf("key[%s] getNsqdNodes error: %s", key, err.Error())
+				continue
+			}
+			select {
+			case nsqds <- nsqdNodes:
+			case <-ctx.Done():
+				close(nsqds)
+				return
+			}
+		}
+		if ctx.Err() != nil {
+			coordLog.Infof("watch key[%s] canceled.", key)
+			close(nsqds)
+			return
+		}
+		// rewatch since the watch is broken or the revision is compacted,
+		// and we should get the nodes to notify watcher since last watch is broken.
+		for {
+			select {
+			case <-ctx.Done():
+				close(nsqds)
+				return
+			case <-time.After(time.Second):
+			}
+			nsqdNodes, rev, err = self.getNsqdNodes(true)
+			if err == nil {
+				break
+			}
+			coordLog.Errorf("rewatch and get key[%s] error: %s", key, err.Error())
+		}
+	}
+}
+
+func (self *NsqLookupdEtcdV3Mgr) getNsqdNodes(upToDate bool) ([]NsqdNodeInfo, int64, error) {
+	kvs, rev, err := self.client.GetChildren(self.createNsqdRootPath(), upToDate)
+	if err != nil {
+		return nil, 0, err
+	}
+	nsqdNodes := make([]NsqdNodeInfo, 0)
+	for _, kv := range kvs {
+		var nodeInfo NsqdNodeInfo
+		err := json.Unmarshal(kv.Value, &nodeInfo)
+		if err != nil {
+			continue
+		}
+		nsqdNodes = append(nsqdNodes, nodeInfo)
+	}
+	return nsqdNodes, rev, nil
+}
+
+func (self *NsqLookupdEtcdV3Mgr) GetAllTopicMetas() (map[string]TopicMetaInfo, error) {
+	self.tmiMutex.RLock()
+	topicMetas := self.topicMetaMap
+	self.tmiMutex.RUnlock()
+	return topicMetas, nil
+}
+
+func (self *NsqLookupdEtcdV3Mgr) ScanTopics() ([]TopicPartitionMetaInfo, error) {
+	if atomic.LoadInt32(&self.ifTopicChanged) == 1 {
+		return self.scanTopics()
+	}
+
+	self.tmiMutex.RLock()
+	topicMetaInfos := self.topicMetaInfos
+	self.tmiMutex.RUnlock()
+	return topicMetaInfos, nil
+}
+
+// watch topics if changed
+func (self *NsqLookupdEtcdV3Mgr) watchTopics() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-self.watchTopicsStopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	for {
+		_, rev, err := self.client.GetChildren(self.topicRoot, false)
+		if err != nil {
+			coordLog.Errorf("get topic root key[%s] error: %s", self.topicRoot, err.Error())
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+		// watch broken or compacted should be treated as changed of node
+		atomic.StoreInt32(&self.ifTopicChanged, 1)
+		watcher := self.client.Watch(ctx, self.topicRoot, rev+1, true)
+		for wrsp := range watcher {
+			if wrsp.Err() != nil {
+				coordLog.Errorf("watcher key[%s] error: %s", self.topicRoot, wrsp.Err().Error())
+				break
+			}
+			coordLog.Debugf("topic changed: %v", len(wrsp.Events))
+			atomic.StoreInt32(&self.ifTopicChanged, 1)
+		}
+		if ctx.Err() != nil {
+			coordLog.Infof("watch key[%s] canceled.", self.topicRoot)
+			return
+		}
+	}
+}
+
+func (self *NsqLookupdEtcdV3Mgr) isCacheNewest() bool {
+	if atomic.LoadInt32(&self.ifTopicChanged) == 1 {
+		return false
+	}
+	if atomic.LoadInt32(&self.ifTopicScanning) == 1 {
+		return false
+	}
+	return true
+}
+
+func (self *NsqLookupdEtcdV3Mgr) scanTopics() ([]TopicPartitionMetaInfo, error) {
+	atomic.StoreInt32(&self.ifTopicScanning, 1)
+	defer atomic.StoreInt32(&self.ifTopicScanning, 0)
+	atomic.StoreInt32(&self.ifTopicChanged, 0)
+	kvs, _, err := self.client.GetChildren(self.topicRoot, true)
+	if err != nil {
+		atomic.StoreInt32(&self.ifTopicChanged, 1)
+		return nil, err
+	}
+	if len(kvs) == 0 {
+		return nil, ErrKeyNotFound
+	}
+
+	topicMetaMap := make(map[string]TopicMetaInfo)
+	topicReplicasMap := make(map[string]map[int]TopicPartitionReplicaInfo)
+	err = self.processTopicKVs(kvs, topicMetaMap, topicReplicasMap)
+	if err != nil {
+		atomic.StoreInt32(&self.ifTopicChanged, 1)
+		return nil, err
+	}
+
+	topicMetaInfos := make([]TopicPartitionMetaInfo, 0)
+	for k, v := range topicReplicasMap {
+		topicMeta, ok := topicMetaMap[k]
+		if !ok {
+			continue
+		}
+		for partition, v2 := range v {
+			var topicInfo TopicPartitionMetaInfo
+			topicInfo.Name = k
+			topicInfo.Partition = partition
+			topicInfo.TopicMetaInfo = topicMeta
+			topicInfo.TopicPartitionReplicaInfo = v2
+			topicMetaInfos = append(topicMetaInfos, topicInfo)
+		}
+	}
+
+	self.tmiMutex.Lock()
+	self.topicMetaInfos = topicMetaInfos
+	self.topicMetaMap = topicMetaMap
+	self.topicReplicasMap = topicReplicasMap
+	self.tmiMutex.Unlock()
+	self.cache.Purge()
+
+	return topicMetaInfos, nil
+}
+
+func (self *NsqLookupdEtcdV3Mgr) processTopicKVs(kvs []*mvccpb.KeyValue,
+	topicMetaMap map[string]TopicMetaInfo,
+	topicReplicasMap map[string]map[int]TopicPartitionReplicaInfo) error {
+	for _, kv := range kvs {
+		keys := strings.Split(string(kv.Key), "/")
+		keyLen := len(keys)
+		key := keys[keyLen-1]
+		if key == NSQ_TOPIC_REPLICA_INFO {
+			var rInfo TopicPartitionReplicaInfo
+			if err := json.Unmarshal(kv.Value, &rInfo); err != nil {
+				coordLog.Infof("process topic info: %s failed: %v", string(kv.Key), err.Error())
+				return err
+			}
+			rInfo.Epoch = self.client.ToEpoch(kv.ModRevision)
+			if keyLen < 3 {
+				continue
+			}
+			topicName := keys[keyLen-3]
+			part, err := strconv.Atoi(keys[keyLen-2])
+			if err != nil {
+				coordLog.Infof("process topic info: %s failed: %v", string(kv.Key), err.Error())
+				continue
+			}
+			v, ok := topicReplicasMap[topicName]
+			if ok {
+				v[part] = rInfo
+			} else {
+				pMap := make(map[int]TopicPartitionReplicaInfo)
+				pMap[part] = rInfo
+				topicReplicasMap[topicName] = pMap
+			}
+		} else if key == NSQ_TOPIC_META {
+			var mInfo TopicMetaInfo
+			if err := json.Unmarshal(kv.Value, &mInfo); err != nil {
+				coordLog.Infof("process topic info: %s failed: %v", string(kv.Key), err.Error())
+				return err
+			}
+			if keyLen < 2 {
+				continue
+			}
+			topicMetaMap[keys[keyLen-2]] = mInfo
+		}
+	}
+	return nil
+}
+
+func (self *NsqLookupdEtcdV3Mgr) GetTopicInfo(topic string, partition int) (*TopicPartitionMetaInfo, error) {
+	var topicInfo TopicPartitionMetaInfo
+	metaInfo, _, err := self.GetTopicMetaInfoTryCache(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	topicInfo.TopicMetaInfo = metaInfo
+	var rInfo TopicPartitionReplicaInfo
+	found := false
+	notInCache := false
+	// try get cache first
+	if self.isCacheNewest() {
+		self.tmiMutex.RLock()
+		parts, ok := self.topicReplicasMap[topic]
+		if ok {
+			p, ok := parts[partition]
+			if ok {
+				rInfo = *(p.Copy())
+				found = true
+			} else {
+				notInCache = true
+			}
+		} else {
+			notInCache = true
+		}
+		self.tmiMutex.RUnlock()
+	}
+	if !found {
+		kv, err := self.client.Get(self.createTopicReplicaInfoPath(topic, partition), true)
+		if err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(kv.Value, &rInfo); err != nil {
+			return nil, err
+		}
+		if notInCache {
+			// not in local cached, but in the etcd, something changed
+			atomic.StoreInt32(&self.ifTopicChanged, 1)
+		}
+		rInfo.Epoch = self.client.ToEpoch(kv.ModRevision)
+	}
+	topicInfo.TopicPartitionReplicaInfo = rInfo
+	topicInfo.Name = topic
+	topicInfo.Partition = partition
+
+	return &topicInfo, nil
+}
+
+func (self *NsqLookupdEtcdV3Mgr) CreateTopicPartition(topic string, partition int) error {
+	_, err := self.client.Create(self.createTopicPartitionPath(topic, partition), "", clientv3.NoLease)
+	return err
+}
+
+func (self *NsqLookupdEtcdV3Mgr) CreateTopic(topic string, meta *TopicMetaInfo) error {
+	metaValue, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	_, err = self.client.Create(self.createTopicMetaPath(topic), string(metaValue), clientv3.NoLease)
+	if err != nil {
+		return err
+	}
+
+	self.tmiMutex.Lock()
+	self.topicMetaMap[topic] = *meta
+	self.tmiMutex.Unlock()
+
+	return nil
+}
+
+func (self *NsqLookupdEtcdV3Mgr) IsExistTopic(topic string) (bool, error) {
+	return self.client.IsExist(self.createTopicPath(topic))
+}
+
+func (self *NsqLookupdEtcdV3Mgr) IsExistTopicPartition(topic string, partitionNum int) (bool, error) {
+	return self.client.IsExist(self.createTopicPartitionPath(topic, partitionNum))
+}
+
+func (self *NsqLookupdEtcdV3Mgr) GetTopicMetaInfoTryCache(topic string) (TopicMetaInfo, bool, error) {
+	var metaInfo TopicMetaInfo
+	var ok bool
+	noInCache := false
+	if self.isCacheNewest() {
+		self.tmiMutex.RLock()
+		metaInfo, ok = self.topicMetaMap[topic]
+		if !ok {
+			noInCache = true
+		}
+		self.tmiMutex.RUnlock()
+	}
+	if ok {
+		return metaInfo, true, nil
+	}
+
+	mInfo, _, err := self.GetTopicMetaInfo(topic)
+	if err != nil {
+		return metaInfo, false, err
+	}
+	if noInCache {
+		atomic.StoreInt32(&self.ifTopicChanged, 1)
+	}
+	return mInfo, false, nil
+}
+
+func (self *NsqLookupdEtcdV3Mgr) GetTopicMetaInfo(topic string) (TopicMetaInfo, EpochType, error) {
+	var metaInfo TopicMetaInfo
+	kv, err := self.client.Get(self.createTopicMetaPath(topic), true)
+	if err != nil {
+		return metaInfo, 0, err
+	}
+	err = json.Unmarshal(kv.Value, &metaInfo)
+	if err != nil {
+		return metaInfo, 0, err
+	}
+	return metaInfo, self.client.ToEpoch(kv.ModRevision), nil
+}
+
+func (self *NsqLookupdEtcdV3Mgr) UpdateTopicMetaInfo(topic string, meta *TopicMetaInfo, oldGen EpochType) error {
+	value, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	coordLog.Infof("Update_topic meta info: %s %s %d", topic, string(value), oldGen)
+
+	self.tmiMutex.Lock()
+	defer self.tmiMutex.Unlock()
+	_, err = self.client.CompareAndSwap(self.createTopicMetaPath(topic), string(value), self.client.ToRevision(oldGen))
+	if err != nil {
+		return err
+	}
+	self.topicMetaMap[topic] = *meta
+	atomic.StoreInt32(&self.ifTopicChanged, 1)
+	return nil
+}
+
+func (self *NsqLookupdEtcdV3Mgr) DeleteWholeTopic(topic string) error {
+	self.tmiMutex.Lock()
+	delete(self.topicMetaMap, topic)
+	deleted, err := self.client.DeleteDir(self.createTopicPath(topic))
+	coordLog.Infof("delete whole topic: %v, %v, %v", topic, err, deleted)
+	if err == nil && deleted == 0 {
+		err = ErrKeyNotFound
+	}
+	atomic.StoreInt32(&self.ifTopicChanged, 1)
+	self.tmiMutex.Unlock()
+	return err
+}
+
+func (self *NsqLookupdEtcdV3Mgr) DeleteTopic(topic string, partition int) error {
+	_, err := self.client.DeleteDir(self.createTopicPartitionPath(topic, partition))
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt32(&self.ifTopicChanged, 1)
+	return nil
+}
+
+func (self *NsqLookupdEtcdV3Mgr) UpdateTopicNodeInfo(topic string, partition int, topicInfo *TopicPartitionReplicaInfo, oldGen EpochType) error {
+	value, err := json.Marshal(topicInfo)
+	if err != nil {
+		return err
+	}
+	coordLog.Infof("Update_topic info: %s %d %s %d", topic, partition, string(value), oldGen)
+	var rev int64
+	if oldGen == 0 {
+		rev, err = self.client.Create(self.createTopicReplicaInfoPath(topic, partition), string(value), clientv3.NoLease)
+	} else {
+		rev, err = self.client.CompareAndSwap(self.createTopicReplicaInfoPath(topic, partition), string(value), self.client.ToRevision(oldGen))
+	}
+	if err != nil {
+		return err
+	}
+	topicInfo.Epoch = self.client.ToEpoch(rev)
+	atomic.StoreInt32(&self.ifTopicChanged, 1)
+	return nil
+}
+
+func (self *NsqLookupdEtcdV3Mgr) GetTopicLeaderSession(topic string, partition int) (*TopicLeaderSession, error) {
+	etcdKey := self.createTopicLeaderSessionPath(topic, partition)
+	tn := time.Now()
+	if self.isCacheNewest() {
+		cv, ok := getCacheValue(self.cache, etcdKey, tn)
+		if ok {
+			return cv.(*TopicLeaderSession), nil
+		}
+	}
+
+	kv, err := self.client.Get(etcdKey, false)
+	if err != nil {
+		if err == ErrKeyNotFound {
+			return nil, ErrLeaderSessionNotExist
+		}
+		return nil, err
+	}
+	var topicLeaderSession TopicLeaderSession
+	if err = json.Unmarshal(kv.Value, &topicLeaderSession); err != nil {
+		return nil, err
+	}
+	putCacheValue(self.cache, etcdKey, &topicLeaderSession, tn, time.Minute*5)
+
+	return &topicLeaderSession, nil
+}
+
+func (self *NsqLookupdEtcdV3Mgr) ReleaseTopicLeader(topic string, partition int, session *TopicLeaderSession) error {
+	topicKey := self.createTopicLeaderSessionPath(topic, partition)
+	err := releaseTopicLeaderV3(self.client, topicKey, session)
+	if err != nil {
+		coordLog.Errorf("try release topic leader session [%s] error: %v", topicKey, err)
+	} else {
+		coordLog.Infof("try release topic leader session [%s] success: %v", topicKey, session)
+	}
+	return err
+}
+
+func (self *NsqLookupdEtcdV3Mgr) GetReassignPlan() (*ReassignPlan, error) {
+	kv, err := self.client.Get(self.createReassignPlanPath(), true)
+	if err != nil {
+		return nil, err
+	}
+	var plan ReassignPlan
+	err = json.Unmarshal(kv.Value, &plan)
+	if err != nil {
+		return nil, err
+	}
+	plan.Epoch = self.client.ToEpoch(kv.ModRevision)
+	return &plan, nil
+}
+
+func (self *NsqLookupdEtcdV3Mgr) UpdateReassignPlan(plan *ReassignPlan, oldGen EpochType) error {
+	value, err := json.Marshal(plan)
+	if err != nil {
+		return err
+	}
+	var rev int64
+	if oldGen == 0 {
+		rev, err = self.client.Create(self.createReassignPlanPath(), string(value), clientv3.NoLease)
+	} else {
+		rev, err = self.client.CompareAndSwap(self.createReassignPlanPath(), string(value), self.client.ToRevision(oldGen))
+	}
+	if err != nil {
+		return err
+	}
+	plan.Epoch = self.client.ToEpoch(rev)
+	return nil
+}
+
+func (self *NsqLookupdEtcdV3Mgr) GetAllConsumerGroups() ([]ConsumerGroupInfo, error) {
+	kvs, _, err := self.client.GetChildren(self.createConsumerGroupRootPath(), true)
+	if err != nil {
+		return nil, err
+	}
+	groups := make([]ConsumerGroupInfo, 0, len(kvs))
+	for _, kv := range kvs {
+		var group ConsumerGroupInfo
+		if err = json.Unmarshal(kv.Value, &group); err != nil {
+			coordLog.Warningf("consumer group %v invalid: %v", string(kv.Key), err)
+			continue
+		}
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
+func (self *NsqLookupdEtcdV3Mgr) UpdateConsumerGroup(group *ConsumerGroupInfo) error {
+	value, err := json.Marshal(group)
+	if err != nil {
+		return err
+	}
+	_, err = self.client.Put(self.createConsumerGroupPath(group.Topic, group.Channel), string(value), clientv3.NoLease)
+	return err
+}
+
+func (self *NsqLookupdEtcdV3Mgr) DeleteConsumerGroup(topic string, channel string) error {
+	err := self.client.Delete(self.createConsumerGroupPath(topic, channel))
+	if err == ErrKeyNotFound {
+		return nil
+	}
+	return err
+}
+
+func (self *NsqLookupdEtcdV3Mgr) createClusterPath() string {
+	return path.Join("/", NSQ_ROOT_DIR, self.clusterID)
+}
+
+func (self *NsqLookupdEtcdV3Mgr) createLookupdPath(value *NsqLookupdNodeInfo) string {
+	return path.Join("/", NSQ_ROOT_DIR, self.clusterID, NSQ_LOOKUPD_DIR, NSQ_LOOKUPD_NODE_DIR, "Node-"+value.ID)
+}
+
+func (self *NsqLookupdEtcdV3Mgr) createLookupdRootPath() string {
+	return path.Join("/", NSQ_ROOT_DIR, self.clusterID, NSQ_LOOKUPD_DIR, NSQ_LOOKUPD_NODE_DIR)
+}
+
+func (self *NsqLookupdEtcdV3Mgr) createLookupdLeaderPath() string {
+	return path.Join("/", NSQ_ROOT_DIR, self.clusterID, NSQ_LOOKUPD_DIR, NSQ_LOOKUPD_LEADER_SESSION)
+}
+
+func (self *NsqLookupdEtcdV3Mgr) createConsumerGroupRootPath() string {
+	return path.Join("/", NSQ_ROOT_DIR, self.clusterID, NSQ_LOOKUPD_DIR, NSQ_LOOKUPD_CONSUMER_GROUP)
+}
+
+func (self *NsqLookupdEtcdV3Mgr) createConsumerGroupPath(topic string, channel string) string {
+	return path.Join(self.createConsumerGroupRootPath(), getGroupKey(topic, channel))
+}
+
+func (self *NsqLookupdEtcdV3Mgr) createReassignPlanPath() string {
+	return path.Join("/", NSQ_ROOT_DIR, self.clusterID, NSQ_LOOKUPD_DIR, NSQ_LOOKUPD_REASSIGN_PLAN)
+}
+
+func (self *NsqLookupdEtcdV3Mgr) createNsqdRootPath() string {
+	return path.Join("/", NSQ_ROOT_DIR, self.clusterID, NSQ_NODE_DIR)
+}
+
+func (self *NsqLookupdEtcdV3Mgr) createTopicRootPath() string {
+	return path.Join("/", NSQ_ROOT_DIR, self.clusterID, NSQ_TOPIC_DIR)
+}
+
+func (self *NsqLookupdEtcdV3Mgr) createTopicPath(topic string) string {
+	return path.Join(self.topicRoot, topic)
+}
+
+func (self *NsqLookupdEtcdV3Mgr) createTopicMetaPath(topic string) string {
+	return path.Join(self.topicRoot, topic, NSQ_TOPIC_META)
+}
+
+func (self *NsqLookupdEtcdV3Mgr) createTopicPartitionPath(topic string, partition int) string {
+	return path.Join(self.topicRoot, topic, strconv.Itoa(partition))
+}
+
+func (self *NsqLookupdEtcdV3Mgr) createTopicReplicaInfoPath(topic string, partition int) string {
+	return path.Join(self.topicRoot, topic, strconv.Itoa(partition), NSQ_TOPIC_REPLICA_INFO)
+}
+
+func (self *NsqLookupdEtcdV3Mgr) createTopicLeaderSessionPath(topic string, partition int) string {
+	return path.Join(self.topicRoot, topic, strconv.Itoa(partition), NSQ_TOPIC_LEADER_SESSION)
+}
+
+// release the topic leader session, since the topic leader session type may be changed,
+// we need do the compatible check if the value mismatch.
+func releaseTopicLeaderV3(client *EtcdV3Client, topicKey string, session *TopicLeaderSession) error {
+	valueB, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	err = client.CompareAndDelete(topicKey, string(valueB))
+	if err == nil || err == ErrKeyNotFound {
+		return err
+	}
+	coordLog.Infof("try release topic leader session [%s] error: %v, orig: %v", topicKey, err, session)
+	kv, innErr := client.Get(topicKey, true)
+	if innErr != nil {
+		return err
+	}
+	var old TopicLeaderSession
+	json.Unmarshal(kv.Value, &old)
+	if !old.IsSame(session) {
+		coordLog.Warningf("topic leader session [%s] mismatch: %v, orig: %v", topicKey, session, old)
+		return err
+	}
+	return client.CompareAndDelete(topicKey, string(kv.Value))
+}
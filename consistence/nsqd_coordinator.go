@@ -152,6 +152,11 @@ type NsqdCoordinator struct {
 	enableBenchCost        bool
 	stopping               int32
 	catchupRunning         int32
+	mirrorMutex            sync.Mutex
+	topicMirrors           map[string]*topicMirror
+	catchupThrottle        catchupThrottle
+	// the cached consumer group owners for the topic partition channel
+	groupOwners sync.Map
 }
 
 func NewNsqdCoordinator(cluster, ip, tcpport, rpcport, httpport, extraID string, rootPath string, nsqd *nsqd.NSQD) *NsqdCoordinator {
@@ -174,6 +179,7 @@ func NewNsqdCoordinator(cluster, ip, tcpport, rpcport, httpport, extraID string,
 		tryCheckUnsynced:       make(chan bool, 1),
 		lookupRemoteCreateFunc: NewNsqLookupRpcClient,
 		lookupRemoteClients:    make(map[string]INsqlookupRemoteProxy),
+		topicMirrors:           make(map[string]*topicMirror),
 	}
 
 	if nsqdCoord.leadership != nil {
@@ -188,6 +194,12 @@ func (ncoord *NsqdCoordinator) GetMyID() string {
 	return ncoord.myNode.GetID()
 }
 
+// SetNodeZone set the rack or zone label registered with this node,
+// should be called before start.
+func (ncoord *NsqdCoordinator) SetNodeZone(zone string) {
+	ncoord.myNode.Zone = zone
+}
+
 func (ncoord *NsqdCoordinator) SetLeadershipMgr(l NSQDLeadership) {
 	ncoord.leadership = l
 	if ncoord.leadership != nil {
@@ -313,6 +325,8 @@ func (ncoord *NsqdCoordinator) Start() error {
 	go ncoord.periodFlushCommitLogs()
 	ncoord.wg.Add(1)
 	go ncoord.checkAndCleanOldData()
+	ncoord.wg.Add(1)
+	go ncoord.checkTopicMirrors()
 	return nil
 }
 
@@ -340,7 +354,7 @@ func (ncoord *NsqdCoordinator) Stop() {
 	ncoord.lookupMutex.Unlock()
 }
 
-func doLogQClean(tcData *coordData, localTopic *nsqd.Topic, retentionSize int64, fromDelayedQueue bool) {
+func doLogQClean(tcData *coordData, localTopic *nsqd.Topic, retentionSize int64, fromDelayedQueue bool, isLeader bool) {
 	localLogQ, logMgr := getCommitLogAndLocalLogQ(tcData, localTopic, fromDelayedQueue)
 	if localLogQ == nil || logMgr == nil {
 		return
@@ -371,6 +385,18 @@ func doLogQClean(tcData *coordData, localTopic *nsqd.Topic, retentionSize int64,
 			// so we should not clean the segment at the middle of the batch.
 			maxCleanOffset = nsqd.BackendOffset(l.MsgOffset)
 		}
+		if !fromDelayedQueue && localTopic.IsArchiveEnabled() {
+			// keep the commit log of the cleaned data in the archive, only the leader upload
+			// and the replicas wait the leader uploaded before clean
+			localTopic.SetArchiveUpload(isLeader)
+			for _, fName := range logMgr.GetClosedSegmentFiles(matchIndex) {
+				err = localTopic.ArchiveCommitLog(fName)
+				if err != nil && !os.IsNotExist(err) {
+					coordLog.Infof("archive commit log %v failed: %v", fName, err)
+					return
+				}
+			}
+		}
 		err = logMgr.CleanOldData(matchIndex, matchOffset)
 		if err != nil {
 			coordLog.Infof("clean commit log err : %v", err)
@@ -399,8 +425,9 @@ func (ncoord *NsqdCoordinator) GreedyCleanTopicOldData(localTopic *nsqd.Topic) e
 		retentionDay = int32(nsqd.DEFAULT_RETENTION_DAYS)
 	}
 	retentionSize := (MaxTopicRetentionSizePerDay / 16) * int64(retentionDay)
-	doLogQClean(tcData, localTopic, retentionSize, false)
-	doLogQClean(tcData, localTopic, retentionSize, true)
+	isLeader := tcData.GetLeader() == ncoord.myNode.GetID()
+	doLogQClean(tcData, localTopic, retentionSize, false, isLeader)
+	doLogQClean(tcData, localTopic, retentionSize, true, isLeader)
 	return nil
 }
 
@@ -443,8 +470,12 @@ func (ncoord *NsqdCoordinator) checkAndCleanOldData() {
 				if checkRetentionDay {
 					retentionSize = 0
 				}
-				doLogQClean(tcData, localTopic, retentionSize, false)
-				doLogQClean(tcData, localTopic, retentionSize, true)
+				isLeader := tcData.GetLeader() == ncoord.myNode.GetID()
+				doLogQClean(tcData, localTopic, retentionSize, false, isLeader)
+				doLogQClean(tcData, localTopic, retentionSize, true, isLeader)
+				if tcData.topicInfo.Compact {
+					localTopic.TryCompactOldData(ncoord.localNsqd.GetOpts().CompactTombstoneRetention)
+				}
 			}
 		}
 	}
@@ -625,6 +656,8 @@ func (ncoord *NsqdCoordinator) forceCleanTopicData(topicName string, partition i
 		}
 	}
 
+	os.Remove(getTopicMirrorPosFile(ncoord.dataRootPath, topicName, partition))
+
 	localErr := ncoord.localNsqd.ForceDeleteTopicData(topicName, partition)
 	if localErr != nil {
 		if !os.IsNotExist(localErr) {
@@ -824,6 +857,8 @@ func (ncoord *NsqdCoordinator) loadLocalTopicData() error {
 			OrderedMulti: topicInfo.OrderedMulti,
 			MultiPart:    topicInfo.MultiPart,
 			Ext:          topicInfo.Ext,
+			Compression:  topicInfo.Compression,
+			Compact:      topicInfo.Compact,
 		}
 		tc.GetData().updateBufferSize(int(dyConf.SyncEvery - 1))
 		maybeInitDelayedQ(tc.GetData(), topic)
@@ -834,7 +869,10 @@ func (ncoord *NsqdCoordinator) loadLocalTopicData() error {
 			coordLog.Errorf("check local topic %v data need to be fixed:%v", topicInfo.GetTopicDesp(), localErr)
 			topic.SetDataFixState(true)
 			go ncoord.requestLeaveFromISR(topicInfo.Name, topicInfo.Partition)
-		} else if !topicInfo.OrderedMulti {
+		} else {
+			rebuildTopicDedupWindow(tc.GetData(), topic)
+		}
+		if localErr == nil && !topicInfo.OrderedMulti {
 			delayQ := topic.GetDelayedQueue()
 			localErr = checkAndFixLocalLogQueueData(tc.GetData(), delayQ, tc.GetData().delayedLogMgr, forceFixLeader)
 			if localErr != nil {
@@ -873,6 +911,36 @@ func (ncoord *NsqdCoordinator) loadLocalTopicData() error {
 	return nil
 }
 
+// the dedup window is not persisted, so we rebuild it from the recent messages while loading.
+// After loading, the window is kept updated while writing on both the leader and the replicas.
+func rebuildTopicDedupWindow(tc *coordData, topic *nsqd.Topic) {
+	winSize := topic.GetDedupWindowSize()
+	if winSize <= 0 || !topic.IsExt() {
+		return
+	}
+	topic.Lock()
+	defer topic.Unlock()
+	searchCnt := int64(topic.TotalMessageCnt()) - int64(winSize)
+	if searchCnt < 0 {
+		searchCnt = 0
+	}
+	_, _, l, err := tc.logMgr.SearchLogDataByMsgCnt(searchCnt)
+	if err != nil {
+		if err != ErrCommitLogEOF {
+			coordLog.Infof("topic %v search log for dedup window failed: %v", tc.topicInfo.GetTopicDesp(), err)
+		}
+		return
+	}
+	startCnt := l.MsgCnt - 1
+	if startCnt < 0 {
+		startCnt = 0
+	}
+	err = topic.RebuildDedupWindowNoLock(nsqd.BackendOffset(l.MsgOffset), startCnt)
+	if err != nil {
+		coordLog.Infof("topic %v rebuild dedup window failed: %v", tc.topicInfo.GetTopicDesp(), err)
+	}
+}
+
 func checkAndFixLocalLogQueueEnd(tc *coordData,
 	localLogQ ILocalLogQueue, logMgr *TopicCommitLogMgr, tryFixEnd bool, forceFix bool) error {
 	if logMgr == nil || localLogQ == nil {
@@ -1211,6 +1279,105 @@ func (ncoord *NsqdCoordinator) IsMineConsumeLeaderForTopic(topic string, part in
 	return tcData.GetLeader() == ncoord.myNode.GetID() && tcData.GetLeaderSessionID() == ncoord.myNode.GetID()
 }
 
+type groupOwnerCache struct {
+	exist      bool
+	owner      string
+	generation int64
+	updated    time.Time
+}
+
+var groupOwnerCacheTimeout = time.Second * 3
+
+func (c *groupOwnerCache) check(memberID string, generation int64) error {
+	if !c.exist {
+		if memberID != "" {
+			return ErrConsumerGroupNotFound
+		}
+		return nil
+	}
+	if c.owner != memberID || c.generation != generation {
+		return ErrConsumerGroupNotOwner
+	}
+	return nil
+}
+
+func (ncoord *NsqdCoordinator) getConsumerGroupOwner(topic string, part int, channel string) (*groupOwnerCache, *CoordErr) {
+	exist, owner, gen, err := ncoord.requestConsumerGroupOwner(topic, part, channel)
+	if err != nil {
+		coordLog.Infof("failed to get consumer group owner for %v-%v-%v: %v", topic, part, channel, err)
+		return nil, err
+	}
+	c := &groupOwnerCache{
+		exist:      exist,
+		owner:      owner,
+		generation: gen,
+		updated:    time.Now(),
+	}
+	ncoord.groupOwners.Store(getTopicPartitionChannelKey(topic, part, channel), c)
+	return c, nil
+}
+
+func getTopicPartitionChannelKey(topic string, part int, channel string) string {
+	return topic + "-" + strconv.Itoa(part) + ":" + channel
+}
+
+// ForgetConsumerGroupOwner remove the cached consumer group owner of the channel, the owner will
+// be requested from lookup again while checking.
+func (ncoord *NsqdCoordinator) ForgetConsumerGroupOwner(topic string, part int, channel string) {
+	ncoord.groupOwners.Delete(getTopicPartitionChannelKey(topic, part, channel))
+}
+
+// remove all the cached consumer group owners of the channels under the topic partition
+func (ncoord *NsqdCoordinator) forgetTopicGroupOwners(topic string, part int) {
+	prefix := getTopicPartitionChannelKey(topic, part, "")
+	ncoord.groupOwners.Range(func(k, v interface{}) bool {
+		if strings.HasPrefix(k.(string), prefix) {
+			ncoord.groupOwners.Delete(k)
+		}
+		return true
+	})
+}
+
+// CheckConsumerGroupOwner check whether the consumer group member owns the topic partition in the
+// given generation. If no consumer group on the channel, only the consumer without member id is allowed.
+func (ncoord *NsqdCoordinator) CheckConsumerGroupOwner(topic string, part int, channel string,
+	memberID string, generation int64) error {
+	c, err := ncoord.getConsumerGroupOwner(topic, part, channel)
+	if err != nil {
+		if memberID == "" {
+			// allow the consumer not in group while the lookup is not available
+			return nil
+		}
+		return err.ToErrorType()
+	}
+	if checkErr := c.check(memberID, generation); checkErr != nil {
+		coordLog.Infof("consumer group owner for %v-%v-%v is %v (generation %v), but got %v (generation %v)",
+			topic, part, channel, c.owner, c.generation, memberID, generation)
+		return checkErr
+	}
+	return nil
+}
+
+// CheckConsumerGroupOwnerCached is the same as CheckConsumerGroupOwner but use the owner cached in
+// a short time, it is used to fence the subscribed consumer after the group rebalanced. The last
+// cached owner will be used if the lookup is not available, and allowed if nothing cached.
+func (ncoord *NsqdCoordinator) CheckConsumerGroupOwnerCached(topic string, part int, channel string,
+	memberID string, generation int64) error {
+	var c *groupOwnerCache
+	if v, ok := ncoord.groupOwners.Load(getTopicPartitionChannelKey(topic, part, channel)); ok {
+		c = v.(*groupOwnerCache)
+	}
+	if c == nil || time.Since(c.updated) >= groupOwnerCacheTimeout {
+		newest, err := ncoord.getConsumerGroupOwner(topic, part, channel)
+		if err == nil {
+			c = newest
+		} else if c == nil {
+			return nil
+		}
+	}
+	return c.check(memberID, generation)
+}
+
 func (ncoord *NsqdCoordinator) IsMineLeaderForTopic(topic string, part int) bool {
 	tcData, err := ncoord.getTopicCoordData(topic, part)
 	if err != nil {
@@ -1246,6 +1413,17 @@ func (ncoord *NsqdCoordinator) SearchLogByMsgOffset(topic string, part int, offs
 	if err != nil || tcData.logMgr == nil {
 		return nil, 0, 0, errors.New(err.String())
 	}
+	if t, localErr := ncoord.localNsqd.GetExistingTopic(topic, part); localErr == nil && t.IsArchiveEnabled() {
+		// the cleaned data can be read back from the archive
+		realOffset, curCount, localErr := t.SearchArchivedMsgOffset(nsqd.BackendOffset(offset))
+		if localErr == nil {
+			return nil, int64(realOffset), curCount, nil
+		}
+		if localErr != nsqd.ErrReadQueueNotCleaned {
+			coordLog.Infof("search archived data failed: %v", localErr)
+			return nil, 0, 0, localErr
+		}
+	}
 	_, _, l, localErr := tcData.logMgr.SearchLogDataByMsgOffset(offset)
 	if localErr != nil {
 		coordLog.Infof("search data failed: %v", localErr)
@@ -1414,6 +1592,26 @@ func (ncoord *NsqdCoordinator) SearchLogByMsgTimestamp(topic string, part int, t
 	if localErr != nil {
 		return nil, 0, 0, localErr
 	}
+	if ts_sec < 0 {
+		return nil, 0, 0, fmt.Errorf("Invalid timestamp %v", ts_sec)
+	}
+
+	// search the time index first, fallback to search the commit log if the index not available
+	startSearch := time.Now()
+	queueOffset, cnt, localErr := t.SearchMsgByTimestamp(ts_sec * 1000 * 1000 * 1000)
+	if localErr == nil {
+		var l *CommitLogData
+		_, _, l, localErr = tcData.logMgr.SearchLogDataByMsgOffset(int64(queueOffset))
+		coordLog.Infof("search time index cost: %v", time.Since(startSearch))
+		if localErr == nil {
+			return l, int64(queueOffset), cnt, nil
+		}
+		// the searched offset may be the end of queue or the commit log may be cleaned,
+		// fallback to search the commit log
+		coordLog.Infof("search log by offset %v failed: %v", queueOffset, localErr)
+	} else {
+		coordLog.Infof("search time index failed: %v", localErr)
+	}
 
 	snap := t.GetDiskQueueSnapshot()
 	comp := &MsgTimestampComparator{
@@ -1423,11 +1621,7 @@ func (ncoord *NsqdCoordinator) SearchLogByMsgTimestamp(topic string, part int, t
 		ext:              tcData.topicInfo.Ext,
 	}
 
-	if comp.searchTs < int64(0) {
-		return nil, 0, 0, fmt.Errorf("Invalid timestamp %v", ts_sec)
-	}
-
-	startSearch := time.Now()
+	startSearch = time.Now()
 	_, _, l, localErr := tcData.logMgr.SearchLogDataByComparator(comp)
 	coordLog.Infof("search log cost: %v", time.Since(startSearch))
 	if localErr != nil {
@@ -1940,6 +2134,71 @@ func (ncoord *NsqdCoordinator) pullDelayedQueueFromLeader(tc *TopicCoordinator,
 	return nil
 }
 
+// checkEncryptKeyringWithLeader make sure the node has all the encryption keys of the leader
+// before joining the isr, since the replica write the encrypted records from the leader as is
+// and should be able to read them.
+func (ncoord *NsqdCoordinator) checkEncryptKeyringWithLeader(c *NsqdRpcClient, topicInfo TopicPartitionMetaInfo) *CoordErr {
+	leaderFP, rpcErr := c.GetEncryptKeyFingerprint()
+	if rpcErr != nil {
+		if !strings.Contains(rpcErr.ErrMsg, "unknown service name") {
+			coordLog.Infof("topic %v get leader encryption keyring failed: %v", topicInfo.GetTopicDesp(), rpcErr)
+			return rpcErr
+		}
+		// the old version leader does not support the encryption
+		leaderFP = ""
+	}
+	return checkEncryptKeyFingerprint(topicInfo, leaderFP)
+}
+
+func checkEncryptKeyFingerprint(topicInfo TopicPartitionMetaInfo, leaderFP string) *CoordErr {
+	missing := missingFingerprintItem(nsqd.GetEncryptKeyring().KeyFingerprint(), leaderFP)
+	if missing != "" {
+		coordLog.Errorf("topic %v can not join isr since the encryption key %v of the leader %v is missing",
+			topicInfo.GetTopicDesp(), missing, topicInfo.Leader)
+		return ErrEncryptKeyringMismatch
+	}
+	return nil
+}
+
+// checkZstdDictsWithLeader make sure the node has all the zstd dictionaries of the leader
+// before joining the isr, the same as the encryption keys.
+func (ncoord *NsqdCoordinator) checkZstdDictsWithLeader(c *NsqdRpcClient, topicInfo TopicPartitionMetaInfo) *CoordErr {
+	leaderFP, rpcErr := c.GetZstdDictFingerprint()
+	if rpcErr != nil {
+		if !strings.Contains(rpcErr.ErrMsg, "unknown service name") {
+			coordLog.Infof("topic %v get leader zstd dictionaries failed: %v", topicInfo.GetTopicDesp(), rpcErr)
+			return rpcErr
+		}
+		// the old version leader does not support the dictionary
+		leaderFP = ""
+	}
+	return checkZstdDictFingerprint(topicInfo, leaderFP)
+}
+
+func checkZstdDictFingerprint(topicInfo TopicPartitionMetaInfo, leaderFP string) *CoordErr {
+	missing := missingFingerprintItem(nsqd.GetZstdDicts().DictFingerprint(), leaderFP)
+	if missing != "" {
+		coordLog.Errorf("topic %v can not join isr since the zstd dictionary %v of the leader %v is missing",
+			topicInfo.GetTopicDesp(), missing, topicInfo.Leader)
+		return ErrZstdDictMismatch
+	}
+	return nil
+}
+
+// missingFingerprintItem return the first item of the leader fingerprint not in the local one.
+func missingFingerprintItem(localFP string, leaderFP string) string {
+	localItems := make(map[string]bool)
+	for _, k := range strings.Split(localFP, ",") {
+		localItems[k] = true
+	}
+	for _, k := range strings.Split(leaderFP, ",") {
+		if k != "" && !localItems[k] {
+			return k
+		}
+	}
+	return ""
+}
+
 func (ncoord *NsqdCoordinator) catchupFromLeader(topicInfo TopicPartitionMetaInfo, joinISRSession string) *CoordErr {
 	// get local commit log from check point , and pull newer logs from leader
 	tc, coordErr := ncoord.getTopicCoord(topicInfo.Name, topicInfo.Partition)
@@ -1971,6 +2230,14 @@ func (ncoord *NsqdCoordinator) catchupFromLeader(topicInfo TopicPartitionMetaInf
 		coordLog.Warningf("failed to get rpc client while catchup: %v", coordErr)
 		return coordErr
 	}
+	coordErr = ncoord.checkEncryptKeyringWithLeader(c, topicInfo)
+	if coordErr != nil {
+		return coordErr
+	}
+	coordErr = ncoord.checkZstdDictsWithLeader(c, topicInfo)
+	if coordErr != nil {
+		return coordErr
+	}
 	localTopic, localErr := ncoord.localNsqd.GetExistingTopic(topicInfo.Name, topicInfo.Partition)
 	if localErr != nil {
 		coordLog.Errorf("get local topic failed:%v", localErr)
@@ -1989,6 +2256,8 @@ func (ncoord *NsqdCoordinator) catchupFromLeader(topicInfo TopicPartitionMetaInf
 		OrderedMulti: topicInfo.OrderedMulti,
 		MultiPart:    topicInfo.MultiPart,
 		Ext:          topicInfo.Ext,
+		Compression:  topicInfo.Compression,
+		Compact:      topicInfo.Compact,
 	}
 	tc.GetData().updateBufferSize(int(dyConf.SyncEvery - 1))
 	localTopic.SetDynamicInfo(*dyConf, tc.GetData().logMgr)
@@ -2130,6 +2399,7 @@ func (ncoord *NsqdCoordinator) syncChannelsFromOther(c *NsqdRpcClient, topicInfo
 					} else {
 						ch.SkipZanTest()
 					}
+					ch.SetDeadLetter(meta.MaxAttempts, meta.DeadLetterTopic)
 				}
 				if offset, ok := consumerOffsetMap[chName]; ok {
 					offset.AllowBackward = true
@@ -2501,6 +2771,8 @@ func (ncoord *NsqdCoordinator) updateTopicLeaderSession(topicCoord *TopicCoordin
 		OrderedMulti: tcData.topicInfo.OrderedMulti,
 		MultiPart:    tcData.topicInfo.MultiPart,
 		Ext:          tcData.topicInfo.Ext,
+		Compression:  tcData.topicInfo.Compression,
+		Compact:      tcData.topicInfo.Compact,
 	}
 	tcData.updateBufferSize(int(dyConf.SyncEvery - 1))
 	localTopic.SetDynamicInfo(*dyConf, tcData.logMgr)
@@ -2592,6 +2864,7 @@ func (ncoord *NsqdCoordinator) removeTopicCoord(topic string, partition int, rem
 		err = nil
 	}
 	ncoord.coordMutex.Unlock()
+	ncoord.forgetTopicGroupOwners(topic, partition)
 	if removeData {
 		coordLog.Infof("removing topic data: %v-%v", topic, partition)
 		// check if any data on local and try remove
@@ -2801,10 +3074,11 @@ func (ncoord *NsqdCoordinator) readTopicRawData(topic string, partition int, off
 
 func (ncoord *NsqdCoordinator) pullCommitLogsAndData(req *RpcPullCommitLogsReq, fromDelayed bool) (*RpcPullCommitLogsRsp, error) {
 	var ret RpcPullCommitLogsRsp
-	tcData, err := ncoord.getTopicCoordData(req.TopicName, req.TopicPartition)
+	tc, err := ncoord.getTopicCoord(req.TopicName, req.TopicPartition)
 	if err != nil {
 		return nil, err.ToErrorType()
 	}
+	tcData := tc.GetData()
 
 	logMgr := tcData.logMgr
 	if fromDelayed {
@@ -2836,6 +3110,7 @@ func (ncoord *NsqdCoordinator) pullCommitLogsAndData(req *RpcPullCommitLogsReq,
 	offsetList := make([]int64, len(ret.Logs))
 	sizeList := make([]int32, len(ret.Logs))
 	totalSize := int32(0)
+	maxPullBytes := getCatchupPullMaxBytes(ncoord.getCatchupRateLimits())
 	for i, l := range ret.Logs {
 		offsetList[i] = l.MsgOffset
 		sizeList[i] = l.MsgSize
@@ -2845,6 +3120,14 @@ func (ncoord *NsqdCoordinator) pullCommitLogsAndData(req *RpcPullCommitLogsReq,
 			coordLog.Warningf("pulling too much log data at one time: %v, %v", totalSize, i)
 			offsetList = offsetList[:i]
 			sizeList = sizeList[:i]
+			totalSize -= l.MsgSize
+			break
+		}
+		// pull less data while throttled, at least one log should be pulled
+		if totalSize > maxPullBytes && i > 0 {
+			offsetList = offsetList[:i]
+			sizeList = sizeList[:i]
+			totalSize -= l.MsgSize
 			break
 		}
 	}
@@ -2856,6 +3139,7 @@ func (ncoord *NsqdCoordinator) pullCommitLogsAndData(req *RpcPullCommitLogsReq,
 		coordLog.Infof("pull log data read failed : %v, %v, %v", err, offsetList, sizeList)
 		return nil, err.ToErrorType()
 	}
+	ncoord.throttleCatchup(tc, int64(totalSize))
 	return &ret, nil
 }
 
@@ -2884,6 +3168,8 @@ func (ncoord *NsqdCoordinator) updateLocalTopic(topicInfo *TopicPartitionMetaInf
 		OrderedMulti: topicInfo.OrderedMulti,
 		MultiPart:    topicInfo.MultiPart,
 		Ext:          topicInfo.Ext,
+		Compression:  topicInfo.Compression,
+		Compact:      topicInfo.Compact,
 	}
 	tcData.updateBufferSize(int(dyConf.SyncEvery - 1))
 	localErr = maybeInitDelayedQ(tcData, t)
@@ -2970,14 +3256,16 @@ func (ncoord *NsqdCoordinator) Stats(topic string, part int) *CoordStats {
 		s.RpcStats = ncoord.rpcServer.rpcServer.Stats.Snapshot()
 	}
 	s.ErrStats = *coordErrStats.GetCopy()
+	s.CatchupThrottle = ncoord.getCatchupThrottleStat()
 	s.TopicCoordStats = make([]TopicCoordStat, 0)
 	if len(topic) == 0 {
 		return s
 	}
 	if part >= 0 {
-		tcData, err := ncoord.getTopicCoordData(topic, part)
+		tc, err := ncoord.getTopicCoord(topic, part)
 		if err != nil {
 		} else {
+			tcData := tc.GetData()
 			var stat TopicCoordStat
 			stat.Name = topic
 			stat.Partition = part
@@ -2987,6 +3275,8 @@ func (ncoord *NsqdCoordinator) Stats(topic string, part int) *CoordStats {
 			for _, nid := range tcData.topicInfo.CatchupList {
 				stat.CatchupStats = append(stat.CatchupStats, CatchupStat{HostName: "", NodeID: nid, Progress: 0})
 			}
+			stat.MirrorStat = ncoord.getTopicMirrorStat(topic, part)
+			stat.CatchupRate = tc.catchupThrottle.currentRate(time.Now())
 			s.TopicCoordStats = append(s.TopicCoordStats, stat)
 		}
 	} else {
@@ -3002,6 +3292,8 @@ func (ncoord *NsqdCoordinator) Stats(topic string, part int) *CoordStats {
 			for _, nid := range tc.topicInfo.CatchupList {
 				stat.CatchupStats = append(stat.CatchupStats, CatchupStat{HostName: "", NodeID: nid, Progress: 0})
 			}
+			stat.MirrorStat = ncoord.getTopicMirrorStat(topic, stat.Partition)
+			stat.CatchupRate = tc.catchupThrottle.currentRate(time.Now())
 
 			s.TopicCoordStats = append(s.TopicCoordStats, stat)
 		}
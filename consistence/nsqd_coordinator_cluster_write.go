@@ -33,9 +33,24 @@ type slaveSyncFunc func(*NsqdRpcClient, string, *coordData) *CoordErr
 type slaveAsyncFunc func(*NsqdRpcClient, string, *coordData) *SlaveAsyncWriteResult
 
 type handleSyncResultFunc func(int, *coordData) bool
+type requiredAcksFunc func(*coordData) int
 
 type checkDupFunc func(*coordData) bool
 
+// the source of the write decides whether the partition not writable for the producer
+// (shrinking or mirroring) can still accept it.
+type clusterWriteFrom int
+
+const (
+	// the new messages from the producer, and the messages published to another topic
+	// by the server (such as the dead letter messages).
+	writeFromProducer clusterWriteFrom = iota
+	// the internal writes of the partition itself (such as requeue, delayed update and
+	// delayed pub release), needed by the consumers to drain the partition.
+	writeFromPartition
+)
+
+// PutMessageBodyToCluster write the internal message of the topic partition itself.
 func (ncoord *NsqdCoordinator) PutMessageBodyToCluster(topic *nsqd.Topic,
 	body []byte, traceID uint64) (nsqd.MessageID, nsqd.BackendOffset, int32, nsqd.BackendQueueEnd, error) {
 	msg := nsqd.NewMessage(0, body)
@@ -43,18 +58,75 @@ func (ncoord *NsqdCoordinator) PutMessageBodyToCluster(topic *nsqd.Topic,
 	return ncoord.PutMessageToCluster(topic, msg)
 }
 
+// PutMessageToCluster write the internal message of the topic partition itself, such as the
+// released delayed pub message. Use PutMessageToClusterWithAck for the producer messages.
 func (ncoord *NsqdCoordinator) PutMessageToCluster(topic *nsqd.Topic,
 	msg *nsqd.Message) (nsqd.MessageID, nsqd.BackendOffset, int32, nsqd.BackendQueueEnd, error) {
-	return ncoord.internalPutMessageToCluster(topic, msg, false)
+	return ncoord.internalPutMessageToCluster(topic, msg, false, nsqd.PubAckAll, writeFromPartition)
+}
+
+// PutMessageToClusterWithAck write the producer message, the write is acknowledged
+// while the replicas required by the ack mode and the min insync of topic are synced.
+func (ncoord *NsqdCoordinator) PutMessageToClusterWithAck(topic *nsqd.Topic,
+	msg *nsqd.Message, ackMode nsqd.PubAckMode) (nsqd.MessageID, nsqd.BackendOffset, int32, nsqd.BackendQueueEnd, error) {
+	return ncoord.internalPutMessageToCluster(topic, msg, false, ackMode, writeFromProducer)
 }
 
+// PutDelayedMessageToCluster write the delayed message, the scheduled pub message is
+// from the producer and the others are from the partition itself.
 func (ncoord *NsqdCoordinator) PutDelayedMessageToCluster(topic *nsqd.Topic,
 	msg *nsqd.Message) (nsqd.MessageID, nsqd.BackendOffset, int32, nsqd.BackendQueueEnd, error) {
-	return ncoord.internalPutMessageToCluster(topic, msg, true)
+	from := writeFromPartition
+	if msg.DelayedType == nsqd.PubDelayed {
+		from = writeFromProducer
+	}
+	return ncoord.internalPutMessageToCluster(topic, msg, true, nsqd.PubAckAll, from)
+}
+
+// IsTopicProducerWritable return true if the producer messages can be written to the topic
+// partition on this node.
+func (ncoord *NsqdCoordinator) IsTopicProducerWritable(topic string, part int) bool {
+	tcData, err := ncoord.getTopicCoordData(topic, part)
+	if err != nil {
+		return false
+	}
+	return checkTopicInfoWritable(&tcData.topicInfo, writeFromProducer, false) == nil
+}
+
+// the new messages from producer are not allowed while the partition is shrinking, the
+// internal writes of the partition are still allowed so the partition can be drained by
+// the consumers.
+// The topic queue of the mirror topic only accept the messages from the remote cluster
+// (written by putMirroredMessagesToCluster without the check), the consumers of the mirror
+// topic can still write the delayed queue (requeue and delayed update).
+func checkTopicInfoWritable(topicInfo *TopicPartitionMetaInfo, from clusterWriteFrom, toDelayedQueue bool) *CoordErr {
+	if topicInfo.MirrorFrom != "" && (from == writeFromProducer || !toDelayedQueue) {
+		return ErrTopicMirrorReadOnly
+	}
+	if from == writeFromProducer && topicInfo.IsPartitionShrinking(topicInfo.Partition) {
+		return ErrTopicPartitionShrinking
+	}
+	return nil
+}
+
+// get the replicas (include leader) should be synced before the write acknowledged to producer.
+func getRequiredSyncAcks(ackMode nsqd.PubAckMode, topicInfo *TopicPartitionMetaInfo) int {
+	isrNum := len(topicInfo.ISR)
+	required := isrNum
+	switch ackMode {
+	case nsqd.PubAckLeader:
+		required = 1
+	case nsqd.PubAckQuorum:
+		required = isrNum/2 + 1
+	}
+	if required < topicInfo.MinInSync {
+		required = topicInfo.MinInSync
+	}
+	return required
 }
 
 func (ncoord *NsqdCoordinator) internalPutMessageToCluster(topic *nsqd.Topic,
-	msg *nsqd.Message, putDelayed bool) (nsqd.MessageID, nsqd.BackendOffset, int32, nsqd.BackendQueueEnd, error) {
+	msg *nsqd.Message, putDelayed bool, ackMode nsqd.PubAckMode, from clusterWriteFrom) (nsqd.MessageID, nsqd.BackendOffset, int32, nsqd.BackendQueueEnd, error) {
 
 	var commitLog CommitLogData
 	var queueEnd nsqd.BackendQueueEnd
@@ -71,9 +143,18 @@ func (ncoord *NsqdCoordinator) internalPutMessageToCluster(topic *nsqd.Topic,
 	if checkErr != nil {
 		return msg.ID, nsqd.BackendOffset(commitLog.MsgOffset), commitLog.MsgSize, queueEnd, checkErr.ToErrorType()
 	}
+	if err := checkTopicInfoWritable(&coord.GetData().topicInfo, from, putDelayed); err != nil {
+		return msg.ID, nsqd.BackendOffset(commitLog.MsgOffset), commitLog.MsgSize, queueEnd, err.ToErrorType()
+	}
 
 	var logMgr *TopicCommitLogMgr
 	var delayQ *nsqd.DelayQueue
+	// the slave sync may be still running after returned if not all the isr are required,
+	// so we need copy the message since the body buffer will be reused by caller
+	slaveMsg := msg
+	// the encoded records replicated to the slaves if the format depends on the leader
+	var slaveRaw []byte
+	var dedupErr error
 	doLocalWrite := func(d *coordData) *CoordErr {
 		logMgr = d.logMgr
 		if putDelayed {
@@ -92,10 +173,27 @@ func (ncoord *NsqdCoordinator) internalPutMessageToCluster(topic *nsqd.Topic,
 		if putDelayed {
 			delayQ, localErr = topic.GetOrCreateDelayedQueueNoLock(logMgr)
 			if localErr == nil {
+				captureRaw := delayQ.StartRawCaptureNoLock()
 				id, offset, writeBytes, qe, localErr = delayQ.PutDelayMessage(msg)
+				if captureRaw {
+					slaveRaw = delayQ.StopRawCaptureNoLock()
+				}
 			}
 		} else {
+			id, offset, writeBytes, dedupErr = topic.CheckDuplicatedNoLock(msg)
+			if dedupErr != nil {
+				// ack the duplicated message with the original write without writing again
+				topic.Unlock()
+				msg.ID = id
+				commitLog.MsgOffset = int64(offset)
+				commitLog.MsgSize = writeBytes
+				return ErrLocalWriteSkipped
+			}
+			captureRaw := topic.StartRawCaptureNoLock()
 			id, offset, writeBytes, qe, localErr = topic.PutMessageNoLock(msg)
+			if captureRaw {
+				slaveRaw = topic.StopRawCaptureNoLock()
+			}
 		}
 		queueEnd = qe
 		topic.Unlock()
@@ -114,6 +212,9 @@ func (ncoord *NsqdCoordinator) internalPutMessageToCluster(topic *nsqd.Topic,
 		commitLog.MsgSize = writeBytes
 		commitLog.MsgCnt = queueEnd.TotalMsgCnt()
 		commitLog.MsgNum = 1
+		if ackMode != nsqd.PubAckAll {
+			slaveMsg = msg.GetCopy()
+		}
 
 		return nil
 	}
@@ -171,14 +272,24 @@ func (ncoord *NsqdCoordinator) internalPutMessageToCluster(topic *nsqd.Topic,
 		}
 		// should retry if failed, and the slave should keep the last success write to avoid the duplicated
 		if putDelayed {
-			putErr := c.PutDelayedMessage(&tcData.topicLeaderSession, &tcData.topicInfo, commitLog, msg)
+			var putErr *CoordErr
+			if len(slaveRaw) > 0 {
+				putErr = c.PutRawDelayedMessage(&tcData.topicLeaderSession, &tcData.topicInfo, commitLog, slaveRaw)
+			} else {
+				putErr = c.PutDelayedMessage(&tcData.topicLeaderSession, &tcData.topicInfo, commitLog, slaveMsg)
+			}
 			if putErr != nil {
 				coordLog.Infof("sync write to replica %v failed: %v. put offset:%v, logmgr: %v, %v",
 					nodeID, putErr, commitLog, logMgr.pLogID, logMgr.nLogID)
 			}
 			return putErr
 		} else {
-			putErr := c.PutMessage(&tcData.topicLeaderSession, &tcData.topicInfo, commitLog, msg)
+			var putErr *CoordErr
+			if len(slaveRaw) > 0 {
+				putErr = c.PutRawMessages(&tcData.topicLeaderSession, &tcData.topicInfo, commitLog, slaveRaw)
+			} else {
+				putErr = c.PutMessage(&tcData.topicLeaderSession, &tcData.topicInfo, commitLog, slaveMsg)
+			}
 			if putErr != nil {
 				coordLog.Infof("sync write to replica %v failed: %v. put offset:%v, logmgr: %v, %v",
 					nodeID, putErr, commitLog, logMgr.pLogID, logMgr.nLogID)
@@ -186,7 +297,13 @@ func (ncoord *NsqdCoordinator) internalPutMessageToCluster(topic *nsqd.Topic,
 			return putErr
 		}
 	}
+	requiredAcks := func(tcData *coordData) int {
+		return getRequiredSyncAcks(ackMode, &tcData.topicInfo)
+	}
 	handleSyncResult := func(successNum int, tcData *coordData) bool {
+		if ackMode != nsqd.PubAckAll {
+			return successNum >= requiredAcks(tcData)
+		}
 		if successNum == len(tcData.topicInfo.ISR) {
 			if successNum > tcData.topicInfo.Replica/2 {
 			} else {
@@ -199,12 +316,17 @@ func (ncoord *NsqdCoordinator) internalPutMessageToCluster(topic *nsqd.Topic,
 		return false
 	}
 
-	clusterErr := ncoord.doSyncOpToCluster(true, coord, doLocalWrite, doLocalExit, doLocalCommit, doLocalRollback,
-		doRefresh, doSlaveSync, handleSyncResult)
+	clusterErr := ncoord.doSyncOpToClusterWithAck(true, coord, requiredAcks, doLocalWrite, doLocalExit, doLocalCommit,
+		doLocalRollback, doRefresh, doSlaveSync, handleSyncResult)
 
 	var err error
 	if clusterErr != nil {
 		err = clusterErr.ToErrorType()
+	} else if dedupErr != nil {
+		if dedupErr != nsqd.ErrMessageDuplicated {
+			err = dedupErr
+		}
+		queueEnd = topic.GetCommitted()
 	} else if coordLog.Level() >= levellogger.LOG_DETAIL {
 		coordLog.Infof("sync write success put offset: %v, logmgr: %v, %v",
 			commitLog, logMgr.pLogID, logMgr.nLogID)
@@ -214,6 +336,11 @@ func (ncoord *NsqdCoordinator) internalPutMessageToCluster(topic *nsqd.Topic,
 
 func (ncoord *NsqdCoordinator) PutMessagesToCluster(topic *nsqd.Topic,
 	msgs []*nsqd.Message) (nsqd.MessageID, nsqd.BackendOffset, int32, error) {
+	return ncoord.PutMessagesToClusterWithAck(topic, msgs, nsqd.PubAckAll)
+}
+
+func (ncoord *NsqdCoordinator) PutMessagesToClusterWithAck(topic *nsqd.Topic,
+	msgs []*nsqd.Message, ackMode nsqd.PubAckMode) (nsqd.MessageID, nsqd.BackendOffset, int32, error) {
 
 	var commitLog CommitLogData
 	topicName := topic.GetTopicName()
@@ -222,6 +349,9 @@ func (ncoord *NsqdCoordinator) PutMessagesToCluster(topic *nsqd.Topic,
 	if checkErr != nil {
 		return nsqd.MessageID(commitLog.LogID), nsqd.BackendOffset(commitLog.MsgOffset), commitLog.MsgSize, checkErr.ToErrorType()
 	}
+	if err := checkTopicInfoWritable(&coord.GetData().topicInfo, writeFromProducer, false); err != nil {
+		return nsqd.MessageID(commitLog.LogID), nsqd.BackendOffset(commitLog.MsgOffset), commitLog.MsgSize, err.ToErrorType()
+	}
 
 	var queueEnd nsqd.BackendQueueEnd
 	var logMgr *TopicCommitLogMgr
@@ -229,6 +359,11 @@ func (ncoord *NsqdCoordinator) PutMessagesToCluster(topic *nsqd.Topic,
 	if ncoord.enableBenchCost {
 		checkCost = true
 	}
+	// the duplicated messages will be filtered before write
+	writeMsgs := msgs
+	slaveMsgs := msgs
+	var slaveRaw []byte
+	var dedupErr error
 
 	doLocalWrite := func(d *coordData) *CoordErr {
 		var s time.Time
@@ -244,7 +379,16 @@ func (ncoord *NsqdCoordinator) PutMessagesToCluster(topic *nsqd.Topic,
 			}
 		}
 		logMgr = d.logMgr
-		id, offset, writeBytes, totalCnt, qe, localErr := topic.PutMessagesNoLock(msgs)
+		writeMsgs, dedupErr = topic.FilterDuplicatedNoLock(msgs)
+		if dedupErr != nil || len(writeMsgs) == 0 {
+			topic.Unlock()
+			return ErrLocalWriteSkipped
+		}
+		captureRaw := topic.StartRawCaptureNoLock()
+		id, offset, writeBytes, totalCnt, qe, localErr := topic.PutMessagesNoLock(writeMsgs)
+		if captureRaw {
+			slaveRaw = topic.StopRawCaptureNoLock()
+		}
 		queueEnd = qe
 		topic.Unlock()
 		if localErr != nil {
@@ -263,12 +407,19 @@ func (ncoord *NsqdCoordinator) PutMessagesToCluster(topic *nsqd.Topic,
 		// need disable write which should hold the write lock.
 		// However, we are holding write lock while doing the cluster write replication.
 		commitLog.Epoch = d.GetTopicEpochForWrite()
-		commitLog.LastMsgLogID = int64(msgs[len(msgs)-1].ID)
+		commitLog.LastMsgLogID = int64(writeMsgs[len(writeMsgs)-1].ID)
 		commitLog.MsgOffset = int64(offset)
 		commitLog.MsgSize = writeBytes
 		// This MsgCnt is the total count until now (include the current written batch message count)
 		commitLog.MsgCnt = totalCnt
-		commitLog.MsgNum = int32(len(msgs))
+		commitLog.MsgNum = int32(len(writeMsgs))
+		slaveMsgs = writeMsgs
+		if ackMode != nsqd.PubAckAll {
+			slaveMsgs = make([]*nsqd.Message, 0, len(writeMsgs))
+			for _, m := range writeMsgs {
+				slaveMsgs = append(slaveMsgs, m.GetCopy())
+			}
+		}
 		return nil
 	}
 	doLocalExit := func(err *CoordErr) {
@@ -310,14 +461,25 @@ func (ncoord *NsqdCoordinator) PutMessagesToCluster(topic *nsqd.Topic,
 			return NewCoordErr("timeout test for slave sync", CoordNetErr)
 		}
 		// should retry if failed, and the slave should keep the last success write to avoid the duplicated
-		putErr := c.PutMessages(&tcData.topicLeaderSession, &tcData.topicInfo, commitLog, msgs)
+		var putErr *CoordErr
+		if len(slaveRaw) > 0 {
+			putErr = c.PutRawMessages(&tcData.topicLeaderSession, &tcData.topicInfo, commitLog, slaveRaw)
+		} else {
+			putErr = c.PutMessages(&tcData.topicLeaderSession, &tcData.topicInfo, commitLog, slaveMsgs)
+		}
 		if putErr != nil {
 			coordLog.Infof("sync write to replica %v failed: %v, put offset: %v, logmgr: %v, %v",
 				nodeID, putErr, commitLog, logMgr.pLogID, logMgr.nLogID)
 		}
 		return putErr
 	}
+	requiredAcks := func(tcData *coordData) int {
+		return getRequiredSyncAcks(ackMode, &tcData.topicInfo)
+	}
 	handleSyncResult := func(successNum int, tcData *coordData) bool {
+		if ackMode != nsqd.PubAckAll {
+			return successNum >= requiredAcks(tcData)
+		}
 		if successNum == len(tcData.topicInfo.ISR) {
 			if successNum > tcData.topicInfo.Replica/2 {
 			} else {
@@ -329,12 +491,14 @@ func (ncoord *NsqdCoordinator) PutMessagesToCluster(topic *nsqd.Topic,
 		}
 		return false
 	}
-	clusterErr := ncoord.doSyncOpToCluster(true, coord, doLocalWrite, doLocalExit, doLocalCommit, doLocalRollback,
-		doRefresh, doSlaveSync, handleSyncResult)
+	clusterErr := ncoord.doSyncOpToClusterWithAck(true, coord, requiredAcks, doLocalWrite, doLocalExit, doLocalCommit,
+		doLocalRollback, doRefresh, doSlaveSync, handleSyncResult)
 
 	var err error
 	if clusterErr != nil {
 		err = clusterErr.ToErrorType()
+	} else if dedupErr != nil {
+		err = dedupErr
 	} else if coordLog.Level() >= levellogger.LOG_DETAIL {
 		coordLog.Infof("sync write success put offset: %v, logmgr: %v, %v",
 			commitLog, logMgr.pLogID, logMgr.nLogID)
@@ -343,9 +507,128 @@ func (ncoord *NsqdCoordinator) PutMessagesToCluster(topic *nsqd.Topic,
 	return nsqd.MessageID(commitLog.LogID), nsqd.BackendOffset(commitLog.MsgOffset), commitLog.MsgSize, err
 }
 
+// putMirroredMessagesToCluster write the messages mirrored from other cluster, the message id
+// is kept as the source so the commit log is the same as the source.
+func (ncoord *NsqdCoordinator) putMirroredMessagesToCluster(topic *nsqd.Topic, msgs []*nsqd.Message) error {
+	var commitLog CommitLogData
+	if len(msgs) == 0 {
+		return nil
+	}
+	coord, checkErr := ncoord.getTopicCoord(topic.GetTopicName(), topic.GetTopicPart())
+	if checkErr != nil {
+		return checkErr.ToErrorType()
+	}
+	// check before write to avoid disabling the write while local write failed
+	lastLogID := coord.GetData().logMgr.GetLastCommitLogID()
+	if int64(msgs[0].ID) <= lastLogID {
+		coordLog.Warningf("topic %v mirrored message id %v is not newer than local %v",
+			topic.GetFullName(), msgs[0].ID, lastLogID)
+		return ErrCommitLogWrongID
+	}
+
+	var queueEnd nsqd.BackendQueueEnd
+	var logMgr *TopicCommitLogMgr
+	var slaveRaw []byte
+
+	doLocalWrite := func(d *coordData) *CoordErr {
+		logMgr = d.logMgr
+		topic.Lock()
+		captureRaw := topic.StartRawCaptureNoLock()
+		id, offset, writeBytes, totalCnt, qe, localErr := topic.PutMirroredMessagesNoLock(msgs)
+		if captureRaw {
+			slaveRaw = topic.StopRawCaptureNoLock()
+		}
+		queueEnd = qe
+		topic.Unlock()
+		if localErr != nil {
+			coordLog.Warningf("put mirrored messages to local failed: %v", localErr)
+			return &CoordErr{localErr.Error(), RpcNoErr, CoordLocalErr}
+		}
+		commitLog.LogID = int64(id)
+		commitLog.Epoch = d.GetTopicEpochForWrite()
+		commitLog.LastMsgLogID = int64(msgs[len(msgs)-1].ID)
+		commitLog.MsgOffset = int64(offset)
+		commitLog.MsgSize = writeBytes
+		commitLog.MsgCnt = totalCnt
+		commitLog.MsgNum = int32(len(msgs))
+		return nil
+	}
+	doLocalExit := func(err *CoordErr) {
+		if err != nil {
+			coordLog.Infof("topic %v put mirrored messages error: %v", topic.GetFullName(), err)
+			if coord.IsWriteDisabled() {
+				topic.DisableForSlave()
+			}
+		}
+	}
+	doLocalCommit := func() error {
+		localErr := logMgr.AppendCommitLogWithSync(&commitLog, false, topic.IsFsync())
+		if localErr != nil {
+			coordLog.Errorf("topic : %v failed write commit log : %v, logMgr: %v, %v",
+				topic.GetFullName(), localErr, logMgr.pLogID, logMgr.nLogID)
+		}
+		// the id is not generated by local, make sure the next local id is larger
+		logMgr.updateNextID(commitLog.LastMsgLogID)
+		topic.Lock()
+		topic.UpdateCommittedOffset(queueEnd)
+		topic.Unlock()
+		return localErr
+	}
+	doLocalRollback := func() {
+		coordLog.Warningf("failed write begin rollback : %v, %v", topic.GetFullName(), commitLog)
+		topic.Lock()
+		topic.ResetBackendEndNoLock(nsqd.BackendOffset(commitLog.MsgOffset), commitLog.MsgCnt-1)
+		topic.Unlock()
+	}
+	doRefresh := func(d *coordData) *CoordErr {
+		logMgr = d.logMgr
+		if d.GetTopicEpochForWrite() != commitLog.Epoch {
+			coordLog.Warningf("write epoch changed during write: %v, %v", d.GetTopicEpochForWrite(), commitLog)
+			return ErrEpochMismatch
+		}
+		ncoord.requestNotifyNewTopicInfo(d.topicInfo.Name, d.topicInfo.Partition)
+		return nil
+	}
+	doSlaveSync := func(c *NsqdRpcClient, nodeID string, tcData *coordData) *CoordErr {
+		var putErr *CoordErr
+		if len(slaveRaw) > 0 {
+			putErr = c.PutRawMessages(&tcData.topicLeaderSession, &tcData.topicInfo, commitLog, slaveRaw)
+		} else {
+			putErr = c.PutMessages(&tcData.topicLeaderSession, &tcData.topicInfo, commitLog, msgs)
+		}
+		if putErr != nil {
+			coordLog.Infof("sync mirrored write to replica %v failed: %v, put offset: %v, logmgr: %v, %v",
+				nodeID, putErr, commitLog, logMgr.pLogID, logMgr.nLogID)
+		}
+		return putErr
+	}
+	handleSyncResult := func(successNum int, tcData *coordData) bool {
+		if successNum == len(tcData.topicInfo.ISR) && successNum > tcData.topicInfo.Replica/2 {
+			return true
+		}
+		return false
+	}
+	clusterErr := ncoord.doSyncOpToCluster(true, coord, doLocalWrite, doLocalExit, doLocalCommit,
+		doLocalRollback, doRefresh, doSlaveSync, handleSyncResult)
+	if clusterErr != nil {
+		return clusterErr.ToErrorType()
+	}
+	return nil
+}
+
 func (ncoord *NsqdCoordinator) doSyncOpToCluster(isWrite bool, coord *TopicCoordinator, doLocalWrite localWriteFunc,
 	doLocalExit localExitFunc, doLocalCommit localCommitFunc, doLocalRollback localRollbackFunc,
 	doRefresh refreshCoordFunc, doSlaveSync slaveSyncFunc, handleSyncResult handleSyncResultFunc) *CoordErr {
+	return ncoord.doSyncOpToClusterWithAck(isWrite, coord, nil, doLocalWrite, doLocalExit, doLocalCommit,
+		doLocalRollback, doRefresh, doSlaveSync, handleSyncResult)
+}
+
+// if requiredAcks is not nil, the operation will be rejected if the isr is less than the required replicas,
+// and if not all the isr are required the operation will be synced to all the isr concurrently and returned
+// once the required replicas synced, the failed replicas will be requested to leave the isr.
+func (ncoord *NsqdCoordinator) doSyncOpToClusterWithAck(isWrite bool, coord *TopicCoordinator, requiredAcks requiredAcksFunc,
+	doLocalWrite localWriteFunc, doLocalExit localExitFunc, doLocalCommit localCommitFunc, doLocalRollback localRollbackFunc,
+	doRefresh refreshCoordFunc, doSlaveSync slaveSyncFunc, handleSyncResult handleSyncResultFunc) *CoordErr {
 
 	if isWrite {
 		coord.writeHold.Lock()
@@ -374,6 +657,11 @@ func (ncoord *NsqdCoordinator) doSyncOpToCluster(isWrite bool, coord *TopicCoord
 		coordErrStats.incWriteErr(ErrWriteQuorumFailed)
 		return ErrWriteQuorumFailed
 	}
+	if requiredAcks != nil && requiredAcks(tcData) > len(tcData.topicInfo.ISR) {
+		coordLog.Infof("topic(%v) operation failed since ISR less than min insync:%v", topicFullName, tcData.topicInfo)
+		coordErrStats.incWriteErr(ErrWriteQuorumFailed)
+		return ErrWriteQuorumFailed
+	}
 
 	checkCost := coordLog.Level() >= levellogger.LOG_DEBUG
 	if ncoord.enableBenchCost {
@@ -389,6 +677,11 @@ func (ncoord *NsqdCoordinator) doSyncOpToCluster(isWrite bool, coord *TopicCoord
 	halfSuccess := false
 
 	localErr := doLocalWrite(tcData)
+	if localErr == ErrLocalWriteSkipped {
+		// nothing written, no need to sync
+		doLocalExit(nil)
+		return nil
+	}
 	if localErr != nil {
 		clusterWriteErr = localErr
 		goto exitsync
@@ -431,6 +724,12 @@ retrysync:
 			clusterWriteErr = ErrWriteQuorumFailed
 			goto exitsync
 		}
+		if requiredAcks != nil && requiredAcks(tcData) > len(tcData.topicInfo.ISR) {
+			coordLog.Infof("topic(%v) sync write failed since ISR less than min insync:%v", topicFullName, tcData.topicInfo)
+			coordErrStats.incWriteErr(ErrWriteQuorumFailed)
+			clusterWriteErr = ErrWriteQuorumFailed
+			goto exitsync
+		}
 		if retryCnt > 3 {
 			go ncoord.requestNotifyNewTopicInfo(topicName, topicPartition)
 		}
@@ -446,6 +745,18 @@ retrysync:
 	// write epoch should keep the same (ignore epoch change during write)
 	// TODO: optimize send all requests first and then wait all responses
 	exitErr = 0
+	if requiredAcks != nil && requiredAcks(tcData) < len(tcData.topicInfo.ISR) {
+		var syncErr *CoordErr
+		success, exitErr, syncErr = ncoord.syncToISRWithAck(coord, tcData, doSlaveSync, requiredAcks(tcData), retryCnt, failedNodes)
+		if syncErr != nil {
+			clusterWriteErr = syncErr
+		}
+		if exitErr > len(tcData.topicInfo.ISR)/2 {
+			needLeaveISR = true
+			goto exitsync
+		}
+		goto handleresult
+	}
 	for _, nodeID := range tcData.topicInfo.ISR {
 		if nodeID == ncoord.myNode.GetID() {
 			success++
@@ -459,6 +770,9 @@ retrysync:
 			failedNodes[nodeID] = struct{}{}
 			continue
 		}
+		if isWrite {
+			coord.waitSlaveSyncDone(nodeID)
+		}
 		var start time.Time
 		if checkCost {
 			start = time.Now()
@@ -488,6 +802,7 @@ retrysync:
 		}
 	}
 
+handleresult:
 	if handleSyncResult(success, tcData) {
 		var start time.Time
 		if checkCost {
@@ -507,6 +822,13 @@ retrysync:
 		} else {
 			needLeaveISR = false
 			clusterWriteErr = nil
+			if requiredAcks != nil {
+				// the data on the failed replicas is not consistent while the write is acknowledged
+				// without all the isr synced, so they should leave the isr and catchup later
+				for nid := range failedNodes {
+					go ncoord.leaveISRForFailedSync(topicName, topicPartition, nid)
+				}
+			}
 		}
 	} else {
 		coordLog.Warningf("topic %v sync operation failed since no enough success: %v", topicFullName, success)
@@ -580,6 +902,106 @@ exitsync:
 	return clusterWriteErr
 }
 
+// waitSlaveSyncDone wait the previous sync to the slave finished, should be called with writeHold.
+func (coord *TopicCoordinator) waitSlaveSyncDone(nodeID string) {
+	done, ok := coord.slaveSyncDone[nodeID]
+	if !ok {
+		return
+	}
+	<-done
+	delete(coord.slaveSyncDone, nodeID)
+}
+
+// startSlaveSync run the sync to the slave after the previous sync to the same slave finished, since the
+// slave will reject the write with the unexpected offset. Should be called with writeHold.
+func (coord *TopicCoordinator) startSlaveSync(nodeID string, sync func()) {
+	prev := coord.slaveSyncDone[nodeID]
+	done := make(chan struct{})
+	if coord.slaveSyncDone == nil {
+		coord.slaveSyncDone = make(map[string]chan struct{})
+	}
+	coord.slaveSyncDone[nodeID] = done
+	go func() {
+		defer close(done)
+		if prev != nil {
+			<-prev
+		}
+		sync()
+	}()
+}
+
+// syncToISRWithAck send the operation to the slaves in isr concurrently and return while the required replicas
+// synced or all the slaves responded. The slower slaves are waited in background and the failed ones
+// will leave the isr. The operations to the same slave are kept in order even the previous one is still
+// running in background. Return the success replicas (include leader) and the number of the non-retry errors.
+func (ncoord *NsqdCoordinator) syncToISRWithAck(coord *TopicCoordinator, tcData *coordData, doSlaveSync slaveSyncFunc,
+	required int, retryCnt uint32, failedNodes map[string]struct{}) (int, int, *CoordErr) {
+	type syncResult struct {
+		nodeID string
+		err    *CoordErr
+	}
+	var lastErr *CoordErr
+	success := 0
+	exitErr := 0
+	pending := 0
+	resultCh := make(chan syncResult, len(tcData.topicInfo.ISR))
+	for _, nodeID := range tcData.topicInfo.ISR {
+		if nodeID == ncoord.myNode.GetID() {
+			success++
+			continue
+		}
+		c, rpcErr := ncoord.acquireRpcClient(nodeID)
+		if rpcErr != nil {
+			coordLog.Infof("get rpc client %v failed: %v", nodeID, rpcErr)
+			failedNodes[nodeID] = struct{}{}
+			continue
+		}
+		pending++
+		nid := nodeID
+		coord.startSlaveSync(nid, func() {
+			resultCh <- syncResult{nodeID: nid, err: doSlaveSync(c, nid, tcData)}
+		})
+	}
+	for pending > 0 && success < required {
+		r := <-resultCh
+		pending--
+		if r.err == nil {
+			success++
+			continue
+		}
+		coordLog.Infof("sync operation to replica %v failed: %v", r.nodeID, r.err)
+		lastErr = r.err
+		failedNodes[r.nodeID] = struct{}{}
+		if !r.err.CanRetryWrite(int(retryCnt)) {
+			exitErr++
+		}
+	}
+	if pending > 0 {
+		topicName := tcData.topicInfo.Name
+		partition := tcData.topicInfo.Partition
+		go func(pending int) {
+			for ; pending > 0; pending-- {
+				r := <-resultCh
+				if r.err != nil {
+					coordLog.Infof("topic %v-%v sync operation to replica %v failed after acknowledged: %v",
+						topicName, partition, r.nodeID, r.err)
+					ncoord.leaveISRForFailedSync(topicName, partition, r.nodeID)
+				}
+			}
+		}(pending)
+	}
+	return success, exitErr, lastErr
+}
+
+func (ncoord *NsqdCoordinator) leaveISRForFailedSync(topicName string, partition int, nodeID string) {
+	err := ncoord.requestLeaveFromISRByLeader(topicName, partition, nodeID)
+	if err != nil {
+		coordLog.Warningf("failed to request remove the failed isr node: %v, %v", nodeID, err)
+	} else {
+		coordLog.Infof("request the failed node: %v to leave topic %v-%v isr", nodeID, topicName, partition)
+	}
+}
+
 func (ncoord *NsqdCoordinator) putRawDataOnSlave(coord *TopicCoordinator, logData CommitLogData,
 	rawData []byte, putDelayed bool) *CoordErr {
 	var topic *nsqd.Topic
@@ -1100,6 +1522,46 @@ func (ncoord *NsqdCoordinator) UpdateChannelStateToCluster(channel *nsqd.Channel
 	return nil
 }
 
+func (ncoord *NsqdCoordinator) UpdateChannelDeadLetterToCluster(channel *nsqd.Channel, maxAttempts uint16, dlqTopic string) error {
+	topicName := channel.GetTopicName()
+	partition := channel.GetTopicPart()
+	coord, checkErr := ncoord.getTopicCoord(topicName, partition)
+	if checkErr != nil {
+		return checkErr.ToErrorType()
+	}
+
+	doLocalWrite := func(d *coordData) *CoordErr {
+		channel.SetDeadLetter(maxAttempts, dlqTopic)
+		return nil
+	}
+	doLocalExit := func(err *CoordErr) {}
+	doLocalCommit := func() error {
+		return nil
+	}
+	doLocalRollback := func() {
+	}
+	doRefresh := func(d *coordData) *CoordErr {
+		return nil
+	}
+	doSlaveSync := func(c *NsqdRpcClient, nodeID string, tcData *coordData) *CoordErr {
+		rpcErr := c.UpdateChannelDeadLetter(&tcData.topicLeaderSession, &tcData.topicInfo, channel.GetName(), maxAttempts, dlqTopic)
+		if rpcErr != nil {
+			coordLog.Infof("sync channel(%v) dead letter max attempts:%v, topic:%v to replica %v failed: %v, topic %v,%v",
+				channel.GetName(), maxAttempts, dlqTopic, nodeID, rpcErr, topicName, partition)
+		}
+		return rpcErr
+	}
+	handleSyncResult := func(successNum int, tcData *coordData) bool {
+		return true
+	}
+	clusterErr := ncoord.doSyncOpToCluster(false, coord, doLocalWrite, doLocalExit, doLocalCommit, doLocalRollback,
+		doRefresh, doSlaveSync, handleSyncResult)
+	if clusterErr != nil {
+		return clusterErr.ToErrorType()
+	}
+	return nil
+}
+
 func (ncoord *NsqdCoordinator) FinishMessageToCluster(channel *nsqd.Channel, clientID int64, clientAddr string, msgID nsqd.MessageID) error {
 	topicName := channel.GetTopicName()
 	partition := channel.GetTopicPart()
@@ -1195,6 +1657,108 @@ func (ncoord *NsqdCoordinator) FinishMessageToCluster(channel *nsqd.Channel, cli
 	return nil
 }
 
+// FinishMessagesToCluster finish a batch of messages and sync the channel offset to the replicas only once.
+// The returned errors are for each message id, and the cluster error is returned if the sync failed.
+func (ncoord *NsqdCoordinator) FinishMessagesToCluster(channel *nsqd.Channel, clientID int64, clientAddr string,
+	msgIDs []nsqd.MessageID) ([]error, error) {
+	topicName := channel.GetTopicName()
+	partition := channel.GetTopicPart()
+	coord, checkErr := ncoord.getTopicCoord(topicName, partition)
+	if checkErr != nil {
+		return nil, checkErr.ToErrorType()
+	}
+
+	var syncOffset ChannelConsumerOffset
+	changed := false
+	var confirmed nsqd.BackendQueueEnd
+	if channel.IsOrdered() {
+		if !coord.GetData().IsISRReadyForWrite(ncoord.myNode.GetID()) {
+			coordLog.Warningf("topic(%v) finish message ordered failed since no enough ISR", topicName)
+			coordErrStats.incWriteErr(ErrWriteQuorumFailed)
+			return nil, ErrWriteQuorumFailed.ToErrorType()
+		}
+
+		confirmed = channel.GetConfirmed()
+	}
+	delayedMsg := false
+	msgErrs := make([]error, len(msgIDs))
+
+	doLocalWrite := func(d *coordData) *CoordErr {
+		finished := 0
+		for i, msgID := range msgIDs {
+			offset, cnt, tmpChanged, msg, localErr := channel.FinishMessageForce(clientID, clientAddr, msgID, false)
+			if localErr != nil {
+				coordLog.Debugf("channel %v finish local msg %v error: %v", channel.GetName(), msgID, localErr)
+				msgErrs[i] = localErr
+				continue
+			}
+			finished++
+			if tmpChanged {
+				// the confirmed offset only move forward, so the last changed is the newest
+				changed = true
+				syncOffset.VOffset = int64(offset)
+				syncOffset.VCnt = cnt
+			}
+			if msg != nil && msg.DelayedType == nsqd.ChannelDelayed && len(msg.DelayedChannel) > 0 {
+				delayedMsg = true
+			}
+		}
+		if finished == 0 {
+			return ErrLocalWriteSkipped
+		}
+		return nil
+	}
+	doLocalExit := func(err *CoordErr) {}
+	doLocalCommit := func() error {
+		channel.ContinueConsumeForOrder()
+		return nil
+	}
+	doLocalRollback := func() {
+		if channel.IsOrdered() && confirmed != nil {
+			coordLog.Warningf("rollback channel confirm to : %v", confirmed)
+			// reset read to last confirmed
+			channel.SetConsumeOffset(confirmed.Offset(), confirmed.TotalMsgCnt(), true)
+		}
+	}
+	doRefresh := func(d *coordData) *CoordErr {
+		return nil
+	}
+	doSlaveSync := func(c *NsqdRpcClient, nodeID string, tcData *coordData) *CoordErr {
+		if !changed || channel.IsEphemeral() {
+			return nil
+		}
+		var rpcErr *CoordErr
+		if channel.IsOrdered() {
+			rpcErr = c.UpdateChannelOffset(&tcData.topicLeaderSession, &tcData.topicInfo, channel.GetName(), syncOffset)
+		} else {
+			if delayedMsg {
+				ts, cursorList, cntList, channelCntList := channel.GetDelayedQueueConsumedDetails()
+				rpcErr = c.UpdateDelayedQueueState(&tcData.topicLeaderSession, &tcData.topicInfo,
+					channel.GetName(), ts, cursorList, cntList, channelCntList, false)
+			} else {
+				c.NotifyUpdateChannelOffset(&tcData.topicLeaderSession, &tcData.topicInfo, channel.GetName(), syncOffset)
+			}
+		}
+		if rpcErr != nil {
+			coordLog.Infof("sync channel(%v) offset to replica %v failed: %v, offset: %v", channel.GetName(),
+				nodeID, rpcErr, syncOffset)
+		}
+		return rpcErr
+	}
+	handleSyncResult := func(successNum int, tcData *coordData) bool {
+		if successNum == len(tcData.topicInfo.ISR) || (!channel.IsOrdered() && !delayedMsg) {
+			return true
+		}
+		return false
+	}
+	clusterErr := ncoord.doSyncOpToCluster(false, coord, doLocalWrite, doLocalExit, doLocalCommit, doLocalRollback,
+		doRefresh, doSlaveSync, handleSyncResult)
+	if clusterErr != nil {
+		return msgErrs, clusterErr.ToErrorType()
+	}
+	return msgErrs, nil
+}
+
 func (ncoord *NsqdCoordinator) updateChannelStateOnSlave(tc *coordData, channelName string, paused int, skipped int, zanTestSkipped int) *CoordErr {
 	topicName := tc.topicInfo.Name
 	partition := tc.topicInfo.Partition
@@ -1270,6 +1834,44 @@ func (ncoord *NsqdCoordinator) updateChannelStateOnSlave(tc *coordData, channelN
 	return nil
 }
 
+func (ncoord *NsqdCoordinator) updateChannelDeadLetterOnSlave(tc *coordData, channelName string, maxAttempts uint16, dlqTopic string) *CoordErr {
+	topicName := tc.topicInfo.Name
+	partition := tc.topicInfo.Partition
+
+	if !tc.IsMineISR(ncoord.myNode.GetID()) {
+		return ErrTopicWriteOnNonISR
+	}
+
+	_, coordErr := ncoord.getTopicCoord(topicName, partition)
+	if coordErr != nil {
+		return ErrMissingTopicCoord
+	}
+
+	topic, localErr := ncoord.localNsqd.GetExistingTopic(topicName, partition)
+	if localErr != nil {
+		coordLog.Warningf("slave missing topic : %v", topicName)
+		return &CoordErr{localErr.Error(), RpcCommonErr, CoordSlaveErr}
+	}
+
+	if topic.GetTopicPart() != partition {
+		coordLog.Errorf("topic on slave has different partition : %v vs %v", topic.GetTopicPart(), partition)
+		return ErrLocalMissingTopic
+	}
+	var ch *nsqd.Channel
+	ch, localErr = topic.GetExistingChannel(channelName)
+	if localErr != nil {
+		ch = topic.GetChannel(channelName)
+		coordLog.Infof("slave init the channel : %v, %v, offset: %v", topic.GetTopicName(), channelName, ch.GetConfirmed())
+	}
+	if ch.IsEphemeral() {
+		coordLog.Errorf("ephemeral channel %v should not be synced on slave", channelName)
+	}
+	ch.SetDeadLetter(maxAttempts, dlqTopic)
+
+	topic.SaveChannelMeta()
+	return nil
+}
+
 func (ncoord *NsqdCoordinator) updateChannelOffsetOnSlave(tc *coordData, channelName string, offset ChannelConsumerOffset) *CoordErr {
 	topicName := tc.topicInfo.Name
 	partition := tc.topicInfo.Partition
@@ -1372,6 +1974,7 @@ func (ncoord *NsqdCoordinator) DeleteChannel(topic *nsqd.Topic, channelName stri
 				topicName, channelName, localErr)
 		} else {
 			topic.SaveChannelMeta()
+			ncoord.ForgetConsumerGroupOwner(topicName, partition, channelName)
 		}
 		return nil
 	}
@@ -1430,6 +2033,7 @@ func (ncoord *NsqdCoordinator) deleteChannelOnSlave(tc *coordData, channelName s
 	} else {
 		tc.syncedConsumeMgr.Clear()
 		topic.SaveChannelMeta()
+		ncoord.ForgetConsumerGroupOwner(topicName, partition, channelName)
 	}
 	return nil
 }
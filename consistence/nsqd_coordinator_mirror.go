@@ -0,0 +1,503 @@
+package consistence
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/youzan/nsq/internal/util"
+	"github.com/youzan/nsq/nsqd"
+)
+
+const (
+	mirrorPosFileSuffix = ".mirror"
+	// the max count index used to get the last commit log from the source
+	mirrorMaxCountIndex = int64(1) << 62
+)
+
+var (
+	checkMirrorInterval   = time.Second * 10
+	mirrorIdleWait        = time.Second
+	mirrorRetryWait       = time.Second * 5
+	mirrorRefreshInterval = time.Minute
+	mirrorHttpClient      = &http.Client{Timeout: time.Second * 5}
+)
+
+var (
+	errMirrorSourceExtMismatch  = errors.New("the ext of mirror source topic mismatch")
+	errMirrorSourcePartMismatch = errors.New("the partition number of mirror source topic mismatch")
+	errMirrorSourceCompacted    = errors.New("the mirror source topic is compacted, which can not be mirrored since the compacted messages are removed")
+)
+
+// TopicMirrorStat is the mirror state of the topic partition leader.
+type TopicMirrorStat struct {
+	Source     string `json:"source"`
+	SourceNode string `json:"source_node"`
+	// the commit log count index of the source partition for the next pull
+	Position  int64 `json:"position"`
+	LastLogID int64 `json:"last_log_id"`
+	// the messages not mirrored yet
+	LagMsgs      int64  `json:"lag_msgs"`
+	LastSyncTime int64  `json:"last_sync_time"`
+	LastError    string `json:"last_error,omitempty"`
+}
+
+// the mirror position persisted on the leader, it will be verified with the
+// local commit log and the source commit log before resume.
+type mirrorPosition struct {
+	SourceCountIndex int64 `json:"source_count_index"`
+	LastLogID        int64 `json:"last_log_id"`
+}
+
+type topicMirror struct {
+	topic     string
+	partition int
+	source    string
+	lookupds  []string
+	stopC     chan struct{}
+
+	sourceNode  string
+	refreshTime time.Time
+	// -1 means the position should be found again
+	pos        int64
+	lastMsgCnt int64
+
+	sync.Mutex
+	stat TopicMirrorStat
+}
+
+// ParseMirrorLookupdAddrs parse the comma separated http addresses of the lookupd in the mirror source cluster.
+func ParseMirrorLookupdAddrs(mirrorFrom string) ([]string, error) {
+	ret := make([]string, 0, 1)
+	for _, addr := range strings.Split(mirrorFrom, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("invalid mirror lookupd address %v: %v", addr, err)
+		}
+		ret = append(ret, addr)
+	}
+	if len(ret) == 0 {
+		return nil, errors.New("missing mirror lookupd address")
+	}
+	return ret, nil
+}
+
+func getTopicMirrorPosFile(rootPath string, topic string, partition int) string {
+	return filepath.Join(GetTopicPartitionBasePath(rootPath, topic, partition),
+		GetTopicPartitionFileName(topic, partition, mirrorPosFileSuffix))
+}
+
+func loadMirrorPosition(fileName string) (*mirrorPosition, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var pos mirrorPosition
+	err = json.Unmarshal(data, &pos)
+	if err != nil {
+		return nil, err
+	}
+	return &pos, nil
+}
+
+func saveMirrorPosition(fileName string, pos mirrorPosition) error {
+	data, err := json.Marshal(pos)
+	if err != nil {
+		return err
+	}
+	tmpFileName := fileName + ".tmp"
+	err = ioutil.WriteFile(tmpFileName, data, 0644)
+	if err != nil {
+		return err
+	}
+	return util.AtomicRename(tmpFileName, fileName)
+}
+
+type mirrorLookupPeer struct {
+	DistributedID string `json:"distributed_id"`
+}
+
+type mirrorLookupResp struct {
+	Meta struct {
+		PartitionNum  int  `json:"partition_num"`
+		ExtendSupport bool `json:"extend_support"`
+		Compact       bool `json:"compact"`
+	} `json:"meta"`
+	Partitions map[string]mirrorLookupPeer `json:"partitions"`
+}
+
+// find the leader node of the topic partition in the mirror source cluster
+func lookupMirrorSource(lookupds []string, topic string, partition int) (string, *mirrorLookupResp, error) {
+	var lastErr error
+	for _, addr := range lookupds {
+		ep := fmt.Sprintf("http://%s/lookup?topic=%s&partition=%v&access=r&consistent=true&metainfo=true",
+			addr, url.QueryEscape(topic), partition)
+		rsp, err := mirrorHttpClient.Get(ep)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		var ret mirrorLookupResp
+		if rsp.StatusCode != http.StatusOK {
+			lastErr = fmt.Errorf("lookup mirror source %v failed: %v", addr, rsp.Status)
+		} else {
+			lastErr = json.NewDecoder(rsp.Body).Decode(&ret)
+		}
+		rsp.Body.Close()
+		if lastErr != nil {
+			continue
+		}
+		peer, ok := ret.Partitions[strconv.Itoa(partition)]
+		if !ok || peer.DistributedID == "" {
+			lastErr = fmt.Errorf("topic %v-%v leader not found in mirror source %v", topic, partition, addr)
+			continue
+		}
+		return peer.DistributedID, &ret, nil
+	}
+	return "", nil, lastErr
+}
+
+func (ncoord *NsqdCoordinator) checkTopicMirrors() {
+	defer ncoord.wg.Done()
+	ticker := time.NewTicker(checkMirrorInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ncoord.updateTopicMirrors()
+		case <-ncoord.stopChan:
+			ncoord.mirrorMutex.Lock()
+			for name, m := range ncoord.topicMirrors {
+				close(m.stopC)
+				delete(ncoord.topicMirrors, name)
+			}
+			ncoord.mirrorMutex.Unlock()
+			return
+		}
+	}
+}
+
+// start the mirror on the leader of the mirror topic partitions, and stop the
+// mirror if not leader anymore or the mirror is disabled.
+func (ncoord *NsqdCoordinator) updateTopicMirrors() {
+	tmpCoords := make(map[string]map[int]*TopicCoordinator)
+	ncoord.getAllCoords(tmpCoords)
+	wanted := make(map[string]*TopicPartitionMetaInfo)
+	for _, tc := range tmpCoords {
+		for _, tpc := range tc {
+			tcData := tpc.GetData()
+			if tcData.topicInfo.MirrorFrom == "" || tpc.IsExiting() ||
+				!tcData.IsMineLeaderSessionReady(ncoord.GetMyID()) {
+				continue
+			}
+			wanted[tcData.topicInfo.GetTopicDesp()] = &tcData.topicInfo
+		}
+	}
+	ncoord.mirrorMutex.Lock()
+	defer ncoord.mirrorMutex.Unlock()
+	for name, m := range ncoord.topicMirrors {
+		if info, ok := wanted[name]; !ok || info.MirrorFrom != m.source {
+			coordLog.Infof("topic %v stop mirror from %v", name, m.source)
+			close(m.stopC)
+			delete(ncoord.topicMirrors, name)
+		}
+	}
+	for name, info := range wanted {
+		if _, ok := ncoord.topicMirrors[name]; ok {
+			continue
+		}
+		lookupds, err := ParseMirrorLookupdAddrs(info.MirrorFrom)
+		if err != nil {
+			coordLog.Warningf("topic %v mirror source %v invalid: %v", name, info.MirrorFrom, err)
+			continue
+		}
+		m := &topicMirror{
+			topic:     info.Name,
+			partition: info.Partition,
+			source:    info.MirrorFrom,
+			lookupds:  lookupds,
+			stopC:     make(chan struct{}),
+			pos:       -1,
+		}
+		m.stat.Source = info.MirrorFrom
+		m.stat.Position = -1
+		ncoord.topicMirrors[name] = m
+		coordLog.Infof("topic %v start mirror from %v", name, info.MirrorFrom)
+		ncoord.wg.Add(1)
+		go ncoord.runTopicMirror(m)
+	}
+}
+
+func (ncoord *NsqdCoordinator) getTopicMirrorStat(topic string, partition int) *TopicMirrorStat {
+	ncoord.mirrorMutex.Lock()
+	m, ok := ncoord.topicMirrors[topic+"-"+strconv.Itoa(partition)]
+	ncoord.mirrorMutex.Unlock()
+	if !ok {
+		return nil
+	}
+	m.Lock()
+	stat := m.stat
+	m.Unlock()
+	return &stat
+}
+
+func (ncoord *NsqdCoordinator) runTopicMirror(m *topicMirror) {
+	defer ncoord.wg.Done()
+	for {
+		select {
+		case <-m.stopC:
+			return
+		case <-ncoord.stopChan:
+			return
+		default:
+		}
+		idle, err := ncoord.doTopicMirrorOnce(m)
+		m.Lock()
+		if err != nil {
+			m.stat.LastError = err.Error()
+		} else {
+			m.stat.LastError = ""
+		}
+		m.Unlock()
+		wait := time.Duration(0)
+		if err != nil {
+			coordLog.Infof("topic %v-%v mirror from %v failed: %v", m.topic, m.partition, m.source, err)
+			wait = mirrorRetryWait
+		} else if idle {
+			wait = mirrorIdleWait
+		}
+		if wait > 0 {
+			select {
+			case <-m.stopC:
+				return
+			case <-ncoord.stopChan:
+				return
+			case <-time.After(wait):
+			}
+		}
+	}
+}
+
+// get the log at the count index from the source partition
+func getMirrorSourceLog(c *NsqdRpcClient, sourceInfo *TopicPartitionMetaInfo, countIndex int64) (*CommitLogData, error) {
+	_, _, _, _, l, rpcErr := c.GetCommitLogFromOffset(sourceInfo, countIndex, 0, 0, false)
+	if rpcErr != nil {
+		return nil, rpcErr.ToErrorType()
+	}
+	return &l, nil
+}
+
+// get the last log and its count index from the source partition, nil if no any log.
+func getMirrorSourceEnd(c *NsqdRpcClient, sourceInfo *TopicPartitionMetaInfo) (int64, *CommitLogData, error) {
+	_, countIndex, _, _, l, rpcErr := c.GetCommitLogFromOffset(sourceInfo, mirrorMaxCountIndex, 0, 0, false)
+	if rpcErr != nil {
+		if rpcErr.IsEqual(ErrTopicCommitLogEOF) {
+			return 0, nil, nil
+		}
+		if !rpcErr.IsEqual(ErrTopicCommitLogOutofBound) {
+			return 0, nil, rpcErr.ToErrorType()
+		}
+	}
+	if l.LogID == 0 {
+		return 0, nil, nil
+	}
+	return countIndex, &l, nil
+}
+
+// find the source count index for the next pull. The saved position is used if it matches
+// the local commit log, otherwise we search the first source log newer than the local.
+func (ncoord *NsqdCoordinator) findMirrorPosition(c *NsqdRpcClient, sourceInfo *TopicPartitionMetaInfo,
+	logMgr *TopicCommitLogMgr) (int64, int64, error) {
+	startInfo, firstLog, err := c.GetFullSyncInfo(sourceInfo.Name, sourceInfo.Partition, false)
+	if err != nil {
+		return 0, 0, err
+	}
+	start := startInfo.SegmentStartCount
+	startMsgCnt := firstLog.MsgCnt - int64(firstLog.MsgNum)
+	if startMsgCnt < 0 {
+		startMsgCnt = 0
+	}
+	lastIndex, lastLog, err := getMirrorSourceEnd(c, sourceInfo)
+	if err != nil {
+		return 0, 0, err
+	}
+	if lastLog == nil {
+		return start, startMsgCnt, nil
+	}
+	localLast := logMgr.GetLastCommitLogID()
+	if localLast == 0 {
+		return start, startMsgCnt, nil
+	}
+	saved, err := loadMirrorPosition(getTopicMirrorPosFile(ncoord.dataRootPath, sourceInfo.Name, sourceInfo.Partition))
+	if err == nil && saved.LastLogID == localLast &&
+		saved.SourceCountIndex > start && saved.SourceCountIndex <= lastIndex+1 {
+		l, err := getMirrorSourceLog(c, sourceInfo, saved.SourceCountIndex-1)
+		if err == nil && l.LogID == localLast {
+			return saved.SourceCountIndex, l.MsgCnt, nil
+		}
+	}
+	// search the first log newer than local
+	lo, hi := start, lastIndex+1
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		l, err := getMirrorSourceLog(c, sourceInfo, mid)
+		if err != nil {
+			return 0, 0, err
+		}
+		if l.LogID > localLast {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+	if lo == start {
+		if localLast > 0 {
+			coordLog.Warningf("topic %v mirror source start %v is newer than local %v, some messages may be lost",
+				sourceInfo.GetTopicDesp(), start, localLast)
+		}
+		return start, startMsgCnt, nil
+	}
+	l, err := getMirrorSourceLog(c, sourceInfo, lo-1)
+	if err != nil {
+		return 0, 0, err
+	}
+	if l.LogID != localLast {
+		coordLog.Warningf("topic %v mirror source log %v not matched with local %v",
+			sourceInfo.GetTopicDesp(), l, localLast)
+	}
+	return lo, l.MsgCnt, nil
+}
+
+// pull the logs from the source and write to local cluster, return true if no more logs.
+func (ncoord *NsqdCoordinator) doTopicMirrorOnce(m *topicMirror) (bool, error) {
+	tc, coordErr := ncoord.getTopicCoord(m.topic, m.partition)
+	if coordErr != nil {
+		return false, coordErr.ToErrorType()
+	}
+	tcData := tc.GetData()
+	if !tcData.IsMineLeaderSessionReady(ncoord.GetMyID()) {
+		return false, ErrNotTopicLeader.ToErrorType()
+	}
+	localTopic, err := ncoord.localNsqd.GetExistingTopic(m.topic, m.partition)
+	if err != nil {
+		return false, err
+	}
+	if m.sourceNode == "" || time.Since(m.refreshTime) > mirrorRefreshInterval {
+		nid, meta, err := lookupMirrorSource(m.lookupds, m.topic, m.partition)
+		if err != nil {
+			return false, err
+		}
+		if meta.Meta.ExtendSupport != localTopic.IsExt() {
+			return false, errMirrorSourceExtMismatch
+		}
+		if meta.Meta.PartitionNum != tcData.topicInfo.PartitionNum {
+			return false, errMirrorSourcePartMismatch
+		}
+		if meta.Meta.Compact {
+			return false, errMirrorSourceCompacted
+		}
+		if nid != m.sourceNode {
+			coordLog.Infof("topic %v-%v mirror source node changed from %v to %v",
+				m.topic, m.partition, m.sourceNode, nid)
+			m.sourceNode = nid
+			m.Lock()
+			m.stat.SourceNode = nid
+			m.Unlock()
+		}
+		m.refreshTime = time.Now()
+	}
+	c, coordErr := ncoord.acquireRpcClient(m.sourceNode)
+	if coordErr != nil {
+		m.sourceNode = ""
+		return false, coordErr.ToErrorType()
+	}
+	sourceInfo := &TopicPartitionMetaInfo{Name: m.topic, Partition: m.partition}
+	if m.pos < 0 {
+		pos, lastMsgCnt, err := ncoord.findMirrorPosition(c, sourceInfo, tcData.logMgr)
+		if err != nil {
+			m.sourceNode = ""
+			return false, err
+		}
+		coordLog.Infof("topic %v-%v mirror from source %v position %v", m.topic, m.partition, m.sourceNode, pos)
+		m.pos = pos
+		m.lastMsgCnt = lastMsgCnt
+	}
+	logs, dataList, err := c.PullCommitLogsAndData(m.topic, m.partition, m.pos, 0, 0, MAX_LOG_PULL, false)
+	if err != nil {
+		// the source may be changed, find the position again
+		m.pos = -1
+		m.sourceNode = ""
+		return false, err
+	}
+	mirrored := 0
+	for i, l := range logs {
+		if l.LogID > tcData.logMgr.GetLastCommitLogID() {
+			msgs, err := nsqd.DecodeRawMessages(dataList[i], localTopic.IsExt())
+			if err == nsqd.ErrRawDataCompacted {
+				// the source lookupd may be the old version without the compact meta
+				err = errMirrorSourceCompacted
+			}
+			if err == nil && int32(len(msgs)) != l.MsgNum {
+				err = fmt.Errorf("mirrored messages number mismatch: %v, %v", len(msgs), l)
+			}
+			if err == nil {
+				err = ncoord.putMirroredMessagesToCluster(localTopic, msgs)
+			}
+			if err != nil {
+				ncoord.updateMirrorProgress(m, mirrored, tcData.logMgr.GetLastCommitLogID(), -1)
+				return false, err
+			}
+		}
+		// the logs already in local (may happen after the leader changed) are skipped
+		m.pos++
+		m.lastMsgCnt = l.MsgCnt
+		mirrored++
+	}
+	sourceMsgCnt := int64(-1)
+	if len(logs) == 0 {
+		sourceMsgCnt = m.lastMsgCnt
+	} else {
+		_, lastLog, err := getMirrorSourceEnd(c, sourceInfo)
+		if err == nil && lastLog != nil {
+			sourceMsgCnt = lastLog.MsgCnt
+		}
+	}
+	ncoord.updateMirrorProgress(m, mirrored, tcData.logMgr.GetLastCommitLogID(), sourceMsgCnt)
+	return len(logs) == 0, nil
+}
+
+// update the mirror stats and save the position, the lag is not changed if the source
+// message count is unknown (-1).
+func (ncoord *NsqdCoordinator) updateMirrorProgress(m *topicMirror, mirrored int, lastLogID int64, sourceMsgCnt int64) {
+	m.Lock()
+	m.stat.Position = m.pos
+	m.stat.LastLogID = lastLogID
+	m.stat.LastSyncTime = time.Now().Unix()
+	if sourceMsgCnt >= 0 {
+		m.stat.LagMsgs = sourceMsgCnt - m.lastMsgCnt
+		if m.stat.LagMsgs < 0 {
+			m.stat.LagMsgs = 0
+		}
+	}
+	m.Unlock()
+	if mirrored == 0 {
+		return
+	}
+	err := saveMirrorPosition(getTopicMirrorPosFile(ncoord.dataRootPath, m.topic, m.partition),
+		mirrorPosition{SourceCountIndex: m.pos, LastLogID: lastLogID})
+	if err != nil {
+		coordLog.Infof("topic %v-%v save mirror position failed: %v", m.topic, m.partition, err)
+	}
+}
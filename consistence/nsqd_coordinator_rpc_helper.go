@@ -101,3 +101,11 @@ func (ncoord *NsqdCoordinator) requestLeaveFromISRByLeader(topic string, partiti
 	//defer ncoord.putLookupRemoteProxy(c)
 	return c.RequestLeaveFromISRByLeader(topic, partition, nid, &topicCoord.topicLeaderSession)
 }
+
+func (ncoord *NsqdCoordinator) requestConsumerGroupOwner(topic string, partition int, channel string) (bool, string, int64, *CoordErr) {
+	c, err := ncoord.getLookupRemoteProxy()
+	if err != nil {
+		return false, "", 0, err
+	}
+	return c.GetConsumerGroupOwner(topic, partition, channel)
+}
@@ -1,11 +1,16 @@
 package consistence
 
 import (
+	"bytes"
+	"encoding/base64"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -69,6 +74,7 @@ type fakeLookupRemoteProxy struct {
 	lookupEpoch    EpochType
 	t              *testing.T
 	addr           string
+	groupMgr       *consumerGroupMgr
 }
 
 func NewFakeLookupRemoteProxy(addr string, timeout time.Duration) (INsqlookupRemoteProxy, error) {
@@ -76,6 +82,7 @@ func NewFakeLookupRemoteProxy(addr string, timeout time.Duration) (INsqlookupRem
 		leaderSessions: make(map[string]map[int]*TopicLeaderSession),
 		fakeNsqdCoords: make(map[string]*NsqdCoordinator),
 		addr:           addr,
+		groupMgr:       newConsumerGroupMgr(defaultGroupSessionTimeout, nil),
 	}, nil
 }
 
@@ -167,6 +174,14 @@ func (self *fakeLookupRemoteProxy) RequestLeaveFromISRByLeader(topic string, par
 	return ErrNotTopicLeader
 }
 
+func (self *fakeLookupRemoteProxy) GetConsumerGroupOwner(topic string, partition int, channel string) (bool, string, int64, *CoordErr) {
+	owner, gen, err := self.groupMgr.getPartitionOwner(topic, channel, partition)
+	if err != nil {
+		return false, "", 0, nil
+	}
+	return true, owner, gen, nil
+}
+
 func mustStartNSQD(opts *nsqdNs.Options) *nsqdNs.NSQD {
 	opts.TCPAddress = "127.0.0.1:0"
 	opts.HTTPAddress = "127.0.0.1:0"
@@ -244,6 +259,10 @@ func ensureCatchupForTopic(nsqdCoord *NsqdCoordinator, topicInfo RpcAdminTopicIn
 }
 
 func newNsqdNode(t *testing.T, id string) (*nsqdNs.NSQD, int, *NsqdNodeInfo, string) {
+	return newNsqdNodeWithOptions(t, id, nil)
+}
+
+func newNsqdNodeWithOptions(t *testing.T, id string, setOpts func(*nsqdNs.Options)) (*nsqdNs.NSQD, int, *NsqdNodeInfo, string) {
 	opts := nsqdNs.NewOptions()
 	opts.Logger = newTestLogger(t)
 	opts.MaxBytesPerFile = 1024 * 1024
@@ -259,6 +278,9 @@ func newNsqdNode(t *testing.T, id string) (*nsqdNs.NSQD, int, *NsqdNodeInfo, str
 	if t == nil {
 		opts.Logger = nil
 	}
+	if setOpts != nil {
+		setOpts(opts)
+	}
 	nsqd := mustStartNSQD(opts)
 	randPort := rand.Int31n(10000) + 20000
 	nodeInfo := NsqdNodeInfo{
@@ -1820,6 +1842,950 @@ func testNsqdCoordPutMessageAndSyncChannelOffset(t *testing.T, isExt bool) {
 	// TODO: test retry write
 }
 
+func TestNsqdCoordRequiredSyncAcks(t *testing.T) {
+	var topicInfo TopicPartitionMetaInfo
+	topicInfo.ISR = []string{"n1", "n2", "n3"}
+	topicInfo.Replica = 3
+	test.Equal(t, 3, getRequiredSyncAcks(nsqdNs.PubAckAll, &topicInfo))
+	test.Equal(t, 2, getRequiredSyncAcks(nsqdNs.PubAckQuorum, &topicInfo))
+	test.Equal(t, 1, getRequiredSyncAcks(nsqdNs.PubAckLeader, &topicInfo))
+	// min insync of topic should override the ack mode of producer
+	topicInfo.MinInSync = 2
+	test.Equal(t, 2, getRequiredSyncAcks(nsqdNs.PubAckLeader, &topicInfo))
+	test.Equal(t, 3, getRequiredSyncAcks(nsqdNs.PubAckAll, &topicInfo))
+	topicInfo.ISR = []string{"n1"}
+	test.Equal(t, 2, getRequiredSyncAcks(nsqdNs.PubAckLeader, &topicInfo))
+	test.Equal(t, 2, getRequiredSyncAcks(nsqdNs.PubAckAll, &topicInfo))
+}
+
+func TestNsqdCoordSyncToISRWithAckInOrder(t *testing.T) {
+	topic := "coordTestTopicAckOrder"
+	partition := 1
+	SetCoordLogger(newTestLogger(t), levellogger.LOG_DEBUG)
+
+	nsqd1, randPort1, nodeInfo1, data1 := newNsqdNode(t, "id1")
+	defer os.RemoveAll(data1)
+	defer nsqd1.Exit()
+	nsqdCoord1 := startNsqdCoord(t, strconv.Itoa(randPort1), data1, "id1", nsqd1, true)
+	nsqdCoord1.Start()
+	defer nsqdCoord1.Stop()
+	time.Sleep(time.Second)
+
+	nsqd2, randPort2, _, data2 := newNsqdNode(t, "id2")
+	defer os.RemoveAll(data2)
+	defer nsqd2.Exit()
+	nsqdCoord2 := startNsqdCoord(t, strconv.Itoa(randPort2), data2, "id2", nsqd2, true)
+	nsqdCoord2.Start()
+	defer nsqdCoord2.Stop()
+
+	nsqd3, randPort3, _, data3 := newNsqdNode(t, "id3")
+	defer os.RemoveAll(data3)
+	defer nsqd3.Exit()
+	nsqdCoord3 := startNsqdCoord(t, strconv.Itoa(randPort3), data3, "id3", nsqd3, true)
+	nsqdCoord3.Start()
+	defer nsqdCoord3.Stop()
+
+	var topicInitInfo RpcAdminTopicInfo
+	topicInitInfo.Name = topic
+	topicInitInfo.Partition = partition
+	topicInitInfo.Epoch = 1
+	topicInitInfo.EpochForWrite = 1
+	topicInitInfo.ISR = append(topicInitInfo.ISR, nsqdCoord1.myNode.GetID())
+	topicInitInfo.ISR = append(topicInitInfo.ISR, nsqdCoord2.myNode.GetID())
+	topicInitInfo.ISR = append(topicInitInfo.ISR, nsqdCoord3.myNode.GetID())
+	topicInitInfo.Leader = nsqdCoord1.myNode.GetID()
+	topicInitInfo.Replica = 3
+	leaderSession := &TopicLeaderSession{
+		LeaderNode:  nodeInfo1,
+		LeaderEpoch: 1,
+		Session:     "fake123",
+	}
+	for _, nsqdCoord := range []*NsqdCoordinator{nsqdCoord1, nsqdCoord2, nsqdCoord3} {
+		ensureTopicOnNsqdCoord(nsqdCoord, topicInitInfo)
+		ensureTopicLeaderSession(nsqdCoord, topic, partition, leaderSession)
+		ensureTopicDisableWrite(nsqdCoord, topic, partition, false)
+	}
+	tc1, coordErr := nsqdCoord1.getTopicCoord(topic, partition)
+	test.Nil(t, coordErr)
+
+	// the slave rejects the write not following the last one, and the slow slave
+	// is still handling the first write while the next write is acknowledged.
+	slowNode := nsqdCoord3.myNode.GetID()
+	var mutex sync.Mutex
+	lastSeq := make(map[string]int)
+	mismatched := 0
+	newSlaveSync := func(seq int) slaveSyncFunc {
+		return func(c *NsqdRpcClient, nodeID string, tcData *coordData) *CoordErr {
+			if nodeID == slowNode && seq == 1 {
+				time.Sleep(time.Millisecond * 500)
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			if lastSeq[nodeID]+1 != seq {
+				mismatched++
+				return NewCoordErr("write offset mismatch", CoordSlaveErr)
+			}
+			lastSeq[nodeID] = seq
+			return nil
+		}
+	}
+	start := time.Now()
+	for seq := 1; seq <= 3; seq++ {
+		failedNodes := make(map[string]struct{})
+		tc1.writeHold.Lock()
+		success, exitErr, err := nsqdCoord1.syncToISRWithAck(tc1, tc1.GetData(), newSlaveSync(seq), 2, 1, failedNodes)
+		tc1.writeHold.Unlock()
+		test.Nil(t, err)
+		test.Equal(t, 2, success)
+		test.Equal(t, 0, exitErr)
+		test.Equal(t, 0, len(failedNodes))
+	}
+	// the writes should be acknowledged without waiting the slow slave
+	test.Equal(t, true, time.Since(start) < time.Millisecond*500)
+	tc1.writeHold.Lock()
+	tc1.waitSlaveSyncDone(slowNode)
+	tc1.writeHold.Unlock()
+	mutex.Lock()
+	test.Equal(t, 0, mismatched)
+	test.Equal(t, 3, lastSeq[slowNode])
+	test.Equal(t, 3, lastSeq[nsqdCoord2.myNode.GetID()])
+	mutex.Unlock()
+
+	// the back to back writes while a replica is slow should be replicated in order
+	topicData1 := nsqd1.GetTopic(topic, partition, false)
+	topicData3 := nsqd3.GetTopic(topic, partition, false)
+	tc3, coordErr := nsqdCoord3.getTopicCoord(topic, partition)
+	test.Nil(t, coordErr)
+	tc3.writeHold.Lock()
+	go func() {
+		time.Sleep(time.Millisecond * 500)
+		tc3.writeHold.Unlock()
+	}()
+	for i := 0; i < 10; i++ {
+		msg := nsqdNs.NewMessage(0, []byte("123"))
+		_, _, _, _, err := nsqdCoord1.PutMessageToClusterWithAck(topicData1, msg, nsqdNs.PubAckQuorum)
+		test.Nil(t, err)
+	}
+	tc1.writeHold.Lock()
+	tc1.waitSlaveSyncDone(slowNode)
+	tc1.writeHold.Unlock()
+	test.Equal(t, false, tc1.IsWriteDisabled())
+	test.Equal(t, 3, len(tc1.GetData().topicInfo.ISR))
+	test.Equal(t, topicData1.TotalMessageCnt(), topicData3.TotalMessageCnt())
+	test.Equal(t, topicData1.TotalDataSize(), topicData3.TotalDataSize())
+	test.Equal(t, tc1.GetData().logMgr.GetLastCommitLogID(), tc3.GetData().logMgr.GetLastCommitLogID())
+}
+
+func TestNsqdCoordPutMessageDedup(t *testing.T) {
+	topic := "coordTestTopicDedup"
+	partition := 1
+	SetCoordLogger(newTestLogger(t), levellogger.LOG_DEBUG)
+
+	nsqd1, randPort1, nodeInfo1, data1 := newNsqdNode(t, "id1")
+	defer os.RemoveAll(data1)
+	defer nsqd1.Exit()
+	nsqdCoord1 := startNsqdCoord(t, strconv.Itoa(randPort1), data1, "id1", nsqd1, true)
+	nsqdCoord1.Start()
+	defer nsqdCoord1.Stop()
+	time.Sleep(time.Second)
+
+	nsqd2, randPort2, _, data2 := newNsqdNode(t, "id2")
+	defer os.RemoveAll(data2)
+	defer nsqd2.Exit()
+	nsqdCoord2 := startNsqdCoord(t, strconv.Itoa(randPort2), data2, "id2", nsqd2, true)
+	nsqdCoord2.Start()
+	defer nsqdCoord2.Stop()
+
+	var topicInitInfo RpcAdminTopicInfo
+	topicInitInfo.Name = topic
+	topicInitInfo.Partition = partition
+	topicInitInfo.Epoch = 1
+	topicInitInfo.EpochForWrite = 1
+	topicInitInfo.ISR = append(topicInitInfo.ISR, nsqdCoord1.myNode.GetID())
+	topicInitInfo.ISR = append(topicInitInfo.ISR, nsqdCoord2.myNode.GetID())
+	topicInitInfo.Leader = nsqdCoord1.myNode.GetID()
+	topicInitInfo.Replica = 2
+	topicInitInfo.Ext = true
+	ensureTopicOnNsqdCoord(nsqdCoord1, topicInitInfo)
+	ensureTopicOnNsqdCoord(nsqdCoord2, topicInitInfo)
+	leaderSession := &TopicLeaderSession{
+		LeaderNode:  nodeInfo1,
+		LeaderEpoch: 1,
+		Session:     "fake123",
+	}
+	ensureTopicLeaderSession(nsqdCoord1, topic, partition, leaderSession)
+	ensureTopicLeaderSession(nsqdCoord2, topic, partition, leaderSession)
+	ensureTopicDisableWrite(nsqdCoord1, topic, partition, false)
+	ensureTopicDisableWrite(nsqdCoord2, topic, partition, false)
+	topicData1 := nsqd1.GetTopic(topic, partition, false)
+	topicData2 := nsqd2.GetTopic(topic, partition, false)
+
+	newMsg := func(header string) *nsqdNs.Message {
+		return nsqdNs.NewMessageWithExt(0, []byte("123"), ext.JSON_HEADER_EXT_VER, []byte(header))
+	}
+	id1, offset1, _, _, err := nsqdCoord1.PutMessageToCluster(topicData1, newMsg(`{"##producer_id":"p1","##producer_seq":1}`))
+	test.Nil(t, err)
+	id, offset, _, _, err := nsqdCoord1.PutMessageToCluster(topicData1, newMsg(`{"##producer_id":"p1","##producer_seq":1}`))
+	test.Nil(t, err)
+	test.Equal(t, id1, id)
+	test.Equal(t, offset1, offset)
+	_, _, _, err = nsqdCoord1.PutMessagesToCluster(topicData1, []*nsqdNs.Message{
+		newMsg(`{"##producer_id":"p1","##producer_seq":1}`),
+		newMsg(`{"##producer_id":"p1","##producer_seq":2}`),
+	})
+	test.Nil(t, err)
+	_, _, _, _, err = nsqdCoord1.PutMessageToCluster(topicData1, newMsg(`{"##producer_id":"p1","##producer_seq":0}`))
+	test.Equal(t, nsqdNs.ErrProducerSeqDuplicated, err)
+	test.Equal(t, uint64(2), topicData1.TotalMessageCnt())
+	test.Equal(t, uint64(2), topicData2.TotalMessageCnt())
+	tc1, coordErr := nsqdCoord1.getTopicCoord(topic, partition)
+	test.Nil(t, coordErr)
+	test.Equal(t, false, tc1.IsWriteDisabled())
+
+	// the replica should have the same dedup state for failover
+	topicData2.Lock()
+	_, _, _, err = topicData2.CheckDuplicatedNoLock(newMsg(`{"##producer_id":"p1","##producer_seq":2}`))
+	topicData2.Unlock()
+	test.Equal(t, nsqdNs.ErrMessageDuplicated, err)
+
+	// rebuild after restart
+	tc2, coordErr := nsqdCoord2.getTopicCoord(topic, partition)
+	test.Nil(t, coordErr)
+	topicData2.ForceFlush()
+	topicData2.Lock()
+	err = topicData2.RebuildDedupWindowNoLock(nsqdNs.BackendOffset(topicData2.TotalDataSize()), int64(topicData2.TotalMessageCnt()))
+	test.Nil(t, err)
+	_, _, _, err = topicData2.CheckDuplicatedNoLock(newMsg(`{"##producer_id":"p1","##producer_seq":2}`))
+	topicData2.Unlock()
+	test.Nil(t, err)
+	rebuildTopicDedupWindow(tc2.GetData(), topicData2)
+	topicData2.Lock()
+	_, _, _, err = topicData2.CheckDuplicatedNoLock(newMsg(`{"##producer_id":"p1","##producer_seq":1}`))
+	topicData2.Unlock()
+	test.Equal(t, nsqdNs.ErrMessageDuplicated, err)
+}
+
+// the leader write the records in a format different from the replica, the replica should
+// write the same records as the leader.
+func testNsqdCoordPutMessageRawReplicated(t *testing.T, topic string, setLeaderOpts func(*nsqdNs.Options),
+	setReplicaOpts func(*nsqdNs.Options), setLeaderTopic func(*nsqdNs.Topic)) {
+	partition := 1
+	SetCoordLogger(newTestLogger(t), levellogger.LOG_DEBUG)
+
+	nsqd1, randPort1, nodeInfo1, data1 := newNsqdNodeWithOptions(t, "id1", setLeaderOpts)
+	defer os.RemoveAll(data1)
+	defer nsqd1.Exit()
+	nsqdCoord1 := startNsqdCoord(t, strconv.Itoa(randPort1), data1, "id1", nsqd1, true)
+	nsqdCoord1.Start()
+	defer nsqdCoord1.Stop()
+	time.Sleep(time.Second)
+
+	nsqd2, randPort2, _, data2 := newNsqdNodeWithOptions(t, "id2", setReplicaOpts)
+	defer os.RemoveAll(data2)
+	defer nsqd2.Exit()
+	nsqdCoord2 := startNsqdCoord(t, strconv.Itoa(randPort2), data2, "id2", nsqd2, true)
+	nsqdCoord2.Start()
+	defer nsqdCoord2.Stop()
+
+	var topicInitInfo RpcAdminTopicInfo
+	topicInitInfo.Name = topic
+	topicInitInfo.Partition = partition
+	topicInitInfo.Epoch = 1
+	topicInitInfo.EpochForWrite = 1
+	topicInitInfo.ISR = append(topicInitInfo.ISR, nsqdCoord1.myNode.GetID())
+	topicInitInfo.ISR = append(topicInitInfo.ISR, nsqdCoord2.myNode.GetID())
+	topicInitInfo.Leader = nsqdCoord1.myNode.GetID()
+	topicInitInfo.Replica = 2
+	ensureTopicOnNsqdCoord(nsqdCoord1, topicInitInfo)
+	ensureTopicOnNsqdCoord(nsqdCoord2, topicInitInfo)
+	leaderSession := &TopicLeaderSession{
+		LeaderNode:  nodeInfo1,
+		LeaderEpoch: 1,
+		Session:     "fake123",
+	}
+	ensureTopicLeaderSession(nsqdCoord1, topic, partition, leaderSession)
+	ensureTopicLeaderSession(nsqdCoord2, topic, partition, leaderSession)
+	ensureTopicDisableWrite(nsqdCoord1, topic, partition, false)
+	ensureTopicDisableWrite(nsqdCoord2, topic, partition, false)
+	topicData1 := nsqd1.GetTopic(topic, partition, false)
+	topicData2 := nsqd2.GetTopic(topic, partition, false)
+	if setLeaderTopic != nil {
+		setLeaderTopic(topicData1)
+	}
+
+	body := bytes.Repeat([]byte("compressed"), 100)
+	_, _, _, _, err := nsqdCoord1.PutMessageBodyToCluster(topicData1, body, 0)
+	test.Nil(t, err)
+	_, _, _, err = nsqdCoord1.PutMessagesToCluster(topicData1, []*nsqdNs.Message{
+		nsqdNs.NewMessage(0, body),
+		nsqdNs.NewMessage(0, body),
+	})
+	test.Nil(t, err)
+	delayedMsg := nsqdNs.NewMessage(0, body)
+	delayedMsg.DelayedType = nsqdNs.ChannelDelayed
+	delayedMsg.DelayedTs = time.Now().Add(time.Hour).UnixNano()
+	delayedMsg.DelayedOrigID = 1
+	delayedMsg.DelayedChannel = "delay-test"
+	_, _, _, _, err = nsqdCoord1.PutDelayedMessageToCluster(topicData1, delayedMsg)
+	test.Nil(t, err)
+	tc1, coordErr := nsqdCoord1.getTopicCoord(topic, partition)
+	test.Nil(t, coordErr)
+	test.Equal(t, false, tc1.IsWriteDisabled())
+	topicData1.ForceFlush()
+	topicData2.ForceFlush()
+	test.Equal(t, uint64(3), topicData2.TotalMessageCnt())
+	test.Equal(t, topicData1.TotalDataSize(), topicData2.TotalDataSize())
+	dq1 := topicData1.GetDelayedQueue()
+	dq2 := topicData2.GetDelayedQueue()
+	test.NotNil(t, dq2)
+	test.Equal(t, dq1.TotalDataSize(), dq2.TotalDataSize())
+	delayedCnt, err := dq2.GetCurrentDelayedCnt(nsqdNs.ChannelDelayed, "delay-test")
+	test.Nil(t, err)
+	test.Equal(t, uint64(1), delayedCnt)
+
+	snap := topicData2.GetDiskQueueSnapshot()
+	defer snap.Close()
+	for i := 0; i < 3; i++ {
+		r := snap.ReadOne()
+		test.Nil(t, r.Err)
+		m, err := nsqdNs.DecodeMessage(r.Data, false)
+		test.Nil(t, err)
+		test.Equal(t, body, m.Body)
+	}
+}
+
+func TestNsqdCoordPutCompressedMessageReplicated(t *testing.T) {
+	testNsqdCoordPutMessageRawReplicated(t, "coordTestTopicCompressed", nil, nil, func(topic *nsqdNs.Topic) {
+		dyConf := topic.GetDynamicInfo()
+		dyConf.Compression = "zstd"
+		topic.SetDynamicInfo(dyConf, nil)
+	})
+}
+
+func TestNsqdCoordPutZstdDictMessageReplicated(t *testing.T) {
+	dictData, err := ioutil.ReadFile("../nsqd/testdata/zstd_test.dict")
+	test.Nil(t, err)
+	zd, err := nsqdNs.NewZstdDicts([][]byte{dictData}, 0)
+	test.Nil(t, err)
+	nsqdNs.SetZstdDicts(zd)
+	defer nsqdNs.SetZstdDicts(nil)
+	testNsqdCoordPutMessageRawReplicated(t, "coordTestTopicZstdDict", nil, nil, func(topic *nsqdNs.Topic) {
+		dyConf := topic.GetDynamicInfo()
+		dyConf.Compression = "zstd"
+		topic.SetDynamicInfo(dyConf, nil)
+	})
+}
+
+func TestNsqdCoordCheckZstdDicts(t *testing.T) {
+	topicInfo := TopicPartitionMetaInfo{}
+	topicInfo.Name = "coordTestTopicZstdDict"
+	test.Nil(t, checkZstdDictFingerprint(topicInfo, ""))
+
+	dictData, err := ioutil.ReadFile("../nsqd/testdata/zstd_test.dict")
+	test.Nil(t, err)
+	zd, err := nsqdNs.NewZstdDicts([][]byte{dictData}, 0)
+	test.Nil(t, err)
+	// the node without the dictionary can not join the leader using it
+	test.Equal(t, ErrZstdDictMismatch, checkZstdDictFingerprint(topicInfo, zd.DictFingerprint()))
+	nsqdNs.SetZstdDicts(zd)
+	defer nsqdNs.SetZstdDicts(nil)
+	test.Nil(t, checkZstdDictFingerprint(topicInfo, ""))
+	test.Nil(t, checkZstdDictFingerprint(topicInfo, zd.DictFingerprint()))
+
+	nsqd1, randPort1, nodeInfo1, data1 := newNsqdNode(t, "id1")
+	defer os.RemoveAll(data1)
+	defer nsqd1.Exit()
+	nsqdCoord1 := startNsqdCoord(t, strconv.Itoa(randPort1), data1, "id1", nsqd1, true)
+	nsqdCoord1.Start()
+	defer nsqdCoord1.Stop()
+	time.Sleep(time.Second)
+	topicInfo.Leader = nodeInfo1.GetID()
+	c, coordErr := nsqdCoord1.acquireRpcClient(nodeInfo1.GetID())
+	test.Nil(t, coordErr)
+	fp, coordErr := c.GetZstdDictFingerprint()
+	test.Nil(t, coordErr)
+	test.Equal(t, zd.DictFingerprint(), fp)
+	test.Nil(t, nsqdCoord1.checkZstdDictsWithLeader(c, topicInfo))
+}
+
+func TestNsqdCoordPutEncryptedMessageReplicated(t *testing.T) {
+	kr, err := nsqdNs.ParseEncryptKeyring([]byte("1 "+base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))), 0)
+	test.Nil(t, err)
+	nsqdNs.SetEncryptKeyring(kr)
+	defer nsqdNs.SetEncryptKeyring(nil)
+	testNsqdCoordPutMessageRawReplicated(t, "coordTestTopicEncrypted", nil, nil, nil)
+}
+
+func TestNsqdCoordCheckEncryptKeyring(t *testing.T) {
+	topicInfo := TopicPartitionMetaInfo{}
+	topicInfo.Name = "coordTestTopicKeyring"
+	test.Nil(t, checkEncryptKeyFingerprint(topicInfo, ""))
+
+	key1 := "1 " + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32)) + "\n"
+	key2 := "2 " + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32)) + "\n"
+	kr1, err := nsqdNs.ParseEncryptKeyring([]byte(key1), 0)
+	test.Nil(t, err)
+	kr2, err := nsqdNs.ParseEncryptKeyring([]byte(key2), 0)
+	test.Nil(t, err)
+	kr12, err := nsqdNs.ParseEncryptKeyring([]byte(key1+key2), 0)
+	test.Nil(t, err)
+	defer nsqdNs.SetEncryptKeyring(nil)
+	// the node without keyring can not join the encrypted leader
+	test.Equal(t, ErrEncryptKeyringMismatch, checkEncryptKeyFingerprint(topicInfo, kr1.KeyFingerprint()))
+	nsqdNs.SetEncryptKeyring(kr1)
+	test.Nil(t, checkEncryptKeyFingerprint(topicInfo, ""))
+	test.Nil(t, checkEncryptKeyFingerprint(topicInfo, kr1.KeyFingerprint()))
+	test.Equal(t, ErrEncryptKeyringMismatch, checkEncryptKeyFingerprint(topicInfo, kr2.KeyFingerprint()))
+	test.Equal(t, ErrEncryptKeyringMismatch, checkEncryptKeyFingerprint(topicInfo, kr12.KeyFingerprint()))
+	// the node with the new key added can join the leader before the key rotated
+	nsqdNs.SetEncryptKeyring(kr12)
+	test.Nil(t, checkEncryptKeyFingerprint(topicInfo, kr1.KeyFingerprint()))
+	nsqdNs.SetEncryptKeyring(kr1)
+
+	// the fingerprint of the leader is returned by rpc
+	nsqd1, randPort1, nodeInfo1, data1 := newNsqdNode(t, "id1")
+	defer os.RemoveAll(data1)
+	defer nsqd1.Exit()
+	nsqdCoord1 := startNsqdCoord(t, strconv.Itoa(randPort1), data1, "id1", nsqd1, true)
+	nsqdCoord1.Start()
+	defer nsqdCoord1.Stop()
+	time.Sleep(time.Second)
+	topicInfo.Leader = nodeInfo1.GetID()
+	c, coordErr := nsqdCoord1.acquireRpcClient(nodeInfo1.GetID())
+	test.Nil(t, coordErr)
+	fp, coordErr := c.GetEncryptKeyFingerprint()
+	test.Nil(t, coordErr)
+	test.Equal(t, kr1.KeyFingerprint(), fp)
+	test.Nil(t, nsqdCoord1.checkEncryptKeyringWithLeader(c, topicInfo))
+}
+
+func TestNsqdCoordPutChecksumMessageReplicated(t *testing.T) {
+	setChecksum := func(opts *nsqdNs.Options) {
+		opts.QueueRecordChecksum = true
+	}
+	testNsqdCoordPutMessageRawReplicated(t, "coordTestTopicChecksum", setChecksum, nil, nil)
+	// the replica with checksum should write the plain records from the leader without checksum
+	testNsqdCoordPutMessageRawReplicated(t, "coordTestTopicChecksumReplica", nil, setChecksum, nil)
+}
+
+func TestNsqdCoordMirrorTopic(t *testing.T) {
+	topic := "coordTestTopicMirror"
+	partition := 1
+	SetCoordLogger(newTestLogger(t), levellogger.LOG_DEBUG)
+
+	nsqd1, randPort1, nodeInfo1, data1 := newNsqdNode(t, "id1")
+	defer os.RemoveAll(data1)
+	defer nsqd1.Exit()
+	nsqdCoord1 := startNsqdCoord(t, strconv.Itoa(randPort1), data1, "id1", nsqd1, true)
+	nsqdCoord1.Start()
+	defer nsqdCoord1.Stop()
+
+	nsqd2, randPort2, nodeInfo2, data2 := newNsqdNode(t, "id2")
+	defer os.RemoveAll(data2)
+	defer nsqd2.Exit()
+	nsqdCoord2 := startNsqdCoord(t, strconv.Itoa(randPort2), data2, "id2", nsqd2, true)
+	nsqdCoord2.Start()
+	defer nsqdCoord2.Stop()
+	time.Sleep(time.Second)
+
+	// the lookupd of the source cluster
+	lookupd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"meta":{"partition_num":2,"extend_support":true},"partitions":{"%v":{"distributed_id":"%v"}}}`,
+			partition, nsqdCoord1.myNode.GetID())
+	}))
+	defer lookupd.Close()
+	lookupdAddr := strings.TrimPrefix(lookupd.URL, "http://")
+
+	initTopic := func(nsqdCoord *NsqdCoordinator, node *NsqdNodeInfo, epoch EpochType, mirrorFrom string) {
+		var topicInitInfo RpcAdminTopicInfo
+		topicInitInfo.Name = topic
+		topicInitInfo.Partition = partition
+		topicInitInfo.PartitionNum = 2
+		topicInitInfo.Epoch = epoch
+		topicInitInfo.EpochForWrite = 1
+		topicInitInfo.ISR = append(topicInitInfo.ISR, node.GetID())
+		topicInitInfo.Leader = node.GetID()
+		topicInitInfo.Replica = 1
+		topicInitInfo.Ext = true
+		topicInitInfo.MirrorFrom = mirrorFrom
+		ensureTopicOnNsqdCoord(nsqdCoord, topicInitInfo)
+		ensureTopicLeaderSession(nsqdCoord, topic, partition, &TopicLeaderSession{
+			LeaderNode:  node,
+			LeaderEpoch: 1,
+			Session:     "fake123",
+		})
+		ensureTopicDisableWrite(nsqdCoord, topic, partition, false)
+	}
+	initTopic(nsqdCoord1, nodeInfo1, 1, "")
+	initTopic(nsqdCoord2, nodeInfo2, 1, lookupdAddr)
+	topicData1 := nsqd1.GetTopic(topic, partition, false)
+	topicData2 := nsqd2.GetTopic(topic, partition, false)
+
+	putSource := func(cnt int) {
+		for i := 0; i < cnt; i++ {
+			msg := nsqdNs.NewMessageWithExt(0, []byte("123"), ext.JSON_HEADER_EXT_VER, []byte(`{"k":"v"}`))
+			msg.TraceID = uint64(i + 1)
+			_, _, _, _, err := nsqdCoord1.PutMessageToCluster(topicData1, msg)
+			test.Nil(t, err)
+		}
+	}
+	waitMirrored := func(cnt uint64) {
+		start := time.Now()
+		for topicData2.TotalMessageCnt() < cnt {
+			if time.Since(start) > time.Second*10 {
+				t.Fatalf("mirror timeout: %v, %v", topicData2.TotalMessageCnt(), cnt)
+			}
+			time.Sleep(time.Millisecond * 100)
+		}
+		test.Equal(t, cnt, topicData2.TotalMessageCnt())
+	}
+	putSource(5)
+
+	// the producer writes are not allowed on the mirror topic
+	msg := nsqdNs.NewMessageWithExt(0, []byte("123"), ext.JSON_HEADER_EXT_VER, []byte(`{"k":"v"}`))
+	_, _, _, _, err := nsqdCoord2.PutMessageToClusterWithAck(topicData2, msg, nsqdNs.PubAckAll)
+	test.Equal(t, ErrTopicMirrorReadOnly.ToErrorType(), err)
+	_, _, _, err = nsqdCoord2.PutMessagesToCluster(topicData2, []*nsqdNs.Message{msg})
+	test.Equal(t, ErrTopicMirrorReadOnly.ToErrorType(), err)
+	// the internal writes to the topic queue are not allowed either
+	_, _, _, _, err = nsqdCoord2.PutMessageToCluster(topicData2, msg)
+	test.Equal(t, ErrTopicMirrorReadOnly.ToErrorType(), err)
+	test.Equal(t, false, nsqdCoord2.IsTopicProducerWritable(topic, partition))
+	test.Equal(t, true, nsqdCoord1.IsTopicProducerWritable(topic, partition))
+
+	nsqdCoord2.updateTopicMirrors()
+	waitMirrored(5)
+	putSource(3)
+	waitMirrored(8)
+
+	tc1, coordErr := nsqdCoord1.getTopicCoord(topic, partition)
+	test.Nil(t, coordErr)
+	tc2, coordErr := nsqdCoord2.getTopicCoord(topic, partition)
+	test.Nil(t, coordErr)
+	test.Equal(t, tc1.GetData().logMgr.GetLastCommitLogID(), tc2.GetData().logMgr.GetLastCommitLogID())
+	time.Sleep(mirrorIdleWait * 2)
+	stats := nsqdCoord2.Stats(topic, partition)
+	test.Equal(t, 1, len(stats.TopicCoordStats))
+	mirrorStat := stats.TopicCoordStats[0].MirrorStat
+	test.NotNil(t, mirrorStat)
+	test.Equal(t, int64(8), mirrorStat.Position)
+	test.Equal(t, int64(0), mirrorStat.LagMsgs)
+	test.Equal(t, nsqdCoord1.myNode.GetID(), mirrorStat.SourceNode)
+
+	// the mirror should resume from the saved position
+	initTopic(nsqdCoord2, nodeInfo2, 2, "")
+	nsqdCoord2.updateTopicMirrors()
+	test.Nil(t, nsqdCoord2.getTopicMirrorStat(topic, partition))
+	putSource(2)
+	initTopic(nsqdCoord2, nodeInfo2, 3, lookupdAddr)
+	nsqdCoord2.updateTopicMirrors()
+	waitMirrored(10)
+	time.Sleep(mirrorIdleWait * 2)
+	test.Equal(t, uint64(10), topicData2.TotalMessageCnt())
+
+	snap := topicData2.GetDiskQueueSnapshot()
+	rawData, err := snap.ReadRaw(int32(topicData2.TotalDataSize()))
+	snap.Close()
+	test.Nil(t, err)
+	msgs, err := nsqdNs.DecodeRawMessages(rawData, true)
+	test.Nil(t, err)
+	test.Equal(t, 10, len(msgs))
+	test.Equal(t, uint64(1), msgs[0].TraceID)
+	test.Equal(t, []byte(`{"k":"v"}`), msgs[0].ExtBytes)
+	test.Equal(t, tc1.GetData().logMgr.GetLastCommitLogID(), int64(msgs[9].ID))
+
+	// the topic is writable after the mirror disabled, and the id should not be reused
+	initTopic(nsqdCoord2, nodeInfo2, 4, "")
+	nsqdCoord2.updateTopicMirrors()
+	id, _, _, _, err := nsqdCoord2.PutMessageToClusterWithAck(topicData2, msg, nsqdNs.PubAckAll)
+	test.Nil(t, err)
+	test.Equal(t, true, id > msgs[9].ID)
+}
+
+func TestCheckTopicInfoWritable(t *testing.T) {
+	var topicInfo TopicPartitionMetaInfo
+	topicInfo.Name = "test-check-writable"
+	topicInfo.Partition = 1
+	topicInfo.PartitionNum = 2
+	test.Nil(t, checkTopicInfoWritable(&topicInfo, writeFromProducer, false))
+	test.Nil(t, checkTopicInfoWritable(&topicInfo, writeFromPartition, false))
+
+	// the shrinking partition should be drained by the consumers
+	topicInfo.ShrinkTo = 1
+	test.Equal(t, ErrTopicPartitionShrinking, checkTopicInfoWritable(&topicInfo, writeFromProducer, false))
+	test.Equal(t, ErrTopicPartitionShrinking, checkTopicInfoWritable(&topicInfo, writeFromProducer, true))
+	test.Nil(t, checkTopicInfoWritable(&topicInfo, writeFromPartition, false))
+	test.Nil(t, checkTopicInfoWritable(&topicInfo, writeFromPartition, true))
+	topicInfo.Partition = 0
+	test.Nil(t, checkTopicInfoWritable(&topicInfo, writeFromProducer, false))
+	topicInfo.ShrinkTo = 0
+
+	// the topic queue of the mirror topic is only written by the mirror
+	topicInfo.MirrorFrom = "127.0.0.1:4161"
+	test.Equal(t, ErrTopicMirrorReadOnly, checkTopicInfoWritable(&topicInfo, writeFromProducer, false))
+	test.Equal(t, ErrTopicMirrorReadOnly, checkTopicInfoWritable(&topicInfo, writeFromProducer, true))
+	test.Equal(t, ErrTopicMirrorReadOnly, checkTopicInfoWritable(&topicInfo, writeFromPartition, false))
+	test.Nil(t, checkTopicInfoWritable(&topicInfo, writeFromPartition, true))
+}
+
+func TestNsqdCoordMirrorCompactedTopic(t *testing.T) {
+	topic := "coordTestTopicMirrorCompacted"
+	partition := 1
+	SetCoordLogger(newTestLogger(t), levellogger.LOG_DEBUG)
+
+	nsqd1, randPort1, nodeInfo1, data1 := newNsqdNodeWithOptions(t, "id1", func(opts *nsqdNs.Options) {
+		opts.MaxBytesPerFile = 1024
+	})
+	defer os.RemoveAll(data1)
+	defer nsqd1.Exit()
+	nsqdCoord1 := startNsqdCoord(t, strconv.Itoa(randPort1), data1, "id1", nsqd1, true)
+	nsqdCoord1.Start()
+	defer nsqdCoord1.Stop()
+
+	nsqd2, randPort2, nodeInfo2, data2 := newNsqdNode(t, "id2")
+	defer os.RemoveAll(data2)
+	defer nsqd2.Exit()
+	nsqdCoord2 := startNsqdCoord(t, strconv.Itoa(randPort2), data2, "id2", nsqd2, true)
+	nsqdCoord2.Start()
+	defer nsqdCoord2.Stop()
+	time.Sleep(time.Second)
+
+	// the lookupd of the source cluster, the old version lookupd has no compact meta
+	var metaCompact int32
+	lookupd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"meta":{"partition_num":2,"extend_support":true,"compact":%v},"partitions":{"%v":{"distributed_id":"%v"}}}`,
+			atomic.LoadInt32(&metaCompact) == 1, partition, nsqdCoord1.myNode.GetID())
+	}))
+	defer lookupd.Close()
+	lookupdAddr := strings.TrimPrefix(lookupd.URL, "http://")
+
+	initTopic := func(nsqdCoord *NsqdCoordinator, node *NsqdNodeInfo, epoch EpochType, mirrorFrom string, compact bool) {
+		var topicInitInfo RpcAdminTopicInfo
+		topicInitInfo.Name = topic
+		topicInitInfo.Partition = partition
+		topicInitInfo.PartitionNum = 2
+		topicInitInfo.Epoch = epoch
+		topicInitInfo.EpochForWrite = 1
+		topicInitInfo.ISR = append(topicInitInfo.ISR, node.GetID())
+		topicInitInfo.Leader = node.GetID()
+		topicInitInfo.Replica = 1
+		topicInitInfo.Ext = true
+		topicInitInfo.Compact = compact
+		topicInitInfo.MirrorFrom = mirrorFrom
+		ensureTopicOnNsqdCoord(nsqdCoord, topicInitInfo)
+		ensureTopicLeaderSession(nsqdCoord, topic, partition, &TopicLeaderSession{
+			LeaderNode:  node,
+			LeaderEpoch: 1,
+			Session:     "fake123",
+		})
+		ensureTopicDisableWrite(nsqdCoord, topic, partition, false)
+	}
+	initTopic(nsqdCoord1, nodeInfo1, 1, "", true)
+	initTopic(nsqdCoord2, nodeInfo2, 1, lookupdAddr, false)
+	topicData1 := nsqd1.GetTopic(topic, partition, false)
+	topicData2 := nsqd2.GetTopic(topic, partition, false)
+	test.Equal(t, true, topicData1.IsCompact())
+
+	for i := 0; i < 100; i++ {
+		msg := nsqdNs.NewMessageWithExt(0, []byte(fmt.Sprintf("v%v", i)), ext.JSON_HEADER_EXT_VER, []byte(`{"##compact_key":"k"}`))
+		_, _, _, _, err := nsqdCoord1.PutMessageToCluster(topicData1, msg)
+		test.Nil(t, err)
+	}
+	topicData1.ForceFlush()
+	err := topicData1.TryCompactOldData(time.Hour)
+	test.Nil(t, err)
+
+	waitMirrorErr := func() *TopicMirrorStat {
+		start := time.Now()
+		for {
+			stat := nsqdCoord2.getTopicMirrorStat(topic, partition)
+			if stat != nil && stat.LastError != "" {
+				return stat
+			}
+			if time.Since(start) > time.Second*10 {
+				t.Fatalf("mirror error timeout: %v", stat)
+			}
+			time.Sleep(time.Millisecond * 100)
+		}
+	}
+	// the padding records of the compacted messages should be refused
+	nsqdCoord2.updateTopicMirrors()
+	stat := waitMirrorErr()
+	test.Equal(t, errMirrorSourceCompacted.Error(), stat.LastError)
+	test.Equal(t, uint64(0), topicData2.TotalMessageCnt())
+
+	// the compacted source should be refused before pulling any data
+	atomic.StoreInt32(&metaCompact, 1)
+	initTopic(nsqdCoord2, nodeInfo2, 2, "", false)
+	nsqdCoord2.updateTopicMirrors()
+	test.Nil(t, nsqdCoord2.getTopicMirrorStat(topic, partition))
+	initTopic(nsqdCoord2, nodeInfo2, 3, lookupdAddr, false)
+	nsqdCoord2.updateTopicMirrors()
+	stat = waitMirrorErr()
+	test.Equal(t, errMirrorSourceCompacted.Error(), stat.LastError)
+	test.Equal(t, "", stat.SourceNode)
+	test.Equal(t, uint64(0), topicData2.TotalMessageCnt())
+}
+
+func TestCatchupThrottleReserve(t *testing.T) {
+	var ct catchupThrottle
+	now := time.Now()
+	// no limit
+	test.Equal(t, time.Duration(0), ct.reserve(1000, 0, now))
+	test.Equal(t, time.Duration(0), ct.reserve(500, 1000, now))
+	test.Equal(t, time.Millisecond*500, ct.reserve(500, 1000, now))
+	test.Equal(t, time.Second, ct.reserve(500, 1000, now))
+	test.Equal(t, time.Millisecond*1500, ct.reserve(1000*1000, 1000, now))
+	// the wait should not be longer than the max
+	test.Equal(t, catchupThrottleMaxWait, ct.reserve(500, 1000, now))
+	test.Equal(t, time.Duration(0), ct.reserve(500, 1000, now.Add(time.Hour)))
+	test.Equal(t, int64(0), ct.currentRate(now.Add(time.Hour*2)))
+
+	test.Equal(t, int32(MAX_LOG_PULL_BYTES), getCatchupPullMaxBytes(0, 0))
+	test.Equal(t, int32(1000), getCatchupPullMaxBytes(4000, 0))
+	test.Equal(t, int32(500), getCatchupPullMaxBytes(4000, 2000))
+}
+
+func TestNsqdCoordSearchLogByMsgTimestamp(t *testing.T) {
+	topic := "coordTestTopicSearchTimestamp"
+	partition := 1
+	SetCoordLogger(newTestLogger(t), levellogger.LOG_DEBUG)
+
+	nsqd1, randPort1, nodeInfo1, data1 := newNsqdNode(t, "id1")
+	defer os.RemoveAll(data1)
+	defer nsqd1.Exit()
+	nsqdCoord1 := startNsqdCoord(t, strconv.Itoa(randPort1), data1, "id1", nsqd1, true)
+	nsqdCoord1.Start()
+	defer nsqdCoord1.Stop()
+	time.Sleep(time.Second)
+
+	var topicInitInfo RpcAdminTopicInfo
+	topicInitInfo.Name = topic
+	topicInitInfo.Partition = partition
+	topicInitInfo.Epoch = 1
+	topicInitInfo.EpochForWrite = 1
+	topicInitInfo.ISR = append(topicInitInfo.ISR, nodeInfo1.GetID())
+	topicInitInfo.Leader = nodeInfo1.GetID()
+	topicInitInfo.Replica = 1
+	ensureTopicOnNsqdCoord(nsqdCoord1, topicInitInfo)
+	ensureTopicLeaderSession(nsqdCoord1, topic, partition, &TopicLeaderSession{
+		LeaderNode:  nodeInfo1,
+		LeaderEpoch: 1,
+		Session:     "fake123",
+	})
+	ensureTopicDisableWrite(nsqdCoord1, topic, partition, false)
+	topicData1 := nsqd1.GetTopic(topic, partition, false)
+	start := time.Now().Unix()
+	for i := 0; i < 10; i++ {
+		_, _, _, _, err := nsqdCoord1.PutMessageBodyToCluster(topicData1, []byte("123"), 0)
+		test.Nil(t, err)
+	}
+	topicData1.ForceFlush()
+
+	l, offset, cnt, err := nsqdCoord1.SearchLogByMsgTimestamp(topic, partition, start-1)
+	test.Nil(t, err)
+	test.NotNil(t, l)
+	test.Equal(t, int64(0), offset)
+	test.Equal(t, int64(0), cnt)
+	// the searched offset is the end of queue which has no commit log,
+	// should fallback to search the commit log
+	l, offset, cnt, err = nsqdCoord1.SearchLogByMsgTimestamp(topic, partition, time.Now().Unix()+3600)
+	test.Nil(t, err)
+	test.NotNil(t, l)
+	test.Equal(t, int64(topicData1.TotalDataSize()), offset)
+	test.Equal(t, int64(10), cnt)
+
+	// the commit log for the offset searched from time index is missing,
+	// should fallback to search the commit log and return the error
+	tcData, coordErr := nsqdCoord1.getTopicCoordData(topic, partition)
+	test.Nil(t, coordErr)
+	_, err = tcData.logMgr.TruncateToOffsetV2(0, 0)
+	test.Equal(t, ErrCommitLogEOF, err)
+	_, _, _, err = tcData.logMgr.SearchLogDataByMsgOffset(0)
+	test.NotNil(t, err)
+	l, _, _, err = nsqdCoord1.SearchLogByMsgTimestamp(topic, partition, start-1)
+	test.NotNil(t, err)
+	test.Nil(t, l)
+}
+
+func TestNsqdCoordCatchupThrottle(t *testing.T) {
+	topic := "coordTestTopicCatchupThrottle"
+	partition := 1
+	SetCoordLogger(newTestLogger(t), levellogger.LOG_DEBUG)
+
+	nsqd1, randPort1, nodeInfo1, data1 := newNsqdNode(t, "id1")
+	defer os.RemoveAll(data1)
+	defer nsqd1.Exit()
+	nsqdCoord1 := startNsqdCoord(t, strconv.Itoa(randPort1), data1, "id1", nsqd1, true)
+	nsqdCoord1.Start()
+	defer nsqdCoord1.Stop()
+	time.Sleep(time.Second)
+
+	var topicInitInfo RpcAdminTopicInfo
+	topicInitInfo.Name = topic
+	topicInitInfo.Partition = partition
+	topicInitInfo.Epoch = 1
+	topicInitInfo.EpochForWrite = 1
+	topicInitInfo.ISR = append(topicInitInfo.ISR, nodeInfo1.GetID())
+	topicInitInfo.Leader = nodeInfo1.GetID()
+	topicInitInfo.Replica = 1
+	ensureTopicOnNsqdCoord(nsqdCoord1, topicInitInfo)
+	ensureTopicLeaderSession(nsqdCoord1, topic, partition, &TopicLeaderSession{
+		LeaderNode:  nodeInfo1,
+		LeaderEpoch: 1,
+		Session:     "fake123",
+	})
+	ensureTopicDisableWrite(nsqdCoord1, topic, partition, false)
+	topicData1 := nsqd1.GetTopic(topic, partition, false)
+	body := make([]byte, 1000)
+	for i := 0; i < 20; i++ {
+		_, _, _, _, err := nsqdCoord1.PutMessageBodyToCluster(topicData1, body, 0)
+		test.Nil(t, err)
+	}
+	topicData1.ForceFlush()
+
+	opts := *nsqd1.GetOpts()
+	opts.CatchupTopicRateLimit = 20000
+	nsqd1.SwapOpts(&opts)
+
+	var req RpcPullCommitLogsReq
+	req.TopicName = topic
+	req.TopicPartition = partition
+	req.LogMaxNum = MAX_LOG_PULL
+	req.UseCountIndex = true
+	pulled := 0
+	start := time.Now()
+	for pulled < 20 {
+		req.LogCountNumIndex = int64(pulled)
+		rsp, err := nsqdCoord1.pullCommitLogsAndData(&req, false)
+		test.Nil(t, err)
+		test.Equal(t, len(rsp.Logs), len(rsp.DataList))
+		// the data pulled at one time should be limited while throttled
+		test.Equal(t, true, len(rsp.Logs) > 0)
+		test.Equal(t, true, len(rsp.Logs) <= 5)
+		pulled += len(rsp.Logs)
+	}
+	cost := time.Since(start)
+	t.Logf("pull cost: %v", cost)
+	test.Equal(t, true, cost > time.Millisecond*500)
+
+	time.Sleep(catchupRateWindow)
+	stats := nsqdCoord1.Stats(topic, partition)
+	test.Equal(t, int64(0), stats.CatchupThrottle.RateLimit)
+	test.Equal(t, int64(20000), stats.CatchupThrottle.TopicRateLimit)
+	test.Equal(t, 1, len(stats.TopicCoordStats))
+	test.Equal(t, true, stats.TopicCoordStats[0].CatchupRate > 0)
+	test.Equal(t, true, stats.TopicCoordStats[0].CatchupRate <= 20000)
+
+	// the full sync data is streamed in slices under the limit
+	_, err := nsqdCoord1.NewCatchupThrottledWriter(topic, partition+1, ioutil.Discard)
+	test.NotNil(t, err)
+	var fullSync bytes.Buffer
+	w, err := nsqdCoord1.NewCatchupThrottledWriter(topic, partition, &fullSync)
+	test.Nil(t, err)
+	start = time.Now()
+	n, err := w.Write(make([]byte, 20000))
+	test.Nil(t, err)
+	test.Equal(t, 20000, n)
+	test.Equal(t, 20000, fullSync.Len())
+	cost = time.Since(start)
+	t.Logf("full sync write cost: %v", cost)
+	test.Equal(t, true, cost > time.Millisecond*500)
+
+	// no limit
+	opts.CatchupTopicRateLimit = 0
+	nsqd1.SwapOpts(&opts)
+	req.LogCountNumIndex = 0
+	rsp, err := nsqdCoord1.pullCommitLogsAndData(&req, false)
+	test.Nil(t, err)
+	test.Equal(t, 20, len(rsp.Logs))
+	start = time.Now()
+	_, err = w.Write(make([]byte, 20000))
+	test.Nil(t, err)
+	test.Equal(t, true, time.Since(start) < time.Millisecond*100)
+}
+
+func TestNsqdCoordFinishMessagesBatch(t *testing.T) {
+	topic := "coordTestTopicBatchFin"
+	partition := 1
+	SetCoordLogger(newTestLogger(t), levellogger.LOG_DEBUG)
+
+	nsqd1, randPort1, nodeInfo1, data1 := newNsqdNode(t, "id1")
+	defer os.RemoveAll(data1)
+	defer nsqd1.Exit()
+	nsqdCoord1 := startNsqdCoord(t, strconv.Itoa(randPort1), data1, "id1", nsqd1, true)
+	nsqdCoord1.Start()
+	defer nsqdCoord1.Stop()
+	time.Sleep(time.Second)
+
+	nsqd2, randPort2, _, data2 := newNsqdNode(t, "id2")
+	defer os.RemoveAll(data2)
+	defer nsqd2.Exit()
+	nsqdCoord2 := startNsqdCoord(t, strconv.Itoa(randPort2), data2, "id2", nsqd2, true)
+	nsqdCoord2.Start()
+	defer nsqdCoord2.Stop()
+
+	var topicInitInfo RpcAdminTopicInfo
+	topicInitInfo.Name = topic
+	topicInitInfo.Partition = partition
+	topicInitInfo.Epoch = 1
+	topicInitInfo.EpochForWrite = 1
+	topicInitInfo.ISR = append(topicInitInfo.ISR, nsqdCoord1.myNode.GetID())
+	topicInitInfo.ISR = append(topicInitInfo.ISR, nsqdCoord2.myNode.GetID())
+	topicInitInfo.Leader = nsqdCoord1.myNode.GetID()
+	topicInitInfo.Replica = 2
+	ensureTopicOnNsqdCoord(nsqdCoord1, topicInitInfo)
+	ensureTopicOnNsqdCoord(nsqdCoord2, topicInitInfo)
+	leaderSession := &TopicLeaderSession{
+		LeaderNode:  nodeInfo1,
+		LeaderEpoch: 1,
+		Session:     "fake123",
+	}
+	ensureTopicLeaderSession(nsqdCoord1, topic, partition, leaderSession)
+	ensureTopicLeaderSession(nsqdCoord2, topic, partition, leaderSession)
+	ensureTopicDisableWrite(nsqdCoord1, topic, partition, false)
+	ensureTopicDisableWrite(nsqdCoord2, topic, partition, false)
+	topicData1 := nsqd1.GetTopic(topic, partition, false)
+	topicData2 := nsqd2.GetTopic(topic, partition, false)
+	channel1 := topicData1.GetChannel("ch1")
+	channel2 := topicData2.GetChannel("ch1")
+
+	msgCnt := 4
+	for i := 0; i < msgCnt; i++ {
+		_, _, _, _, err := nsqdCoord1.PutMessageBodyToCluster(topicData1, []byte("123"), 0)
+		test.Nil(t, err)
+	}
+	topicData1.ForceFlush()
+	topicData2.ForceFlush()
+	test.Equal(t, int64(msgCnt), channel1.Depth())
+	test.Equal(t, int64(msgCnt), channel2.Depth())
+
+	msgIDs := make([]nsqdNs.MessageID, 0, msgCnt)
+	for i := 0; i < msgCnt-1; i++ {
+		msg := <-channel1.GetClientMsgChan()
+		channel1.StartInFlightTimeout(msg, NewFakeConsumer(1), "", time.Second*10)
+		msgIDs = append(msgIDs, msg.ID)
+	}
+	// the duplicated id in batch should fail alone
+	msgIDs = append(msgIDs, msgIDs[0])
+	msgErrs, err := nsqdCoord1.FinishMessagesToCluster(channel1, 1, "", msgIDs)
+	test.Nil(t, err)
+	test.Equal(t, len(msgIDs), len(msgErrs))
+	for i := 0; i < msgCnt-1; i++ {
+		test.Nil(t, msgErrs[i])
+	}
+	test.NotNil(t, msgErrs[msgCnt-1])
+	test.Equal(t, int64(1), channel1.Depth())
+	time.Sleep(time.Millisecond * 100)
+	test.Equal(t, int64(1), channel2.Depth())
+
+	// all failed should not sync
+	msgErrs, err = nsqdCoord1.FinishMessagesToCluster(channel1, 1, "", msgIDs[:1])
+	test.Nil(t, err)
+	test.NotNil(t, msgErrs[0])
+	test.Equal(t, int64(1), channel1.Depth())
+}
+
 func TestNsqdCoordLeaderChangeWhileWrite(t *testing.T) {
 	// TODO: old leader write and part of the isr got the write,
 	// then leader failed, choose new leader from isr
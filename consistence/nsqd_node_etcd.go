@@ -31,6 +31,7 @@ type NsqdEtcdMgr struct {
 	nodeKey       string
 	nodeValue     string
 	refreshStopCh chan bool
+	refreshWg     sync.WaitGroup
 }
 
 func NewNsqdEtcdMgr(host, username, pwd string) (*NsqdEtcdMgr, error) {
@@ -56,6 +57,7 @@ func (nem *NsqdEtcdMgr) RegisterNsqd(nodeData *NsqdNodeInfo) error {
 	}
 	if nem.refreshStopCh != nil {
 		close(nem.refreshStopCh)
+		nem.refreshWg.Wait()
 	}
 
 	nem.nodeKey = nem.createNsqdNodePath(nodeData)
@@ -67,12 +69,14 @@ func (nem *NsqdEtcdMgr) RegisterNsqd(nodeData *NsqdNodeInfo) error {
 	coordLog.Infof("registered new node: %v", nodeData)
 	nem.refreshStopCh = make(chan bool, 1)
 	// start refresh node
+	nem.refreshWg.Add(1)
 	go nem.refresh(nem.refreshStopCh)
 
 	return nil
 }
 
 func (nem *NsqdEtcdMgr) refresh(stopChan chan bool) {
+	defer nem.refreshWg.Done()
 	for {
 		select {
 		case <-stopChan:
@@ -94,10 +98,11 @@ func (nem *NsqdEtcdMgr) UnregisterNsqd(nodeData *NsqdNodeInfo) error {
 	nem.Lock()
 	defer nem.Unlock()
 
-	// stop refresh
+	// stop refresh and wait the refreshing in progress done
 	if nem.refreshStopCh != nil {
 		close(nem.refreshStopCh)
 		nem.refreshStopCh = nil
+		nem.refreshWg.Wait()
 	}
 
 	_, err := nem.client.Delete(nem.createNsqdNodePath(nodeData), false)
@@ -0,0 +1,302 @@
+package consistence
+
+import (
+	"encoding/json"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.etcd.io/etcd/clientv3"
+	"golang.org/x/net/context"
+)
+
+// NsqdEtcdV3Mgr is the same as NsqdEtcdMgr but using the etcd v3 api.
+type NsqdEtcdV3Mgr struct {
+	sync.Mutex
+
+	client      *EtcdV3Client
+	clusterID   string
+	topicRoot   string
+	lookupdRoot string
+
+	nodeKey       string
+	nodeValue     string
+	refreshStopCh chan bool
+}
+
+func NewNsqdEtcdV3Mgr(host, username, pwd string) (*NsqdEtcdV3Mgr, error) {
+	client, err := NewEV3Client(host, username, pwd)
+	if err != nil {
+		return nil, err
+	}
+	err = client.LoadEpochBase()
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &NsqdEtcdV3Mgr{
+		client: client,
+	}, nil
+}
+
+func (nem *NsqdEtcdV3Mgr) InitClusterID(id string) {
+	nem.clusterID = id
+	nem.topicRoot = nem.createTopicRootPath()
+	nem.lookupdRoot = nem.createLookupdRootPath()
+}
+
+func (nem *NsqdEtcdV3Mgr) RegisterNsqd(nodeData *NsqdNodeInfo) error {
+	value, err := json.Marshal(nodeData)
+	if err != nil {
+		return err
+	}
+	nem.Lock()
+	defer nem.Unlock()
+	if nem.refreshStopCh != nil {
+		close(nem.refreshStopCh)
+		nem.refreshStopCh = nil
+	}
+
+	nem.nodeKey = nem.createNsqdNodePath(nodeData)
+	nem.nodeValue = string(value)
+	refreshStopCh := make(chan bool, 1)
+	err = nem.client.PutWithKeepAlive(nem.nodeKey, nem.nodeValue, ETCD_TTL, refreshStopCh)
+	if err != nil {
+		return err
+	}
+	coordLog.Infof("registered new node: %v", nodeData)
+	nem.refreshStopCh = refreshStopCh
+	return nil
+}
+
+func (nem *NsqdEtcdV3Mgr) UnregisterNsqd(nodeData *NsqdNodeInfo) error {
+	nem.Lock()
+	defer nem.Unlock()
+
+	// stop keepalive
+	if nem.refreshStopCh != nil {
+		close(nem.refreshStopCh)
+		nem.refreshStopCh = nil
+	}
+
+	err := nem.client.Delete(nem.createNsqdNodePath(nodeData))
+	if err != nil {
+		coordLog.Warningf("cluser[%v] node[%v] unregister failed: %v", nem.clusterID, nodeData, err)
+		return err
+	}
+
+	coordLog.Infof("cluser[%v] node[%v] unregistered", nem.clusterID, nodeData)
+	return nil
+}
+
+func (nem *NsqdEtcdV3Mgr) AcquireTopicLeader(topic string, partition int, nodeData *NsqdNodeInfo, epoch EpochType) error {
+	topicLeaderSession := &TopicLeaderSession{
+		Topic:       topic,
+		Partition:   partition,
+		LeaderNode:  nodeData,
+		Session:     hostname + strconv.FormatInt(time.Now().Unix(), 10),
+		LeaderEpoch: epoch,
+	}
+	valueB, err := json.Marshal(topicLeaderSession)
+	if err != nil {
+		return err
+	}
+	topicKey := nem.createTopicLeaderPath(topic, partition)
+	coordLog.Infof("try to acquire topic leader session [%s]", topicKey)
+	kv, created, err := nem.client.CreateIfNotExist(topicKey, string(valueB), clientv3.NoLease)
+	if err != nil {
+		coordLog.Warningf("try to acquire topic %v leader session failed: %v", topicKey, err)
+		return err
+	}
+	if created {
+		coordLog.Infof("acquire topic leader [%s] success: %v", topicKey, string(valueB))
+		return nil
+	}
+	if string(kv.Value) == string(valueB) {
+		coordLog.Infof("get topic leader with the same [%s] ", topicKey)
+		return nil
+	}
+	coordLog.Infof("get topic leader [%s] failed, lock exist value[%s]", topicKey, string(kv.Value))
+	return ErrKeyAlreadyExist
+}
+
+func (nem *NsqdEtcdV3Mgr) ReleaseTopicLeader(topic string, partition int, session *TopicLeaderSession) error {
+	nem.Lock()
+	defer nem.Unlock()
+
+	topicKey := nem.createTopicLeaderPath(topic, partition)
+	err := releaseTopicLeaderV3(nem.client, topicKey, session)
+	if err == nil {
+		coordLog.Infof("try release topic leader session [%s] success: %v", topicKey, session)
+	} else if err != ErrKeyNotFound {
+		coordLog.Warningf("release topic leader session [%s] error: %v, orig: %v", topicKey, err, session)
+	}
+	return err
+}
+
+func (nem *NsqdEtcdV3Mgr) GetAllLookupdNodes() ([]NsqLookupdNodeInfo, error) {
+	kvs, _, err := nem.client.GetChildren(nem.lookupdRoot, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(kvs) == 0 {
+		return nil, ErrKeyNotFound
+	}
+	lookupdNodeList := make([]NsqLookupdNodeInfo, 0)
+	for _, kv := range kvs {
+		var nodeInfo NsqLookupdNodeInfo
+		if err = json.Unmarshal(kv.Value, &nodeInfo); err != nil {
+			continue
+		}
+		lookupdNodeList = append(lookupdNodeList, nodeInfo)
+	}
+	return lookupdNodeList, nil
+}
+
+func (nem *NsqdEtcdV3Mgr) WatchLookupdLeader(leader chan *NsqLookupdNodeInfo, stop chan struct{}) error {
+	key := nem.createLookupdLeaderPath()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for {
+		kv, rev, err := nem.client.GetWithRevision(key)
+		if err != nil && err != ErrKeyNotFound {
+			coordLog.Errorf("get key[%s] error: %s", key, err.Error())
+			select {
+			case <-ctx.Done():
+				close(leader)
+				return nil
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+		// note: the leader may be changed while the watch is broken, so we notify
+		// the newest while rewatching.
+		var lookupdInfo NsqLookupdNodeInfo
+		if kv != nil {
+			coordLog.Infof("key: %s value: %s, revision: %v", key, string(kv.Value), rev)
+			json.Unmarshal(kv.Value, &lookupdInfo)
+		}
+		select {
+		case leader <- &lookupdInfo:
+		case <-ctx.Done():
+			close(leader)
+			return nil
+		}
+
+		watcher := nem.client.Watch(ctx, key, rev+1, false)
+		for wrsp := range watcher {
+			if wrsp.Err() != nil {
+				coordLog.Errorf("watcher key[%s] error: %s", key, wrsp.Err().Error())
+				break
+			}
+			for _, ev := range wrsp.Events {
+				var lookupdInfo NsqLookupdNodeInfo
+				if ev.Type == clientv3.EventTypeDelete {
+					coordLog.Infof("key[%s] deleted", key)
+				} else {
+					err := json.Unmarshal(ev.Kv.Value, &lookupdInfo)
+					if err != nil {
+						continue
+					}
+				}
+				select {
+				case leader <- &lookupdInfo:
+				case <-ctx.Done():
+					close(leader)
+					return nil
+				}
+			}
+		}
+		if ctx.Err() != nil {
+			coordLog.Infof("watch key[%s] canceled.", key)
+			close(leader)
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (nem *NsqdEtcdV3Mgr) GetTopicInfo(topic string, partition int) (*TopicPartitionMetaInfo, error) {
+	var topicInfo TopicPartitionMetaInfo
+	kv, err := nem.client.Get(nem.createTopicMetaPath(topic), false)
+	if err != nil {
+		return nil, err
+	}
+	var mInfo TopicMetaInfo
+	err = json.Unmarshal(kv.Value, &mInfo)
+	if err != nil {
+		return nil, err
+	}
+	topicInfo.TopicMetaInfo = mInfo
+
+	kv, err = nem.client.Get(nem.createTopicReplicaInfoPath(topic, partition), false)
+	if err != nil {
+		return nil, err
+	}
+	var rInfo TopicPartitionReplicaInfo
+	if err = json.Unmarshal(kv.Value, &rInfo); err != nil {
+		return nil, err
+	}
+	rInfo.Epoch = nem.client.ToEpoch(kv.ModRevision)
+	topicInfo.TopicPartitionReplicaInfo = rInfo
+	topicInfo.Name = topic
+	topicInfo.Partition = partition
+
+	return &topicInfo, nil
+}
+
+func (nem *NsqdEtcdV3Mgr) GetTopicLeaderSession(topic string, partition int) (*TopicLeaderSession, error) {
+	kv, err := nem.client.Get(nem.createTopicLeaderPath(topic, partition), false)
+	if err != nil {
+		return nil, err
+	}
+	var topicLeaderSession TopicLeaderSession
+	if err = json.Unmarshal(kv.Value, &topicLeaderSession); err != nil {
+		return nil, err
+	}
+	return &topicLeaderSession, nil
+}
+
+func (nem *NsqdEtcdV3Mgr) IsTopicRealDeleted(topic string) (bool, error) {
+	return true, nil
+}
+
+func (nem *NsqdEtcdV3Mgr) createNsqdNodePath(nodeData *NsqdNodeInfo) string {
+	return path.Join("/", NSQ_ROOT_DIR, nem.clusterID, NSQ_NODE_DIR, "Node-"+nodeData.ID)
+}
+
+func (nem *NsqdEtcdV3Mgr) createTopicRootPath() string {
+	return path.Join("/", NSQ_ROOT_DIR, nem.clusterID, NSQ_TOPIC_DIR)
+}
+
+func (nem *NsqdEtcdV3Mgr) createTopicMetaPath(topic string) string {
+	return path.Join(nem.topicRoot, topic, NSQ_TOPIC_META)
+}
+
+func (nem *NsqdEtcdV3Mgr) createTopicReplicaInfoPath(topic string, partition int) string {
+	return path.Join(nem.topicRoot, topic, strconv.Itoa(partition), NSQ_TOPIC_REPLICA_INFO)
+}
+
+func (nem *NsqdEtcdV3Mgr) createLookupdRootPath() string {
+	return path.Join("/", NSQ_ROOT_DIR, nem.clusterID, NSQ_LOOKUPD_DIR, NSQ_LOOKUPD_NODE_DIR)
+}
+
+func (nem *NsqdEtcdV3Mgr) createLookupdLeaderPath() string {
+	return path.Join("/", NSQ_ROOT_DIR, nem.clusterID, NSQ_LOOKUPD_DIR, NSQ_LOOKUPD_LEADER_SESSION)
+}
+
+func (nem *NsqdEtcdV3Mgr) createTopicLeaderPath(topic string, partition int) string {
+	return path.Join(nem.topicRoot, topic, strconv.Itoa(partition), NSQ_TOPIC_LEADER_SESSION)
+}
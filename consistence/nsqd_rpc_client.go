@@ -340,6 +340,22 @@ func (nrpc *NsqdRpcClient) UpdateChannelState(leaderSession *TopicLeaderSession,
 	return convertRpcError(err, retErr)
 }
 
+func (nrpc *NsqdRpcClient) UpdateChannelDeadLetter(leaderSession *TopicLeaderSession, info *TopicPartitionMetaInfo, channel string, maxAttempts uint16, dlqTopic string) *CoordErr {
+	var deadLetter RpcChannelDeadLetter
+	deadLetter.TopicName = info.Name
+	deadLetter.TopicPartition = info.Partition
+	deadLetter.TopicWriteEpoch = info.EpochForWrite
+	deadLetter.Epoch = info.Epoch
+	deadLetter.TopicLeaderSessionEpoch = leaderSession.LeaderEpoch
+	deadLetter.TopicLeaderSession = leaderSession.Session
+	deadLetter.Channel = channel
+	deadLetter.MaxAttempts = maxAttempts
+	deadLetter.DeadLetterTopic = dlqTopic
+
+	retErr, err := nrpc.CallWithRetry("UpdateChannelDeadLetter", &deadLetter)
+	return convertRpcError(err, retErr)
+}
+
 func (nrpc *NsqdRpcClient) UpdateChannelOffset(leaderSession *TopicLeaderSession, info *TopicPartitionMetaInfo, channel string, offset ChannelConsumerOffset) *CoordErr {
 	// it seems grpc is slower, so disable it.
 	if nrpc.grpcClient != nil && false {
@@ -548,6 +564,37 @@ func (nrpc *NsqdRpcClient) PutMessages(leaderSession *TopicLeaderSession, info *
 	return convertRpcError(err, retErr)
 }
 
+// PutRawMessages replicate the encoded records written by the leader, the raw data
+// include the record header and will be written to the replica without re-encoding.
+func (nrpc *NsqdRpcClient) PutRawMessages(leaderSession *TopicLeaderSession, info *TopicPartitionMetaInfo, log CommitLogData, rawData []byte) *CoordErr {
+	var putData RpcPutMessages
+	putData.LogData = log
+	putData.TopicName = info.Name
+	putData.TopicPartition = info.Partition
+	putData.TopicRawMessage = rawData
+	putData.TopicWriteEpoch = info.EpochForWrite
+	putData.Epoch = info.Epoch
+	putData.TopicLeaderSessionEpoch = leaderSession.LeaderEpoch
+	putData.TopicLeaderSession = leaderSession.Session
+	retErr, err := nrpc.CallWithRetry("PutMessages", &putData)
+	return convertRpcError(err, retErr)
+}
+
+// PutRawDelayedMessage replicate the encoded delayed record written by the leader.
+func (nrpc *NsqdRpcClient) PutRawDelayedMessage(leaderSession *TopicLeaderSession, info *TopicPartitionMetaInfo, log CommitLogData, rawData []byte) *CoordErr {
+	var putData RpcPutMessage
+	putData.LogData = log
+	putData.TopicName = info.Name
+	putData.TopicPartition = info.Partition
+	putData.TopicRawMessage = rawData
+	putData.TopicWriteEpoch = info.EpochForWrite
+	putData.Epoch = info.Epoch
+	putData.TopicLeaderSessionEpoch = leaderSession.LeaderEpoch
+	putData.TopicLeaderSession = leaderSession.Session
+	retErr, err := nrpc.CallWithRetry("PutDelayedMessage", &putData)
+	return convertRpcError(err, retErr)
+}
+
 func (nrpc *NsqdRpcClient) GetLastCommitLogID(topicInfo *TopicPartitionMetaInfo) (int64, *CoordErr) {
 	var req RpcCommitLogReq
 	req.TopicName = topicInfo.Name
@@ -560,6 +607,24 @@ func (nrpc *NsqdRpcClient) GetLastCommitLogID(topicInfo *TopicPartitionMetaInfo)
 	return ret.(int64), convertRpcError(err, &retErr)
 }
 
+func (nrpc *NsqdRpcClient) GetEncryptKeyFingerprint() (string, *CoordErr) {
+	var retErr CoordErr
+	ret, err := nrpc.CallWithRetry("GetEncryptKeyFingerprint", "")
+	if err != nil || ret == nil {
+		return "", convertRpcError(err, &retErr)
+	}
+	return ret.(string), nil
+}
+
+func (nrpc *NsqdRpcClient) GetZstdDictFingerprint() (string, *CoordErr) {
+	var retErr CoordErr
+	ret, err := nrpc.CallWithRetry("GetZstdDictFingerprint", "")
+	if err != nil || ret == nil {
+		return "", convertRpcError(err, &retErr)
+	}
+	return ret.(string), nil
+}
+
 func (nrpc *NsqdRpcClient) GetLastDelayedQueueCommitLogID(topicInfo *TopicPartitionMetaInfo) (int64, *CoordErr) {
 	var req RpcCommitLogReq
 	req.TopicName = topicInfo.Name
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/youzan/nsq/internal/protocol"
+	"github.com/youzan/nsq/nsqd"
 )
 
 const (
@@ -38,6 +39,11 @@ func (nlcoord *NsqLookupCoordinator) GetTopicsMetaInfoMap(topics []string) (map[
 	return nlcoord.leadership.GetTopicsMetaInfoMap(topics)
 }
 
+// GetAllTopicPartitionsInfo return the meta and replica info of all the topic partitions in cluster
+func (nlcoord *NsqLookupCoordinator) GetAllTopicPartitionsInfo() ([]TopicPartitionMetaInfo, error) {
+	return nlcoord.leadership.ScanTopics()
+}
+
 func (nlcoord *NsqLookupCoordinator) GetTopicLeaderNodes(topicName string) (map[string]string, error) {
 	meta, cached, err := nlcoord.leadership.GetTopicMetaInfoTryCache(topicName)
 	if err != nil {
@@ -48,8 +54,14 @@ func (nlcoord *NsqLookupCoordinator) GetTopicLeaderNodes(topicName string) (map[
 		coordLog.Infof("miss cache read for topic info: %v", topicName)
 	}
 	ret := make(map[string]string)
+	if meta.MirrorFrom != "" {
+		return ret, nil
+	}
 	var anyErr error
 	for i := 0; i < meta.PartitionNum; i++ {
+		if meta.IsPartitionShrinking(i) {
+			continue
+		}
 		info, err := nlcoord.leadership.GetTopicInfo(topicName, i)
 		if err != nil {
 			anyErr = err
@@ -389,7 +401,8 @@ func (nlcoord *NsqLookupCoordinator) deleteTopicPartition(topic string, pid int)
 }
 
 func (nlcoord *NsqLookupCoordinator) ChangeTopicMetaParam(topic string,
-	newSyncEvery int, newRetentionDay int, newReplicator int, upgradeExt string) error {
+	newSyncEvery int, newRetentionDay int, newReplicator int, newMinInSync int, upgradeExt string,
+	newCompression string, newMirrorFrom string) error {
 	if nlcoord.leaderNode.GetID() != nlcoord.myNode.GetID() {
 		coordLog.Infof("not leader while create topic")
 		return ErrNotNsqLookupLeader
@@ -408,6 +421,14 @@ func (nlcoord *NsqLookupCoordinator) ChangeTopicMetaParam(topic string,
 	if newReplicator > 5 {
 		return errors.New("max replicator allowed exceed")
 	}
+	if _, err := nsqd.ParseCompressCodec(newCompression); err != nil {
+		return err
+	}
+	if newMirrorFrom != "" && newMirrorFrom != "none" {
+		if _, err := ParseMirrorLookupdAddrs(newMirrorFrom); err != nil {
+			return err
+		}
+	}
 
 	nlcoord.joinStateMutex.Lock()
 	state, ok := nlcoord.joinISRState[topic]
@@ -443,12 +464,36 @@ func (nlcoord *NsqLookupCoordinator) ChangeTopicMetaParam(topic string,
 		if newReplicator > 0 {
 			meta.Replica = newReplicator
 		}
+		if newMinInSync >= 0 {
+			meta.MinInSync = newMinInSync
+		}
+		if meta.MinInSync > meta.Replica {
+			return errors.New("min insync should not be larger than replica")
+		}
 		// change to ext only, can not change ext to non-ext
 		needDisableWrite := false
 		if upgradeExt == "true" && !meta.Ext {
 			meta.Ext = true
 			needDisableWrite = true
 		}
+		if newCompression == "none" {
+			newCompression = ""
+		} else if newCompression == "" {
+			newCompression = meta.Compression
+		}
+		// the mirror can be stopped by none to allow the producer writes, for example
+		// while switching the producers to the mirror cluster.
+		if newMirrorFrom == "none" {
+			meta.MirrorFrom = ""
+		} else if newMirrorFrom != "" {
+			meta.MirrorFrom = newMirrorFrom
+		}
+		if newCompression != meta.Compression {
+			// the compressed records are replicated as written by the leader, disable the
+			// write while changing so the new leader after failover use the same compression.
+			meta.Compression = newCompression
+			needDisableWrite = true
+		}
 		if needDisableWrite {
 			if !atomic.CompareAndSwapInt32(&nlcoord.isUpgrading, 0, 1) {
 				coordLog.Infof("the cluster state is already upgrading")
@@ -566,6 +611,9 @@ func (nlcoord *NsqLookupCoordinator) ExpandTopicPartition(topic string, newParti
 		if newPartitionNum < meta.PartitionNum {
 			return errors.New("the partition number can not be reduced")
 		}
+		if meta.ShrinkTo > 0 {
+			return errors.New("the topic is shrinking")
+		}
 		currentNodes := nlcoord.getCurrentNodes()
 		meta.PartitionNum = newPartitionNum
 		err = nlcoord.updateTopicMeta(currentNodes, topic, meta, oldGen)
@@ -591,6 +639,23 @@ func (nlcoord *NsqLookupCoordinator) CreateTopic(topic string, meta TopicMetaInf
 	if meta.PartitionNum >= MAX_PARTITION_NUM {
 		return errors.New("max partition allowed exceed")
 	}
+	if meta.MinInSync < 0 || meta.MinInSync > meta.Replica {
+		return errors.New("min insync should not be larger than replica")
+	}
+	if _, err := nsqd.ParseCompressCodec(meta.Compression); err != nil {
+		return err
+	}
+	if meta.Compression == "none" {
+		meta.Compression = ""
+	}
+	if meta.Compact && !meta.Ext {
+		return errors.New("the compacted topic should be ext")
+	}
+	if meta.MirrorFrom != "" {
+		if _, err := ParseMirrorLookupdAddrs(meta.MirrorFrom); err != nil {
+			return err
+		}
+	}
 
 	currentNodes := nlcoord.getCurrentNodes()
 	if len(currentNodes) < meta.Replica {
@@ -693,6 +758,7 @@ func (nlcoord *NsqLookupCoordinator) checkAndUpdateTopicPartitions(currentNodes
 		var tmpTopicReplicaInfo TopicPartitionReplicaInfo
 		tmpTopicReplicaInfo.ISR = isrList[i]
 		tmpTopicReplicaInfo.Leader = leaders[i]
+		tmpTopicReplicaInfo.PreferredLeader = leaders[i]
 		tmpTopicReplicaInfo.EpochForWrite = 1
 
 		commonErr := nlcoord.leadership.UpdateTopicNodeInfo(topic, i, &tmpTopicReplicaInfo, tmpTopicReplicaInfo.Epoch)
@@ -715,3 +781,45 @@ func (nlcoord *NsqLookupCoordinator) checkAndUpdateTopicPartitions(currentNodes
 	nlcoord.triggerCheckTopics("", 0, time.Millisecond*500)
 	return nil
 }
+
+// JoinConsumerGroup add the member to the consumer group of the topic channel, a new member id
+// will be generated if empty. All the partitions of the topic will be rebalanced among the members.
+func (nlcoord *NsqLookupCoordinator) JoinConsumerGroup(topic string, channel string,
+	memberID string, hostname string) (ConsumerGroupAssignment, error) {
+	if !nlcoord.IsMineLeader() {
+		return ConsumerGroupAssignment{}, ErrNotNsqLookupLeader
+	}
+	meta, err := nlcoord.GetTopicMetaInfo(topic)
+	if err != nil {
+		return ConsumerGroupAssignment{}, err
+	}
+	return nlcoord.groupMgr.join(topic, channel, meta.PartitionNum, memberID, hostname)
+}
+
+// HeartbeatConsumerGroup keep the member alive and return the current assignment, the member
+// should rejoin if ErrConsumerGroupMemberNotFound returned.
+func (nlcoord *NsqLookupCoordinator) HeartbeatConsumerGroup(topic string, channel string,
+	memberID string) (ConsumerGroupAssignment, error) {
+	if !nlcoord.IsMineLeader() {
+		return ConsumerGroupAssignment{}, ErrNotNsqLookupLeader
+	}
+	meta, err := nlcoord.GetTopicMetaInfo(topic)
+	if err != nil {
+		return ConsumerGroupAssignment{}, err
+	}
+	return nlcoord.groupMgr.heartbeat(topic, channel, meta.PartitionNum, memberID)
+}
+
+func (nlcoord *NsqLookupCoordinator) LeaveConsumerGroup(topic string, channel string, memberID string) error {
+	if !nlcoord.IsMineLeader() {
+		return ErrNotNsqLookupLeader
+	}
+	return nlcoord.groupMgr.leave(topic, channel, memberID)
+}
+
+func (nlcoord *NsqLookupCoordinator) GetConsumerGroupInfo(topic string, channel string) (ConsumerGroupInfo, error) {
+	if !nlcoord.IsMineLeader() {
+		return ConsumerGroupInfo{}, ErrNotNsqLookupLeader
+	}
+	return nlcoord.groupMgr.getGroupInfo(topic, channel)
+}
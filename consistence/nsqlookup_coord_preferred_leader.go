@@ -0,0 +1,232 @@
+package consistence
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/youzan/nsq/internal/protocol"
+)
+
+var (
+	checkPreferredLeaderInterval = time.Minute
+	// the max number of leaders moved in each round of the background restore
+	preferredLeaderMaxMoves = 4
+	// wait between each leader move to avoid too much election in short time
+	preferredLeaderMoveWait = time.Second * 5
+)
+
+// PreferredLeaderMove is the leader move from current leader to the preferred leader
+type PreferredLeaderMove struct {
+	Topic     string `json:"topic"`
+	Partition int    `json:"partition"`
+	Leader    string `json:"leader"`
+	Preferred string `json:"preferred"`
+	Moved     bool   `json:"moved"`
+	Error     string `json:"error,omitempty"`
+}
+
+func (nlcoord *NsqLookupCoordinator) SetPreferredLeaderRestore(enable bool) error {
+	if nlcoord.leaderNode.GetID() != nlcoord.myNode.GetID() {
+		coordLog.Infof("not leader while set preferred leader restore")
+		return ErrNotNsqLookupLeader
+	}
+	if enable {
+		atomic.StoreInt32(&nlcoord.enablePreferredLeader, 1)
+	} else {
+		atomic.StoreInt32(&nlcoord.enablePreferredLeader, 0)
+	}
+	return nil
+}
+
+func (nlcoord *NsqLookupCoordinator) IsPreferredLeaderRestoreEnabled() bool {
+	return atomic.LoadInt32(&nlcoord.enablePreferredLeader) == 1
+}
+
+// check whether the leader of the partition can be moved back to the preferred leader,
+// the preferred leader should be alive and in isr, and the isr should be full to
+// avoid moving leader while the partition is recovering.
+func (nlcoord *NsqLookupCoordinator) getPreferredLeaderMove(topicInfo *TopicPartitionMetaInfo,
+	currentNodes map[string]NsqdNodeInfo) (PreferredLeaderMove, bool) {
+	move := PreferredLeaderMove{
+		Topic:     topicInfo.Name,
+		Partition: topicInfo.Partition,
+		Leader:    topicInfo.Leader,
+		Preferred: topicInfo.GetPreferredLeader(),
+	}
+	if move.Preferred == "" || move.Preferred == topicInfo.Leader {
+		return move, false
+	}
+	if FindSlice(topicInfo.ISR, move.Preferred) == -1 {
+		return move, false
+	}
+	if _, ok := currentNodes[move.Preferred]; !ok {
+		return move, false
+	}
+	if _, ok := currentNodes[topicInfo.Leader]; !ok {
+		return move, false
+	}
+	if len(topicInfo.ISR) < topicInfo.Replica {
+		return move, false
+	}
+	return move, true
+}
+
+func (nlcoord *NsqLookupCoordinator) getTopicPartitionsForPreferredLeader(topic string) ([]TopicPartitionMetaInfo, error) {
+	if topic == "" {
+		return nlcoord.leadership.ScanTopics()
+	}
+	if !protocol.IsValidTopicName(topic) {
+		return nil, errors.New("invalid topic name")
+	}
+	meta, _, err := nlcoord.leadership.GetTopicMetaInfo(topic)
+	if err != nil {
+		return nil, err
+	}
+	topics := make([]TopicPartitionMetaInfo, 0, meta.PartitionNum)
+	for pid := 0; pid < meta.PartitionNum; pid++ {
+		topicInfo, err := nlcoord.leadership.GetTopicInfo(topic, pid)
+		if err != nil {
+			return nil, err
+		}
+		topics = append(topics, *topicInfo)
+	}
+	return topics, nil
+}
+
+// RestorePreferredLeaders will move the leaders of the topic partitions (all topics if topic is empty)
+// back to the preferred leader. At most maxMoves leaders will be moved and it will wait a while
+// between each move. In dry run mode only the leaders need to be moved are returned.
+func (nlcoord *NsqLookupCoordinator) RestorePreferredLeaders(topic string, dryRun bool, maxMoves int) ([]PreferredLeaderMove, error) {
+	if nlcoord.leaderNode.GetID() != nlcoord.myNode.GetID() {
+		coordLog.Infof("not leader while restore preferred leader")
+		return nil, ErrNotNsqLookupLeader
+	}
+	if maxMoves <= 0 {
+		maxMoves = preferredLeaderMaxMoves
+	}
+	if !dryRun {
+		if !nlcoord.IsClusterStable() {
+			return nil, ErrClusterUnstable
+		}
+		if !atomic.CompareAndSwapInt32(&nlcoord.balanceWaiting, 0, 1) {
+			coordLog.Infof("another balance is running, should wait")
+			return nil, ErrClusterBalanceRunning
+		}
+		defer atomic.StoreInt32(&nlcoord.balanceWaiting, 0)
+	}
+	topics, err := nlcoord.getTopicPartitionsForPreferredLeader(topic)
+	if err != nil {
+		return nil, err
+	}
+	currentNodes := nlcoord.getCurrentNodes()
+	moves := make([]PreferredLeaderMove, 0)
+	for i := range topics {
+		if len(moves) >= maxMoves {
+			break
+		}
+		topicInfo := &topics[i]
+		move, ok := nlcoord.getPreferredLeaderMove(topicInfo, currentNodes)
+		if !ok {
+			continue
+		}
+		if dryRun {
+			moves = append(moves, move)
+			continue
+		}
+		if len(moves) > 0 {
+			select {
+			case <-nlcoord.stopChan:
+				return moves, errLookupExiting
+			case <-time.After(preferredLeaderMoveWait):
+			}
+			if !nlcoord.IsClusterStable() {
+				return moves, ErrClusterUnstable
+			}
+		}
+		coordErr := nlcoord.moveLeaderToPreferred(topicInfo.Name, topicInfo.Partition)
+		if coordErr != nil {
+			coordLog.Infof("topic %v move leader to preferred %v failed: %v", topicInfo.GetTopicDesp(), move.Preferred, coordErr)
+			move.Error = coordErr.ErrMsg
+		} else {
+			move.Moved = true
+		}
+		moves = append(moves, move)
+	}
+	return moves, nil
+}
+
+func (nlcoord *NsqLookupCoordinator) moveLeaderToPreferred(topic string, partition int) *CoordErr {
+	topicInfo, err := nlcoord.leadership.GetTopicInfo(topic, partition)
+	if err != nil {
+		coordLog.Infof("get topic info failed :%v", err)
+		return &CoordErr{err.Error(), RpcCommonErr, CoordCommonErr}
+	}
+	currentNodes, currentNodesEpoch := nlcoord.getCurrentNodesWithEpoch()
+	move, ok := nlcoord.getPreferredLeaderMove(topicInfo, currentNodes)
+	if !ok {
+		return nil
+	}
+	coordLog.Infof("topic %v move leader from %v to the preferred leader %v", topicInfo.GetTopicDesp(), move.Leader, move.Preferred)
+	coordErr := nlcoord.handleTopicLeaderElection(topicInfo, currentNodes, currentNodesEpoch, true)
+	if coordErr != nil {
+		return coordErr
+	}
+	if topicInfo.Leader != move.Preferred {
+		coordLog.Infof("topic %v leader moved to %v not the preferred leader %v", topicInfo.GetTopicDesp(), topicInfo.Leader, move.Preferred)
+		return ErrLeaderElectionFail
+	}
+	return nil
+}
+
+// change the preferred leader to the current leader, this is used while the leader is moved
+// by plan (balance or node removing), so the restore will not move the leader back.
+func (nlcoord *NsqLookupCoordinator) updateTopicPreferredLeader(topicInfo *TopicPartitionMetaInfo) *CoordErr {
+	return nlcoord.setTopicPreferredLeader(topicInfo, topicInfo.Leader)
+}
+
+func (nlcoord *NsqLookupCoordinator) setTopicPreferredLeader(topicInfo *TopicPartitionMetaInfo, preferred string) *CoordErr {
+	if preferred == "" || topicInfo.PreferredLeader == preferred {
+		return nil
+	}
+	newTopicInfo := *topicInfo
+	newTopicInfo.PreferredLeader = preferred
+	err := nlcoord.leadership.UpdateTopicNodeInfo(topicInfo.Name, topicInfo.Partition,
+		&newTopicInfo.TopicPartitionReplicaInfo, topicInfo.Epoch)
+	if err != nil {
+		coordLog.Infof("update topic %v preferred leader failed: %v", topicInfo.GetTopicDesp(), err)
+		return &CoordErr{err.Error(), RpcNoErr, CoordCommonErr}
+	}
+	*topicInfo = newTopicInfo
+	nlcoord.notifyTopicMetaInfo(topicInfo)
+	return nil
+}
+
+func (nlcoord *NsqLookupCoordinator) checkPreferredLeaders(monitorChan chan struct{}) {
+	ticker := time.NewTicker(checkPreferredLeaderInterval)
+	defer func() {
+		ticker.Stop()
+		coordLog.Infof("check preferred leaders quit.")
+	}()
+
+	for {
+		select {
+		case <-monitorChan:
+			return
+		case <-ticker.C:
+			if nlcoord.leadership == nil || !nlcoord.IsPreferredLeaderRestoreEnabled() {
+				continue
+			}
+			if !nlcoord.IsClusterStable() || atomic.LoadInt32(&nlcoord.isUpgrading) == 1 {
+				continue
+			}
+			moves, err := nlcoord.RestorePreferredLeaders("", false, preferredLeaderMaxMoves)
+			if err != nil {
+				coordLog.Infof("restore preferred leaders failed: %v", err)
+			}
+			if len(moves) > 0 {
+				coordLog.Infof("restore preferred leaders: %v", moves)
+			}
+		}
+	}
+}
@@ -0,0 +1,711 @@
+package consistence
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/youzan/nsq/internal/protocol"
+)
+
+const (
+	ReassignStateRunning   = "running"
+	ReassignStatePaused    = "paused"
+	ReassignStateCancelled = "cancelled"
+	ReassignStateDone      = "done"
+)
+
+const (
+	ReassignPartPending = "pending"
+	ReassignPartMoving  = "moving"
+	ReassignPartDone    = "done"
+	ReassignPartFailed  = "failed"
+)
+
+var (
+	checkReassignInterval = time.Second * 10
+	// the max number of topics moved at the same time
+	maxReassignConcurrency = 16
+)
+
+var (
+	ErrReassignPlanNotFound    = errors.New("reassignment plan not found")
+	ErrReassignPlanNotFinished = errors.New("the reassignment plan is not finished")
+	errReassignPlanChanged     = errors.New("the reassignment plan is changed")
+)
+
+// ReassignPartition is the new isr of the topic partition in the reassignment plan,
+// the first node in the new isr will be the leader.
+type ReassignPartition struct {
+	Topic     string   `json:"topic"`
+	Partition int      `json:"partition"`
+	ISR       []string `json:"isr"`
+	// the leader and isr while the plan submitted
+	OldLeader string   `json:"old_leader,omitempty"`
+	OldISR    []string `json:"old_isr,omitempty"`
+	State     string   `json:"state,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+func (rp *ReassignPartition) isFinished() bool {
+	return rp.State == ReassignPartDone || rp.State == ReassignPartFailed
+}
+
+// ReassignPlan is the partition reassignment plan of the cluster. The plan is saved in
+// leadership and executed by the lookup leader, so it can be resumed after the leader changed.
+// The partitions of different topics are moved concurrently and the partitions of the same
+// topic are moved one by one to avoid the conflict of the replica placement.
+type ReassignPlan struct {
+	ID string `json:"id"`
+	// running, paused, cancelled or done
+	State string `json:"state"`
+	// the max number of topics moved at the same time
+	Concurrency int                 `json:"concurrency"`
+	Partitions  []ReassignPartition `json:"partitions"`
+	CreateTime  int64               `json:"create_time"`
+	UpdateTime  int64               `json:"update_time"`
+	Epoch       EpochType           `json:"-"`
+}
+
+func (plan *ReassignPlan) IsFinished() bool {
+	return plan.State == ReassignStateDone || plan.State == ReassignStateCancelled
+}
+
+// ReassignNodeLoad is the load of the node before and after the reassignment
+type ReassignNodeLoad struct {
+	NodeID      string  `json:"node_id"`
+	Leaders     int     `json:"leaders"`
+	Replicas    int     `json:"replicas"`
+	LeaderLF    float64 `json:"leader_load_factor"`
+	NodeLF      float64 `json:"node_load_factor"`
+	NewLeaders  int     `json:"new_leaders"`
+	NewReplicas int     `json:"new_replicas"`
+	NewLeaderLF float64 `json:"new_leader_load_factor"`
+	NewNodeLF   float64 `json:"new_node_load_factor"`
+}
+
+// SubmitReassignPlan will check the plan and return the load of each node before and after the
+// reassignment. In dry run mode the plan is only checked, otherwise the plan is saved and executed
+// in background. Only one plan can be executed at the same time.
+func (nlcoord *NsqLookupCoordinator) SubmitReassignPlan(plan *ReassignPlan, dryRun bool) ([]ReassignNodeLoad, error) {
+	if nlcoord.leaderNode.GetID() != nlcoord.myNode.GetID() {
+		coordLog.Infof("not leader while submit reassignment plan")
+		return nil, ErrNotNsqLookupLeader
+	}
+	if plan.Concurrency <= 0 {
+		plan.Concurrency = 1
+	}
+	if plan.Concurrency > maxReassignConcurrency {
+		return nil, fmt.Errorf("the concurrency should not be larger than %v", maxReassignConcurrency)
+	}
+	topics, err := nlcoord.leadership.ScanTopics()
+	if err != nil {
+		coordLog.Infof("scan topics error: %v", err)
+		return nil, err
+	}
+	currentNodes := nlcoord.getCurrentNodes()
+	err = checkReassignPlan(plan, topics, currentNodes)
+	if err != nil {
+		return nil, err
+	}
+	loads := nlcoord.getReassignNodeLoads(plan, topics, currentNodes)
+	if dryRun {
+		return loads, nil
+	}
+	if !nlcoord.IsClusterStable() {
+		return nil, ErrClusterUnstable
+	}
+
+	nlcoord.reassignMutex.Lock()
+	defer nlcoord.reassignMutex.Unlock()
+	oldGen := EpochType(0)
+	old, err := nlcoord.leadership.GetReassignPlan()
+	if err == nil {
+		if !old.IsFinished() {
+			return nil, ErrReassignPlanNotFinished
+		}
+		oldGen = old.Epoch
+	} else if err != ErrKeyNotFound {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	plan.ID = strconv.FormatInt(time.Now().UnixNano(), 10)
+	plan.State = ReassignStateRunning
+	plan.CreateTime = now
+	plan.UpdateTime = now
+	err = nlcoord.leadership.UpdateReassignPlan(plan, oldGen)
+	if err != nil {
+		coordLog.Infof("save reassignment plan failed: %v", err)
+		return nil, err
+	}
+	coordLog.Infof("reassignment plan %v submitted with %v partitions", plan.ID, len(plan.Partitions))
+	return loads, nil
+}
+
+// GetReassignPlan return the current (or the last finished) reassignment plan with the progress.
+func (nlcoord *NsqLookupCoordinator) GetReassignPlan() (*ReassignPlan, error) {
+	plan, err := nlcoord.leadership.GetReassignPlan()
+	if err == ErrKeyNotFound {
+		return nil, ErrReassignPlanNotFound
+	}
+	return plan, err
+}
+
+// PauseReassignPlan will stop moving more partitions, the moving partitions will be finished.
+func (nlcoord *NsqLookupCoordinator) PauseReassignPlan() error {
+	return nlcoord.changeReassignPlanState([]string{ReassignStateRunning}, ReassignStatePaused)
+}
+
+func (nlcoord *NsqLookupCoordinator) ResumeReassignPlan() error {
+	return nlcoord.changeReassignPlanState([]string{ReassignStatePaused}, ReassignStateRunning)
+}
+
+// CancelReassignPlan will stop the plan and stop waiting the moving partitions, the partitions
+// already moved will not be changed back.
+func (nlcoord *NsqLookupCoordinator) CancelReassignPlan() error {
+	return nlcoord.changeReassignPlanState([]string{ReassignStateRunning, ReassignStatePaused}, ReassignStateCancelled)
+}
+
+func (nlcoord *NsqLookupCoordinator) changeReassignPlanState(from []string, to string) error {
+	if nlcoord.leaderNode.GetID() != nlcoord.myNode.GetID() {
+		coordLog.Infof("not leader while change reassignment plan")
+		return ErrNotNsqLookupLeader
+	}
+	nlcoord.reassignMutex.Lock()
+	defer nlcoord.reassignMutex.Unlock()
+	plan, err := nlcoord.leadership.GetReassignPlan()
+	if err != nil {
+		if err == ErrKeyNotFound {
+			return ErrReassignPlanNotFound
+		}
+		return err
+	}
+	if plan.State == to {
+		return nil
+	}
+	if FindSlice(from, plan.State) == -1 {
+		return fmt.Errorf("the reassignment plan is %v", plan.State)
+	}
+	coordLog.Infof("reassignment plan %v state changed from %v to %v", plan.ID, plan.State, to)
+	plan.State = to
+	plan.UpdateTime = time.Now().Unix()
+	err = nlcoord.leadership.UpdateReassignPlan(plan, plan.Epoch)
+	if err != nil {
+		coordLog.Infof("save reassignment plan failed: %v", err)
+		return err
+	}
+	if to == ReassignStateCancelled && nlcoord.reassignCancelChan != nil {
+		close(nlcoord.reassignCancelChan)
+		nlcoord.reassignCancelChan = nil
+	}
+	return nil
+}
+
+// check the partitions in plan and set the current leader and isr
+func checkReassignPlan(plan *ReassignPlan, topics []TopicPartitionMetaInfo, currentNodes map[string]NsqdNodeInfo) error {
+	if len(plan.Partitions) == 0 {
+		return errors.New("the reassignment plan is empty")
+	}
+	topicInfoMap := getTopicInfoMap(topics)
+	// the new isr of all the partitions for the topics in plan
+	newISRs := make(map[string]map[int][]string)
+	for i := range plan.Partitions {
+		rp := &plan.Partitions[i]
+		if !protocol.IsValidTopicName(rp.Topic) {
+			return fmt.Errorf("invalid topic name: %v", rp.Topic)
+		}
+		desp := rp.Topic + "-" + strconv.Itoa(rp.Partition)
+		topicInfo, ok := topicInfoMap[desp]
+		if !ok {
+			return fmt.Errorf("topic partition %v not found", desp)
+		}
+		parts, ok := newISRs[rp.Topic]
+		if !ok {
+			parts = make(map[int][]string)
+			newISRs[rp.Topic] = parts
+		}
+		if _, ok := parts[rp.Partition]; ok {
+			return fmt.Errorf("duplicate topic partition %v in plan", desp)
+		}
+		if len(rp.ISR) != topicInfo.Replica {
+			return fmt.Errorf("the new isr of %v should have %v replicas", desp, topicInfo.Replica)
+		}
+		for j, nid := range rp.ISR {
+			if _, ok := currentNodes[nid]; !ok {
+				return fmt.Errorf("the node %v for %v is not found in cluster", nid, desp)
+			}
+			if FindSlice(rp.ISR[:j], nid) != -1 {
+				return fmt.Errorf("duplicate node %v in the new isr of %v", nid, desp)
+			}
+		}
+		parts[rp.Partition] = rp.ISR
+		rp.OldLeader = topicInfo.Leader
+		rp.OldISR = append([]string(nil), topicInfo.ISR...)
+		rp.State = ReassignPartPending
+		rp.Error = ""
+	}
+	// the partitions of the same topic can not be on the same node if not allowed
+	allowMulti := make(map[string]bool)
+	for _, topicInfo := range topics {
+		parts, ok := newISRs[topicInfo.Name]
+		if !ok {
+			continue
+		}
+		allowMulti[topicInfo.Name] = topicInfo.AllowMulti()
+		if _, ok := parts[topicInfo.Partition]; !ok {
+			parts[topicInfo.Partition] = topicInfo.ISR
+		}
+	}
+	for topic, parts := range newISRs {
+		if allowMulti[topic] {
+			continue
+		}
+		usedNodes := make(map[string]int)
+		for pid, isr := range parts {
+			for _, nid := range isr {
+				if other, ok := usedNodes[nid]; ok {
+					return fmt.Errorf("the partition %v and %v of topic %v are on the same node %v", other, pid, topic, nid)
+				}
+				usedNodes[nid] = pid
+			}
+		}
+	}
+	return nil
+}
+
+// copy the stats of the topic partition from other node, the stats only on the leader
+// will be copied if leader is true.
+func (nts *NodeTopicStats) copyTopicStats(from *NodeTopicStats, topicFullName string, leader bool) {
+	if v, ok := from.TopicTotalDataSize[topicFullName]; ok {
+		nts.TopicTotalDataSize[topicFullName] = v
+	}
+	if v, ok := from.TopicHourlyPubDataList[topicFullName]; ok {
+		nts.TopicHourlyPubDataList[topicFullName] = v
+	}
+	if !leader {
+		return
+	}
+	if v, ok := from.TopicLeaderDataSize[topicFullName]; ok {
+		nts.TopicLeaderDataSize[topicFullName] = v
+	}
+	if v, ok := from.ChannelDepthData[topicFullName]; ok {
+		nts.ChannelDepthData[topicFullName] = v
+	}
+	if v, ok := from.PendingMsgCnt[topicFullName]; ok {
+		nts.PendingMsgCnt[topicFullName] = v
+	}
+	if v, ok := from.ChannelNum[topicFullName]; ok {
+		nts.ChannelNum[topicFullName] = v
+	}
+	if v, ok := from.ChannelList[topicFullName]; ok {
+		nts.ChannelList[topicFullName] = v
+	}
+	if v, ok := from.ChannelMetas[topicFullName]; ok {
+		nts.ChannelMetas[topicFullName] = v
+	}
+}
+
+func (nts *NodeTopicStats) removeTopicStats(topicFullName string) {
+	delete(nts.TopicTotalDataSize, topicFullName)
+	delete(nts.TopicHourlyPubDataList, topicFullName)
+	delete(nts.TopicLeaderDataSize, topicFullName)
+	delete(nts.ChannelDepthData, topicFullName)
+	delete(nts.PendingMsgCnt, topicFullName)
+	delete(nts.ChannelNum, topicFullName)
+	delete(nts.ChannelList, topicFullName)
+	delete(nts.ChannelMetas, topicFullName)
+	delete(nts.ChannelOffsets, topicFullName)
+}
+
+// move the stats of the topic partition to the new isr nodes as if the plan is done
+func moveReassignTopicStats(nodeStats map[string]*NodeTopicStats, topicInfo *TopicPartitionMetaInfo, newISR []string) {
+	desp := topicInfo.GetTopicDesp()
+	moved := NewNodeTopicStats("", 1, 1)
+	for _, nid := range topicInfo.ISR {
+		if s, ok := nodeStats[nid]; ok {
+			moved.copyTopicStats(s, desp, false)
+		}
+	}
+	if s, ok := nodeStats[topicInfo.Leader]; ok {
+		moved.copyTopicStats(s, desp, true)
+	}
+	for _, nid := range topicInfo.ISR {
+		if s, ok := nodeStats[nid]; ok {
+			s.removeTopicStats(desp)
+		}
+	}
+	for i, nid := range newISR {
+		if s, ok := nodeStats[nid]; ok {
+			s.copyTopicStats(moved, desp, i == 0)
+		}
+	}
+}
+
+func (nlcoord *NsqLookupCoordinator) getReassignNodeLoads(plan *ReassignPlan, topics []TopicPartitionMetaInfo,
+	currentNodes map[string]NsqdNodeInfo) []ReassignNodeLoad {
+	nodeStats := make(map[string]*NodeTopicStats, len(currentNodes))
+	loads := make(map[string]*ReassignNodeLoad, len(currentNodes))
+	for nid, nodeInfo := range currentNodes {
+		topicStat, err := nlcoord.getNsqdTopicStat(nodeInfo)
+		if err != nil {
+			coordLog.Infof("failed to get node topic status : %v", nid)
+			topicStat = NewNodeTopicStats(nid, 0, 1)
+		}
+		nodeStats[nid] = topicStat
+		l := &ReassignNodeLoad{NodeID: nid}
+		l.LeaderLF, l.NodeLF = topicStat.GetNodeLoadFactor()
+		loads[nid] = l
+	}
+	newISRs := make(map[string][]string, len(plan.Partitions))
+	for _, rp := range plan.Partitions {
+		newISRs[rp.Topic+"-"+strconv.Itoa(rp.Partition)] = rp.ISR
+	}
+	for i := range topics {
+		topicInfo := &topics[i]
+		if l, ok := loads[topicInfo.Leader]; ok {
+			l.Leaders++
+		}
+		for _, nid := range topicInfo.ISR {
+			if l, ok := loads[nid]; ok {
+				l.Replicas++
+			}
+		}
+		newISR, ok := newISRs[topicInfo.GetTopicDesp()]
+		if !ok {
+			newISR = topicInfo.ISR
+			if l, ok := loads[topicInfo.Leader]; ok {
+				l.NewLeaders++
+			}
+		} else {
+			moveReassignTopicStats(nodeStats, topicInfo, newISR)
+			if l, ok := loads[newISR[0]]; ok {
+				l.NewLeaders++
+			}
+		}
+		for _, nid := range newISR {
+			if l, ok := loads[nid]; ok {
+				l.NewReplicas++
+			}
+		}
+	}
+	nodeLoads := make([]ReassignNodeLoad, 0, len(loads))
+	for nid, l := range loads {
+		l.NewLeaderLF, l.NewNodeLF = nodeStats[nid].GetNodeLoadFactor()
+		nodeLoads = append(nodeLoads, *l)
+	}
+	sort.Slice(nodeLoads, func(i, j int) bool {
+		return nodeLoads[i].NodeID < nodeLoads[j].NodeID
+	})
+	return nodeLoads
+}
+
+func (nlcoord *NsqLookupCoordinator) checkReassignPlanLoop(monitorChan chan struct{}) {
+	ticker := time.NewTicker(checkReassignInterval)
+	defer func() {
+		ticker.Stop()
+		coordLog.Infof("check reassignment plan quit.")
+	}()
+
+	for {
+		select {
+		case <-monitorChan:
+			return
+		case <-ticker.C:
+			if nlcoord.leadership == nil {
+				continue
+			}
+			if !nlcoord.IsClusterStable() || atomic.LoadInt32(&nlcoord.isUpgrading) == 1 {
+				continue
+			}
+			nlcoord.runReassignPlan(monitorChan)
+		}
+	}
+}
+
+// run the partitions not finished in the reassignment plan until all finished or the plan is
+// paused or cancelled. The moving partitions will be moved again after the lookup leader changed.
+func (nlcoord *NsqLookupCoordinator) runReassignPlan(monitorChan chan struct{}) {
+	plan, err := nlcoord.leadership.GetReassignPlan()
+	if err != nil {
+		if err != ErrKeyNotFound {
+			coordLog.Infof("get reassignment plan failed: %v", err)
+		}
+		return
+	}
+	if plan.State != ReassignStateRunning {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&nlcoord.balanceWaiting, 0, 1) {
+		coordLog.Infof("another balance is running, reassignment should wait")
+		return
+	}
+	defer atomic.StoreInt32(&nlcoord.balanceWaiting, 0)
+
+	// the topics not finished in the plan order
+	topicOrder := make([]string, 0)
+	topicParts := make(map[string][]int)
+	for i := range plan.Partitions {
+		rp := &plan.Partitions[i]
+		if rp.isFinished() {
+			continue
+		}
+		if _, ok := topicParts[rp.Topic]; !ok {
+			topicOrder = append(topicOrder, rp.Topic)
+		}
+		topicParts[rp.Topic] = append(topicParts[rp.Topic], i)
+	}
+	if len(topicOrder) == 0 {
+		nlcoord.finishReassignPlan(plan.ID)
+		return
+	}
+	coordLog.Infof("reassignment plan %v running, topics to move: %v", plan.ID, topicOrder)
+
+	cancelChan := make(chan struct{})
+	nlcoord.reassignMutex.Lock()
+	nlcoord.reassignCancelChan = cancelChan
+	nlcoord.reassignMutex.Unlock()
+	stopChan := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-monitorChan:
+		case <-cancelChan:
+		case <-done:
+		}
+		close(stopChan)
+	}()
+	defer func() {
+		close(done)
+		nlcoord.reassignMutex.Lock()
+		if nlcoord.reassignCancelChan == cancelChan {
+			nlcoord.reassignCancelChan = nil
+		}
+		nlcoord.reassignMutex.Unlock()
+	}()
+
+	jobs := make(chan []int, len(topicOrder))
+	for _, topic := range topicOrder {
+		jobs <- topicParts[topic]
+	}
+	close(jobs)
+	var wg sync.WaitGroup
+	for w := 0; w < plan.Concurrency && w < len(topicOrder); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for parts := range jobs {
+				for _, idx := range parts {
+					if !nlcoord.isReassignPlanRunning(plan.ID, stopChan) {
+						return
+					}
+					nlcoord.doReassignPartition(monitorChan, stopChan, plan.ID, idx, plan.Partitions[idx])
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	select {
+	case <-monitorChan:
+		return
+	default:
+	}
+	nlcoord.finishReassignPlan(plan.ID)
+}
+
+func (nlcoord *NsqLookupCoordinator) isReassignPlanRunning(id string, stopChan chan struct{}) bool {
+	select {
+	case <-stopChan:
+		return false
+	default:
+	}
+	if !nlcoord.IsMineLeader() {
+		return false
+	}
+	plan, err := nlcoord.leadership.GetReassignPlan()
+	if err != nil {
+		coordLog.Infof("get reassignment plan failed: %v", err)
+		return false
+	}
+	return plan.ID == id && plan.State == ReassignStateRunning
+}
+
+func (nlcoord *NsqLookupCoordinator) doReassignPartition(monitorChan chan struct{}, stopChan chan struct{},
+	id string, idx int, rp ReassignPartition) {
+	err := nlcoord.updateReassignPartition(id, idx, ReassignPartMoving, "")
+	if err != nil {
+		coordLog.Infof("update reassignment plan %v failed: %v", id, err)
+		return
+	}
+	coordLog.Infof("reassign topic %v-%v from %v to %v", rp.Topic, rp.Partition, rp.OldISR, rp.ISR)
+	err = nlcoord.moveTopicPartitionToISR(stopChan, rp.Topic, rp.Partition, rp.ISR)
+	state := ReassignPartDone
+	errMsg := ""
+	if err != nil {
+		select {
+		case <-monitorChan:
+			// keep moving and the new leader will move it again
+			coordLog.Infof("reassign topic %v-%v stopped: %v", rp.Topic, rp.Partition, err)
+			return
+		case <-stopChan:
+			err = errors.New("the reassignment plan is cancelled")
+		default:
+		}
+		coordLog.Infof("reassign topic %v-%v failed: %v", rp.Topic, rp.Partition, err)
+		state = ReassignPartFailed
+		errMsg = err.Error()
+	}
+	err = nlcoord.updateReassignPartition(id, idx, state, errMsg)
+	if err != nil {
+		coordLog.Infof("update reassignment plan %v failed: %v", id, err)
+	}
+}
+
+func (nlcoord *NsqLookupCoordinator) updateReassignPartition(id string, idx int, state string, errMsg string) error {
+	nlcoord.reassignMutex.Lock()
+	defer nlcoord.reassignMutex.Unlock()
+	plan, err := nlcoord.leadership.GetReassignPlan()
+	if err != nil {
+		return err
+	}
+	if plan.ID != id || idx >= len(plan.Partitions) {
+		return errReassignPlanChanged
+	}
+	plan.Partitions[idx].State = state
+	plan.Partitions[idx].Error = errMsg
+	plan.UpdateTime = time.Now().Unix()
+	return nlcoord.leadership.UpdateReassignPlan(plan, plan.Epoch)
+}
+
+// mark the plan done if all the partitions are finished
+func (nlcoord *NsqLookupCoordinator) finishReassignPlan(id string) {
+	nlcoord.reassignMutex.Lock()
+	defer nlcoord.reassignMutex.Unlock()
+	plan, err := nlcoord.leadership.GetReassignPlan()
+	if err != nil {
+		coordLog.Infof("get reassignment plan failed: %v", err)
+		return
+	}
+	if plan.ID != id || plan.State != ReassignStateRunning {
+		return
+	}
+	for i := range plan.Partitions {
+		if !plan.Partitions[i].isFinished() {
+			return
+		}
+	}
+	plan.State = ReassignStateDone
+	plan.UpdateTime = time.Now().Unix()
+	err = nlcoord.leadership.UpdateReassignPlan(plan, plan.Epoch)
+	if err != nil {
+		coordLog.Infof("save reassignment plan failed: %v", err)
+		return
+	}
+	coordLog.Infof("reassignment plan %v done", id)
+}
+
+func isCoordTmpErr(err error) bool {
+	coordErr, ok := err.(*CommonCoordErr)
+	return ok && coordErr.ErrType == CoordElectionTmpErr
+}
+
+// move the replicas of the topic partition one by one to the new isr, and move the leader
+// to the first node of the new isr at last.
+func (nlcoord *NsqLookupCoordinator) moveTopicPartitionToISR(stopChan chan struct{}, topic string, partition int, newISR []string) error {
+	steps := 0
+	retryStart := time.Now()
+	// each step will add or remove one replica
+	for steps <= len(newISR)*2 {
+		done, err := nlcoord.moveTopicPartitionOneStep(stopChan, topic, partition, newISR)
+		if err != nil {
+			// the isr may be changing, wait and retry
+			if !isCoordTmpErr(err) || time.Since(retryStart) > moveWaitTimeout {
+				return err
+			}
+			coordLog.Infof("reassign topic %v-%v need wait: %v", topic, partition, err)
+			select {
+			case <-stopChan:
+				return errLookupExiting
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+		if done {
+			return nil
+		}
+		steps++
+		retryStart = time.Now()
+	}
+	return errors.New("the isr of the topic partition is not changed as planned")
+}
+
+func (nlcoord *NsqLookupCoordinator) moveTopicPartitionOneStep(stopChan chan struct{}, topic string, partition int, newISR []string) (bool, error) {
+	topicInfo, err := nlcoord.leadership.GetTopicInfo(topic, partition)
+	if err != nil {
+		return false, err
+	}
+	if len(newISR) != topicInfo.Replica {
+		return false, errors.New("the replica of the topic changed")
+	}
+	adds := make([]string, 0)
+	removes := make([]string, 0)
+	for _, nid := range newISR {
+		if FindSlice(topicInfo.ISR, nid) == -1 {
+			adds = append(adds, nid)
+		}
+	}
+	for _, nid := range topicInfo.ISR {
+		if FindSlice(newISR, nid) == -1 {
+			removes = append(removes, nid)
+		}
+	}
+	if len(adds) == 0 && len(removes) == 0 {
+		return true, nlcoord.moveTopicLeaderTo(topicInfo, newISR[0])
+	}
+	if len(removes) == 0 {
+		return false, errors.New("the isr of the topic partition is less than the replica")
+	}
+	// move the non-leader replica first to avoid moving the leader more than once
+	from := removes[0]
+	for _, nid := range removes {
+		if nid != topicInfo.Leader {
+			from = nid
+			break
+		}
+	}
+	if len(adds) == 0 {
+		// the new replica is ready but the old one is not removed yet
+		coordErr := nlcoord.handleRemoveTopicNodeOrMoveLeader(from == topicInfo.Leader, topic, partition, from)
+		if coordErr != nil {
+			return false, coordErr.ToErrorType()
+		}
+		return false, nil
+	}
+	err = nlcoord.dpm.tryMoveTopicPartition(stopChan, false, topic, partition, from == topicInfo.Leader, from, adds[0])
+	return false, err
+}
+
+func (nlcoord *NsqLookupCoordinator) moveTopicLeaderTo(topicInfo *TopicPartitionMetaInfo, leader string) error {
+	coordErr := nlcoord.setTopicPreferredLeader(topicInfo, leader)
+	if coordErr != nil {
+		return coordErr.ToErrorType()
+	}
+	if topicInfo.Leader == leader {
+		return nil
+	}
+	coordErr = nlcoord.moveLeaderToPreferred(topicInfo.Name, topicInfo.Partition)
+	if coordErr != nil {
+		return coordErr.ToErrorType()
+	}
+	newInfo, err := nlcoord.leadership.GetTopicInfo(topicInfo.Name, topicInfo.Partition)
+	if err != nil {
+		return err
+	}
+	if newInfo.Leader != leader {
+		return ErrLeaderElectionFail.ToErrorType()
+	}
+	return nil
+}
@@ -49,6 +49,18 @@ type RpcReqLeaveFromISRByLeader struct {
 	LeaderSession TopicLeaderSession
 }
 
+type RpcReqConsumerGroupOwner struct {
+	RpcLookupReqBase
+	Channel string
+}
+
+type RpcRspConsumerGroupOwner struct {
+	CoordErr
+	GroupExist bool
+	Owner      string
+	Generation int64
+}
+
 type NsqLookupCoordRpcServer struct {
 	nsqLookupCoord *NsqLookupCoordinator
 	rpcDispatcher  *gorpc.Dispatcher
@@ -186,3 +198,23 @@ func (nlcoord *NsqLookupCoordRpcServer) RequestCheckTopicConsistence(req *RpcReq
 	nlcoord.nsqLookupCoord.handleRequestCheckTopicConsistence(req.TopicName, req.TopicPartition)
 	return &coordErr
 }
+
+func (nlcoord *NsqLookupCoordRpcServer) GetConsumerGroupOwner(req *RpcReqConsumerGroupOwner) *RpcRspConsumerGroupOwner {
+	var ret RpcRspConsumerGroupOwner
+	if !nlcoord.nsqLookupCoord.IsMineLeader() {
+		ret.CoordErr = *NewCoordErr(ErrNotNsqLookupLeader.Error(), CoordNetErr)
+		return &ret
+	}
+	owner, gen, err := nlcoord.nsqLookupCoord.groupMgr.getPartitionOwner(req.TopicName, req.Channel, req.TopicPartition)
+	if err == ErrConsumerGroupNotFound {
+		return &ret
+	}
+	if err != nil {
+		ret.CoordErr = *NewCoordErr(err.Error(), CoordCommonErr)
+		return &ret
+	}
+	ret.GroupExist = true
+	ret.Owner = owner
+	ret.Generation = gen
+	return &ret
+}
@@ -0,0 +1,261 @@
+package consistence
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/youzan/nsq/internal/protocol"
+)
+
+var ErrShrinkOrderedTopicStopWrite = errors.New("shrinking the ordered topic stops the producer writes to all the partitions until all consumed, confirm it with stop_ordered_write")
+
+// ShrinkTopicPartition will start shrinking the topic to the new partition number.
+// The producer writes to the trailing partitions will be disabled (all the partitions for the
+// ordered topic), and the trailing partitions will be removed after all the channels consumed them.
+// The shrink is done in background and can be canceled before the partitions removed.
+// Since the ordered topic is not writable while shrinking, stopOrderedWrite should be true to
+// shrink the ordered topic.
+func (nlcoord *NsqLookupCoordinator) ShrinkTopicPartition(topic string, newPartitionNum int, stopOrderedWrite bool) error {
+	if nlcoord.leaderNode.GetID() != nlcoord.myNode.GetID() {
+		coordLog.Infof("not leader while shrink topic")
+		return ErrNotNsqLookupLeader
+	}
+
+	if !protocol.IsValidTopicName(topic) {
+		return errors.New("invalid topic name")
+	}
+	if newPartitionNum <= 0 {
+		return errors.New("the partition number should be positive")
+	}
+
+	coordLog.Infof("shrink topic %v partition number to %v", topic, newPartitionNum)
+	if !nlcoord.IsClusterStable() {
+		return ErrClusterUnstable
+	}
+	nlcoord.joinStateMutex.Lock()
+	state, ok := nlcoord.joinISRState[topic]
+	if !ok {
+		state = &JoinISRState{}
+		nlcoord.joinISRState[topic] = state
+	}
+	nlcoord.joinStateMutex.Unlock()
+	state.Lock()
+	defer state.Unlock()
+	if state.waitingJoin {
+		coordLog.Warningf("topic state is not ready:%v, %v ", topic, state)
+		return ErrWaitingJoinISR.ToErrorType()
+	}
+	if ok, _ := nlcoord.leadership.IsExistTopic(topic); !ok {
+		coordLog.Infof("topic not exist %v", topic)
+		return ErrTopicNotCreated
+	}
+	meta, oldGen, err := nlcoord.leadership.GetTopicMetaInfo(topic)
+	if err != nil {
+		coordLog.Infof("get topic key %v failed :%v", topic, err)
+		return err
+	}
+	if newPartitionNum >= meta.PartitionNum {
+		return errors.New("the partition number should be less than current")
+	}
+	if meta.ShrinkTo == newPartitionNum {
+		return nil
+	}
+	if meta.ShrinkTo > 0 {
+		return errors.New("the topic is already shrinking")
+	}
+	if meta.OrderedMulti && !stopOrderedWrite {
+		coordLog.Infof("shrink ordered topic %v without confirming the write stop", topic)
+		return ErrShrinkOrderedTopicStopWrite
+	}
+	meta.ShrinkTo = newPartitionNum
+	err = nlcoord.updateTopicMeta(nlcoord.getCurrentNodes(), topic, meta, oldGen)
+	if err != nil {
+		coordLog.Infof("update topic %v meta failed :%v", topic, err)
+		return err
+	}
+	nlcoord.notifyTopicPartitionsMeta(topic, meta.PartitionNum)
+	return nil
+}
+
+// CancelTopicShrink will stop the shrinking and enable the writes for all partitions.
+func (nlcoord *NsqLookupCoordinator) CancelTopicShrink(topic string) error {
+	if nlcoord.leaderNode.GetID() != nlcoord.myNode.GetID() {
+		coordLog.Infof("not leader while cancel shrink topic")
+		return ErrNotNsqLookupLeader
+	}
+	if !protocol.IsValidTopicName(topic) {
+		return errors.New("invalid topic name")
+	}
+	// the shrink may be finishing in the check loop
+	begin := time.Now()
+	for !atomic.CompareAndSwapInt32(&nlcoord.doChecking, 0, 1) {
+		coordLog.Infof("cancel shrink topic %v waiting check topic finish", topic)
+		time.Sleep(time.Millisecond * 200)
+		if time.Since(begin) > time.Second*5 {
+			return ErrClusterUnstable
+		}
+	}
+	defer atomic.StoreInt32(&nlcoord.doChecking, 0)
+	meta, oldGen, err := nlcoord.leadership.GetTopicMetaInfo(topic)
+	if err != nil {
+		coordLog.Infof("get topic key %v failed :%v", topic, err)
+		return err
+	}
+	if meta.ShrinkTo <= 0 {
+		return nil
+	}
+	coordLog.Infof("cancel shrink topic %v to %v", topic, meta.ShrinkTo)
+	meta.ShrinkTo = 0
+	err = nlcoord.leadership.UpdateTopicMetaInfo(topic, &meta, oldGen)
+	if err != nil {
+		coordLog.Infof("update topic %v meta failed :%v", topic, err)
+		return err
+	}
+	nlcoord.notifyTopicPartitionsMeta(topic, meta.PartitionNum)
+	return nil
+}
+
+// GetTopicShrinkPending return the topic meta and the messages count not consumed
+// on each shrinking partition. The shrink will be done if all the pending are 0.
+func (nlcoord *NsqLookupCoordinator) GetTopicShrinkPending(topic string) (TopicMetaInfo, map[int]int64, error) {
+	meta, _, err := nlcoord.leadership.GetTopicMetaInfo(topic)
+	if err != nil {
+		return meta, nil, err
+	}
+	pendings := make(map[int]int64)
+	if meta.ShrinkTo <= 0 {
+		return meta, pendings, nil
+	}
+	for pid := 0; pid < meta.PartitionNum; pid++ {
+		if !meta.IsPartitionShrinking(pid) {
+			continue
+		}
+		topicInfo, err := nlcoord.leadership.GetTopicInfo(topic, pid)
+		if err != nil {
+			return meta, pendings, err
+		}
+		if topicInfo.Leader == "" {
+			return meta, pendings, ErrLeaderNodeLost.ToErrorType()
+		}
+		c, rpcErr := nlcoord.acquireRpcClient(topicInfo.Leader)
+		if rpcErr != nil {
+			return meta, pendings, rpcErr.ToErrorType()
+		}
+		stat, err := c.GetTopicStats(topic)
+		if err != nil {
+			return meta, pendings, err
+		}
+		pending, ok := stat.PendingMsgCnt[topicInfo.GetTopicDesp()]
+		if !ok {
+			return meta, pendings, errors.New("missing stats for topic partition " + topicInfo.GetTopicDesp())
+		}
+		pendings[pid] = pending
+	}
+	return meta, pendings, nil
+}
+
+// notify the new meta to all the partitions so the write state can be changed on nsqd
+func (nlcoord *NsqLookupCoordinator) notifyTopicPartitionsMeta(topic string, partitionNum int) {
+	for i := 0; i < partitionNum; i++ {
+		topicInfo, err := nlcoord.leadership.GetTopicInfo(topic, i)
+		if err != nil {
+			coordLog.Infof("failed get info for topic : %v-%v, %v", topic, i, err)
+			continue
+		}
+		topicReplicaInfo := &topicInfo.TopicPartitionReplicaInfo
+		err = nlcoord.leadership.UpdateTopicNodeInfo(topic, i, topicReplicaInfo, topicReplicaInfo.Epoch)
+		if err != nil {
+			coordLog.Infof("failed update info for topic : %v-%v, %v", topic, i, err)
+			continue
+		}
+		rpcErr := nlcoord.notifyTopicMetaInfo(topicInfo)
+		if rpcErr != nil {
+			coordLog.Warningf("failed notify topic info : %v", rpcErr)
+		}
+	}
+}
+
+func (nlcoord *NsqLookupCoordinator) checkShrinkingTopics(monitorChan chan struct{}) {
+	ticker := time.NewTicker(checkShrinkInterval)
+	defer func() {
+		ticker.Stop()
+		coordLog.Infof("check shrinking topics quit.")
+	}()
+
+	for {
+		select {
+		case <-monitorChan:
+			return
+		case <-ticker.C:
+			if nlcoord.leadership == nil {
+				continue
+			}
+			topicMetas, err := nlcoord.leadership.GetAllTopicMetas()
+			if err != nil {
+				continue
+			}
+			for name, meta := range topicMetas {
+				if meta.ShrinkTo <= 0 {
+					continue
+				}
+				select {
+				case <-monitorChan:
+					return
+				default:
+				}
+				err := nlcoord.tryFinishTopicShrink(name)
+				if err != nil {
+					coordLog.Infof("topic %v shrink not done: %v", name, err)
+				}
+			}
+		}
+	}
+}
+
+func (nlcoord *NsqLookupCoordinator) tryFinishTopicShrink(topic string) error {
+	meta, pendings, err := nlcoord.GetTopicShrinkPending(topic)
+	if err != nil {
+		return err
+	}
+	if meta.ShrinkTo <= 0 {
+		return nil
+	}
+	for pid, pending := range pendings {
+		if pending > 0 {
+			coordLog.Debugf("topic %v-%v still has %v messages pending", topic, pid, pending)
+			return nil
+		}
+	}
+	if !atomic.CompareAndSwapInt32(&nlcoord.doChecking, 0, 1) {
+		return ErrClusterUnstable
+	}
+	defer atomic.StoreInt32(&nlcoord.doChecking, 0)
+	// check again since the shrink may be canceled
+	meta, oldGen, err := nlcoord.leadership.GetTopicMetaInfo(topic)
+	if err != nil {
+		return err
+	}
+	if meta.ShrinkTo <= 0 {
+		return nil
+	}
+	oldPartitionNum := meta.PartitionNum
+	coordLog.Infof("topic %v drained, shrink partition from %v to %v", topic, oldPartitionNum, meta.ShrinkTo)
+	// update the partition number before delete, so the check topics will not
+	// create the removed partitions again
+	meta.PartitionNum = meta.ShrinkTo
+	meta.ShrinkTo = 0
+	err = nlcoord.leadership.UpdateTopicMetaInfo(topic, &meta, oldGen)
+	if err != nil {
+		coordLog.Infof("update topic %v meta failed :%v", topic, err)
+		return err
+	}
+	for pid := meta.PartitionNum; pid < oldPartitionNum; pid++ {
+		err := nlcoord.deleteTopicPartition(topic, pid)
+		if err != nil {
+			coordLog.Infof("failed to delete topic partition %v for topic: %v, err:%v", pid, topic, err)
+		}
+	}
+	nlcoord.notifyTopicPartitionsMeta(topic, meta.PartitionNum)
+	return nil
+}
@@ -42,6 +42,7 @@ var (
 	waitRemovingNodeInterval     = time.Second * 30
 	balanceInterval              = time.Second * 60
 	doCheckInterval              = time.Second * 60
+	checkShrinkInterval          = time.Second * 30
 )
 
 type JoinISRState struct {
@@ -81,6 +82,8 @@ type TopicNameInfo struct {
 type Options struct {
 	BalanceStart int
 	BalanceEnd   int
+	// move the leaders back to the preferred leader in background
+	PreferredLeaderRestore bool
 }
 
 // nsqlookup coordinator is used for the topic leader and isr coordinator, all the changes for leader or isr
@@ -112,6 +115,13 @@ type NsqLookupCoordinator struct {
 	balanceWaiting     int32
 	doChecking         int32
 	enableTopNBalance  int32
+	groupMgr           *consumerGroupMgr
+	// enable the background restore for the preferred leaders
+	enablePreferredLeader int32
+	// protect the read-modify-write of the reassignment plan
+	reassignMutex sync.Mutex
+	// closed while the running reassignment plan is cancelled
+	reassignCancelChan chan struct{}
 }
 
 func NewNsqLookupCoordinator(cluster string, n *NsqLookupdNodeInfo, opts *Options) *NsqLookupCoordinator {
@@ -127,6 +137,7 @@ func NewNsqLookupCoordinator(cluster string, n *NsqLookupdNodeInfo, opts *Option
 		joinISRState:       make(map[string]*JoinISRState),
 		failedRpcList:      make([]RpcFailedInfo, 0),
 		nsqdMonitorChan:    make(chan struct{}),
+		groupMgr:           newConsumerGroupMgr(defaultGroupSessionTimeout, nil),
 	}
 	if coord.leadership != nil {
 		coord.leadership.InitClusterID(coord.clusterKey)
@@ -135,6 +146,9 @@ func NewNsqLookupCoordinator(cluster string, n *NsqLookupdNodeInfo, opts *Option
 	coord.dpm = NewDataPlacement(coord)
 	if opts != nil {
 		coord.dpm.SetBalanceInterval(opts.BalanceStart, opts.BalanceEnd)
+		if opts.PreferredLeaderRestore {
+			coord.enablePreferredLeader = 1
+		}
 	}
 	return coord
 }
@@ -144,6 +158,7 @@ func (nlcoord *NsqLookupCoordinator) SetLeadershipMgr(l NSQLookupdLeadership) {
 	if nlcoord.leadership != nil {
 		nlcoord.leadership.InitClusterID(nlcoord.clusterKey)
 	}
+	nlcoord.groupMgr.setStore(l)
 }
 
 func RetryWithTimeout(fn func() error) error {
@@ -270,9 +285,12 @@ func (nlcoord *NsqLookupCoordinator) notifyLeaderChanged(monitorChan chan struct
 			delete(nlcoord.nsqdRpcClients, nid)
 		}
 		nlcoord.rpcMutex.Unlock()
+		nlcoord.groupMgr.reset()
 		return
 	}
 	coordLog.Infof("I am master now.")
+	// reload the consumer groups saved by the old leader
+	nlcoord.groupMgr.reset()
 
 	// we do not need to watch each topic leader,
 	// we can make sure the leader on the alive node is alive.
@@ -324,6 +342,21 @@ func (nlcoord *NsqLookupCoordinator) notifyLeaderChanged(monitorChan chan struct
 		defer nlcoord.wg.Done()
 		nlcoord.handleRemovingNodesLoop(monitorChan)
 	}()
+	nlcoord.wg.Add(1)
+	go func() {
+		defer nlcoord.wg.Done()
+		nlcoord.checkShrinkingTopics(monitorChan)
+	}()
+	nlcoord.wg.Add(1)
+	go func() {
+		defer nlcoord.wg.Done()
+		nlcoord.checkPreferredLeaders(monitorChan)
+	}()
+	nlcoord.wg.Add(1)
+	go func() {
+		defer nlcoord.wg.Done()
+		nlcoord.checkReassignPlanLoop(monitorChan)
+	}()
 }
 
 // for the nsqd node that temporally lost, we need send the related topics to
@@ -1909,6 +1942,8 @@ func (nlcoord *NsqLookupCoordinator) handleRemoveTopicNodeOrMoveLeader(isLeader
 		if coordErr != nil {
 			return coordErr
 		}
+		// the leader is moved by plan, the new leader should be preferred from now on.
+		nlcoord.updateTopicPreferredLeader(topicInfo)
 		if len(topicInfo.ISR) <= topicInfo.Replica && FindSlice(topicInfo.ISR, nodeID) != -1 {
 			return nil
 		}
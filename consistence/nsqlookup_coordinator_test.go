@@ -2,6 +2,7 @@ package consistence
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"math"
@@ -19,6 +20,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/youzan/nsq/internal/levellogger"
 	"github.com/youzan/nsq/internal/test"
+	"github.com/youzan/nsq/nsqd"
 )
 
 const (
@@ -35,6 +37,10 @@ func ChangeIntervalForTest() {
 	waitRemovingNodeInterval = time.Second * 3
 	balanceInterval = time.Second * 6
 	doCheckInterval = time.Second * 6
+	checkShrinkInterval = time.Second * 3
+	checkPreferredLeaderInterval = time.Second * 3
+	preferredLeaderMoveWait = time.Second
+	checkReassignInterval = time.Second * 2
 }
 func TestMain(m *testing.M) {
 	ChangeIntervalForTest()
@@ -60,6 +66,9 @@ type FakeNsqlookupLeadership struct {
 	leaderSessionChanged chan *TopicLeaderSession
 	clusterEpoch         EpochType
 	exitChan             chan struct{}
+	reassignPlan         []byte
+	reassignPlanEpoch    EpochType
+	consumerGroups       map[string][]byte
 }
 
 func NewFakeNsqlookupLeadership() *FakeNsqlookupLeadership {
@@ -71,6 +80,7 @@ func NewFakeNsqlookupLeadership() *FakeNsqlookupLeadership {
 		leaderChanged:        make(chan struct{}, 1),
 		leaderSessionChanged: make(chan *TopicLeaderSession, 1),
 		exitChan:             make(chan struct{}),
+		consumerGroups:       make(map[string][]byte),
 	}
 }
 
@@ -92,6 +102,73 @@ func (self *FakeNsqlookupLeadership) GetTopicsMetaInfoMap(topics []string) (map[
 	return metas, nil
 }
 
+func (self *FakeNsqlookupLeadership) GetReassignPlan() (*ReassignPlan, error) {
+	self.dataMutex.Lock()
+	defer self.dataMutex.Unlock()
+	if self.reassignPlan == nil {
+		return nil, ErrKeyNotFound
+	}
+	var plan ReassignPlan
+	err := json.Unmarshal(self.reassignPlan, &plan)
+	if err != nil {
+		return nil, err
+	}
+	plan.Epoch = self.reassignPlanEpoch
+	return &plan, nil
+}
+
+func (self *FakeNsqlookupLeadership) GetAllConsumerGroups() ([]ConsumerGroupInfo, error) {
+	self.dataMutex.Lock()
+	defer self.dataMutex.Unlock()
+	groups := make([]ConsumerGroupInfo, 0, len(self.consumerGroups))
+	for _, v := range self.consumerGroups {
+		var group ConsumerGroupInfo
+		err := json.Unmarshal(v, &group)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
+func (self *FakeNsqlookupLeadership) UpdateConsumerGroup(group *ConsumerGroupInfo) error {
+	value, err := json.Marshal(group)
+	if err != nil {
+		return err
+	}
+	self.dataMutex.Lock()
+	self.consumerGroups[getGroupKey(group.Topic, group.Channel)] = value
+	self.dataMutex.Unlock()
+	return nil
+}
+
+func (self *FakeNsqlookupLeadership) DeleteConsumerGroup(topic string, channel string) error {
+	self.dataMutex.Lock()
+	delete(self.consumerGroups, getGroupKey(topic, channel))
+	self.dataMutex.Unlock()
+	return nil
+}
+
+func (self *FakeNsqlookupLeadership) UpdateReassignPlan(plan *ReassignPlan, oldGen EpochType) error {
+	self.dataMutex.Lock()
+	defer self.dataMutex.Unlock()
+	if oldGen == 0 && self.reassignPlan != nil {
+		return ErrKeyAlreadyExist
+	}
+	if oldGen != self.reassignPlanEpoch {
+		return ErrEpochMismatch.ToErrorType()
+	}
+	value, err := json.Marshal(plan)
+	if err != nil {
+		return err
+	}
+	self.reassignPlan = value
+	self.reassignPlanEpoch++
+	plan.Epoch = self.reassignPlanEpoch
+	return nil
+}
+
 func (self *FakeNsqlookupLeadership) GetClusterEpoch() (EpochType, error) {
 	return self.clusterEpoch, nil
 }
@@ -694,7 +771,7 @@ func testNsqLookupNsqdNodesChange(t *testing.T, useFakeLeadership bool) {
 	}()
 
 	// test new topic create
-	err := lookupCoord1.CreateTopic(topic, TopicMetaInfo{2, 2, 0, 0, 0, 0, false, false, false})
+	err := lookupCoord1.CreateTopic(topic, TopicMetaInfo{PartitionNum: 2, Replica: 2})
 	test.Nil(t, err)
 
 	waitClusterStable(lookupCoord1, time.Second*3)
@@ -879,7 +956,7 @@ func testNsqLookupNsqdNodesChange(t *testing.T, useFakeLeadership bool) {
 	waitClusterStable(lookupCoord1, time.Second*5)
 	// test new topic create
 	coordLog.Warningf("============= begin test 3 replicas ====")
-	err = lookupCoord1.CreateTopic(topic3, TopicMetaInfo{1, 3, 0, 0, 0, 0, false, false, false})
+	err = lookupCoord1.CreateTopic(topic3, TopicMetaInfo{PartitionNum: 1, Replica: 3})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord1, time.Second*5)
 	// with 3 replica, the isr join timeout will change the isr list if the isr has the quorum nodes
@@ -1010,7 +1087,7 @@ func TestNsqLookupNsqdCreateTopic(t *testing.T) {
 	}()
 
 	// test new topic create
-	err := lookupCoord1.CreateTopic(topic_p1_r1, TopicMetaInfo{1, 1, 0, 0, 0, 0, false, false, false})
+	err := lookupCoord1.CreateTopic(topic_p1_r1, TopicMetaInfo{PartitionNum: 1, Replica: 1})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord1, time.Second*3)
 	pmeta, _, err := lookupLeadership.GetTopicMetaInfo(topic_p1_r1)
@@ -1032,7 +1109,7 @@ func TestNsqLookupNsqdCreateTopic(t *testing.T) {
 	test.Equal(t, tc0.topicInfo.Leader, t0.Leader)
 	test.Equal(t, len(tc0.topicInfo.ISR), 1)
 
-	err = lookupCoord1.CreateTopic(topic_p1_r3, TopicMetaInfo{1, 3, 0, 0, 0, 0, false, false, false})
+	err = lookupCoord1.CreateTopic(topic_p1_r3, TopicMetaInfo{PartitionNum: 1, Replica: 3})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord1, time.Second*5)
 	lookupCoord1.triggerCheckTopics("", 0, 0)
@@ -1057,7 +1134,7 @@ func TestNsqLookupNsqdCreateTopic(t *testing.T) {
 	test.Equal(t, tc0.topicInfo.Leader, t0.Leader)
 	test.Equal(t, len(tc0.topicInfo.ISR), 3)
 
-	err = lookupCoord1.CreateTopic(topic_p3_r1, TopicMetaInfo{3, 1, 0, 0, 0, 0, false, false, false})
+	err = lookupCoord1.CreateTopic(topic_p3_r1, TopicMetaInfo{PartitionNum: 3, Replica: 1})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord1, time.Second*2)
 	waitClusterStable(lookupCoord1, time.Second*5)
@@ -1089,7 +1166,7 @@ func TestNsqLookupNsqdCreateTopic(t *testing.T) {
 	test.Equal(t, tc1.topicInfo.Leader, t1.Leader)
 	test.Equal(t, len(tc1.topicInfo.ISR), 1)
 
-	err = lookupCoord1.CreateTopic(topic_p2_r2, TopicMetaInfo{2, 2, 0, 0, 0, 0, false, false, false})
+	err = lookupCoord1.CreateTopic(topic_p2_r2, TopicMetaInfo{PartitionNum: 2, Replica: 2})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord1, time.Second*3)
 	waitClusterStable(lookupCoord1, time.Second*5)
@@ -1124,7 +1201,7 @@ func TestNsqLookupNsqdCreateTopic(t *testing.T) {
 	// test create on exist topic, create on partial partition
 	oldMeta, _, err := lookupCoord1.leadership.GetTopicMetaInfo(topic_p2_r2)
 	test.Nil(t, err)
-	err = lookupCoord1.CreateTopic(topic_p2_r2, TopicMetaInfo{2, 2, 0, 0, 1, 1, false, false, false})
+	err = lookupCoord1.CreateTopic(topic_p2_r2, TopicMetaInfo{PartitionNum: 2, Replica: 2, MagicCode: 1, RetentionDay: 1})
 	test.NotNil(t, err)
 	waitClusterStable(lookupCoord1, time.Second)
 	waitClusterStable(lookupCoord1, time.Second*5)
@@ -1170,7 +1247,7 @@ func TestNsqLookupNsqdCreateTopicFailPartition(t *testing.T) {
 		lookupCoord1.Stop()
 	}()
 
-	err := lookupLeadership.CreateTopic(topic_p3_r1, &TopicMetaInfo{3, 1, 0, 0, 0, 0, false, false, false})
+	err := lookupLeadership.CreateTopic(topic_p3_r1, &TopicMetaInfo{PartitionNum: 3, Replica: 1})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord1, time.Second*2)
 	waitClusterStable(lookupCoord1, time.Second*5)
@@ -1202,7 +1279,7 @@ func TestNsqLookupNsqdCreateTopicFailPartition(t *testing.T) {
 	test.Equal(t, tc1.topicInfo.Leader, t1.Leader)
 	test.Equal(t, len(tc1.topicInfo.ISR), 1)
 
-	err = lookupLeadership.CreateTopic(topic_p2_r2, &TopicMetaInfo{2, 2, 0, 0, 0, 0, false, false, false})
+	err = lookupLeadership.CreateTopic(topic_p2_r2, &TopicMetaInfo{PartitionNum: 2, Replica: 2})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord1, time.Second*3)
 	waitClusterStable(lookupCoord1, time.Second*5)
@@ -1267,16 +1344,16 @@ func TestNsqLookupUpdateTopicMeta(t *testing.T) {
 		lookupCoord.Stop()
 	}()
 
-	err := lookupCoord.CreateTopic(topic_p1_r1, TopicMetaInfo{1, 1, 0, 0, 0, 0, false, false, false})
+	err := lookupCoord.CreateTopic(topic_p1_r1, TopicMetaInfo{PartitionNum: 1, Replica: 1})
 	test.Nil(t, err)
 	time.Sleep(time.Second)
 
-	err = lookupCoord.CreateTopic(topic_p2_r1, TopicMetaInfo{2, 1, 0, 0, 0, 0, false, false, false})
+	err = lookupCoord.CreateTopic(topic_p2_r1, TopicMetaInfo{PartitionNum: 2, Replica: 1})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord, time.Second*5)
 
 	// test increase replicator and decrease the replicator
-	err = lookupCoord.ChangeTopicMetaParam(topic_p1_r1, -1, -1, 3, "")
+	err = lookupCoord.ChangeTopicMetaParam(topic_p1_r1, -1, -1, 3, -1, "", "", "")
 	coordLog.Infof("!!!increase replicator to 3")
 	lookupCoord.triggerCheckTopics("", 0, 0)
 	waitClusterStable(lookupCoord, time.Second*30)
@@ -1290,7 +1367,7 @@ func TestNsqLookupUpdateTopicMeta(t *testing.T) {
 		test.Equal(t, tmeta.Replica, len(info.ISR))
 	}
 
-	err = lookupCoord.ChangeTopicMetaParam(topic_p1_r1, -1, -1, 2, "")
+	err = lookupCoord.ChangeTopicMetaParam(topic_p1_r1, -1, -1, 2, -1, "", "", "")
 	lookupCoord.triggerCheckTopics("", 0, 0)
 	waitClusterStable(lookupCoord, time.Second*5)
 	time.Sleep(time.Second * 3)
@@ -1302,7 +1379,7 @@ func TestNsqLookupUpdateTopicMeta(t *testing.T) {
 		test.Equal(t, tmeta.Replica, len(info.ISR))
 	}
 
-	err = lookupCoord.ChangeTopicMetaParam(topic_p2_r1, -1, -1, 2, "")
+	err = lookupCoord.ChangeTopicMetaParam(topic_p2_r1, -1, -1, 2, -1, "", "", "")
 	lookupCoord.triggerCheckTopics("", 0, 0)
 	waitClusterStable(lookupCoord, time.Second*5)
 	time.Sleep(time.Second * 5)
@@ -1315,10 +1392,10 @@ func TestNsqLookupUpdateTopicMeta(t *testing.T) {
 	}
 
 	// should fail
-	err = lookupCoord.ChangeTopicMetaParam(topic_p2_r1, -1, -1, 3, "")
+	err = lookupCoord.ChangeTopicMetaParam(topic_p2_r1, -1, -1, 3, -1, "", "", "")
 	test.NotNil(t, err)
 
-	err = lookupCoord.ChangeTopicMetaParam(topic_p2_r1, -1, -1, 1, "")
+	err = lookupCoord.ChangeTopicMetaParam(topic_p2_r1, -1, -1, 1, -1, "", "", "")
 	waitClusterStable(lookupCoord, time.Second*5)
 	lookupCoord.triggerCheckTopics("", 0, 0)
 	time.Sleep(time.Second * 3)
@@ -1331,7 +1408,7 @@ func TestNsqLookupUpdateTopicMeta(t *testing.T) {
 	}
 
 	// test update the sync and retention , all partition and replica should be updated
-	err = lookupCoord.ChangeTopicMetaParam(topic_p1_r1, 1234, 3, -1, "")
+	err = lookupCoord.ChangeTopicMetaParam(topic_p1_r1, 1234, 3, -1, -1, "", "", "")
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord, time.Second*5)
 	time.Sleep(time.Second)
@@ -1388,15 +1465,15 @@ func TestNsqLookupMarkNodeRemove(t *testing.T) {
 		lookupCoord.Stop()
 	}()
 
-	err := lookupCoord.CreateTopic(topic_p4_r1, TopicMetaInfo{4, 1, 0, 0, 0, 0, false, false, false})
+	err := lookupCoord.CreateTopic(topic_p4_r1, TopicMetaInfo{PartitionNum: 4, Replica: 1})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord, time.Second)
 
-	err = lookupCoord.CreateTopic(topic_p2_r2, TopicMetaInfo{2, 2, 0, 0, 0, 0, false, false, false})
+	err = lookupCoord.CreateTopic(topic_p2_r2, TopicMetaInfo{PartitionNum: 2, Replica: 2})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord, time.Second)
 
-	err = lookupCoord.CreateTopic(topic_p1_r3, TopicMetaInfo{1, 3, 0, 0, 0, 0, false, false, false})
+	err = lookupCoord.CreateTopic(topic_p1_r3, TopicMetaInfo{PartitionNum: 1, Replica: 3})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord, time.Second)
 
@@ -1503,15 +1580,15 @@ func TestNsqLookupExpandPartition(t *testing.T) {
 		lookupCoord.Stop()
 	}()
 
-	err := lookupCoord.CreateTopic(topic_p1_r1, TopicMetaInfo{1, 1, 0, 0, 0, 0, false, false, false})
+	err := lookupCoord.CreateTopic(topic_p1_r1, TopicMetaInfo{PartitionNum: 1, Replica: 1})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord, time.Second)
 
-	err = lookupCoord.CreateTopic(topic_p1_r2, TopicMetaInfo{1, 2, 0, 0, 0, 0, false, false, false})
+	err = lookupCoord.CreateTopic(topic_p1_r2, TopicMetaInfo{PartitionNum: 1, Replica: 2})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord, time.Second)
 
-	err = lookupCoord.CreateTopic(topic_p1_r3, TopicMetaInfo{1, 3, 0, 0, 0, 0, false, false, false})
+	err = lookupCoord.CreateTopic(topic_p1_r3, TopicMetaInfo{PartitionNum: 1, Replica: 3})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord, time.Second)
 	waitClusterStable(lookupCoord, time.Second)
@@ -1579,6 +1656,459 @@ func TestNsqLookupExpandPartition(t *testing.T) {
 	SetCoordLogger(newTestLogger(t), levellogger.LOG_ERR)
 }
 
+func TestTopicMetaPartitionShrinking(t *testing.T) {
+	meta := TopicMetaInfo{PartitionNum: 3}
+	for pid := 0; pid < 3; pid++ {
+		test.Equal(t, false, meta.IsPartitionShrinking(pid))
+	}
+	meta.ShrinkTo = 2
+	test.Equal(t, false, meta.IsPartitionShrinking(0))
+	test.Equal(t, false, meta.IsPartitionShrinking(1))
+	test.Equal(t, true, meta.IsPartitionShrinking(2))
+	// all partitions of the ordered topic are not writable while shrinking
+	meta.OrderedMulti = true
+	for pid := 0; pid < 3; pid++ {
+		test.Equal(t, true, meta.IsPartitionShrinking(pid))
+	}
+}
+
+func TestTopicPreferredLeader(t *testing.T) {
+	var info TopicPartitionReplicaInfo
+	test.Equal(t, "", info.GetPreferredLeader())
+	// the first isr replica is preferred for the old partition
+	info.ISR = []string{"id2", "id1"}
+	info.Leader = "id1"
+	test.Equal(t, "id2", info.GetPreferredLeader())
+	info.PreferredLeader = "id3"
+	test.Equal(t, "", info.GetPreferredLeader())
+	info.CatchupList = []string{"id3"}
+	test.Equal(t, "id3", info.GetPreferredLeader())
+
+	nlcoord := &NsqLookupCoordinator{}
+	topicInfo := &TopicPartitionMetaInfo{Name: "test", Partition: 0}
+	topicInfo.Replica = 2
+	topicInfo.TopicPartitionReplicaInfo = info
+	currentNodes := map[string]NsqdNodeInfo{"id1": {}, "id2": {}, "id3": {}}
+	// not in isr
+	_, ok := nlcoord.getPreferredLeaderMove(topicInfo, currentNodes)
+	test.Equal(t, false, ok)
+	topicInfo.ISR = []string{"id1", "id3"}
+	topicInfo.CatchupList = nil
+	move, ok := nlcoord.getPreferredLeaderMove(topicInfo, currentNodes)
+	test.Equal(t, true, ok)
+	test.Equal(t, "id1", move.Leader)
+	test.Equal(t, "id3", move.Preferred)
+	// preferred leader is not alive
+	delete(currentNodes, "id3")
+	_, ok = nlcoord.getPreferredLeaderMove(topicInfo, currentNodes)
+	test.Equal(t, false, ok)
+	currentNodes["id3"] = NsqdNodeInfo{}
+	// isr not enough
+	topicInfo.ISR = []string{"id3"}
+	_, ok = nlcoord.getPreferredLeaderMove(topicInfo, currentNodes)
+	test.Equal(t, false, ok)
+}
+
+func TestFakeNsqLookupRestorePreferredLeader(t *testing.T) {
+	SetCoordLogger(newTestLogger(t), levellogger.LOG_WARN)
+	// only two nodes, so the old leader will join the isr again after restart
+	idList := []string{"id1", "id2"}
+	lookupCoord1, nodeInfoList := prepareCluster(t, idList, true)
+	for _, n := range nodeInfoList {
+		defer os.RemoveAll(n.dataPath)
+		defer n.localNsqd.Exit()
+		defer n.nsqdCoord.Stop()
+	}
+	topic := "test-nsqlookup-topic-preferred-leader"
+	lookupLeadership := lookupCoord1.leadership
+	defer func() {
+		lookupCoord1.DeleteTopic(topic, "**")
+		time.Sleep(time.Second * 3)
+		lookupCoord1.Stop()
+	}()
+
+	err := lookupCoord1.CreateTopic(topic, TopicMetaInfo{PartitionNum: 1, Replica: 2})
+	test.Nil(t, err)
+	waitClusterStable(lookupCoord1, time.Second*3)
+	t0, err := lookupLeadership.GetTopicInfo(topic, 0)
+	test.Nil(t, err)
+	test.Equal(t, t0.Leader, t0.PreferredLeader)
+	preferred := t0.Leader
+
+	// the leader lost and a new leader elected
+	atomic.StoreInt32(&nodeInfoList[preferred].nsqdCoord.stopping, 1)
+	nodeInfoList[preferred].nsqdCoord.leadership.UnregisterNsqd(nodeInfoList[preferred].nodeInfo)
+	waitClusterStable(lookupCoord1, time.Second*3)
+	t0, _ = lookupLeadership.GetTopicInfo(topic, 0)
+	start := time.Now()
+	for t0.Leader == preferred && time.Since(start) < time.Second*15 {
+		waitClusterStable(lookupCoord1, time.Second*3)
+		t0, _ = lookupLeadership.GetTopicInfo(topic, 0)
+	}
+	test.NotEqual(t, preferred, t0.Leader)
+	test.Equal(t, preferred, t0.PreferredLeader)
+
+	// the old leader rejoin, the leader should not change until restored
+	atomic.StoreInt32(&nodeInfoList[preferred].nsqdCoord.stopping, 0)
+	nodeInfoList[preferred].nsqdCoord.leadership.RegisterNsqd(nodeInfoList[preferred].nodeInfo)
+	waitClusterStable(lookupCoord1, time.Second*3)
+	t0, _ = lookupLeadership.GetTopicInfo(topic, 0)
+	start = time.Now()
+	for FindSlice(t0.ISR, preferred) == -1 && time.Since(start) < time.Second*15 {
+		waitClusterStable(lookupCoord1, time.Second*3)
+		t0, _ = lookupLeadership.GetTopicInfo(topic, 0)
+	}
+	test.NotEqual(t, -1, FindSlice(t0.ISR, preferred))
+	oldLeader := t0.Leader
+	test.NotEqual(t, preferred, oldLeader)
+
+	moves, err := lookupCoord1.RestorePreferredLeaders(topic, true, 0)
+	test.Nil(t, err)
+	test.Equal(t, 1, len(moves))
+	test.Equal(t, false, moves[0].Moved)
+	test.Equal(t, oldLeader, moves[0].Leader)
+	test.Equal(t, preferred, moves[0].Preferred)
+	t0, _ = lookupLeadership.GetTopicInfo(topic, 0)
+	test.Equal(t, oldLeader, t0.Leader)
+
+	moves, err = lookupCoord1.RestorePreferredLeaders(topic, false, 0)
+	test.Nil(t, err)
+	test.Equal(t, 1, len(moves))
+	test.Equal(t, true, moves[0].Moved)
+	waitClusterStable(lookupCoord1, time.Second*3)
+	t0, _ = lookupLeadership.GetTopicInfo(topic, 0)
+	test.Equal(t, preferred, t0.Leader)
+	test.Equal(t, preferred, t0.PreferredLeader)
+	tc0, coordErr := nodeInfoList[preferred].nsqdCoord.getTopicCoord(topic, 0)
+	test.Nil(t, coordErr)
+	test.Equal(t, preferred, tc0.GetData().GetLeader())
+
+	moves, err = lookupCoord1.RestorePreferredLeaders(topic, true, 0)
+	test.Nil(t, err)
+	test.Equal(t, 0, len(moves))
+}
+
+func TestReassignPlanCheck(t *testing.T) {
+	topics := make([]TopicPartitionMetaInfo, 2)
+	for i := range topics {
+		topics[i].Name = "test"
+		topics[i].Partition = i
+		topics[i].PartitionNum = 2
+		topics[i].Replica = 2
+	}
+	topics[0].Leader = "id1"
+	topics[0].ISR = []string{"id1", "id2"}
+	topics[1].Leader = "id3"
+	topics[1].ISR = []string{"id3", "id4"}
+	currentNodes := map[string]NsqdNodeInfo{"id1": {}, "id2": {}, "id3": {}, "id4": {}}
+
+	plan := &ReassignPlan{}
+	test.NotNil(t, checkReassignPlan(plan, topics, currentNodes))
+	// partition not found
+	plan.Partitions = []ReassignPartition{{Topic: "test", Partition: 2, ISR: []string{"id1", "id2"}}}
+	test.NotNil(t, checkReassignPlan(plan, topics, currentNodes))
+	// node not found
+	plan.Partitions = []ReassignPartition{{Topic: "test", Partition: 0, ISR: []string{"id2", "id5"}}}
+	test.NotNil(t, checkReassignPlan(plan, topics, currentNodes))
+	// replicas mismatch
+	plan.Partitions = []ReassignPartition{{Topic: "test", Partition: 0, ISR: []string{"id2"}}}
+	test.NotNil(t, checkReassignPlan(plan, topics, currentNodes))
+	// duplicate node
+	plan.Partitions = []ReassignPartition{{Topic: "test", Partition: 0, ISR: []string{"id2", "id2"}}}
+	test.NotNil(t, checkReassignPlan(plan, topics, currentNodes))
+	// duplicate partition
+	plan.Partitions = []ReassignPartition{{Topic: "test", Partition: 0, ISR: []string{"id2", "id1"}},
+		{Topic: "test", Partition: 0, ISR: []string{"id1", "id2"}}}
+	test.NotNil(t, checkReassignPlan(plan, topics, currentNodes))
+	// the partitions can not be on the same node
+	plan.Partitions = []ReassignPartition{{Topic: "test", Partition: 0, ISR: []string{"id3", "id1"}}}
+	test.NotNil(t, checkReassignPlan(plan, topics, currentNodes))
+	plan.Partitions = []ReassignPartition{{Topic: "test", Partition: 0, ISR: []string{"id3", "id1"}},
+		{Topic: "test", Partition: 1, ISR: []string{"id4", "id2"}}}
+	test.Nil(t, checkReassignPlan(plan, topics, currentNodes))
+	test.Equal(t, "id1", plan.Partitions[0].OldLeader)
+	test.Equal(t, []string{"id1", "id2"}, plan.Partitions[0].OldISR)
+	test.Equal(t, ReassignPartPending, plan.Partitions[0].State)
+	test.Equal(t, "id3", plan.Partitions[1].OldLeader)
+	// allow multi partitions on the same node
+	plan.Partitions = []ReassignPartition{{Topic: "test", Partition: 0, ISR: []string{"id3", "id4"}}}
+	test.NotNil(t, checkReassignPlan(plan, topics, currentNodes))
+	topics[0].MultiPart = true
+	topics[1].MultiPart = true
+	test.Nil(t, checkReassignPlan(plan, topics, currentNodes))
+
+	nodeStats := make(map[string]*NodeTopicStats)
+	for nid := range currentNodes {
+		nodeStats[nid] = NewNodeTopicStats(nid, 1, 1)
+	}
+	nodeStats["id1"].TopicTotalDataSize["test-0"] = 10
+	nodeStats["id1"].TopicLeaderDataSize["test-0"] = 10
+	nodeStats["id1"].ChannelDepthData["test-0"] = 5
+	nodeStats["id2"].TopicTotalDataSize["test-0"] = 10
+	moveReassignTopicStats(nodeStats, &topics[0], []string{"id3", "id1"})
+	test.Equal(t, int64(10), nodeStats["id3"].TopicTotalDataSize["test-0"])
+	test.Equal(t, int64(10), nodeStats["id3"].TopicLeaderDataSize["test-0"])
+	test.Equal(t, int64(5), nodeStats["id3"].ChannelDepthData["test-0"])
+	test.Equal(t, int64(10), nodeStats["id1"].TopicTotalDataSize["test-0"])
+	_, ok := nodeStats["id1"].TopicLeaderDataSize["test-0"]
+	test.Equal(t, false, ok)
+	_, ok = nodeStats["id2"].TopicTotalDataSize["test-0"]
+	test.Equal(t, false, ok)
+}
+
+func waitReassignPlanState(t *testing.T, lookupCoord *NsqLookupCoordinator, state string, timeout time.Duration) *ReassignPlan {
+	start := time.Now()
+	for {
+		plan, err := lookupCoord.GetReassignPlan()
+		test.Nil(t, err)
+		if plan.State == state || time.Since(start) > timeout {
+			return plan
+		}
+		time.Sleep(time.Millisecond * 500)
+	}
+}
+
+func TestFakeNsqLookupReassignPlan(t *testing.T) {
+	SetCoordLogger(newTestLogger(t), levellogger.LOG_WARN)
+	idList := []string{"id1", "id2", "id3"}
+	lookupCoord1, nodeInfoList := prepareCluster(t, idList, true)
+	for _, n := range nodeInfoList {
+		defer os.RemoveAll(n.dataPath)
+		defer n.localNsqd.Exit()
+		defer n.nsqdCoord.Stop()
+	}
+	topics := []string{"test-nsqlookup-topic-reassign1", "test-nsqlookup-topic-reassign2"}
+	lookupLeadership := lookupCoord1.leadership
+	defer func() {
+		for _, topic := range topics {
+			lookupCoord1.DeleteTopic(topic, "**")
+		}
+		time.Sleep(time.Second * 3)
+		lookupCoord1.Stop()
+	}()
+
+	_, err := lookupCoord1.GetReassignPlan()
+	test.Equal(t, ErrReassignPlanNotFound, err)
+	for _, topic := range topics {
+		err = lookupCoord1.CreateTopic(topic, TopicMetaInfo{PartitionNum: 1, Replica: 2})
+		test.Nil(t, err)
+	}
+	waitClusterStable(lookupCoord1, time.Second*3)
+
+	// move the leader out and the node not in isr will be the new leader
+	plan := &ReassignPlan{Concurrency: 2}
+	for _, topic := range topics {
+		t0, err := lookupLeadership.GetTopicInfo(topic, 0)
+		test.Nil(t, err)
+		test.Equal(t, 2, len(t0.ISR))
+		newISR := make([]string, 0, 2)
+		for nid := range nodeInfoList {
+			if FindSlice(t0.ISR, nid) == -1 {
+				newISR = append(newISR, nid)
+			}
+		}
+		for _, nid := range t0.ISR {
+			if nid != t0.Leader {
+				newISR = append(newISR, nid)
+			}
+		}
+		plan.Partitions = append(plan.Partitions, ReassignPartition{Topic: topic, Partition: 0, ISR: newISR})
+	}
+
+	loads, err := lookupCoord1.SubmitReassignPlan(plan, true)
+	test.Nil(t, err)
+	test.Equal(t, len(idList), len(loads))
+	newLeaders := 0
+	newReplicas := 0
+	for _, l := range loads {
+		newLeaders += l.NewLeaders
+		newReplicas += l.NewReplicas
+	}
+	test.Equal(t, len(topics), newLeaders)
+	test.Equal(t, len(topics)*2, newReplicas)
+	_, err = lookupCoord1.GetReassignPlan()
+	test.Equal(t, ErrReassignPlanNotFound, err)
+
+	_, err = lookupCoord1.SubmitReassignPlan(plan, false)
+	test.Nil(t, err)
+	err = lookupCoord1.PauseReassignPlan()
+	test.Nil(t, err)
+	_, err = lookupCoord1.SubmitReassignPlan(plan, false)
+	test.Equal(t, ErrReassignPlanNotFinished, err)
+	time.Sleep(checkReassignInterval * 2)
+	saved, err := lookupCoord1.GetReassignPlan()
+	test.Nil(t, err)
+	test.Equal(t, ReassignStatePaused, saved.State)
+	for i, rp := range saved.Partitions {
+		test.Equal(t, ReassignPartPending, rp.State)
+		test.Equal(t, plan.Partitions[i].ISR, rp.ISR)
+		t0, _ := lookupLeadership.GetTopicInfo(rp.Topic, 0)
+		test.Equal(t, rp.OldLeader, t0.Leader)
+	}
+
+	err = lookupCoord1.ResumeReassignPlan()
+	test.Nil(t, err)
+	saved = waitReassignPlanState(t, lookupCoord1, ReassignStateDone, time.Second*60)
+	test.Equal(t, ReassignStateDone, saved.State)
+	waitClusterStable(lookupCoord1, time.Second*3)
+	for _, rp := range saved.Partitions {
+		test.Equal(t, ReassignPartDone, rp.State)
+		t0, err := lookupLeadership.GetTopicInfo(rp.Topic, 0)
+		test.Nil(t, err)
+		test.Equal(t, rp.ISR[0], t0.Leader)
+		test.Equal(t, rp.ISR[0], t0.PreferredLeader)
+		test.Equal(t, len(rp.ISR), len(t0.ISR))
+		for _, nid := range rp.ISR {
+			test.NotEqual(t, -1, FindSlice(t0.ISR, nid))
+		}
+	}
+	// the finished plan can not be changed
+	test.NotNil(t, lookupCoord1.CancelReassignPlan())
+	test.NotNil(t, lookupCoord1.ResumeReassignPlan())
+
+	// the plan is already done, nothing moved
+	_, err = lookupCoord1.SubmitReassignPlan(plan, false)
+	test.Nil(t, err)
+	err = lookupCoord1.CancelReassignPlan()
+	test.Nil(t, err)
+	saved, err = lookupCoord1.GetReassignPlan()
+	test.Nil(t, err)
+	test.Equal(t, ReassignStateCancelled, saved.State)
+	time.Sleep(checkReassignInterval * 2)
+	for _, rp := range saved.Partitions {
+		t0, _ := lookupLeadership.GetTopicInfo(rp.Topic, 0)
+		test.Equal(t, rp.ISR[0], t0.Leader)
+	}
+}
+
+func TestNsqLookupShrinkPartition(t *testing.T) {
+	if testing.Verbose() {
+		SetCoordLogger(levellogger.NewSimpleLog(), levellogger.LOG_INFO)
+		glog.SetFlags(0, "", "", true, true, 1)
+		glog.StartWorker(time.Second)
+	} else {
+		SetCoordLogger(newTestLogger(t), levellogger.LOG_WARN)
+	}
+
+	idList := []string{"id1", "id2", "id3", "id4"}
+	lookupCoord, nodeInfoList := prepareCluster(t, idList, false)
+	for _, n := range nodeInfoList {
+		defer os.RemoveAll(n.dataPath)
+		defer n.localNsqd.Exit()
+		defer n.nsqdCoord.Stop()
+	}
+
+	topic_p2_r2 := "test-nsqlookup-topic-unit-test-shrink-p2-r2"
+	lookupLeadership := lookupCoord.leadership
+
+	checkDeleteErr(t, lookupCoord.DeleteTopic(topic_p2_r2, "**"))
+	time.Sleep(time.Second * 3)
+	defer func() {
+		waitClusterStable(lookupCoord, time.Second*3)
+		checkDeleteErr(t, lookupCoord.DeleteTopic(topic_p2_r2, "**"))
+		time.Sleep(time.Second * 3)
+		lookupCoord.Stop()
+	}()
+
+	err := lookupCoord.CreateTopic(topic_p2_r2, TopicMetaInfo{PartitionNum: 2, Replica: 2})
+	test.Nil(t, err)
+	waitClusterStable(lookupCoord, time.Second*3)
+	err = lookupCoord.ShrinkTopicPartition(topic_p2_r2, 2, false)
+	test.NotNil(t, err)
+
+	leaderNode := getTopicLeaderNode(t, lookupLeadership, topic_p2_r2, 1, nodeInfoList)
+	localT, _ := leaderNode.nsqdCoord.localNsqd.GetExistingTopic(topic_p2_r2, 1)
+	test.NotNil(t, localT)
+	ch := localT.GetChannel("ch1")
+	test.NotNil(t, ch)
+	for i := 0; i < 10; i++ {
+		_, _, _, _, err = leaderNode.nsqdCoord.PutMessageBodyToCluster(localT, []byte("beforeshrink"), 0)
+		test.Nil(t, err)
+	}
+
+	err = lookupCoord.ShrinkTopicPartition(topic_p2_r2, 1, false)
+	test.Nil(t, err)
+	meta, _, err := lookupLeadership.GetTopicMetaInfo(topic_p2_r2)
+	test.Nil(t, err)
+	test.Equal(t, 2, meta.PartitionNum)
+	test.Equal(t, 1, meta.ShrinkTo)
+	// can not expand or shrink to other while shrinking
+	test.NotNil(t, lookupCoord.ExpandTopicPartition(topic_p2_r2, 3))
+	test.NotNil(t, lookupCoord.ShrinkTopicPartition(topic_p2_r2, 0, false))
+
+	leaders, err := lookupCoord.GetTopicLeaderNodes(topic_p2_r2)
+	test.Nil(t, err)
+	test.Equal(t, 1, len(leaders))
+	_, ok := leaders["1"]
+	test.Equal(t, false, ok)
+	// the producer write is disabled while the internal write is allowed
+	msg := nsqd.NewMessage(0, []byte("aftershrink"))
+	_, _, _, _, err = leaderNode.nsqdCoord.PutMessageToClusterWithAck(localT, msg, nsqd.PubAckAll)
+	test.NotNil(t, err)
+	_, _, _, _, err = leaderNode.nsqdCoord.PutMessageBodyToCluster(localT, []byte("requeue"), 0)
+	test.Nil(t, err)
+
+	_, pendings, err := lookupCoord.GetTopicShrinkPending(topic_p2_r2)
+	test.Nil(t, err)
+	test.Equal(t, int64(11), pendings[1])
+	test.Nil(t, lookupCoord.tryFinishTopicShrink(topic_p2_r2))
+	meta, _, err = lookupLeadership.GetTopicMetaInfo(topic_p2_r2)
+	test.Nil(t, err)
+	test.Equal(t, 2, meta.PartitionNum)
+
+	// cancel and enable write again
+	err = lookupCoord.CancelTopicShrink(topic_p2_r2)
+	test.Nil(t, err)
+	meta, _, err = lookupLeadership.GetTopicMetaInfo(topic_p2_r2)
+	test.Nil(t, err)
+	test.Equal(t, 0, meta.ShrinkTo)
+	msg = nsqd.NewMessage(0, []byte("aftercancel"))
+	_, _, _, _, err = leaderNode.nsqdCoord.PutMessageToClusterWithAck(localT, msg, nsqd.PubAckAll)
+	test.Nil(t, err)
+
+	err = lookupCoord.ShrinkTopicPartition(topic_p2_r2, 1, false)
+	test.Nil(t, err)
+	// consume all and the partition should be removed
+	committed := localT.GetCommitted()
+	err = leaderNode.nsqdCoord.SetChannelConsumeOffsetToCluster(ch, int64(committed.Offset()), committed.TotalMsgCnt(), true)
+	test.Nil(t, err)
+	_, pendings, err = lookupCoord.GetTopicShrinkPending(topic_p2_r2)
+	test.Nil(t, err)
+	test.Equal(t, int64(0), pendings[1])
+	test.Nil(t, lookupCoord.tryFinishTopicShrink(topic_p2_r2))
+	meta, _, err = lookupLeadership.GetTopicMetaInfo(topic_p2_r2)
+	test.Nil(t, err)
+	test.Equal(t, 1, meta.PartitionNum)
+	test.Equal(t, 0, meta.ShrinkTo)
+	_, err = lookupLeadership.GetTopicInfo(topic_p2_r2, 1)
+	test.NotNil(t, err)
+	waitClusterStable(lookupCoord, time.Second*3)
+	t0, err := lookupLeadership.GetTopicInfo(topic_p2_r2, 0)
+	test.Nil(t, err)
+	test.Equal(t, 0, t0.ShrinkTo)
+
+	// the ordered topic should be shrunk only if the write stop is confirmed
+	topicOrdered := "test-nsqlookup-topic-unit-test-shrink-ordered"
+	checkDeleteErr(t, lookupCoord.DeleteTopic(topicOrdered, "**"))
+	defer func() {
+		checkDeleteErr(t, lookupCoord.DeleteTopic(topicOrdered, "**"))
+	}()
+	err = lookupCoord.CreateTopic(topicOrdered, TopicMetaInfo{PartitionNum: 2, Replica: 2, OrderedMulti: true})
+	test.Nil(t, err)
+	waitClusterStable(lookupCoord, time.Second*3)
+	test.Equal(t, ErrShrinkOrderedTopicStopWrite, lookupCoord.ShrinkTopicPartition(topicOrdered, 1, false))
+	meta, _, err = lookupLeadership.GetTopicMetaInfo(topicOrdered)
+	test.Nil(t, err)
+	test.Equal(t, 0, meta.ShrinkTo)
+	test.Nil(t, lookupCoord.ShrinkTopicPartition(topicOrdered, 1, true))
+	meta, _, err = lookupLeadership.GetTopicMetaInfo(topicOrdered)
+	test.Nil(t, err)
+	test.Equal(t, 1, meta.ShrinkTo)
+	test.Equal(t, true, meta.IsPartitionShrinking(0))
+	test.Nil(t, lookupCoord.CancelTopicShrink(topicOrdered))
+	SetCoordLogger(newTestLogger(t), levellogger.LOG_ERR)
+}
+
 func TestNsqLookupMovePartition(t *testing.T) {
 	if testing.Verbose() {
 		SetCoordLogger(levellogger.NewSimpleLog(), levellogger.LOG_INFO)
@@ -1615,13 +2145,13 @@ func TestNsqLookupMovePartition(t *testing.T) {
 	}()
 
 	// test new topic create
-	err := lookupCoord.CreateTopic(topic_p1_r1, TopicMetaInfo{1, 1, 0, 0, 0, 0, false, false, false})
+	err := lookupCoord.CreateTopic(topic_p1_r1, TopicMetaInfo{PartitionNum: 1, Replica: 1})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord, time.Second*3)
 
-	err = lookupCoord.CreateTopic(topic_p2_r2, TopicMetaInfo{2, 2, 0, 0, 0, 0, false, false, false})
+	err = lookupCoord.CreateTopic(topic_p2_r2, TopicMetaInfo{PartitionNum: 2, Replica: 2})
 	test.Nil(t, err)
-	err = lookupCoord.CreateTopic(topic_ordered_p4_r3, TopicMetaInfo{4, 3, 0, 0, 0, 0, true, false, false})
+	err = lookupCoord.CreateTopic(topic_ordered_p4_r3, TopicMetaInfo{PartitionNum: 4, Replica: 3, OrderedMulti: true})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord, time.Second*5)
 
@@ -1891,7 +2421,7 @@ func TestNsqLookupMovePartitionRetryWhileLocalRemoved(t *testing.T) {
 		lookupCoord.Stop()
 	}()
 
-	err := lookupCoord.CreateTopic(topic_ordered_p1_r3, TopicMetaInfo{4, 3, 0, 0, 0, 0, true, false, false})
+	err := lookupCoord.CreateTopic(topic_ordered_p1_r3, TopicMetaInfo{PartitionNum: 4, Replica: 3, OrderedMulti: true})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord, time.Second*5)
 
@@ -2070,7 +2600,7 @@ func TestNsqLookupSlaveTimeoutReadUncommitted(t *testing.T) {
 		lookupCoord.Stop()
 	}()
 
-	err := lookupCoord.CreateTopic(topic_p1_r2, TopicMetaInfo{1, 2, 0, 0, 0, 0, false, false, false})
+	err := lookupCoord.CreateTopic(topic_p1_r2, TopicMetaInfo{PartitionNum: 1, Replica: 2})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord, time.Second*5)
 
@@ -2246,7 +2776,7 @@ func TestNsqLookupMovePartitionAndSlaveTimeoutWhileReadWrite(t *testing.T) {
 		lookupCoord.Stop()
 	}()
 
-	err := lookupCoord.CreateTopic(topic_p1_r2, TopicMetaInfo{1, 2, 0, 0, 0, 0, false, false, false})
+	err := lookupCoord.CreateTopic(topic_p1_r2, TopicMetaInfo{PartitionNum: 1, Replica: 2})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord, time.Second*5)
 
@@ -2578,14 +3108,14 @@ func testNsqLookupOrderedOrMultiPartTopicCreate(t *testing.T, tnameSuffix string
 	}()
 
 	// test new topic create
-	err := lookupCoord1.CreateTopic(topic_p8_r3, TopicMetaInfo{8, 3, 0, 0, 0, 0, ordered, multi, false})
+	err := lookupCoord1.CreateTopic(topic_p8_r3, TopicMetaInfo{PartitionNum: 8, Replica: 3, OrderedMulti: ordered, MultiPart: multi})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord1, time.Second*3)
 
 	checkOrderedMultiTopic(t, topic_p8_r3, 8, len(nodeInfoList),
 		nodeInfoList, lookupLeadership, true)
 
-	err = lookupCoord1.CreateTopic(topic_p13_r1, TopicMetaInfo{13, 1, 0, 0, 0, 0, ordered, multi, false})
+	err = lookupCoord1.CreateTopic(topic_p13_r1, TopicMetaInfo{PartitionNum: 13, Replica: 1, OrderedMulti: ordered, MultiPart: multi})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord1, time.Second*5)
 	lookupCoord1.triggerCheckTopics("", 0, 0)
@@ -2594,7 +3124,7 @@ func testNsqLookupOrderedOrMultiPartTopicCreate(t *testing.T, tnameSuffix string
 	checkOrderedMultiTopic(t, topic_p13_r1, 13, len(nodeInfoList),
 		nodeInfoList, lookupLeadership, true)
 
-	err = lookupCoord1.CreateTopic(topic_p25_r3, TopicMetaInfo{25, 3, 0, 0, 0, 0, ordered, multi, false})
+	err = lookupCoord1.CreateTopic(topic_p25_r3, TopicMetaInfo{PartitionNum: 25, Replica: 3, OrderedMulti: ordered, MultiPart: multi})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord1, time.Second*2)
 	waitClusterStable(lookupCoord1, time.Second*5)
@@ -2605,7 +3135,7 @@ func testNsqLookupOrderedOrMultiPartTopicCreate(t *testing.T, tnameSuffix string
 	// test create on exist topic, create on partial partition
 	oldMeta, _, err := lookupCoord1.leadership.GetTopicMetaInfo(topic_p25_r3)
 	test.Nil(t, err)
-	err = lookupCoord1.CreateTopic(topic_p25_r3, TopicMetaInfo{25, 3, 0, 0, 1, 1, ordered, multi, false})
+	err = lookupCoord1.CreateTopic(topic_p25_r3, TopicMetaInfo{PartitionNum: 25, Replica: 3, MagicCode: 1, RetentionDay: 1, OrderedMulti: ordered, MultiPart: multi})
 	test.NotNil(t, err)
 	waitClusterStable(lookupCoord1, time.Second)
 	waitClusterStable(lookupCoord1, time.Second*5)
@@ -2748,7 +3278,7 @@ func testNsqLookupOrderedOrMultiPartTopicBalance(t *testing.T, tname string, ord
 		lookupCoord1.Stop()
 	}()
 
-	err := lookupCoord1.CreateTopic(topic_p13_r2, TopicMetaInfo{13, 2, 0, 0, 0, 0, ordered, multi, false})
+	err := lookupCoord1.CreateTopic(topic_p13_r2, TopicMetaInfo{PartitionNum: 13, Replica: 2, OrderedMulti: ordered, MultiPart: multi})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord1, time.Second*10)
 	time.Sleep(time.Second * 3)
@@ -2882,17 +3412,17 @@ func TestNsqLookupTopNTopicBalance(t *testing.T) {
 		lookupCoord1.Stop()
 	}()
 
-	err := lookupCoord1.CreateTopic(topic_p1_r2, TopicMetaInfo{1, 2, 0, 0, 0, 0, false, false, false})
+	err := lookupCoord1.CreateTopic(topic_p1_r2, TopicMetaInfo{PartitionNum: 1, Replica: 2})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord1, time.Second)
-	err = lookupCoord1.CreateTopic(topic_p1_r3, TopicMetaInfo{1, 3, 0, 0, 0, 0, false, false, false})
+	err = lookupCoord1.CreateTopic(topic_p1_r3, TopicMetaInfo{PartitionNum: 1, Replica: 3})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord1, time.Second)
-	err = lookupCoord1.CreateTopic(topic_p2_r2, TopicMetaInfo{2, 2, 0, 0, 0, 0, false, false, false})
+	err = lookupCoord1.CreateTopic(topic_p2_r2, TopicMetaInfo{PartitionNum: 2, Replica: 2})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord1, time.Second)
 	for _, tn := range testTopicList {
-		err = lookupCoord1.CreateTopic(tn, TopicMetaInfo{2, 2, 0, 0, 0, 0, false, false, false})
+		err = lookupCoord1.CreateTopic(tn, TopicMetaInfo{PartitionNum: 2, Replica: 2})
 		test.Nil(t, err)
 		waitClusterStable(lookupCoord1, time.Second)
 	}
@@ -18,6 +18,7 @@ type INsqlookupRemoteProxy interface {
 	RequestLeaveFromISRByLeader(topic string, partition int, nid string, leaderSession *TopicLeaderSession) *CoordErr
 	RequestNotifyNewTopicInfo(topic string, partition int, nid string)
 	RequestCheckTopicConsistence(topic string, partition int)
+	GetConsumerGroupOwner(topic string, partition int, channel string) (bool, string, int64, *CoordErr)
 }
 
 type nsqlookupRemoteProxyCreateFunc func(string, time.Duration) (INsqlookupRemoteProxy, error)
@@ -194,3 +195,19 @@ func (nlrpc *NsqLookupRpcClient) RequestCheckTopicConsistence(topic string, part
 	req.TopicPartition = partition
 	nlrpc.CallWithRetry("RequestCheckTopicConsistence", &req)
 }
+
+func (nlrpc *NsqLookupRpcClient) GetConsumerGroupOwner(topic string, partition int, channel string) (bool, string, int64, *CoordErr) {
+	var req RpcReqConsumerGroupOwner
+	req.TopicName = topic
+	req.TopicPartition = partition
+	req.Channel = channel
+	ret, err := nlrpc.CallWithRetry("GetConsumerGroupOwner", &req)
+	if err != nil || ret == nil {
+		return false, "", 0, convertRpcError(err, nil)
+	}
+	rsp := ret.(*RpcRspConsumerGroupOwner)
+	if rsp.HasError() {
+		return false, "", 0, &rsp.CoordErr
+	}
+	return rsp.GroupExist, rsp.Owner, rsp.Generation, nil
+}
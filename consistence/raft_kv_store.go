@@ -0,0 +1,523 @@
+package consistence
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/client"
+)
+
+// The embedded raft leadership store keeps the data in a tree which follows
+// the etcd v2 keys model (dirs, ttl, compare and swap, watch by index), so the
+// etcd leadership implementations can run on it without any change.
+
+const (
+	raftOpSet    = "set"
+	raftOpDelete = "delete"
+	raftOpExpire = "expire"
+	raftOpSync   = "sync"
+
+	raftActionGet              = "get"
+	raftActionSet              = "set"
+	raftActionCreate           = "create"
+	raftActionUpdate           = "update"
+	raftActionDelete           = "delete"
+	raftActionExpire           = "expire"
+	raftActionCompareAndSwap   = "compareAndSwap"
+	raftActionCompareAndDelete = "compareAndDelete"
+)
+
+const (
+	raftPrevExistTrue  = "true"
+	raftPrevExistFalse = "false"
+)
+
+const raftKVHistorySize = 1000
+
+// raftKVOp is the operation proposed to raft, all the nondeterministic values
+// (like the expire time) are decided by the proposer before proposing.
+type raftKVOp struct {
+	ReqID     uint64 `json:"req_id,omitempty"`
+	Op        string `json:"op"`
+	Key       string `json:"key,omitempty"`
+	Value     string `json:"value,omitempty"`
+	Dir       bool   `json:"dir,omitempty"`
+	PrevValue string `json:"prev_value,omitempty"`
+	PrevIndex uint64 `json:"prev_index,omitempty"`
+	PrevExist string `json:"prev_exist,omitempty"`
+	ExpireAt  int64  `json:"expire_at,omitempty"`
+	Refresh   bool   `json:"refresh,omitempty"`
+	Recursive bool   `json:"recursive,omitempty"`
+}
+
+type raftKVNode struct {
+	key           string
+	value         string
+	dir           bool
+	createdIndex  uint64
+	modifiedIndex uint64
+	// unix nano, 0 means never expire
+	expireAt int64
+	children map[string]*raftKVNode
+}
+
+func newRaftKVDirNode(key string, index uint64) *raftKVNode {
+	return &raftKVNode{
+		key:           key,
+		dir:           true,
+		createdIndex:  index,
+		modifiedIndex: index,
+		children:      make(map[string]*raftKVNode),
+	}
+}
+
+func (n *raftKVNode) repr(recursive bool, sorted bool, deep bool, now int64) *client.Node {
+	cn := &client.Node{
+		Key:           n.key,
+		Dir:           n.dir,
+		CreatedIndex:  n.createdIndex,
+		ModifiedIndex: n.modifiedIndex,
+	}
+	if !n.dir {
+		cn.Value = n.value
+	}
+	if n.expireAt > 0 {
+		exp := time.Unix(0, n.expireAt).UTC()
+		cn.Expiration = &exp
+		ttl := (n.expireAt - now + int64(time.Second) - 1) / int64(time.Second)
+		if ttl <= 0 {
+			ttl = 1
+		}
+		cn.TTL = ttl
+	}
+	if n.dir && deep {
+		cn.Nodes = make(client.Nodes, 0, len(n.children))
+		for _, child := range n.children {
+			cn.Nodes = append(cn.Nodes, child.repr(recursive, sorted, recursive, now))
+		}
+		if sorted {
+			sort.Sort(cn.Nodes)
+		}
+	}
+	return cn
+}
+
+type raftKVSnapNode struct {
+	Key           string `json:"key"`
+	Value         string `json:"value,omitempty"`
+	Dir           bool   `json:"dir,omitempty"`
+	CreatedIndex  uint64 `json:"created_index"`
+	ModifiedIndex uint64 `json:"modified_index"`
+	ExpireAt      int64  `json:"expire_at,omitempty"`
+}
+
+type raftKVSnapshot struct {
+	Index uint64           `json:"index"`
+	Nodes []raftKVSnapNode `json:"nodes"`
+}
+
+// raftKVStore is the state machine of the raft leadership store, it should
+// only be changed by applying the committed raft entries.
+type raftKVStore struct {
+	sync.RWMutex
+	root    *raftKVNode
+	index   uint64
+	ttlKeys map[string]*raftKVNode
+	// the events with index not less than historyStart are all in the history
+	history      []*client.Response
+	historyStart uint64
+	notifyCh     chan struct{}
+}
+
+func newRaftKVStore() *raftKVStore {
+	return &raftKVStore{
+		root:     newRaftKVDirNode("/", 0),
+		ttlKeys:  make(map[string]*raftKVNode),
+		notifyCh: make(chan struct{}),
+	}
+}
+
+func cleanRaftKey(key string) string {
+	return path.Clean("/" + key)
+}
+
+func newRaftKVError(code int, msg string, cause string, index uint64) error {
+	return client.Error{Code: code, Message: msg, Cause: cause, Index: index}
+}
+
+func (s *raftKVStore) CurrentIndex() uint64 {
+	s.RLock()
+	defer s.RUnlock()
+	return s.index
+}
+
+func (s *raftKVStore) find(key string) *raftKVNode {
+	if key == "/" {
+		return s.root
+	}
+	n := s.root
+	for _, p := range strings.Split(key[1:], "/") {
+		if !n.dir {
+			return nil
+		}
+		child, ok := n.children[p]
+		if !ok {
+			return nil
+		}
+		n = child
+	}
+	return n
+}
+
+func (s *raftKVStore) Get(key string, recursive bool, sorted bool) (*client.Response, error) {
+	key = cleanRaftKey(key)
+	s.RLock()
+	defer s.RUnlock()
+	n := s.find(key)
+	if n == nil {
+		return nil, newRaftKVError(client.ErrorCodeKeyNotFound, "Key not found", key, s.index)
+	}
+	return &client.Response{
+		Action: raftActionGet,
+		Node:   n.repr(recursive, sorted, true, time.Now().UnixNano()),
+		Index:  s.index,
+	}, nil
+}
+
+// Watch return the first event not less than the waitIndex for the key. If no
+// such event happened yet, the returned channel will be closed at the next event.
+// A waitIndex of 0 means waiting the events after the current index, and the
+// resolved waitIndex is returned to be used for the next call.
+func (s *raftKVStore) Watch(key string, recursive bool, waitIndex uint64) (*client.Response, uint64, <-chan struct{}, error) {
+	key = cleanRaftKey(key)
+	s.RLock()
+	defer s.RUnlock()
+	if waitIndex == 0 {
+		waitIndex = s.index + 1
+	}
+	if waitIndex < s.historyStart {
+		return nil, waitIndex, nil, newRaftKVError(client.ErrorCodeEventIndexCleared, "The event in requested index is outdated and cleared",
+			fmt.Sprintf("the requested history has been cleared [%v/%v]", s.historyStart, waitIndex), s.index)
+	}
+	for _, e := range s.history {
+		if e.Index < waitIndex {
+			continue
+		}
+		if isRaftWatchMatch(key, recursive, e) {
+			return e, waitIndex, nil, nil
+		}
+	}
+	return nil, waitIndex, s.notifyCh, nil
+}
+
+func isRaftWatchMatch(key string, recursive bool, e *client.Response) bool {
+	eventKey := e.Node.Key
+	if eventKey == key {
+		return true
+	}
+	if recursive {
+		if key == "/" || strings.HasPrefix(eventKey, key+"/") {
+			return true
+		}
+	}
+	// the watched key is removed with the parent dir
+	if e.Node.Dir && (e.Action == raftActionDelete || e.Action == raftActionExpire ||
+		e.Action == raftActionCompareAndDelete) {
+		if eventKey == "/" || strings.HasPrefix(key, eventKey+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *raftKVStore) addEvent(e *client.Response) {
+	s.history = append(s.history, e)
+	if len(s.history) > raftKVHistorySize {
+		s.historyStart = s.history[0].Index + 1
+		s.history[0] = nil
+		s.history = s.history[1:]
+	}
+	close(s.notifyCh)
+	s.notifyCh = make(chan struct{})
+}
+
+// Apply the committed operation at the raft log index, the response of the
+// operation is returned to the proposer.
+func (s *raftKVStore) Apply(op *raftKVOp, index uint64) (*client.Response, error) {
+	s.Lock()
+	defer s.Unlock()
+	switch op.Op {
+	case raftOpSet:
+		return s.applySet(op, index)
+	case raftOpDelete:
+		return s.applyDelete(op, index)
+	case raftOpExpire:
+		return s.applyExpire(op, index)
+	case raftOpSync:
+		return nil, nil
+	}
+	return nil, newRaftKVError(client.ErrorCodeRaftInternal, "Raft Internal Error", "unknown operation "+op.Op, s.index)
+}
+
+func (s *raftKVStore) compare(n *raftKVNode, prevValue string, prevIndex uint64) (bool, string) {
+	ok := true
+	cause := ""
+	if prevValue != "" && n.value != prevValue {
+		ok = false
+		cause = fmt.Sprintf("[%v != %v]", prevValue, n.value)
+	}
+	if prevIndex != 0 && n.modifiedIndex != prevIndex {
+		ok = false
+		cause += fmt.Sprintf("[%v != %v]", prevIndex, n.modifiedIndex)
+	}
+	return ok, cause
+}
+
+func (s *raftKVStore) updateTTL(n *raftKVNode, expireAt int64) {
+	n.expireAt = expireAt
+	if expireAt > 0 {
+		s.ttlKeys[n.key] = n
+	} else {
+		delete(s.ttlKeys, n.key)
+	}
+}
+
+func (s *raftKVStore) applySet(op *raftKVOp, index uint64) (*client.Response, error) {
+	key := cleanRaftKey(op.Key)
+	if key == "/" {
+		return nil, newRaftKVError(client.ErrorCodeRootROnly, "Root is read only", key, s.index)
+	}
+	now := time.Now().UnixNano()
+	n := s.find(key)
+	isCompare := op.PrevValue != "" || op.PrevIndex != 0
+	if n != nil && op.PrevExist == raftPrevExistFalse {
+		return nil, newRaftKVError(client.ErrorCodeNodeExist, "Key already exists", key, s.index)
+	}
+	if n == nil && (isCompare || op.Refresh || op.PrevExist == raftPrevExistTrue) {
+		return nil, newRaftKVError(client.ErrorCodeKeyNotFound, "Key not found", key, s.index)
+	}
+	action := raftActionSet
+	if isCompare {
+		if n.dir {
+			return nil, newRaftKVError(client.ErrorCodeNotFile, "Not a file", key, s.index)
+		}
+		if ok, cause := s.compare(n, op.PrevValue, op.PrevIndex); !ok {
+			return nil, newRaftKVError(client.ErrorCodeTestFailed, "Compare failed", cause, s.index)
+		}
+		action = raftActionCompareAndSwap
+	} else if op.PrevExist == raftPrevExistTrue {
+		action = raftActionUpdate
+	} else if op.PrevExist == raftPrevExistFalse {
+		action = raftActionCreate
+	}
+	if n != nil && n.dir && !op.Refresh && !(op.Dir && action == raftActionUpdate) {
+		return nil, newRaftKVError(client.ErrorCodeNotFile, "Not a file", key, s.index)
+	}
+
+	var prevNode *client.Node
+	if n != nil {
+		prevNode = n.repr(false, false, false, now)
+	}
+	if op.Refresh || (n != nil && n.dir) {
+		// only the ttl is changed while refreshing, the watchers will not be notified
+		n.modifiedIndex = index
+		s.updateTTL(n, op.ExpireAt)
+		s.index = index
+		rsp := &client.Response{Action: action, Node: n.repr(false, false, false, now), PrevNode: prevNode, Index: index}
+		if !op.Refresh {
+			s.addEvent(rsp)
+		}
+		return rsp, nil
+	}
+
+	parent := s.root
+	parts := strings.Split(key[1:], "/")
+	for i, p := range parts[:len(parts)-1] {
+		child, ok := parent.children[p]
+		if !ok {
+			child = newRaftKVDirNode("/"+strings.Join(parts[:i+1], "/"), index)
+			parent.children[p] = child
+		} else if !child.dir {
+			return nil, newRaftKVError(client.ErrorCodeNotDir, "Not a directory", child.key, s.index)
+		}
+		parent = child
+	}
+	name := parts[len(parts)-1]
+	if n != nil && (action == raftActionUpdate || action == raftActionCompareAndSwap) {
+		n.value = op.Value
+		n.modifiedIndex = index
+	} else {
+		if n != nil {
+			s.removeTTLKeys(n)
+		}
+		if op.Dir {
+			n = newRaftKVDirNode(key, index)
+		} else {
+			n = &raftKVNode{key: key, value: op.Value, createdIndex: index, modifiedIndex: index}
+		}
+		parent.children[name] = n
+	}
+	s.updateTTL(n, op.ExpireAt)
+	s.index = index
+	rsp := &client.Response{Action: action, Node: n.repr(false, false, false, now), PrevNode: prevNode, Index: index}
+	s.addEvent(rsp)
+	return rsp, nil
+}
+
+func (s *raftKVStore) removeTTLKeys(n *raftKVNode) {
+	delete(s.ttlKeys, n.key)
+	for _, child := range n.children {
+		s.removeTTLKeys(child)
+	}
+}
+
+func (s *raftKVStore) remove(n *raftKVNode, action string, index uint64) *client.Response {
+	now := time.Now().UnixNano()
+	prevNode := n.repr(false, false, false, now)
+	parent := s.find(path.Dir(n.key))
+	if parent != nil {
+		delete(parent.children, path.Base(n.key))
+	}
+	s.removeTTLKeys(n)
+	s.index = index
+	rsp := &client.Response{
+		Action: action,
+		Node: &client.Node{
+			Key:           n.key,
+			Dir:           n.dir,
+			CreatedIndex:  n.createdIndex,
+			ModifiedIndex: index,
+		},
+		PrevNode: prevNode,
+		Index:    index,
+	}
+	s.addEvent(rsp)
+	return rsp
+}
+
+func (s *raftKVStore) applyDelete(op *raftKVOp, index uint64) (*client.Response, error) {
+	key := cleanRaftKey(op.Key)
+	if key == "/" {
+		return nil, newRaftKVError(client.ErrorCodeRootROnly, "Root is read only", key, s.index)
+	}
+	n := s.find(key)
+	if n == nil {
+		return nil, newRaftKVError(client.ErrorCodeKeyNotFound, "Key not found", key, s.index)
+	}
+	action := raftActionDelete
+	if op.PrevValue != "" || op.PrevIndex != 0 {
+		if n.dir {
+			return nil, newRaftKVError(client.ErrorCodeNotFile, "Not a file", key, s.index)
+		}
+		if ok, cause := s.compare(n, op.PrevValue, op.PrevIndex); !ok {
+			return nil, newRaftKVError(client.ErrorCodeTestFailed, "Compare failed", cause, s.index)
+		}
+		action = raftActionCompareAndDelete
+	}
+	if n.dir {
+		if !op.Dir && !op.Recursive {
+			return nil, newRaftKVError(client.ErrorCodeNotFile, "Not a file", key, s.index)
+		}
+		if !op.Recursive && len(n.children) > 0 {
+			return nil, newRaftKVError(client.ErrorCodeDirNotEmpty, "Directory not empty", key, s.index)
+		}
+	}
+	return s.remove(n, action, index), nil
+}
+
+func (s *raftKVStore) applyExpire(op *raftKVOp, index uint64) (*client.Response, error) {
+	n, ok := s.ttlKeys[cleanRaftKey(op.Key)]
+	if !ok || n.modifiedIndex != op.PrevIndex {
+		// refreshed or changed after the expire proposed
+		return nil, nil
+	}
+	return s.remove(n, raftActionExpire, index), nil
+}
+
+// ExpiredOps return the expire operations for all the keys expired before now,
+// the key will not be expired if it is modified before the operation applied.
+func (s *raftKVStore) ExpiredOps(now int64) []*raftKVOp {
+	s.RLock()
+	defer s.RUnlock()
+	var ops []*raftKVOp
+	for key, n := range s.ttlKeys {
+		if n.expireAt > 0 && n.expireAt <= now {
+			ops = append(ops, &raftKVOp{Op: raftOpExpire, Key: key, PrevIndex: n.modifiedIndex})
+		}
+	}
+	return ops
+}
+
+func (s *raftKVStore) Save() ([]byte, error) {
+	s.RLock()
+	defer s.RUnlock()
+	snap := raftKVSnapshot{Index: s.index}
+	var walk func(n *raftKVNode)
+	walk = func(n *raftKVNode) {
+		for _, child := range n.children {
+			snap.Nodes = append(snap.Nodes, raftKVSnapNode{
+				Key:           child.key,
+				Value:         child.value,
+				Dir:           child.dir,
+				CreatedIndex:  child.createdIndex,
+				ModifiedIndex: child.modifiedIndex,
+				ExpireAt:      child.expireAt,
+			})
+			if child.dir {
+				walk(child)
+			}
+		}
+	}
+	walk(s.root)
+	return json.Marshal(&snap)
+}
+
+// Recovery reset the state from the snapshot data, the watch history before
+// the snapshot is cleared.
+func (s *raftKVStore) Recovery(data []byte) error {
+	var snap raftKVSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return err
+	}
+	root := newRaftKVDirNode("/", 0)
+	ttlKeys := make(map[string]*raftKVNode)
+	nodes := map[string]*raftKVNode{"/": root}
+	// the parent is always saved before the children
+	for _, sn := range snap.Nodes {
+		parent, ok := nodes[path.Dir(sn.Key)]
+		if !ok {
+			return fmt.Errorf("parent of key %v missing in snapshot", sn.Key)
+		}
+		n := &raftKVNode{
+			key:           sn.Key,
+			value:         sn.Value,
+			dir:           sn.Dir,
+			createdIndex:  sn.CreatedIndex,
+			modifiedIndex: sn.ModifiedIndex,
+			expireAt:      sn.ExpireAt,
+		}
+		if n.dir {
+			n.children = make(map[string]*raftKVNode)
+			nodes[n.key] = n
+		}
+		if n.expireAt > 0 {
+			ttlKeys[n.key] = n
+		}
+		parent.children[path.Base(n.key)] = n
+	}
+	s.Lock()
+	s.root = root
+	s.ttlKeys = ttlKeys
+	s.index = snap.Index
+	s.history = nil
+	s.historyStart = snap.Index + 1
+	close(s.notifyCh)
+	s.notifyCh = make(chan struct{})
+	s.Unlock()
+	return nil
+}
@@ -0,0 +1,820 @@
+package consistence
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"github.com/coreos/etcd/raft"
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/coreos/etcd/snap"
+	"github.com/coreos/etcd/wal"
+	"github.com/coreos/etcd/wal/walpb"
+	"golang.org/x/net/context"
+)
+
+const (
+	LeadershipBackendEtcd = "etcd"
+	LeadershipBackendRaft = "raft"
+)
+
+const (
+	raftMessagePath = "/raft/message"
+	raftStatusPath  = "/raft/status"
+	raftKeysPrefix  = "/v2/keys"
+
+	raftDefaultSnapCount    = 10000
+	raftCatchUpEntries      = 5000
+	raftDefaultTickInterval = time.Millisecond * 100
+	raftElectionTicks       = 10
+	raftProposeTimeout      = time.Second * 3
+	raftExpireCheckInterval = time.Millisecond * 500
+	raftPeerQueueSize       = 4096
+)
+
+var (
+	ErrRaftStoreStopped = errors.New("raft store stopped")
+	ErrRaftProposeLost  = errors.New("raft proposal timeout, maybe no leader")
+	ErrRaftNoLeader     = errors.New("raft leader not elected")
+	ErrRaftStoreFailed  = errors.New("raft store failed to persist the raft state")
+)
+
+type RaftStoreConfig struct {
+	// the raft member id, which is the index (start from 1) of this member in Peers
+	ID uint64
+	// the http address of all the raft members, the leadership clients (both nsqd
+	// and nsqlookupd) should use these addresses as the leadership addresses.
+	Peers []string
+	// default to listen on the address of this member in Peers
+	ListenAddress string
+	DataDir       string
+	SnapCount     uint64
+	TickInterval  time.Duration
+}
+
+type raftProposeResult struct {
+	rsp *client.Response
+	err error
+}
+
+// RaftStore is the leadership store embedded in the nsqlookupd, the data is
+// replicated by raft between the nsqlookupd members and served by the etcd v2
+// keys http api, so both the nsqd and nsqlookupd can use the etcd leadership
+// implementations on it and no external etcd cluster is needed.
+type RaftStore struct {
+	conf        RaftStoreConfig
+	kv          *raftKVStore
+	node        raft.Node
+	raftStorage *raft.MemoryStorage
+	wal         *wal.WAL
+	snapshotter *snap.Snapshotter
+
+	confState     raftpb.ConfState
+	snapshotIndex uint64
+	appliedIndex  uint64
+	leader        uint64
+
+	reqIDGen  uint64
+	waitMutex sync.Mutex
+	waits     map[uint64]chan raftProposeResult
+
+	peerQueues map[uint64]chan raftpb.Message
+	httpClient *http.Client
+	httpServer *http.Server
+
+	stopC   chan struct{}
+	stopped int32
+	wg      sync.WaitGroup
+	// closed if the raft state can not be saved, the store is stopped since it
+	// can not continue without losing the data.
+	failedC chan struct{}
+	failed  int32
+	// make the wal save failed, only for test
+	testSaveFailed int32
+}
+
+func NewRaftStore(conf RaftStoreConfig) (*RaftStore, error) {
+	if conf.ID == 0 || conf.ID > uint64(len(conf.Peers)) {
+		return nil, fmt.Errorf("invalid raft member id %v for peers: %v", conf.ID, conf.Peers)
+	}
+	if conf.DataDir == "" {
+		return nil, errors.New("raft data dir should not be empty")
+	}
+	if conf.SnapCount == 0 {
+		conf.SnapCount = raftDefaultSnapCount
+	}
+	if conf.TickInterval == 0 {
+		conf.TickInterval = raftDefaultTickInterval
+	}
+	peers := make([]string, 0, len(conf.Peers))
+	for _, p := range conf.Peers {
+		p = strings.TrimSpace(p)
+		if !strings.Contains(p, "://") {
+			p = "http://" + p
+		}
+		peers = append(peers, strings.TrimRight(p, "/"))
+	}
+	conf.Peers = peers
+	if conf.ListenAddress == "" {
+		u, err := url.Parse(conf.Peers[conf.ID-1])
+		if err != nil {
+			return nil, err
+		}
+		conf.ListenAddress = u.Host
+	}
+	rs := &RaftStore{
+		conf:        conf,
+		kv:          newRaftKVStore(),
+		raftStorage: raft.NewMemoryStorage(),
+		reqIDGen:    uint64(time.Now().UnixNano()) & 0xffffffffffff,
+		waits:       make(map[uint64]chan raftProposeResult),
+		peerQueues:  make(map[uint64]chan raftpb.Message),
+		httpClient:  &http.Client{Timeout: time.Second * 5},
+		stopC:       make(chan struct{}),
+		failedC:     make(chan struct{}),
+	}
+	return rs, nil
+}
+
+// Addresses return the leadership addresses used by the etcd client.
+func (rs *RaftStore) Addresses() string {
+	return strings.Join(rs.conf.Peers, ",")
+}
+
+// Failed return the channel closed after the store failed and stopped, the leadership
+// depending on this member (such as the nsqlookupd leader) should be given up.
+func (rs *RaftStore) Failed() <-chan struct{} {
+	return rs.failedC
+}
+
+func (rs *RaftStore) IsFailed() bool {
+	return atomic.LoadInt32(&rs.failed) == 1
+}
+
+func (rs *RaftStore) IsLeader() bool {
+	return atomic.LoadUint64(&rs.leader) == rs.conf.ID
+}
+
+// WaitLeader wait until the leader of the raft members is elected, the store
+// can not serve any request before that.
+func (rs *RaftStore) WaitLeader(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadUint64(&rs.leader) == 0 {
+		if time.Now().After(deadline) {
+			return ErrRaftNoLeader
+		}
+		select {
+		case <-rs.stopC:
+			return ErrRaftStoreStopped
+		case <-time.After(rs.conf.TickInterval):
+		}
+	}
+	return nil
+}
+
+func (rs *RaftStore) Start() error {
+	if err := rs.openStorage(); err != nil {
+		return err
+	}
+	c := &raft.Config{
+		ID:              rs.conf.ID,
+		ElectionTick:    raftElectionTicks,
+		HeartbeatTick:   1,
+		Storage:         rs.raftStorage,
+		Applied:         rs.appliedIndex,
+		MaxSizePerMsg:   1024 * 1024,
+		MaxInflightMsgs: 256,
+		CheckQuorum:     true,
+		Logger:          &raftLogger{},
+	}
+	if rs.hasOldWAL() {
+		rs.node = raft.RestartNode(c)
+	} else {
+		peers := make([]raft.Peer, len(rs.conf.Peers))
+		for i := range peers {
+			peers[i] = raft.Peer{ID: uint64(i + 1)}
+		}
+		rs.node = raft.StartNode(c, peers)
+	}
+
+	ln, err := net.Listen("tcp", rs.conf.ListenAddress)
+	if err != nil {
+		rs.node.Stop()
+		rs.wal.Close()
+		return err
+	}
+	coordLog.Infof("raft store %v listening on %v, peers: %v", rs.conf.ID, ln.Addr(), rs.conf.Peers)
+	mux := http.NewServeMux()
+	mux.HandleFunc(raftMessagePath, rs.handleRaftMessage)
+	mux.HandleFunc(raftStatusPath, rs.handleRaftStatus)
+	mux.HandleFunc(raftKeysPrefix, rs.handleKeys)
+	mux.HandleFunc(raftKeysPrefix+"/", rs.handleKeys)
+	rs.httpServer = &http.Server{Handler: mux}
+	go rs.httpServer.Serve(ln)
+
+	for i := range rs.conf.Peers {
+		id := uint64(i + 1)
+		if id == rs.conf.ID {
+			continue
+		}
+		q := make(chan raftpb.Message, raftPeerQueueSize)
+		rs.peerQueues[id] = q
+		rs.wg.Add(1)
+		go rs.sendLoop(id, q)
+	}
+	rs.wg.Add(2)
+	go rs.serveChannels()
+	go rs.expireLoop()
+	return nil
+}
+
+func (rs *RaftStore) Stop() {
+	if !atomic.CompareAndSwapInt32(&rs.stopped, 0, 1) {
+		return
+	}
+	close(rs.stopC)
+	if rs.httpServer != nil {
+		// close all the connections so the clients will not reuse them
+		rs.httpServer.Close()
+	}
+	rs.wg.Wait()
+	if rs.node != nil {
+		rs.node.Stop()
+	}
+	if rs.wal != nil {
+		rs.wal.Close()
+	}
+	coordLog.Infof("raft store %v stopped", rs.conf.ID)
+}
+
+func (rs *RaftStore) walDir() string {
+	return filepath.Join(rs.conf.DataDir, "wal")
+}
+
+func (rs *RaftStore) snapDir() string {
+	return filepath.Join(rs.conf.DataDir, "snap")
+}
+
+func (rs *RaftStore) hasOldWAL() bool {
+	st, _, _ := rs.raftStorage.InitialState()
+	return !raft.IsEmptyHardState(st) || rs.appliedIndex > 0
+}
+
+// openStorage replay the snapshot and the wal to the memory storage
+func (rs *RaftStore) openStorage() error {
+	if err := os.MkdirAll(rs.snapDir(), 0755); err != nil {
+		return err
+	}
+	rs.snapshotter = snap.New(rs.snapDir())
+	snapshot, err := rs.snapshotter.Load()
+	if err != nil && err != snap.ErrNoSnapshot {
+		return err
+	}
+	walSnap := walpb.Snapshot{}
+	if snapshot != nil {
+		walSnap.Index, walSnap.Term = snapshot.Metadata.Index, snapshot.Metadata.Term
+		if err := rs.kv.Recovery(snapshot.Data); err != nil {
+			return err
+		}
+		rs.raftStorage.ApplySnapshot(*snapshot)
+		rs.confState = snapshot.Metadata.ConfState
+		rs.snapshotIndex = snapshot.Metadata.Index
+		rs.appliedIndex = snapshot.Metadata.Index
+	}
+	if !wal.Exist(rs.walDir()) {
+		w, err := wal.Create(rs.walDir(), nil)
+		if err != nil {
+			return err
+		}
+		w.Close()
+	}
+	w, err := wal.Open(rs.walDir(), walSnap)
+	if err != nil {
+		return err
+	}
+	_, st, ents, err := w.ReadAll()
+	if err != nil {
+		w.Close()
+		return err
+	}
+	rs.raftStorage.SetHardState(st)
+	rs.raftStorage.Append(ents)
+	rs.wal = w
+	return nil
+}
+
+func (rs *RaftStore) serveChannels() {
+	defer rs.wg.Done()
+	ticker := time.NewTicker(rs.conf.TickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			rs.node.Tick()
+		case rd := <-rs.node.Ready():
+			if rd.SoftState != nil {
+				atomic.StoreUint64(&rs.leader, rd.SoftState.Lead)
+			}
+			if err := rs.saveWAL(rd.HardState, rd.Entries); err != nil {
+				rs.fail(fmt.Errorf("save wal failed: %v", err))
+				return
+			}
+			if !raft.IsEmptySnap(rd.Snapshot) {
+				if err := rs.saveSnap(rd.Snapshot); err != nil {
+					rs.fail(fmt.Errorf("save snapshot failed: %v", err))
+					return
+				}
+				rs.raftStorage.ApplySnapshot(rd.Snapshot)
+				rs.applySnapshot(rd.Snapshot)
+			}
+			rs.raftStorage.Append(rd.Entries)
+			rs.send(rd.Messages)
+			rs.applyEntries(rd.CommittedEntries)
+			rs.maybeTriggerSnapshot()
+			rs.node.Advance()
+		case <-rs.stopC:
+			return
+		}
+	}
+}
+
+func (rs *RaftStore) saveWAL(st raftpb.HardState, ents []raftpb.Entry) error {
+	if atomic.LoadInt32(&rs.testSaveFailed) == 1 {
+		return ErrRaftStoreFailed
+	}
+	return rs.wal.Save(st, ents)
+}
+
+// fail is called by the raft loop if the raft state can not be persisted. The raft
+// messages should not be sent without the state saved, so the store is stopped to
+// let the other members elect a new leader and the clients retry on the other members.
+func (rs *RaftStore) fail(err error) {
+	coordLog.Errorf("raft store %v failed and will be stopped: %v", rs.conf.ID, err)
+	if atomic.CompareAndSwapInt32(&rs.failed, 0, 1) {
+		close(rs.failedC)
+	}
+	// the raft loop should exit before stopping
+	go rs.Stop()
+}
+
+func (rs *RaftStore) saveSnap(s raftpb.Snapshot) error {
+	if err := rs.snapshotter.SaveSnap(s); err != nil {
+		return err
+	}
+	return rs.wal.SaveSnapshot(walpb.Snapshot{Index: s.Metadata.Index, Term: s.Metadata.Term})
+}
+
+func (rs *RaftStore) applySnapshot(s raftpb.Snapshot) {
+	if s.Metadata.Index <= rs.appliedIndex {
+		return
+	}
+	coordLog.Infof("raft store %v applying snapshot at index %v", rs.conf.ID, s.Metadata.Index)
+	if err := rs.kv.Recovery(s.Data); err != nil {
+		coordLog.Errorf("raft store recovery from snapshot failed: %v", err)
+		return
+	}
+	rs.confState = s.Metadata.ConfState
+	rs.snapshotIndex = s.Metadata.Index
+	rs.appliedIndex = s.Metadata.Index
+}
+
+func (rs *RaftStore) applyEntries(ents []raftpb.Entry) {
+	for _, ent := range ents {
+		if ent.Index <= rs.appliedIndex {
+			continue
+		}
+		switch ent.Type {
+		case raftpb.EntryNormal:
+			if len(ent.Data) > 0 {
+				rs.applyOp(ent)
+			}
+		case raftpb.EntryConfChange:
+			var cc raftpb.ConfChange
+			if err := cc.Unmarshal(ent.Data); err != nil {
+				coordLog.Errorf("raft store unmarshal conf change failed: %v", err)
+			} else {
+				rs.confState = *rs.node.ApplyConfChange(cc)
+			}
+		}
+		rs.appliedIndex = ent.Index
+	}
+}
+
+func (rs *RaftStore) applyOp(ent raftpb.Entry) {
+	var op raftKVOp
+	var result raftProposeResult
+	if err := json.Unmarshal(ent.Data, &op); err != nil {
+		coordLog.Errorf("raft store unmarshal entry %v failed: %v", ent.Index, err)
+		return
+	}
+	result.rsp, result.err = rs.kv.Apply(&op, ent.Index)
+	if op.ReqID == 0 {
+		return
+	}
+	rs.waitMutex.Lock()
+	ch, ok := rs.waits[op.ReqID]
+	delete(rs.waits, op.ReqID)
+	rs.waitMutex.Unlock()
+	if ok {
+		ch <- result
+	}
+}
+
+func (rs *RaftStore) maybeTriggerSnapshot() {
+	if rs.appliedIndex-rs.snapshotIndex <= rs.conf.SnapCount {
+		return
+	}
+	data, err := rs.kv.Save()
+	if err != nil {
+		coordLog.Errorf("raft store save state failed: %v", err)
+		return
+	}
+	s, err := rs.raftStorage.CreateSnapshot(rs.appliedIndex, &rs.confState, data)
+	if err != nil {
+		coordLog.Errorf("raft store create snapshot failed: %v", err)
+		return
+	}
+	if err := rs.saveSnap(s); err != nil {
+		coordLog.Errorf("raft store save snapshot failed: %v", err)
+		return
+	}
+	compactIndex := uint64(1)
+	if rs.appliedIndex > raftCatchUpEntries {
+		compactIndex = rs.appliedIndex - raftCatchUpEntries
+	}
+	if err := rs.raftStorage.Compact(compactIndex); err != nil && err != raft.ErrCompacted {
+		coordLog.Warningf("raft store compact log failed: %v", err)
+	}
+	coordLog.Infof("raft store %v snapshot at index %v, compacted to %v", rs.conf.ID, rs.appliedIndex, compactIndex)
+	rs.snapshotIndex = rs.appliedIndex
+}
+
+// expireLoop propose the expire for the ttl keys, only the leader will do this.
+func (rs *RaftStore) expireLoop() {
+	defer rs.wg.Done()
+	ticker := time.NewTicker(raftExpireCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if !rs.IsLeader() {
+				continue
+			}
+			for _, op := range rs.kv.ExpiredOps(time.Now().UnixNano()) {
+				data, _ := json.Marshal(op)
+				ctx, cancel := context.WithTimeout(context.Background(), raftProposeTimeout)
+				err := rs.node.Propose(ctx, data)
+				cancel()
+				if err != nil {
+					coordLog.Infof("raft store propose expire %v failed: %v", op.Key, err)
+					break
+				}
+			}
+		case <-rs.stopC:
+			return
+		}
+	}
+}
+
+func (rs *RaftStore) send(msgs []raftpb.Message) {
+	for _, m := range msgs {
+		q, ok := rs.peerQueues[m.To]
+		if !ok {
+			continue
+		}
+		select {
+		case q <- m:
+		default:
+			rs.node.ReportUnreachable(m.To)
+			if m.Type == raftpb.MsgSnap {
+				rs.node.ReportSnapshot(m.To, raft.SnapshotFailure)
+			}
+		}
+	}
+}
+
+func (rs *RaftStore) sendLoop(id uint64, q chan raftpb.Message) {
+	defer rs.wg.Done()
+	target := rs.conf.Peers[id-1] + raftMessagePath
+	for {
+		select {
+		case m := <-q:
+			err := rs.postMessage(target, m)
+			if err != nil {
+				rs.node.ReportUnreachable(m.To)
+			}
+			if m.Type == raftpb.MsgSnap {
+				if err != nil {
+					rs.node.ReportSnapshot(m.To, raft.SnapshotFailure)
+				} else {
+					rs.node.ReportSnapshot(m.To, raft.SnapshotFinish)
+				}
+			}
+		case <-rs.stopC:
+			return
+		}
+	}
+}
+
+func (rs *RaftStore) postMessage(target string, m raftpb.Message) error {
+	data, err := m.Marshal()
+	if err != nil {
+		return err
+	}
+	rsp, err := rs.httpClient.Post(target, "application/protobuf", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	ioutil.ReadAll(rsp.Body)
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("send raft message to %v failed: %v", target, rsp.Status)
+	}
+	return nil
+}
+
+func (rs *RaftStore) handleRaftMessage(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	data, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var m raftpb.Message
+	if err := m.Unmarshal(data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := rs.node.Step(context.Background(), m); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (rs *RaftStore) handleRaftStatus(w http.ResponseWriter, req *http.Request) {
+	st := rs.node.Status()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":            rs.conf.ID,
+		"leader":        st.Lead,
+		"term":          st.Term,
+		"commit":        st.Commit,
+		"applied_index": st.Applied,
+		"store_index":   rs.kv.CurrentIndex(),
+		"peers":         rs.conf.Peers,
+	})
+}
+
+func (rs *RaftStore) propose(ctx context.Context, op *raftKVOp) (*client.Response, error) {
+	op.ReqID = rs.conf.ID<<48 | (atomic.AddUint64(&rs.reqIDGen, 1) & 0xffffffffffff)
+	data, err := json.Marshal(op)
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan raftProposeResult, 1)
+	rs.waitMutex.Lock()
+	rs.waits[op.ReqID] = ch
+	rs.waitMutex.Unlock()
+	defer func() {
+		rs.waitMutex.Lock()
+		delete(rs.waits, op.ReqID)
+		rs.waitMutex.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, raftProposeTimeout)
+	defer cancel()
+	if err := rs.node.Propose(ctx, data); err != nil {
+		return nil, err
+	}
+	select {
+	case r := <-ch:
+		return r.rsp, r.err
+	case <-ctx.Done():
+		return nil, ErrRaftProposeLost
+	case <-rs.stopC:
+		return nil, ErrRaftStoreStopped
+	}
+}
+
+func writeRaftKeysResponse(w http.ResponseWriter, rsp *client.Response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Etcd-Index", strconv.FormatUint(rsp.Index, 10))
+	if rsp.Action == raftActionCreate {
+		w.WriteHeader(http.StatusCreated)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	json.NewEncoder(w).Encode(rsp)
+}
+
+func writeRaftKeysError(w http.ResponseWriter, err error, index uint64) {
+	cerr, ok := err.(client.Error)
+	if !ok {
+		cerr = client.Error{Code: client.ErrorCodeRaftInternal, Message: "Raft Internal Error", Cause: err.Error(), Index: index}
+	}
+	status := http.StatusBadRequest
+	switch cerr.Code {
+	case client.ErrorCodeKeyNotFound:
+		status = http.StatusNotFound
+	case client.ErrorCodeNotFile, client.ErrorCodeNotDir, client.ErrorCodeRootROnly, client.ErrorCodeDirNotEmpty:
+		status = http.StatusForbidden
+	case client.ErrorCodeTestFailed, client.ErrorCodeNodeExist:
+		status = http.StatusPreconditionFailed
+	case client.ErrorCodeRaftInternal, client.ErrorCodeLeaderElect:
+		// the client will retry on other members
+		status = http.StatusInternalServerError
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Etcd-Index", strconv.FormatUint(cerr.Index, 10))
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(cerr)
+}
+
+func parseRaftBoolParam(req *http.Request, name string) bool {
+	b, _ := strconv.ParseBool(req.Form.Get(name))
+	return b
+}
+
+// handleKeys serve the subset of the etcd v2 keys api used by the etcd client.
+func (rs *RaftStore) handleKeys(w http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		writeRaftKeysError(w, client.Error{Code: client.ErrorCodeInvalidForm, Message: "Invalid form", Cause: err.Error()}, rs.kv.CurrentIndex())
+		return
+	}
+	key := path.Clean("/" + strings.TrimPrefix(req.URL.Path, raftKeysPrefix))
+	var prevIndex uint64
+	if s := req.Form.Get("prevIndex"); s != "" {
+		var err error
+		prevIndex, err = strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			writeRaftKeysError(w, client.Error{Code: client.ErrorCodeIndexNaN, Message: "The given index in POST form is not a number", Cause: s}, rs.kv.CurrentIndex())
+			return
+		}
+	}
+	var rsp *client.Response
+	var err error
+	switch req.Method {
+	case "GET":
+		if parseRaftBoolParam(req, "wait") {
+			rs.handleWatch(w, req, key)
+			return
+		}
+		if parseRaftBoolParam(req, "quorum") {
+			// make sure all the committed changes before this read are applied
+			_, err = rs.propose(req.Context(), &raftKVOp{Op: raftOpSync})
+		}
+		if err == nil {
+			rsp, err = rs.kv.Get(key, parseRaftBoolParam(req, "recursive"), parseRaftBoolParam(req, "sorted"))
+		}
+	case "PUT":
+		op := &raftKVOp{
+			Op:        raftOpSet,
+			Key:       key,
+			Value:     req.Form.Get("value"),
+			Dir:       parseRaftBoolParam(req, "dir"),
+			PrevValue: req.Form.Get("prevValue"),
+			PrevIndex: prevIndex,
+			PrevExist: req.Form.Get("prevExist"),
+			Refresh:   parseRaftBoolParam(req, "refresh"),
+		}
+		if s := req.Form.Get("ttl"); s != "" {
+			ttl, perr := strconv.ParseUint(s, 10, 64)
+			if perr != nil {
+				writeRaftKeysError(w, client.Error{Code: client.ErrorCodeTTLNaN, Message: "The given TTL in POST form is not a number", Cause: s}, rs.kv.CurrentIndex())
+				return
+			}
+			if ttl > 0 {
+				op.ExpireAt = time.Now().Add(time.Duration(ttl) * time.Second).UnixNano()
+			}
+		}
+		rsp, err = rs.propose(req.Context(), op)
+	case "DELETE":
+		rsp, err = rs.propose(req.Context(), &raftKVOp{
+			Op:        raftOpDelete,
+			Key:       key,
+			Dir:       parseRaftBoolParam(req, "dir"),
+			Recursive: parseRaftBoolParam(req, "recursive"),
+			PrevValue: req.Form.Get("prevValue"),
+			PrevIndex: prevIndex,
+		})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		writeRaftKeysError(w, err, rs.kv.CurrentIndex())
+		return
+	}
+	writeRaftKeysResponse(w, rsp)
+}
+
+// handleWatch write the header at once and the event after it happened, which
+// is the same as etcd so the header timeout in client will not be triggered.
+func (rs *RaftStore) handleWatch(w http.ResponseWriter, req *http.Request, key string) {
+	recursive := parseRaftBoolParam(req, "recursive")
+	var waitIndex uint64
+	if s := req.Form.Get("waitIndex"); s != "" {
+		waitIndex, _ = strconv.ParseUint(s, 10, 64)
+	}
+	curIndex := rs.kv.CurrentIndex()
+	rsp, waitIndex, ch, err := rs.kv.Watch(key, recursive, waitIndex)
+	if err != nil {
+		writeRaftKeysError(w, err, curIndex)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Etcd-Index", strconv.FormatUint(curIndex, 10))
+	w.WriteHeader(http.StatusOK)
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	for rsp == nil {
+		select {
+		case <-ch:
+		case <-req.Context().Done():
+			return
+		case <-rs.stopC:
+			return
+		}
+		rsp, waitIndex, ch, err = rs.kv.Watch(key, recursive, waitIndex)
+		if err != nil {
+			// the client will get the empty body error and watch again
+			return
+		}
+	}
+	json.NewEncoder(w).Encode(rsp)
+}
+
+type raftLogger struct{}
+
+func (l *raftLogger) Debug(v ...interface{}) {
+	coordLog.Debugf("%v", fmt.Sprint(v...))
+}
+
+func (l *raftLogger) Debugf(format string, v ...interface{}) {
+	coordLog.Debugf(format, v...)
+}
+
+func (l *raftLogger) Error(v ...interface{}) {
+	coordLog.Errorf("%v", fmt.Sprint(v...))
+}
+
+func (l *raftLogger) Errorf(format string, v ...interface{}) {
+	coordLog.Errorf(format, v...)
+}
+
+func (l *raftLogger) Info(v ...interface{}) {
+	coordLog.Infof("%v", fmt.Sprint(v...))
+}
+
+func (l *raftLogger) Infof(format string, v ...interface{}) {
+	coordLog.Infof(format, v...)
+}
+
+func (l *raftLogger) Warning(v ...interface{}) {
+	coordLog.Warningf("%v", fmt.Sprint(v...))
+}
+
+func (l *raftLogger) Warningf(format string, v ...interface{}) {
+	coordLog.Warningf(format, v...)
+}
+
+func (l *raftLogger) Fatal(v ...interface{}) {
+	coordLog.Errorf("%v", fmt.Sprint(v...))
+	os.Exit(1)
+}
+
+func (l *raftLogger) Fatalf(format string, v ...interface{}) {
+	coordLog.Errorf(format, v...)
+	os.Exit(1)
+}
+
+func (l *raftLogger) Panic(v ...interface{}) {
+	s := fmt.Sprint(v...)
+	coordLog.Errorf("%v", s)
+	panic(s)
+}
+
+func (l *raftLogger) Panicf(format string, v ...interface{}) {
+	s := fmt.Sprintf(format, v...)
+	coordLog.Errorf("%v", s)
+	panic(s)
+}
@@ -0,0 +1,417 @@
+package consistence
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"github.com/youzan/nsq/internal/test"
+	"golang.org/x/net/context"
+)
+
+func getFreeTestAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	test.Nil(t, err)
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+func startTestRaftStores(t *testing.T, dir string, num int) []*RaftStore {
+	peers := make([]string, 0, num)
+	for i := 0; i < num; i++ {
+		peers = append(peers, getFreeTestAddr(t))
+	}
+	stores := make([]*RaftStore, 0, num)
+	for i := 0; i < num; i++ {
+		rs, err := NewRaftStore(RaftStoreConfig{
+			ID:      uint64(i + 1),
+			Peers:   peers,
+			DataDir: filepath.Join(dir, fmt.Sprintf("raft-%v", i+1)),
+		})
+		test.Nil(t, err)
+		test.Nil(t, rs.Start())
+		stores = append(stores, rs)
+	}
+	for _, rs := range stores {
+		test.Nil(t, rs.WaitLeader(time.Second*10))
+	}
+	return stores
+}
+
+func TestRaftKVStoreApply(t *testing.T) {
+	s := newRaftKVStore()
+	rsp, err := s.Apply(&raftKVOp{Op: raftOpSet, Key: "/a/b/c", Value: "v1", PrevExist: raftPrevExistFalse}, 3)
+	test.Nil(t, err)
+	test.Equal(t, raftActionCreate, rsp.Action)
+	test.Equal(t, uint64(3), rsp.Node.ModifiedIndex)
+
+	_, err = s.Apply(&raftKVOp{Op: raftOpSet, Key: "/a/b/c", Value: "v2", PrevExist: raftPrevExistFalse}, 4)
+	test.Equal(t, client.ErrorCodeNodeExist, err.(client.Error).Code)
+	_, err = s.Apply(&raftKVOp{Op: raftOpSet, Key: "/a/b/c/d", Value: "v2"}, 4)
+	test.Equal(t, client.ErrorCodeNotDir, err.(client.Error).Code)
+	_, err = s.Apply(&raftKVOp{Op: raftOpSet, Key: "/a/b", Dir: true}, 4)
+	test.Equal(t, client.ErrorCodeNotFile, err.(client.Error).Code)
+	_, err = s.Apply(&raftKVOp{Op: raftOpSet, Key: "/a/b/c", Value: "v2", PrevIndex: 2}, 4)
+	test.Equal(t, client.ErrorCodeTestFailed, err.(client.Error).Code)
+
+	rsp, err = s.Apply(&raftKVOp{Op: raftOpSet, Key: "/a/b/c", Value: "v2", PrevValue: "v1", PrevIndex: 3}, 5)
+	test.Nil(t, err)
+	test.Equal(t, raftActionCompareAndSwap, rsp.Action)
+	test.Equal(t, "v1", rsp.PrevNode.Value)
+	test.Equal(t, uint64(3), rsp.Node.CreatedIndex)
+
+	rsp, err = s.Get("/a", true, true)
+	test.Nil(t, err)
+	test.Equal(t, true, rsp.Node.Dir)
+	test.Equal(t, "/a/b/c", rsp.Node.Nodes[0].Nodes[0].Key)
+	test.Equal(t, "v2", rsp.Node.Nodes[0].Nodes[0].Value)
+	rsp, err = s.Get("/a", false, true)
+	test.Nil(t, err)
+	test.Equal(t, 0, len(rsp.Node.Nodes[0].Nodes))
+
+	// watch from the history
+	rsp, _, _, err = s.Watch("/a", true, 4)
+	test.Nil(t, err)
+	test.Equal(t, uint64(5), rsp.Index)
+	rsp, waitIndex, ch, err := s.Watch("/a/b/c", false, 0)
+	test.Nil(t, err)
+	test.Equal(t, true, rsp == nil)
+	test.Equal(t, uint64(6), waitIndex)
+
+	_, err = s.Apply(&raftKVOp{Op: raftOpDelete, Key: "/a"}, 6)
+	test.Equal(t, client.ErrorCodeNotFile, err.(client.Error).Code)
+	_, err = s.Apply(&raftKVOp{Op: raftOpDelete, Key: "/a", Dir: true}, 6)
+	test.Equal(t, client.ErrorCodeDirNotEmpty, err.(client.Error).Code)
+	_, err = s.Apply(&raftKVOp{Op: raftOpDelete, Key: "/a", Recursive: true}, 6)
+	test.Nil(t, err)
+	select {
+	case <-ch:
+	default:
+		t.Fatal("watch should be notified")
+	}
+	// the watched key is removed with the parent
+	rsp, _, _, err = s.Watch("/a/b/c", false, waitIndex)
+	test.Nil(t, err)
+	test.Equal(t, raftActionDelete, rsp.Action)
+	test.Equal(t, "/a", rsp.Node.Key)
+	_, err = s.Get("/a/b/c", false, false)
+	test.Equal(t, client.ErrorCodeKeyNotFound, err.(client.Error).Code)
+
+	// ttl
+	s.Apply(&raftKVOp{Op: raftOpSet, Key: "/ttl", Value: "v", ExpireAt: time.Now().Add(-time.Second).UnixNano()}, 7)
+	ops := s.ExpiredOps(time.Now().UnixNano())
+	test.Equal(t, 1, len(ops))
+	// refresh will cancel the expire proposed before
+	rsp, err = s.Apply(&raftKVOp{Op: raftOpSet, Key: "/ttl", Refresh: true, PrevExist: raftPrevExistTrue,
+		ExpireAt: time.Now().Add(time.Minute).UnixNano()}, 8)
+	test.Nil(t, err)
+	test.Equal(t, "v", rsp.Node.Value)
+	rsp, _ = s.Apply(ops[0], 9)
+	test.Equal(t, true, rsp == nil)
+	_, err = s.Get("/ttl", false, false)
+	test.Nil(t, err)
+	ops = s.ExpiredOps(time.Now().Add(time.Minute * 2).UnixNano())
+	test.Equal(t, 1, len(ops))
+	rsp, err = s.Apply(ops[0], 10)
+	test.Nil(t, err)
+	test.Equal(t, raftActionExpire, rsp.Action)
+	_, err = s.Get("/ttl", false, false)
+	test.Equal(t, client.ErrorCodeKeyNotFound, err.(client.Error).Code)
+
+	// snapshot
+	s.Apply(&raftKVOp{Op: raftOpSet, Key: "/x/y", Value: "v"}, 11)
+	data, err := s.Save()
+	test.Nil(t, err)
+	s2 := newRaftKVStore()
+	test.Nil(t, s2.Recovery(data))
+	rsp, err = s2.Get("/x/y", false, false)
+	test.Nil(t, err)
+	test.Equal(t, "v", rsp.Node.Value)
+	test.Equal(t, uint64(11), rsp.Index)
+	_, _, _, err = s2.Watch("/x/y", false, 11)
+	test.Equal(t, client.ErrorCodeEventIndexCleared, err.(client.Error).Code)
+}
+
+func TestRaftStoreWithEtcdClient(t *testing.T) {
+	coordLog.Logger = newTestLogger(t)
+	tmpDir, err := ioutil.TempDir("", "raft-store-test")
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	stores := startTestRaftStores(t, tmpDir, 3)
+	defer func() {
+		for _, rs := range stores {
+			rs.Stop()
+		}
+	}()
+
+	// each client only talk to one member to test the replication
+	clients := make([]*EtcdClient, 0, len(stores))
+	for _, rs := range stores {
+		c, err := NewEClient(rs.conf.Peers[rs.conf.ID-1], "", "")
+		test.Nil(t, err)
+		clients = append(clients, c)
+	}
+	rsp, err := clients[0].Create("/test/key1", "v1", 0)
+	test.Nil(t, err)
+	createIndex := rsp.Node.ModifiedIndex
+	_, err = clients[1].Create("/test/key1", "v1", 0)
+	test.Equal(t, true, IsEtcdNodeExist(err))
+
+	watcher := clients[2].Watch("/test", createIndex+1, true)
+	watchDone := make(chan *client.Response, 1)
+	go func() {
+		rsp, err := watcher.Next(context.Background())
+		test.Nil(t, err)
+		watchDone <- rsp
+	}()
+	rsp, err = clients[1].CompareAndSwap("/test/key1", "v2", 0, "v1", createIndex)
+	test.Nil(t, err)
+	test.Equal(t, "v2", rsp.Node.Value)
+	select {
+	case rsp := <-watchDone:
+		test.Equal(t, raftActionCompareAndSwap, rsp.Action)
+		test.Equal(t, "v2", rsp.Node.Value)
+	case <-time.After(time.Second * 5):
+		t.Fatal("watch timeout")
+	}
+
+	rsp, err = clients[2].GetNewest("/test/key1", false, false)
+	test.Nil(t, err)
+	test.Equal(t, "v2", rsp.Node.Value)
+	_, err = clients[0].CompareAndSwap("/test/key1", "v3", 0, "v1", 0)
+	test.Equal(t, true, isEtcdErrorNum(err, client.ErrorCodeTestFailed))
+
+	_, err = clients[0].CreateDir("/test/dir", 0)
+	test.Nil(t, err)
+	_, err = clients[0].CreateDir("/test/dir", 0)
+	test.Equal(t, true, IsEtcdNotFile(err))
+
+	// ttl key
+	_, err = clients[0].Set("/test/ttl", "v", 1)
+	test.Nil(t, err)
+	_, err = clients[1].SetWithTTL("/test/ttl", 1)
+	test.Nil(t, err)
+	rsp, err = clients[1].GetNewest("/test/ttl", false, false)
+	test.Nil(t, err)
+	test.Equal(t, "v", rsp.Node.Value)
+	time.Sleep(time.Second * 3)
+	_, err = clients[2].GetNewest("/test/ttl", false, false)
+	test.Equal(t, true, client.IsKeyNotFound(err))
+
+	// write is still available with one member down
+	stores[0].Stop()
+	for i := 1; i < len(stores); i++ {
+		test.Nil(t, stores[i].WaitLeader(time.Second*10))
+	}
+	for i := 0; i < 10; i++ {
+		_, err = clients[1].Set("/test/key2", "v", 0)
+		if err == nil {
+			break
+		}
+		time.Sleep(time.Second)
+	}
+	test.Nil(t, err)
+	rsp, err = clients[2].GetNewest("/test/key2", false, false)
+	test.Nil(t, err)
+	test.Equal(t, "v", rsp.Node.Value)
+}
+
+func TestRaftStoreSaveFailed(t *testing.T) {
+	coordLog.Logger = newTestLogger(t)
+	tmpDir, err := ioutil.TempDir("", "raft-store-test")
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	stores := startTestRaftStores(t, tmpDir, 3)
+	defer func() {
+		for _, rs := range stores {
+			rs.Stop()
+		}
+	}()
+	var leader *RaftStore
+	for _, rs := range stores {
+		if rs.IsLeader() {
+			leader = rs
+		}
+	}
+	test.NotNil(t, leader)
+	c, err := NewEClient(leader.Addresses(), "", "")
+	test.Nil(t, err)
+	_, err = c.Set("/failed/key1", "v", 0)
+	test.Nil(t, err)
+
+	atomic.StoreInt32(&leader.testSaveFailed, 1)
+	select {
+	case <-leader.Failed():
+	case <-time.After(time.Second * 5):
+		t.Fatal("raft store should fail while saving wal")
+	}
+	test.Equal(t, true, leader.IsFailed())
+	// the other members should elect a new leader and serve the clients
+	for _, rs := range stores {
+		if rs == leader {
+			continue
+		}
+		test.Equal(t, false, rs.IsFailed())
+	}
+	for i := 0; i < 10; i++ {
+		_, err = c.Set("/failed/key2", "v", 0)
+		if err == nil {
+			break
+		}
+		time.Sleep(time.Second)
+	}
+	test.Nil(t, err)
+	newLeader := 0
+	for _, rs := range stores {
+		if rs != leader && rs.IsLeader() {
+			newLeader++
+		}
+	}
+	test.Equal(t, 1, newLeader)
+}
+
+func TestRaftStoreRestart(t *testing.T) {
+	coordLog.Logger = newTestLogger(t)
+	tmpDir, err := ioutil.TempDir("", "raft-store-test")
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	addr := getFreeTestAddr(t)
+	conf := RaftStoreConfig{
+		ID:        1,
+		Peers:     []string{addr},
+		DataDir:   tmpDir,
+		SnapCount: 10,
+	}
+	rs, err := NewRaftStore(conf)
+	test.Nil(t, err)
+	test.Nil(t, rs.Start())
+	test.Nil(t, rs.WaitLeader(time.Second*10))
+	c, err := NewEClient(rs.Addresses(), "", "")
+	test.Nil(t, err)
+	for i := 0; i < 25; i++ {
+		_, err = c.Set(fmt.Sprintf("/restart/key%v", i), fmt.Sprintf("v%v", i), 0)
+		test.Nil(t, err)
+	}
+	rs.Stop()
+	names, _ := ioutil.ReadDir(filepath.Join(tmpDir, "snap"))
+	test.NotEqual(t, 0, len(names))
+
+	rs, err = NewRaftStore(conf)
+	test.Nil(t, err)
+	test.Nil(t, rs.Start())
+	defer rs.Stop()
+	test.Nil(t, rs.WaitLeader(time.Second*10))
+	rsp, err := c.GetNewest("/restart", true, true)
+	test.Nil(t, err)
+	test.Equal(t, 25, len(rsp.Node.Nodes))
+	for _, n := range rsp.Node.Nodes {
+		test.Equal(t, "v"+strings.TrimPrefix(n.Key, "/restart/key"), n.Value)
+	}
+}
+
+func TestRaftStoreLeadership(t *testing.T) {
+	coordLog.Logger = newTestLogger(t)
+	tmpDir, err := ioutil.TempDir("", "raft-store-test")
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	stores := startTestRaftStores(t, tmpDir, 3)
+	defer func() {
+		for _, rs := range stores {
+			rs.Stop()
+		}
+	}()
+	addrs := stores[0].Addresses()
+	clusterID := "test-nsq-cluster-unit-test-raft-leadership"
+
+	nodeMgr, err := NewNsqdEtcdMgr(addrs, "", "")
+	test.Nil(t, err)
+	nodeMgr.InitClusterID(clusterID)
+	nodeInfo := &NsqdNodeInfo{
+		ID:      "n-1",
+		NodeIP:  "127.0.0.1",
+		TcpPort: "2222",
+		RpcPort: "2223",
+	}
+	test.Nil(t, nodeMgr.RegisterNsqd(nodeInfo))
+
+	lookupdMgr, err := NewNsqLookupdEtcdMgr(addrs, "", "")
+	test.Nil(t, err)
+	lookupdMgr.InitClusterID(clusterID)
+	defer lookupdMgr.Stop()
+	lookupdInfo := &NsqLookupdNodeInfo{
+		ID:       "l-1",
+		NodeIP:   "127.0.0.1",
+		HttpPort: "8090",
+	}
+	test.Nil(t, lookupdMgr.Register(lookupdInfo))
+	defer lookupdMgr.Unregister(lookupdInfo)
+	lookupList, err := nodeMgr.GetAllLookupdNodes()
+	test.Nil(t, err)
+	test.Equal(t, 1, len(lookupList))
+
+	nsqds, err := lookupdMgr.GetNsqdNodes()
+	test.Nil(t, err)
+	test.Equal(t, 1, len(nsqds))
+	test.Equal(t, nodeInfo.ID, nsqds[0].ID)
+
+	stop := make(chan struct{})
+	lookupLeaderCh := make(chan *NsqLookupdNodeInfo, 1)
+	lookupdMgr.AcquireAndWatchLeader(lookupLeaderCh, stop)
+	select {
+	case leader := <-lookupLeaderCh:
+		test.Equal(t, lookupdInfo.ID, leader.ID)
+	case <-time.After(time.Second * 10):
+		t.Fatal("acquire lookup leader timeout")
+	}
+	nodeLeaderCh := make(chan *NsqLookupdNodeInfo, 1)
+	go nodeMgr.WatchLookupdLeader(nodeLeaderCh, stop)
+	select {
+	case leader := <-nodeLeaderCh:
+		test.Equal(t, lookupdInfo.ID, leader.ID)
+	case <-time.After(time.Second * 10):
+		t.Fatal("watch lookup leader timeout")
+	}
+
+	topicName := "raft-topic"
+	partition := 0
+	test.Nil(t, lookupdMgr.CreateTopic(topicName, &TopicMetaInfo{PartitionNum: 1, Replica: 1}))
+	test.Nil(t, lookupdMgr.CreateTopicPartition(topicName, partition))
+	test.NotNil(t, lookupdMgr.CreateTopicPartition(topicName, partition))
+	replicaInfo := &TopicPartitionReplicaInfo{
+		Leader: nodeInfo.GetID(),
+		ISR:    []string{nodeInfo.GetID()},
+	}
+	test.Nil(t, lookupdMgr.UpdateTopicNodeInfo(topicName, partition, replicaInfo, 0))
+	// the epoch mismatch should fail
+	test.NotNil(t, lookupdMgr.UpdateTopicNodeInfo(topicName, partition, replicaInfo, 0))
+
+	topicInfo, err := nodeMgr.GetTopicInfo(topicName, partition)
+	test.Nil(t, err)
+	test.Equal(t, nodeInfo.GetID(), topicInfo.Leader)
+	test.Equal(t, 1, topicInfo.PartitionNum)
+
+	test.Nil(t, nodeMgr.AcquireTopicLeader(topicName, partition, nodeInfo, topicInfo.Epoch))
+	session, err := lookupdMgr.GetTopicLeaderSession(topicName, partition)
+	test.Nil(t, err)
+	test.Equal(t, nodeInfo.GetID(), session.LeaderNode.GetID())
+	test.Nil(t, nodeMgr.ReleaseTopicLeader(topicName, partition, session))
+
+	test.Nil(t, lookupdMgr.DeleteWholeTopic(topicName))
+	exist, err := lookupdMgr.IsExistTopic(topicName)
+	test.Nil(t, err)
+	test.Equal(t, false, exist)
+	test.Nil(t, nodeMgr.UnregisterNsqd(nodeInfo))
+
+	// wait the leader lock released before the stores stopped
+	close(stop)
+	for range lookupLeaderCh {
+	}
+}
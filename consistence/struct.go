@@ -19,6 +19,8 @@ const (
 	NSQ_LOOKUPD_DIR            = "NsqlookupdInfo"
 	NSQ_LOOKUPD_NODE_DIR       = "NsqlookupdNodes"
 	NSQ_LOOKUPD_LEADER_SESSION = "LookupdLeaderSession"
+	NSQ_LOOKUPD_REASSIGN_PLAN  = "ReassignPlan"
+	NSQ_LOOKUPD_CONSUMER_GROUP = "ConsumerGroups"
 )
 
 const (
@@ -154,6 +154,11 @@ type TopicCoordinator struct {
 	disableWrite   int32
 	exiting        int32
 	basePath       string
+	// throttle the catchup data sent to the replicas of this topic partition
+	catchupThrottle catchupThrottle
+	// the last sync to each slave which may be still running after the write acknowledged,
+	// protected by writeHold. The next sync to the same slave should wait it to keep the order.
+	slaveSyncDone map[string]chan struct{}
 }
 
 func NewTopicCoordinatorWithFixMode(name string, partition int, basepath string,
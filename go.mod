@@ -27,6 +27,7 @@ require (
 	github.com/hashicorp/golang-lru v0.5.3
 	github.com/judwhite/go-svc v1.0.0
 	github.com/julienschmidt/httprouter v1.2.0
+	github.com/klauspost/compress v1.11.13
 	github.com/kr/pretty v0.2.0 // indirect
 	github.com/mreiferson/go-options v0.0.0-20161229190002-77551d20752b
 	github.com/myesui/uuid v1.0.0 // indirect
@@ -38,7 +39,9 @@ require (
 	github.com/viki-org/dnscache v0.0.0-20130720023526-c70c1f23c5d8
 	github.com/wendal/errors v0.0.0-20181209125328-7f31f4b264ec // indirect
 	github.com/youzan/go-nsq v1.6.1-HA
-	golang.org/x/net v0.0.0-20190311183353-d8887717615a
+	go.etcd.io/bbolt v1.3.5 // indirect
+	go.etcd.io/etcd v0.5.0-alpha.5.0.20200910180754-dd1b699fc489
+	golang.org/x/net v0.0.0-20190813141303-74dc4d7220e7
 	golang.org/x/sync v0.0.0-20190911185100-cd5d95a43a6e
 	google.golang.org/grpc v1.26.0
 	gopkg.in/stretchr/testify.v1 v1.2.2 // indirect
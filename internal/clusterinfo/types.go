@@ -542,18 +542,38 @@ type CatchupStat struct {
 	Progress int    `json:"progress"`
 }
 
+type TopicMirrorStat struct {
+	Source       string `json:"source"`
+	SourceNode   string `json:"source_node"`
+	Position     int64  `json:"position"`
+	LastLogID    int64  `json:"last_log_id"`
+	LagMsgs      int64  `json:"lag_msgs"`
+	LastSyncTime int64  `json:"last_sync_time"`
+	LastError    string `json:"last_error,omitempty"`
+}
+
 type TopicCoordStat struct {
-	Node         string        `json:"node"`
-	Name         string        `json:"name"`
-	Partition    int           `json:"partition"`
-	ISRStats     []ISRStat     `json:"isr_stats"`
-	CatchupStats []CatchupStat `json:"catchup_stats"`
-	DC           string        `json:"dc,omitempty"`
+	Node         string           `json:"node"`
+	Name         string           `json:"name"`
+	Partition    int              `json:"partition"`
+	ISRStats     []ISRStat        `json:"isr_stats"`
+	CatchupStats []CatchupStat    `json:"catchup_stats"`
+	MirrorStat   *TopicMirrorStat `json:"mirror_stat,omitempty"`
+	CatchupRate  int64            `json:"catchup_rate"`
+	DC           string           `json:"dc,omitempty"`
+}
+
+type CatchupThrottleStat struct {
+	RateLimit      int64 `json:"rate_limit"`
+	TopicRateLimit int64 `json:"topic_rate_limit"`
+	CurrentRate    int64 `json:"current_rate"`
+	WaitedMs       int64 `json:"waited_ms"`
 }
 
 type CoordStats struct {
-	RpcStats        *gorpc.ConnStats `json:"rpc_stats"`
-	TopicCoordStats []TopicCoordStat `json:"topic_coord_stats"`
+	RpcStats        *gorpc.ConnStats     `json:"rpc_stats"`
+	CatchupThrottle *CatchupThrottleStat `json:"catchup_throttle"`
+	TopicCoordStats []TopicCoordStat     `json:"topic_coord_stats"`
 }
 
 type MessageHistoryStat []int64
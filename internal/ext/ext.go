@@ -14,6 +14,34 @@ const (
 	TRACE_ID_KEY            = "##trace_id"
 	MaxExtLen               = 65535
 	ZAN_TEST_KEY = "zan_test"
+
+	// the unix timestamp in milliseconds, the message will be dropped if not delivered before it
+	EXPIRE_AT_KEY = "##expire_at"
+
+	// the producer id and the monotonically increasing sequence of the producer,
+	// used to deduplicate the retried message in the dedup window of the topic partition
+	PRODUCER_ID_KEY  = "##producer_id"
+	PRODUCER_SEQ_KEY = "##producer_seq"
+	// the unique key of the message used to deduplicate the retried message
+	DEDUP_KEY = "##dedup_key"
+
+	// the reserved keys for the message moved to the dead letter topic
+	DLQ_ORIG_TOPIC_KEY     = "##dlq_orig_topic"
+	DLQ_ORIG_PARTITION_KEY = "##dlq_orig_partition"
+	DLQ_ORIG_CHANNEL_KEY   = "##dlq_orig_channel"
+	DLQ_ORIG_MSGID_KEY     = "##dlq_orig_msgid"
+	DLQ_ATTEMPTS_KEY       = "##dlq_attempts"
+
+	// the key of the message in the compacted topic, only the newest message of each key
+	// is kept after compaction. The message with the tombstone (true) means the key is deleted.
+	COMPACT_KEY           = "##compact_key"
+	COMPACT_TOMBSTONE_KEY = "##compact_tombstone"
+
+	// the scheduled message will be kept in the delayed queue of the topic and published to
+	// all the channels at the given unix timestamp in milliseconds, or after the given milliseconds.
+	// The ##delay_until is used if both given.
+	DELAY_UNTIL_KEY = "##delay_until"
+	DELAY_MS_KEY    = "##delay_ms"
 )
 
 var MAX_TAG_LEN = 100
@@ -0,0 +1,172 @@
+package prometheus
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ContentType is the content type of the prometheus text exposition format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+const (
+	TypeCounter = "counter"
+	TypeGauge   = "gauge"
+	TypeSummary = "summary"
+)
+
+type Label struct {
+	Name  string
+	Value string
+}
+
+func L(name string, value string) Label {
+	return Label{Name: name, Value: value}
+}
+
+type sample struct {
+	suffix string
+	labels []Label
+	value  float64
+}
+
+type family struct {
+	name    string
+	help    string
+	typ     string
+	samples []sample
+}
+
+// Registry collects the samples for one scrape. The samples of the same
+// metric will be grouped together while writing since the text format
+// requires all the samples of one metric family are adjacent.
+type Registry struct {
+	prefix   string
+	families []*family
+	index    map[string]*family
+}
+
+func NewRegistry(prefix string) *Registry {
+	return &Registry{
+		prefix: prefix,
+		index:  make(map[string]*family),
+	}
+}
+
+func (r *Registry) getFamily(name string, help string, typ string) *family {
+	name = r.prefix + name
+	f, ok := r.index[name]
+	if !ok {
+		f = &family{name: name, help: help, typ: typ}
+		r.index[name] = f
+		r.families = append(r.families, f)
+	}
+	return f
+}
+
+func (r *Registry) add(name string, help string, typ string, suffix string, value float64, labels []Label) {
+	f := r.getFamily(name, help, typ)
+	f.samples = append(f.samples, sample{suffix: suffix, labels: labels, value: value})
+}
+
+func (r *Registry) Gauge(name string, help string, value float64, labels ...Label) {
+	r.add(name, help, TypeGauge, "", value, labels)
+}
+
+// Counter add the value of the monotonic counter, the name should end with _total
+// by the prometheus naming convention.
+func (r *Registry) Counter(name string, help string, value float64, labels ...Label) {
+	r.add(name, help, TypeCounter, "", value, labels)
+}
+
+// SummaryQuantile add the value for the quantile (0 ~ 1) of the summary metric
+func (r *Registry) SummaryQuantile(name string, help string, q float64, value float64, labels ...Label) {
+	ls := make([]Label, 0, len(labels)+1)
+	ls = append(ls, labels...)
+	ls = append(ls, L("quantile", formatFloat(q)))
+	r.add(name, help, TypeSummary, "", value, ls)
+}
+
+func (r *Registry) SummaryCount(name string, help string, count float64, labels ...Label) {
+	r.add(name, help, TypeSummary, "_count", count, labels)
+}
+
+func (r *Registry) Bytes() []byte {
+	var buf bytes.Buffer
+	r.WriteTo(&buf)
+	return buf.Bytes()
+}
+
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	for _, f := range r.families {
+		if f.help != "" {
+			buf.WriteString("# HELP ")
+			buf.WriteString(f.name)
+			buf.WriteByte(' ')
+			buf.WriteString(escapeHelp(f.help))
+			buf.WriteByte('\n')
+		}
+		buf.WriteString("# TYPE ")
+		buf.WriteString(f.name)
+		buf.WriteByte(' ')
+		buf.WriteString(f.typ)
+		buf.WriteByte('\n')
+		for _, s := range f.samples {
+			buf.WriteString(f.name)
+			buf.WriteString(s.suffix)
+			if len(s.labels) > 0 {
+				buf.WriteByte('{')
+				for i, l := range s.labels {
+					if i > 0 {
+						buf.WriteByte(',')
+					}
+					buf.WriteString(l.Name)
+					buf.WriteString(`="`)
+					buf.WriteString(escapeLabelValue(l.Value))
+					buf.WriteByte('"')
+				}
+				buf.WriteByte('}')
+			}
+			buf.WriteByte(' ')
+			buf.WriteString(formatFloat(s.value))
+			buf.WriteByte('\n')
+		}
+	}
+	n, err := w.Write(buf.Bytes())
+	return int64(n), err
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabelValue(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func BoolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,30 @@
+package prometheus
+
+import (
+	"testing"
+)
+
+func TestRegistryWriteText(t *testing.T) {
+	r := NewRegistry("nsq_")
+	r.Gauge("channel_depth", "depth of channel", 10, L("topic", "t1"), L("channel", "ch1"))
+	r.Counter("topic_messages_total", "", 3, L("topic", "t1"))
+	r.Gauge("channel_depth", "depth of channel", 2.5, L("topic", "t1"), L("channel", "a\"b\\c\nd"))
+	r.SummaryQuantile("e2e_latency", "e2e\nlatency", 0.99, 100, L("topic", "t1"))
+	r.SummaryCount("e2e_latency", "e2e\nlatency", 5, L("topic", "t1"))
+
+	expected := `# HELP nsq_channel_depth depth of channel
+# TYPE nsq_channel_depth gauge
+nsq_channel_depth{topic="t1",channel="ch1"} 10
+nsq_channel_depth{topic="t1",channel="a\"b\\c\nd"} 2.5
+# TYPE nsq_topic_messages_total counter
+nsq_topic_messages_total{topic="t1"} 3
+# HELP nsq_e2e_latency e2e\nlatency
+# TYPE nsq_e2e_latency summary
+nsq_e2e_latency{topic="t1",quantile="0.99"} 100
+nsq_e2e_latency_count{topic="t1"} 5
+`
+	out := string(r.Bytes())
+	if out != expected {
+		t.Errorf("unexpected output:\n%s\nexpected:\n%s", out, expected)
+	}
+}
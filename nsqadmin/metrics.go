@@ -0,0 +1,96 @@
+package nsqadmin
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/youzan/nsq/internal/clusterinfo"
+	"github.com/youzan/nsq/internal/http_api"
+	"github.com/youzan/nsq/internal/prometheus"
+	"github.com/youzan/nsq/internal/protocol"
+	"github.com/youzan/nsq/internal/quantile"
+)
+
+const metricsPrefix = "nsqadmin_"
+
+// metricsHandler export the stats of all the nsqd nodes in the cluster in the
+// prometheus text format, each series is labeled by dc, node, topic, partition and channel.
+func (s *httpServer) metricsHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	producers, err := s.ci.GetProducers(s.ctx.nsqadmin.opts.NSQLookupdHTTPAddressesDC, s.ctx.nsqadmin.opts.NSQDHTTPAddresses)
+	if err != nil {
+		if _, ok := err.(clusterinfo.PartialErr); !ok {
+			s.ctx.nsqadmin.logf("ERROR: failed to get producers - %s", err)
+			return nil, http_api.Err{502, fmt.Sprintf("UPSTREAM_ERROR: %s", err)}
+		}
+		s.ctx.nsqadmin.logf("WARNING: %s", err)
+	}
+	topicStats, _, err := s.ci.GetNSQDStats(producers, "", "", false)
+	if err != nil {
+		if topicStats == nil {
+			s.ctx.nsqadmin.logf("ERROR: failed to get nsqd stats - %s", err)
+			return nil, http_api.Err{502, fmt.Sprintf("UPSTREAM_ERROR: %s", err)}
+		}
+		s.ctx.nsqadmin.logf("WARNING: %s", err)
+	}
+
+	r := prometheus.NewRegistry(metricsPrefix)
+	r.Gauge("producer_count", "nsqd nodes found in cluster", float64(len(producers)))
+	for _, t := range topicStats {
+		writeTopicMetrics(r, t)
+	}
+	w.Header().Set("Content-Type", prometheus.ContentType)
+	return r.Bytes(), nil
+}
+
+func writeLatencyMetrics(r *prometheus.Registry, name string, help string,
+	e2e *quantile.E2eProcessingLatencyAggregate, labels []prometheus.Label) {
+	if e2e == nil {
+		return
+	}
+	for _, item := range e2e.Percentiles {
+		r.SummaryQuantile(name, help, item["quantile"], item["value"]/float64(time.Second), labels...)
+	}
+	r.SummaryCount(name, help, float64(e2e.Count), labels...)
+}
+
+func writeTopicMetrics(r *prometheus.Registry, t *clusterinfo.TopicStats) {
+	tl := []prometheus.Label{
+		prometheus.L("dc", t.DC),
+		prometheus.L("node", t.Node),
+		prometheus.L("topic", t.TopicName),
+		prometheus.L("partition", t.TopicPartition),
+	}
+	r.Gauge("topic_is_leader", "whether the node is the leader of the topic partition",
+		prometheus.BoolToFloat(t.IsLeader), tl...)
+	r.Gauge("topic_depth", "total data size in bytes of the topic partition", float64(t.Depth), tl...)
+	r.Gauge("topic_disk_queue_size_bytes", "data size in bytes of the topic disk queue",
+		float64(t.BackendDepth-t.BackendStart), tl...)
+	r.Counter("topic_messages_total", "total messages written to the topic partition", float64(t.MessageCount), tl...)
+	r.Gauge("topic_hourly_pub_size", "pub size in bytes during the past hour", float64(t.HourlyPubSize), tl...)
+	writeLatencyMetrics(r, "topic_e2e_processing_latency_seconds", "e2e processing latency of all channels",
+		t.E2eProcessingLatency, tl)
+
+	for _, c := range t.Channels {
+		if protocol.IsEphemeral(c.ChannelName) {
+			continue
+		}
+		cl := make([]prometheus.Label, 0, len(tl)+1)
+		cl = append(cl, tl...)
+		cl = append(cl, prometheus.L("channel", c.ChannelName))
+		r.Gauge("channel_depth", "messages waiting to be consumed", float64(c.Depth), cl...)
+		r.Gauge("channel_depth_size", "message bytes waiting to be consumed", float64(c.DepthSize), cl...)
+		r.Gauge("channel_backend_depth", "message bytes left in the disk queue", float64(c.BackendDepth), cl...)
+		r.Gauge("channel_in_flight_count", "messages in flight", float64(c.InFlightCount), cl...)
+		r.Gauge("channel_deferred_count", "messages deferred", float64(c.DeferredCount), cl...)
+		r.Gauge("channel_delayed_queue_count", "messages waiting in the delayed queue", float64(c.DelayedQueueCount), cl...)
+		r.Counter("channel_messages_total", "total messages of the channel", float64(c.MessageCount), cl...)
+		r.Counter("channel_requeue_total", "total requeued messages", float64(c.RequeueCount), cl...)
+		r.Counter("channel_timeout_total", "total timeouted messages", float64(c.TimeoutCount), cl...)
+		r.Gauge("channel_client_count", "consumers connected", float64(len(c.Clients)), cl...)
+		r.Gauge("channel_paused", "whether the channel is paused", prometheus.BoolToFloat(c.Paused), cl...)
+		writeLatencyMetrics(r, "channel_e2e_processing_latency_seconds", "e2e processing latency of the channel",
+			c.E2eProcessingLatency, cl)
+	}
+}
@@ -0,0 +1,174 @@
+package nsqd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// SegmentArchive is the backend of the tiered storage, the cleaned segments of the topic data
+// and the commit log will be uploaded to the archive before removed from the local disk.
+// The key is a slash separated path.
+type SegmentArchive interface {
+	Put(key string, r io.Reader, size int64) error
+	// Get return ErrArchiveKeyNotFound if the key is not in the archive
+	Get(key string) (io.ReadCloser, error)
+	// List return all the keys with the prefix in lexical order
+	List(prefix string) ([]string, error)
+	Delete(key string) error
+}
+
+const (
+	ArchiveTypeLocal = "local"
+	ArchiveTypeS3    = "s3"
+)
+
+var (
+	ErrArchiveKeyNotFound  = errors.New("archive key not found")
+	ErrArchiveKeyInvalid   = errors.New("archive key invalid")
+	ErrArchiveNotEnabled   = errors.New("archive not enabled")
+	ErrReadQueueNotCleaned = errors.New("the queue position is not cleaned")
+)
+
+// NewSegmentArchive create the archive backend configured in the options, nil will be
+// returned if the tiered storage is disabled.
+func NewSegmentArchive(opt *Options) (SegmentArchive, error) {
+	switch opt.ArchiveType {
+	case "":
+		return nil, nil
+	case ArchiveTypeLocal:
+		return NewLocalFSArchive(opt.ArchivePath)
+	case ArchiveTypeS3:
+		return NewS3Archive(S3ArchiveConfig{
+			Endpoint:  opt.ArchiveS3Endpoint,
+			Bucket:    opt.ArchiveS3Bucket,
+			Region:    opt.ArchiveS3Region,
+			AccessKey: opt.ArchiveS3AccessKey,
+			SecretKey: opt.ArchiveS3SecretKey,
+		})
+	default:
+		return nil, fmt.Errorf("unknown archive type: %v", opt.ArchiveType)
+	}
+}
+
+func checkArchiveKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") {
+		return ErrArchiveKeyInvalid
+	}
+	for _, p := range strings.Split(key, "/") {
+		if p == "" || p == "." || p == ".." {
+			return ErrArchiveKeyInvalid
+		}
+	}
+	return nil
+}
+
+// LocalFSArchive keep the archived files under the root directory, it can be used with
+// a mounted network file system or a large cheap disk.
+type LocalFSArchive struct {
+	root string
+}
+
+func NewLocalFSArchive(root string) (*LocalFSArchive, error) {
+	if root == "" {
+		return nil, errors.New("archive path should not be empty")
+	}
+	err := os.MkdirAll(root, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalFSArchive{root: root}, nil
+}
+
+func (a *LocalFSArchive) Put(key string, r io.Reader, size int64) error {
+	if err := checkArchiveKey(key); err != nil {
+		return err
+	}
+	fileName := filepath.Join(a.root, filepath.FromSlash(key))
+	err := os.MkdirAll(filepath.Dir(fileName), 0755)
+	if err != nil {
+		return err
+	}
+	// write to the hidden temp file first to avoid reading the partial file
+	tmp, err := ioutil.TempFile(filepath.Dir(fileName), "."+path.Base(key)+".tmp")
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(tmp, r)
+	if err == nil && size >= 0 && n != size {
+		err = fmt.Errorf("archive %v size mismatch: %v, %v", key, n, size)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	tmp.Close()
+	if err == nil {
+		err = os.Rename(tmp.Name(), fileName)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func (a *LocalFSArchive) Get(key string) (io.ReadCloser, error) {
+	if err := checkArchiveKey(key); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(filepath.Join(a.root, filepath.FromSlash(key)))
+	if os.IsNotExist(err) {
+		return nil, ErrArchiveKeyNotFound
+	}
+	return f, err
+}
+
+func (a *LocalFSArchive) List(prefix string) ([]string, error) {
+	// only walk the directory of the prefix
+	dir := a.root
+	if i := strings.LastIndex(prefix, "/"); i > 0 {
+		dir = filepath.Join(a.root, filepath.FromSlash(prefix[:i]))
+	}
+	keys := make([]string, 0)
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+			return nil
+		}
+		rel, err := filepath.Rel(a.root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (a *LocalFSArchive) Delete(key string) error {
+	if err := checkArchiveKey(key); err != nil {
+		return err
+	}
+	err := os.Remove(filepath.Join(a.root, filepath.FromSlash(key)))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
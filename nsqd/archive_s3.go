@@ -0,0 +1,275 @@
+package nsqd
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+	s3SignAlgorithm   = "AWS4-HMAC-SHA256"
+	s3DefaultRegion   = "us-east-1"
+	s3RequestTimeout  = time.Minute * 5
+)
+
+type S3ArchiveConfig struct {
+	// the endpoint of the S3 compatible service, such as http://127.0.0.1:9000
+	Endpoint  string
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+}
+
+// S3Archive store the archived files in a bucket of the S3 compatible object store,
+// the path style url is used so it can work with the most self-hosted services.
+type S3Archive struct {
+	conf     S3ArchiveConfig
+	endpoint *url.URL
+	client   *http.Client
+	nowFunc  func() time.Time
+}
+
+func NewS3Archive(conf S3ArchiveConfig) (*S3Archive, error) {
+	if conf.Endpoint == "" || conf.Bucket == "" {
+		return nil, errors.New("archive s3 endpoint and bucket should not be empty")
+	}
+	u, err := url.Parse(conf.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("archive s3 endpoint scheme not supported: %v", conf.Endpoint)
+	}
+	if conf.Region == "" {
+		conf.Region = s3DefaultRegion
+	}
+	return &S3Archive{
+		conf:     conf,
+		endpoint: u,
+		client:   &http.Client{Timeout: s3RequestTimeout},
+		nowFunc:  time.Now,
+	}, nil
+}
+
+type s3ErrorResponse struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (a *S3Archive) Put(key string, r io.Reader, size int64) error {
+	if err := checkArchiveKey(key); err != nil {
+		return err
+	}
+	rsp, err := a.do("PUT", key, nil, r, size)
+	if err != nil {
+		return err
+	}
+	rsp.Body.Close()
+	return nil
+}
+
+func (a *S3Archive) Get(key string) (io.ReadCloser, error) {
+	if err := checkArchiveKey(key); err != nil {
+		return nil, err
+	}
+	rsp, err := a.do("GET", key, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return rsp.Body, nil
+}
+
+func (a *S3Archive) List(prefix string) ([]string, error) {
+	keys := make([]string, 0)
+	token := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", prefix)
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		rsp, err := a.do("GET", "", query, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(rsp.Body).Decode(&result)
+		rsp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range result.Contents {
+			keys = append(keys, c.Key)
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (a *S3Archive) Delete(key string) error {
+	if err := checkArchiveKey(key); err != nil {
+		return err
+	}
+	rsp, err := a.do("DELETE", key, nil, nil, 0)
+	if err == ErrArchiveKeyNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	rsp.Body.Close()
+	return nil
+}
+
+func (a *S3Archive) do(method string, key string, query url.Values, body io.Reader, size int64) (*http.Response, error) {
+	u := *a.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + a.conf.Bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = s3URIEncode(u.Path, false)
+	u.RawQuery = s3CanonicalQuery(query)
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	a.sign(req)
+	rsp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.StatusCode >= 200 && rsp.StatusCode < 300 {
+		return rsp, nil
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode == http.StatusNotFound && key != "" {
+		return nil, ErrArchiveKeyNotFound
+	}
+	var errRsp s3ErrorResponse
+	data, _ := ioutil.ReadAll(io.LimitReader(rsp.Body, 4096))
+	xml.Unmarshal(data, &errRsp)
+	return nil, fmt.Errorf("archive s3 %v %v failed: %v, %v %v", method, key, rsp.Status, errRsp.Code, errRsp.Message)
+}
+
+// sign the request using the AWS signature version 4, the payload is not signed
+// to avoid reading the segment data twice.
+func (a *S3Archive) sign(req *http.Request) {
+	now := a.nowFunc().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", s3UnsignedPayload)
+	if a.conf.AccessKey == "" {
+		// anonymous access
+		return
+	}
+	signedHeaders, canonicalReq := s3CanonicalRequest(req)
+	scope := day + "/" + a.conf.Region + "/s3/aws4_request"
+	reqHash := sha256.Sum256([]byte(canonicalReq))
+	stringToSign := s3SignAlgorithm + "\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(reqHash[:])
+
+	key := s3HmacSHA256([]byte("AWS4"+a.conf.SecretKey), day)
+	key = s3HmacSHA256(key, a.conf.Region)
+	key = s3HmacSHA256(key, "s3")
+	key = s3HmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(s3HmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3SignAlgorithm, a.conf.AccessKey, scope, signedHeaders, signature))
+}
+
+func s3CanonicalRequest(req *http.Request) (string, string) {
+	headers := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": req.Header.Get("X-Amz-Content-Sha256"),
+		"x-amz-date":           req.Header.Get("X-Amz-Date"),
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + strings.TrimSpace(headers[k]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalReq := strings.Join([]string{
+		req.Method,
+		s3URIEncode(req.URL.Path, false),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		req.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+	return signedHeaders, canonicalReq
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	if len(query) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		vs := query[k]
+		sort.Strings(vs)
+		for _, v := range vs {
+			parts = append(parts, s3URIEncode(k, true)+"="+s3URIEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3URIEncode encode all the bytes except the unreserved characters, the slash is kept
+// in the path.
+func s3URIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func s3HmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
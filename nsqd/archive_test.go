@@ -0,0 +1,165 @@
+package nsqd
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/youzan/nsq/internal/test"
+)
+
+// fakeS3Server is a local stand-in of the S3 compatible service, which check the
+// signature of the request and keep the objects in memory.
+type fakeS3Server struct {
+	sync.Mutex
+	bucket  string
+	signer  *S3Archive
+	objects map[string][]byte
+}
+
+func (s *fakeS3Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	// verify the signature using the same secret
+	auth := req.Header.Get("Authorization")
+	verifyReq, _ := http.NewRequest(req.Method, "http://"+req.Host+req.URL.RequestURI(), nil)
+	verifyReq.Header.Set("X-Amz-Date", req.Header.Get("X-Amz-Date"))
+	amzDate, _ := time.Parse("20060102T150405Z", req.Header.Get("X-Amz-Date"))
+	s.signer.nowFunc = func() time.Time { return amzDate }
+	s.signer.sign(verifyReq)
+	if auth == "" || auth != verifyReq.Header.Get("Authorization") {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("<Error><Code>SignatureDoesNotMatch</Code><Message>signature mismatch</Message></Error>"))
+		return
+	}
+	prefix := "/" + s.bucket
+	if !strings.HasPrefix(req.URL.Path, prefix) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	key := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, prefix), "/")
+	s.Lock()
+	defer s.Unlock()
+	switch req.Method {
+	case "PUT":
+		data, _ := ioutil.ReadAll(req.Body)
+		s.objects[key] = data
+	case "GET":
+		if key == "" {
+			s.list(w, req)
+			return
+		}
+		data, ok := s.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	case "DELETE":
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// list return one key for each page to test the continuation
+func (s *fakeS3Server) list(w http.ResponseWriter, req *http.Request) {
+	keys := make([]string, 0)
+	for k := range s.objects {
+		if strings.HasPrefix(k, req.URL.Query().Get("prefix")) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var result s3ListResult
+	token := req.URL.Query().Get("continuation-token")
+	for i, k := range keys {
+		if k <= token {
+			continue
+		}
+		result.Contents = append(result.Contents, struct {
+			Key string `xml:"Key"`
+		}{Key: k})
+		if i < len(keys)-1 {
+			result.IsTruncated = true
+			result.NextContinuationToken = k
+		}
+		break
+	}
+	data, _ := xml.Marshal(&result)
+	w.Write(data)
+}
+
+func testSegmentArchive(t *testing.T, archive SegmentArchive) {
+	_, err := archive.Get("test-0/segments/not-exist.dat")
+	test.Equal(t, ErrArchiveKeyNotFound, err)
+	err = archive.Put("../test", bytes.NewReader([]byte("data")), 4)
+	test.Equal(t, ErrArchiveKeyInvalid, err)
+
+	keys := []string{"test-0/segments/b.dat", "test-0/segments/a.dat", "test-0/commitlog/a+b c.log", "test-1/segments/a.dat"}
+	for _, k := range keys {
+		err = archive.Put(k, bytes.NewReader([]byte(k)), int64(len(k)))
+		test.Nil(t, err)
+	}
+	for _, k := range keys {
+		rc, err := archive.Get(k)
+		test.Nil(t, err)
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		test.Nil(t, err)
+		test.Equal(t, k, string(data))
+	}
+	list, err := archive.List("test-0/segments/")
+	test.Nil(t, err)
+	test.Equal(t, []string{"test-0/segments/a.dat", "test-0/segments/b.dat"}, list)
+	list, err = archive.List("test-0/")
+	test.Nil(t, err)
+	test.Equal(t, 3, len(list))
+
+	err = archive.Delete("test-0/segments/a.dat")
+	test.Nil(t, err)
+	err = archive.Delete("test-0/segments/a.dat")
+	test.Nil(t, err)
+	list, err = archive.List("test-0/segments/")
+	test.Nil(t, err)
+	test.Equal(t, []string{"test-0/segments/b.dat"}, list)
+}
+
+func TestLocalFSArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nsq-archive")
+	test.Nil(t, err)
+	defer os.RemoveAll(dir)
+	archive, err := NewLocalFSArchive(dir)
+	test.Nil(t, err)
+	testSegmentArchive(t, archive)
+}
+
+func TestS3Archive(t *testing.T) {
+	conf := S3ArchiveConfig{
+		Bucket:    "nsq-archive",
+		AccessKey: "test-access",
+		SecretKey: "test-secret",
+	}
+	fake := &fakeS3Server{bucket: conf.Bucket, objects: make(map[string][]byte)}
+	ts := httptest.NewServer(fake)
+	defer ts.Close()
+	conf.Endpoint = ts.URL
+	var err error
+	fake.signer, err = NewS3Archive(conf)
+	test.Nil(t, err)
+	archive, err := NewS3Archive(conf)
+	test.Nil(t, err)
+	testSegmentArchive(t, archive)
+
+	conf.SecretKey = "wrong-secret"
+	wrong, err := NewS3Archive(conf)
+	test.Nil(t, err)
+	err = wrong.Put("test-0/segments/c.dat", bytes.NewReader([]byte("c")), 1)
+	test.NotNil(t, err)
+	test.Equal(t, true, strings.Contains(err.Error(), "SignatureDoesNotMatch"))
+}
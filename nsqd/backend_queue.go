@@ -43,6 +43,8 @@ type ReadResult struct {
 	CurCnt    int64
 	Data      []byte
 	Err       error
+	// the message body in the segment file which is not read into Data
+	rawBody *rawMsgBody
 }
 
 // for channel consumer
@@ -29,6 +29,7 @@ const (
 	memSizeForSmall            = 2
 	delayedReqToEndMinInterval = time.Millisecond * 64
 	DefaultMaxChDelayedQNum    = 10000 * 16
+	deadLetterTopicSuffix      = "_dlq"
 )
 
 var (
@@ -84,6 +85,8 @@ type Channel struct {
 	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
 	requeueCount      uint64
 	timeoutCount      uint64
+	deadLetterCount   uint64
+	expiredCount      uint64
 	deferredCount     int64
 	deferredFromDelay int64
 
@@ -121,6 +124,8 @@ type Channel struct {
 	deleteCallback   func(*Channel)
 	deleter          sync.Once
 	moreDataCallback func(*Channel)
+	// called while reading the corrupt data from disk
+	corruptCallback func(*Channel)
 
 	// Stats tracking
 	e2eProcessingLatencyStream *quantile.Quantile
@@ -157,12 +162,17 @@ type Channel struct {
 	channelStatsInfo      *ChannelStatsInfo
 	topicOrdered          bool
 	lastDelayedReqToEndTs int64
+
+	// the message attempted more than maxAttempts will be moved to the dead letter topic
+	// 0 means dead letter is disabled
+	maxAttempts     int32
+	deadLetterTopic atomic.Value
 }
 
 // NewChannel creates a new instance of the Channel type and returns a pointer
 func NewChannel(topicName string, part int, topicOrdered bool, channelName string, chEnd BackendQueueEnd, opt *Options,
-	deleteCallback func(*Channel), moreDataCallback func(*Channel), consumeDisabled int32,
-	notify INsqdNotify, ext int32, queueStart BackendQueueEnd, metaStorage IMetaStorage) *Channel {
+	deleteCallback func(*Channel), moreDataCallback func(*Channel), corruptCallback func(*Channel),
+	consumeDisabled int32, notify INsqdNotify, ext int32, queueStart BackendQueueEnd, metaStorage IMetaStorage) *Channel {
 
 	c := &Channel{
 		topicName:          topicName,
@@ -182,6 +192,7 @@ func NewChannel(topicName string, part int, topicOrdered bool, channelName strin
 		endUpdatedChan:     make(chan bool, 1),
 		deleteCallback:     deleteCallback,
 		moreDataCallback:   moreDataCallback,
+		corruptCallback:    corruptCallback,
 		option:             opt,
 		nsqdNotify:         notify,
 		consumeDisabled:    consumeDisabled,
@@ -380,12 +391,83 @@ func (c *Channel) IsEphemeral() bool {
 	return c.ephemeral
 }
 
+// GetDefaultDeadLetterTopic returns the dead letter topic name used
+// if no dead letter topic is configured for the channel.
+func GetDefaultDeadLetterTopic(topicName string, channelName string) string {
+	return topicName + "_" + channelName + deadLetterTopicSuffix
+}
+
+// SetDeadLetter enables moving the messages attempted more than maxAttempts
+// to the dead letter topic. maxAttempts 0 will disable the dead letter and
+// the empty dlqTopic means using the default dead letter topic name.
+func (c *Channel) SetDeadLetter(maxAttempts uint16, dlqTopic string) {
+	c.deadLetterTopic.Store(dlqTopic)
+	atomic.StoreInt32(&c.maxAttempts, int32(maxAttempts))
+}
+
+func (c *Channel) GetMaxAttempts() uint16 {
+	return uint16(atomic.LoadInt32(&c.maxAttempts))
+}
+
+// GetDeadLetterTopic return the configured dead letter topic (not the default one)
+func (c *Channel) GetDeadLetterTopic() string {
+	t, _ := c.deadLetterTopic.Load().(string)
+	return t
+}
+
+func (c *Channel) GetDeadLetterTopicOrDefault() string {
+	t := c.GetDeadLetterTopic()
+	if t == "" {
+		return GetDefaultDeadLetterTopic(c.topicName, c.name)
+	}
+	return t
+}
+
+func (c *Channel) IsDeadLetterEnabled() bool {
+	if c.IsOrdered() || c.IsEphemeral() {
+		return false
+	}
+	return c.GetMaxAttempts() > 0
+}
+
+// ShouldDeadLetter check whether the message has been attempted too many times
+// and should be moved to the dead letter topic.
+func (c *Channel) ShouldDeadLetter(msg *Message) bool {
+	if !c.IsDeadLetterEnabled() {
+		return false
+	}
+	return msg.Attempts >= c.GetMaxAttempts()
+}
+
+func (c *Channel) IncrDeadLetterCount() {
+	atomic.AddUint64(&c.deadLetterCount, 1)
+}
+
+func (c *Channel) GetDeadLetterCount() uint64 {
+	return atomic.LoadUint64(&c.deadLetterCount)
+}
+
 func (c *Channel) SetDelayedQueue(dq *DelayQueue) {
 	c.delayedLock.Lock()
 	c.delayedQueue = dq
 	c.delayedLock.Unlock()
 }
 
+// SetArchive enable reading the cleaned topic data from the archive
+func (c *Channel) SetArchive(archive *diskQueueArchive) {
+	if d, ok := c.backend.(*diskQueueReader); ok {
+		d.SetArchive(archive)
+	}
+}
+
+// SetZeroCopyMinSize set the min size of the message body sent to the consumer from the segment
+// file directly, 0 to disable.
+func (c *Channel) SetZeroCopyMinSize(size int64) {
+	if d, ok := c.backend.(*diskQueueReader); ok {
+		d.SetRawBodyMinSize(size)
+	}
+}
+
 func (c *Channel) GetDelayedQueue() *DelayQueue {
 	c.delayedLock.RLock()
 	dq := c.delayedQueue
@@ -1142,6 +1224,12 @@ func (c *Channel) ShouldRequeueToEnd(clientID int64, clientAddr string, id Messa
 	if msg.GetClientID() != clientID || msg.IsDeferred() {
 		return nil, false
 	}
+	if c.ShouldDeadLetter(msg) {
+		// requeue to end will move it to the dead letter topic
+		nsqLog.Logf("channel %v message %v attempted %v exceed the max attempts %v, should move to dead letter",
+			c.GetName(), id, msg.Attempts, c.GetMaxAttempts())
+		return msg.GetCopy(), true
+	}
 
 	if nsqLog.Level() >= levellogger.LOG_DEBUG || c.IsTraced() {
 		nsqLog.LogDebugf("channel %v check requeue to end, timeout:%v, msg timestamp:%v, depth ts:%v, msg attempt:%v, waiting :%v",
@@ -1932,6 +2020,9 @@ LOOP:
 					if data.Err == ErrReadQueueCountMissing {
 						time.Sleep(time.Second)
 					} else {
+						if data.Err == ErrRecordChecksumMismatch && c.corruptCallback != nil {
+							c.corruptCallback(c)
+						}
 						// TODO: fix corrupt file from other replica.
 						// and should handle the confirm offset, since some skipped data
 						// may never be confirmed any more
@@ -1965,6 +2056,7 @@ LOOP:
 				msg.Offset = data.Offset
 				msg.RawMoveSize = data.MovedSize
 				msg.queueCntIndex = data.CurCnt
+				msg.rawBody = data.rawBody
 				if msg.TraceID != 0 || c.IsTraced() || nsqLog.Level() >= levellogger.LOG_DETAIL {
 					nsqMsgTracer.TraceSub(c.GetTopicName(), c.GetName(), "READ_QUEUE", msg.TraceID, msg, "0", time.Now().UnixNano() - msg.Timestamp)
 				}
@@ -2040,6 +2132,9 @@ LOOP:
 			c.ConfirmMsgWithoutGoInflight(msg)
 			continue LOOP
 		}
+		if c.confirmIfExpired(msg, time.Now(), false) {
+			continue LOOP
+		}
 
 		atomic.StoreInt32(&c.waitingDeliveryState, 1)
 		//atomic.StoreInt32(&msg.deferredCnt, 0)
@@ -2139,6 +2234,65 @@ func (c *Channel) shouldSkipZanTest(msg *Message) bool {
 	return false
 }
 
+// parse the expire time (unix milliseconds) from the json ext header
+func parseExpireAtIfAny(msg *Message) (int64, bool) {
+	if msg.ExtVer != ext.JSON_HEADER_EXT_VER {
+		return 0, false
+	}
+	// avoid parsing json for most messages without expire
+	if !bytes.Contains(msg.ExtBytes, []byte(ext.EXPIRE_AT_KEY)) {
+		return 0, false
+	}
+	extHeader, err := simpleJson.NewJson(msg.ExtBytes)
+	if err != nil {
+		return 0, false
+	}
+	expireJson, exist := extHeader.CheckGet(ext.EXPIRE_AT_KEY)
+	if !exist {
+		return 0, false
+	}
+	expireAt, err := expireJson.Int64()
+	if err != nil {
+		es, _ := expireJson.String()
+		expireAt, err = strconv.ParseInt(es, 10, 64)
+		if err != nil {
+			return 0, false
+		}
+	}
+	return expireAt, expireAt > 0
+}
+
+func isMessageExpired(msg *Message, tn time.Time) bool {
+	expireAt, ok := parseExpireAtIfAny(msg)
+	if !ok {
+		return false
+	}
+	return tn.UnixNano()/int64(time.Millisecond) >= expireAt
+}
+
+// expired message will be confirmed without delivery to any client, both the
+// messages read from the topic queue and the delayed queue are checked here.
+func (c *Channel) confirmIfExpired(msg *Message, tn time.Time, fromDelayed bool) bool {
+	if !isMessageExpired(msg, tn) {
+		return false
+	}
+	if fromDelayed {
+		atomic.AddInt64(&c.deferredFromDelay, 1)
+		c.ConfirmDelayedMessage(msg)
+	} else {
+		c.ConfirmMsgWithoutGoInflight(msg)
+	}
+	atomic.AddUint64(&c.expiredCount, 1)
+	if msg.TraceID != 0 || c.IsTraced() || nsqLog.Level() >= levellogger.LOG_DEBUG {
+		nsqMsgTracer.TraceSub(c.GetTopicName(), c.GetName(), "EXPIRED", msg.TraceID, msg, "", tn.UnixNano()-msg.Timestamp)
+	}
+	return true
+}
+
+func (c *Channel) GetExpiredCount() uint64 {
+	return atomic.LoadUint64(&c.expiredCount)
+}
+
 func parseTagIfAny(msg *Message) (string, error) {
 	var msgTag string
 	var err error
@@ -2274,6 +2428,23 @@ func (c *Channel) processInFlightQueue(tnow int64) (bool, bool) {
 			c.inFlightMutex.Unlock()
 			goto exit
 		}
+		if !msg.IsDeferred() && c.ShouldDeadLetter(msg) {
+			// the message timeout too many times should be moved to the dead letter topic,
+			// keep it in flight until moved, it will timeout and try again if failed to move.
+			atomic.AddUint64(&c.timeoutCount, 1)
+			if msg.belongedConsumer != nil {
+				msg.belongedConsumer.TimedOutMessage()
+				msg.belongedConsumer = nil
+			}
+			nsqLog.Logf("channel %v message %v timeout with attempts %v exceed the max attempts %v, move to dead letter",
+				c.GetName(), msg.ID, msg.Attempts, c.GetMaxAttempts())
+			msg.pri = tnow + int64(c.option.MsgTimeout)
+			c.inFlightPQ.Push(msg)
+			copyMsg := msg.GetCopy()
+			c.inFlightMutex.Unlock()
+			c.nsqdNotify.ReqToEnd(c, copyMsg, 0)
+			continue
+		}
 		c.inFlightMessages[msg.ID] = nil
 		delete(c.inFlightMessages, msg.ID)
 		// note: if this message is deferred by client, we treat it as a delay message,
@@ -2468,7 +2639,7 @@ func (c *Channel) peekAndReqDelayedMessages(tnow int64, delayedQueue *DelayQueue
 						oldMsg2.DelayedType == 0 {
 						// this inflight message is caused by leader changed, and the
 						// new leader read from disk queue (which will be treated as non delayed message)
-						if bytes.Equal(oldMsg2.Body, m.Body) {
+						if body, err := oldMsg2.GetBody(); err == nil && bytes.Equal(body, m.Body) {
 							// just fin it
 							nsqLog.Logf("old msg %v in flight confirmed since in delayed queue",
 								PrintMessage(oldMsg2))
@@ -2484,6 +2655,11 @@ func (c *Channel) peekAndReqDelayedMessages(tnow int64, delayedQueue *DelayQueue
 				m.ID = m.DelayedOrigID
 				m.DelayedOrigID = tmpID
 
+				// the expired message no need to be requeued for delivery
+				if c.confirmIfExpired(&m, time.Unix(0, tnow), true) {
+					continue
+				}
+
 				if tnow > m.DelayedTs+int64(c.option.QueueScanInterval*2) {
 					nsqLog.LogDebugf("channel %v delayed is too late now %v for message: %v",
 						c.GetName(), tnow, m)
@@ -387,6 +387,150 @@ func TestChannelSkip(t *testing.T) {
 	}
 }
 
+func TestChannelDeadLetter(t *testing.T) {
+	opts := NewOptions()
+	opts.SyncEvery = 1
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_dead_letter" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopicIgnPart(topicName)
+	channel := topic.GetChannel("channel")
+	equal(t, channel.IsDeadLetterEnabled(), false)
+	equal(t, channel.GetDeadLetterTopicOrDefault(), topicName+"_channel_dlq")
+
+	msg := NewMessage(topic.nextMsgID(), []byte("test"))
+	msg.Attempts = 3
+	channel.StartInFlightTimeout(msg, NewFakeConsumer(0), "", opts.MsgTimeout)
+	_, toEnd := channel.ShouldRequeueToEnd(0, "", msg.ID, 0, true)
+	equal(t, toEnd, false)
+
+	channel.SetDeadLetter(5, "")
+	equal(t, channel.IsDeadLetterEnabled(), true)
+	equal(t, channel.ShouldDeadLetter(msg), false)
+	_, toEnd = channel.ShouldRequeueToEnd(0, "", msg.ID, 0, true)
+	equal(t, toEnd, false)
+
+	channel.SetDeadLetter(3, "test_dlq")
+	equal(t, channel.GetDeadLetterTopicOrDefault(), "test_dlq")
+	equal(t, channel.ShouldDeadLetter(msg), true)
+	oldMsg, toEnd := channel.ShouldRequeueToEnd(0, "", msg.ID, 0, true)
+	equal(t, toEnd, true)
+	equal(t, oldMsg.ID, msg.ID)
+	// requeue not by client should not go to dead letter
+	_, toEnd = channel.ShouldRequeueToEnd(0, "", msg.ID, 0, false)
+	equal(t, toEnd, false)
+
+	// dead letter should be reloaded from meta
+	topic.SaveChannelMeta()
+	channel.SetDeadLetter(0, "")
+	equal(t, channel.IsDeadLetterEnabled(), false)
+	topic.LoadChannelMeta()
+	equal(t, channel.GetMaxAttempts(), uint16(3))
+	equal(t, channel.GetDeadLetterTopic(), "test_dlq")
+}
+
+func TestChannelDropExpiredMessage(t *testing.T) {
+	opts := NewOptions()
+	opts.SyncEvery = 1
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_expired" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopicWithExt(topicName, 0, false)
+	channel := topic.GetChannel("channel")
+
+	nowMs := time.Now().UnixNano() / int64(time.Millisecond)
+	msgs := make([]*Message, 0, 4)
+	for i, expireAt := range []interface{}{nowMs - 1000, strconv.FormatInt(nowMs-1000, 10), nowMs + 60000, nil} {
+		var msgId MessageID
+		extJ := simpleJson.New()
+		if expireAt != nil {
+			extJ.Set(ext.EXPIRE_AT_KEY, expireAt)
+		}
+		extBytes, _ := extJ.Encode()
+		msg := NewMessageWithExt(msgId, []byte(strconv.Itoa(i)), ext.JSON_HEADER_EXT_VER, extBytes)
+		msgs = append(msgs, msg)
+	}
+	topic.PutMessages(msgs)
+	topic.flushBuffer(true)
+
+	for i := 2; i < 4; i++ {
+		select {
+		case outputMsg := <-channel.clientMsgChan:
+			equal(t, string(outputMsg.Body), strconv.Itoa(i))
+			channel.StartInFlightTimeout(outputMsg, NewFakeConsumer(0), "", opts.MsgTimeout)
+			channel.FinishMessageForce(0, "", outputMsg.ID, true)
+		case <-time.After(time.Second * 5):
+			t.Fatalf("timeout waiting consume")
+		}
+	}
+	equal(t, channel.GetExpiredCount(), uint64(2))
+	equal(t, channel.Depth(), int64(0))
+}
+
+func TestChannelDeadLetterOnTimeout(t *testing.T) {
+	opts := NewOptions()
+	opts.SyncEvery = 1
+	opts.MsgTimeout = time.Second
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+	reqToEndCh := make(chan *Message, 1)
+	nsqd.SetReqToEndCB(func(ch *Channel, m *Message, to time.Duration) error {
+		reqToEndCh <- m
+		return nil
+	})
+
+	topicName := "test_channel_dead_letter_timeout" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopicIgnPart(topicName)
+	channel := topic.GetChannel("channel")
+	channel.SetDeadLetter(2, "")
+
+	// the message timeout with less attempts should be requeued,
+	// the attempts will be increased while starting in flight
+	msg := NewMessage(topic.nextMsgID(), []byte("test"))
+	channel.StartInFlightTimeout(msg, NewFakeConsumer(0), "", opts.MsgTimeout)
+	channel.processInFlightQueue(time.Now().Add(opts.MsgTimeout * 2).UnixNano())
+	equal(t, channel.GetInflightNum(), 0)
+	select {
+	case <-reqToEndCh:
+		t.Fatal("should not move to dead letter")
+	default:
+	}
+
+	// the message timeout with max attempts should move to dead letter and keep in flight
+	msg = NewMessage(topic.nextMsgID(), []byte("test"))
+	msg.Attempts = 1
+	channel.StartInFlightTimeout(msg, NewFakeConsumer(0), "", opts.MsgTimeout)
+	tnow := time.Now().Add(opts.MsgTimeout * 2).UnixNano()
+	channel.processInFlightQueue(tnow)
+	select {
+	case m := <-reqToEndCh:
+		equal(t, m.ID, msg.ID)
+		equal(t, m.Attempts, uint16(2))
+	case <-time.After(time.Second * 3):
+		t.Fatal("timeout message should move to dead letter")
+	}
+	equal(t, channel.GetInflightNum(), 1)
+	// the message should timeout again if not moved
+	channel.processInFlightQueue(tnow + int64(opts.MsgTimeout) + 1)
+	select {
+	case m := <-reqToEndCh:
+		equal(t, m.ID, msg.ID)
+	case <-time.After(time.Second * 3):
+		t.Fatal("timeout message should move to dead letter again")
+	}
+	_, _, _, _, err := channel.FinishMessageForce(0, "", msg.ID, true)
+	equal(t, err, nil)
+	equal(t, channel.GetInflightNum(), 0)
+}
+
 func TestChannelSkipZanTestForOrdered(t *testing.T) {
 	// while the ordered message is timeouted and requeued,
 	// change the state to skip zan test may block waiting the next
@@ -4,8 +4,10 @@ import (
 	"bufio"
 	"compress/flate"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
+	"os"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -50,6 +52,46 @@ type IdentifyDataV2 struct {
 	DesiredTag          string        `json:"desired_tag,omitempty"`
 	ExtendSupport       bool          `json:"extend_support"`
 	ExtFilter           ExtFilterData `json:"ext_filter"`
+	AckMode             string        `json:"ack_mode,omitempty"`
+	// the member id and generation assigned by the consumer group in nsqlookupd
+	GroupMemberID   string `json:"group_member_id,omitempty"`
+	GroupGeneration int64  `json:"group_generation,omitempty"`
+}
+
+// PubAckMode is the replicas acknowledgement level for the message published by the client.
+type PubAckMode int32
+
+const (
+	// wait all the replicas in isr
+	PubAckAll PubAckMode = iota
+	// wait the quorum of the replicas in isr
+	PubAckQuorum
+	// wait the leader only
+	PubAckLeader
+)
+
+var ErrInvalidAckMode = errors.New("invalid ack mode")
+
+func ParsePubAckMode(mode string) (PubAckMode, error) {
+	switch mode {
+	case "", "all":
+		return PubAckAll, nil
+	case "quorum":
+		return PubAckQuorum, nil
+	case "leader":
+		return PubAckLeader, nil
+	}
+	return PubAckAll, ErrInvalidAckMode
+}
+
+func (m PubAckMode) String() string {
+	switch m {
+	case PubAckQuorum:
+		return "quorum"
+	case PubAckLeader:
+		return "leader"
+	}
+	return "all"
 }
 
 type identifyEvent struct {
@@ -68,6 +110,8 @@ type ClientV2 struct {
 	FinishCount   uint64
 	RequeueCount  uint64
 	TimeoutCount  uint64
+	// the messages with the body sent from the segment file directly
+	ZeroCopyCount uint64
 
 	// this lock used only for connection writer
 	// do not use it while get/set stats for client, use meta lock instead
@@ -135,6 +179,12 @@ type ClientV2 struct {
 	TagMsgChannel   chan *Message
 	extFilter       ExtFilterData
 	PubStats        *ClientPubStats
+	pubAckMode      int32
+	groupMemberID   string
+	groupGeneration int64
+	// the segment file opened to send the raw message body, it is kept opened since
+	// the messages are mostly read from the same file
+	rawBodyFile *os.File
 }
 
 func NewClientV2(id int64, conn net.Conn, opts *Options, tls *tls.Config) *ClientV2 {
@@ -216,6 +266,10 @@ func (c *ClientV2) FinalClose() {
 		c.tlsConn.Close()
 		c.tlsConn = nil
 	}
+	if c.rawBodyFile != nil {
+		c.rawBodyFile.Close()
+		c.rawBodyFile = nil
+	}
 	c.Conn.Close()
 }
 
@@ -245,6 +299,8 @@ func (c *ClientV2) Identify(data IdentifyDataV2) error {
 	c.ClientID = clientID
 	c.Hostname = hostname
 	c.UserAgent = data.UserAgent
+	c.groupMemberID = data.GroupMemberID
+	c.groupGeneration = data.GroupGeneration
 	c.metaLock.Unlock()
 
 	err := c.SetHeartbeatInterval(data.HeartbeatInterval)
@@ -276,6 +332,10 @@ func (c *ClientV2) Identify(data IdentifyDataV2) error {
 	if err != nil {
 		return err
 	}
+	err = c.SetPubAckMode(data.AckMode)
+	if err != nil {
+		return err
+	}
 	if data.ExtendSupport {
 		c.SetExtendSupport()
 	}
@@ -331,6 +391,7 @@ func (c *ClientV2) Stats() ClientStats {
 		FinishCount:     atomic.LoadUint64(&c.FinishCount),
 		RequeueCount:    atomic.LoadUint64(&c.RequeueCount),
 		TimeoutCount:    int64(atomic.LoadUint64(&c.TimeoutCount)),
+		ZeroCopyCount:   atomic.LoadUint64(&c.ZeroCopyCount),
 		ConnectTime:     c.ConnectTime.Unix(),
 		SampleRate:      atomic.LoadInt32(&c.SampleRate),
 		TLS:             atomic.LoadInt32(&c.TLS) == 1,
@@ -671,6 +732,25 @@ func (c *ClientV2) SetExtendSupport() {
 	atomic.StoreInt32(&c.isExtendSupport, 1)
 }
 
+func (c *ClientV2) SetPubAckMode(mode string) error {
+	ackMode, err := ParsePubAckMode(mode)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt32(&c.pubAckMode, int32(ackMode))
+	return nil
+}
+
+func (c *ClientV2) GetPubAckMode() PubAckMode {
+	return PubAckMode(atomic.LoadInt32(&c.pubAckMode))
+}
+
+func (c *ClientV2) GetGroupMember() (string, int64) {
+	c.metaLock.RLock()
+	defer c.metaLock.RUnlock()
+	return c.groupMemberID, c.groupGeneration
+}
+
 func (c *ClientV2) GetMsgTimeout() time.Duration {
 	return time.Duration(atomic.LoadInt64(&c.msgTimeout))
 }
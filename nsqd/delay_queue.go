@@ -44,19 +44,19 @@ const (
 	maxEmptyRunning     = 5
 )
 
+// DelayedUpdate is the record to cancel or reschedule the delayed message, it is written to
+// the delayed queue for replication and applied to the delayed message store.
+const DelayedUpdate = 16
+
 type RecentKeyList [][]byte
 
-func writeDelayedMessageToBackendWithCheck(buf *bytes.Buffer, msg *Message,
-	checkSize int64, bq *diskQueueWriter,
-	isExt bool) (BackendOffset, int32, diskQueueEndInfo, error) {
+func writeDelayedMessageToBackend(buf *bytes.Buffer, msg *Message,
+	bq *diskQueueWriter, isExt bool) (BackendOffset, int32, diskQueueEndInfo, error) {
 	buf.Reset()
-	wsize, err := msg.WriteDelayedTo(buf, isExt)
+	_, err := msg.WriteDelayedTo(buf, isExt)
 	if err != nil {
 		return 0, 0, diskQueueEndInfo{}, err
 	}
-	if checkSize > 0 && checkSize != wsize+4 {
-		return 0, 0, diskQueueEndInfo{}, fmt.Errorf("write message size mismatch: %v vs %v", checkSize, wsize+4)
-	}
 	return bq.PutV2(buf.Bytes())
 }
 
@@ -67,6 +67,8 @@ func IsValidDelayedMessage(m *Message) bool {
 		return m.DelayedTs > 0
 	} else if m.DelayedType == TransactionDelayed {
 		return true
+	} else if m.DelayedType == DelayedUpdate {
+		return m.DelayedOrigID > 0 && m.DelayedTs > 0 && len(m.Body) == delayedUpdateBodyLen
 	}
 	return false
 }
@@ -162,7 +164,42 @@ func getDelayedMsgDBPrefixKey(dt int, ch string) []byte {
 	return msgKey
 }
 
-func deleteMsgIndex(msgData []byte, tx *bolt.Tx, isExt bool) error {
+// the encrypted value of the delayed message in kv store starts with the marker, which will never
+// be the first byte of the plain message (the high byte of the timestamp).
+const delayedMsgEncryptedMarker = byte(0xff)
+
+// sealDelayedMsgValue encrypt the delayed message data stored in the kv store if the
+// encryption at rest is enabled.
+func sealDelayedMsgValue(data []byte) ([]byte, error) {
+	kr := GetEncryptKeyring()
+	if kr == nil {
+		return data, nil
+	}
+	aad := []byte{delayedMsgEncryptedMarker}
+	return kr.Seal(aad, data, aad)
+}
+
+// openDelayedMsgValue return the plain delayed message data from the kv store value, the
+// returned data will not share the memory with the value.
+func openDelayedMsgValue(v []byte) ([]byte, error) {
+	if len(v) == 0 || v[0] != delayedMsgEncryptedMarker {
+		buf := make([]byte, len(v))
+		copy(buf, v)
+		return buf, nil
+	}
+	kr := GetEncryptKeyring()
+	if kr == nil {
+		return nil, ErrEncryptKeyringNotLoaded
+	}
+	return kr.Open(v[1:], v[:1])
+}
+
+func deleteMsgIndex(v []byte, tx *bolt.Tx, isExt bool) error {
+	msgData, err := openDelayedMsgValue(v)
+	if err != nil {
+		nsqLog.LogErrorf("failed to decrypt delayed message: %v", err)
+		return err
+	}
 	m, err := DecodeDelayedMessage(msgData, isExt)
 	if err != nil {
 		nsqLog.LogErrorf("failed to decode delayed message: %v, %v", msgData, err)
@@ -217,6 +254,58 @@ func deleteBucketKey(dt int, ch string, ts int64, id MessageID, tx *bolt.Tx, isE
 	return nil
 }
 
+// putBucketKey write the delayed message to the bolt store and update the index and the counter,
+// the data is the plain message data of the value.
+func putBucketKey(m *Message, msgKey []byte, msgValue []byte, data []byte, tx *bolt.Tx, isExt bool) error {
+	b := tx.Bucket(bucketDelayedMsg)
+	oldV := b.Get(msgKey)
+	exists := oldV != nil
+	var oldData []byte
+	if exists {
+		// ignore the error and overwrite the old one if it can not be decrypted
+		oldData, _ = openDelayedMsgValue(oldV)
+	}
+	if exists && bytes.Equal(oldData, data) {
+	} else {
+		err := b.Put(msgKey, msgValue)
+		if err != nil {
+			return err
+		}
+		if oldV != nil {
+			err = deleteMsgIndex(oldV, tx, isExt)
+			if err != nil {
+				nsqLog.Infof("failed to delete old delayed index : %v, %v", oldV, err)
+				return err
+			}
+		}
+		b = tx.Bucket(bucketDelayedMsgIndex)
+		newIndexKey := getDelayedMsgDBIndexKey(int(m.DelayedType), m.DelayedChannel, m.DelayedOrigID)
+		d := getDelayedMsgDBIndexValue(m.DelayedTs, m.DelayedOrigID)
+		err = b.Put(newIndexKey, d)
+		if err != nil {
+			return err
+		}
+	}
+	b = tx.Bucket(bucketMeta)
+	if !exists {
+		cntKey := append([]byte("counter_"), getDelayedMsgDBPrefixKey(int(m.DelayedType), m.DelayedChannel)...)
+		cnt := uint64(0)
+		cntBytes := b.Get(cntKey)
+		if cntBytes != nil && len(cntBytes) == 8 {
+			cnt = binary.BigEndian.Uint64(cntBytes)
+		}
+		cnt++
+		cntBytes = make([]byte, 8)
+
+		binary.BigEndian.PutUint64(cntBytes[:8], cnt)
+		err := b.Put(cntKey, cntBytes)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 type DelayQueue struct {
 	tname     string
 	fullName  string
@@ -228,9 +317,11 @@ type DelayQueue struct {
 	msgIDCursor  MsgIDGenerator
 	defaultIDSeq uint64
 
-	needFlush   int32
-	putBuffer   bytes.Buffer
-	kvStore     *bolt.DB
+	needFlush int32
+	putBuffer bytes.Buffer
+	kvStore   *bolt.DB
+	// the delayed message store of the wheel engine, nil if the bolt engine is used
+	wheel       *delayedWheelStore
 	EnableTrace int32
 	SyncEvery   int64
 	lastSyncCnt int64
@@ -289,6 +380,30 @@ func newDelayQueue(topicName string, part int, dataPath string, opt *Options,
 		return nil, err
 	}
 	q.backend = queue.(*diskQueueWriter)
+	q.backend.SetRecordChecksum(opt.QueueRecordChecksum)
+	engine := opt.DelayQueueEngine
+	logPath := path.Join(q.dataPath, getDelayQueueLogName(q.tname, q.partition))
+	if ro != nil && ro.ReadOnly {
+		// the read only queue should not change the store, so the engine is decided by the store file
+		engine = DelayQueueEngineBolt
+		if _, err := os.Stat(logPath); err == nil {
+			engine = DelayQueueEngineWheel
+		}
+	} else {
+		err = migrateDelayedStore(q.dataPath, q.tname, q.partition, engine, isExt)
+		if err != nil {
+			nsqLog.LogErrorf("topic(%v) failed to migrate delayed store to %v engine: %v", q.fullName, engine, err)
+			return nil, err
+		}
+	}
+	if engine == DelayQueueEngineWheel {
+		q.wheel, err = openDelayedWheelStore(logPath, ro != nil && ro.ReadOnly)
+		if err != nil {
+			nsqLog.LogErrorf("topic(%v) failed to init delayed log: %v , %v ", q.fullName, err, logPath)
+			return nil, err
+		}
+		return q, nil
+	}
 	if ro == nil {
 		ro = &bolt.Options{
 			Timeout:      time.Second,
@@ -325,6 +440,9 @@ func newDelayQueue(topicName string, part int, dataPath string, opt *Options,
 }
 
 func (q *DelayQueue) CheckConsistence() error {
+	if q.wheel != nil {
+		return q.wheel.check()
+	}
 	// Perform consistency check.
 	return q.getStore().View(func(tx *bolt.Tx) error {
 		var count int
@@ -354,6 +472,9 @@ func (q *DelayQueue) CheckConsistence() error {
 }
 
 func (q *DelayQueue) Stats() string {
+	if q.wheel != nil {
+		return q.wheel.stats()
+	}
 	s := q.getStore().Stats()
 	d, _ := json.MarshalIndent(s, "", " ")
 	return string(d)
@@ -528,6 +649,9 @@ func (q *DelayQueue) TotalDataSize() int64 {
 }
 
 func (q *DelayQueue) GetDBSize() (int64, error) {
+	if q.wheel != nil {
+		return q.wheel.size(), nil
+	}
 	totalSize := int64(0)
 	err := q.getStore().View(func(tx *bolt.Tx) error {
 		totalSize = tx.Size()
@@ -537,6 +661,9 @@ func (q *DelayQueue) GetDBSize() (int64, error) {
 }
 
 func (q *DelayQueue) BackupKVStoreTo(w io.Writer) (int64, error) {
+	if q.wheel != nil {
+		return q.wheel.backupTo(w)
+	}
 	totalSize := int64(0)
 	err := q.getStore().View(func(tx *bolt.Tx) error {
 		buf := make([]byte, 8)
@@ -590,6 +717,31 @@ func (q *DelayQueue) RestoreKVStoreFrom(body io.Reader) error {
 
 	q.compactMutex.Lock()
 	defer q.compactMutex.Unlock()
+	if q.wheel != nil {
+		err = q.wheel.restore(tmpPath, q.IsExt())
+		if err != nil {
+			nsqLog.LogErrorf("topic(%v) failed to restore delayed log: %v", q.fullName, err)
+			return err
+		}
+		q.oldestMutex.Lock()
+		q.oldestChannelDelayedTs = make(map[string]int64)
+		q.oldestMutex.Unlock()
+		atomic.StoreInt64(&q.changedTs, time.Now().UnixNano())
+		return nil
+	}
+	// the backup from the node using the wheel engine should be converted
+	isLog, err := isDelayedLogFile(tmpPath)
+	if err != nil {
+		return err
+	}
+	if isLog {
+		err = convertDelayedLogToBolt(tmpPath, tmpPath+".bolt")
+		if err != nil {
+			return err
+		}
+		os.Remove(tmpPath)
+		tmpPath = tmpPath + ".bolt"
+	}
 	kvPath := path.Join(q.dataPath, getDelayQueueDBName(q.tname, q.partition))
 	q.dbLock.Lock()
 	defer q.dbLock.Unlock()
@@ -644,24 +796,39 @@ func (q *DelayQueue) PutRawDataOnReplica(rawData []byte, offset BackendOffset, c
 	return &dend, nil
 }
 
+// PutMessageOnReplica write the message from the leader, the leader send the message instead of
+// the raw record only if it write the plain record, so the replica should write the same record
+// ignoring the local encryption.
 func (q *DelayQueue) PutMessageOnReplica(m *Message, offset BackendOffset, checkSize int64) (BackendQueueEnd, error) {
 	if atomic.LoadInt32(&q.exitFlag) == 1 {
 		return nil, ErrExiting
 	}
-	wend := q.backend.GetQueueWriteEnd()
-	if wend.Offset() != offset {
-		nsqLog.LogErrorf("topic %v: write offset mismatch: %v, %v", q.GetFullName(), offset, wend)
-		return nil, ErrWriteOffsetMismatch
-	}
 	if !IsValidDelayedMessage(m) {
 		return nil, errors.New("invalid delayed message")
 	}
-	_, _, _, dend, err := q.put(m, nil, false, checkSize)
+	q.putBuffer.Reset()
+	_, err := m.WriteDelayedTo(&q.putBuffer, q.IsExt())
 	if err != nil {
-		q.ResetBackendEndNoLock(wend.Offset(), wend.TotalMsgCnt())
 		return nil, err
 	}
-	return &dend, nil
+	rawData := appendPlainRecord(nil, q.putBuffer.Bytes())
+	return q.PutRawDataOnReplica(rawData, offset, checkSize, 1)
+}
+
+// StartRawCaptureNoLock begin to keep the encoded records written if the replicas should write
+// the same bytes as the leader, return false if not needed.
+func (q *DelayQueue) StartRawCaptureNoLock() bool {
+	if !q.backend.NeedRawReplicate() {
+		return false
+	}
+	q.backend.StartRawCapture()
+	return true
+}
+
+// StopRawCaptureNoLock return the encoded records written since the capture started, which
+// can be replicated by PutRawDataOnReplica.
+func (q *DelayQueue) StopRawCaptureNoLock() []byte {
+	return q.backend.StopRawCapture()
 }
 
 func (q *DelayQueue) put(m *Message, rawData []byte, trace bool, checkSize int64) (MessageID, BackendOffset, int32, diskQueueEndInfo, error) {
@@ -669,10 +836,17 @@ func (q *DelayQueue) put(m *Message, rawData []byte, trace bool, checkSize int64
 	var dend diskQueueEndInfo
 	// it may happened while the topic is upgraded to extend topic, so the message from leader will be raw.
 	if rawData != nil {
-		if len(rawData) < 4 {
+		var data []byte
+		err = walkRawRecords(rawData, func(pos int, d []byte, recordSize int) {
+			data = d
+		})
+		if err != nil {
+			return 0, 0, 0, dend, err
+		}
+		if data == nil {
 			return 0, 0, 0, dend, fmt.Errorf("invalid raw message data: %v", rawData)
 		}
-		m, err = DecodeDelayedMessage(rawData[4:], q.IsExt())
+		m, err = DecodeDelayedMessage(data, q.IsExt())
 		if err != nil {
 			return 0, 0, 0, dend, err
 		}
@@ -684,18 +858,19 @@ func (q *DelayQueue) put(m *Message, rawData []byte, trace bool, checkSize int64
 	var offset BackendOffset
 	var writeBytes int32
 	if rawData != nil {
+		// the buffer is used as the value in kv store
 		q.putBuffer.Reset()
-		_, err := m.WriteDelayedTo(&q.putBuffer, q.IsExt())
+		_, err = m.WriteDelayedTo(&q.putBuffer, q.IsExt())
 		if err != nil {
 			return 0, 0, 0, dend, err
 		}
 		offset, writeBytes, dend, err = q.backend.PutRawV2(rawData, 1)
-		if checkSize > 0 && checkSize != int64(writeBytes) {
-			return 0, 0, 0, dend, err
+		if err == nil && checkSize > 0 && checkSize != int64(writeBytes) {
+			return 0, 0, 0, dend, fmt.Errorf("write message size mismatch: %v vs %v", checkSize, writeBytes)
 		}
 	} else {
-		offset, writeBytes, dend, err = writeDelayedMessageToBackendWithCheck(&q.putBuffer,
-			m, checkSize, q.backend, q.IsExt())
+		offset, writeBytes, dend, err = writeDelayedMessageToBackend(&q.putBuffer,
+			m, q.backend, q.IsExt())
 	}
 	atomic.StoreInt32(&q.needFlush, 1)
 	if err != nil {
@@ -704,54 +879,39 @@ func (q *DelayQueue) put(m *Message, rawData []byte, trace bool, checkSize int64
 			q.GetFullName(), err)
 		return m.ID, offset, writeBytes, dend, err
 	}
+	if m.DelayedType == DelayedUpdate {
+		err = q.applyDelayedUpdate(m, dend.Offset())
+		if err != nil {
+			nsqLog.LogErrorf("TOPIC(%s) : failed to apply delayed update %v - %s", q.GetFullName(), m, err)
+			return m.ID, offset, writeBytes, dend, err
+		}
+		if trace && (m.TraceID != 0 || atomic.LoadInt32(&q.EnableTrace) == 1 || nsqLog.Level() >= levellogger.LOG_DETAIL) {
+			nsqMsgTracer.TracePub(q.GetTopicName(), q.GetTopicPart(), "DELAY_QUEUE_UPDATE", m.TraceID, m, offset, dend.TotalMsgCnt())
+		}
+		q.trySyncEvery(dend)
+		return m.ID, offset, writeBytes, dend, nil
+	}
 	msgKey := getDelayedMsgDBKey(int(m.DelayedType), m.DelayedChannel, m.DelayedTs, m.ID)
+	msgValue, err := sealDelayedMsgValue(q.putBuffer.Bytes())
+	if err != nil {
+		nsqLog.LogErrorf("TOPIC(%s) : failed to encrypt delayed message - %s", q.GetFullName(), err)
+		return m.ID, offset, writeBytes, dend, err
+	}
 
 	wstart := time.Now()
 	q.compactMutex.Lock()
-	err = q.getStore().Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucketDelayedMsg)
-		oldV := b.Get(msgKey)
-		exists := oldV != nil
-		if exists && bytes.Equal(oldV, q.putBuffer.Bytes()) {
-		} else {
-			err := b.Put(msgKey, q.putBuffer.Bytes())
-			if err != nil {
-				return err
-			}
-			if oldV != nil {
-				err = deleteMsgIndex(oldV, tx, q.IsExt())
-				if err != nil {
-					nsqLog.Infof("failed to delete old delayed index : %v, %v", oldV, err)
-					return err
-				}
-			}
-			b = tx.Bucket(bucketDelayedMsgIndex)
-			newIndexKey := getDelayedMsgDBIndexKey(int(m.DelayedType), m.DelayedChannel, m.DelayedOrigID)
-			d := getDelayedMsgDBIndexValue(m.DelayedTs, m.DelayedOrigID)
-			err = b.Put(newIndexKey, d)
-			if err != nil {
-				return err
-			}
-		}
-		b = tx.Bucket(bucketMeta)
-		if !exists {
-			cntKey := append([]byte("counter_"), getDelayedMsgDBPrefixKey(int(m.DelayedType), m.DelayedChannel)...)
-			cnt := uint64(0)
-			cntBytes := b.Get(cntKey)
-			if cntBytes != nil && len(cntBytes) == 8 {
-				cnt = binary.BigEndian.Uint64(cntBytes)
-			}
-			cnt++
-			cntBytes = make([]byte, 8)
-
-			binary.BigEndian.PutUint64(cntBytes[:8], cnt)
-			err = b.Put(cntKey, cntBytes)
+	if q.wheel != nil {
+		err = q.wheel.put(msgKey, m.DelayedOrigID, msgValue, dend.Offset())
+	} else {
+		err = q.getStore().Update(func(tx *bolt.Tx) error {
+			err := putBucketKey(m, msgKey, msgValue, q.putBuffer.Bytes(), tx, q.IsExt())
 			if err != nil {
 				return err
 			}
-		}
-		return b.Put(syncedOffsetKey, []byte(strconv.Itoa(int(dend.Offset()))))
-	})
+			b := tx.Bucket(bucketMeta)
+			return b.Put(syncedOffsetKey, []byte(strconv.Itoa(int(dend.Offset()))))
+		})
+	}
 	atomic.StoreInt64(&q.changedTs, time.Now().UnixNano())
 	q.compactMutex.Unlock()
 	if err != nil {
@@ -779,13 +939,16 @@ func (q *DelayQueue) put(m *Message, rawData []byte, trace bool, checkSize int64
 			nsqMsgTracer.TracePub(q.GetTopicName(), q.GetTopicPart(), "DELAY_QUEUE_PUB", m.TraceID, m, offset, dend.TotalMsgCnt())
 		}
 	}
+	q.trySyncEvery(dend)
+	return m.ID, offset, writeBytes, dend, nil
+}
+
+func (q *DelayQueue) trySyncEvery(dend diskQueueEndInfo) {
 	syncEvery := atomic.LoadInt64(&q.SyncEvery)
 	if syncEvery == 1 ||
 		dend.TotalMsgCnt()-atomic.LoadInt64(&q.lastSyncCnt) >= syncEvery {
 		q.flush(false)
 	}
-
-	return m.ID, offset, writeBytes, dend, nil
 }
 
 func (q *DelayQueue) Delete() error {
@@ -802,17 +965,26 @@ func (q *DelayQueue) exit(deleted bool) error {
 	}
 
 	if deleted {
-		q.getStore().Close()
+		q.closeStore()
 		os.RemoveAll(path.Join(q.dataPath, getDelayQueueDBName(q.tname, q.partition)))
+		os.RemoveAll(path.Join(q.dataPath, getDelayQueueLogName(q.tname, q.partition)))
 		return q.backend.Delete()
 	}
 
 	// write anything leftover to disk
 	q.flush(true)
-	q.getStore().Close()
+	q.closeStore()
 	return q.backend.Close()
 }
 
+func (q *DelayQueue) closeStore() {
+	if q.wheel != nil {
+		q.wheel.close()
+		return
+	}
+	q.getStore().Close()
+}
+
 func (q *DelayQueue) ForceFlush() {
 	q.flush(false)
 }
@@ -829,7 +1001,11 @@ func (q *DelayQueue) flush(fsync bool) error {
 		nsqLog.LogErrorf("failed flush: %v", err)
 		return err
 	}
-	q.getStore().Sync()
+	if q.wheel != nil {
+		q.wheel.sync()
+	} else {
+		q.getStore().Sync()
+	}
 
 	cost := time.Now().Sub(s)
 	if cost > slowCost {
@@ -858,7 +1034,7 @@ func (q *DelayQueue) emptyDelayedUntil(dt int, peekTs int64, id MessageID, ch st
 	}
 	db := q.getStore()
 	prefix := getDelayedMsgDBPrefixKey(dt, ch)
-	if totalCnt < uint64(txMaxBatch) {
+	if totalCnt < uint64(txMaxBatch) && q.wheel == nil {
 		if ds, _ := q.GetDBSize(); ds > largeDBSize {
 			nsqLog.Infof("topic %v empty return early since exceed max size %v, %v, %v", q.GetFullName(), string(prefix), ds, totalCnt)
 			// we just ignore large db error
@@ -874,76 +1050,80 @@ func (q *DelayQueue) emptyDelayedUntil(dt int, peekTs int64, id MessageID, ch st
 	batched := 0
 	exceedMaxBatch := false
 
-	err = db.Update(func(tx *bolt.Tx) error {
-		dbSize := tx.Size()
-		b := tx.Bucket(bucketDelayedMsg)
-		c := b.Cursor()
-		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
-			if batched > txMaxBatch {
-				exceedMaxBatch = true
-				nsqLog.Infof("topic %v empty return early since exceed max batch : %v, %v", q.GetFullName(), string(prefix), batched)
-				break
-			}
-			if dbSize > largeDBSize/4 && time.Since(scanStart) >= time.Second {
-				exceedMaxBatch = true
-				nsqLog.Infof("topic %v empty return early since exceed max time: %v, %v, %v", q.GetFullName(), string(prefix), batched, dbSize)
-				break
-			}
-			delayedType, delayedTs, delayedID, delayedCh, err := decodeDelayedMsgDBKey(k)
-			if err != nil {
-				nsqLog.Infof("decode key failed : %v, %v", k, err)
-				continue
-			}
-			if delayedType != uint16(dt) {
-				continue
-			}
-			if !emptyAll {
-				if delayedTs > peekTs {
+	if q.wheel != nil {
+		cleanedTs, batched, exceedMaxBatch, err = q.wheel.deleteUntil(prefix, peekTs, id, emptyAll, txMaxBatch)
+	} else {
+		err = db.Update(func(tx *bolt.Tx) error {
+			dbSize := tx.Size()
+			b := tx.Bucket(bucketDelayedMsg)
+			c := b.Cursor()
+			for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+				if batched > txMaxBatch {
+					exceedMaxBatch = true
+					nsqLog.Infof("topic %v empty return early since exceed max batch : %v, %v", q.GetFullName(), string(prefix), batched)
 					break
 				}
-				if delayedTs == peekTs && delayedID >= id {
+				if dbSize > largeDBSize/4 && time.Since(scanStart) >= time.Second {
+					exceedMaxBatch = true
+					nsqLog.Infof("topic %v empty return early since exceed max time: %v, %v, %v", q.GetFullName(), string(prefix), batched, dbSize)
 					break
 				}
-				if delayedCh != ch {
+				delayedType, delayedTs, delayedID, delayedCh, err := decodeDelayedMsgDBKey(k)
+				if err != nil {
+					nsqLog.Infof("decode key failed : %v, %v", k, err)
 					continue
 				}
-			} else {
-				if ch != "" && delayedCh != ch {
+				if delayedType != uint16(dt) {
 					continue
 				}
-			}
-			err = deleteBucketKey(dt, delayedCh, delayedTs, delayedID, tx, q.IsExt())
-			if err != nil {
-				if err != errBucketKeyNotFound {
-					nsqLog.Warningf("failed to delete : %v, %v", k, err)
-					return err
+				if !emptyAll {
+					if delayedTs > peekTs {
+						break
+					}
+					if delayedTs == peekTs && delayedID >= id {
+						break
+					}
+					if delayedCh != ch {
+						continue
+					}
+				} else {
+					if ch != "" && delayedCh != ch {
+						continue
+					}
 				}
-			}
-			cleanedTs = delayedTs
-			batched++
-		}
-		if batched == 0 && !exceedMaxBatch && emptyAll && ch != "" {
-			bm := tx.Bucket(bucketMeta)
-			cntKey := append([]byte("counter_"), getDelayedMsgDBPrefixKey(dt, ch)...)
-			cnt := uint64(0)
-			cntBytes := bm.Get(cntKey)
-			if cntBytes != nil && len(cntBytes) == 8 {
-				cnt = binary.BigEndian.Uint64(cntBytes)
-			}
-			if cnt > 0 {
-				nsqLog.Warningf("topic %v empty delayed counter need fix: %v, %v", q.GetFullName(), string(prefix), cnt)
-				cnt = 0
-				cntBytes = make([]byte, 8)
-				binary.BigEndian.PutUint64(cntBytes[:8], cnt)
-				err = bm.Put(cntKey, cntBytes)
+				err = deleteBucketKey(dt, delayedCh, delayedTs, delayedID, tx, q.IsExt())
 				if err != nil {
-					nsqLog.Infof("failed to update the meta count: %v, %v", cntKey, err)
-					return err
+					if err != errBucketKeyNotFound {
+						nsqLog.Warningf("failed to delete : %v, %v", k, err)
+						return err
+					}
 				}
+				cleanedTs = delayedTs
+				batched++
 			}
-		}
-		return nil
-	})
+			if batched == 0 && !exceedMaxBatch && emptyAll && ch != "" {
+				bm := tx.Bucket(bucketMeta)
+				cntKey := append([]byte("counter_"), getDelayedMsgDBPrefixKey(dt, ch)...)
+				cnt := uint64(0)
+				cntBytes := bm.Get(cntKey)
+				if cntBytes != nil && len(cntBytes) == 8 {
+					cnt = binary.BigEndian.Uint64(cntBytes)
+				}
+				if cnt > 0 {
+					nsqLog.Warningf("topic %v empty delayed counter need fix: %v, %v", q.GetFullName(), string(prefix), cnt)
+					cnt = 0
+					cntBytes = make([]byte, 8)
+					binary.BigEndian.PutUint64(cntBytes[:8], cnt)
+					err = bm.Put(cntKey, cntBytes)
+					if err != nil {
+						nsqLog.Infof("failed to update the meta count: %v, %v", cntKey, err)
+						return err
+					}
+				}
+			}
+			return nil
+		})
+	}
 	if err != nil {
 		if err == errDBSizeTooLarge {
 			return cleanedTs, nil
@@ -1022,56 +1202,68 @@ func (q *DelayQueue) PeekRecentTimeoutWithFilter(results []Message, peekTs int64
 		}
 	}
 	oldest = int64(0)
-	err := db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucketDelayedMsg)
-		c := b.Cursor()
-		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
-			_, delayedTs, _, delayedCh, err := decodeDelayedMsgDBKey(k)
-			if err != nil {
-				nsqLog.Infof("decode key failed : %v, %v", k, err)
-				continue
-			}
-			if oldest == 0 && filterType == ChannelDelayed && filterChannel != "" {
-				oldest = delayedTs
-			}
-			if nsqLog.Level() > levellogger.LOG_DETAIL {
-				nsqLog.LogDebugf("peek delayed message %v: %v at %v", k, delayedTs, time.Now().UnixNano())
-			}
+	var err error
+	if q.wheel != nil {
+		idx, oldest = q.wheel.peek(results, peekTs, prefix, q.IsExt())
+		if filterType != ChannelDelayed || filterChannel == "" {
+			oldest = 0
+		}
+	} else {
+		err = db.View(func(tx *bolt.Tx) error {
+			b := tx.Bucket(bucketDelayedMsg)
+			c := b.Cursor()
+			for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+				_, delayedTs, _, delayedCh, err := decodeDelayedMsgDBKey(k)
+				if err != nil {
+					nsqLog.Infof("decode key failed : %v, %v", k, err)
+					continue
+				}
+				if oldest == 0 && filterType == ChannelDelayed && filterChannel != "" {
+					oldest = delayedTs
+				}
+				if nsqLog.Level() > levellogger.LOG_DETAIL {
+					nsqLog.LogDebugf("peek delayed message %v: %v at %v", k, delayedTs, time.Now().UnixNano())
+				}
 
-			if delayedTs > peekTs || idx >= len(results) {
-				break
-			}
+				if delayedTs > peekTs || idx >= len(results) {
+					break
+				}
 
-			if filterChannel != "" && delayedCh != filterChannel {
-				continue
-			}
+				if filterChannel != "" && delayedCh != filterChannel {
+					continue
+				}
 
-			if v == nil {
-				// k is not nil, v is nil, sub bucket?
-				nsqLog.LogErrorf("topic %v iterater nil value: %v",
-					q.fullName, k)
-				continue
-			}
-			buf := make([]byte, len(v))
-			copy(buf, v)
-			m, err := DecodeDelayedMessage(buf, q.IsExt())
-			if err != nil {
-				nsqLog.LogErrorf("topic %v failed to decode delayed message: %v, %v, %v",
-					q.fullName, v, k, err)
-				continue
-			}
-			if nsqLog.Level() > levellogger.LOG_DETAIL {
-				nsqLog.LogDebugf("peek delayed message %v: %v, %v", k, delayedTs, m)
-			}
+				if v == nil {
+					// k is not nil, v is nil, sub bucket?
+					nsqLog.LogErrorf("topic %v iterater nil value: %v",
+						q.fullName, k)
+					continue
+				}
+				buf, err := openDelayedMsgValue(v)
+				if err != nil {
+					nsqLog.LogErrorf("topic %v failed to decrypt delayed message: %v, %v",
+						q.fullName, k, err)
+					continue
+				}
+				m, err := DecodeDelayedMessage(buf, q.IsExt())
+				if err != nil {
+					nsqLog.LogErrorf("topic %v failed to decode delayed message: %v, %v, %v",
+						q.fullName, v, k, err)
+					continue
+				}
+				if nsqLog.Level() > levellogger.LOG_DETAIL {
+					nsqLog.LogDebugf("peek delayed message %v: %v, %v", k, delayedTs, m)
+				}
 
-			if filterType >= 0 && filterType != int(m.DelayedType) {
-				continue
+				if filterType >= 0 && filterType != int(m.DelayedType) {
+					continue
+				}
+				results[idx] = *m
+				idx++
 			}
-			results[idx] = *m
-			idx++
-		}
-		return nil
-	})
+			return nil
+		})
+	}
 	// if the delayed queue changed during peeking, we should not update oldest ts since it may changed by write
 	if err == nil && oldest > 0 && oldChangeTs == q.GetChangedTs() {
 		q.oldestMutex.Lock()
@@ -1098,6 +1290,13 @@ func (q *DelayQueue) PeekAll(results []Message) (int, error) {
 }
 
 func (q *DelayQueue) GetSyncedOffset() (BackendOffset, error) {
+	if q.wheel != nil {
+		synced, err := q.wheel.syncedOffset()
+		if err != nil {
+			nsqLog.LogErrorf("topic %v failed to get synced offset: %v", q.fullName, err)
+		}
+		return synced, err
+	}
 	var synced BackendOffset
 	err := q.getStore().View(func(tx *bolt.Tx) error {
 		b := tx.Bucket(bucketMeta)
@@ -1116,6 +1315,9 @@ func (q *DelayQueue) GetSyncedOffset() (BackendOffset, error) {
 }
 
 func (q *DelayQueue) GetCurrentDelayedCnt(dt int, channel string) (uint64, error) {
+	if q.wheel != nil {
+		return q.wheel.count(getDelayedMsgDBPrefixKey(dt, channel)), nil
+	}
 	cnt := uint64(0)
 	err := q.getStore().View(func(tx *bolt.Tx) error {
 		b := tx.Bucket(bucketMeta)
@@ -1134,10 +1336,16 @@ func (q *DelayQueue) ConfirmedMessage(msg *Message) error {
 	// confirmed message is finished by channel, this message has swap the
 	// delayed id and original id to make sure the map key of inflight is original id
 	q.compactMutex.Lock()
-	err := q.getStore().Update(func(tx *bolt.Tx) error {
-		return deleteBucketKey(int(msg.DelayedType), msg.DelayedChannel,
-			msg.DelayedTs, msg.DelayedOrigID, tx, q.IsExt())
-	})
+	var err error
+	if q.wheel != nil {
+		err = q.wheel.delete(getDelayedMsgDBKey(int(msg.DelayedType), msg.DelayedChannel,
+			msg.DelayedTs, msg.DelayedOrigID))
+	} else {
+		err = q.getStore().Update(func(tx *bolt.Tx) error {
+			return deleteBucketKey(int(msg.DelayedType), msg.DelayedChannel,
+				msg.DelayedTs, msg.DelayedOrigID, tx, q.IsExt())
+		})
+	}
 	atomic.StoreInt64(&q.changedTs, time.Now().UnixNano())
 	q.compactMutex.Unlock()
 	if err != nil {
@@ -1158,6 +1366,9 @@ func (q *DelayQueue) ConfirmedMessage(msg *Message) error {
 func (q *DelayQueue) IsChannelMessageDelayed(msgID MessageID, ch string) bool {
 	found := false
 	msgKey := getDelayedMsgDBIndexKey(ChannelDelayed, ch, msgID)
+	if q.wheel != nil {
+		return q.wheel.isIndexed(msgKey)
+	}
 	q.getStore().View(func(tx *bolt.Tx) error {
 		b := tx.Bucket(bucketDelayedMsgIndex)
 		v := b.Get(msgKey)
@@ -1212,6 +1423,12 @@ func (q *DelayQueue) GetOldestConsumedState(chList []string, includeOthers bool)
 		if nsqLog.Level() > levellogger.LOG_DETAIL {
 			nsqLog.LogDebugf("peek prefix %v: channel %v", prefix, origCh)
 		}
+		if q.wheel != nil {
+			if k := q.wheel.oldestKey(prefix); k != nil {
+				keyList = append(keyList, k)
+			}
+			continue
+		}
 
 		err := db.View(func(tx *bolt.Tx) error {
 			b := tx.Bucket(bucketDelayedMsg)
@@ -1366,6 +1583,9 @@ func (q *DelayQueue) TryCleanOldData(retentionSize int64, noRealClean bool, maxC
 }
 
 func (q *DelayQueue) compactStore(force bool) error {
+	if q.wheel != nil {
+		return q.wheel.compact(force)
+	}
 	src := q.getStore()
 	origPath := src.Path()
 	if !force {
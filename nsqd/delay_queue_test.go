@@ -741,3 +741,184 @@ func TestDelayQueueCompactStore(t *testing.T) {
 		time.Sleep(time.Millisecond)
 	}
 }
+
+func TestDelayQueueWheelEngine(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-delay-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.SyncEvery = 1
+	if testing.Verbose() {
+		SetLogger(opts.Logger)
+	}
+
+	// write to the bolt engine and convert to the wheel engine
+	dq, err := NewDelayQueue("test-wheel", 0, tmpDir, opts, nil, false)
+	test.Nil(t, err)
+	cnt := 10
+	now := time.Now().UnixNano()
+	var end BackendOffset
+	var middle *Message
+	for i := 0; i < cnt; i++ {
+		for _, ch := range []string{"test", "test2"} {
+			msg := NewMessage(0, []byte("body"))
+			msg.DelayedType = ChannelDelayed
+			msg.DelayedTs = now + int64(i)*int64(time.Millisecond*300)
+			msg.DelayedChannel = ch
+			msg.DelayedOrigID = MessageID(i + 1)
+			_, _, _, dend, err := dq.PutDelayMessage(msg)
+			test.Nil(t, err)
+			end = dend.Offset()
+			if i == cnt/2 && ch == "test" {
+				middle = msg
+			}
+		}
+	}
+	msg := NewMessage(0, []byte("pub"))
+	msg.DelayedType = PubDelayed
+	msg.DelayedTs = now
+	_, _, _, dend, err := dq.PutDelayMessage(msg)
+	test.Nil(t, err)
+	end = dend.Offset()
+	dq.Close()
+
+	opts.DelayQueueEngine = DelayQueueEngineWheel
+	dq, err = NewDelayQueue("test-wheel", 0, tmpDir, opts, nil, false)
+	test.Nil(t, err)
+	test.NotNil(t, dq.wheel)
+	_, err = os.Stat(path.Join(dq.dataPath, getDelayQueueDBName(dq.tname, dq.partition)))
+	test.NotNil(t, err)
+	synced, err := dq.GetSyncedOffset()
+	test.Nil(t, err)
+	test.Equal(t, end, synced)
+	newCnt, _ := dq.GetCurrentDelayedCnt(ChannelDelayed, "test")
+	test.Equal(t, cnt, int(newCnt))
+	newCnt, _ = dq.GetCurrentDelayedCnt(PubDelayed, "")
+	test.Equal(t, 1, int(newCnt))
+	test.Equal(t, true, dq.IsChannelMessageDelayed(1, "test"))
+	test.Nil(t, dq.CheckConsistence())
+
+	ret := make([]Message, cnt*3)
+	n, err := dq.PeekRecentChannelTimeout(middle.DelayedTs, ret, "test")
+	test.Nil(t, err)
+	test.Equal(t, cnt/2+1, n)
+	for i, m := range ret[:n] {
+		test.Equal(t, "test", m.DelayedChannel)
+		test.Equal(t, MessageID(i+1), m.DelayedOrigID)
+	}
+	n, err = dq.PeekRecentDelayedPub(now, ret)
+	test.Nil(t, err)
+	test.Equal(t, 1, n)
+	test.Equal(t, "pub", string(ret[0].Body))
+	n, err = dq.PeekAll(ret)
+	test.Nil(t, err)
+	test.Equal(t, cnt*2+1, n)
+
+	// write more to the wheel engine after converted
+	for i := cnt; i < cnt*2; i++ {
+		msg := NewMessage(0, []byte("body"))
+		msg.DelayedType = ChannelDelayed
+		msg.DelayedTs = now + int64(i)*int64(time.Millisecond*300)
+		msg.DelayedChannel = "test"
+		msg.DelayedOrigID = MessageID(i + 1)
+		_, _, _, _, err := dq.PutDelayMessage(msg)
+		test.Nil(t, err)
+	}
+	n, err = dq.PeekRecentChannelTimeout(now, ret, "test")
+	test.Nil(t, err)
+	test.Equal(t, 1, n)
+	err = dq.ConfirmedMessage(&ret[0])
+	test.Nil(t, err)
+	test.Equal(t, false, dq.IsChannelMessageDelayed(1, "test"))
+	newCnt, _ = dq.GetCurrentDelayedCnt(ChannelDelayed, "test")
+	test.Equal(t, cnt*2-1, int(newCnt))
+
+	dq.emptyDelayedUntil(ChannelDelayed, middle.DelayedTs, middle.ID, "test", false)
+	recent, _, chCntList := dq.GetOldestConsumedState([]string{"test", "test2"}, true)
+	// the pub delayed and the channels
+	test.Equal(t, 3, len(recent))
+	_, ts, id, ch, err := decodeDelayedMsgDBKey(recent[1])
+	test.Nil(t, err)
+	test.Equal(t, middle.DelayedChannel, ch)
+	test.Equal(t, middle.ID, id)
+	test.Equal(t, middle.DelayedTs, ts)
+	test.Equal(t, uint64(cnt*2-cnt/2), chCntList["test"])
+	test.Equal(t, uint64(cnt), chCntList["test2"])
+
+	// the log should be the same after compacted and replayed
+	dbSize, _ := dq.GetDBSize()
+	err = dq.compactStore(true)
+	test.Nil(t, err)
+	newSize, _ := dq.GetDBSize()
+	test.Equal(t, true, newSize < dbSize)
+	n, err = dq.PeekRecentChannelTimeout(middle.DelayedTs, ret, "test")
+	test.Nil(t, err)
+	test.Equal(t, 1, n)
+	test.Equal(t, middle.DelayedOrigID, ret[0].DelayedOrigID)
+	dq.EmptyDelayedChannel("test2")
+	dq.Close()
+	dq, err = NewDelayQueue("test-wheel", 0, tmpDir, opts, nil, false)
+	test.Nil(t, err)
+	newCnt, _ = dq.GetCurrentDelayedCnt(ChannelDelayed, "test")
+	test.Equal(t, cnt*2-cnt/2, int(newCnt))
+	newCnt, _ = dq.GetCurrentDelayedCnt(ChannelDelayed, "test2")
+	test.Equal(t, 0, int(newCnt))
+	synced, err = dq.GetSyncedOffset()
+	test.Nil(t, err)
+	test.Equal(t, dq.backend.GetQueueWriteEnd().Offset(), synced)
+
+	// the backup of the wheel engine can be restored by the bolt engine
+	var buf bytes.Buffer
+	fsize, err := dq.BackupKVStoreTo(&buf)
+	test.Nil(t, err)
+	test.Equal(t, int64(buf.Len()), fsize)
+	boltOpts := NewOptions()
+	boltOpts.Logger = opts.Logger
+	dqBolt, err := NewDelayQueue("test-bolt", 0, tmpDir, boltOpts, nil, false)
+	test.Nil(t, err)
+	defer dqBolt.Close()
+	err = dqBolt.RestoreKVStoreFrom(&buf)
+	test.Nil(t, err)
+	newCnt, _ = dqBolt.GetCurrentDelayedCnt(ChannelDelayed, "test")
+	test.Equal(t, cnt*2-cnt/2, int(newCnt))
+	test.Equal(t, true, dqBolt.IsChannelMessageDelayed(MessageID(cnt*2), "test"))
+	synced2, err := dqBolt.GetSyncedOffset()
+	test.Nil(t, err)
+	test.Equal(t, synced, synced2)
+
+	// and the backup of the bolt engine can be restored by the wheel engine
+	buf.Reset()
+	_, err = dqBolt.BackupKVStoreTo(&buf)
+	test.Nil(t, err)
+	dq.EmptyDelayedChannel("test")
+	newCnt, _ = dq.GetCurrentDelayedCnt(ChannelDelayed, "test")
+	test.Equal(t, 0, int(newCnt))
+	err = dq.RestoreKVStoreFrom(&buf)
+	test.Nil(t, err)
+	newCnt, _ = dq.GetCurrentDelayedCnt(ChannelDelayed, "test")
+	test.Equal(t, cnt*2-cnt/2, int(newCnt))
+	n, err = dq.PeekRecentChannelTimeout(middle.DelayedTs, ret, "test")
+	test.Nil(t, err)
+	test.Equal(t, 1, n)
+	test.Equal(t, "body", string(ret[0].Body))
+	dq.Close()
+
+	// convert back to the bolt engine
+	dq, err = NewDelayQueue("test-wheel", 0, tmpDir, boltOpts, nil, false)
+	test.Nil(t, err)
+	defer dq.Close()
+	test.Equal(t, true, dq.wheel == nil)
+	_, err = os.Stat(path.Join(dq.dataPath, getDelayQueueLogName(dq.tname, dq.partition)))
+	test.NotNil(t, err)
+	newCnt, _ = dq.GetCurrentDelayedCnt(ChannelDelayed, "test")
+	test.Equal(t, cnt*2-cnt/2, int(newCnt))
+	test.Equal(t, true, dq.IsChannelMessageDelayed(MessageID(cnt*2), "test"))
+	n, err = dq.PeekRecentChannelTimeout(middle.DelayedTs, ret, "test")
+	test.Nil(t, err)
+	test.Equal(t, 1, n)
+	test.Equal(t, middle.DelayedOrigID, ret[0].DelayedOrigID)
+}
@@ -0,0 +1,245 @@
+package nsqd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/absolute8511/bolt"
+)
+
+// The delayed message is canceled or rescheduled by writing the update record to the delayed
+// queue, so the update is replicated to the replicas by the delayed commit log in the same
+// order as the delayed messages. The record is applied to the delayed message store (the
+// target message is removed or moved to the new delayed time) instead of stored.
+const delayedUpdateBodyLen = 2 + 8
+
+var ErrDelayedMessageNotFound = errors.New("delayed message not found")
+
+// NewDelayedUpdateMessage create the record to reschedule the delayed message to the new time
+// (unix nano), the delayed message will be canceled if the new time is 0.
+func NewDelayedUpdateMessage(target *Message, newTs int64) *Message {
+	body := make([]byte, delayedUpdateBodyLen)
+	binary.BigEndian.PutUint16(body[:2], uint16(target.DelayedType))
+	binary.BigEndian.PutUint64(body[2:], uint64(newTs))
+	m := NewMessage(0, body)
+	m.TraceID = target.TraceID
+	m.DelayedType = DelayedUpdate
+	m.DelayedTs = target.DelayedTs
+	m.DelayedOrigID = target.ID
+	m.DelayedChannel = target.DelayedChannel
+	return m
+}
+
+func decodeDelayedUpdate(m *Message) (int, int64, error) {
+	if len(m.Body) != delayedUpdateBodyLen {
+		return 0, 0, errors.New("invalid delayed update message")
+	}
+	dt := int(binary.BigEndian.Uint16(m.Body[:2]))
+	newTs := int64(binary.BigEndian.Uint64(m.Body[2:]))
+	return dt, newTs, nil
+}
+
+// getDelayedTypeOfChannel return the delayed type of the channel, the scheduled pub messages
+// have no channel.
+func getDelayedTypeOfChannel(ch string) int {
+	if ch == "" {
+		return PubDelayed
+	}
+	return ChannelDelayed
+}
+
+// rescheduleDelayedMsgValue decode the stored delayed message and return the message moved to the
+// new delayed time with the plain data and the value to store.
+func rescheduleDelayedMsgValue(v []byte, newTs int64, isExt bool) (*Message, []byte, []byte, error) {
+	plain, err := openDelayedMsgValue(v)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	m, err := DecodeDelayedMessage(plain, isExt)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	m.DelayedTs = newTs
+	var buf bytes.Buffer
+	_, err = m.WriteDelayedTo(&buf, isExt)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	value, err := sealDelayedMsgValue(buf.Bytes())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return m, buf.Bytes(), value, nil
+}
+
+// applyDelayedUpdate remove or reschedule the target delayed message of the update record, the
+// record is ignored if the target is not found (confirmed or cleaned already).
+func (q *DelayQueue) applyDelayedUpdate(m *Message, synced BackendOffset) error {
+	dt, newTs, err := decodeDelayedUpdate(m)
+	if err != nil {
+		return err
+	}
+	oldKey := getDelayedMsgDBKey(dt, m.DelayedChannel, m.DelayedTs, m.DelayedOrigID)
+	q.compactMutex.Lock()
+	defer q.compactMutex.Unlock()
+	defer atomic.StoreInt64(&q.changedTs, time.Now().UnixNano())
+	if q.wheel != nil {
+		oldV, err := q.wheel.get(oldKey)
+		if err != nil {
+			return err
+		}
+		var newKey, newValue []byte
+		var target *Message
+		origID := MessageID(0)
+		if oldV != nil && newTs > 0 {
+			target, _, newValue, err = rescheduleDelayedMsgValue(oldV, newTs, q.IsExt())
+			if err != nil {
+				return err
+			}
+			newKey = getDelayedMsgDBKey(dt, m.DelayedChannel, newTs, target.ID)
+			origID = target.DelayedOrigID
+		}
+		err = q.wheel.replace(oldKey, newKey, origID, newValue, synced)
+		if err == nil && target != nil {
+			q.updateOldestChannelDelayedTs(target)
+		}
+		return err
+	}
+	var target *Message
+	err = q.getStore().Update(func(tx *bolt.Tx) error {
+		oldV := tx.Bucket(bucketDelayedMsg).Get(oldKey)
+		if oldV != nil {
+			var data, newValue []byte
+			var err error
+			if newTs > 0 {
+				target, data, newValue, err = rescheduleDelayedMsgValue(oldV, newTs, q.IsExt())
+				if err != nil {
+					return err
+				}
+			}
+			err = deleteBucketKey(dt, m.DelayedChannel, m.DelayedTs, m.DelayedOrigID, tx, q.IsExt())
+			if err != nil {
+				return err
+			}
+			if target != nil {
+				err = putBucketKey(target, getDelayedMsgDBKey(dt, m.DelayedChannel, newTs, target.ID),
+					newValue, data, tx, q.IsExt())
+				if err != nil {
+					return err
+				}
+			}
+		}
+		b := tx.Bucket(bucketMeta)
+		return b.Put(syncedOffsetKey, []byte(strconv.Itoa(int(synced))))
+	})
+	if err == nil && target != nil {
+		q.updateOldestChannelDelayedTs(target)
+	}
+	return err
+}
+
+func (q *DelayQueue) updateOldestChannelDelayedTs(m *Message) {
+	if m.DelayedType != ChannelDelayed {
+		return
+	}
+	q.oldestMutex.Lock()
+	oldest, ok := q.oldestChannelDelayedTs[m.DelayedChannel]
+	if !ok || oldest == 0 || m.DelayedTs < oldest {
+		q.oldestChannelDelayedTs[m.DelayedChannel] = m.DelayedTs
+	}
+	q.oldestMutex.Unlock()
+}
+
+// walkDelayedMessages walk the delayed messages of the channel (or the scheduled pub messages
+// if the channel is empty) ordered by the delayed time until fn return false.
+func (q *DelayQueue) walkDelayedMessages(ch string, fn func(m *Message) bool) error {
+	dt := getDelayedTypeOfChannel(ch)
+	prefix := getDelayedMsgDBPrefixKey(dt, ch)
+	walkFn := func(k []byte, v []byte) bool {
+		_, _, _, delayedCh, err := decodeDelayedMsgDBKey(k)
+		// prefix seek may across to other channel with the same prefix
+		if err != nil || delayedCh != ch {
+			return true
+		}
+		buf, err := openDelayedMsgValue(v)
+		if err != nil {
+			nsqLog.LogErrorf("topic %v failed to decrypt delayed message: %v, %v", q.fullName, k, err)
+			return true
+		}
+		m, err := DecodeDelayedMessage(buf, q.IsExt())
+		if err != nil {
+			nsqLog.LogErrorf("topic %v failed to decode delayed message: %v, %v", q.fullName, k, err)
+			return true
+		}
+		return fn(m)
+	}
+	if q.wheel != nil {
+		return q.wheel.walkPrefix(prefix, walkFn)
+	}
+	return q.getStore().View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketDelayedMsg).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			if !walkFn(k, v) {
+				break
+			}
+		}
+		return nil
+	})
+}
+
+// ListDelayedMessages return at most limit delayed messages of the channel (or the scheduled pub
+// messages if the channel is empty) delayed before dueBefore (unix nano, 0 for all) after skipping
+// the first offset messages.
+func (q *DelayQueue) ListDelayedMessages(ch string, dueBefore int64, offset int, limit int) ([]*Message, error) {
+	msgs := make([]*Message, 0, limit)
+	skipped := 0
+	err := q.walkDelayedMessages(ch, func(m *Message) bool {
+		if dueBefore > 0 && m.DelayedTs > dueBefore {
+			return false
+		}
+		if skipped < offset {
+			skipped++
+			return true
+		}
+		msgs = append(msgs, m)
+		return len(msgs) < limit
+	})
+	return msgs, err
+}
+
+// FindDelayedMessage find the delayed message of the channel (or the scheduled pub message if
+// the channel is empty) by the message id or the trace id if the id is 0. The message id is the
+// id in the topic for the channel delayed message, and the id returned by the pub for the
+// scheduled pub message.
+func (q *DelayQueue) FindDelayedMessage(ch string, id MessageID, traceID uint64) (*Message, error) {
+	var found *Message
+	err := q.walkDelayedMessages(ch, func(m *Message) bool {
+		if id > 0 {
+			if GetDelayedMessageClientID(m) == id {
+				found = m
+			}
+		} else if m.TraceID == traceID {
+			found = m
+		}
+		return found == nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, ErrDelayedMessageNotFound
+	}
+	return found, nil
+}
+
+// GetDelayedMessageClientID return the message id known by the client of the delayed message
+func GetDelayedMessageClientID(m *Message) MessageID {
+	if m.DelayedType == ChannelDelayed {
+		return m.DelayedOrigID
+	}
+	return m.ID
+}
@@ -0,0 +1,129 @@
+package nsqd
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/youzan/nsq/internal/test"
+)
+
+func TestDelayQueueUpdateDelayedMessage(t *testing.T) {
+	for _, engine := range []string{DelayQueueEngineBolt, DelayQueueEngineWheel} {
+		tmpDir, err := ioutil.TempDir("", "nsq-test-delayed-update")
+		test.Nil(t, err)
+		defer os.RemoveAll(tmpDir)
+
+		opts := NewOptions()
+		opts.Logger = newTestLogger(t)
+		opts.SyncEvery = 1
+		opts.DelayQueueEngine = engine
+		dq, err := NewDelayQueue("test", 0, tmpDir, opts, nil, false)
+		test.Nil(t, err)
+		replicaDir := tmpDir + "/replica"
+		os.MkdirAll(replicaDir, 0755)
+		replica, err := NewDelayQueue("test", 0, replicaDir, opts, nil, false)
+		test.Nil(t, err)
+		defer replica.Close()
+
+		putOnLeaderAndReplica := func(m *Message) {
+			wend := replica.backend.GetQueueWriteEnd()
+			_, _, _, _, err := dq.PutDelayMessage(m)
+			test.Nil(t, err)
+			_, err = replica.PutMessageOnReplica(m, wend.Offset(), 0)
+			test.Nil(t, err)
+		}
+		now := time.Now().UnixNano()
+		cnt := 5
+		for i := 0; i < cnt; i++ {
+			msg := NewMessage(0, []byte("body"))
+			msg.DelayedType = ChannelDelayed
+			msg.DelayedTs = now + int64(i+1)*int64(time.Second)
+			msg.DelayedOrigID = MessageID(i + 1)
+			msg.DelayedChannel = "ch"
+			msg.TraceID = uint64(i + 100)
+			putOnLeaderAndReplica(msg)
+		}
+		// the channel with the same prefix should not be listed
+		msg := NewMessage(0, []byte("body"))
+		msg.DelayedType = ChannelDelayed
+		msg.DelayedTs = now
+		msg.DelayedOrigID = MessageID(1)
+		msg.DelayedChannel = "ch2"
+		putOnLeaderAndReplica(msg)
+
+		msgs, err := dq.ListDelayedMessages("ch", 0, 0, 10)
+		test.Nil(t, err)
+		test.Equal(t, cnt, len(msgs))
+		for i, m := range msgs {
+			test.Equal(t, MessageID(i+1), GetDelayedMessageClientID(m))
+		}
+		msgs, err = dq.ListDelayedMessages("ch", now+int64(time.Second)*2, 0, 10)
+		test.Nil(t, err)
+		test.Equal(t, 2, len(msgs))
+		msgs, err = dq.ListDelayedMessages("ch", 0, 1, 2)
+		test.Nil(t, err)
+		test.Equal(t, 2, len(msgs))
+		test.Equal(t, MessageID(2), msgs[0].DelayedOrigID)
+		test.Equal(t, MessageID(3), msgs[1].DelayedOrigID)
+
+		_, err = dq.FindDelayedMessage("ch", 6, 0)
+		test.Equal(t, ErrDelayedMessageNotFound, err)
+		target, err := dq.FindDelayedMessage("ch", 0, 102)
+		test.Nil(t, err)
+		test.Equal(t, MessageID(3), target.DelayedOrigID)
+
+		// cancel the second
+		target, err = dq.FindDelayedMessage("ch", 2, 0)
+		test.Nil(t, err)
+		putOnLeaderAndReplica(NewDelayedUpdateMessage(target, 0))
+		// reschedule the third before the first
+		target, err = dq.FindDelayedMessage("ch", 3, 0)
+		test.Nil(t, err)
+		putOnLeaderAndReplica(NewDelayedUpdateMessage(target, now))
+
+		checkUpdated := func(q *DelayQueue) {
+			delayedCnt, _ := q.GetCurrentDelayedCnt(ChannelDelayed, "ch")
+			test.Equal(t, uint64(cnt-1), delayedCnt)
+			_, err := q.FindDelayedMessage("ch", 2, 0)
+			test.Equal(t, ErrDelayedMessageNotFound, err)
+			test.Equal(t, false, q.IsChannelMessageDelayed(2, "ch"))
+			test.Equal(t, true, q.IsChannelMessageDelayed(3, "ch"))
+			msgs, err := q.ListDelayedMessages("ch", 0, 0, 10)
+			test.Nil(t, err)
+			test.Equal(t, cnt-1, len(msgs))
+			test.Equal(t, MessageID(3), msgs[0].DelayedOrigID)
+			test.Equal(t, now, msgs[0].DelayedTs)
+			test.Equal(t, uint64(102), msgs[0].TraceID)
+			results := make([]Message, cnt)
+			n, err := q.PeekRecentChannelTimeout(now+int64(time.Millisecond), results, "ch")
+			test.Nil(t, err)
+			test.Equal(t, 1, n)
+			test.Equal(t, MessageID(3), results[0].DelayedOrigID)
+			delayedCnt, _ = q.GetCurrentDelayedCnt(ChannelDelayed, "ch2")
+			test.Equal(t, uint64(1), delayedCnt)
+		}
+		checkUpdated(dq)
+		checkUpdated(replica)
+
+		// the update of the missing message is ignored
+		putOnLeaderAndReplica(NewDelayedUpdateMessage(target, 0))
+		putOnLeaderAndReplica(NewDelayedUpdateMessage(target, now))
+		target.DelayedTs = now
+		putOnLeaderAndReplica(NewDelayedUpdateMessage(target, 0))
+		delayedCnt, _ := dq.GetCurrentDelayedCnt(ChannelDelayed, "ch")
+		test.Equal(t, uint64(cnt-2), delayedCnt)
+		delayedCnt, _ = replica.GetCurrentDelayedCnt(ChannelDelayed, "ch")
+		test.Equal(t, uint64(cnt-2), delayedCnt)
+
+		dq.Close()
+		dq, err = NewDelayQueue("test", 0, tmpDir, opts, nil, false)
+		test.Nil(t, err)
+		delayedCnt, _ = dq.GetCurrentDelayedCnt(ChannelDelayed, "ch")
+		test.Equal(t, uint64(cnt-2), delayedCnt)
+		_, err = dq.FindDelayedMessage("ch", 3, 0)
+		test.Equal(t, ErrDelayedMessageNotFound, err)
+		dq.Close()
+	}
+}
@@ -0,0 +1,1119 @@
+package nsqd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/absolute8511/bolt"
+	"github.com/youzan/nsq/internal/util"
+)
+
+const (
+	DelayQueueEngineBolt  = "bolt"
+	DelayQueueEngineWheel = "wheel"
+)
+
+// The wheel engine keeps the delayed messages in an append-only log, each record is
+// [4-bytes size][4-bytes crc32c][1-byte op][payload], the size is the length of op and payload.
+// The put payload is [2-bytes key length][key][8-bytes orig id][8-bytes synced offset][value],
+// the key and value are the same as the bolt store, so the consumed state (the keys) replicated
+// between the nodes is compatible for both engines. The log is replayed to build the in-memory
+// time-bucketed index while opening, and rewritten with only the alive records while compacting.
+const (
+	delayedLogOpPut    = byte(1)
+	delayedLogOpDelete = byte(2)
+	delayedLogOpSynced = byte(3)
+
+	delayedLogHeaderSize   = 4 + 4
+	delayedLogPutFixedSize = 2 + 8 + 8
+	delayedLogMaxBodySize  = MAX_POSSIBLE_MSG_SIZE
+	delayedLogCompactRatio = 2
+	// the delayed messages in the same tick are kept in the same bucket
+	delayedWheelTick = int64(time.Second)
+)
+
+var (
+	delayedLogMagic          = []byte("NSQDLYLG")
+	errDelayedLogInvalid     = errors.New("invalid delayed log file")
+	errDelayedLogReadOnly    = errors.New("delayed log is read only")
+	errDelayedSyncedNotFound = errors.New("synced offset not found")
+)
+
+func getDelayQueueLogName(topicName string, part int) string {
+	return getDelayQueueDBName(topicName, part) + ".log"
+}
+
+func delayedWheelTickOf(ts int64) int64 {
+	tick := ts / delayedWheelTick
+	if ts < 0 && ts%delayedWheelTick != 0 {
+		tick--
+	}
+	return tick
+}
+
+func encodeDelayedLogRecord(op byte, body []byte) []byte {
+	rec := make([]byte, delayedLogHeaderSize+1+len(body))
+	rec[delayedLogHeaderSize] = op
+	copy(rec[delayedLogHeaderSize+1:], body)
+	binary.BigEndian.PutUint32(rec[:4], uint32(1+len(body)))
+	binary.BigEndian.PutUint32(rec[4:delayedLogHeaderSize], crc32.Checksum(rec[delayedLogHeaderSize:], crc32cTable))
+	return rec
+}
+
+func encodeDelayedLogPut(key []byte, origID MessageID, synced BackendOffset, value []byte) []byte {
+	body := make([]byte, delayedLogPutFixedSize+len(key)+len(value))
+	binary.BigEndian.PutUint16(body[:2], uint16(len(key)))
+	pos := 2
+	copy(body[pos:], key)
+	pos += len(key)
+	binary.BigEndian.PutUint64(body[pos:pos+8], uint64(origID))
+	pos += 8
+	binary.BigEndian.PutUint64(body[pos:pos+8], uint64(synced))
+	pos += 8
+	copy(body[pos:], value)
+	return encodeDelayedLogRecord(delayedLogOpPut, body)
+}
+
+func encodeDelayedLogSynced(synced BackendOffset) []byte {
+	var body [8]byte
+	binary.BigEndian.PutUint64(body[:], uint64(synced))
+	return encodeDelayedLogRecord(delayedLogOpSynced, body[:])
+}
+
+// scanDelayedLog read all the records after the magic, the position of the last valid
+// record end is returned with the error if the log is corrupt.
+func scanDelayedLog(r io.Reader, fn func(op byte, body []byte, pos int64, size int64) error) (int64, error) {
+	br := bufio.NewReaderSize(r, compactReadBufSize)
+	magic := make([]byte, len(delayedLogMagic))
+	_, err := io.ReadFull(br, magic)
+	if err != nil || !bytes.Equal(magic, delayedLogMagic) {
+		return 0, errDelayedLogInvalid
+	}
+	pos := int64(len(magic))
+	var header [delayedLogHeaderSize]byte
+	for {
+		_, err = io.ReadFull(br, header[:])
+		if err == io.EOF {
+			return pos, nil
+		}
+		if err != nil {
+			return pos, err
+		}
+		bodySize := binary.BigEndian.Uint32(header[:4])
+		if bodySize == 0 || bodySize > delayedLogMaxBodySize {
+			return pos, fmt.Errorf("invalid delayed log record size %v", bodySize)
+		}
+		body := make([]byte, bodySize)
+		_, err = io.ReadFull(br, body)
+		if err != nil {
+			return pos, err
+		}
+		if crc32.Checksum(body, crc32cTable) != binary.BigEndian.Uint32(header[4:]) {
+			return pos, ErrRecordChecksumMismatch
+		}
+		size := int64(delayedLogHeaderSize) + int64(bodySize)
+		err = fn(body[0], body[1:], pos, size)
+		if err != nil {
+			return pos, err
+		}
+		pos += size
+	}
+}
+
+// isDelayedLogFile check whether the file is the log of the wheel engine or the bolt db.
+func isDelayedLogFile(fileName string) (bool, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	magic := make([]byte, len(delayedLogMagic))
+	_, err = io.ReadFull(f, magic)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(magic, delayedLogMagic), nil
+}
+
+type delayedLogEntry struct {
+	key    string
+	prefix string
+	ts     int64
+	id     MessageID
+	origID MessageID
+	dt     int
+	ch     string
+	// the position and size of the record in the log
+	pos  int64
+	size int64
+	// the position of the value in the log
+	vpos int64
+	vlen int
+}
+
+func newDelayedLogEntry(body []byte, pos int64, size int64) (*delayedLogEntry, error) {
+	if len(body) < delayedLogPutFixedSize {
+		return nil, errDelayedLogInvalid
+	}
+	keyLen := int(binary.BigEndian.Uint16(body[:2]))
+	if len(body) < delayedLogPutFixedSize+keyLen {
+		return nil, errDelayedLogInvalid
+	}
+	key := body[2 : 2+keyLen]
+	dt, ts, id, ch, err := decodeDelayedMsgDBKey(key)
+	if err != nil {
+		return nil, err
+	}
+	e := &delayedLogEntry{
+		key:    string(key),
+		prefix: string(getDelayedMsgDBPrefixKey(int(dt), ch)),
+		ts:     ts,
+		id:     id,
+		origID: MessageID(binary.BigEndian.Uint64(body[2+keyLen : 2+keyLen+8])),
+		dt:     int(dt),
+		ch:     ch,
+		pos:    pos,
+		size:   size,
+		vpos:   pos + delayedLogHeaderSize + 1 + int64(delayedLogPutFixedSize+keyLen),
+		vlen:   len(body) - delayedLogPutFixedSize - keyLen,
+	}
+	return e, nil
+}
+
+func (e *delayedLogEntry) indexKey() string {
+	return string(getDelayedMsgDBIndexKey(e.dt, e.ch, e.origID))
+}
+
+// delayedTimeBucket hold the entries delayed in the same tick, sorted lazily while reading.
+type delayedTimeBucket struct {
+	entries map[string]*delayedLogEntry
+	sorted  []*delayedLogEntry
+}
+
+func (b *delayedTimeBucket) sortedEntries() []*delayedLogEntry {
+	if b.sorted != nil {
+		return b.sorted
+	}
+	b.sorted = make([]*delayedLogEntry, 0, len(b.entries))
+	for _, e := range b.entries {
+		b.sorted = append(b.sorted, e)
+	}
+	sort.Slice(b.sorted, func(i, j int) bool {
+		if b.sorted[i].ts != b.sorted[j].ts {
+			return b.sorted[i].ts < b.sorted[j].ts
+		}
+		return b.sorted[i].id < b.sorted[j].id
+	})
+	return b.sorted
+}
+
+// delayedTimeWheel is the time-bucketed index of the delayed messages with the same
+// delayed type and channel (the same key prefix in bolt).
+type delayedTimeWheel struct {
+	buckets map[int64]*delayedTimeBucket
+	// the sorted ticks of all the buckets
+	ticks []int64
+	cnt   uint64
+}
+
+func newDelayedTimeWheel() *delayedTimeWheel {
+	return &delayedTimeWheel{
+		buckets: make(map[int64]*delayedTimeBucket),
+	}
+}
+
+func (w *delayedTimeWheel) add(e *delayedLogEntry) {
+	tick := delayedWheelTickOf(e.ts)
+	b, ok := w.buckets[tick]
+	if !ok {
+		b = &delayedTimeBucket{entries: make(map[string]*delayedLogEntry)}
+		w.buckets[tick] = b
+		i := sort.Search(len(w.ticks), func(i int) bool { return w.ticks[i] >= tick })
+		w.ticks = append(w.ticks, 0)
+		copy(w.ticks[i+1:], w.ticks[i:])
+		w.ticks[i] = tick
+	}
+	b.entries[e.key] = e
+	b.sorted = nil
+	w.cnt++
+}
+
+func (w *delayedTimeWheel) remove(e *delayedLogEntry) {
+	tick := delayedWheelTickOf(e.ts)
+	b, ok := w.buckets[tick]
+	if !ok {
+		return
+	}
+	if _, ok := b.entries[e.key]; !ok {
+		return
+	}
+	delete(b.entries, e.key)
+	b.sorted = nil
+	w.cnt--
+	if len(b.entries) > 0 {
+		return
+	}
+	delete(w.buckets, tick)
+	i := sort.Search(len(w.ticks), func(i int) bool { return w.ticks[i] >= tick })
+	if i < len(w.ticks) && w.ticks[i] == tick {
+		w.ticks = append(w.ticks[:i], w.ticks[i+1:]...)
+	}
+}
+
+// walk the entries ordered by the delayed timestamp and id until fn return false.
+func (w *delayedTimeWheel) walk(fn func(e *delayedLogEntry) bool) {
+	for _, tick := range w.ticks {
+		for _, e := range w.buckets[tick].sortedEntries() {
+			if !fn(e) {
+				return
+			}
+		}
+	}
+}
+
+type delayedWheelStoreStats struct {
+	FileSize int64  `json:"file_size"`
+	LiveSize int64  `json:"live_size"`
+	Entries  int    `json:"entries"`
+	Wheels   int    `json:"wheels"`
+	Synced   int64  `json:"synced_offset"`
+	FileName string `json:"file_name"`
+}
+
+// delayedWheelStore is the delayed message store of the wheel engine, all the delayed
+// messages are indexed in memory by the key prefix and delayed time, and the values
+// are read from the log while peeking.
+type delayedWheelStore struct {
+	sync.Mutex
+	fileName  string
+	readOnly  bool
+	file      *os.File
+	fileSize  int64
+	liveSize  int64
+	synced    BackendOffset
+	hasSynced bool
+	entries   map[string]*delayedLogEntry
+	index     map[string]*delayedLogEntry
+	wheels    map[string]*delayedTimeWheel
+}
+
+func openDelayedWheelStore(fileName string, readOnly bool) (*delayedWheelStore, error) {
+	s := &delayedWheelStore{
+		fileName: fileName,
+		readOnly: readOnly,
+	}
+	err := s.openNoLock()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *delayedWheelStore) openNoLock() error {
+	flag := os.O_RDWR | os.O_CREATE
+	if s.readOnly {
+		flag = os.O_RDONLY
+	}
+	f, err := os.OpenFile(s.fileName, flag, 0644)
+	if err != nil {
+		return err
+	}
+	s.file = f
+	s.fileSize = 0
+	s.liveSize = 0
+	s.synced = 0
+	s.hasSynced = false
+	s.entries = make(map[string]*delayedLogEntry)
+	s.index = make(map[string]*delayedLogEntry)
+	s.wheels = make(map[string]*delayedTimeWheel)
+	err = s.replayNoLock()
+	if err != nil {
+		f.Close()
+		s.file = nil
+		return err
+	}
+	return nil
+}
+
+func (s *delayedWheelStore) replayNoLock() error {
+	stat, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.Size() == 0 && !s.readOnly {
+		_, err = s.file.WriteAt(delayedLogMagic, 0)
+		if err != nil {
+			return err
+		}
+		s.fileSize = int64(len(delayedLogMagic))
+		return nil
+	}
+	start := time.Now()
+	end, err := scanDelayedLog(io.NewSectionReader(s.file, 0, stat.Size()), s.applyNoLock)
+	if err == errDelayedLogInvalid {
+		nsqLog.LogErrorf("delayed log %v is invalid", s.fileName)
+		return err
+	}
+	if err != nil {
+		// the tail may be partial written before crash, the synced offset will be checked
+		// with the delayed queue data, so the lost tail can be fixed by the replication.
+		nsqLog.LogWarningf("delayed log %v corrupt at %v (size %v): %v", s.fileName, end, stat.Size(), err)
+		if !s.readOnly {
+			err = s.file.Truncate(end)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	s.fileSize = end
+	nsqLog.Logf("delayed log %v replayed %v entries, size %v, cost %v", s.fileName, len(s.entries), end, time.Since(start))
+	return nil
+}
+
+func (s *delayedWheelStore) applyNoLock(op byte, body []byte, pos int64, size int64) error {
+	switch op {
+	case delayedLogOpPut:
+		e, err := newDelayedLogEntry(body, pos, size)
+		if err != nil {
+			return err
+		}
+		s.addEntryNoLock(e)
+		keyLen := int(binary.BigEndian.Uint16(body[:2]))
+		s.synced = BackendOffset(binary.BigEndian.Uint64(body[2+keyLen+8 : 2+keyLen+16]))
+		s.hasSynced = true
+	case delayedLogOpDelete:
+		s.removeEntryNoLock(string(body))
+	case delayedLogOpSynced:
+		if len(body) < 8 {
+			return errDelayedLogInvalid
+		}
+		s.synced = BackendOffset(binary.BigEndian.Uint64(body[:8]))
+		s.hasSynced = true
+	default:
+		return fmt.Errorf("unknown delayed log op %v", op)
+	}
+	return nil
+}
+
+func (s *delayedWheelStore) addEntryNoLock(e *delayedLogEntry) {
+	s.removeEntryNoLock(e.key)
+	s.entries[e.key] = e
+	s.index[e.indexKey()] = e
+	w, ok := s.wheels[e.prefix]
+	if !ok {
+		w = newDelayedTimeWheel()
+		s.wheels[e.prefix] = w
+	}
+	w.add(e)
+	s.liveSize += e.size
+}
+
+func (s *delayedWheelStore) removeEntryNoLock(key string) *delayedLogEntry {
+	e, ok := s.entries[key]
+	if !ok {
+		return nil
+	}
+	delete(s.entries, key)
+	ik := e.indexKey()
+	if s.index[ik] == e {
+		delete(s.index, ik)
+	}
+	if w, ok := s.wheels[e.prefix]; ok {
+		w.remove(e)
+		if w.cnt == 0 {
+			delete(s.wheels, e.prefix)
+		}
+	}
+	s.liveSize -= e.size
+	return e
+}
+
+func (s *delayedWheelStore) appendNoLock(data []byte) (int64, error) {
+	if s.readOnly {
+		return 0, errDelayedLogReadOnly
+	}
+	pos := s.fileSize
+	_, err := s.file.WriteAt(data, pos)
+	if err != nil {
+		// remove the partial written data
+		s.file.Truncate(pos)
+		return pos, err
+	}
+	s.fileSize += int64(len(data))
+	return pos, nil
+}
+
+func (s *delayedWheelStore) readValueNoLock(e *delayedLogEntry) ([]byte, error) {
+	buf := make([]byte, e.vlen)
+	_, err := s.file.ReadAt(buf, e.vpos)
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (s *delayedWheelStore) put(key []byte, origID MessageID, value []byte, synced BackendOffset) error {
+	rec := encodeDelayedLogPut(key, origID, synced, value)
+	s.Lock()
+	defer s.Unlock()
+	pos, err := s.appendNoLock(rec)
+	if err != nil {
+		return err
+	}
+	e, err := newDelayedLogEntry(rec[delayedLogHeaderSize+1:], pos, int64(len(rec)))
+	if err != nil {
+		return err
+	}
+	s.addEntryNoLock(e)
+	s.synced = synced
+	s.hasSynced = true
+	return nil
+}
+
+func (s *delayedWheelStore) delete(key []byte) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.entries[string(key)]; !ok {
+		return errBucketKeyNotFound
+	}
+	_, err := s.appendNoLock(encodeDelayedLogRecord(delayedLogOpDelete, key))
+	if err != nil {
+		return err
+	}
+	s.removeEntryNoLock(string(key))
+	return nil
+}
+
+// get return the value of the key, nil if not found.
+func (s *delayedWheelStore) get(key []byte) ([]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+	e, ok := s.entries[string(key)]
+	if !ok {
+		return nil, nil
+	}
+	return s.readValueNoLock(e)
+}
+
+// walkPrefix walk the messages with the prefix ordered by the delayed timestamp and id
+// until fn return false.
+func (s *delayedWheelStore) walkPrefix(prefix []byte, fn func(key []byte, v []byte) bool) error {
+	s.Lock()
+	defer s.Unlock()
+	w, ok := s.wheels[string(prefix)]
+	if !ok {
+		return nil
+	}
+	var err error
+	w.walk(func(e *delayedLogEntry) bool {
+		var v []byte
+		v, err = s.readValueNoLock(e)
+		if err != nil {
+			return false
+		}
+		return fn([]byte(e.key), v)
+	})
+	return err
+}
+
+// replace delete the old key and put the new key with the value if the new key is not nil,
+// the synced offset is updated even if the old key is not found.
+func (s *delayedWheelStore) replace(oldKey []byte, newKey []byte, origID MessageID, value []byte,
+	synced BackendOffset) error {
+	s.Lock()
+	defer s.Unlock()
+	var buf bytes.Buffer
+	if _, ok := s.entries[string(oldKey)]; ok {
+		buf.Write(encodeDelayedLogRecord(delayedLogOpDelete, oldKey))
+	}
+	putPos := int64(buf.Len())
+	var rec []byte
+	if newKey != nil {
+		rec = encodeDelayedLogPut(newKey, origID, synced, value)
+	} else {
+		rec = encodeDelayedLogSynced(synced)
+	}
+	buf.Write(rec)
+	pos, err := s.appendNoLock(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	s.removeEntryNoLock(string(oldKey))
+	if newKey != nil {
+		e, err := newDelayedLogEntry(rec[delayedLogHeaderSize+1:], pos+putPos, int64(len(rec)))
+		if err != nil {
+			return err
+		}
+		s.addEntryNoLock(e)
+	}
+	s.synced = synced
+	s.hasSynced = true
+	return nil
+}
+
+// deleteUntil delete the messages with the prefix before the delayed timestamp and id (or all
+// if emptyAll), at most maxBatch messages will be deleted. It returns the delayed timestamp of the
+// last deleted message, the deleted number and whether there are more messages need to be deleted.
+func (s *delayedWheelStore) deleteUntil(prefix []byte, peekTs int64, id MessageID, emptyAll bool,
+	maxBatch int) (int64, int, bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	w, ok := s.wheels[string(prefix)]
+	if !ok {
+		return 0, 0, false, nil
+	}
+	exceedMaxBatch := false
+	var deleting []*delayedLogEntry
+	w.walk(func(e *delayedLogEntry) bool {
+		if !emptyAll {
+			if e.ts > peekTs || (e.ts == peekTs && e.id >= id) {
+				return false
+			}
+		}
+		if len(deleting) >= maxBatch {
+			exceedMaxBatch = true
+			return false
+		}
+		deleting = append(deleting, e)
+		return true
+	})
+	if len(deleting) == 0 {
+		return 0, 0, exceedMaxBatch, nil
+	}
+	var buf bytes.Buffer
+	for _, e := range deleting {
+		buf.Write(encodeDelayedLogRecord(delayedLogOpDelete, []byte(e.key)))
+	}
+	_, err := s.appendNoLock(buf.Bytes())
+	if err != nil {
+		return 0, 0, exceedMaxBatch, err
+	}
+	cleanedTs := int64(0)
+	for _, e := range deleting {
+		s.removeEntryNoLock(e.key)
+		cleanedTs = e.ts
+	}
+	return cleanedTs, len(deleting), exceedMaxBatch, nil
+}
+
+// peek the messages with the prefix (or all the messages if the prefix is nil) delayed before the
+// peekTs, the oldest delayed timestamp of the prefix is returned if the prefix is not nil.
+func (s *delayedWheelStore) peek(results []Message, peekTs int64, prefix []byte, isExt bool) (int, int64) {
+	s.Lock()
+	defer s.Unlock()
+	var wheels []*delayedTimeWheel
+	if prefix != nil {
+		if w, ok := s.wheels[string(prefix)]; ok {
+			wheels = append(wheels, w)
+		}
+	} else {
+		prefixList := make([]string, 0, len(s.wheels))
+		for p := range s.wheels {
+			prefixList = append(prefixList, p)
+		}
+		sort.Strings(prefixList)
+		for _, p := range prefixList {
+			wheels = append(wheels, s.wheels[p])
+		}
+	}
+	idx := 0
+	oldest := int64(0)
+	for _, w := range wheels {
+		if idx >= len(results) {
+			break
+		}
+		w.walk(func(e *delayedLogEntry) bool {
+			if oldest == 0 && prefix != nil {
+				oldest = e.ts
+			}
+			if e.ts > peekTs || idx >= len(results) {
+				return false
+			}
+			v, err := s.readValueNoLock(e)
+			if err != nil {
+				nsqLog.LogErrorf("delayed log %v failed to read message at %v: %v", s.fileName, e.vpos, err)
+				return true
+			}
+			buf, err := openDelayedMsgValue(v)
+			if err != nil {
+				nsqLog.LogErrorf("delayed log %v failed to decrypt delayed message: %v, %v", s.fileName, e.vpos, err)
+				return true
+			}
+			m, err := DecodeDelayedMessage(buf, isExt)
+			if err != nil {
+				nsqLog.LogErrorf("delayed log %v failed to decode delayed message: %v, %v", s.fileName, e.vpos, err)
+				return true
+			}
+			results[idx] = *m
+			idx++
+			return true
+		})
+	}
+	return idx, oldest
+}
+
+// oldestKey return the key of the oldest message with the prefix, nil if no message.
+func (s *delayedWheelStore) oldestKey(prefix []byte) []byte {
+	s.Lock()
+	defer s.Unlock()
+	w, ok := s.wheels[string(prefix)]
+	if !ok {
+		return nil
+	}
+	var key []byte
+	w.walk(func(e *delayedLogEntry) bool {
+		key = []byte(e.key)
+		return false
+	})
+	return key
+}
+
+func (s *delayedWheelStore) count(prefix []byte) uint64 {
+	s.Lock()
+	defer s.Unlock()
+	if w, ok := s.wheels[string(prefix)]; ok {
+		return w.cnt
+	}
+	return 0
+}
+
+func (s *delayedWheelStore) isIndexed(indexKey []byte) bool {
+	s.Lock()
+	_, ok := s.index[string(indexKey)]
+	s.Unlock()
+	return ok
+}
+
+func (s *delayedWheelStore) syncedOffset() (BackendOffset, error) {
+	s.Lock()
+	defer s.Unlock()
+	if !s.hasSynced {
+		return 0, errDelayedSyncedNotFound
+	}
+	return s.synced, nil
+}
+
+func (s *delayedWheelStore) size() int64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.fileSize
+}
+
+func (s *delayedWheelStore) sync() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.readOnly {
+		return nil
+	}
+	return s.file.Sync()
+}
+
+func (s *delayedWheelStore) close() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+func (s *delayedWheelStore) check() error {
+	s.Lock()
+	defer s.Unlock()
+	_, err := scanDelayedLog(io.NewSectionReader(s.file, 0, s.fileSize),
+		func(op byte, body []byte, pos int64, size int64) error {
+			if op == delayedLogOpPut {
+				_, err := newDelayedLogEntry(body, pos, size)
+				return err
+			}
+			return nil
+		})
+	if err != nil {
+		nsqLog.LogErrorf("delayed log %v check failed: %v", s.fileName, err)
+	}
+	return err
+}
+
+func (s *delayedWheelStore) stats() string {
+	s.Lock()
+	st := delayedWheelStoreStats{
+		FileSize: s.fileSize,
+		LiveSize: s.liveSize,
+		Entries:  len(s.entries),
+		Wheels:   len(s.wheels),
+		Synced:   int64(s.synced),
+		FileName: s.fileName,
+	}
+	s.Unlock()
+	d, _ := json.MarshalIndent(st, "", " ")
+	return string(d)
+}
+
+func (s *delayedWheelStore) sortedEntriesNoLock() []*delayedLogEntry {
+	list := make([]*delayedLogEntry, 0, len(s.entries))
+	for _, e := range s.entries {
+		list = append(list, e)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].pos < list[j].pos })
+	return list
+}
+
+func (s *delayedWheelStore) snapshotSizeNoLock() int64 {
+	sz := int64(len(delayedLogMagic)) + s.liveSize
+	if s.hasSynced {
+		sz += int64(len(encodeDelayedLogSynced(0)))
+	}
+	return sz
+}
+
+// writeSnapshotNoLock write the log with only the alive records, the records are copied in
+// the order of the position in the old log, and the synced offset is written at last.
+func (s *delayedWheelStore) writeSnapshotNoLock(w io.Writer, list []*delayedLogEntry) (int64, error) {
+	n, err := w.Write(delayedLogMagic)
+	if err != nil {
+		return 0, err
+	}
+	written := int64(n)
+	for _, e := range list {
+		rec := make([]byte, e.size)
+		_, err = s.file.ReadAt(rec, e.pos)
+		if err != nil {
+			return written, err
+		}
+		n, err = w.Write(rec)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	if s.hasSynced {
+		n, err = w.Write(encodeDelayedLogSynced(s.synced))
+		written += int64(n)
+	}
+	return written, err
+}
+
+// backupTo write the snapshot of the log prefixed with the size, which is the same as the bolt
+// backup, so the replica can restore from the node using any engine.
+func (s *delayedWheelStore) backupTo(w io.Writer) (int64, error) {
+	s.Lock()
+	defer s.Unlock()
+	buf := make([]byte, 8)
+	sz := s.snapshotSizeNoLock()
+	binary.BigEndian.PutUint64(buf, uint64(sz))
+	_, err := w.Write(buf)
+	if err != nil {
+		return 0, err
+	}
+	bw := bufio.NewWriterSize(w, compactWriteBufSize)
+	_, err = s.writeSnapshotNoLock(bw, s.sortedEntriesNoLock())
+	if err != nil {
+		return 0, err
+	}
+	return sz + 8, bw.Flush()
+}
+
+// compact rewrite the log if more than half of the log is deleted.
+func (s *delayedWheelStore) compact(force bool) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.readOnly {
+		return nil
+	}
+	if !force {
+		if s.fileSize < int64(CompactThreshold) || s.liveSize*delayedLogCompactRatio > s.fileSize {
+			return nil
+		}
+	}
+	start := time.Now()
+	tmpPath := s.fileName + compactTmpSuffix
+	f, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+	list := s.sortedEntriesNoLock()
+	bw := bufio.NewWriterSize(f, compactWriteBufSize)
+	newSize, err := s.writeSnapshotNoLock(bw, list)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		nsqLog.LogWarningf("delayed log %v compact failed: %v", s.fileName, err)
+		return err
+	}
+	s.file.Close()
+	err = util.AtomicRename(tmpPath, s.fileName)
+	if err != nil {
+		nsqLog.LogWarningf("delayed log %v failed to rename compacted log: %v", s.fileName, err)
+		if openErr := s.openNoLock(); openErr != nil {
+			return openErr
+		}
+		return err
+	}
+	s.file, err = os.OpenFile(s.fileName, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	oldSize := s.fileSize
+	pos := int64(len(delayedLogMagic))
+	for _, e := range list {
+		e.vpos = e.vpos - e.pos + pos
+		e.pos = pos
+		pos += e.size
+	}
+	s.fileSize = newSize
+	nsqLog.Infof("delayed log %v compacted from %v to %v, cost %v", s.fileName, oldSize, newSize, time.Since(start))
+	return nil
+}
+
+// restore replace the log with the restored file, which may be the bolt db backup from
+// the node using the bolt engine.
+func (s *delayedWheelStore) restore(tmpPath string, isExt bool) error {
+	isLog, err := isDelayedLogFile(tmpPath)
+	if err != nil {
+		return err
+	}
+	if !isLog {
+		logPath := tmpPath + ".log"
+		err = convertBoltToDelayedLog(tmpPath, logPath, isExt)
+		if err != nil {
+			return err
+		}
+		os.Remove(tmpPath)
+		tmpPath = logPath
+	}
+	s.Lock()
+	defer s.Unlock()
+	if s.file != nil {
+		s.file.Close()
+	}
+	err = util.AtomicRename(tmpPath, s.fileName)
+	if err != nil {
+		return err
+	}
+	return s.openNoLock()
+}
+
+// exportToBolt write all the delayed messages to the bolt db using the same layout as
+// the bolt engine.
+func (s *delayedWheelStore) exportToBolt(db *bolt.DB) error {
+	s.Lock()
+	defer s.Unlock()
+	list := s.sortedEntriesNoLock()
+	for {
+		var size int64
+		err := db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists(bucketDelayedMsg)
+			if err != nil {
+				return err
+			}
+			bi, err := tx.CreateBucketIfNotExists(bucketDelayedMsgIndex)
+			if err != nil {
+				return err
+			}
+			_, err = tx.CreateBucketIfNotExists(bucketMeta)
+			if err != nil {
+				return err
+			}
+			for len(list) > 0 && size < TxMaxSize {
+				e := list[0]
+				v, err := s.readValueNoLock(e)
+				if err != nil {
+					return err
+				}
+				err = b.Put([]byte(e.key), v)
+				if err != nil {
+					return err
+				}
+				err = bi.Put([]byte(e.indexKey()), getDelayedMsgDBIndexValue(e.ts, e.origID))
+				if err != nil {
+					return err
+				}
+				size += int64(len(e.key) + len(v))
+				list = list[1:]
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if len(list) == 0 {
+			break
+		}
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketMeta)
+		for prefix, w := range s.wheels {
+			cntBytes := make([]byte, 8)
+			binary.BigEndian.PutUint64(cntBytes, w.cnt)
+			err := b.Put(append([]byte("counter_"), prefix...), cntBytes)
+			if err != nil {
+				return err
+			}
+		}
+		if !s.hasSynced {
+			return nil
+		}
+		return b.Put(syncedOffsetKey, []byte(strconv.Itoa(int(s.synced))))
+	})
+}
+
+// convertBoltToDelayedLog write all the delayed messages in the bolt db to the log of the wheel engine.
+func convertBoltToDelayedLog(boltPath string, logPath string, isExt bool) error {
+	db, err := bolt.Open(boltPath, 0644, &bolt.Options{
+		Timeout:      time.Second,
+		ReadOnly:     true,
+		FreelistType: bolt.FreelistMapType,
+	})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	tmpPath := logPath + ".convert.tmp"
+	f, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+	defer f.Close()
+	w := bufio.NewWriterSize(f, compactWriteBufSize)
+	_, err = w.Write(delayedLogMagic)
+	if err != nil {
+		return err
+	}
+	cnt := 0
+	err = db.View(func(tx *bolt.Tx) error {
+		synced := -1
+		if bm := tx.Bucket(bucketMeta); bm != nil {
+			if v := bm.Get(syncedOffsetKey); v != nil {
+				synced, _ = strconv.Atoi(string(v))
+			}
+		}
+		b := tx.Bucket(bucketDelayedMsg)
+		if b != nil {
+			err := b.ForEach(func(k, v []byte) error {
+				if v == nil {
+					return nil
+				}
+				data, err := openDelayedMsgValue(v)
+				if err != nil {
+					return err
+				}
+				m, err := DecodeDelayedMessage(data, isExt)
+				if err != nil {
+					nsqLog.LogWarningf("delayed db %v ignore invalid message %v: %v", boltPath, k, err)
+					return nil
+				}
+				_, err = w.Write(encodeDelayedLogPut(k, m.DelayedOrigID, BackendOffset(synced), v))
+				cnt++
+				return err
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if synced < 0 {
+			return nil
+		}
+		_, err := w.Write(encodeDelayedLogSynced(BackendOffset(synced)))
+		return err
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		return err
+	}
+	nsqLog.Infof("delayed db %v converted to %v with %v messages", boltPath, logPath, cnt)
+	return util.AtomicRename(tmpPath, logPath)
+}
+
+// convertDelayedLogToBolt write all the delayed messages in the log of the wheel engine to the bolt db.
+func convertDelayedLogToBolt(logPath string, boltPath string) error {
+	s, err := openDelayedWheelStore(logPath, true)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+	tmpPath := boltPath + "-tmp.convert"
+	os.Remove(tmpPath)
+	db, err := bolt.Open(tmpPath, 0644, &bolt.Options{
+		Timeout:      time.Second,
+		ReadOnly:     false,
+		FreelistType: bolt.FreelistMapType,
+	})
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+	db.NoSync = true
+	err = s.exportToBolt(db)
+	if err == nil {
+		err = db.Sync()
+	}
+	db.Close()
+	if err != nil {
+		return err
+	}
+	nsqLog.Infof("delayed log %v converted to %v with %v messages", logPath, boltPath, len(s.entries))
+	return util.AtomicRename(tmpPath, boltPath)
+}
+
+// migrateDelayedStore convert the delayed store of the other engine to the engine used by this
+// node, the store of the other engine is removed after converted.
+func migrateDelayedStore(dataPath string, topicName string, part int, engine string, isExt bool) error {
+	dbPath := path.Join(dataPath, getDelayQueueDBName(topicName, part))
+	logPath := path.Join(dataPath, getDelayQueueLogName(topicName, part))
+	src, dst := dbPath, logPath
+	if engine != DelayQueueEngineWheel {
+		src, dst = logPath, dbPath
+	}
+	_, err := os.Stat(src)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if _, err := os.Stat(dst); err == nil {
+		// the old store is left if crashed after the converted store renamed
+		nsqLog.LogWarningf("delayed store %v already converted to %v, remove the old", src, dst)
+		return os.Remove(src)
+	}
+	nsqLog.Infof("converting the delayed store %v to %v", src, dst)
+	if engine == DelayQueueEngineWheel {
+		err = convertBoltToDelayedLog(src, dst, isExt)
+	} else {
+		err = convertDelayedLogToBolt(src, dst)
+	}
+	if err != nil {
+		nsqLog.LogErrorf("failed to convert the delayed store %v: %v", src, err)
+		return err
+	}
+	return os.Remove(src)
+}
@@ -0,0 +1,114 @@
+package nsqd
+
+import (
+	"errors"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	simpleJson "github.com/bitly/go-simplejson"
+	"github.com/youzan/nsq/internal/ext"
+)
+
+// The scheduled message is written to the delayed queue of the topic as the PubDelayed type
+// with the deliver time, and it is published to the topic by the leader after the time. The
+// released message is confirmed in the delayed queue and the replicas will clean it while
+// syncing the delayed queue consumed state.
+var (
+	ErrDelayedPubInvalid  = errors.New("invalid delayed pub time")
+	ErrDelayedPubTooLate  = errors.New("delayed pub time exceed the max delay")
+	ErrDelayedPubNotAllow = errors.New("delayed pub is not allowed on the ordered topic")
+)
+
+func parseDelayedPubJsonInt(v *simpleJson.Json) (int64, error) {
+	n, err := v.Int64()
+	if err != nil {
+		s, _ := v.String()
+		n, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return 0, ErrDelayedPubInvalid
+		}
+	}
+	return n, nil
+}
+
+// GetDelayedPubTs return the deliver time (unix nano) of the scheduled message from the ##delay_until
+// or ##delay_ms in the json ext header, zero is returned if the message should be delivered now.
+func GetDelayedPubTs(jsonHeader *simpleJson.Json, now time.Time, maxDelay time.Duration) (int64, error) {
+	if jsonHeader == nil {
+		return 0, nil
+	}
+	if v, ok := jsonHeader.CheckGet(ext.DELAY_UNTIL_KEY); ok {
+		until, err := parseDelayedPubJsonInt(v)
+		if err != nil {
+			return 0, err
+		}
+		if until < 0 {
+			return 0, ErrDelayedPubInvalid
+		}
+		return checkDelayedPubTs(time.Unix(0, until*int64(time.Millisecond)), now, maxDelay)
+	}
+	if v, ok := jsonHeader.CheckGet(ext.DELAY_MS_KEY); ok {
+		ms, err := parseDelayedPubJsonInt(v)
+		if err != nil {
+			return 0, err
+		}
+		return GetDelayedPubTsByDuration(time.Duration(ms)*time.Millisecond, now, maxDelay)
+	}
+	return 0, nil
+}
+
+// GetDelayedPubTsByDuration return the deliver time (unix nano) of the message published after the delay.
+func GetDelayedPubTsByDuration(delay time.Duration, now time.Time, maxDelay time.Duration) (int64, error) {
+	if delay < 0 {
+		return 0, ErrDelayedPubInvalid
+	}
+	return checkDelayedPubTs(now.Add(delay), now, maxDelay)
+}
+
+func checkDelayedPubTs(deliverAt time.Time, now time.Time, maxDelay time.Duration) (int64, error) {
+	delay := deliverAt.Sub(now)
+	// the time already passed (maybe the clock of producer is not synced) should be delivered now
+	if delay <= 0 {
+		return 0, nil
+	}
+	if delay > maxDelay {
+		return 0, ErrDelayedPubTooLate
+	}
+	return deliverAt.UnixNano(), nil
+}
+
+// SetDelayedPub make the message delivered to the topic at the given time (unix nano)
+func (m *Message) SetDelayedPub(ts int64) {
+	m.DelayedType = PubDelayed
+	m.DelayedTs = ts
+}
+
+// NewReleasedDelayedPubMessage create the message published to the topic for the scheduled message
+// peeked from the delayed queue, the body, ext header and trace id are kept.
+func NewReleasedDelayedPubMessage(m *Message) *Message {
+	var msg *Message
+	if m.ExtVer != ext.NO_EXT_VER {
+		msg = NewMessageWithExt(0, m.Body, m.ExtVer, m.ExtBytes)
+	} else {
+		msg = NewMessage(0, m.Body)
+	}
+	msg.TraceID = m.TraceID
+	return msg
+}
+
+// ConfirmDelayedPub remove the released scheduled message from the delayed queue
+func (q *DelayQueue) ConfirmDelayedPub(m *Message) error {
+	// the delayed pub message is stored with the id in the delayed queue
+	cm := *m
+	cm.DelayedOrigID = m.ID
+	return q.ConfirmedMessage(&cm)
+}
+
+func (t *Topic) IncrDelayedPubReleased(cnt int64) {
+	atomic.AddInt64(&t.delayedPubReleased, cnt)
+}
+
+func (t *Topic) DelayedPubReleased() int64 {
+	return atomic.LoadInt64(&t.delayedPubReleased)
+}
@@ -0,0 +1,112 @@
+package nsqd
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	simpleJson "github.com/bitly/go-simplejson"
+	"github.com/youzan/nsq/internal/ext"
+	"github.com/youzan/nsq/internal/test"
+)
+
+func TestGetDelayedPubTs(t *testing.T) {
+	now := time.Now()
+	maxDelay := time.Hour
+	nowMs := now.UnixNano() / int64(time.Millisecond)
+
+	ts, err := GetDelayedPubTs(nil, now, maxDelay)
+	test.Nil(t, err)
+	test.Equal(t, int64(0), ts)
+
+	jh := simpleJson.New()
+	jh.Set(ext.DELAY_MS_KEY, 1000)
+	ts, err = GetDelayedPubTs(jh, now, maxDelay)
+	test.Nil(t, err)
+	test.Equal(t, now.Add(time.Second).UnixNano(), ts)
+	jh.Set(ext.DELAY_MS_KEY, "2000")
+	ts, err = GetDelayedPubTs(jh, now, maxDelay)
+	test.Nil(t, err)
+	test.Equal(t, now.Add(time.Second*2).UnixNano(), ts)
+	jh.Set(ext.DELAY_MS_KEY, "0")
+	ts, err = GetDelayedPubTs(jh, now, maxDelay)
+	test.Nil(t, err)
+	test.Equal(t, int64(0), ts)
+	jh.Set(ext.DELAY_MS_KEY, "-1")
+	_, err = GetDelayedPubTs(jh, now, maxDelay)
+	test.Equal(t, ErrDelayedPubInvalid, err)
+	jh.Set(ext.DELAY_MS_KEY, "abc")
+	_, err = GetDelayedPubTs(jh, now, maxDelay)
+	test.Equal(t, ErrDelayedPubInvalid, err)
+	jh.Set(ext.DELAY_MS_KEY, int64(maxDelay/time.Millisecond)+1)
+	_, err = GetDelayedPubTs(jh, now, maxDelay)
+	test.Equal(t, ErrDelayedPubTooLate, err)
+
+	// the delay until is used if both given
+	jh.Set(ext.DELAY_UNTIL_KEY, nowMs+3000)
+	ts, err = GetDelayedPubTs(jh, now, maxDelay)
+	test.Nil(t, err)
+	test.Equal(t, (nowMs+3000)*int64(time.Millisecond), ts)
+	jh.Set(ext.DELAY_UNTIL_KEY, nowMs-3000)
+	ts, err = GetDelayedPubTs(jh, now, maxDelay)
+	test.Nil(t, err)
+	test.Equal(t, int64(0), ts)
+	jh.Set(ext.DELAY_UNTIL_KEY, nowMs+int64(maxDelay/time.Millisecond)+1)
+	_, err = GetDelayedPubTs(jh, now, maxDelay)
+	test.Equal(t, ErrDelayedPubTooLate, err)
+}
+
+func TestDelayQueueDelayedPub(t *testing.T) {
+	for _, engine := range []string{DelayQueueEngineBolt, DelayQueueEngineWheel} {
+		tmpDir, err := ioutil.TempDir("", "nsq-test-delayed-pub")
+		test.Nil(t, err)
+		defer os.RemoveAll(tmpDir)
+
+		opts := NewOptions()
+		opts.Logger = newTestLogger(t)
+		opts.SyncEvery = 1
+		opts.DelayQueueEngine = engine
+		dq, err := NewDelayQueue("test", 0, tmpDir, opts, nil, true)
+		test.Nil(t, err)
+		defer dq.Close()
+		now := time.Now().UnixNano()
+		cnt := 5
+		for i := 0; i < cnt; i++ {
+			msg := NewMessageWithExt(0, []byte("body"), ext.JSON_HEADER_EXT_VER, []byte(`{"##delay_ms":"1000"}`))
+			msg.TraceID = uint64(i + 1)
+			msg.SetDelayedPub(now + int64(i)*int64(time.Second))
+			_, _, _, _, err := dq.PutDelayMessage(msg)
+			test.Nil(t, err)
+		}
+		delayedCnt, _ := dq.GetCurrentDelayedCnt(PubDelayed, "")
+		test.Equal(t, uint64(cnt), delayedCnt)
+
+		results := make([]Message, cnt)
+		n, err := dq.PeekRecentDelayedPub(now+int64(time.Second), results)
+		test.Nil(t, err)
+		test.Equal(t, 2, n)
+		for i := 0; i < n; i++ {
+			msg := NewReleasedDelayedPubMessage(&results[i])
+			test.Equal(t, MessageID(0), msg.ID)
+			test.Equal(t, int32(0), msg.DelayedType)
+			test.Equal(t, results[i].TraceID, msg.TraceID)
+			test.Equal(t, results[i].ExtBytes, msg.ExtBytes)
+			test.Equal(t, results[i].Body, msg.Body)
+			err = dq.ConfirmDelayedPub(&results[i])
+			test.Nil(t, err)
+		}
+		delayedCnt, _ = dq.GetCurrentDelayedCnt(PubDelayed, "")
+		test.Equal(t, uint64(cnt-2), delayedCnt)
+		n, err = dq.PeekRecentDelayedPub(now+int64(time.Second), results)
+		test.Nil(t, err)
+		test.Equal(t, 0, n)
+
+		// the replica will clean the released messages by the oldest consumed key
+		keyList, _, _ := dq.GetOldestConsumedState(nil, true)
+		test.Equal(t, 1, len(keyList))
+		_, ts, _, _, err := decodeDelayedMsgDBKey(keyList[0])
+		test.Nil(t, err)
+		test.Equal(t, now+2*int64(time.Second), ts)
+	}
+}
@@ -26,6 +26,8 @@ type DiskQueueSnapshot struct {
 	exitFlag int32
 
 	readFile *os.File
+	// read the cleaned data from the archive, nil if disabled
+	archive *diskQueueArchive
 }
 
 // newDiskQueue instantiates a new instance of DiskQueueSnapshot, retrieving metadata
@@ -41,6 +43,13 @@ func NewDiskQueueSnapshot(readFrom string, dataPath string, endInfo BackendQueue
 	return &d
 }
 
+// SetArchive enable reading the cleaned positions from the archive
+func (d *DiskQueueSnapshot) SetArchive(archive *diskQueueArchive) {
+	d.Lock()
+	d.archive = archive
+	d.Unlock()
+}
+
 func (d *DiskQueueSnapshot) getCurrentFileEnd(offset diskQueueOffset) (int64, error) {
 	curFileName := d.fileName(offset.FileNum)
 	f, err := os.Stat(curFileName)
@@ -131,6 +140,12 @@ func (d *DiskQueueSnapshot) stepOffset(allowBackward bool, cur diskQueueEndInfo,
 	if !allowBackward && step < 0 {
 		return newOffset.EndOffset, fmt.Errorf("can not step backward")
 	}
+	if d.archive != nil {
+		newPos, handled, err := d.archive.stepOffset(cur, BackendOffset(step), maxStep)
+		if handled {
+			return newPos, err
+		}
+	}
 	return stepOffset(d.dataPath, d.readFrom, cur, BackendOffset(step), maxStep)
 }
 
@@ -147,6 +162,16 @@ retry:
 		d.readFile.Close()
 		d.readFile = nil
 	}
+	if d.archive != nil {
+		next, handled, err := d.archive.nextSegment(newPos)
+		if handled {
+			if err != nil {
+				return err
+			}
+			d.readPos = next
+			return nil
+		}
+	}
 	cnt, _, endPos, err := getQueueFileOffsetMeta(d.fileName(newPos.EndOffset.FileNum))
 	newPos.EndOffset.FileNum++
 	newPos.EndOffset.Pos = 0
@@ -190,7 +215,7 @@ func (d *DiskQueueSnapshot) seekTo(voffset BackendOffset, cnt int64, allowBackwa
 	} else if voffset == d.endPos.virtualEnd {
 		newPos = d.endPos.EndOffset
 	} else {
-		if voffset < d.queueStart.Offset() {
+		if voffset < d.queueStart.Offset() && d.archive == nil {
 			nsqLog.LogWarningf("seek error : seek queue position cleaned : %v, %v", voffset, d.queueStart)
 			return ErrReadQueueAlreadyCleaned
 		}
@@ -239,7 +264,11 @@ func (d *DiskQueueSnapshot) ReadRaw(size int32) ([]byte, error) {
 	for readOffset < size {
 	CheckFileOpen:
 		if d.readFile == nil {
-			curFileName := d.fileName(d.readPos.EndOffset.FileNum)
+			var curFileName string
+			curFileName, err = d.readFileName()
+			if err != nil {
+				return result, err
+			}
 			d.readFile, err = os.OpenFile(curFileName, os.O_RDONLY, 0600)
 			if err != nil {
 				return result, err
@@ -299,7 +328,7 @@ func (d *DiskQueueSnapshot) ReadOne() ReadResult {
 	defer d.Unlock()
 
 	var result ReadResult
-	var msgSize int32
+	var sizeHeader uint32
 	result.Offset = BackendOffset(0)
 	if d.readPos == d.endPos {
 		result.Err = io.EOF
@@ -310,7 +339,11 @@ CheckFileOpen:
 
 	result.Offset = d.readPos.Offset()
 	if d.readFile == nil {
-		curFileName := d.fileName(d.readPos.EndOffset.FileNum)
+		var curFileName string
+		curFileName, result.Err = d.readFileName()
+		if result.Err != nil {
+			return result
+		}
 		d.readFile, result.Err = os.OpenFile(curFileName, os.O_RDONLY, 0600)
 		if result.Err != nil {
 			return result
@@ -332,7 +365,7 @@ CheckFileOpen:
 		result.Err = errors.New("exceed end of queue")
 		return result
 	}
-	result.Err = binary.Read(d.readFile, binary.BigEndian, &msgSize)
+	result.Err = binary.Read(d.readFile, binary.BigEndian, &sizeHeader)
 	if result.Err != nil {
 		nsqLog.LogWarningf("DISKQUEUE(%s): readOne() read failed %v  at %v, end: %v",
 			d.readFrom, result.Err, d.readPos, d.endPos)
@@ -345,6 +378,21 @@ CheckFileOpen:
 		d.readFile = nil
 		return result
 	}
+	if sizeHeader == 0 {
+		// skip the padding record of the compacted message, and return the next message
+		result.Err = d.skipPaddingRecord()
+		if result.Err != nil {
+			d.readFile.Close()
+			d.readFile = nil
+			return result
+		}
+		if d.readPos.Offset() >= d.endPos.Offset() {
+			result.Err = io.EOF
+			return result
+		}
+		goto CheckFileOpen
+	}
+	msgSize, withChecksum, codec := decodeRecordSize(sizeHeader)
 
 	if msgSize <= 0 || msgSize > MAX_POSSIBLE_MSG_SIZE {
 		// this file is corrupt and we have no reasonable guarantee on
@@ -354,9 +402,28 @@ CheckFileOpen:
 		result.Err = fmt.Errorf("invalid message read size (%d)", msgSize)
 		return result
 	}
+	var checksum uint32
+	if withChecksum {
+		result.Err = binary.Read(d.readFile, binary.BigEndian, &checksum)
+		if result.Err != nil {
+			d.readFile.Close()
+			d.readFile = nil
+			return result
+		}
+	}
 
 	result.Data = make([]byte, msgSize)
 	_, result.Err = io.ReadFull(d.readFile, result.Data)
+	if result.Err == nil && withChecksum {
+		result.Err = checkRecordChecksum(result.Data, checksum)
+		if result.Err != nil {
+			nsqLog.LogErrorf("DISKQUEUE(%s): readOne() checksum mismatch at %v", d.readFrom, d.readPos)
+			result.Data = nil
+		}
+	}
+	if result.Err == nil && codec != CompressNone {
+		result.Data, result.Err = decompressRecord(codec, result.Data)
+	}
 	if result.Err != nil {
 		d.readFile.Close()
 		d.readFile = nil
@@ -365,7 +432,7 @@ CheckFileOpen:
 
 	result.Offset = d.readPos.Offset()
 
-	totalBytes := int64(4 + msgSize)
+	totalBytes := int64(recordHeaderSize(withChecksum)) + int64(msgSize)
 	result.MovedSize = BackendOffset(totalBytes)
 
 	oldPos := d.readPos
@@ -378,6 +445,26 @@ CheckFileOpen:
 	return result
 }
 
+func (d *DiskQueueSnapshot) skipPaddingRecord() error {
+	var v uint32
+	err := binary.Read(d.readFile, binary.BigEndian, &v)
+	if err != nil {
+		return err
+	}
+	psize, err := decodePaddingSize(v)
+	if err != nil {
+		return err
+	}
+	_, err = d.readFile.Seek(psize-recordPaddingHeaderSize, 1)
+	if err != nil {
+		return err
+	}
+	d.readPos.EndOffset.Pos += psize
+	d.readPos.virtualEnd += BackendOffset(psize)
+	atomic.AddInt64(&d.readPos.totalMsgCnt, 1)
+	return nil
+}
+
 func (d *DiskQueueSnapshot) handleReachEnd() {
 	if d.readFile != nil {
 		d.readFile.Close()
@@ -385,6 +472,20 @@ func (d *DiskQueueSnapshot) handleReachEnd() {
 	}
 	d.readPos.EndOffset.FileNum++
 	d.readPos.EndOffset.Pos = 0
+	if d.archive != nil {
+		d.archive.fixSegmentEnd(&d.readPos)
+	}
+}
+
+// the file at the read position, the cleaned segment will be fetched from the archive
+func (d *DiskQueueSnapshot) readFileName() (string, error) {
+	if d.archive != nil {
+		fileName, handled, err := d.archive.segmentFile(d.readPos)
+		if handled {
+			return fileName, err
+		}
+	}
+	return d.fileName(d.readPos.EndOffset.FileNum), nil
 }
 
 func (d *DiskQueueSnapshot) fileName(fileNum int64) string {
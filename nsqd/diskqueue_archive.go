@@ -0,0 +1,427 @@
+package nsqd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// The cleaned segments of the topic disk queue are uploaded to the archive with the key
+// [queue name]/segments/[start virtual offset]-[end virtual offset].dat, the time index and the meta
+// will be uploaded with the suffix .timeindex and .meta. The meta is uploaded at last, so only
+// the segment with meta is complete in the archive.
+// Since the virtual offset is the same on all the replicas, the segment uploaded by the leader can be
+// read back by all, and the position in the archived segment is located by the virtual offset instead
+// of the local file number. The replicas with the upload disabled will not upload but only clean the
+// segments already archived by the leader.
+const (
+	archiveSegmentDir         = "segments"
+	archiveCommitLogDir       = "commitlog"
+	archiveDataSuffix         = ".dat"
+	archiveMetaSuffix         = ".meta"
+	archiveCacheDirName       = "archive_cache"
+	defaultArchiveCacheSegNum = 4
+)
+
+type archivedSegment struct {
+	FileNum     int64         `json:"file_num"`
+	StartOffset BackendOffset `json:"start_offset"`
+	EndOffset   BackendOffset `json:"end_offset"`
+	StartCnt    int64         `json:"start_cnt"`
+	EndCnt      int64         `json:"end_cnt"`
+	metaLoaded  bool
+}
+
+type diskQueueArchive struct {
+	sync.Mutex
+	archive  SegmentArchive
+	name     string
+	dataPath string
+	cacheDir string
+	maxCache int
+	// the start of the local queue, the data before it can only be read from archive
+	localStart diskQueueEndInfo
+	// archived segments sorted by start offset
+	segments []*archivedSegment
+	loaded   bool
+	// the cached segment files in the fetched order
+	cachedFiles []string
+	fetchLock   sync.Mutex
+	// only the leader of the partition upload the segments to avoid duplicate uploading
+	uploadDisabled int32
+}
+
+func newDiskQueueArchive(archive SegmentArchive, name string, dataPath string, maxCache int) *diskQueueArchive {
+	if maxCache <= 0 {
+		maxCache = defaultArchiveCacheSegNum
+	}
+	return &diskQueueArchive{
+		archive:  archive,
+		name:     name,
+		dataPath: dataPath,
+		cacheDir: path.Join(dataPath, archiveCacheDirName, name),
+		maxCache: maxCache,
+	}
+}
+
+func (a *diskQueueArchive) segmentKey(start BackendOffset, end BackendOffset, suffix string) string {
+	return fmt.Sprintf("%s/%s/%020d-%020d%s", a.name, archiveSegmentDir, start, end, suffix)
+}
+
+func (a *diskQueueArchive) setLocalStart(start diskQueueEndInfo) {
+	a.Lock()
+	a.localStart = start
+	a.Unlock()
+}
+
+func (a *diskQueueArchive) getLocalStart() diskQueueEndInfo {
+	a.Lock()
+	s := a.localStart
+	a.Unlock()
+	return s
+}
+
+func (a *diskQueueArchive) setUploadEnabled(enable bool) {
+	if enable {
+		atomic.StoreInt32(&a.uploadDisabled, 0)
+	} else {
+		atomic.StoreInt32(&a.uploadDisabled, 1)
+	}
+}
+
+func (a *diskQueueArchive) isUploadEnabled() bool {
+	return atomic.LoadInt32(&a.uploadDisabled) == 0
+}
+
+func (a *diskQueueArchive) isKeyArchived(key string) (bool, error) {
+	rc, err := a.archive.Get(key)
+	if err == ErrArchiveKeyNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	rc.Close()
+	return true, nil
+}
+
+func (a *diskQueueArchive) putFile(key string, fileName string) error {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return a.archive.Put(key, f, stat.Size())
+}
+
+// archiveFile upload the file with the name under the kind directory of the queue, if the upload
+// is disabled, ErrArchiveKeyNotFound will be returned if the file is not uploaded by the leader.
+func (a *diskQueueArchive) archiveFile(kind string, fileName string) error {
+	key := fmt.Sprintf("%s/%s/%s", a.name, kind, path.Base(fileName))
+	if !a.isUploadEnabled() {
+		ok, err := a.isKeyArchived(key)
+		if err == nil && !ok {
+			err = ErrArchiveKeyNotFound
+		}
+		return err
+	}
+	return a.putFile(key, fileName)
+}
+
+// ensureSegmentArchived make sure the segment is in the archive before it is removed, the segment
+// will be uploaded if the upload is enabled, otherwise ErrArchiveKeyNotFound will be returned
+// if the segment is not uploaded by the leader.
+func (a *diskQueueArchive) ensureSegmentArchived(fileNum int64, dataFileName string, prevDataFileName string) error {
+	if a.isUploadEnabled() {
+		return a.archiveSegment(fileNum, dataFileName, prevDataFileName)
+	}
+	_, start, end, err := getQueueFileOffsetMeta(dataFileName)
+	if err != nil {
+		return err
+	}
+	ok, err := a.isKeyArchived(a.segmentKey(BackendOffset(start), BackendOffset(end), archiveMetaSuffix))
+	if err == nil && !ok {
+		err = ErrArchiveKeyNotFound
+	}
+	return err
+}
+
+// archiveSegment upload the segment data and the time index with the meta before the segment removed.
+func (a *diskQueueArchive) archiveSegment(fileNum int64, dataFileName string, prevDataFileName string) error {
+	endCnt, start, end, err := getQueueFileOffsetMeta(dataFileName)
+	if err != nil {
+		return err
+	}
+	seg := &archivedSegment{
+		FileNum:     fileNum,
+		StartOffset: BackendOffset(start),
+		EndOffset:   BackendOffset(end),
+		EndCnt:      endCnt,
+		metaLoaded:  true,
+	}
+	prevCnt, _, prevEnd, err := getQueueFileOffsetMeta(prevDataFileName)
+	if err == nil && prevEnd == start {
+		seg.StartCnt = prevCnt
+	} else {
+		cnt := int64(0)
+		err = scanRecordTimestamps(dataFileName, 0, end-start, func(int64, int64) {
+			cnt++
+		})
+		if err != nil {
+			return err
+		}
+		seg.StartCnt = endCnt - cnt
+	}
+	err = a.putFile(a.segmentKey(seg.StartOffset, seg.EndOffset, archiveDataSuffix), dataFileName)
+	if err != nil {
+		return err
+	}
+	err = a.putFile(a.segmentKey(seg.StartOffset, seg.EndOffset, timeIndexFileSuffix), timeIndexFileName(dataFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	meta, _ := json.Marshal(seg)
+	err = a.archive.Put(a.segmentKey(seg.StartOffset, seg.EndOffset, archiveMetaSuffix),
+		strings.NewReader(string(meta)), int64(len(meta)))
+	if err != nil {
+		return err
+	}
+	nsqLog.Logf("DISKQUEUE(%s): archived segment %v: %v-%v", a.name, fileNum, start, end)
+	a.Lock()
+	if a.loaded {
+		a.insertSegment(seg)
+	}
+	a.Unlock()
+	return nil
+}
+
+func (a *diskQueueArchive) insertSegment(seg *archivedSegment) {
+	i := sort.Search(len(a.segments), func(i int) bool {
+		return a.segments[i].StartOffset >= seg.StartOffset
+	})
+	if i < len(a.segments) && a.segments[i].StartOffset == seg.StartOffset {
+		a.segments[i] = seg
+		return
+	}
+	a.segments = append(a.segments, nil)
+	copy(a.segments[i+1:], a.segments[i:])
+	a.segments[i] = seg
+}
+
+// reload the archived segments from the archive list, should be locked.
+func (a *diskQueueArchive) loadSegments() error {
+	keys, err := a.archive.List(fmt.Sprintf("%s/%s/", a.name, archiveSegmentDir))
+	if err != nil {
+		return err
+	}
+	old := a.segments
+	a.segments = make([]*archivedSegment, 0, len(keys))
+	for _, k := range keys {
+		if !strings.HasSuffix(k, archiveMetaSuffix) {
+			continue
+		}
+		var start, end int64
+		_, err := fmt.Sscanf(path.Base(k), "%d-%d"+archiveMetaSuffix, &start, &end)
+		if err != nil || end <= start {
+			continue
+		}
+		a.insertSegment(&archivedSegment{StartOffset: BackendOffset(start), EndOffset: BackendOffset(end)})
+	}
+	// keep the meta already loaded
+	for _, seg := range old {
+		if seg.metaLoaded {
+			a.insertSegment(seg)
+		}
+	}
+	a.loaded = true
+	return nil
+}
+
+// findSegment return the archived segment contains the offset, the segment list will
+// be reloaded once if not found.
+func (a *diskQueueArchive) findSegment(offset BackendOffset) (*archivedSegment, error) {
+	a.Lock()
+	defer a.Unlock()
+	for retry := 0; retry < 2; retry++ {
+		if !a.loaded || retry > 0 {
+			err := a.loadSegments()
+			if err != nil {
+				return nil, err
+			}
+		}
+		i := sort.Search(len(a.segments), func(i int) bool {
+			return a.segments[i].EndOffset > offset
+		})
+		if i < len(a.segments) && a.segments[i].StartOffset <= offset {
+			seg := a.segments[i]
+			if !seg.metaLoaded {
+				rc, err := a.archive.Get(a.segmentKey(seg.StartOffset, seg.EndOffset, archiveMetaSuffix))
+				if err != nil {
+					return nil, err
+				}
+				err = json.NewDecoder(rc).Decode(seg)
+				rc.Close()
+				if err != nil {
+					return nil, err
+				}
+				seg.metaLoaded = true
+			}
+			s := *seg
+			return &s, nil
+		}
+	}
+	return nil, ErrArchiveKeyNotFound
+}
+
+// isCleaned check if the position is before the local queue start
+func (a *diskQueueArchive) isCleaned(offset BackendOffset) bool {
+	start := a.getLocalStart()
+	return offset < start.Offset()
+}
+
+// locate return the position of the offset in the archived segment
+func (a *diskQueueArchive) locate(offset BackendOffset) (diskQueueEndInfo, error) {
+	var pos diskQueueEndInfo
+	seg, err := a.findSegment(offset)
+	if err != nil {
+		if err == ErrArchiveKeyNotFound {
+			return pos, ErrReadQueueAlreadyCleaned
+		}
+		return pos, err
+	}
+	pos.EndOffset.FileNum = seg.FileNum
+	pos.EndOffset.Pos = int64(offset - seg.StartOffset)
+	pos.virtualEnd = offset
+	if offset == seg.StartOffset {
+		pos.totalMsgCnt = seg.StartCnt
+	}
+	return pos, nil
+}
+
+// stepOffset handle the step from or to the cleaned position, false will be returned
+// if both the current and the target are in the local queue.
+func (a *diskQueueArchive) stepOffset(cur diskQueueEndInfo, step BackendOffset,
+	maxStep diskQueueEndInfo) (diskQueueOffset, bool, error) {
+	target := cur.Offset() + step
+	start := a.getLocalStart()
+	if target < start.Offset() {
+		pos, err := a.locate(target)
+		return pos.EndOffset, true, err
+	}
+	if cur.Offset() < start.Offset() {
+		// step from the archived segment to the local, we start from the local queue start
+		newPos, err := stepOffset(a.dataPath, a.name, start, target-start.Offset(), maxStep)
+		return newPos, true, err
+	}
+	return cur.EndOffset, false, nil
+}
+
+// fixSegmentEnd change the position to the local queue start if we reach the end of the last
+// archived segment, since the file number of the archived segment may be different with local.
+func (a *diskQueueArchive) fixSegmentEnd(pos *diskQueueEndInfo) {
+	start := a.getLocalStart()
+	if pos.EndOffset.Pos == 0 && pos.Offset() == start.Offset() && pos.EndOffset != start.EndOffset {
+		nsqLog.Logf("DISKQUEUE(%s): read from archived to local start: %v, %v", a.name, pos, start)
+		pos.EndOffset = start.EndOffset
+	}
+}
+
+// nextSegment return the start of the next segment after the cleaned position
+func (a *diskQueueArchive) nextSegment(pos diskQueueEndInfo) (diskQueueEndInfo, bool, error) {
+	if !a.isCleaned(pos.Offset()) {
+		return pos, false, nil
+	}
+	seg, err := a.findSegment(pos.Offset())
+	if err == ErrArchiveKeyNotFound {
+		return pos, false, nil
+	}
+	if err != nil {
+		return pos, true, err
+	}
+	var next diskQueueEndInfo
+	next.EndOffset.FileNum = seg.FileNum + 1
+	next.virtualEnd = seg.EndOffset
+	next.totalMsgCnt = seg.EndCnt
+	a.fixSegmentEnd(&next)
+	return next, true, nil
+}
+
+// segmentFile return the local cached file of the archived segment at the cleaned position,
+// the segment will be fetched from the archive if not cached. False will be returned if the
+// position is not cleaned or the segment is not archived.
+func (a *diskQueueArchive) segmentFile(pos diskQueueEndInfo) (string, bool, error) {
+	if !a.isCleaned(pos.Offset()) {
+		return "", false, nil
+	}
+	seg, err := a.findSegment(pos.Offset() - BackendOffset(pos.EndOffset.Pos))
+	if err == ErrArchiveKeyNotFound {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", true, err
+	}
+	if seg.StartOffset != pos.Offset()-BackendOffset(pos.EndOffset.Pos) {
+		nsqLog.LogWarningf("DISKQUEUE(%s): archived segment %v not matched with the read position: %v",
+			a.name, seg, pos)
+		return "", true, ErrReadQueueAlreadyCleaned
+	}
+	fileName, err := a.fetchSegment(seg)
+	return fileName, true, err
+}
+
+func (a *diskQueueArchive) fetchSegment(seg *archivedSegment) (string, error) {
+	a.fetchLock.Lock()
+	defer a.fetchLock.Unlock()
+	fileName := path.Join(a.cacheDir, fmt.Sprintf("%020d-%020d%s", seg.StartOffset, seg.EndOffset, archiveDataSuffix))
+	if _, err := os.Stat(fileName); err == nil {
+		return fileName, nil
+	}
+	err := os.MkdirAll(a.cacheDir, 0755)
+	if err != nil {
+		return "", err
+	}
+	rc, err := a.archive.Get(a.segmentKey(seg.StartOffset, seg.EndOffset, archiveDataSuffix))
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	tmp, err := ioutil.TempFile(a.cacheDir, path.Base(fileName)+".tmp")
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(tmp, rc)
+	tmp.Close()
+	if err == nil {
+		err = os.Rename(tmp.Name(), fileName)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	nsqLog.Logf("DISKQUEUE(%s): fetched archived segment %v-%v", a.name, seg.StartOffset, seg.EndOffset)
+	a.cachedFiles = append(a.cachedFiles, fileName)
+	// the opened file can still be read after removed
+	for len(a.cachedFiles) > a.maxCache {
+		os.Remove(a.cachedFiles[0])
+		a.cachedFiles = a.cachedFiles[1:]
+	}
+	return fileName, nil
+}
+
+func (a *diskQueueArchive) clearCache() {
+	a.fetchLock.Lock()
+	os.RemoveAll(a.cacheDir)
+	a.cachedFiles = nil
+	a.fetchLock.Unlock()
+}
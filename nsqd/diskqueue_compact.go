@@ -0,0 +1,306 @@
+package nsqd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	simpleJson "github.com/bitly/go-simplejson"
+	"github.com/youzan/nsq/internal/ext"
+	"github.com/youzan/nsq/internal/util"
+)
+
+// The compaction only rewrites the closed segments, the records superseded by the newer
+// record with the same compact key and the expired tombstones are replaced by the padding
+// records, so the offsets, the message count and the commit log of the topic are not changed.
+// Since the compaction only depends on the data, all the replicas will have the same result.
+const (
+	compactTmpSuffix    = ".compact.tmp"
+	compactReadBufSize  = 1024 * 1024
+	compactWriteBufSize = 1024 * 1024
+)
+
+// compactKeyFunc parse the compact key of the message data, the message without the
+// key will never be compacted. The timestamp is used to expire the tombstone.
+type compactKeyFunc func(data []byte) (key string, tombstone bool, ts int64)
+
+type compactKeyEntry struct {
+	offset    BackendOffset
+	fileNum   int64
+	tombstone bool
+	ts        int64
+}
+
+type compactStats struct {
+	segments int
+	removed  int64
+}
+
+// parseCompactKey parse the compact key and tombstone from the json ext header of the message.
+func parseCompactKey(data []byte) (string, bool, int64) {
+	msg, err := DecodeMessage(data, true)
+	if err != nil || msg.ExtVer != ext.JSON_HEADER_EXT_VER {
+		return "", false, 0
+	}
+	// avoid parsing json for the messages without the compact key
+	if !bytes.Contains(msg.ExtBytes, []byte(ext.COMPACT_KEY)) {
+		return "", false, msg.Timestamp
+	}
+	extHeader, err := simpleJson.NewJson(msg.ExtBytes)
+	if err != nil {
+		return "", false, msg.Timestamp
+	}
+	key, _ := extHeader.Get(ext.COMPACT_KEY).String()
+	tombstone := false
+	if tj, ok := extHeader.CheckGet(ext.COMPACT_TOMBSTONE_KEY); ok {
+		tombstone, err = tj.Bool()
+		if err != nil {
+			ts, _ := tj.String()
+			tombstone, _ = strconv.ParseBool(ts)
+		}
+	}
+	return key, tombstone, msg.Timestamp
+}
+
+// readCompactRecord read the next record, the raw record and the decoded data are returned,
+// the padding record is returned with nil data and only the padding header in raw.
+func readCompactRecord(r *bufio.Reader) (int64, []byte, []byte, error) {
+	var header [recordPaddingHeaderSize]byte
+	_, err := io.ReadFull(r, header[:recordSizeLen])
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	v := binary.BigEndian.Uint32(header[:recordSizeLen])
+	if v == 0 {
+		_, err = io.ReadFull(r, header[recordSizeLen:])
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		psize, err := decodePaddingSize(binary.BigEndian.Uint32(header[recordSizeLen:]))
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		_, err = r.Discard(int(psize - recordPaddingHeaderSize))
+		return psize, header[:], nil, err
+	}
+	sz, withChecksum, codec := decodeRecordSize(v)
+	if sz <= 0 || sz > MAX_POSSIBLE_MSG_SIZE {
+		return 0, nil, nil, fmt.Errorf("invalid message read size (%d)", sz)
+	}
+	hsize := recordHeaderSize(withChecksum)
+	raw := make([]byte, hsize+int(sz))
+	copy(raw, header[:recordSizeLen])
+	_, err = io.ReadFull(r, raw[recordSizeLen:])
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	data := raw[hsize:]
+	if withChecksum {
+		err = checkRecordChecksum(data, binary.BigEndian.Uint32(raw[recordSizeLen:hsize]))
+		if err != nil {
+			return 0, nil, nil, err
+		}
+	}
+	data, err = decompressRecord(codec, data)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	return int64(len(raw)), raw, data, nil
+}
+
+// scanCompactRecords read the records of the segment from pos to the endPos (or the end
+// of file if endPos is negative).
+func scanCompactRecords(fileName string, pos int64, endPos int64,
+	fn func(pos int64, size int64, raw []byte, data []byte) error) error {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if pos > 0 {
+		_, err = f.Seek(pos, 0)
+		if err != nil {
+			return err
+		}
+	}
+	r := bufio.NewReaderSize(f, compactReadBufSize)
+	for endPos < 0 || pos < endPos {
+		size, raw, data, err := readCompactRecord(r)
+		if err == io.EOF && endPos < 0 {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		err = fn(pos, size, raw, data)
+		if err != nil {
+			return err
+		}
+		pos += size
+	}
+	return nil
+}
+
+// compactSegments keep the newest record of each compact key in the closed segments, the
+// tombstone written before tombstoneExpire (unix nano) is removed too.
+func (d *diskQueueWriter) compactSegments(keyFn compactKeyFunc, tombstoneExpire int64) (compactStats, error) {
+	var stats compactStats
+	d.RLock()
+	start := d.diskQueueStart
+	end := d.diskReadEnd
+	d.RUnlock()
+	if end.EndOffset.FileNum <= start.EndOffset.FileNum {
+		return stats, nil
+	}
+	keys := make(map[string]compactKeyEntry)
+	removable := make(map[int64]int64)
+	segStarts := make(map[int64]BackendOffset)
+	segStart := start.Offset() - BackendOffset(start.EndOffset.Pos)
+	for fileNum := start.EndOffset.FileNum; fileNum <= end.EndOffset.FileNum; fileNum++ {
+		segStarts[fileNum] = segStart
+		scanStart := int64(0)
+		if fileNum == start.EndOffset.FileNum {
+			scanStart = start.EndOffset.Pos
+		}
+		scanEnd := int64(-1)
+		if fileNum == end.EndOffset.FileNum {
+			scanEnd = end.EndOffset.Pos
+		}
+		fileName := d.fileName(fileNum)
+		err := scanCompactRecords(fileName, scanStart, scanEnd, func(pos int64, size int64, raw []byte, data []byte) error {
+			if data == nil {
+				return nil
+			}
+			key, tombstone, ts := keyFn(data)
+			if key == "" {
+				return nil
+			}
+			if old, ok := keys[key]; ok {
+				removable[old.fileNum]++
+			}
+			keys[key] = compactKeyEntry{offset: segStart + BackendOffset(pos), fileNum: fileNum, tombstone: tombstone, ts: ts}
+			return nil
+		})
+		if err != nil {
+			return stats, err
+		}
+		if fileNum < end.EndOffset.FileNum {
+			fstat, err := os.Stat(fileName)
+			if err != nil {
+				return stats, err
+			}
+			segStart += BackendOffset(fstat.Size())
+		}
+	}
+	for _, e := range keys {
+		if e.tombstone && e.ts < tombstoneExpire {
+			removable[e.fileNum]++
+		}
+	}
+	for fileNum := start.EndOffset.FileNum; fileNum < end.EndOffset.FileNum; fileNum++ {
+		if removable[fileNum] == 0 {
+			continue
+		}
+		removed, err := d.compactSegment(fileNum, segStarts[fileNum], keyFn, keys, tombstoneExpire)
+		if err != nil {
+			nsqLog.LogWarningf("diskqueue(%s) failed to compact segment %v: %v", d.name, fileNum, err)
+			return stats, err
+		}
+		if removed > 0 {
+			stats.segments++
+			stats.removed += removed
+		}
+	}
+	return stats, nil
+}
+
+// compactSegment rewrite the closed segment to the tmp file with the removed records replaced
+// by the padding records, the padding is written as the hole of the file. The tmp file will
+// replace the segment if the segment is not changed while compacting, the readers which have
+// opened the old segment will still read the old data with the same offsets.
+func (d *diskQueueWriter) compactSegment(fileNum int64, segStart BackendOffset, keyFn compactKeyFunc,
+	keys map[string]compactKeyEntry, tombstoneExpire int64) (int64, error) {
+	fileName := d.fileName(fileNum)
+	stat, err := os.Stat(fileName)
+	if err != nil {
+		return 0, err
+	}
+	tmpFileName := fileName + compactTmpSuffix
+	tmpFile, err := os.OpenFile(tmpFileName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmpFileName)
+	defer tmpFile.Close()
+	w := bufio.NewWriterSize(tmpFile, compactWriteBufSize)
+	var paddingHeader [recordPaddingHeaderSize]byte
+	removed := int64(0)
+	err = scanCompactRecords(fileName, 0, -1, func(pos int64, size int64, raw []byte, data []byte) error {
+		remove := data == nil
+		if data != nil {
+			key, _, _ := keyFn(data)
+			if e, ok := keys[key]; key != "" && ok {
+				if e.offset != segStart+BackendOffset(pos) || (e.tombstone && e.ts < tombstoneExpire) {
+					remove = true
+					removed++
+				}
+			}
+		}
+		if !remove {
+			_, err := w.Write(raw)
+			return err
+		}
+		err := w.Flush()
+		if err != nil {
+			return err
+		}
+		encodePaddingHeader(paddingHeader[:], int(size))
+		_, err = tmpFile.Write(paddingHeader[:])
+		if err != nil {
+			return err
+		}
+		_, err = tmpFile.Seek(size-recordPaddingHeaderSize, 1)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+	err = w.Flush()
+	if err == nil {
+		// make sure the hole at the end of segment is kept
+		err = tmpFile.Truncate(stat.Size())
+	}
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	if fileNum < d.diskQueueStart.EndOffset.FileNum || fileNum >= d.diskWriteEnd.EndOffset.FileNum {
+		return 0, fmt.Errorf("segment %v changed while compacting, queue start %v, end %v",
+			fileNum, d.diskQueueStart, d.diskWriteEnd)
+	}
+	newStat, err := os.Stat(fileName)
+	if err != nil {
+		return 0, err
+	}
+	if newStat.Size() != stat.Size() || !newStat.ModTime().Equal(stat.ModTime()) {
+		return 0, fmt.Errorf("segment %v changed while compacting", fileNum)
+	}
+	err = util.AtomicRename(tmpFileName, fileName)
+	if err != nil {
+		return 0, err
+	}
+	nsqLog.Logf("DISKQUEUE(%s): compacted segment %v, removed %v records", d.name, fileNum, removed)
+	return removed, nil
+}
@@ -21,6 +21,7 @@ const (
 )
 
 var errInvalidMetaFileData = errors.New("invalid meta file data")
+var errOnlyPaddingLeft = errors.New("only padding records left to the end")
 var diskMagicEndBytes = []byte{0xae, 0x83}
 var testCrash = false
 
@@ -115,6 +116,10 @@ type diskQueueReader struct {
 	autoSkipError   bool
 	waitingMoreData int32
 	metaStorage     IMetaStorage
+	// read the cleaned data from the archive, nil if disabled
+	archive *diskQueueArchive
+	// the message body not less than the size is not read into memory, 0 to disable
+	rawBodyMinSize int64
 }
 
 func newDiskQueueReaderWithFileMeta(readFrom string, metaname string, dataPath string, maxBytesPerFile int64,
@@ -186,6 +191,25 @@ func newDiskQueueReader(readFrom string, metaname string,
 	return &d
 }
 
+// SetArchive enable reading the cleaned positions from the archive
+func (d *diskQueueReader) SetArchive(archive *diskQueueArchive) {
+	d.Lock()
+	d.archive = archive
+	d.Unlock()
+}
+
+// stepOffset is the same as the global stepOffset except the cleaned positions will be
+// located in the archive if enabled.
+func (d *diskQueueReader) stepOffset(cur diskQueueEndInfo, step BackendOffset, maxStep diskQueueEndInfo) (diskQueueOffset, error) {
+	if d.archive != nil {
+		newPos, handled, err := d.archive.stepOffset(cur, step, maxStep)
+		if handled {
+			return newPos, err
+		}
+	}
+	return stepOffset(d.dataPath, d.readFrom, cur, step, maxStep)
+}
+
 func getQueueSegmentEnd(dataRoot string, readFrom string, offset diskQueueOffset) (int64, error) {
 	curFileName := GetQueueFileName(dataRoot, readFrom, offset.FileNum)
 	f, err := os.Stat(curFileName)
@@ -463,6 +487,9 @@ func (d *diskQueueReader) TryReadOne() (ReadResult, bool) {
 		if d.queueEndInfo.EndOffset.GreatThan(&d.readQueueInfo.EndOffset) && d.queueEndInfo.Offset() > d.readQueueInfo.Offset() {
 			dataRead := d.readOne()
 			rerr := dataRead.Err
+			if rerr == errOnlyPaddingLeft {
+				return ReadResult{}, false
+			}
 			if rerr != nil {
 				nsqLog.LogErrorf("reading from diskqueue(%s) at %d of %s - %s, current end: %v",
 					d.readerMetaName, d.readQueueInfo, d.fileName(d.readQueueInfo.EndOffset.FileNum), dataRead.Err, d.queueEndInfo)
@@ -635,8 +662,7 @@ func (d *diskQueueReader) internalConfirm(offset BackendOffset, cnt int64) error
 	}
 
 	diffVirtual := offset - d.confirmedQueueInfo.Offset()
-	newConfirm, err := stepOffset(d.dataPath, d.readFrom,
-		d.confirmedQueueInfo, diffVirtual, d.readQueueInfo)
+	newConfirm, err := d.stepOffset(d.confirmedQueueInfo, diffVirtual, d.readQueueInfo)
 	if err != nil {
 		nsqLog.LogErrorf("confirmed exceed the read pos: %v, %v", offset, d.readQueueInfo.Offset())
 		return ErrConfirmSizeInvalid
@@ -705,7 +731,7 @@ func (d *diskQueueReader) internalSkipTo(voffset BackendOffset, cnt int64, backT
 			return ErrMoveOffsetInvalid
 		}
 
-		newPos, err = stepOffset(d.dataPath, d.readFrom, d.readQueueInfo,
+		newPos, err = d.stepOffset(d.readQueueInfo,
 			voffset-d.readQueueInfo.Offset(), d.queueEndInfo)
 		if err != nil {
 			nsqLog.LogErrorf("internal skip error : %v, skipping to : %v", err, voffset)
@@ -860,7 +886,10 @@ func (d *diskQueueReader) ensureReadBuffer(dataNeed int64, curNum int64, current
 // while advancing read positions and rolling files, if necessary
 func (d *diskQueueReader) readOne() ReadResult {
 	var result ReadResult
-	var msgSize int32
+	var sizeHeader uint32
+	// the padding records of the compacted messages are skipped and returned with the next message
+	var hasPadding bool
+	var paddingStart diskQueueEndInfo
 	result.Offset = BackendOffset(0)
 	if d.readQueueInfo.totalMsgCnt <= 0 && d.readQueueInfo.Offset() > 0 {
 		result.Err = ErrReadQueueCountMissing
@@ -872,7 +901,11 @@ CheckFileOpen:
 
 	result.Offset = d.readQueueInfo.Offset()
 	if d.readFile == nil {
-		curFileName := d.fileName(d.readQueueInfo.EndOffset.FileNum)
+		var curFileName string
+		curFileName, result.Err = d.readFileName()
+		if result.Err != nil {
+			return result
+		}
 		d.readFile, result.Err = os.OpenFile(curFileName, os.O_RDONLY, 0644)
 		if result.Err != nil {
 			return result
@@ -904,6 +937,9 @@ CheckFileOpen:
 			d.readBuffer.Reset()
 			d.readFile.Close()
 			d.readFile = nil
+			if hasPadding {
+				d.readQueueInfo = paddingStart
+			}
 		}
 	}()
 
@@ -937,7 +973,7 @@ CheckFileOpen:
 			return result
 		}
 	}
-	result.Err = binary.Read(d.readBuffer, binary.BigEndian, &msgSize)
+	result.Err = binary.Read(d.readBuffer, binary.BigEndian, &sizeHeader)
 	if result.Err != nil {
 		nsqLog.LogWarningf("DISKQUEUE(%s): read %v error %v, buffer: %v", d.readerMetaName, d.readQueueInfo, result.Err, d.readBuffer.Len())
 		tmpStat, tmpErr := d.readFile.Stat()
@@ -948,6 +984,24 @@ CheckFileOpen:
 		}
 		return result
 	}
+	if sizeHeader == 0 {
+		if !hasPadding {
+			hasPadding = true
+			paddingStart = d.readQueueInfo
+		}
+		result.Err = d.skipPaddingRecord()
+		if result.Err != nil {
+			nsqLog.LogWarningf("DISKQUEUE(%s): read %v padding error %v", d.readerMetaName, d.readQueueInfo, result.Err)
+			return result
+		}
+		if d.readQueueInfo.Offset() >= d.queueEndInfo.Offset() {
+			// wait the new message to return with the padding records
+			result.Err = errOnlyPaddingLeft
+			return result
+		}
+		goto CheckFileOpen
+	}
+	msgSize, withChecksum, codec := decodeRecordSize(sizeHeader)
 
 	if msgSize <= 0 || msgSize > MAX_POSSIBLE_MSG_SIZE {
 		// this file is corrupt and we have no reasonable guarantee on
@@ -955,20 +1009,39 @@ CheckFileOpen:
 		result.Err = fmt.Errorf("invalid message read size (%d)", msgSize)
 		return result
 	}
-
-	result.Data = make([]byte, msgSize)
-	rn, result.Err = d.ensureReadBuffer(int64(msgSize), d.readQueueInfo.EndOffset.FileNum, d.readQueueInfo.EndOffset.Pos+4, d.queueEndInfo)
-	if result.Err != nil {
-		if result.Err == io.EOF && d.readBuffer.Len() >= int(msgSize) {
-			//
-		} else {
-			tmpStat, _ := d.readFile.Stat()
-			nsqLog.LogWarningf("DISKQUEUE(%s): ensure buffer for msg body error %v, %v, left %v, need: %v, stats: %v",
-				d.readerMetaName, result.Err.Error(), rn, d.readBuffer.Len(), msgSize, tmpStat)
-			return result
+	headerSize := int64(recordHeaderSize(withChecksum))
+	var checksum uint32
+	var rawBody *rawMsgBody
+	if d.canReadRawBody(codec, withChecksum, msgSize) {
+		result.Data, rawBody, result.Err = d.readRawBodyRecord(msgSize)
+	} else {
+		dataNeed := int64(msgSize) + headerSize - recordSizeLen
+		rn, result.Err = d.ensureReadBuffer(dataNeed, d.readQueueInfo.EndOffset.FileNum, d.readQueueInfo.EndOffset.Pos+recordSizeLen, d.queueEndInfo)
+		if result.Err != nil {
+			if result.Err == io.EOF && int64(d.readBuffer.Len()) >= dataNeed {
+				//
+			} else {
+				tmpStat, _ := d.readFile.Stat()
+				nsqLog.LogWarningf("DISKQUEUE(%s): ensure buffer for msg body error %v, %v, left %v, need: %v, stats: %v",
+					d.readerMetaName, result.Err.Error(), rn, d.readBuffer.Len(), msgSize, tmpStat)
+				return result
+			}
+		}
+		if withChecksum {
+			result.Err = binary.Read(d.readBuffer, binary.BigEndian, &checksum)
+			if result.Err != nil {
+				nsqLog.LogWarningf("DISKQUEUE(%s): read %v checksum error %v, buffer: %v", d.readerMetaName, d.readQueueInfo, result.Err, d.readBuffer.Len())
+				return result
+			}
 		}
+		result.Data = make([]byte, msgSize)
+		_, result.Err = io.ReadFull(d.readBuffer, result.Data)
+	}
+	if result.Err == ErrRecordChecksumMismatch {
+		nsqLog.LogErrorf("DISKQUEUE(%s): read %v checksum mismatch, size: %v", d.readerMetaName, d.readQueueInfo, msgSize)
+		result.Data = nil
+		return result
 	}
-	_, result.Err = io.ReadFull(d.readBuffer, result.Data)
 	if result.Err != nil {
 		nsqLog.LogWarningf("DISKQUEUE(%s): read %v error %v, %v, buffer: %v", d.readerMetaName, d.readQueueInfo, result.Err, msgSize, d.readBuffer.Len())
 		tmpStat, tmpErr := d.readFile.Stat()
@@ -980,10 +1053,27 @@ CheckFileOpen:
 
 		return result
 	}
+	if withChecksum {
+		result.Err = checkRecordChecksum(result.Data, checksum)
+		if result.Err != nil {
+			nsqLog.LogErrorf("DISKQUEUE(%s): read %v checksum mismatch, size: %v", d.readerMetaName, d.readQueueInfo, msgSize)
+			result.Data = nil
+			return result
+		}
+	}
+	if codec != CompressNone {
+		result.Data, result.Err = decompressRecord(codec, result.Data)
+		if result.Err != nil {
+			nsqLog.LogErrorf("DISKQUEUE(%s): read %v decompress error: %v", d.readerMetaName, d.readQueueInfo, result.Err)
+			result.Data = nil
+			return result
+		}
+	}
 
 	result.Offset = d.readQueueInfo.Offset()
+	result.rawBody = rawBody
 
-	totalBytes := int64(4 + msgSize)
+	totalBytes := headerSize + int64(msgSize)
 	result.MovedSize = BackendOffset(totalBytes)
 	oldCnt := d.readQueueInfo.TotalMsgCnt()
 	oldPos := d.readQueueInfo.EndOffset
@@ -999,6 +1089,11 @@ CheckFileOpen:
 		}
 		d.readQueueInfo.totalMsgCnt = d.queueEndInfo.totalMsgCnt
 	}
+	if hasPadding {
+		// the channel will confirm the padding records with this message
+		result.Offset = paddingStart.Offset()
+		result.MovedSize = d.readQueueInfo.Offset() - paddingStart.Offset()
+	}
 
 	if nsqLog.Level() >= levellogger.LOG_DETAIL {
 		nsqLog.LogDebugf("=== read move forward: from %v (cnt:%v) to %v", oldPos, oldCnt,
@@ -1013,6 +1108,106 @@ CheckFileOpen:
 	return result
 }
 
+// SetRawBodyMinSize set the min size of the message body which is not read into memory, the body
+// will be sent from the segment file directly. 0 to disable.
+func (d *diskQueueReader) SetRawBodyMinSize(size int64) {
+	atomic.StoreInt64(&d.rawBodyMinSize, size)
+}
+
+// canReadRawBody check whether the body of the record can be kept in the file, only the plain
+// record in the local segment file is allowed. The record with checksum is read into memory
+// since the checksum should be verified on the whole data before sending to the consumer.
+func (d *diskQueueReader) canReadRawBody(codec CompressCodec, withChecksum bool, msgSize int32) bool {
+	minSize := atomic.LoadInt64(&d.rawBodyMinSize)
+	if minSize <= 0 || codec != CompressNone || withChecksum || int64(msgSize) < minSize+minValidMsgLength {
+		return false
+	}
+	return d.readFile.Name() == d.fileName(d.readQueueInfo.EndOffset.FileNum)
+}
+
+// readRawBodyRecord read the message header of the record and skip the body in the segment
+// file, so the body is only read while sending to the consumer. The location of the body is
+// returned with the header. The whole data is returned if the header is invalid or too large
+// and it will be handled while decoding.
+func (d *diskQueueReader) readRawBodyRecord(msgSize int32) ([]byte, *rawMsgBody, error) {
+	curNum := d.readQueueInfo.EndOffset.FileNum
+	dataPos := d.readQueueInfo.EndOffset.Pos + recordHeaderSizeV1
+	dataNeed := int64(msgSize)
+	if dataNeed > readBufferSize {
+		dataNeed = readBufferSize
+	}
+	_, err := d.ensureReadBuffer(dataNeed, curNum, dataPos, d.queueEndInfo)
+	if err != nil && (err != io.EOF || int64(d.readBuffer.Len()) < dataNeed) {
+		return nil, nil, err
+	}
+	hdrLen := messageHeaderLen(d.readBuffer.Bytes()[:dataNeed])
+	if hdrLen < 0 {
+		_, err = d.ensureReadBuffer(int64(msgSize), curNum, dataPos, d.queueEndInfo)
+		if err != nil && (err != io.EOF || d.readBuffer.Len() < int(msgSize)) {
+			return nil, nil, err
+		}
+		data := make([]byte, msgSize)
+		_, err = io.ReadFull(d.readBuffer, data)
+		return data, nil, err
+	}
+	header := make([]byte, hdrLen)
+	copy(header, d.readBuffer.Next(hdrLen))
+	skip := int64(msgSize) - int64(hdrLen)
+	if int64(d.readBuffer.Len()) >= skip {
+		d.readBuffer.Next(int(skip))
+	} else {
+		skip -= int64(d.readBuffer.Len())
+		d.readBuffer.Reset()
+		_, err = d.readFile.Seek(skip, 1)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	rawBody := &rawMsgBody{
+		fileName: d.readFile.Name(),
+		pos:      dataPos + int64(hdrLen),
+		size:     int64(msgSize) - int64(hdrLen),
+	}
+	return header, rawBody, nil
+}
+
+// skipPaddingRecord skip the padding record after the zero header is read, and advance the read position.
+func (d *diskQueueReader) skipPaddingRecord() error {
+	curNum := d.readQueueInfo.EndOffset.FileNum
+	curPos := d.readQueueInfo.EndOffset.Pos
+	_, err := d.ensureReadBuffer(recordPaddingHeaderSize-recordSizeLen, curNum, curPos+recordSizeLen, d.queueEndInfo)
+	if err != nil && (err != io.EOF || d.readBuffer.Len() < recordPaddingHeaderSize-recordSizeLen) {
+		return err
+	}
+	var v uint32
+	err = binary.Read(d.readBuffer, binary.BigEndian, &v)
+	if err != nil {
+		return err
+	}
+	psize, err := decodePaddingSize(v)
+	if err != nil {
+		return err
+	}
+	if curNum == d.queueEndInfo.EndOffset.FileNum && curPos+psize > d.queueEndInfo.EndOffset.Pos {
+		return fmt.Errorf("padding record size %v exceed the end %v", psize, d.queueEndInfo)
+	}
+	skip := psize - recordPaddingHeaderSize
+	if int64(d.readBuffer.Len()) >= skip {
+		d.readBuffer.Next(int(skip))
+	} else {
+		skip -= int64(d.readBuffer.Len())
+		d.readBuffer.Reset()
+		_, err = d.readFile.Seek(skip, 1)
+		if err != nil {
+			return err
+		}
+	}
+	d.readQueueInfo.EndOffset.Pos += psize
+	d.readQueueInfo.virtualEnd += BackendOffset(psize)
+	atomic.AddInt64(&d.readQueueInfo.totalMsgCnt, 1)
+	return nil
+}
+
 func (d *diskQueueReader) handleReachEnd() {
 	if d.readFile != nil {
 		d.readFile.Close()
@@ -1022,6 +1217,10 @@ func (d *diskQueueReader) handleReachEnd() {
 
 	d.readQueueInfo.EndOffset.FileNum++
 	d.readQueueInfo.EndOffset.Pos = 0
+	if d.archive != nil && d.archive.isCleaned(d.readQueueInfo.Offset()-1) {
+		d.archive.fixSegmentEnd(&d.readQueueInfo)
+		return
+	}
 	fixCnt, _, metaEnd, err := getQueueFileOffsetMeta(d.fileName(d.readQueueInfo.EndOffset.FileNum - 1))
 	if err == nil {
 		// we compare the meta file to check if any wrong on the count of message
@@ -1106,6 +1305,17 @@ func GetQueueFileName(dataRoot string, base string, fileNum int64) string {
 	return fmt.Sprintf(path.Join(dataRoot, "%s.diskqueue.%06d.dat"), base, fileNum)
 }
 
+// the file at the read position, the cleaned segment will be fetched from the archive
+func (d *diskQueueReader) readFileName() (string, error) {
+	if d.archive != nil {
+		fileName, handled, err := d.archive.segmentFile(d.readQueueInfo)
+		if handled {
+			return fileName, err
+		}
+	}
+	return d.fileName(d.readQueueInfo.EndOffset.FileNum), nil
+}
+
 func (d *diskQueueReader) fileName(fileNum int64) string {
 	return GetQueueFileName(d.dataPath, d.readFrom, fileNum)
 }
@@ -1,6 +1,7 @@
 package nsqd
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -9,6 +10,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/youzan/nsq/internal/ext"
 	"github.com/youzan/nsq/internal/test"
 )
 
@@ -507,6 +509,229 @@ func TestDiskQueueSnapshotReader(t *testing.T) {
 	// remove some begin of queue, and test queue start
 }
 
+func TestDiskQueueReaderRecordChecksum(t *testing.T) {
+	dqName := "test_disk_queue_checksum" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 1024*1024, 4, 1<<10, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+
+	// the old records without checksum should be readable after the checksum enabled
+	msg := []byte("test")
+	_, wsize, _, err := dqWriter.PutV2(msg)
+	test.Nil(t, err)
+	test.Equal(t, int32(len(msg)+recordHeaderSizeV1), wsize)
+	dqWriter.SetRecordChecksum(true)
+	test.Equal(t, int64(recordHeaderSizeV2), dqWriter.RecordHeaderSize())
+	msgNum := 10
+	for i := 0; i < msgNum; i++ {
+		_, wsize, _, err = dqWriter.PutV2(msg)
+		test.Nil(t, err)
+		test.Equal(t, int32(len(msg)+recordHeaderSizeV2), wsize)
+	}
+	dqWriter.Flush(false)
+	end := dqWriter.GetQueueWriteEnd()
+
+	dqReader := newDiskQueueReaderWithMetaStorage(dqName, dqName, tmpDir, 1024*1024, 4, 1<<10, 1, 2*time.Second, nil, true)
+	defer dqReader.Close()
+	dqReader.UpdateQueueEnd(end, false)
+	for i := 0; i < msgNum+1; i++ {
+		msgOut, hasData := dqReader.TryReadOne()
+		test.Equal(t, true, hasData)
+		test.Nil(t, msgOut.Err)
+		test.Equal(t, msg, msgOut.Data)
+		test.Equal(t, int64(i+1), msgOut.CurCnt)
+	}
+	snap := NewDiskQueueSnapshot(dqName, tmpDir, end)
+	defer snap.Close()
+	for i := 0; i < msgNum+1; i++ {
+		r := snap.ReadOne()
+		test.Nil(t, r.Err)
+		test.Equal(t, msg, r.Data)
+	}
+	rawSnap := NewDiskQueueSnapshot(dqName, tmpDir, end)
+	defer rawSnap.Close()
+	rawData, err := rawSnap.ReadRaw(int32(end.Offset()))
+	test.Nil(t, err)
+	test.Nil(t, walkRawRecords(rawData, nil))
+
+	// flip one bit in the body of the last record
+	f, err := os.OpenFile(dqWriter.fileName(0), os.O_RDWR, 0644)
+	test.Nil(t, err)
+	_, err = f.WriteAt([]byte("T"), int64(end.Offset())-int64(len(msg)))
+	test.Nil(t, err)
+	f.Close()
+	rawData[len(rawData)-len(msg)] = 'T'
+	test.Equal(t, ErrRecordChecksumMismatch, walkRawRecords(rawData, nil))
+
+	dqReader2 := newDiskQueueReaderWithMetaStorage(dqName, dqName+"2", tmpDir, 1024*1024, 4, 1<<10, 1, 2*time.Second, nil, false)
+	defer dqReader2.Close()
+	dqReader2.UpdateQueueEnd(end, false)
+	for i := 0; i < msgNum; i++ {
+		msgOut, _ := dqReader2.TryReadOne()
+		test.Nil(t, msgOut.Err)
+	}
+	msgOut, _ := dqReader2.TryReadOne()
+	test.Equal(t, ErrRecordChecksumMismatch, msgOut.Err)
+	test.Nil(t, msgOut.Data)
+
+	snap2 := NewDiskQueueSnapshot(dqName, tmpDir, end)
+	defer snap2.Close()
+	for i := 0; i < msgNum; i++ {
+		r := snap2.ReadOne()
+		test.Nil(t, r.Err)
+	}
+	r := snap2.ReadOne()
+	test.Equal(t, ErrRecordChecksumMismatch, r.Err)
+}
+
+func TestDiskQueueReaderRecordCompression(t *testing.T) {
+	for _, codec := range []CompressCodec{CompressSnappy, CompressZstd} {
+		dqName := "test_disk_queue_compress_" + codec.String() + strconv.Itoa(int(time.Now().Unix()))
+		tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+		test.Nil(t, err)
+		defer os.RemoveAll(tmpDir)
+		queue, _ := NewDiskQueueWriter(dqName, tmpDir, 1024*1024, 4, 1<<20, 1)
+		dqWriter := queue.(*diskQueueWriter)
+		defer dqWriter.Close()
+
+		// the old records without compression should be readable after the compression enabled
+		msg := bytes.Repeat([]byte("test"), 256)
+		_, wsize, _, err := dqWriter.PutV2(msg)
+		test.Nil(t, err)
+		test.Equal(t, int32(len(msg)+recordHeaderSizeV1), wsize)
+		dqWriter.SetRecordChecksum(true)
+		dqWriter.SetCompressCodec(codec)
+		test.Equal(t, codec, dqWriter.GetCompressCodec())
+		msgNum := 10
+		for i := 0; i < msgNum; i++ {
+			_, wsize, _, err = dqWriter.PutV2(msg)
+			test.Nil(t, err)
+			test.Equal(t, true, wsize < int32(len(msg)/2))
+		}
+		// the data not compressible should be written without compression
+		small := []byte("tttt")
+		_, wsize, _, err = dqWriter.PutV2(small)
+		test.Nil(t, err)
+		test.Equal(t, int32(len(small)+recordHeaderSizeV2), wsize)
+		dqWriter.Flush(false)
+		end := dqWriter.GetQueueWriteEnd()
+
+		dqReader := newDiskQueueReaderWithMetaStorage(dqName, dqName, tmpDir, 1024*1024, 4, 1<<20, 1, 2*time.Second, nil, false)
+		defer dqReader.Close()
+		dqReader.UpdateQueueEnd(end, false)
+		for i := 0; i < msgNum+1; i++ {
+			msgOut, hasData := dqReader.TryReadOne()
+			test.Equal(t, true, hasData)
+			test.Nil(t, msgOut.Err)
+			test.Equal(t, msg, msgOut.Data)
+		}
+		msgOut, _ := dqReader.TryReadOne()
+		test.Nil(t, msgOut.Err)
+		test.Equal(t, small, msgOut.Data)
+		test.Equal(t, end.Offset(), msgOut.Offset+msgOut.MovedSize)
+
+		snap := NewDiskQueueSnapshot(dqName, tmpDir, end)
+		defer snap.Close()
+		for i := 0; i < msgNum+1; i++ {
+			r := snap.ReadOne()
+			test.Nil(t, r.Err)
+			test.Equal(t, msg, r.Data)
+		}
+		rawSnap := NewDiskQueueSnapshot(dqName, tmpDir, end)
+		defer rawSnap.Close()
+		rawData, err := rawSnap.ReadRaw(int32(end.Offset()))
+		test.Nil(t, err)
+		cnt := 0
+		err = walkRawRecords(rawData, func(pos int, data []byte, recordSize int) {
+			if cnt <= msgNum {
+				test.Equal(t, msg, data)
+			} else {
+				test.Equal(t, small, data)
+			}
+			cnt++
+		})
+		test.Nil(t, err)
+		test.Equal(t, msgNum+2, cnt)
+	}
+}
+
+func TestDiskQueueReaderRecordEncryption(t *testing.T) {
+	dqName := "test_disk_queue_encrypt" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	defer SetEncryptKeyring(nil)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 1024*1024, 4, 1<<20, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+
+	// the old records before the encryption enabled should be readable
+	msg := bytes.Repeat([]byte("secret"), 100)
+	_, wsize, _, err := dqWriter.PutV2(msg)
+	test.Nil(t, err)
+	test.Equal(t, int32(len(msg)+recordHeaderSizeV1), wsize)
+	kr1, err := ParseEncryptKeyring(testKeyringData(1), 0)
+	test.Nil(t, err)
+	SetEncryptKeyring(kr1)
+	dqWriter.SetRecordChecksum(true)
+	msgNum := 5
+	for i := 0; i < msgNum; i++ {
+		_, wsize, _, err = dqWriter.PutV2(msg)
+		test.Nil(t, err)
+		test.Equal(t, int64(len(msg))+recordHeaderSizeV2+1+EncryptOverhead, int64(wsize))
+	}
+	// rotate the key and enable the compression
+	kr2, err := ParseEncryptKeyring(testKeyringData(1, 2), 0)
+	test.Nil(t, err)
+	SetEncryptKeyring(kr2)
+	dqWriter.SetCompressCodec(CompressZstd)
+	for i := 0; i < msgNum; i++ {
+		_, wsize, _, err = dqWriter.PutV2(msg)
+		test.Nil(t, err)
+		test.Equal(t, true, wsize < int32(len(msg)/2))
+	}
+	dqWriter.Flush(false)
+	end := dqWriter.GetQueueWriteEnd()
+
+	rawSnap := NewDiskQueueSnapshot(dqName, tmpDir, end)
+	defer rawSnap.Close()
+	rawData, err := rawSnap.ReadRaw(int32(end.Offset()))
+	test.Nil(t, err)
+	test.Equal(t, 1, bytes.Count(rawData, msg))
+	cnt := 0
+	err = walkRawRecords(rawData, func(pos int, data []byte, recordSize int) {
+		test.Equal(t, msg, data)
+		cnt++
+	})
+	test.Nil(t, err)
+	test.Equal(t, msgNum*2+1, cnt)
+
+	dqReader := newDiskQueueReaderWithMetaStorage(dqName, dqName, tmpDir, 1024*1024, 4, 1<<20, 1, 2*time.Second, nil, false)
+	defer dqReader.Close()
+	dqReader.UpdateQueueEnd(end, false)
+	for i := 0; i < msgNum*2+1; i++ {
+		msgOut, hasData := dqReader.TryReadOne()
+		test.Equal(t, true, hasData)
+		test.Nil(t, msgOut.Err)
+		test.Equal(t, msg, msgOut.Data)
+	}
+
+	// the records encrypted by the removed key can not be read
+	SetEncryptKeyring(kr1)
+	snap := NewDiskQueueSnapshot(dqName, tmpDir, end)
+	defer snap.Close()
+	for i := 0; i < msgNum+1; i++ {
+		r := snap.ReadOne()
+		test.Nil(t, r.Err)
+		test.Equal(t, msg, r.Data)
+	}
+	r := snap.ReadOne()
+	test.Equal(t, ErrEncryptKeyNotFound, r.Err)
+}
+
 func TestDiskQueueSnapshotReaderSkipNextError(t *testing.T) {
 	// test skip can ignore not exist error to skip next
 	dqName := "test_disk_queue" + strconv.Itoa(int(time.Now().Unix()))
@@ -680,3 +905,88 @@ func TestDiskQueueReaderFileMetaInvalid(t *testing.T) {
 	err = dqReader.(*diskQueueReader).retrieveMetaData()
 	test.Nil(t, err)
 }
+
+func TestDiskQueueReaderZeroCopyBody(t *testing.T) {
+	dqName := "test_disk_queue_zero_copy" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 1024*1024, 4, 1<<20, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+
+	large := bytes.Repeat([]byte("test"), 256)
+	// the body larger than the read buffer is skipped by seeking the segment file
+	huge := bytes.Repeat([]byte("test"), readBufferSize)
+	small := []byte("test")
+	msgs := []*Message{
+		NewMessage(1, large),
+		NewMessageWithExt(2, large, ext.JSON_HEADER_EXT_VER, []byte(`{"k":"v"}`)),
+		NewMessage(3, huge),
+		NewMessage(4, large),
+		NewMessageWithExt(5, small, ext.JSON_HEADER_EXT_VER, []byte(`{"k":"v"}`)),
+		NewMessageWithExt(6, large, ext.NO_EXT_VER, nil),
+	}
+	checksumStart := 4
+	for i, m := range msgs {
+		if i == checksumStart {
+			dqWriter.SetRecordChecksum(true)
+		}
+		buf := &bytes.Buffer{}
+		_, err = m.WriteTo(buf, true)
+		test.Nil(t, err)
+		_, _, _, err = dqWriter.PutV2(buf.Bytes())
+		test.Nil(t, err)
+	}
+	dqWriter.Flush(false)
+	end := dqWriter.GetQueueWriteEnd()
+
+	dqReader := newDiskQueueReaderWithMetaStorage(dqName, dqName, tmpDir, 1024*1024, 4, 1<<20, 1, 2*time.Second, nil, true)
+	defer dqReader.Close()
+	dqReader.(*diskQueueReader).SetRawBodyMinSize(int64(len(large)))
+	dqReader.UpdateQueueEnd(end, false)
+	for i, m := range msgs {
+		msgOut, hasData := dqReader.TryReadOne()
+		test.Equal(t, true, hasData)
+		test.Nil(t, msgOut.Err)
+		decoded, err := DecodeMessage(msgOut.Data, true)
+		test.Nil(t, err)
+		test.Equal(t, m.ID, decoded.ID)
+		test.Equal(t, m.ExtBytes, decoded.ExtBytes)
+		// the record with checksum is verified and read into memory
+		if len(m.Body) < len(large) || i >= checksumStart {
+			test.Nil(t, msgOut.rawBody)
+			test.Equal(t, m.Body, decoded.Body)
+			continue
+		}
+		test.NotNil(t, msgOut.rawBody)
+		test.Equal(t, 0, len(decoded.Body))
+		decoded.rawBody = msgOut.rawBody
+		test.Equal(t, int64(len(m.Body)), decoded.BodySize())
+		body, err := decoded.GetBody()
+		test.Nil(t, err)
+		test.Equal(t, m.Body, body)
+		body, err = decoded.GetCopy().GetBody()
+		test.Nil(t, err)
+		test.Equal(t, m.Body, body)
+	}
+	test.Equal(t, end.Offset(), dqReader.(*diskQueueReader).readQueueInfo.Offset())
+
+	// the corrupted body should be detected by the checksum
+	f, err := os.OpenFile(dqWriter.fileName(0), os.O_RDWR, 0644)
+	test.Nil(t, err)
+	_, err = f.WriteAt([]byte("T"), int64(end.Offset())-1)
+	test.Nil(t, err)
+	f.Close()
+	dqReader2 := newDiskQueueReaderWithMetaStorage(dqName, dqName+"2", tmpDir, 1024*1024, 4, 1<<20, 1, 2*time.Second, nil, false)
+	defer dqReader2.Close()
+	dqReader2.(*diskQueueReader).SetRawBodyMinSize(int64(len(large)))
+	dqReader2.UpdateQueueEnd(end, false)
+	for i := 0; i < len(msgs)-1; i++ {
+		msgOut, _ := dqReader2.TryReadOne()
+		test.Nil(t, msgOut.Err)
+	}
+	msgOut, _ := dqReader2.TryReadOne()
+	test.Equal(t, ErrRecordChecksumMismatch, msgOut.Err)
+	test.Nil(t, msgOut.Data)
+}
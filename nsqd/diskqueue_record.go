@@ -0,0 +1,262 @@
+package nsqd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// The record on disk is [4-bytes size][data] for the old format (v1). The v2 record
+// has the checksum flag in the highest bit of the size and the CRC32C of the data
+// following the size: [4-bytes flag|size][4-bytes crc32c][data].
+// The next 2 bits of the size is the compression codec of the record data, and the
+// checksum is computed on the compressed data.
+// Since the version is kept in each record, the old segments and the records written
+// before the checksum enabled are still readable.
+// If the encryption at rest is enabled, the codec of the record is recordCodecEncrypted and
+// the data is [1-byte compression codec][sealed data], see EncryptKeyring for the sealed data.
+// The key id is kept in each record so the segment can have the records encrypted by different
+// keys while rotating.
+// The record removed by the compaction is replaced by the padding record with the same size,
+// so the offsets of the other records are not changed. The padding record is
+// [4-bytes zero][4-bytes total record size][hole], the hole is not allocated on disk.
+const (
+	recordChecksumFlag      = uint32(1 << 31)
+	recordCodecShift        = 29
+	recordCodecMask         = uint32(3 << recordCodecShift)
+	recordSizeMask          = uint32(1<<recordCodecShift) - 1
+	recordSizeLen           = 4
+	recordChecksumLen       = 4
+	recordHeaderSizeV1      = recordSizeLen
+	recordHeaderSizeV2      = recordSizeLen + recordChecksumLen
+	recordPaddingHeaderSize = recordSizeLen + 4
+)
+
+type CompressCodec int32
+
+const (
+	CompressNone   CompressCodec = 0
+	CompressSnappy CompressCodec = 1
+	CompressZstd   CompressCodec = 2
+	// only used in the record header for the encrypted data
+	recordCodecEncrypted CompressCodec = 3
+)
+
+func (c CompressCodec) String() string {
+	switch c {
+	case CompressSnappy:
+		return "snappy"
+	case CompressZstd:
+		return "zstd"
+	default:
+		return "none"
+	}
+}
+
+// ParseCompressCodec parse the topic compression, empty means no compression.
+func ParseCompressCodec(s string) (CompressCodec, error) {
+	switch s {
+	case "", "none":
+		return CompressNone, nil
+	case "snappy":
+		return CompressSnappy, nil
+	case "zstd":
+		return CompressZstd, nil
+	default:
+		return CompressNone, fmt.Errorf("unknown compression: %v", s)
+	}
+}
+
+var (
+	ErrRecordChecksumMismatch = errors.New("disk queue record checksum mismatch")
+	crc32cTable               = crc32.MakeTable(crc32.Castagnoli)
+
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+func initZstd() {
+	zstdOnce.Do(func() {
+		zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+	})
+}
+
+// compressRecord return the compressed data and the codec used, the original data
+// will be returned without compression if the compressed is not smaller. The zstd
+// records are compressed with the active dictionary if loaded, see ZstdDicts.
+func compressRecord(codec CompressCodec, data []byte, buf []byte) ([]byte, CompressCodec) {
+	var compressed []byte
+	switch codec {
+	case CompressSnappy:
+		compressed = snappy.Encode(buf[:cap(buf)], data)
+	case CompressZstd:
+		if zd := GetZstdDicts(); zd != nil {
+			compressed = zd.encoder.EncodeAll(data, buf[:0])
+			break
+		}
+		initZstd()
+		compressed = zstdEncoder.EncodeAll(data, buf[:0])
+	default:
+		return data, CompressNone
+	}
+	if len(compressed) >= len(data) {
+		return data, CompressNone
+	}
+	return compressed, codec
+}
+
+func decompressRecord(codec CompressCodec, data []byte) ([]byte, error) {
+	switch codec {
+	case CompressNone:
+		return data, nil
+	case CompressSnappy:
+		return snappy.Decode(nil, data)
+	case CompressZstd:
+		if zd := GetZstdDicts(); zd != nil {
+			return zd.decoder.DecodeAll(data, nil)
+		}
+		initZstd()
+		return zstdDecoder.DecodeAll(data, nil)
+	case recordCodecEncrypted:
+		return decryptRecord(data)
+	default:
+		return nil, fmt.Errorf("unknown record compression: %v", codec)
+	}
+}
+
+// encryptRecord seal the (compressed) data and append to buf, the compression codec is
+// authenticated with the data.
+func encryptRecord(kr *EncryptKeyring, codec CompressCodec, data []byte, buf []byte) ([]byte, error) {
+	aad := []byte{byte(codec)}
+	buf = append(buf[:0], aad...)
+	return kr.Seal(buf, data, aad)
+}
+
+// appendPlainRecord append the record without checksum, compression and encryption to dst.
+func appendPlainRecord(dst []byte, data []byte) []byte {
+	var header [recordHeaderSizeV2]byte
+	hsize := encodeRecordHeader(header[:], data, false, CompressNone)
+	dst = append(dst, header[:hsize]...)
+	return append(dst, data...)
+}
+
+func decryptRecord(data []byte) ([]byte, error) {
+	kr := GetEncryptKeyring()
+	if kr == nil {
+		return nil, ErrEncryptKeyringNotLoaded
+	}
+	if len(data) < 1 || CompressCodec(data[0]) == recordCodecEncrypted {
+		return nil, ErrEncryptDataInvalid
+	}
+	plain, err := kr.Open(data[1:], data[:1])
+	if err != nil {
+		return nil, err
+	}
+	return decompressRecord(CompressCodec(data[0]), plain)
+}
+
+func recordChecksum(data []byte) uint32 {
+	return crc32.Checksum(data, crc32cTable)
+}
+
+func recordHeaderSize(withChecksum bool) int {
+	if withChecksum {
+		return recordHeaderSizeV2
+	}
+	return recordHeaderSizeV1
+}
+
+// decodeRecordSize return the data size on disk, whether the record has the checksum
+// and the compression codec of the data.
+func decodeRecordSize(v uint32) (int32, bool, CompressCodec) {
+	return int32(v & recordSizeMask), v&recordChecksumFlag != 0,
+		CompressCodec((v & recordCodecMask) >> recordCodecShift)
+}
+
+// encodeRecordHeader write the record header for the data to buf, buf should have
+// enough space for the header.
+func encodeRecordHeader(buf []byte, data []byte, withChecksum bool, codec CompressCodec) int {
+	v := uint32(len(data)) | uint32(codec)<<recordCodecShift
+	if !withChecksum {
+		binary.BigEndian.PutUint32(buf, v)
+		return recordHeaderSizeV1
+	}
+	binary.BigEndian.PutUint32(buf, v|recordChecksumFlag)
+	binary.BigEndian.PutUint32(buf[recordSizeLen:], recordChecksum(data))
+	return recordHeaderSizeV2
+}
+
+func encodePaddingHeader(buf []byte, recordSize int) {
+	binary.BigEndian.PutUint32(buf, 0)
+	binary.BigEndian.PutUint32(buf[recordSizeLen:], uint32(recordSize))
+}
+
+// decodePaddingSize return the total size of the padding record from the second word of the header.
+func decodePaddingSize(v uint32) (int64, error) {
+	if v < recordPaddingHeaderSize || v > uint32(MAX_POSSIBLE_MSG_SIZE)+recordHeaderSizeV2 {
+		return 0, fmt.Errorf("invalid padding record size (%d)", v)
+	}
+	return int64(v), nil
+}
+
+func checkRecordChecksum(data []byte, sum uint32) error {
+	if recordChecksum(data) != sum {
+		return ErrRecordChecksumMismatch
+	}
+	return nil
+}
+
+// walkRawRecords parse the raw disk queue data and verify the checksum of the record if any,
+// the decompressed record data and the position of the record in raw data will be passed to fn.
+// The padding record of the compacted message is passed to fn with nil data.
+func walkRawRecords(rawData []byte, fn func(pos int, data []byte, recordSize int)) error {
+	pos := 0
+	for pos < len(rawData) {
+		if pos+recordSizeLen > len(rawData) {
+			return fmt.Errorf("invalid raw record header at %v, total %v", pos, len(rawData))
+		}
+		header := binary.BigEndian.Uint32(rawData[pos : pos+recordSizeLen])
+		if header == 0 {
+			if pos+recordPaddingHeaderSize > len(rawData) {
+				return fmt.Errorf("invalid raw padding record at %v, total %v", pos, len(rawData))
+			}
+			psize, err := decodePaddingSize(binary.BigEndian.Uint32(rawData[pos+recordSizeLen : pos+recordPaddingHeaderSize]))
+			if err != nil || pos+int(psize) > len(rawData) {
+				return fmt.Errorf("invalid raw padding record size %v at %v, total %v", psize, pos, len(rawData))
+			}
+			if fn != nil {
+				fn(pos, nil, int(psize))
+			}
+			pos += int(psize)
+			continue
+		}
+		sz, withChecksum, codec := decodeRecordSize(header)
+		hsize := recordHeaderSize(withChecksum)
+		if sz <= 0 || pos+hsize+int(sz) > len(rawData) {
+			return fmt.Errorf("invalid raw record size %v at %v, total %v", sz, pos, len(rawData))
+		}
+		data := rawData[pos+hsize : pos+hsize+int(sz)]
+		if withChecksum {
+			err := checkRecordChecksum(data, binary.BigEndian.Uint32(rawData[pos+recordSizeLen:pos+hsize]))
+			if err != nil {
+				return err
+			}
+		}
+		if fn != nil {
+			data, err := decompressRecord(codec, data)
+			if err != nil {
+				return err
+			}
+			fn(pos, data, hsize+int(sz))
+		}
+		pos += hsize + int(sz)
+	}
+	return nil
+}
@@ -0,0 +1,443 @@
+package nsqd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+)
+
+// The sparse time index keep the timestamp of the first message of each segment and the
+// message written after every interval since the last indexed, so seeking to a timestamp
+// can be done by binary search in the index and a few reads of the data.
+// The entries are kept in a file next to each segment data file, each entry is
+// [8-bytes timestamp][8-bytes virtual offset][8-bytes message count before the message].
+// Since the index entry is written before the data is flushed, the entries beyond the write
+// end will be ignored while loading, and the index of the segment will be rebuilt from
+// the data if the index file is missing.
+const (
+	timeIndexEntrySize          = 24
+	timeIndexFileSuffix         = ".timeindex"
+	defaultTimeIndexInterval    = time.Second * 10
+	timeIndexRebuildReadBufSize = 1024 * 1024
+)
+
+var ErrTimeIndexNotAvailable = errors.New("time index not available")
+
+type timeIndexEntry struct {
+	Timestamp int64
+	Offset    BackendOffset
+	// the total message count before this message
+	TotalCnt int64
+}
+
+type timeIndexSegment struct {
+	fileNum int64
+	entries []timeIndexEntry
+}
+
+type diskQueueTimeIndex struct {
+	interval int64
+	readOnly bool
+	// ordered by the file num, the segment without any entry will be removed
+	segments []*timeIndexSegment
+	file     *os.File
+	fileNum  int64
+	buf      [timeIndexEntrySize]byte
+}
+
+func newDiskQueueTimeIndex(interval time.Duration, readOnly bool) *diskQueueTimeIndex {
+	return &diskQueueTimeIndex{
+		interval: int64(interval),
+		readOnly: readOnly,
+		fileNum:  -1,
+	}
+}
+
+func timeIndexFileName(dataFileName string) string {
+	return dataFileName + timeIndexFileSuffix
+}
+
+func encodeTimeIndexEntry(buf []byte, e timeIndexEntry) {
+	binary.BigEndian.PutUint64(buf[:8], uint64(e.Timestamp))
+	binary.BigEndian.PutUint64(buf[8:16], uint64(e.Offset))
+	binary.BigEndian.PutUint64(buf[16:24], uint64(e.TotalCnt))
+}
+
+func readTimeIndexFile(fileName string) ([]timeIndexEntry, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	// ignore the partial entry at the end
+	entries := make([]timeIndexEntry, 0, len(data)/timeIndexEntrySize)
+	for pos := 0; pos+timeIndexEntrySize <= len(data); pos += timeIndexEntrySize {
+		entries = append(entries, timeIndexEntry{
+			Timestamp: int64(binary.BigEndian.Uint64(data[pos : pos+8])),
+			Offset:    BackendOffset(binary.BigEndian.Uint64(data[pos+8 : pos+16])),
+			TotalCnt:  int64(binary.BigEndian.Uint64(data[pos+16 : pos+24])),
+		})
+	}
+	return entries, nil
+}
+
+func writeTimeIndexFile(fileName string, entries []timeIndexEntry) error {
+	data := make([]byte, len(entries)*timeIndexEntrySize)
+	for i, e := range entries {
+		encodeTimeIndexEntry(data[i*timeIndexEntrySize:], e)
+	}
+	return ioutil.WriteFile(fileName, data, 0644)
+}
+
+// scanRecordTimestamps read the records of the segment data file from pos to the endPos (or the end of file
+// if endPos is negative), the message timestamp and the position of each record will be passed to fn.
+// The padding record of the compacted message is passed to fn with the negative timestamp.
+func scanRecordTimestamps(fileName string, pos int64, endPos int64, fn func(pos int64, ts int64)) error {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if pos > 0 {
+		_, err = f.Seek(pos, 0)
+		if err != nil {
+			return err
+		}
+	}
+	r := bufio.NewReaderSize(f, timeIndexRebuildReadBufSize)
+	var header [recordHeaderSizeV2]byte
+	for endPos < 0 || pos < endPos {
+		_, err = io.ReadFull(r, header[:recordSizeLen])
+		if err != nil {
+			break
+		}
+		if binary.BigEndian.Uint32(header[:recordSizeLen]) == 0 {
+			// skip the padding record of the compacted message
+			_, err = io.ReadFull(r, header[recordSizeLen:recordPaddingHeaderSize])
+			if err != nil {
+				break
+			}
+			var psize int64
+			psize, err = decodePaddingSize(binary.BigEndian.Uint32(header[recordSizeLen:recordPaddingHeaderSize]))
+			if err != nil {
+				return err
+			}
+			_, err = r.Discard(int(psize - recordPaddingHeaderSize))
+			if err != nil {
+				break
+			}
+			fn(pos, -1)
+			pos += psize
+			continue
+		}
+		sz, withChecksum, codec := decodeRecordSize(binary.BigEndian.Uint32(header[:recordSizeLen]))
+		hsize := recordHeaderSize(withChecksum)
+		if hsize > recordSizeLen {
+			_, err = io.ReadFull(r, header[recordSizeLen:hsize])
+			if err != nil {
+				break
+			}
+		}
+		if sz <= 0 {
+			return errInvalidMetaFileData
+		}
+		var tsBuf []byte
+		if codec == CompressNone && sz >= 8 {
+			tsBuf, err = r.Peek(8)
+			if err == nil {
+				fn(pos, int64(binary.BigEndian.Uint64(tsBuf)))
+			}
+			_, err = r.Discard(int(sz))
+		} else {
+			data := make([]byte, sz)
+			_, err = io.ReadFull(r, data)
+			if err == nil {
+				tsBuf, err = decompressRecord(codec, data)
+				if err == nil && len(tsBuf) >= 8 {
+					fn(pos, int64(binary.BigEndian.Uint64(tsBuf)))
+				}
+			}
+		}
+		if err != nil {
+			break
+		}
+		pos += int64(hsize) + int64(sz)
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		// the partial record at the end of the file is not flushed
+		return nil
+	}
+	return err
+}
+
+// needIndex check whether the message should be indexed, the first message of each segment is always indexed.
+func (idx *diskQueueTimeIndex) needIndex(fileNum int64, ts int64) bool {
+	if len(idx.segments) == 0 {
+		return true
+	}
+	seg := idx.segments[len(idx.segments)-1]
+	if seg.fileNum != fileNum {
+		return true
+	}
+	return ts >= seg.entries[len(seg.entries)-1].Timestamp+idx.interval
+}
+
+func (idx *diskQueueTimeIndex) appendEntry(fileNum int64, e timeIndexEntry) {
+	var seg *timeIndexSegment
+	if len(idx.segments) > 0 && idx.segments[len(idx.segments)-1].fileNum == fileNum {
+		seg = idx.segments[len(idx.segments)-1]
+	} else {
+		seg = &timeIndexSegment{fileNum: fileNum}
+		idx.segments = append(idx.segments, seg)
+	}
+	seg.entries = append(seg.entries, e)
+}
+
+// add the message written to the segment, the entry will be appended to the index file if needed.
+func (idx *diskQueueTimeIndex) add(dataFileName string, fileNum int64, e timeIndexEntry) {
+	if !idx.needIndex(fileNum, e.Timestamp) {
+		return
+	}
+	idx.appendEntry(fileNum, e)
+	if idx.readOnly {
+		return
+	}
+	if idx.file == nil || idx.fileNum != fileNum {
+		idx.closeFile()
+		f, err := os.OpenFile(timeIndexFileName(dataFileName), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			nsqLog.LogErrorf("failed to open time index file %v: %v", dataFileName, err)
+			return
+		}
+		idx.file = f
+		idx.fileNum = fileNum
+	}
+	encodeTimeIndexEntry(idx.buf[:], e)
+	_, err := idx.file.Write(idx.buf[:])
+	if err != nil {
+		nsqLog.LogErrorf("failed to write time index file %v: %v", dataFileName, err)
+		idx.closeFile()
+	}
+}
+
+func (idx *diskQueueTimeIndex) closeFile() {
+	if idx.file != nil {
+		idx.file.Close()
+		idx.file = nil
+	}
+	idx.fileNum = -1
+}
+
+func (idx *diskQueueTimeIndex) reset() {
+	idx.closeFile()
+	idx.segments = nil
+}
+
+// truncate remove the entries at or after the end, the index files will be truncated too.
+func (idx *diskQueueTimeIndex) truncate(end BackendOffset, fileName func(int64) string) {
+	for len(idx.segments) > 0 {
+		seg := idx.segments[len(idx.segments)-1]
+		n := sort.Search(len(seg.entries), func(i int) bool {
+			return seg.entries[i].Offset >= end
+		})
+		if n == len(seg.entries) {
+			return
+		}
+		if idx.fileNum == seg.fileNum {
+			idx.closeFile()
+		}
+		seg.entries = seg.entries[:n]
+		fn := timeIndexFileName(fileName(seg.fileNum))
+		if n == 0 {
+			idx.segments = idx.segments[:len(idx.segments)-1]
+			if !idx.readOnly {
+				os.Remove(fn)
+			}
+			continue
+		}
+		if !idx.readOnly {
+			err := os.Truncate(fn, int64(n*timeIndexEntrySize))
+			if err != nil && !os.IsNotExist(err) {
+				nsqLog.LogErrorf("failed to truncate time index file %v: %v", fn, err)
+			}
+		}
+		return
+	}
+}
+
+// trimBefore remove the entries before the start, the index files of the cleaned segments
+// should be removed with the data files.
+func (idx *diskQueueTimeIndex) trimBefore(start BackendOffset) {
+	for len(idx.segments) > 0 {
+		seg := idx.segments[0]
+		n := sort.Search(len(seg.entries), func(i int) bool {
+			return seg.entries[i].Offset >= start
+		})
+		if n < len(seg.entries) {
+			seg.entries = seg.entries[n:]
+			return
+		}
+		idx.segments = idx.segments[1:]
+	}
+}
+
+// search return the last indexed entry with the timestamp less than the given, false will
+// be returned if there is no such entry.
+func (idx *diskQueueTimeIndex) search(ts int64) (timeIndexEntry, bool) {
+	i := sort.Search(len(idx.segments), func(i int) bool {
+		return idx.segments[i].entries[0].Timestamp >= ts
+	})
+	if i == 0 {
+		return timeIndexEntry{}, false
+	}
+	seg := idx.segments[i-1]
+	j := sort.Search(len(seg.entries), func(j int) bool {
+		return seg.entries[j].Timestamp >= ts
+	})
+	return seg.entries[j-1], true
+}
+
+func (idx *diskQueueTimeIndex) entryCount() int {
+	cnt := 0
+	for _, seg := range idx.segments {
+		cnt += len(seg.entries)
+	}
+	return cnt
+}
+
+// loadTimeIndex load the index of all the segments from the queue start to the write end, the
+// index will be rebuilt from the data for the segment without the index file.
+func (d *diskQueueWriter) loadTimeIndex() {
+	idx := d.timeIndex
+	idx.reset()
+	start := d.diskQueueStart
+	end := d.diskWriteEnd
+	s := time.Now()
+	rebuilt := 0
+	// the start of the segment
+	segStart := start
+	for fileNum := start.EndOffset.FileNum; fileNum <= end.EndOffset.FileNum; fileNum++ {
+		if fileNum == end.EndOffset.FileNum && end.EndOffset.Pos == 0 {
+			break
+		}
+		dataFileName := d.fileName(fileNum)
+		if fileNum > start.EndOffset.FileNum {
+			cnt, _, endPos, err := getQueueFileOffsetMeta(d.fileName(fileNum - 1))
+			if err != nil {
+				segStart.EndOffset.FileNum = -1
+			} else {
+				segStart.EndOffset.FileNum = fileNum
+				segStart.EndOffset.Pos = 0
+				segStart.virtualEnd = BackendOffset(endPos)
+				segStart.totalMsgCnt = cnt
+			}
+		}
+		entries, err := readTimeIndexFile(timeIndexFileName(dataFileName))
+		if err == nil {
+			for _, e := range entries {
+				if e.Offset < start.Offset() || e.Offset >= end.Offset() {
+					continue
+				}
+				idx.appendEntry(fileNum, e)
+			}
+			continue
+		}
+		if segStart.EndOffset.FileNum != fileNum {
+			nsqLog.LogWarningf("diskqueue(%s) can not rebuild time index for segment %v since the start unknown",
+				d.name, fileNum)
+			continue
+		}
+		endPos := int64(-1)
+		if fileNum == end.EndOffset.FileNum {
+			endPos = end.EndOffset.Pos
+		}
+		virtualStart := segStart.Offset() - BackendOffset(segStart.EndOffset.Pos)
+		cnt := segStart.TotalMsgCnt()
+		var rebuiltEntries []timeIndexEntry
+		err = scanRecordTimestamps(dataFileName, segStart.EndOffset.Pos, endPos, func(pos int64, ts int64) {
+			if ts >= 0 && idx.needIndex(fileNum, ts) {
+				e := timeIndexEntry{Timestamp: ts, Offset: virtualStart + BackendOffset(pos), TotalCnt: cnt}
+				idx.appendEntry(fileNum, e)
+				rebuiltEntries = append(rebuiltEntries, e)
+			}
+			cnt++
+		})
+		if err != nil && !os.IsNotExist(err) {
+			nsqLog.LogWarningf("diskqueue(%s) failed to rebuild time index for segment %v: %v", d.name, fileNum, err)
+		}
+		if err == nil && !idx.readOnly {
+			err = writeTimeIndexFile(timeIndexFileName(dataFileName), rebuiltEntries)
+			if err != nil {
+				nsqLog.LogWarningf("diskqueue(%s) failed to save time index for segment %v: %v", d.name, fileNum, err)
+			}
+		}
+		rebuilt++
+	}
+	nsqLog.Logf("diskqueue(%s) time index loaded, entries: %v, rebuilt segments: %v, cost: %v",
+		d.name, idx.entryCount(), rebuilt, time.Since(s))
+}
+
+// SetTimeIndexInterval enable the time index with the interval, the index will be loaded or rebuilt
+// from the data. Zero interval will disable the index.
+func (d *diskQueueWriter) SetTimeIndexInterval(interval time.Duration) {
+	d.Lock()
+	defer d.Unlock()
+	if d.timeIndex != nil {
+		d.timeIndex.reset()
+		d.timeIndex = nil
+	}
+	if interval <= 0 {
+		return
+	}
+	d.timeIndex = newDiskQueueTimeIndex(interval, d.readOnly)
+	d.loadTimeIndex()
+}
+
+// SearchTimeIndex return the position of the last indexed message with the timestamp (in nanoseconds)
+// less than the given, and the message count before the position. The queue start will be returned if
+// no indexed message is less than the timestamp. The messages with the timestamp not less than the given
+// should be read from the returned position.
+func (d *diskQueueWriter) SearchTimeIndex(ts int64) (BackendOffset, int64, error) {
+	d.RLock()
+	defer d.RUnlock()
+	if d.timeIndex == nil || len(d.timeIndex.segments) == 0 {
+		return 0, 0, ErrTimeIndexNotAvailable
+	}
+	e, ok := d.timeIndex.search(ts)
+	if !ok {
+		return d.diskQueueStart.Offset(), d.diskQueueStart.TotalMsgCnt(), nil
+	}
+	return e.Offset, e.TotalCnt, nil
+}
+
+func (d *diskQueueWriter) updateTimeIndex(data []byte, isRaw bool, fileNum int64,
+	offset BackendOffset, totalCnt int64) {
+	if d.timeIndex == nil {
+		return
+	}
+	dataFileName := d.fileName(fileNum)
+	if !isRaw {
+		if len(data) >= 8 {
+			d.timeIndex.add(dataFileName, fileNum, timeIndexEntry{
+				Timestamp: int64(binary.BigEndian.Uint64(data[:8])),
+				Offset:    offset,
+				TotalCnt:  totalCnt,
+			})
+		}
+		return
+	}
+	walkRawRecords(data, func(pos int, msgData []byte, recordSize int) {
+		if len(msgData) >= 8 {
+			d.timeIndex.add(dataFileName, fileNum, timeIndexEntry{
+				Timestamp: int64(binary.BigEndian.Uint64(msgData[:8])),
+				Offset:    offset + BackendOffset(pos),
+				TotalCnt:  totalCnt,
+			})
+		}
+		totalCnt++
+	})
+}
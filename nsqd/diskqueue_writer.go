@@ -2,7 +2,6 @@ package nsqd
 
 import (
 	"bufio"
-	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -66,6 +65,21 @@ type diskQueueWriter struct {
 	maxMsgSize      int32
 	exitFlag        int32
 	needSync        bool
+	readOnly        bool
+	// write the record with the crc32c checksum
+	withChecksum bool
+	headerBuf    [recordHeaderSizeV2]byte
+	codec        CompressCodec
+	compressBuf  []byte
+	encryptBuf   []byte
+	// keep the encoded records written while capturing, so the leader can
+	// replicate the same bytes to the replicas
+	capturing  bool
+	rawCapture []byte
+	// the sparse time index, nil if disabled
+	timeIndex *diskQueueTimeIndex
+	// the cleaned segments will be uploaded to archive before removed, nil if disabled
+	archive *diskQueueArchive
 
 	writeFile     *os.File
 	bufferWriter  *bufio.Writer
@@ -105,6 +119,7 @@ func newDiskQueueWriter(name string, dataPath string, maxBytesPerFile int64,
 		maxBytesPerFile: maxBytesPerFile,
 		minMsgSize:      minMsgSize,
 		maxMsgSize:      maxMsgSize,
+		readOnly:        readOnly,
 	}
 
 	// no need to lock here, nothing else could possibly be touching this instance
@@ -176,6 +191,67 @@ func (d *diskQueueWriter) SetBufSize(s int64) {
 	atomic.StoreInt64(&d.bufSize, s)
 }
 
+// SetRecordChecksum change the format of the new written records. It only takes effect on
+// the leader since the replicas write the same records as the leader.
+func (d *diskQueueWriter) SetRecordChecksum(enable bool) {
+	d.Lock()
+	d.withChecksum = enable
+	d.Unlock()
+}
+
+// SetCompressCodec change the compression of the new written records, the records
+// are compressed one by one so the offset can still address each message. The replicas
+// write the compressed records from the leader without re-compressing.
+func (d *diskQueueWriter) SetCompressCodec(codec CompressCodec) {
+	d.Lock()
+	if d.codec != codec {
+		nsqLog.Logf("DISKQUEUE(%s): compression changed from %v to %v", d.name, d.codec, codec)
+	}
+	d.codec = codec
+	d.Unlock()
+}
+
+// NeedRawReplicate return true if the replicas should write the same encoded records as
+// the leader, since the compressed output, the encrypted output and the record format may
+// differ between the nodes.
+func (d *diskQueueWriter) NeedRawReplicate() bool {
+	d.RLock()
+	defer d.RUnlock()
+	return d.codec != CompressNone || d.withChecksum || GetEncryptKeyring() != nil
+}
+
+// StartRawCapture begin to keep the encoded records written, should be stopped by StopRawCapture.
+func (d *diskQueueWriter) StartRawCapture() {
+	d.Lock()
+	d.capturing = true
+	d.rawCapture = nil
+	d.Unlock()
+}
+
+// StopRawCapture stop the capture and return the records written since started.
+func (d *diskQueueWriter) StopRawCapture() []byte {
+	d.Lock()
+	raw := d.rawCapture
+	d.capturing = false
+	d.rawCapture = nil
+	d.Unlock()
+	return raw
+}
+
+func (d *diskQueueWriter) GetCompressCodec() CompressCodec {
+	d.RLock()
+	c := d.codec
+	d.RUnlock()
+	return c
+}
+
+func (d *diskQueueWriter) RecordHeaderSize() int64 {
+	d.RLock()
+	s := recordHeaderSize(d.withChecksum)
+	d.RUnlock()
+	return int64(s)
+}
+
 func (d *diskQueueWriter) PutV2(data []byte) (BackendOffset, int32, diskQueueEndInfo, error) {
 	d.Lock()
 
@@ -397,12 +473,25 @@ func (d *diskQueueWriter) prepareCleanByRetention(cleanEndInfo BackendQueueOffse
 		cleanStartFileNum = 0
 	}
 	d.diskQueueStart = newStart
+	if d.timeIndex != nil {
+		d.timeIndex.trimBefore(newStart.Offset())
+	}
 	d.saveExtraMeta()
 	return &newStart, cleanStartFileNum, cleanFileNum, nil
 }
 
 func (d *diskQueueWriter) CleanOldDataByRetention(cleanEndInfo BackendQueueOffset,
 	noRealClean bool, maxCleanOffset BackendOffset) (BackendQueueEnd, error) {
+	d.RLock()
+	archive := d.archive
+	d.RUnlock()
+	if archive != nil && !noRealClean {
+		var err error
+		cleanEndInfo, err = d.archiveBeforeClean(archive, cleanEndInfo, maxCleanOffset)
+		if err != nil {
+			return nil, err
+		}
+	}
 	newStart, cleanStartFileNum, cleanFileNum, err := d.prepareCleanByRetention(cleanEndInfo, noRealClean, maxCleanOffset)
 	if err != nil {
 		return nil, err
@@ -419,6 +508,7 @@ func (d *diskQueueWriter) CleanOldDataByRetention(cleanEndInfo BackendQueueOffse
 		} else {
 			nsqLog.Logf("DISKQUEUE(%s): removed data file: %v", d.name, fn)
 		}
+		os.Remove(timeIndexFileName(fn))
 
 		//remove queue meta file
 		if i <= cleanMetaFileNum {
@@ -437,6 +527,57 @@ func (d *diskQueueWriter) CleanOldDataByRetention(cleanEndInfo BackendQueueOffse
 	return newStart, nil
 }
 
+// archiveBeforeClean make sure the segments to be cleaned are in the archive before the queue start
+// is moved, the clean end will be limited to the first segment failed to archive, so the cleaned
+// data can always be read back from the archive and the failed will be retried in the next clean.
+func (d *diskQueueWriter) archiveBeforeClean(archive *diskQueueArchive, cleanEndInfo BackendQueueOffset,
+	maxCleanOffset BackendOffset) (BackendQueueOffset, error) {
+	planned, _, _, err := d.prepareCleanByRetention(cleanEndInfo, true, maxCleanOffset)
+	if err != nil || planned == nil {
+		return cleanEndInfo, err
+	}
+	plannedStart := planned.(*diskQueueEndInfo)
+	d.RLock()
+	startFileNum := d.diskQueueStart.EndOffset.FileNum
+	d.RUnlock()
+	for i := startFileNum; i < plannedStart.EndOffset.FileNum; i++ {
+		fn := d.fileName(i)
+		if _, err := os.Stat(fn); err != nil {
+			continue
+		}
+		err := archive.ensureSegmentArchived(i, fn, d.fileName(i-1))
+		// the segment without the offset meta can not be located in the archive, so it is removed as before
+		if err == nil || os.IsNotExist(err) {
+			continue
+		}
+		nsqLog.LogErrorf("diskqueue(%s) failed to archive data file %v - %s", d.name, fn, err)
+		if i == startFileNum {
+			return nil, err
+		}
+		cnt, _, end, err := getQueueFileOffsetMeta(d.fileName(i - 1))
+		if err != nil {
+			return nil, err
+		}
+		var limited diskQueueEndInfo
+		limited.EndOffset.FileNum = i
+		limited.virtualEnd = BackendOffset(end)
+		limited.totalMsgCnt = cnt
+		nsqLog.Logf("DISKQUEUE(%s): clean end limited to the archived: %v", d.name, limited)
+		return &limited, nil
+	}
+	return cleanEndInfo, nil
+}
+
+// SetArchive enable the tiered storage, the cleaned segments will be uploaded to the archive
+func (d *diskQueueWriter) SetArchive(archive *diskQueueArchive) {
+	d.Lock()
+	d.archive = archive
+	if archive != nil {
+		archive.setLocalStart(d.diskQueueStart)
+	}
+	d.Unlock()
+}
+
 func (d *diskQueueWriter) closeCurrentFile() {
 	if d.bufferWriter != nil {
 		d.bufferWriter.Flush()
@@ -468,6 +609,9 @@ func (d *diskQueueWriter) truncateDiskQueueToWriteEnd() {
 		}
 	}
 	d.persistMetaData(true, d.diskWriteEnd)
+	if d.timeIndex != nil {
+		d.timeIndex.truncate(d.diskWriteEnd.Offset(), d.fileName)
+	}
 	cleanNum := d.diskWriteEnd.EndOffset.FileNum + 1
 	for {
 		fileName := d.fileName(cleanNum)
@@ -598,6 +742,9 @@ func (d *diskQueueWriter) RemoveTo(destPath string) error {
 	d.syncAll(true)
 	d.closeCurrentFile()
 	d.saveFileOffsetMeta()
+	if d.timeIndex != nil {
+		d.timeIndex.reset()
+	}
 	for i := int64(0); i <= d.diskWriteEnd.EndOffset.FileNum; i++ {
 		fn := d.fileName(i)
 		destFile := GetQueueFileName(destPath, d.name, i)
@@ -612,6 +759,7 @@ func (d *diskQueueWriter) RemoveTo(destPath string) error {
 		if innerErr != nil && !os.IsNotExist(innerErr) {
 			nsqLog.LogErrorf("diskqueue(%s) failed to remove offset meta file %v - %s", d.name, fName, innerErr)
 		}
+		util.AtomicRename(timeIndexFileName(fn), timeIndexFileName(destFile))
 	}
 	d.diskWriteEnd.EndOffset.FileNum++
 	d.diskWriteEnd.EndOffset.Pos = 0
@@ -641,6 +789,9 @@ func (d *diskQueueWriter) exit(deleted bool) error {
 	}
 
 	d.syncAll(true)
+	if d.timeIndex != nil {
+		d.timeIndex.closeFile()
+	}
 	if deleted {
 		return d.deleteAllFiles(deleted)
 	}
@@ -681,6 +832,9 @@ func (d *diskQueueWriter) deleteAllFiles(deleted bool) error {
 func (d *diskQueueWriter) cleanOldData() error {
 	d.closeCurrentFile()
 	d.saveFileOffsetMeta()
+	if d.timeIndex != nil {
+		d.timeIndex.reset()
+	}
 	cleanStartFileNum := d.diskQueueStart.EndOffset.FileNum - MAX_QUEUE_OFFSET_META_DATA_KEEP - 1
 	if cleanStartFileNum < 0 {
 		cleanStartFileNum = 0
@@ -698,6 +852,7 @@ func (d *diskQueueWriter) cleanOldData() error {
 			if innerErr != nil && !os.IsNotExist(innerErr) {
 				nsqLog.LogErrorf("diskqueue(%s) failed to remove offset meta file %v - %s", d.name, fName, innerErr)
 			}
+			os.Remove(timeIndexFileName(fn))
 		}
 	}
 
@@ -788,12 +943,33 @@ func (d *diskQueueWriter) writeOne(data []byte, isRaw bool, msgCnt int32) (Backe
 
 	d.needSync = true
 	dataLen := int32(len(data))
+	origData := data
+	hsize := 0
 	if !isRaw {
 		if dataLen < d.minMsgSize || dataLen > d.maxMsgSize {
 			return 0, 0, nil, fmt.Errorf("invalid message write size (%d) maxMsgSize=%d", dataLen, d.maxMsgSize)
 		}
+		codec := CompressNone
+		if d.codec != CompressNone {
+			data, codec = compressRecord(d.codec, data, d.compressBuf)
+			if codec != CompressNone {
+				d.compressBuf = data[:0]
+			}
+			dataLen = int32(len(data))
+		}
+		if kr := GetEncryptKeyring(); kr != nil {
+			data, err = encryptRecord(kr, codec, data, d.encryptBuf)
+			if err != nil {
+				nsqLog.LogErrorf("DISKQUEUE(%s): writeOne() encrypt failed %s", d.name, err)
+				return 0, 0, nil, err
+			}
+			d.encryptBuf = data[:0]
+			codec = recordCodecEncrypted
+			dataLen = int32(len(data))
+		}
 
-		err = binary.Write(d.bufferWriter, binary.BigEndian, dataLen)
+		hsize = encodeRecordHeader(d.headerBuf[:], data, d.withChecksum, codec)
+		_, err = d.bufferWriter.Write(d.headerBuf[:hsize])
 		if err != nil {
 			d.sync(true, false)
 			if d.writeFile != nil {
@@ -814,11 +990,16 @@ func (d *diskQueueWriter) writeOne(data []byte, isRaw bool, msgCnt int32) (Backe
 		nsqLog.Logf("DISKQUEUE(%s): writeOne() faled %s", d.name, err)
 		return 0, 0, nil, err
 	}
+	if d.capturing && !isRaw {
+		d.rawCapture = append(d.rawCapture, d.headerBuf[:hsize]...)
+		d.rawCapture = append(d.rawCapture, data...)
+	}
 
 	writeOffset := d.diskWriteEnd.Offset()
+	d.updateTimeIndex(origData, isRaw, d.diskWriteEnd.EndOffset.FileNum, writeOffset, d.diskWriteEnd.TotalMsgCnt())
 	totalBytes := int64(dataLen)
 	if !isRaw {
-		totalBytes += 4
+		totalBytes += int64(recordHeaderSize(d.withChecksum))
 	}
 	d.diskWriteEnd.EndOffset.Pos += totalBytes
 	d.diskWriteEnd.virtualEnd += BackendOffset(totalBytes)
@@ -1025,6 +1206,9 @@ func (d *diskQueueWriter) saveExtraMeta() error {
 	fileName := d.extraMetaFileName()
 	tmpFileName := fmt.Sprintf("%s.%d.tmp", fileName, rand.Int())
 
+	if d.archive != nil {
+		d.archive.setLocalStart(d.diskQueueStart)
+	}
 	var tmp extraMeta
 	tmp.SegOffset = d.diskQueueStart.EndOffset
 	tmp.VirtualOffset = d.diskQueueStart.Offset()
@@ -2,6 +2,7 @@ package nsqd
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -1011,3 +1012,106 @@ func benchmarkDiskQueueReaderGet(size int64, b *testing.B) {
 		dqReader.TryReadOne()
 	}
 }
+
+func TestDiskQueueWriterTimeIndex(t *testing.T) {
+	dqName := "test_disk_queue_time_index" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	// each record is 20 bytes, so 5 records in each segment
+	recordSize := int64(20)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 100, 4, 1<<10, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	dqWriter.SetTimeIndexInterval(10)
+	// the message with the timestamp i*5
+	putMsg := func(w *diskQueueWriter, i int) {
+		data := make([]byte, 16)
+		binary.BigEndian.PutUint64(data, uint64(i*5))
+		_, _, _, err := w.PutV2(data)
+		test.Nil(t, err)
+	}
+	checkSearch := func(w *diskQueueWriter, ts int64) (BackendOffset, int64) {
+		offset, cnt, err := w.SearchTimeIndex(ts)
+		test.Nil(t, err)
+		test.Equal(t, BackendOffset(cnt*recordSize), offset)
+		start := w.GetQueueReadStart()
+		if cnt > start.TotalMsgCnt() {
+			test.Equal(t, true, cnt*5 < ts)
+		}
+		// the first message not less than ts should be near the searched
+		expected := (ts + 4) / 5
+		if expected > w.GetQueueWriteEnd().TotalMsgCnt() {
+			expected = w.GetQueueWriteEnd().TotalMsgCnt()
+		}
+		if expected > start.TotalMsgCnt() {
+			test.Equal(t, true, cnt <= expected && expected-cnt <= 2)
+		}
+		return offset, cnt
+	}
+	msgNum := 30
+	for i := 0; i < msgNum; i++ {
+		putMsg(dqWriter, i)
+	}
+	dqWriter.Flush(false)
+	offset, cnt := checkSearch(dqWriter, 0)
+	test.Equal(t, BackendOffset(0), offset)
+	test.Equal(t, int64(0), cnt)
+	searchTs := []int64{1, 12, 24, 26, 50, 148}
+	for _, ts := range searchTs {
+		checkSearch(dqWriter, ts)
+	}
+	_, cnt = checkSearch(dqWriter, 1000)
+	test.Equal(t, true, cnt >= int64(msgNum-2))
+	for i := int64(0); i < 6; i++ {
+		_, err := os.Stat(timeIndexFileName(dqWriter.fileName(i)))
+		test.Nil(t, err)
+	}
+
+	// the entries after the write end should be removed while truncating
+	_, err = dqWriter.ResetWriteEndV2(BackendOffset(22*recordSize), 22)
+	test.Nil(t, err)
+	_, cnt = checkSearch(dqWriter, 1000)
+	test.Equal(t, true, cnt < 22)
+	for i := 22; i < msgNum; i++ {
+		putMsg(dqWriter, i)
+	}
+	dqWriter.Flush(false)
+	results := make(map[int64]int64)
+	for _, ts := range append(searchTs, 1000) {
+		_, cnt = checkSearch(dqWriter, ts)
+		results[ts] = cnt
+	}
+	dqWriter.Close()
+
+	// the index should be rebuilt from the data if the index files are missing
+	for i := int64(0); i < 6; i++ {
+		os.Remove(timeIndexFileName(dqWriter.fileName(i)))
+	}
+	queue, err = NewDiskQueueWriter(dqName, tmpDir, 100, 4, 1<<10, 1)
+	test.Nil(t, err)
+	dqWriter = queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+	dqWriter.SetTimeIndexInterval(10)
+	for ts, cnt := range results {
+		_, newCnt := checkSearch(dqWriter, ts)
+		test.Equal(t, cnt, newCnt)
+	}
+	for i := int64(0); i < 6; i++ {
+		_, err := os.Stat(timeIndexFileName(dqWriter.fileName(i)))
+		test.Nil(t, err)
+	}
+
+	// the index of the cleaned segments should be removed
+	newStart, err := dqWriter.CleanOldDataByRetention(&customeOffset{12 * recordSize}, false, 0)
+	test.Nil(t, err)
+	test.Equal(t, int64(10), newStart.TotalMsgCnt())
+	for i := int64(0); i < 2; i++ {
+		_, err := os.Stat(timeIndexFileName(dqWriter.fileName(i)))
+		test.Equal(t, true, os.IsNotExist(err))
+	}
+	offset, cnt = checkSearch(dqWriter, 1)
+	test.Equal(t, newStart.Offset(), offset)
+	test.Equal(t, int64(10), cnt)
+	_, cnt = checkSearch(dqWriter, 57)
+	test.Equal(t, int64(10), cnt)
+}
@@ -0,0 +1,184 @@
+package nsqd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// The sealed data is [4-bytes key id][12-bytes nonce][ciphertext][16-bytes tag], the key id
+// is kept with the data so the old data can still be decrypted after the active key rotated.
+const (
+	EncryptKeyIDLen    = 4
+	EncryptNonceLen    = 12
+	EncryptTagLen      = 16
+	EncryptSealHeadLen = EncryptKeyIDLen + EncryptNonceLen
+	EncryptOverhead    = EncryptSealHeadLen + EncryptTagLen
+)
+
+var (
+	ErrEncryptKeyNotFound      = errors.New("encrypt key not found in keyring")
+	ErrEncryptDataInvalid      = errors.New("encrypted data invalid")
+	ErrEncryptKeyringNotLoaded = errors.New("encrypted data found but the keyring is not loaded")
+
+	encryptKeyring atomic.Value
+)
+
+// EncryptKeyring hold all the AES-GCM keys by the key id, the new data will be encrypted
+// using the active key and the old keys are only used for decrypting.
+type EncryptKeyring struct {
+	keys     map[uint32]cipher.AEAD
+	activeID uint32
+}
+
+// LoadEncryptKeyring load the keyring file, each line of the file is a key: "<key id> <base64 key>",
+// the key id should be positive and the key should be 16, 24 or 32 bytes for AES-128, AES-192
+// or AES-256, the lines start with # are ignored. The largest key id will be the active key
+// if activeID is 0.
+func LoadEncryptKeyring(fileName string, activeID uint32) (*EncryptKeyring, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return ParseEncryptKeyring(data, activeID)
+}
+
+func ParseEncryptKeyring(data []byte, activeID uint32) (*EncryptKeyring, error) {
+	kr := &EncryptKeyring{
+		keys: make(map[uint32]cipher.AEAD),
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lineNum := 0
+	maxID := uint32(0)
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid keyring line %v", lineNum)
+		}
+		id, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil || id == 0 {
+			return nil, fmt.Errorf("invalid key id at keyring line %v", lineNum)
+		}
+		if _, ok := kr.keys[uint32(id)]; ok {
+			return nil, fmt.Errorf("duplicate key id %v at keyring line %v", id, lineNum)
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid key at keyring line %v: %v", lineNum, err)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key at keyring line %v: %v", lineNum, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		kr.keys[uint32(id)] = aead
+		if uint32(id) > maxID {
+			maxID = uint32(id)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(kr.keys) == 0 {
+		return nil, errors.New("no key found in keyring")
+	}
+	if activeID == 0 {
+		activeID = maxID
+	}
+	if _, ok := kr.keys[activeID]; !ok {
+		return nil, fmt.Errorf("active key %v not found in keyring", activeID)
+	}
+	kr.activeID = activeID
+	return kr, nil
+}
+
+func (kr *EncryptKeyring) ActiveKeyID() uint32 {
+	return kr.activeID
+}
+
+// keyCheckData is sealed with the zero nonce to get the check value of each key, which
+// can be compared between the nodes without exposing the key.
+var keyCheckData = []byte("nsq encrypt keyring check")
+
+// KeyFingerprint return all the key ids with the check value of each key, the nodes with the
+// same keys have the same fingerprint. Empty for the nil keyring.
+func (kr *EncryptKeyring) KeyFingerprint() string {
+	if kr == nil {
+		return ""
+	}
+	ids := make([]int, 0, len(kr.keys))
+	for id := range kr.keys {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+	var nonce [EncryptNonceLen]byte
+	fps := make([]string, 0, len(ids))
+	for _, id := range ids {
+		check := kr.keys[uint32(id)].Seal(nil, nonce[:], nil, keyCheckData)
+		fps = append(fps, fmt.Sprintf("%v:%x", id, check[:8]))
+	}
+	return strings.Join(fps, ",")
+}
+
+// Seal encrypt the data using the active key and append the sealed data to dst.
+func (kr *EncryptKeyring) Seal(dst []byte, data []byte, aad []byte) ([]byte, error) {
+	aead := kr.keys[kr.activeID]
+	var head [EncryptSealHeadLen]byte
+	binary.BigEndian.PutUint32(head[:EncryptKeyIDLen], kr.activeID)
+	_, err := rand.Read(head[EncryptKeyIDLen:])
+	if err != nil {
+		return nil, err
+	}
+	dst = append(dst, head[:]...)
+	return aead.Seal(dst, head[EncryptKeyIDLen:], data, aad), nil
+}
+
+// Open decrypt the sealed data using the key recorded in the data.
+func (kr *EncryptKeyring) Open(sealed []byte, aad []byte) ([]byte, error) {
+	if len(sealed) < EncryptOverhead {
+		return nil, ErrEncryptDataInvalid
+	}
+	aead, ok := kr.keys[binary.BigEndian.Uint32(sealed[:EncryptKeyIDLen])]
+	if !ok {
+		return nil, ErrEncryptKeyNotFound
+	}
+	data, err := aead.Open(nil, sealed[EncryptKeyIDLen:EncryptSealHeadLen], sealed[EncryptSealHeadLen:], aad)
+	if err != nil {
+		return nil, ErrEncryptDataInvalid
+	}
+	return data, nil
+}
+
+// SetEncryptKeyring set the keyring used for all the data on this node, all the data written
+// after this will be encrypted, nil to disable. The replicas write the encrypted records from
+// the leader as is, so the node should have all the keys of the leader before joining the isr.
+func SetEncryptKeyring(kr *EncryptKeyring) {
+	encryptKeyring.Store(&kr)
+}
+
+func GetEncryptKeyring() *EncryptKeyring {
+	kr, ok := encryptKeyring.Load().(**EncryptKeyring)
+	if !ok {
+		return nil
+	}
+	return *kr
+}
@@ -0,0 +1,155 @@
+package nsqd
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/youzan/nsq/internal/test"
+)
+
+func testKeyringData(ids ...int) []byte {
+	var b bytes.Buffer
+	b.WriteString("# test keyring\n\n")
+	for _, id := range ids {
+		key := bytes.Repeat([]byte{byte(id)}, 32)
+		fmt.Fprintf(&b, "%v %v\n", id, base64.StdEncoding.EncodeToString(key))
+	}
+	return b.Bytes()
+}
+
+func TestParseEncryptKeyring(t *testing.T) {
+	kr, err := ParseEncryptKeyring(testKeyringData(1, 3, 2), 0)
+	test.Nil(t, err)
+	test.Equal(t, uint32(3), kr.ActiveKeyID())
+	kr, err = ParseEncryptKeyring(testKeyringData(1, 3, 2), 2)
+	test.Nil(t, err)
+	test.Equal(t, uint32(2), kr.ActiveKeyID())
+
+	_, err = ParseEncryptKeyring(testKeyringData(1, 2), 3)
+	test.NotNil(t, err)
+	_, err = ParseEncryptKeyring(testKeyringData(), 0)
+	test.NotNil(t, err)
+	_, err = ParseEncryptKeyring(testKeyringData(0), 0)
+	test.NotNil(t, err)
+	_, err = ParseEncryptKeyring(testKeyringData(1, 1), 0)
+	test.NotNil(t, err)
+	_, err = ParseEncryptKeyring([]byte("1 "+base64.StdEncoding.EncodeToString([]byte("short"))), 0)
+	test.NotNil(t, err)
+	_, err = ParseEncryptKeyring([]byte("1 not-base64!"), 0)
+	test.NotNil(t, err)
+
+	tmpDir, err := ioutil.TempDir("", "nsq-keyring")
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	fileName := path.Join(tmpDir, "keyring")
+	err = ioutil.WriteFile(fileName, testKeyringData(1, 2), 0600)
+	test.Nil(t, err)
+	kr1, err := LoadEncryptKeyring(fileName, 1)
+	test.Nil(t, err)
+	test.Equal(t, uint32(1), kr1.ActiveKeyID())
+
+	data := []byte("test data")
+	sealed, err := kr1.Seal(nil, data, []byte("aad"))
+	test.Nil(t, err)
+	test.Equal(t, len(data)+EncryptOverhead, len(sealed))
+	test.Equal(t, false, bytes.Contains(sealed, data))
+	plain, err := kr1.Open(sealed, []byte("aad"))
+	test.Nil(t, err)
+	test.Equal(t, data, plain)
+	_, err = kr1.Open(sealed, []byte("other"))
+	test.Equal(t, ErrEncryptDataInvalid, err)
+
+	// the data sealed by the old key can be opened after rotated
+	kr2, err := ParseEncryptKeyring(testKeyringData(1, 2), 0)
+	test.Nil(t, err)
+	plain, err = kr2.Open(sealed, []byte("aad"))
+	test.Nil(t, err)
+	test.Equal(t, data, plain)
+	sealed2, err := kr2.Seal(nil, data, nil)
+	test.Nil(t, err)
+	onlyOld, err := ParseEncryptKeyring(testKeyringData(1), 0)
+	test.Nil(t, err)
+	_, err = onlyOld.Open(sealed2, nil)
+	test.Equal(t, ErrEncryptKeyNotFound, err)
+}
+
+func TestEncryptKeyringFingerprint(t *testing.T) {
+	var empty *EncryptKeyring
+	test.Equal(t, "", empty.KeyFingerprint())
+	kr1, err := ParseEncryptKeyring(testKeyringData(1, 2), 1)
+	test.Nil(t, err)
+	kr2, err := ParseEncryptKeyring(testKeyringData(2, 1), 2)
+	test.Nil(t, err)
+	// the active key is not included since it only affects the new written data
+	test.Equal(t, kr1.KeyFingerprint(), kr2.KeyFingerprint())
+	test.Equal(t, true, strings.HasPrefix(kr1.KeyFingerprint(), "1:"))
+	kr3, err := ParseEncryptKeyring(testKeyringData(1), 0)
+	test.Nil(t, err)
+	test.NotEqual(t, kr1.KeyFingerprint(), kr3.KeyFingerprint())
+	// the same key id with different key
+	other := []byte("1 " + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{9}, 32)) + "\n")
+	kr4, err := ParseEncryptKeyring(other, 0)
+	test.Nil(t, err)
+	test.NotEqual(t, kr3.KeyFingerprint(), kr4.KeyFingerprint())
+}
+
+func TestDelayQueueEncryptStore(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "nsq-test-delay-encrypt")
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	kr, err := ParseEncryptKeyring(testKeyringData(1), 0)
+	test.Nil(t, err)
+	SetEncryptKeyring(kr)
+	defer SetEncryptKeyring(nil)
+
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.SyncEvery = 1
+	dq, err := NewDelayQueue("test", 0, tmpDir, opts, nil, false)
+	test.Nil(t, err)
+	defer dq.Close()
+	body := []byte("secret-delayed-body")
+	cnt := 5
+	for i := 0; i < cnt; i++ {
+		msg := NewMessage(0, body)
+		msg.DelayedType = ChannelDelayed
+		msg.DelayedTs = 1
+		msg.DelayedChannel = "test"
+		msg.DelayedOrigID = MessageID(i + 1)
+		_, _, _, _, err := dq.PutDelayMessage(msg)
+		test.Nil(t, err)
+	}
+	dq.ForceFlush()
+	results := make([]Message, cnt*2)
+	n, err := dq.PeekRecentChannelTimeout(2, results, "test")
+	test.Nil(t, err)
+	test.Equal(t, cnt, n)
+	for i := 0; i < n; i++ {
+		test.Equal(t, body, results[i].Body)
+	}
+	for _, name := range []string{path.Join(dq.dataPath, getDelayQueueDBName(dq.tname, dq.partition)),
+		GetQueueFileName(dq.dataPath, getDelayQueueBackendName(dq.tname, dq.partition), 0)} {
+		data, err := ioutil.ReadFile(name)
+		test.Nil(t, err)
+		test.Equal(t, false, bytes.Contains(data, body))
+	}
+	err = dq.ConfirmedMessage(&results[0])
+	test.Nil(t, err)
+	newCnt, _ := dq.GetCurrentDelayedCnt(ChannelDelayed, "test")
+	test.Equal(t, cnt-1, int(newCnt))
+
+	// the encrypted data can not be read without the keyring
+	SetEncryptKeyring(nil)
+	n, err = dq.PeekRecentChannelTimeout(2, results, "test")
+	test.Nil(t, err)
+	test.Equal(t, 0, n)
+	snap := dq.GetDiskQueueSnapshot()
+	r := snap.ReadOne()
+	test.Equal(t, true, strings.Contains(r.Err.Error(), ErrEncryptKeyringNotLoaded.Error()))
+}
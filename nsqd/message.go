@@ -76,6 +76,8 @@ type Message struct {
 	DelayedChannel string
 	// will be used for delayed pub. (json data to tell different type of delay)
 	DelayedData []byte
+	// the body in the topic segment file if the body is not read into memory
+	rawBody *rawMsgBody
 }
 
 func MessageHeaderBytes() int {
@@ -124,8 +126,14 @@ func (m *Message) IsDeferred() bool {
 
 func (m *Message) GetCopy() *Message {
 	newMsg := *m
-	newMsg.Body = make([]byte, len(m.Body))
-	copy(newMsg.Body, m.Body)
+	body, err := m.GetBody()
+	if err != nil {
+		nsqLog.LogErrorf("failed to load the body of message %v: %v", m.ID, err)
+	} else {
+		newMsg.rawBody = nil
+	}
+	newMsg.Body = make([]byte, len(body))
+	copy(newMsg.Body, body)
 	if m.ExtBytes != nil {
 		newMsg.ExtBytes = make([]byte, len(m.ExtBytes))
 		copy(newMsg.ExtBytes, m.ExtBytes)
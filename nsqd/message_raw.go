@@ -0,0 +1,132 @@
+package nsqd
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"sync/atomic"
+
+	"github.com/youzan/nsq/internal/ext"
+)
+
+// rawMsgBody is the location of the message body in the topic segment file. The channel reads
+// only the message header into memory for the large message if the zero copy is enabled, and
+// the body is sent to the consumer from the segment file directly (sendfile on linux).
+type rawMsgBody struct {
+	fileName string
+	pos      int64
+	size     int64
+}
+
+func (r *rawMsgBody) read() ([]byte, error) {
+	f, err := os.Open(r.fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	b := make([]byte, r.size)
+	_, err = f.ReadAt(b, r.pos)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// messageHeaderLen return the length of the message data before the body, -1 if the data
+// is too short. The message with the ext high bits has the ext header.
+func messageHeaderLen(b []byte) int {
+	if len(b) < minValidMsgLength {
+		return -1
+	}
+	combined := binary.BigEndian.Uint16(b[8:10])
+	if combined <= MaxAttempts || combined&uint16(0xF000) != extMsgHighBits {
+		return minValidMsgLength
+	}
+	if len(b) < minValidMsgLength+1 {
+		return -1
+	}
+	if ext.ExtVer(b[minValidMsgLength]) == ext.NO_EXT_VER {
+		return minValidMsgLength + 1
+	}
+	if len(b) < minValidMsgLength+3 {
+		return -1
+	}
+	extLen := int(binary.BigEndian.Uint16(b[minValidMsgLength+1 : minValidMsgLength+3]))
+	if len(b) < minValidMsgLength+3+extLen {
+		return -1
+	}
+	return minValidMsgLength + 3 + extLen
+}
+
+// HasRawBody return true if the body of the message is not read into memory
+func (m *Message) HasRawBody() bool {
+	return m.rawBody != nil
+}
+
+// BodySize return the size of the message body no matter it is in memory or not
+func (m *Message) BodySize() int64 {
+	if m.rawBody != nil {
+		return m.rawBody.size
+	}
+	return int64(len(m.Body))
+}
+
+// GetBody return the body of the message, the body will be read from the segment file if it
+// is not in memory. The message is not changed so it is safe while the message is in flight.
+func (m *Message) GetBody() ([]byte, error) {
+	if m.rawBody == nil {
+		return m.Body, nil
+	}
+	return m.rawBody.read()
+}
+
+func (c *ClientV2) canSendFile() bool {
+	return c.tlsConn == nil && atomic.LoadInt32(&c.Deflate) == 0 && atomic.LoadInt32(&c.Snappy) == 0
+}
+
+// WriteMessageBody write the message body to the client after the message header. The body not
+// in memory is sent from the segment file, and the buffered data will be flushed before sending
+// by the sendfile if the connection is not encrypted or compressed.
+// The caller should hold the write lock.
+func (c *ClientV2) WriteMessageBody(m *Message) error {
+	r := m.rawBody
+	if r == nil {
+		_, err := c.Writer.Write(m.Body)
+		return err
+	}
+	if c.rawBodyFile == nil || c.rawBodyFile.Name() != r.fileName {
+		if c.rawBodyFile != nil {
+			c.rawBodyFile.Close()
+			c.rawBodyFile = nil
+		}
+		f, err := os.Open(r.fileName)
+		if err != nil {
+			return err
+		}
+		c.rawBodyFile = f
+	}
+	_, err := c.rawBodyFile.Seek(r.pos, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	lr := &io.LimitedReader{R: c.rawBodyFile, N: r.size}
+	var n int64
+	if c.canSendFile() {
+		err = c.Writer.Flush()
+		if err != nil {
+			return err
+		}
+		// the tcp connection will use sendfile for the limited file reader
+		n, err = io.Copy(c.Conn, lr)
+	} else {
+		n, err = io.Copy(c.Writer, lr)
+	}
+	if err != nil {
+		return err
+	}
+	if n != r.size {
+		return io.ErrUnexpectedEOF
+	}
+	atomic.AddUint64(&c.ZeroCopyCount, 1)
+	return nil
+}
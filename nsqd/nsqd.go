@@ -147,6 +147,36 @@ func New(opts *Options) *NSQD {
 		nsqLog.LogErrorf("FATAL: --worker-id must be [0,%d)", MAX_NODE_ID)
 		os.Exit(1)
 	}
+	if opts.DelayQueueEngine != DelayQueueEngineBolt && opts.DelayQueueEngine != DelayQueueEngineWheel {
+		nsqLog.LogErrorf("FATAL: --delay-queue-engine must be %v or %v", DelayQueueEngineBolt, DelayQueueEngineWheel)
+		os.Exit(1)
+	}
+	if opts.ZeroCopyMinSize < 0 {
+		nsqLog.LogErrorf("FATAL: --zero-copy-min-size must be non-negative")
+		os.Exit(1)
+	}
+	if opts.CatchupRateLimit < 0 || opts.CatchupTopicRateLimit < 0 {
+		nsqLog.LogErrorf("FATAL: --catchup-rate-limit and --catchup-topic-rate-limit must be non-negative")
+		os.Exit(1)
+	}
+	if opts.EncryptKeyringFile != "" {
+		kr, err := LoadEncryptKeyring(opts.EncryptKeyringFile, uint32(opts.EncryptActiveKeyID))
+		if err != nil {
+			nsqLog.LogErrorf("FATAL: load --encrypt-keyring-file=%s failed: %v", opts.EncryptKeyringFile, err)
+			os.Exit(1)
+		}
+		nsqLog.Logf("encryption at rest enabled with active key: %v", kr.ActiveKeyID())
+		SetEncryptKeyring(kr)
+	}
+	if opts.ZstdDictDir != "" {
+		zd, err := LoadZstdDicts(opts.ZstdDictDir, uint32(opts.ZstdActiveDictID))
+		if err != nil {
+			nsqLog.LogErrorf("FATAL: load --zstd-dict-dir=%s failed: %v", opts.ZstdDictDir, err)
+			os.Exit(1)
+		}
+		nsqLog.Logf("zstd dictionaries loaded with active dictionary: %v", zd.ActiveDictID())
+		SetZstdDicts(zd)
+	}
 	nsqLog.Logf("broadcast option: %s, %s", opts.BroadcastAddress, opts.BroadcastInterface)
 
 	n.metaStorage, err = NewShardedDBMetaStorage(path.Join(dataPath, "shared_meta"))
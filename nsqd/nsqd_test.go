@@ -377,7 +377,9 @@ func TestSkipMetaData(t *testing.T) {
 func TestSetHealth(t *testing.T) {
 	opts := NewOptions()
 	opts.Logger = newTestLogger(t)
-	nsqd := New(opts)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
 
 	equal(t, nsqd.GetError(), nil)
 	equal(t, nsqd.IsHealthy(), true)
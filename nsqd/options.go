@@ -26,6 +26,8 @@ type Options struct {
 	ClusterLeadershipUsername  string        `flag:"cluster-leadership-username" cfg:"cluster_leadership_username"`
 	ClusterLeadershipPassword  string        `flag:"cluster-leadership-password" cfg:"cluster_leadership_password"`
 	ClusterLeadershipRootDir   string        `flag:"cluster-leadership-root-dir" cfg:"cluster_leadership_root_dir"`
+	ClusterLeadershipBackend   string        `flag:"cluster-leadership-backend" cfg:"cluster_leadership_backend"`
+	Zone                       string        `flag:"zone"`
 	TCPAddress                 string        `flag:"tcp-address"`
 	RPCPort                    string        `flag:"rpc-port"`
 	ReverseProxyPort           string        `flag:"reverse-proxy-port"`
@@ -43,6 +45,40 @@ type Options struct {
 	MaxBytesPerFile int64         `flag:"max-bytes-per-file"`
 	SyncEvery       int64         `flag:"sync-every"`
 	SyncTimeout     time.Duration `flag:"sync-timeout"`
+	// write the crc32c checksum for each record, the old records without checksum are still readable
+	QueueRecordChecksum bool `flag:"queue-record-checksum" cfg:"queue_record_checksum"`
+	// the interval of the sparse time index for the topic data, 0 to disable
+	QueueTimeIndexInterval time.Duration `flag:"queue-time-index-interval" cfg:"queue_time_index_interval"`
+	// the tiered storage for the cleaned topic data, empty to disable, local or s3
+	ArchiveType          string `flag:"archive-type" cfg:"archive_type"`
+	ArchivePath          string `flag:"archive-path" cfg:"archive_path"`
+	ArchiveS3Endpoint    string `flag:"archive-s3-endpoint" cfg:"archive_s3_endpoint"`
+	ArchiveS3Bucket      string `flag:"archive-s3-bucket" cfg:"archive_s3_bucket"`
+	ArchiveS3Region      string `flag:"archive-s3-region" cfg:"archive_s3_region"`
+	ArchiveS3AccessKey   string `flag:"archive-s3-access-key" cfg:"archive_s3_access_key"`
+	ArchiveS3SecretKey   string `flag:"archive-s3-secret-key" cfg:"archive_s3_secret_key"`
+	ArchiveCacheSegments int    `flag:"archive-cache-segments" cfg:"archive_cache_segments"`
+	// the keyring file for the encryption at rest, empty to disable
+	EncryptKeyringFile string `flag:"encrypt-keyring-file" cfg:"encrypt_keyring_file"`
+	// the key id used to encrypt the new data, 0 to use the largest key id in the keyring
+	EncryptActiveKeyID int `flag:"encrypt-active-key-id" cfg:"encrypt_active_key_id"`
+	// the directory of the zstd dictionaries for the zstd compressed topics, empty to disable
+	ZstdDictDir string `flag:"zstd-dict-dir" cfg:"zstd_dict_dir"`
+	// the dictionary id used to compress the new data, 0 to use the largest dictionary id
+	ZstdActiveDictID int `flag:"zstd-active-dict-id" cfg:"zstd_active_dict_id"`
+	// the tombstone of the compacted topic will be removed after the retention
+	CompactTombstoneRetention time.Duration `flag:"compact-tombstone-retention" cfg:"compact_tombstone_retention"`
+	// the delayed queue store engine, bolt or wheel, the store will be converted while the engine changed
+	DelayQueueEngine string `flag:"delay-queue-engine" cfg:"delay_queue_engine"`
+	// the message body not less than the size is sent to the consumer from the segment file
+	// directly without loading into memory, 0 to disable. The records with checksum are
+	// always loaded to verify the checksum.
+	ZeroCopyMinSize int64 `flag:"zero-copy-min-size" cfg:"zero_copy_min_size"`
+	// the max bytes per second of the data sent to all the replicas catching up (and full sync)
+	// from this node, 0 to disable
+	CatchupRateLimit int64 `flag:"catchup-rate-limit" cfg:"catchup_rate_limit"`
+	// the max bytes per second of the catchup data sent for each topic partition, 0 to disable
+	CatchupTopicRateLimit int64 `flag:"catchup-topic-rate-limit" cfg:"catchup_topic_rate_limit"`
 
 	QueueScanInterval          time.Duration `flag:"queue-scan-interval"`
 	QueueScanRefreshInterval   time.Duration `flag:"queue-scan-refresh-interval"`
@@ -61,6 +97,7 @@ type Options struct {
 	MaxChannelDelayedQNum int64         `flag:"max-channel-delayed-qnum"`
 	ClientTimeout         time.Duration
 	ReqToEndThreshold     time.Duration `flag:"req-to-end-threshold"`
+	DedupWindowSize       int           `flag:"dedup-window-size" cfg:"dedup_window_size"`
 
 	// client overridable configuration options
 	MaxHeartbeatInterval   time.Duration `flag:"max-heartbeat-interval"`
@@ -124,6 +161,7 @@ func NewOptions() *Options {
 
 		ClusterID:                  "nsq-clusterid-test-only",
 		ClusterLeadershipAddresses: "",
+		ClusterLeadershipBackend:   "etcd",
 		TCPAddress:                 "0.0.0.0:4150",
 		HTTPAddress:                "0.0.0.0:4151",
 		HTTPSAddress:               "0.0.0.0:4152",
@@ -139,6 +177,12 @@ func NewOptions() *Options {
 		SyncEvery:       2500,
 		SyncTimeout:     2 * time.Second,
 
+		QueueTimeIndexInterval: defaultTimeIndexInterval,
+		ArchiveCacheSegments:   defaultArchiveCacheSegNum,
+
+		CompactTombstoneRetention: 24 * time.Hour,
+		DelayQueueEngine:          DelayQueueEngineBolt,
+
 		QueueScanInterval:          500 * time.Millisecond,
 		QueueScanRefreshInterval:   5 * time.Second,
 		QueueScanSelectionCount:    20,
@@ -153,6 +197,7 @@ func NewOptions() *Options {
 		MaxReqTimeout:     3 * 24 * time.Hour,
 		ClientTimeout:     60 * time.Second,
 		ReqToEndThreshold: 15 * time.Minute,
+		DedupWindowSize:   10000,
 
 		MaxHeartbeatInterval:   60 * time.Second,
 		MaxRdyCount:            2500,
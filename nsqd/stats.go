@@ -40,6 +40,12 @@ type TopicStats struct {
 	IsExt                bool             `json:"is_ext"`
 	StatsdName           string           `json:"statsd_name"`
 	PubFailedCnt         int64            `json:"pub_failed_cnt"`
+	// the disk size of the delayed queue, including the log and the kv store
+	DelayedQueueDataSize int64 `json:"delayed_queue_data_size"`
+	DelayedQueueDBSize   int64 `json:"delayed_queue_db_size"`
+	// the scheduled messages waiting in the delayed queue and the released count
+	DelayedPubCount    uint64 `json:"delayed_pub_count"`
+	DelayedPubReleased int64  `json:"delayed_pub_released"`
 
 	E2eProcessingLatency *quantile.Result `json:"e2e_processing_latency"`
 }
@@ -53,6 +59,13 @@ func NewTopicStats(t *Topic, channels []ChannelStats, filterClients bool) TopicS
 	if !filterClients {
 		clients = t.detailStats.GetPubClientStats()
 	}
+	var dqDataSize, dqDBSize int64
+	var delayedPubCnt uint64
+	if dq := t.GetDelayedQueue(); dq != nil {
+		dqDataSize = dq.TotalDataSize()
+		dqDBSize, _ = dq.GetDBSize()
+		delayedPubCnt, _ = dq.GetCurrentDelayedCnt(PubDelayed, "")
+	}
 	return TopicStats{
 		TopicName:            t.GetTopicName(),
 		TopicFullName:        t.GetFullName(),
@@ -71,6 +84,10 @@ func NewTopicStats(t *Topic, channels []ChannelStats, filterClients bool) TopicS
 		IsExt:                t.IsExt(),
 		PubFailedCnt:         t.PubFailed(),
 		StatsdName:           statsdName,
+		DelayedQueueDataSize: dqDataSize,
+		DelayedQueueDBSize:   dqDBSize,
+		DelayedPubCount:      delayedPubCnt,
+		DelayedPubReleased:   t.DelayedPubReleased(),
 
 		E2eProcessingLatency: t.AggregateChannelE2eProcessingLatency().Result(),
 	}
@@ -101,6 +118,11 @@ type ChannelStats struct {
 	DelayedQueueCount  uint64 `json:"delayed_queue_count"`
 	DelayedQueueRecent string `json:"delayed_queue_recent"`
 
+	MaxAttempts     uint16 `json:"max_attempts"`
+	DeadLetterTopic string `json:"dead_letter_topic"`
+	DeadLetterCount uint64 `json:"dead_letter_count"`
+	ExpiredCount    uint64 `json:"expired_count"`
+
 	E2eProcessingLatency    *quantile.Result `json:"e2e_processing_latency"`
 	MsgConsumeLatencyStats  []int64          `json:"msg_consume_latency_stats"`
 	MsgDeliveryLatencyStats []int64          `json:"msg_delivery_latency_stats"`
@@ -134,6 +156,10 @@ func NewChannelStats(c *Channel, clients []ClientStats, clientNum int) ChannelSt
 		ZanTestSkipped:         c.IsZanTestSkipped(),
 		DelayedQueueCount:      dqCnt,
 		DelayedQueueRecent:     time.Unix(0, recentTs).String(),
+		MaxAttempts:            c.GetMaxAttempts(),
+		DeadLetterTopic:        c.GetDeadLetterTopicOrDefault(),
+		DeadLetterCount:        c.GetDeadLetterCount(),
+		ExpiredCount:           c.GetExpiredCount(),
 
 		E2eProcessingLatency:    c.e2eProcessingLatencyStream.Result(),
 		MsgConsumeLatencyStats:  c.channelStatsInfo.GetChannelLatencyStats(),
@@ -185,6 +211,7 @@ type ClientStats struct {
 	FinishCount     uint64 `json:"finish_count"`
 	RequeueCount    uint64 `json:"requeue_count"`
 	TimeoutCount    int64  `json:"timeout_count"`
+	ZeroCopyCount   uint64 `json:"zero_copy_count"`
 	DeferredCount   int64  `json:"deferred_count"`
 	ConnectTime     int64  `json:"connect_ts"`
 	SampleRate      int32  `json:"sample_rate"`
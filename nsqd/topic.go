@@ -34,6 +34,8 @@ var (
 	ErrWriteOffsetMismatch        = errors.New("write offset mismatch")
 	ErrOperationInvalidState      = errors.New("the operation is not allowed under current state")
 	ErrMessageInvalidDelayedState = errors.New("the message is invalid for delayed")
+	ErrMessageDuplicated          = errors.New("the message is duplicated")
+	ErrProducerSeqDuplicated      = errors.New("the producer sequence is duplicated")
 )
 
 func writeMessageToBackend(writeExt bool, buf *bytes.Buffer, msg *Message, bq *diskQueueWriter) (BackendOffset, int32, diskQueueEndInfo, error) {
@@ -45,19 +47,6 @@ func writeMessageToBackend(writeExt bool, buf *bytes.Buffer, msg *Message, bq *d
 	return bq.PutV2(buf.Bytes())
 }
 
-func writeMessageToBackendWithCheck(writeExt bool, buf *bytes.Buffer, msg *Message, checkSize int64, bq *diskQueueWriter) (BackendOffset, int32, diskQueueEndInfo, error) {
-	buf.Reset()
-	wsize, err := msg.WriteTo(buf, writeExt)
-	if err != nil {
-		return 0, 0, diskQueueEndInfo{}, err
-	}
-	// there are 4bytes data length on disk.
-	if checkSize > 0 && wsize+4 != checkSize {
-		return 0, 0, diskQueueEndInfo{}, fmt.Errorf("message write size mismatch %v vs %v", checkSize, wsize+4)
-	}
-	return bq.PutV2(buf.Bytes())
-}
-
 type MsgIDGenerator interface {
 	NextID() uint64
 	Reset(uint64)
@@ -70,6 +59,10 @@ type TopicDynamicConf struct {
 	OrderedMulti bool
 	MultiPart    bool
 	Ext          bool
+	// the compression (snappy or zstd) for the new written messages, empty means no compression
+	Compression string
+	// keep only the newest message of each compact key in the old data
+	Compact bool
 }
 
 type PubInfo struct {
@@ -87,6 +80,9 @@ type ChannelMetaInfo struct {
 	Paused         bool   `json:"paused"`
 	Skipped        bool   `json:"skipped"`
 	ZanTestSkipped bool   `json:"zanTestSkipped"`
+	// the dead letter config, 0 max attempts means disabled
+	MaxAttempts     uint16 `json:"maxAttempts,omitempty"`
+	DeadLetterTopic string `json:"deadLetterTopic,omitempty"`
 }
 
 func (cm *ChannelMetaInfo) IsZanTestSkipepd() bool {
@@ -134,7 +130,17 @@ type Topic struct {
 	isExt        int32
 	saveMutex    sync.Mutex
 	pubFailedCnt int64
-	metaStorage  IMetaStorage
+	// the scheduled messages published from the delayed queue
+	delayedPubReleased int64
+	metaStorage        IMetaStorage
+	dedup              *msgDedupWindow
+	// the tiered storage for the cleaned data, nil if disabled
+	archive *diskQueueArchive
+	// the read end and time of the last compaction
+	lastCompactEnd  BackendOffset
+	lastCompactTime time.Time
+	// the min body size of the zero copy delivery for the channels, 0 if disabled
+	zeroCopyMinSize int64
 }
 
 func (t *Topic) setExt() {
@@ -145,6 +151,13 @@ func (t *Topic) IsExt() bool {
 	return atomic.LoadInt32(&t.isExt) == 1
 }
 
+// IsCompact return whether the topic is compacted by the compact key of the message
+func (t *Topic) IsCompact() bool {
+	t.Lock()
+	defer t.Unlock()
+	return t.dynamicConf.Compact
+}
+
 func (t *Topic) IncrPubFailed() {
 	atomic.AddInt64(&t.pubFailedCnt, 1)
 }
@@ -171,19 +184,21 @@ func NewTopicWithExt(topicName string, part int, ext bool, ordered bool, opt *Op
 		return nil
 	}
 	t := &Topic{
-		tname:          topicName,
-		partition:      part,
-		channelMap:     make(map[string]*Channel),
-		flushChan:      make(chan int, 10),
-		option:         opt,
-		dynamicConf:    &TopicDynamicConf{SyncEvery: opt.SyncEvery, AutoCommit: 1},
-		putBuffer:      bytes.Buffer{},
-		nsqdNotify:     notify,
-		writeDisabled:  writeDisabled,
-		pubWaitingChan: make(PubInfoChan, pubQueue),
-		quitChan:       make(chan struct{}),
-		pubLoopFunc:    loopFunc,
-		metaStorage:    metaStorage,
+		tname:           topicName,
+		partition:       part,
+		channelMap:      make(map[string]*Channel),
+		flushChan:       make(chan int, 10),
+		option:          opt,
+		dynamicConf:     &TopicDynamicConf{SyncEvery: opt.SyncEvery, AutoCommit: 1},
+		zeroCopyMinSize: opt.ZeroCopyMinSize,
+		putBuffer:       bytes.Buffer{},
+		nsqdNotify:      notify,
+		writeDisabled:   writeDisabled,
+		pubWaitingChan:  make(PubInfoChan, pubQueue),
+		quitChan:        make(chan struct{}),
+		pubLoopFunc:     loopFunc,
+		metaStorage:     metaStorage,
+		dedup:           newMsgDedupWindow(opt.DedupWindowSize),
 	}
 	if ext {
 		t.setExt()
@@ -223,6 +238,17 @@ func NewTopicWithExt(topicName string, part int, ext bool, ordered bool, opt *Op
 		}
 	}
 	t.backend = queue.(*diskQueueWriter)
+	t.backend.SetRecordChecksum(opt.QueueRecordChecksum)
+	t.backend.SetTimeIndexInterval(opt.QueueTimeIndexInterval)
+	archive, err := NewSegmentArchive(opt)
+	if err != nil {
+		nsqLog.LogErrorf("topic(%v) failed to init archive: %v ", t.fullName, err)
+	} else if archive != nil {
+		t.archive = newDiskQueueArchive(archive, backendName, t.dataPath, opt.ArchiveCacheSegments)
+		// the cached segments from last run are not tracked, so we clean them
+		t.archive.clearCache()
+		t.backend.SetArchive(t.archive)
+	}
 
 	t.UpdateCommittedOffset(t.backend.GetQueueWriteEnd())
 	err = t.loadMagicCode()
@@ -294,6 +320,14 @@ func (t *Topic) SetDataFixState(needFix bool) {
 	}
 }
 
+// the channel read the data with checksum mismatch, the topic data should be fixed from other replicas.
+func (t *Topic) markChannelDataCorrupt(c *Channel) {
+	if !t.IsDataNeedFix() {
+		nsqLog.LogErrorf("TOPIC(%s): channel %v read corrupt data, mark topic data need fix", t.GetFullName(), c.GetName())
+	}
+	t.SetDataFixState(true)
+}
+
 func (t *Topic) getMagicCodeFileName() string {
 	return path.Join(t.dataPath, "magic"+strconv.Itoa(t.partition))
 }
@@ -461,6 +495,7 @@ func (t *Topic) LoadChannelMeta() error {
 		if !ch.IsZanTestSkipepd() {
 			channel.UnskipZanTest()
 		}
+		channel.SetDeadLetter(ch.MaxAttempts, ch.DeadLetterTopic)
 	}
 	return nil
 }
@@ -476,6 +511,9 @@ func (t *Topic) GetChannelMeta() []ChannelMetaInfo {
 				Paused:         channel.IsPaused(),
 				Skipped:        channel.IsSkipped(),
 				ZanTestSkipped: channel.IsZanTestSkipped(),
+
+				MaxAttempts:     channel.GetMaxAttempts(),
+				DeadLetterTopic: channel.GetDeadLetterTopic(),
 			}
 			channels = append(channels, meta)
 		}
@@ -497,6 +535,9 @@ func (t *Topic) SaveChannelMeta() error {
 				Paused:         channel.IsPaused(),
 				Skipped:        channel.IsSkipped(),
 				ZanTestSkipped: channel.IsZanTestSkipped(),
+
+				MaxAttempts:     channel.GetMaxAttempts(),
+				DeadLetterTopic: channel.GetDeadLetterTopic(),
 			}
 			channels = append(channels, meta)
 		}
@@ -595,9 +636,105 @@ func (t *Topic) GetDiskQueueSnapshot() *DiskQueueSnapshot {
 	start := t.backend.GetQueueReadStart()
 	d := NewDiskQueueSnapshot(getBackendName(t.tname, t.partition), t.dataPath, e)
 	d.SetQueueStart(start)
+	d.SetArchive(t.archive)
 	return d
 }
 
+// IsArchiveEnabled return true if the cleaned data is kept in the tiered storage
+func (t *Topic) IsArchiveEnabled() bool {
+	return t.archive != nil
+}
+
+// SetArchiveUpload enable or disable uploading the cleaned data to the archive, only the leader
+// of the partition upload and the replicas will only clean the data already archived by the leader.
+func (t *Topic) SetArchiveUpload(enable bool) {
+	if t.archive != nil {
+		t.archive.setUploadEnabled(enable)
+	}
+}
+
+// ArchiveCommitLog upload the commit log segment file to the archive of the topic before it is cleaned
+func (t *Topic) ArchiveCommitLog(fileName string) error {
+	if t.archive == nil {
+		return ErrArchiveNotEnabled
+	}
+	return t.archive.archiveFile(archiveCommitLogDir, fileName)
+}
+
+// SearchArchivedMsgOffset search the first message with the offset not less than the given
+// in the cleaned and archived data, return the offset of the message and the message count before it.
+func (t *Topic) SearchArchivedMsgOffset(offset BackendOffset) (BackendOffset, int64, error) {
+	if t.archive == nil {
+		return 0, 0, ErrArchiveNotEnabled
+	}
+	if !t.archive.isCleaned(offset) {
+		return 0, 0, ErrReadQueueNotCleaned
+	}
+	seg, err := t.archive.findSegment(offset)
+	if err != nil {
+		if err == ErrArchiveKeyNotFound {
+			return 0, 0, ErrReadQueueAlreadyCleaned
+		}
+		return 0, 0, err
+	}
+	snap := t.GetDiskQueueSnapshot()
+	defer snap.Close()
+	err = snap.ResetSeekTo(seg.StartOffset, seg.StartCnt)
+	if err != nil {
+		return 0, 0, err
+	}
+	cur := seg.StartOffset
+	cnt := seg.StartCnt
+	for cur < offset {
+		ret := snap.ReadOne()
+		if ret.Err != nil {
+			if ret.Err == io.EOF {
+				break
+			}
+			return 0, 0, ret.Err
+		}
+		cur = ret.Offset + ret.MovedSize
+		cnt = ret.CurCnt
+	}
+	return cur, cnt, nil
+}
+
+// SearchMsgByTimestamp search the first message with the timestamp (in nanoseconds) not less than the given
+// using the time index, return the offset of the message and the message count before it. The queue end
+// will be returned if all the messages are older.
+func (t *Topic) SearchMsgByTimestamp(ts int64) (BackendOffset, int64, error) {
+	offset, cnt, err := t.backend.SearchTimeIndex(ts)
+	if err != nil {
+		return 0, 0, err
+	}
+	snap := t.GetDiskQueueSnapshot()
+	defer snap.Close()
+	err = snap.ResetSeekTo(offset, cnt)
+	if err != nil {
+		return 0, 0, err
+	}
+	// the messages between the index entries should be read to find the exact position
+	for {
+		ret := snap.ReadOne()
+		if ret.Err != nil {
+			if ret.Err == io.EOF {
+				break
+			}
+			return 0, 0, ret.Err
+		}
+		msg, err := DecodeMessage(ret.Data, t.IsExt())
+		if err != nil {
+			return 0, 0, err
+		}
+		if msg.Timestamp >= ts {
+			break
+		}
+		offset = ret.Offset + ret.MovedSize
+		cnt++
+	}
+	return offset, cnt, nil
+}
+
 func (t *Topic) BufferPoolGet(capacity int) *bytes.Buffer {
 	b := t.bp.Get().(*bytes.Buffer)
 	b.Reset()
@@ -662,11 +799,27 @@ func (t *Topic) SetDynamicInfo(dynamicConf TopicDynamicConf, idGen MsgIDGenerato
 	if dynamicConf.Ext {
 		t.setExt()
 	}
+	codec, err := ParseCompressCodec(dynamicConf.Compression)
+	if err != nil {
+		nsqLog.LogWarningf("topic %v compression invalid: %v", t.GetFullName(), err)
+	} else {
+		t.dynamicConf.Compression = dynamicConf.Compression
+		t.backend.SetCompressCodec(codec)
+	}
+	t.dynamicConf.Compact = dynamicConf.Compact
+	// the zero copy delivery is disabled for the compacted topic since the segments may be
+	// rewritten while the message is in flight
+	if dynamicConf.Compact {
+		atomic.StoreInt64(&t.zeroCopyMinSize, 0)
+	} else {
+		atomic.StoreInt64(&t.zeroCopyMinSize, t.option.ZeroCopyMinSize)
+	}
 	nsqLog.Logf("topic dynamic configure changed to %v", dynamicConf)
 	t.channelLock.RLock()
 	for _, ch := range t.channelMap {
 		ext := dynamicConf.Ext
 		ch.SetExt(ext)
+		ch.SetZeroCopyMinSize(atomic.LoadInt64(&t.zeroCopyMinSize))
 	}
 	t.channelLock.RUnlock()
 	t.Unlock()
@@ -754,11 +907,13 @@ func (t *Topic) getOrCreateChannel(channelName string) (*Channel, bool) {
 		}
 		start := t.backend.GetQueueReadStart()
 		channel = NewChannel(t.GetTopicName(), t.GetTopicPart(), t.IsOrdered(), channelName, readEnd,
-			t.option, deleteCallback, t.flushForChannelMoreData, atomic.LoadInt32(&t.writeDisabled),
+			t.option, deleteCallback, t.flushForChannelMoreData, t.markChannelDataCorrupt, atomic.LoadInt32(&t.writeDisabled),
 			t.nsqdNotify, ext, start, t.metaStorage)
 
 		channel.UpdateQueueEnd(readEnd, false)
 		channel.SetDelayedQueue(t.GetDelayedQueue())
+		channel.SetArchive(t.archive)
+		channel.SetZeroCopyMinSize(atomic.LoadInt64(&t.zeroCopyMinSize))
 		if t.IsWriteDisabled() {
 			channel.DisableConsume(true)
 		}
@@ -820,6 +975,7 @@ func (t *Topic) RollbackNoLock(vend BackendOffset, diffCnt uint64) error {
 	nsqLog.Logf("reset the backend from %v to : %v, %v", old, vend, diffCnt)
 	dend, err := t.backend.RollbackWriteV2(vend, diffCnt)
 	if err == nil {
+		t.dedup.truncate(dend.Offset())
 		t.UpdateCommittedOffset(&dend)
 		t.updateChannelsEnd(true, true)
 	}
@@ -836,6 +992,7 @@ func (t *Topic) ResetBackendEndNoLock(vend BackendOffset, totalCnt int64) error
 	if err != nil {
 		nsqLog.LogErrorf("reset backend to %v error: %v", vend, err)
 	} else {
+		t.dedup.truncate(dend.Offset())
 		t.UpdateCommittedOffset(&dend)
 		t.updateChannelsEnd(true, true)
 	}
@@ -854,6 +1011,11 @@ func (t *Topic) PutMessage(m *Message) (MessageID, BackendOffset, int32, Backend
 	if m.DelayedType >= MinDelayedType {
 		return 0, 0, 0, nil, ErrMessageInvalidDelayedState
 	}
+	if id, offset, writeBytes, err := t.CheckDuplicatedNoLock(m); err == ErrMessageDuplicated {
+		return id, offset, writeBytes, t.GetCommitted(), nil
+	} else if err != nil {
+		return 0, 0, 0, nil, err
+	}
 
 	id, offset, writeBytes, dend, err := t.PutMessageNoLock(m)
 	return id, offset, writeBytes, dend, err
@@ -868,7 +1030,7 @@ func (t *Topic) PutMessageNoLock(m *Message) (MessageID, BackendOffset, int32, B
 		return 0, 0, 0, nil, ErrInvalidMessageID
 	}
 
-	id, offset, writeBytes, dend, err := t.put(m, true, 0)
+	id, offset, writeBytes, dend, err := t.put(m, true)
 	return id, offset, writeBytes, &dend, err
 }
 
@@ -922,6 +1084,22 @@ func (t *Topic) flushForChannels(forceUpdate bool) {
 	}
 }
 
+// StartRawCaptureNoLock begin to keep the encoded records written if the replicas should write
+// the same bytes as the leader, return false if not needed.
+func (t *Topic) StartRawCaptureNoLock() bool {
+	if !t.backend.NeedRawReplicate() {
+		return false
+	}
+	t.backend.StartRawCapture()
+	return true
+}
+
+// StopRawCaptureNoLock return the encoded records written since the capture started, which
+// can be replicated by PutRawDataOnReplica.
+func (t *Topic) StopRawCaptureNoLock() []byte {
+	return t.backend.StopRawCapture()
+}
+
 func (t *Topic) PutRawDataOnReplica(rawData []byte, offset BackendOffset, checkSize int64, msgNum int32) (BackendQueueEnd, error) {
 	if atomic.LoadInt32(&t.exitFlag) == 1 {
 		return nil, ErrExiting
@@ -931,6 +1109,12 @@ func (t *Topic) PutRawDataOnReplica(rawData []byte, offset BackendOffset, checkS
 		nsqLog.LogErrorf("topic %v: write offset mismatch: %v, %v", t.GetFullName(), offset, wend)
 		return nil, ErrWriteOffsetMismatch
 	}
+	// verify the checksum before writing to avoid replicating the corrupt data from leader
+	err := walkRawRecords(rawData, nil)
+	if err != nil {
+		nsqLog.LogErrorf("topic %v: raw data at %v is invalid: %v", t.GetFullName(), offset, err)
+		return nil, err
+	}
 	_, writeBytes, dend, err := t.backend.PutRawV2(rawData, msgNum)
 	if err != nil {
 		nsqLog.LogErrorf("topic %v: write to disk error: %v, %v", t.GetFullName(), offset, err.Error())
@@ -940,6 +1124,7 @@ func (t *Topic) PutRawDataOnReplica(rawData []byte, offset BackendOffset, checkS
 		t.ResetBackendEndNoLock(wend.Offset(), wend.TotalMsgCnt())
 		return &dend, fmt.Errorf("message write size mismatch %v vs %v", checkSize, writeBytes)
 	}
+	t.updateDedupWindowFromRawData(rawData, offset)
 	atomic.StoreInt32(&t.needFlush, 1)
 	if atomic.LoadInt32(&t.dynamicConf.AutoCommit) == 1 {
 		t.UpdateCommittedOffset(&dend)
@@ -949,52 +1134,34 @@ func (t *Topic) PutRawDataOnReplica(rawData []byte, offset BackendOffset, checkS
 }
 
 func (t *Topic) PutMessageOnReplica(m *Message, offset BackendOffset, checkSize int64) (BackendQueueEnd, error) {
-	if atomic.LoadInt32(&t.exitFlag) == 1 {
-		return nil, ErrExiting
-	}
-	wend := t.backend.GetQueueWriteEnd()
-	if wend.Offset() != offset {
-		nsqLog.LogErrorf("topic %v: write offset mismatch: %v, %v", t.GetFullName(), offset, wend)
-		return nil, ErrWriteOffsetMismatch
-	}
-	_, _, _, dend, err := t.put(m, false, checkSize)
-	if err != nil {
-		return nil, err
-	}
-	return &dend, nil
+	return t.PutMessagesOnReplica([]*Message{m}, offset, checkSize)
 }
 
 func (t *Topic) PutMessagesOnReplica(msgs []*Message, offset BackendOffset, checkSize int64) (BackendQueueEnd, error) {
 	if atomic.LoadInt32(&t.exitFlag) == 1 {
 		return nil, ErrExiting
 	}
-
-	wend := t.backend.GetQueueWriteEnd()
-	if wend.Offset() != offset {
-		nsqLog.LogErrorf(
-			"TOPIC(%s) : write message offset mismatch %v, %v",
-			t.GetFullName(), offset, wend)
-		return nil, ErrWriteOffsetMismatch
+	rawData, err := t.encodePlainRecords(msgs)
+	if err != nil {
+		return nil, err
 	}
+	return t.PutRawDataOnReplica(rawData, offset, checkSize, int32(len(msgs)))
+}
 
-	var dend diskQueueEndInfo
-	var err error
-	wsize := int32(0)
-	wsizeTotal := int32(0)
+// encodePlainRecords encode the messages as the records without checksum, compression and
+// encryption. The leader send the messages instead of the raw records only if it write the plain
+// records, so the replica should write the same records ignoring the local record format.
+func (t *Topic) encodePlainRecords(msgs []*Message) ([]byte, error) {
+	rawData := make([]byte, 0, len(msgs)*(recordHeaderSizeV1+minValidMsgLength))
 	for _, m := range msgs {
-		_, _, wsize, dend, err = t.put(m, false, 0)
+		t.putBuffer.Reset()
+		_, err := m.WriteTo(&t.putBuffer, t.IsExt())
 		if err != nil {
-			t.ResetBackendEndNoLock(wend.Offset(), wend.TotalMsgCnt())
 			return nil, err
 		}
-		wsizeTotal += wsize
-	}
-	if checkSize > 0 && int64(wsizeTotal) != checkSize {
-		t.ResetBackendEndNoLock(wend.Offset(), wend.TotalMsgCnt())
-		return nil, fmt.Errorf("batch message size mismatch: %v vs %v", checkSize, wsizeTotal)
+		rawData = appendPlainRecord(rawData, t.putBuffer.Bytes())
 	}
-
-	return &dend, nil
+	return rawData, nil
 }
 
 func (t *Topic) PutMessagesNoLock(msgs []*Message) (MessageID, BackendOffset, int32, int64, BackendQueueEnd, error) {
@@ -1014,7 +1181,7 @@ func (t *Topic) PutMessagesNoLock(msgs []*Message) (MessageID, BackendOffset, in
 			t.ResetBackendEndNoLock(wend.Offset(), wend.TotalMsgCnt())
 			return 0, 0, 0, 0, nil, ErrInvalidMessageID
 		}
-		id, offset, bytes, end, err := t.put(m, true, 0)
+		id, offset, bytes, end, err := t.put(m, true)
 		if err != nil {
 			t.ResetBackendEndNoLock(wend.Offset(), wend.TotalMsgCnt())
 			return firstMsgID, firstOffset, batchBytes, firstCnt, &diskEnd, err
@@ -1035,6 +1202,15 @@ func (t *Topic) PutMessages(msgs []*Message) (MessageID, BackendOffset, int32, i
 	s := time.Now()
 	t.Lock()
 	defer t.Unlock()
+	msgs, err := t.FilterDuplicatedNoLock(msgs)
+	if err != nil {
+		return 0, 0, 0, 0, nil, err
+	}
+	if len(msgs) == 0 {
+		// all duplicated
+		e := t.GetCommitted()
+		return 0, 0, 0, e.TotalMsgCnt(), e, nil
+	}
 	firstMsgID, firstOffset, batchBytes, totalCnt, dend, err := t.PutMessagesNoLock(msgs)
 	cost := time.Since(s)
 	if cost >= slowCost {
@@ -1043,11 +1219,11 @@ func (t *Topic) PutMessages(msgs []*Message) (MessageID, BackendOffset, int32, i
 	return firstMsgID, firstOffset, batchBytes, totalCnt, dend, err
 }
 
-func (t *Topic) put(m *Message, trace bool, checkSize int64) (MessageID, BackendOffset, int32, diskQueueEndInfo, error) {
+func (t *Topic) put(m *Message, trace bool) (MessageID, BackendOffset, int32, diskQueueEndInfo, error) {
 	if m.ID <= 0 {
 		m.ID = t.nextMsgID()
 	}
-	offset, writeBytes, dend, err := writeMessageToBackendWithCheck(t.IsExt(), &t.putBuffer, m, checkSize, t.backend)
+	offset, writeBytes, dend, err := writeMessageToBackend(t.IsExt(), &t.putBuffer, m, t.backend)
 	atomic.StoreInt32(&t.needFlush, 1)
 	if err != nil {
 		nsqLog.LogErrorf(
@@ -1059,6 +1235,7 @@ func (t *Topic) put(m *Message, trace bool, checkSize int64) (MessageID, Backend
 	if atomic.LoadInt32(&t.dynamicConf.AutoCommit) == 1 {
 		t.UpdateCommittedOffset(&dend)
 	}
+	t.updateDedupWindow(m, offset, writeBytes)
 
 	if trace {
 		if m.TraceID != 0 || atomic.LoadInt32(&t.EnableTrace) == 1 || nsqLog.Level() >= levellogger.LOG_DETAIL {
@@ -1179,6 +1356,9 @@ func (t *Topic) exit(deleted bool) error {
 		t.removeHistoryStat()
 		t.RemoveChannelMeta()
 		t.removeMagicCode()
+		if t.archive != nil {
+			t.archive.clearCache()
+		}
 		return t.backend.Delete()
 	}
 
@@ -1358,7 +1538,42 @@ func (t *Topic) AggregateChannelE2eProcessingLatency() *quantile.Quantile {
 }
 
 // maybe should return the cleaned offset to allow commit log clean
+// TryCompactOldData compact the closed segments of the compacted topic, only the newest message of
+// each compact key is kept and the tombstone is removed after the retention. It will do nothing if no
+// new data since the last compaction and the tombstone retention is not passed.
+func (t *Topic) TryCompactOldData(tombstoneRetention time.Duration) error {
+	if !t.IsExt() || !t.IsCompact() {
+		return nil
+	}
+	end := t.backend.GetQueueReadEnd()
+	t.Lock()
+	skip := end.Offset() == t.lastCompactEnd && time.Since(t.lastCompactTime) < tombstoneRetention
+	t.Unlock()
+	if skip {
+		return nil
+	}
+	s := time.Now()
+	stats, err := t.backend.compactSegments(parseCompactKey, s.Add(-1*tombstoneRetention).UnixNano())
+	if err != nil {
+		nsqLog.LogErrorf("topic %v failed to compact: %v", t.GetFullName(), err)
+		return err
+	}
+	t.Lock()
+	t.lastCompactEnd = end.Offset()
+	t.lastCompactTime = s
+	t.Unlock()
+	if stats.segments > 0 {
+		nsqLog.Logf("topic %v compacted %v segments, removed %v messages, cost: %v", t.GetFullName(),
+			stats.segments, stats.removed, time.Since(s))
+	}
+	return nil
+}
+
 func (t *Topic) TryCleanOldData(retentionSize int64, noRealClean bool, maxCleanOffset BackendOffset) (BackendQueueEnd, error) {
+	if t.IsCompact() {
+		// the compacted data is kept as the snapshot of all the keys
+		return nil, nil
+	}
 	// clean the data that has been consumed and keep the retention policy
 	var oldestPos BackendQueueEnd
 	t.channelLock.RLock()
@@ -1471,6 +1686,7 @@ func (t *Topic) TryFixQueueEnd(vend BackendOffset, totalCnt int64) error {
 	if err != nil {
 		nsqLog.LogErrorf("fix backend to %v error: %v", vend, err)
 	} else {
+		t.dedup.truncate(dend.Offset())
 		t.UpdateCommittedOffset(&dend)
 		t.updateChannelsEnd(true, true)
 	}
@@ -1493,6 +1709,7 @@ func (t *Topic) ResetBackendWithQueueStartNoLock(queueStartOffset int64, queueSt
 	if err != nil {
 		return err
 	}
+	t.dedup.reset()
 	newEnd := t.backend.GetQueueReadEnd()
 	t.UpdateCommittedOffset(newEnd)
 
@@ -0,0 +1,349 @@
+package nsqd
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+
+	simpleJson "github.com/bitly/go-simplejson"
+	"github.com/youzan/nsq/internal/ext"
+)
+
+// dedupEntry is the written message with the dedup key, the original write result
+// will be returned to the producer if the duplicated message is published again.
+type dedupEntry struct {
+	key      string
+	producer string
+	seq      int64
+	id       MessageID
+	offset   BackendOffset
+	size     int32
+}
+
+// msgDedupWindow keep the recent written messages which have the producer sequence or
+// the dedup key in the json ext header. Since it is updated while writing message on both the
+// leader and the replicas, the new leader has the same dedup state after failover.
+// All the methods should be called while holding the topic lock.
+type msgDedupWindow struct {
+	maxSize int
+	// ring buffer ordered by the write offset
+	entries   []dedupEntry
+	head      int
+	count     int
+	keys      map[string]dedupEntry
+	producers map[string]int64
+}
+
+func newMsgDedupWindow(maxSize int) *msgDedupWindow {
+	return &msgDedupWindow{
+		maxSize: maxSize,
+	}
+}
+
+func (w *msgDedupWindow) enabled() bool {
+	return w != nil && w.maxSize > 0
+}
+
+func (w *msgDedupWindow) init() {
+	if w.entries != nil {
+		return
+	}
+	w.entries = make([]dedupEntry, w.maxSize)
+	w.keys = make(map[string]dedupEntry)
+	w.producers = make(map[string]int64)
+}
+
+func (w *msgDedupWindow) Len() int {
+	if w == nil {
+		return 0
+	}
+	return w.count
+}
+
+func (w *msgDedupWindow) at(i int) *dedupEntry {
+	return &w.entries[(w.head+i)%w.maxSize]
+}
+
+func (w *msgDedupWindow) popFront() {
+	e := w.at(0)
+	if old, ok := w.keys[e.key]; ok && old.offset == e.offset {
+		delete(w.keys, e.key)
+	}
+	if e.producer != "" {
+		if last, ok := w.producers[e.producer]; ok && last == e.seq {
+			delete(w.producers, e.producer)
+		}
+	}
+	*e = dedupEntry{}
+	w.head = (w.head + 1) % w.maxSize
+	w.count--
+}
+
+// check return the original entry and ErrMessageDuplicated if the message is already written in window,
+// and ErrProducerSeqDuplicated if the producer sequence is not increasing but the original is out of window.
+func (w *msgDedupWindow) check(key string, producer string, seq int64) (dedupEntry, error) {
+	if !w.enabled() || w.count == 0 {
+		return dedupEntry{}, nil
+	}
+	if e, ok := w.keys[key]; ok {
+		return e, ErrMessageDuplicated
+	}
+	if producer != "" {
+		if last, ok := w.producers[producer]; ok && seq <= last {
+			return dedupEntry{}, ErrProducerSeqDuplicated
+		}
+	}
+	return dedupEntry{}, nil
+}
+
+func (w *msgDedupWindow) add(e dedupEntry) {
+	if !w.enabled() {
+		return
+	}
+	w.init()
+	if w.count >= w.maxSize {
+		w.popFront()
+	}
+	*w.at(w.count) = e
+	w.count++
+	w.keys[e.key] = e
+	if e.producer != "" {
+		if last, ok := w.producers[e.producer]; !ok || e.seq > last {
+			w.producers[e.producer] = e.seq
+		}
+	}
+}
+
+// truncate remove the entries written at or after the offset, used while rollback or reset the write end.
+func (w *msgDedupWindow) truncate(vend BackendOffset) {
+	if w == nil || w.count == 0 {
+		return
+	}
+	removed := false
+	for w.count > 0 {
+		e := w.at(w.count - 1)
+		if e.offset < vend {
+			break
+		}
+		*e = dedupEntry{}
+		w.count--
+		removed = true
+	}
+	if !removed {
+		return
+	}
+	// rebuild the index from the remaining entries, since the older entry with the same key may be overwritten
+	w.keys = make(map[string]dedupEntry, w.count)
+	w.producers = make(map[string]int64)
+	for i := 0; i < w.count; i++ {
+		e := w.at(i)
+		w.keys[e.key] = *e
+		if e.producer != "" {
+			if last, ok := w.producers[e.producer]; !ok || e.seq > last {
+				w.producers[e.producer] = e.seq
+			}
+		}
+	}
+}
+
+func (w *msgDedupWindow) reset() {
+	if w == nil {
+		return
+	}
+	w.entries = nil
+	w.keys = nil
+	w.producers = nil
+	w.head = 0
+	w.count = 0
+}
+
+// parse the dedup key from the json ext header, the dedup key is used if both the dedup key
+// and the producer sequence are given.
+func parseDedupKeyIfAny(msg *Message) (string, string, int64, bool) {
+	if msg.ExtVer != ext.JSON_HEADER_EXT_VER {
+		return "", "", 0, false
+	}
+	// avoid parsing json for most messages without dedup
+	if !bytes.Contains(msg.ExtBytes, []byte(ext.PRODUCER_ID_KEY)) &&
+		!bytes.Contains(msg.ExtBytes, []byte(ext.DEDUP_KEY)) {
+		return "", "", 0, false
+	}
+	extHeader, err := simpleJson.NewJson(msg.ExtBytes)
+	if err != nil {
+		return "", "", 0, false
+	}
+	var key string
+	var producer string
+	var seq int64
+	if dk, ok := extHeader.CheckGet(ext.DEDUP_KEY); ok {
+		key, _ = dk.String()
+	}
+	if pj, ok := extHeader.CheckGet(ext.PRODUCER_ID_KEY); ok {
+		producer, _ = pj.String()
+	}
+	if producer != "" {
+		sj, ok := extHeader.CheckGet(ext.PRODUCER_SEQ_KEY)
+		if !ok {
+			producer = ""
+		} else {
+			seq, err = sj.Int64()
+			if err != nil {
+				ss, _ := sj.String()
+				seq, err = strconv.ParseInt(ss, 10, 64)
+				if err != nil {
+					producer = ""
+				}
+			}
+		}
+	}
+	if key != "" {
+		key = "k:" + key
+	} else if producer != "" {
+		key = "p:" + producer + ":" + strconv.FormatInt(seq, 10)
+	} else {
+		return "", "", 0, false
+	}
+	return key, producer, seq, true
+}
+
+// CheckDuplicatedNoLock check the message in the dedup window. If the message is duplicated
+// the original message id and write position will be returned with ErrMessageDuplicated, and the
+// producer can be acked without writing the message again.
+func (t *Topic) CheckDuplicatedNoLock(m *Message) (MessageID, BackendOffset, int32, error) {
+	if !t.dedup.enabled() {
+		return 0, 0, 0, nil
+	}
+	key, producer, seq, ok := parseDedupKeyIfAny(m)
+	if !ok {
+		return 0, 0, 0, nil
+	}
+	e, err := t.dedup.check(key, producer, seq)
+	if err != nil {
+		nsqLog.Logf("topic %v message duplicated: %v, %v", t.GetFullName(), key, err)
+	}
+	return e.id, e.offset, e.size, err
+}
+
+// FilterDuplicatedNoLock remove the messages already written in the dedup window, the duplicated
+// messages in the same batch will also be removed. The whole batch will be rejected if any producer
+// sequence is duplicated without the original message in window.
+func (t *Topic) FilterDuplicatedNoLock(msgs []*Message) ([]*Message, error) {
+	if !t.dedup.enabled() {
+		return msgs, nil
+	}
+	var filtered []*Message
+	batchKeys := make(map[string]struct{})
+	batchProducers := make(map[string]int64)
+	for i, m := range msgs {
+		key, producer, seq, ok := parseDedupKeyIfAny(m)
+		dup := false
+		if ok {
+			_, err := t.dedup.check(key, producer, seq)
+			if err == ErrProducerSeqDuplicated {
+				return nil, err
+			}
+			dup = err == ErrMessageDuplicated
+			if !dup {
+				_, dup = batchKeys[key]
+			}
+			if !dup && producer != "" {
+				if last, exist := batchProducers[producer]; exist && seq <= last {
+					return nil, ErrProducerSeqDuplicated
+				}
+			}
+		}
+		if dup {
+			if filtered == nil {
+				filtered = make([]*Message, 0, len(msgs))
+				filtered = append(filtered, msgs[:i]...)
+			}
+			continue
+		}
+		if ok {
+			batchKeys[key] = struct{}{}
+			if producer != "" {
+				batchProducers[producer] = seq
+			}
+		}
+		if filtered != nil {
+			filtered = append(filtered, m)
+		}
+	}
+	if filtered == nil {
+		return msgs, nil
+	}
+	nsqLog.Logf("topic %v filtered duplicated messages: %v", t.GetFullName(), len(msgs)-len(filtered))
+	return filtered, nil
+}
+
+func (t *Topic) updateDedupWindow(m *Message, offset BackendOffset, size int32) {
+	if !t.dedup.enabled() {
+		return
+	}
+	key, producer, seq, ok := parseDedupKeyIfAny(m)
+	if !ok {
+		return
+	}
+	t.dedup.add(dedupEntry{
+		key:      key,
+		producer: producer,
+		seq:      seq,
+		id:       m.ID,
+		offset:   offset,
+		size:     size,
+	})
+}
+
+// the raw data is the disk queue records: [record header][message data]...
+func (t *Topic) updateDedupWindowFromRawData(rawData []byte, offset BackendOffset) {
+	if !t.dedup.enabled() || !t.IsExt() {
+		return
+	}
+	walkRawRecords(rawData, func(pos int, data []byte, recordSize int) {
+		m, err := DecodeMessage(data, true)
+		if err == nil {
+			t.updateDedupWindow(m, offset+BackendOffset(pos), int32(recordSize))
+		}
+	})
+}
+
+// RebuildDedupWindowNoLock rebuild the dedup window by reading the recent messages from the given
+// start, it should be called while loading the topic since the dedup window is not persisted.
+func (t *Topic) RebuildDedupWindowNoLock(startOffset BackendOffset, startCnt int64) error {
+	if !t.dedup.enabled() {
+		return nil
+	}
+	t.dedup.reset()
+	if !t.IsExt() {
+		return nil
+	}
+	snap := t.GetDiskQueueSnapshot()
+	defer snap.Close()
+	err := snap.SeekTo(startOffset, startCnt)
+	if err != nil {
+		return err
+	}
+	for {
+		ret := snap.ReadOne()
+		if ret.Err != nil {
+			if ret.Err == io.EOF {
+				break
+			}
+			return ret.Err
+		}
+		m, err := DecodeMessage(ret.Data, true)
+		if err != nil {
+			continue
+		}
+		t.updateDedupWindow(m, ret.Offset, int32(ret.MovedSize))
+	}
+	nsqLog.Logf("topic %v dedup window rebuilt from %v: %v", t.GetFullName(), startOffset, t.dedup.Len())
+	return nil
+}
+
+func (t *Topic) GetDedupWindowSize() int {
+	if !t.dedup.enabled() {
+		return 0
+	}
+	return t.dedup.maxSize
+}
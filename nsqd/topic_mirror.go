@@ -0,0 +1,79 @@
+package nsqd
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// ErrRawDataCompacted is returned while decoding the raw data with the padding records of the
+// compacted messages, since the messages can not be written with the same offsets and counts.
+var ErrRawDataCompacted = errors.New("the raw data has the compacted messages")
+
+// DecodeRawMessages decode the messages from the raw disk queue data (pulled from the
+// other cluster), ErrRawDataCompacted is returned if any padding record found.
+// note: the message body is using the origin buffer, so never modify the raw data after decode.
+func DecodeRawMessages(rawData []byte, isExt bool) ([]*Message, error) {
+	msgs := make([]*Message, 0, 1)
+	var decodeErr error
+	err := walkRawRecords(rawData, func(pos int, data []byte, recordSize int) {
+		if decodeErr != nil {
+			return
+		}
+		if data == nil {
+			decodeErr = ErrRawDataCompacted
+			return
+		}
+		m, err := DecodeMessage(data, isExt)
+		if err != nil {
+			decodeErr = fmt.Errorf("decode message at %v failed: %v", pos, err)
+			return
+		}
+		msgs = append(msgs, m)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if decodeErr != nil {
+		return nil, decodeErr
+	}
+	return msgs, nil
+}
+
+// PutMirroredMessagesNoLock writes the messages mirrored from the other cluster, unlike
+// PutMessagesNoLock the message id, trace id and ext header are kept the same as the origin,
+// so the message id should be given and increased.
+func (t *Topic) PutMirroredMessagesNoLock(msgs []*Message) (MessageID, BackendOffset, int32, int64, BackendQueueEnd, error) {
+	if atomic.LoadInt32(&t.exitFlag) == 1 {
+		return 0, 0, 0, 0, nil, ErrExiting
+	}
+
+	wend := t.backend.GetQueueWriteEnd()
+	firstMsgID := MessageID(0)
+	firstOffset := BackendOffset(-1)
+	firstCnt := int64(0)
+	var diskEnd diskQueueEndInfo
+	batchBytes := int32(0)
+	lastID := MessageID(0)
+	for _, m := range msgs {
+		if m.ID <= 0 || m.ID <= lastID {
+			nsqLog.Logf("topic %v mirrored message id invalid: %v, last: %v", t.GetFullName(), m.ID, lastID)
+			t.ResetBackendEndNoLock(wend.Offset(), wend.TotalMsgCnt())
+			return 0, 0, 0, 0, nil, ErrInvalidMessageID
+		}
+		lastID = m.ID
+		id, offset, bytes, end, err := t.put(m, true)
+		if err != nil {
+			t.ResetBackendEndNoLock(wend.Offset(), wend.TotalMsgCnt())
+			return firstMsgID, firstOffset, batchBytes, firstCnt, &diskEnd, err
+		}
+		diskEnd = end
+		batchBytes += bytes
+		if firstOffset == BackendOffset(-1) {
+			firstOffset = offset
+			firstMsgID = id
+			firstCnt = diskEnd.TotalMsgCnt()
+		}
+	}
+	return firstMsgID, firstOffset, batchBytes, firstCnt, &diskEnd, nil
+}
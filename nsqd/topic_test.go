@@ -1,7 +1,11 @@
 package nsqd
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"sync/atomic"
 
@@ -9,6 +13,7 @@ import (
 	"path"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -828,3 +833,643 @@ func BenchmarkTopicToChannelPut(b *testing.B) {
 		topic.PutMessage(msg)
 	}
 }
+
+func TestTopicPutMessageDedup(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.DedupWindowSize = 3
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopicWithExt("test-dedup", 0, false)
+	newMsg := func(header string) *Message {
+		return NewMessageWithExt(0, []byte("body"), ext.JSON_HEADER_EXT_VER, []byte(header))
+	}
+	id1, offset1, size1, _, err := topic.PutMessage(newMsg(`{"##producer_id":"p1","##producer_seq":1}`))
+	test.Nil(t, err)
+	// retry with the same sequence should be acked with the original message
+	id, offset, size, _, err := topic.PutMessage(newMsg(`{"##producer_id":"p1","##producer_seq":1}`))
+	test.Nil(t, err)
+	test.Equal(t, id1, id)
+	test.Equal(t, offset1, offset)
+	test.Equal(t, size1, size)
+	test.Equal(t, uint64(1), topic.TotalMessageCnt())
+
+	_, _, _, _, err = topic.PutMessage(newMsg(`{"##dedup_key":"k1"}`))
+	test.Nil(t, err)
+	_, _, _, _, err = topic.PutMessage(newMsg(`{"##dedup_key":"k1"}`))
+	test.Nil(t, err)
+	test.Equal(t, uint64(2), topic.TotalMessageCnt())
+	// the message without dedup header should not be affected
+	_, _, _, _, err = topic.PutMessage(newMsg(`{"k":"v"}`))
+	test.Nil(t, err)
+	_, _, _, _, err = topic.PutMessage(newMsg(`{"k":"v"}`))
+	test.Nil(t, err)
+	test.Equal(t, uint64(4), topic.TotalMessageCnt())
+
+	// batch with the duplicated messages in window and in the same batch
+	msgs := []*Message{
+		newMsg(`{"##producer_id":"p1","##producer_seq":1}`),
+		newMsg(`{"##producer_id":"p1","##producer_seq":2}`),
+		newMsg(`{"##producer_id":"p1","##producer_seq":2}`),
+		newMsg(`{"##dedup_key":"k2"}`),
+	}
+	_, _, _, _, _, err = topic.PutMessages(msgs)
+	test.Nil(t, err)
+	test.Equal(t, uint64(6), topic.TotalMessageCnt())
+
+	// the seq 1 is out of window, but still less than the last sequence
+	_, _, _, _, err = topic.PutMessage(newMsg(`{"##producer_id":"p1","##producer_seq":1}`))
+	test.Equal(t, ErrProducerSeqDuplicated, err)
+	_, _, _, _, _, err = topic.PutMessages([]*Message{newMsg(`{"##producer_id":"p1","##producer_seq":3}`),
+		newMsg(`{"##producer_id":"p1","##producer_seq":1}`)})
+	test.Equal(t, ErrProducerSeqDuplicated, err)
+	test.Equal(t, uint64(6), topic.TotalMessageCnt())
+
+	// the rolled back message should be removed from window
+	topic.Lock()
+	defer topic.Unlock()
+	end := topic.backend.GetQueueWriteEnd()
+	_, _, size, _, err = topic.PutMessageNoLock(newMsg(`{"##producer_id":"p1","##producer_seq":3}`))
+	test.Nil(t, err)
+	_, _, _, err = topic.CheckDuplicatedNoLock(newMsg(`{"##producer_id":"p1","##producer_seq":3}`))
+	test.Equal(t, ErrMessageDuplicated, err)
+	err = topic.RollbackNoLock(end.Offset(), 1)
+	test.Nil(t, err)
+	_, _, _, err = topic.CheckDuplicatedNoLock(newMsg(`{"##producer_id":"p1","##producer_seq":3}`))
+	test.Nil(t, err)
+
+	// rebuild the window from disk
+	topic.ForceFlush()
+	err = topic.RebuildDedupWindowNoLock(0, 0)
+	test.Nil(t, err)
+	test.Equal(t, 3, topic.dedup.Len())
+	_, _, _, err = topic.CheckDuplicatedNoLock(newMsg(`{"##dedup_key":"k2"}`))
+	test.Equal(t, ErrMessageDuplicated, err)
+	_, _, _, err = topic.CheckDuplicatedNoLock(newMsg(`{"##producer_id":"p1","##producer_seq":2}`))
+	test.Equal(t, ErrMessageDuplicated, err)
+	_, _, _, err = topic.CheckDuplicatedNoLock(newMsg(`{"##producer_id":"p1","##producer_seq":1}`))
+	test.Equal(t, ErrProducerSeqDuplicated, err)
+	_, _, _, err = topic.CheckDuplicatedNoLock(newMsg(`{"##dedup_key":"k1"}`))
+	test.Equal(t, ErrMessageDuplicated, err)
+}
+
+func TestTopicCompactOldData(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.MaxBytesPerFile = 1024
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopicWithExt("test-compact", 0, false)
+	topic.SetDynamicInfo(TopicDynamicConf{AutoCommit: 1, SyncEvery: 1, Ext: true, Compact: true}, nil)
+	putMsg := func(header string, body string) {
+		_, _, _, _, err := topic.PutMessage(NewMessageWithExt(0, []byte(body), ext.JSON_HEADER_EXT_VER, []byte(header)))
+		test.Nil(t, err)
+	}
+	rounds := 10
+	for i := 0; i < rounds; i++ {
+		for k := 0; k < 3; k++ {
+			putMsg(fmt.Sprintf(`{"##compact_key":"k%v"}`, k), fmt.Sprintf("k%v-%v", k, i))
+		}
+		putMsg(`{"k":"v"}`, "nokey")
+	}
+	putMsg(`{"##compact_key":"k0","##compact_tombstone":true}`, "deleted")
+	for i := 0; i < 30; i++ {
+		putMsg(`{"##compact_key":"k9"}`, fmt.Sprintf("k9-%v", i))
+	}
+	topic.ForceFlush()
+	end := topic.backend.GetQueueReadEnd()
+	test.Equal(t, true, end.(*diskQueueEndInfo).EndOffset.FileNum > 2)
+
+	readAll := func() map[string]int {
+		reader := newDiskQueueReaderWithMetaStorage(getBackendName(topic.tname, topic.partition), "test-compact-reader", topic.dataPath,
+			opts.MaxBytesPerFile, 4, 1<<20, 1, time.Second, nil, false)
+		defer reader.Close()
+		reader.UpdateQueueEnd(end, false)
+		bodies := make(map[string]int)
+		lastEnd := BackendOffset(0)
+		lastCnt := int64(0)
+		for {
+			r, hasData := reader.TryReadOne()
+			if !hasData {
+				break
+			}
+			test.Nil(t, r.Err)
+			// the padding of the compacted messages is returned with the next message
+			test.Equal(t, lastEnd, r.Offset)
+			lastEnd = r.Offset + r.MovedSize
+			lastCnt = r.CurCnt
+			msg, err := DecodeMessage(r.Data, true)
+			test.Nil(t, err)
+			bodies[string(msg.Body)]++
+		}
+		test.Equal(t, end.Offset(), lastEnd)
+		test.Equal(t, end.TotalMsgCnt(), lastCnt)
+		return bodies
+	}
+	bodies := readAll()
+	test.Equal(t, rounds, bodies["nokey"])
+	test.Equal(t, rounds*3+30+2, len(bodies))
+
+	err := topic.TryCompactOldData(time.Hour)
+	test.Nil(t, err)
+	newEnd := topic.backend.GetQueueReadEnd()
+	test.Equal(t, end.Offset(), newEnd.Offset())
+	test.Equal(t, end.TotalMsgCnt(), newEnd.TotalMsgCnt())
+	bodies = readAll()
+	test.Equal(t, rounds, bodies["nokey"])
+	test.Equal(t, 1, bodies["deleted"])
+	test.Equal(t, 0, bodies["k0-9"])
+	for k := 1; k < 3; k++ {
+		test.Equal(t, 1, bodies[fmt.Sprintf("k%v-9", k)])
+		test.Equal(t, 0, bodies[fmt.Sprintf("k%v-8", k)])
+	}
+	test.Equal(t, 1, bodies["k9-29"])
+	test.Equal(t, 0, bodies["k9-0"])
+
+	// the snapshot should skip the padding
+	snap := topic.GetDiskQueueSnapshot()
+	err = snap.SeekTo(0, 0)
+	test.Nil(t, err)
+	snapCnt := 0
+	for {
+		r := snap.ReadOne()
+		if r.Err == io.EOF {
+			break
+		}
+		test.Nil(t, r.Err)
+		snapCnt++
+	}
+	readCnt := 0
+	for _, c := range bodies {
+		readCnt += c
+	}
+	test.Equal(t, readCnt, snapCnt)
+	test.Equal(t, true, readCnt < rounds*4+31)
+
+	// the tombstone should be removed after the retention
+	err = topic.TryCompactOldData(0)
+	test.Nil(t, err)
+	bodies = readAll()
+	test.Equal(t, 0, bodies["deleted"])
+	test.Equal(t, rounds, bodies["nokey"])
+}
+
+func TestTopicPutMirroredMessages(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	source := nsqd.GetTopicWithExt("test-mirror-source", 0, false)
+	msgNum := 3
+	for i := 0; i < msgNum; i++ {
+		msg := NewMessageWithExt(0, []byte("body"+strconv.Itoa(i)), ext.JSON_HEADER_EXT_VER, []byte(`{"k":"v"}`))
+		msg.TraceID = uint64(i + 100)
+		_, _, _, _, err := source.PutMessage(msg)
+		test.Nil(t, err)
+	}
+	source.ForceFlush()
+	end := source.backend.GetQueueWriteEnd()
+	snap := source.GetDiskQueueSnapshot()
+	rawData, err := snap.ReadRaw(int32(end.Offset()))
+	snap.Close()
+	test.Nil(t, err)
+
+	msgs, err := DecodeRawMessages(rawData, true)
+	test.Nil(t, err)
+	test.Equal(t, msgNum, len(msgs))
+
+	mirror := nsqd.GetTopicWithExt("test-mirror-dest", 0, false)
+	mirror.Lock()
+	id, offset, _, _, _, err := mirror.PutMirroredMessagesNoLock(msgs)
+	mirror.Unlock()
+	test.Nil(t, err)
+	test.Equal(t, msgs[0].ID, id)
+	test.Equal(t, BackendOffset(0), offset)
+	test.Equal(t, uint64(msgNum), mirror.TotalMessageCnt())
+	mirror.ForceFlush()
+
+	snap = mirror.GetDiskQueueSnapshot()
+	mirrorData, err := snap.ReadRaw(int32(mirror.backend.GetQueueWriteEnd().Offset()))
+	snap.Close()
+	test.Nil(t, err)
+	mirrored, err := DecodeRawMessages(mirrorData, true)
+	test.Nil(t, err)
+	test.Equal(t, msgNum, len(mirrored))
+	for i, m := range mirrored {
+		test.Equal(t, msgs[i].ID, m.ID)
+		test.Equal(t, uint64(i+100), m.TraceID)
+		test.Equal(t, ext.JSON_HEADER_EXT_VER, m.ExtVer)
+		test.Equal(t, []byte(`{"k":"v"}`), m.ExtBytes)
+		test.Equal(t, []byte("body"+strconv.Itoa(i)), m.Body)
+	}
+
+	// the message id should be given
+	mirror.Lock()
+	_, _, _, _, _, err = mirror.PutMirroredMessagesNoLock([]*Message{NewMessage(0, []byte("body"))})
+	mirror.Unlock()
+	test.Equal(t, ErrInvalidMessageID, err)
+	test.Equal(t, uint64(msgNum), mirror.TotalMessageCnt())
+}
+
+func TestTopicRecordChecksum(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.QueueRecordChecksum = true
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test-checksum", 0, false)
+	msgNum := 3
+	for i := 0; i < msgNum; i++ {
+		_, _, _, _, err := topic.PutMessage(NewMessage(0, []byte("body")))
+		test.Nil(t, err)
+	}
+	topic.ForceFlush()
+	end := topic.backend.GetQueueWriteEnd()
+	snap := topic.GetDiskQueueSnapshot()
+	rawData, err := snap.ReadRaw(int32(end.Offset()))
+	snap.Close()
+	test.Nil(t, err)
+
+	// the replica should verify the raw data from leader
+	replica := nsqd.GetTopic("test-checksum-replica", 0, false)
+	replica.Lock()
+	_, err = replica.PutRawDataOnReplica(rawData, 0, int64(len(rawData)), int32(msgNum))
+	replica.Unlock()
+	test.Nil(t, err)
+	test.Equal(t, uint64(msgNum), replica.TotalMessageCnt())
+	corrupt := make([]byte, len(rawData))
+	copy(corrupt, rawData)
+	corrupt[len(corrupt)-1]++
+	replica.Lock()
+	_, err = replica.PutRawDataOnReplica(corrupt, end.Offset(), int64(len(corrupt)), int32(msgNum))
+	replica.Unlock()
+	test.Equal(t, ErrRecordChecksumMismatch, err)
+	test.Equal(t, uint64(msgNum), replica.TotalMessageCnt())
+	test.Equal(t, end.Offset(), replica.backend.GetQueueWriteEnd().Offset())
+
+	// the channel read the corrupt data should mark the topic need fix
+	f, err := os.OpenFile(topic.backend.fileName(0), os.O_RDWR, 0644)
+	test.Nil(t, err)
+	_, err = f.WriteAt([]byte("B"), int64(end.Offset())-1)
+	test.Nil(t, err)
+	f.Close()
+	test.Equal(t, false, topic.IsDataNeedFix())
+	ch := topic.GetChannel("ch")
+	err = ch.SetConsumeOffset(0, 0, true)
+	test.Nil(t, err)
+	for i := 0; i < msgNum-1; i++ {
+		select {
+		case <-ch.GetClientMsgChan():
+		case <-time.After(time.Second * 3):
+			t.Fatal("should read the valid messages")
+		}
+	}
+	start := time.Now()
+	for !topic.IsDataNeedFix() {
+		if time.Since(start) > time.Second*5 {
+			t.Fatal("topic should be marked as need fix")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestTopicRawCaptureForReplica(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test-raw-capture", 0, false)
+	topic.Lock()
+	test.Equal(t, false, topic.StartRawCaptureNoLock())
+	topic.Unlock()
+	topic.SetDynamicInfo(TopicDynamicConf{
+		AutoCommit:  1,
+		Compression: "snappy",
+	}, nil)
+	body := bytes.Repeat([]byte("body"), 256)
+	msgs := make([]*Message, 0, 3)
+	for i := 0; i < cap(msgs); i++ {
+		msgs = append(msgs, NewMessage(0, body))
+	}
+	topic.Lock()
+	test.Equal(t, true, topic.StartRawCaptureNoLock())
+	_, offset, wsize, _, _, err := topic.PutMessagesNoLock(msgs)
+	rawData := topic.StopRawCaptureNoLock()
+	topic.Unlock()
+	test.Nil(t, err)
+	test.Equal(t, int(wsize), len(rawData))
+
+	// the replica without compression should write the same records as the leader
+	replica := nsqd.GetTopic("test-raw-capture-replica", 0, false)
+	replica.Lock()
+	_, err = replica.PutRawDataOnReplica(rawData, offset, int64(wsize), int32(len(msgs)))
+	replica.Unlock()
+	test.Nil(t, err)
+	test.Equal(t, topic.backend.GetQueueWriteEnd().Offset(), replica.backend.GetQueueWriteEnd().Offset())
+	test.Equal(t, topic.backend.GetQueueWriteEnd().TotalMsgCnt(), replica.backend.GetQueueWriteEnd().TotalMsgCnt())
+	replica.ForceFlush()
+	rsnap := replica.GetDiskQueueSnapshot()
+	defer rsnap.Close()
+	for i := 0; i < len(msgs); i++ {
+		r := rsnap.ReadOne()
+		test.Nil(t, r.Err)
+		m, err := DecodeMessage(r.Data, false)
+		test.Nil(t, err)
+		test.Equal(t, msgs[i].ID, m.ID)
+		test.Equal(t, body, m.Body)
+	}
+}
+
+func TestTopicCompression(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.QueueRecordChecksum = true
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test-compression", 0, false)
+	topic.SetDynamicInfo(TopicDynamicConf{
+		AutoCommit:  1,
+		Compression: "zstd",
+	}, nil)
+	test.Equal(t, CompressZstd, topic.backend.GetCompressCodec())
+	ch := topic.GetChannel("ch")
+	body := bytes.Repeat([]byte("body"), 256)
+	msgNum := 3
+	for i := 0; i < msgNum; i++ {
+		_, _, wsize, _, err := topic.PutMessage(NewMessage(0, body))
+		test.Nil(t, err)
+		test.Equal(t, true, wsize < int32(len(body)/2))
+	}
+	topic.ForceFlush()
+	for i := 0; i < msgNum; i++ {
+		select {
+		case m := <-ch.GetClientMsgChan():
+			test.Equal(t, body, m.Body)
+		case <-time.After(time.Second * 3):
+			t.Fatal("should read the compressed messages")
+		}
+	}
+
+	// the replica should write the raw compressed data from leader
+	end := topic.backend.GetQueueWriteEnd()
+	snap := topic.GetDiskQueueSnapshot()
+	rawData, err := snap.ReadRaw(int32(end.Offset()))
+	snap.Close()
+	test.Nil(t, err)
+	replica := nsqd.GetTopic("test-compression-replica", 0, false)
+	replica.SetDynamicInfo(TopicDynamicConf{
+		AutoCommit:  1,
+		Compression: "zstd",
+	}, nil)
+	replica.Lock()
+	_, err = replica.PutRawDataOnReplica(rawData, 0, int64(len(rawData)), int32(msgNum))
+	replica.Unlock()
+	test.Nil(t, err)
+	test.Equal(t, end.Offset(), replica.backend.GetQueueWriteEnd().Offset())
+	rsnap := replica.GetDiskQueueSnapshot()
+	defer rsnap.Close()
+	for i := 0; i < msgNum; i++ {
+		r := rsnap.ReadOne()
+		test.Nil(t, r.Err)
+		m, err := DecodeMessage(r.Data, false)
+		test.Nil(t, err)
+		test.Equal(t, body, m.Body)
+	}
+
+	// disable the compression for the new messages
+	topic.SetDynamicInfo(TopicDynamicConf{AutoCommit: 1}, nil)
+	test.Equal(t, CompressNone, topic.backend.GetCompressCodec())
+	_, _, wsize, _, err := topic.PutMessage(NewMessage(0, body))
+	test.Nil(t, err)
+	test.Equal(t, true, wsize > int32(len(body)))
+	topic.ForceFlush()
+	select {
+	case m := <-ch.GetClientMsgChan():
+		test.Equal(t, body, m.Body)
+	case <-time.After(time.Second * 3):
+		t.Fatal("should read the uncompressed message")
+	}
+}
+
+func TestTopicSearchMsgByTimestamp(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.QueueTimeIndexInterval = time.Second * 3
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test-search-timestamp", 0, false)
+	_, _, err := topic.SearchMsgByTimestamp(time.Now().UnixNano())
+	test.Equal(t, ErrTimeIndexNotAvailable, err)
+	base := time.Now().Add(-time.Hour).UnixNano()
+	msgNum := 20
+	for i := 0; i < msgNum; i++ {
+		msg := NewMessage(0, []byte("body"))
+		msg.Timestamp = base + int64(i)*int64(time.Second)
+		_, _, _, _, err := topic.PutMessage(msg)
+		test.Nil(t, err)
+	}
+	topic.ForceFlush()
+
+	for _, i := range []int{0, 1, 5, 6, 13, 19} {
+		offset, cnt, err := topic.SearchMsgByTimestamp(base + int64(i)*int64(time.Second) - 1)
+		test.Nil(t, err)
+		test.Equal(t, int64(i), cnt)
+		snap := topic.GetDiskQueueSnapshot()
+		err = snap.SeekTo(offset, cnt)
+		test.Nil(t, err)
+		ret := snap.ReadOne()
+		snap.Close()
+		test.Nil(t, ret.Err)
+		m, err := DecodeMessage(ret.Data, false)
+		test.Nil(t, err)
+		test.Equal(t, base+int64(i)*int64(time.Second), m.Timestamp)
+	}
+	// all the messages are older, should seek to the end
+	offset, cnt, err := topic.SearchMsgByTimestamp(time.Now().UnixNano())
+	test.Nil(t, err)
+	test.Equal(t, int64(msgNum), cnt)
+	test.Equal(t, topic.backend.GetQueueWriteEnd().Offset(), offset)
+}
+
+func TestTopicCleanOldDataWithArchive(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.MaxBytesPerFile = 1024 * 16
+	opts.ArchiveType = ArchiveTypeLocal
+	opts.ArchivePath, _ = ioutil.TempDir("", "nsq-archive")
+	defer os.RemoveAll(opts.ArchivePath)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test-archive", 0, false)
+	test.Equal(t, true, topic.IsArchiveEnabled())
+	changeDynamicConfAutCommit(topic.dynamicConf)
+	atomic.StoreInt32(&topic.dynamicConf.RetentionDay, 1)
+
+	msgNum := 100
+	channel := topic.GetChannel("ch")
+	ids := make([]MessageID, 0, msgNum)
+	offsets := make([]BackendOffset, 0, msgNum)
+	for i := 0; i < msgNum; i++ {
+		msg := NewMessage(0, make([]byte, 1000))
+		id, offset, _, _, err := topic.PutMessage(msg)
+		test.Nil(t, err)
+		ids = append(ids, id)
+		offsets = append(offsets, offset)
+	}
+	topic.ForceFlush()
+	for i := 0; i < msgNum; i++ {
+		msg := <-channel.clientMsgChan
+		channel.ConfirmBackendQueue(msg)
+	}
+	_, err := topic.TryCleanOldData(1, false, 0)
+	test.Nil(t, err)
+	start := topic.backend.GetQueueReadStart().(*diskQueueEndInfo)
+	test.Equal(t, true, start.EndOffset.FileNum > 1)
+	_, err = os.Stat(topic.backend.fileName(0))
+	test.Equal(t, true, os.IsNotExist(err))
+	keys, err := topic.archive.archive.List(topic.GetFullName() + "/")
+	test.Nil(t, err)
+	test.Equal(t, true, len(keys) >= 2*int(start.EndOffset.FileNum))
+
+	// read all from the beginning, the cleaned should be read from archive
+	snap := topic.GetDiskQueueSnapshot()
+	err = snap.ResetSeekTo(0, 0)
+	test.Nil(t, err)
+	for i := 0; i < msgNum; i++ {
+		ret := snap.ReadOne()
+		test.Nil(t, ret.Err)
+		test.Equal(t, offsets[i], ret.Offset)
+		test.Equal(t, int64(i+1), ret.CurCnt)
+		m, err := DecodeMessage(ret.Data, false)
+		test.Nil(t, err)
+		test.Equal(t, ids[i], m.ID)
+	}
+	snap.Close()
+
+	index := 5
+	offset, cnt, err := topic.SearchArchivedMsgOffset(offsets[index] + 1)
+	test.Nil(t, err)
+	test.Equal(t, offsets[index+1], offset)
+	test.Equal(t, int64(index+1), cnt)
+	_, _, err = topic.SearchArchivedMsgOffset(start.Offset())
+	test.Equal(t, ErrReadQueueNotCleaned, err)
+
+	// reset the channel to the cleaned offset, should consume all the messages after it
+	err = channel.SetConsumeOffset(offsets[index], int64(index), true)
+	test.Nil(t, err)
+	for i := index; i < msgNum; i++ {
+		select {
+		case msg := <-channel.clientMsgChan:
+			test.Equal(t, ids[i], msg.ID)
+			channel.ConfirmBackendQueue(msg)
+		case <-time.After(time.Second * 3):
+			t.Fatalf("timeout while consume message %v", i)
+		}
+	}
+	test.Equal(t, topic.backend.GetQueueReadEnd().Offset(), channel.GetConfirmed().Offset())
+}
+
+type failedPutArchive struct {
+	SegmentArchive
+	failPrefix atomic.Value
+}
+
+func (a *failedPutArchive) Put(key string, r io.Reader, size int64) error {
+	if prefix, _ := a.failPrefix.Load().(string); prefix != "" && strings.HasPrefix(key, prefix) {
+		return errors.New("put failed")
+	}
+	return a.SegmentArchive.Put(key, r, size)
+}
+
+func TestTopicCleanOldDataArchiveFailed(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.MaxBytesPerFile = 1024 * 16
+	opts.ArchiveType = ArchiveTypeLocal
+	opts.ArchivePath, _ = ioutil.TempDir("", "nsq-archive")
+	defer os.RemoveAll(opts.ArchivePath)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test-archive-failed", 0, false)
+	failedArchive := &failedPutArchive{SegmentArchive: topic.archive.archive}
+	topic.archive.archive = failedArchive
+	changeDynamicConfAutCommit(topic.dynamicConf)
+	atomic.StoreInt32(&topic.dynamicConf.RetentionDay, 1)
+
+	msgNum := 100
+	channel := topic.GetChannel("ch")
+	ids := make([]MessageID, 0, msgNum)
+	for i := 0; i < msgNum; i++ {
+		msg := NewMessage(0, make([]byte, 1000))
+		id, _, _, _, err := topic.PutMessage(msg)
+		test.Nil(t, err)
+		ids = append(ids, id)
+	}
+	topic.ForceFlush()
+	for i := 0; i < msgNum; i++ {
+		msg := <-channel.clientMsgChan
+		channel.ConfirmBackendQueue(msg)
+	}
+
+	// the queue start should not move if the first segment failed to archive
+	failedArchive.failPrefix.Store(topic.GetFullName() + "/")
+	_, err := topic.TryCleanOldData(1, false, 0)
+	test.NotNil(t, err)
+	test.Equal(t, int64(0), topic.backend.GetQueueReadStart().(*diskQueueEndInfo).EndOffset.FileNum)
+	_, err = os.Stat(topic.backend.fileName(0))
+	test.Nil(t, err)
+
+	// the clean should stop at the segment failed to archive
+	_, start, end, err := getQueueFileOffsetMeta(topic.backend.fileName(1))
+	test.Nil(t, err)
+	failedArchive.failPrefix.Store(topic.archive.segmentKey(BackendOffset(start), BackendOffset(end), ""))
+	_, err = topic.TryCleanOldData(1, false, 0)
+	test.Nil(t, err)
+	test.Equal(t, int64(1), topic.backend.GetQueueReadStart().(*diskQueueEndInfo).EndOffset.FileNum)
+	test.Equal(t, BackendOffset(start), topic.backend.GetQueueReadStart().Offset())
+	_, err = os.Stat(topic.backend.fileName(1))
+	test.Nil(t, err)
+
+	// the replica should not clean the segment not archived by the leader
+	failedArchive.failPrefix.Store("")
+	topic.SetArchiveUpload(false)
+	_, err = topic.TryCleanOldData(1, false, 0)
+	test.Equal(t, ErrArchiveKeyNotFound, err)
+	test.Equal(t, int64(1), topic.backend.GetQueueReadStart().(*diskQueueEndInfo).EndOffset.FileNum)
+
+	topic.SetArchiveUpload(true)
+	_, err = topic.TryCleanOldData(1, false, 0)
+	test.Nil(t, err)
+	test.Equal(t, true, topic.backend.GetQueueReadStart().(*diskQueueEndInfo).EndOffset.FileNum > 1)
+
+	// all the cleaned can be read back from the archive
+	snap := topic.GetDiskQueueSnapshot()
+	defer snap.Close()
+	err = snap.ResetSeekTo(0, 0)
+	test.Nil(t, err)
+	for i := 0; i < msgNum; i++ {
+		ret := snap.ReadOne()
+		test.Nil(t, ret.Err)
+		m, err := DecodeMessage(ret.Data, false)
+		test.Nil(t, err)
+		test.Equal(t, ids[i], m.ID)
+	}
+}
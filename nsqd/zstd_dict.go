@@ -0,0 +1,143 @@
+package nsqd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Most messages are too small for zstd to find the repeated data inside a single record, the
+// dictionary trained from the sample messages of the topics (zstd --train) provides the
+// common content, so each record can still be compressed and read on its own. The dictionary
+// id is kept in the zstd frame of each record, the old dictionaries are only used for decompressing.
+const ZstdDictFileSuffix = ".dict"
+
+var (
+	ErrZstdDictInvalid = errors.New("invalid zstd dictionary")
+
+	zstdDictMagic = []byte{0x37, 0xa4, 0x30, 0xec}
+	zstdDicts     atomic.Value
+)
+
+// ZstdDicts hold all the zstd dictionaries by the dictionary id, the new records will be
+// compressed using the active dictionary.
+type ZstdDicts struct {
+	dicts    map[uint32][]byte
+	activeID uint32
+	encoder  *zstd.Encoder
+	decoder  *zstd.Decoder
+}
+
+// LoadZstdDicts load all the dictionary files with the .dict suffix in the directory. The
+// largest dictionary id will be the active dictionary if activeID is 0.
+func LoadZstdDicts(dir string, activeID uint32) (*ZstdDicts, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*"+ZstdDictFileSuffix))
+	if err != nil {
+		return nil, err
+	}
+	dicts := make([][]byte, 0, len(files))
+	for _, fileName := range files {
+		data, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			return nil, err
+		}
+		dicts = append(dicts, data)
+	}
+	return NewZstdDicts(dicts, activeID)
+}
+
+func NewZstdDicts(dicts [][]byte, activeID uint32) (*ZstdDicts, error) {
+	zd := &ZstdDicts{
+		dicts: make(map[uint32][]byte, len(dicts)),
+	}
+	maxID := uint32(0)
+	for _, d := range dicts {
+		if len(d) < 8 || string(d[:4]) != string(zstdDictMagic) {
+			return nil, ErrZstdDictInvalid
+		}
+		id := binary.LittleEndian.Uint32(d[4:8])
+		if id == 0 {
+			return nil, ErrZstdDictInvalid
+		}
+		if _, ok := zd.dicts[id]; ok {
+			return nil, fmt.Errorf("duplicate zstd dictionary id %v", id)
+		}
+		zd.dicts[id] = d
+		if id > maxID {
+			maxID = id
+		}
+	}
+	if len(zd.dicts) == 0 {
+		return nil, errors.New("no zstd dictionary found")
+	}
+	if activeID == 0 {
+		activeID = maxID
+	}
+	if _, ok := zd.dicts[activeID]; !ok {
+		return nil, fmt.Errorf("active zstd dictionary %v not found", activeID)
+	}
+	zd.activeID = activeID
+	// compressing with the dictionary costs more cpu since the dictionary content is loaded as
+	// the history of each record, so the topics should not wait for each other.
+	concurrency := runtime.GOMAXPROCS(0)
+	var err error
+	zd.encoder, err = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(concurrency),
+		zstd.WithEncoderDict(zd.dicts[activeID]))
+	if err != nil {
+		return nil, fmt.Errorf("load zstd dictionary %v failed: %v", activeID, err)
+	}
+	all := make([][]byte, 0, len(zd.dicts))
+	for _, d := range zd.dicts {
+		all = append(all, d)
+	}
+	zd.decoder, err = zstd.NewReader(nil, zstd.WithDecoderConcurrency(concurrency), zstd.WithDecoderDicts(all...))
+	if err != nil {
+		return nil, fmt.Errorf("load zstd dictionaries failed: %v", err)
+	}
+	return zd, nil
+}
+
+func (zd *ZstdDicts) ActiveDictID() uint32 {
+	return zd.activeID
+}
+
+// DictFingerprint return all the dictionary ids with the checksum of each dictionary, the nodes
+// with the same dictionaries have the same fingerprint. Empty for the nil dictionaries.
+func (zd *ZstdDicts) DictFingerprint() string {
+	if zd == nil {
+		return ""
+	}
+	ids := make([]int, 0, len(zd.dicts))
+	for id := range zd.dicts {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+	fps := make([]string, 0, len(ids))
+	for _, id := range ids {
+		fps = append(fps, fmt.Sprintf("%v:%08x", id, recordChecksum(zd.dicts[uint32(id)])))
+	}
+	return strings.Join(fps, ",")
+}
+
+// SetZstdDicts set the dictionaries used by all the zstd compressed topics on this node, nil to
+// disable. The replicas write the compressed records from the leader as is, so the node should
+// have all the dictionaries of the leader before joining the isr.
+func SetZstdDicts(zd *ZstdDicts) {
+	zstdDicts.Store(&zd)
+}
+
+func GetZstdDicts() *ZstdDicts {
+	zd, ok := zstdDicts.Load().(**ZstdDicts)
+	if !ok {
+		return nil
+	}
+	return *zd
+}
@@ -0,0 +1,176 @@
+package nsqd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/youzan/nsq/internal/test"
+)
+
+// testdata/zstd_test.dict is trained by "zstd --train --maxdict=16384 --dictID=1001" from
+// 2000 messages of testSampleMessages with the seed 1.
+const testZstdDictID = 1001
+
+func testZstdDictData() ([]byte, error) {
+	return ioutil.ReadFile(path.Join("testdata", "zstd_test.dict"))
+}
+
+// testSampleMessages return the small json messages like the order events in the business topics.
+func testSampleMessages(seed int64, n int) [][]byte {
+	r := rand.New(rand.NewSource(seed))
+	status := []string{"created", "paid", "shipped", "delivered", "refunded", "closed"}
+	channels := []string{"app", "web", "mini_program", "offline"}
+	msgs := make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		items := make([]map[string]interface{}, 1+r.Intn(3))
+		for j := range items {
+			items[j] = map[string]interface{}{
+				"sku_id":   fmt.Sprintf("SKU%08d", r.Intn(100000000)),
+				"quantity": 1 + r.Intn(5),
+				"price":    float64(r.Intn(100000)) / 100,
+			}
+		}
+		event := map[string]interface{}{
+			"event_id":   fmt.Sprintf("%016x", r.Uint64()),
+			"event_type": "order_status_changed",
+			"order_no":   fmt.Sprintf("E%d%08d", 20260000+r.Intn(1000), r.Intn(100000000)),
+			"shop_id":    r.Intn(1000000),
+			"buyer_id":   r.Intn(100000000),
+			"status":     status[r.Intn(len(status))],
+			"channel":    channels[r.Intn(len(channels))],
+			"pay_amount": float64(r.Intn(1000000)) / 100,
+			"items":      items,
+			"created_at": 1790000000000 + r.Int63n(100000000),
+			"version":    1 + r.Intn(10),
+		}
+		data, _ := json.Marshal(event)
+		msgs = append(msgs, data)
+	}
+	return msgs
+}
+
+func TestLoadZstdDicts(t *testing.T) {
+	dictData, err := testZstdDictData()
+	test.Nil(t, err)
+	tmpDir, err := ioutil.TempDir("", "zstd-dict")
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	_, err = LoadZstdDicts(tmpDir, 0)
+	test.NotNil(t, err)
+
+	test.Nil(t, ioutil.WriteFile(path.Join(tmpDir, "1001.dict"), dictData, 0644))
+	// the other files are ignored
+	test.Nil(t, ioutil.WriteFile(path.Join(tmpDir, "README"), []byte("zstd dictionaries"), 0644))
+	zd, err := LoadZstdDicts(tmpDir, 0)
+	test.Nil(t, err)
+	test.Equal(t, uint32(testZstdDictID), zd.ActiveDictID())
+	test.Equal(t, fmt.Sprintf("%v:%08x", testZstdDictID, recordChecksum(dictData)), zd.DictFingerprint())
+	_, err = LoadZstdDicts(tmpDir, 1002)
+	test.NotNil(t, err)
+
+	// the same dictionary id in different files
+	test.Nil(t, ioutil.WriteFile(path.Join(tmpDir, "1001-copy.dict"), dictData, 0644))
+	_, err = LoadZstdDicts(tmpDir, 0)
+	test.NotNil(t, err)
+	test.Nil(t, os.Remove(path.Join(tmpDir, "1001-copy.dict")))
+
+	test.Nil(t, ioutil.WriteFile(path.Join(tmpDir, "invalid.dict"), []byte("invalid dictionary"), 0644))
+	_, err = LoadZstdDicts(tmpDir, 0)
+	test.Equal(t, ErrZstdDictInvalid, err)
+
+	var nilDicts *ZstdDicts
+	test.Equal(t, "", nilDicts.DictFingerprint())
+}
+
+func TestCompressRecordWithZstdDict(t *testing.T) {
+	msgs := testSampleMessages(2, 100)
+	plainCompressed := make([][]byte, 0, len(msgs))
+	for _, msg := range msgs {
+		data, codec := compressRecord(CompressZstd, msg, nil)
+		if codec == CompressZstd {
+			data = append([]byte(nil), data...)
+		}
+		plainCompressed = append(plainCompressed, data)
+	}
+
+	dictData, err := testZstdDictData()
+	test.Nil(t, err)
+	zd, err := NewZstdDicts([][]byte{dictData}, 0)
+	test.Nil(t, err)
+	SetZstdDicts(zd)
+	defer SetZstdDicts(nil)
+	dictTotal := 0
+	plainTotal := 0
+	dictCompressed := make([][]byte, 0, len(msgs))
+	for i, msg := range msgs {
+		data, codec := compressRecord(CompressZstd, msg, nil)
+		test.Equal(t, CompressZstd, codec)
+		dictCompressed = append(dictCompressed, data)
+		dictTotal += len(data)
+		plainTotal += len(plainCompressed[i])
+
+		decompressed, err := decompressRecord(CompressZstd, data)
+		test.Nil(t, err)
+		test.Equal(t, msg, decompressed)
+		// the records compressed before the dictionary loaded are still readable
+		decompressed, err = decompressRecord(CompressZstd, plainCompressed[i])
+		test.Nil(t, err)
+		test.Equal(t, msg, decompressed)
+	}
+	t.Logf("compressed %v bytes without dictionary, %v bytes with dictionary", plainTotal, dictTotal)
+	test.Equal(t, true, dictTotal*2 < plainTotal)
+
+	// the dictionary is needed to read the records compressed with it
+	SetZstdDicts(nil)
+	_, err = decompressRecord(CompressZstd, dictCompressed[0])
+	test.Equal(t, zstd.ErrUnknownDictionary, err)
+}
+
+// BenchmarkCompressRecordRatio report the compression ratio (plain size / record data size)
+// of the small json messages compressed one by one.
+func BenchmarkCompressRecordRatio(b *testing.B) {
+	msgs := testSampleMessages(2, 1000)
+	dictData, err := testZstdDictData()
+	if err != nil {
+		b.Fatal(err)
+	}
+	zd, err := NewZstdDicts([][]byte{dictData}, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	cases := []struct {
+		name  string
+		codec CompressCodec
+		dicts *ZstdDicts
+	}{
+		{"none", CompressNone, nil},
+		{"snappy", CompressSnappy, nil},
+		{"zstd", CompressZstd, nil},
+		{"zstd-dict", CompressZstd, zd},
+	}
+	for _, c := range cases {
+		b.Run(c.name, func(b *testing.B) {
+			SetZstdDicts(c.dicts)
+			defer SetZstdDicts(nil)
+			buf := make([]byte, 0, snappy.MaxEncodedLen(4096))
+			plainSize := 0
+			recordSize := 0
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				msg := msgs[i%len(msgs)]
+				data, _ := compressRecord(c.codec, msg, buf)
+				plainSize += len(msg)
+				recordSize += len(data)
+			}
+			b.SetBytes(int64(plainSize / b.N))
+			b.ReportMetric(float64(plainSize)/float64(recordSize), "ratio")
+		})
+	}
+}
@@ -4,9 +4,11 @@ import (
 	"crypto/tls"
 	"errors"
 	"net"
+	"strconv"
 	"sync/atomic"
 	"time"
 
+	simpleJson "github.com/bitly/go-simplejson"
 	"github.com/youzan/nsq/consistence"
 	"github.com/youzan/nsq/internal/ext"
 	"github.com/youzan/nsq/nsqd"
@@ -22,6 +24,10 @@ var (
 	testPopQueueTimeout int32
 )
 
+var (
+	ErrDeadLetterTopicNotFound = errors.New("no dead letter topic partition can be written on this node")
+)
+
 func incrServerPubFailed() {
 	atomic.AddInt64(&serverPubFailedCnt, 1)
 }
@@ -146,6 +152,34 @@ func (c *context) checkConsumeForMasterWrite(topic string, part int) bool {
 	return c.nsqdCoord.IsMineConsumeLeaderForTopic(topic, part)
 }
 
+func (c *context) checkConsumerGroupOwner(topic string, part int, channel string, client *nsqd.ClientV2) error {
+	if c.nsqdCoord == nil {
+		return nil
+	}
+	memberID, gen := client.GetGroupMember()
+	return c.nsqdCoord.CheckConsumerGroupOwner(topic, part, channel, memberID, gen)
+}
+
+// checkSubscribedGroupOwner check the owner of the ordered subscribed client, so the subscriber
+// can be fenced after the consumer group rebalanced.
+func (c *context) checkSubscribedGroupOwner(client *nsqd.ClientV2) error {
+	if c.nsqdCoord == nil || client.Channel == nil || !client.Channel.IsOrdered() {
+		return nil
+	}
+	memberID, gen := client.GetGroupMember()
+	return c.nsqdCoord.CheckConsumerGroupOwnerCached(client.Channel.GetTopicName(), client.Channel.GetTopicPart(),
+		client.Channel.GetName(), memberID, gen)
+}
+
+// forgetSubscribedGroupOwner remove the cached group owner of the ordered channel after the client unsubscribed
+func (c *context) forgetSubscribedGroupOwner(client *nsqd.ClientV2) {
+	if c.nsqdCoord == nil || client.Channel == nil || !client.Channel.IsOrdered() {
+		return
+	}
+	c.nsqdCoord.ForgetConsumerGroupOwner(client.Channel.GetTopicName(), client.Channel.GetTopicPart(),
+		client.Channel.GetName())
+}
+
 func (c *context) checkForMasterWrite(topic string, part int) bool {
 	if c.nsqdCoord == nil {
 		return true
@@ -156,6 +190,8 @@ func (c *context) checkForMasterWrite(topic string, part int) bool {
 	return c.nsqdCoord.IsMineLeaderForTopic(topic, part)
 }
 
+// PutMessageObj write the internal message of the topic partition itself (requeue, delayed
+// update, delayed pub release) or the scheduled pub message from the producer.
 func (c *context) PutMessageObj(topic *nsqd.Topic,
 	msg *nsqd.Message) (nsqd.MessageID, nsqd.BackendOffset, int32, nsqd.BackendQueueEnd, error) {
 	if c.nsqdCoord == nil {
@@ -182,7 +218,7 @@ func (c *context) PutMessageObj(topic *nsqd.Topic,
 }
 
 func (c *context) PutMessage(topic *nsqd.Topic,
-	body []byte, extContent ext.IExtContent, traceID uint64) (nsqd.MessageID, nsqd.BackendOffset, int32, nsqd.BackendQueueEnd, error) {
+	body []byte, extContent ext.IExtContent, traceID uint64, ackMode nsqd.PubAckMode) (nsqd.MessageID, nsqd.BackendOffset, int32, nsqd.BackendQueueEnd, error) {
 
 	var msg *nsqd.Message
 	if !topic.IsExt() {
@@ -193,17 +229,19 @@ func (c *context) PutMessage(topic *nsqd.Topic,
 	msg.TraceID = traceID
 
 	if c.nsqdCoord == nil {
+		// the duplicated producer write is checked by the topic in the same way as the cluster write
 		return topic.PutMessage(msg)
 	}
-	return c.nsqdCoord.PutMessageToCluster(topic, msg)
+	return c.nsqdCoord.PutMessageToClusterWithAck(topic, msg, ackMode)
 }
 
-func (c *context) PutMessages(topic *nsqd.Topic, msgs []*nsqd.Message) (nsqd.MessageID, nsqd.BackendOffset, int32, error) {
+func (c *context) PutMessages(topic *nsqd.Topic, msgs []*nsqd.Message, ackMode nsqd.PubAckMode) (nsqd.MessageID, nsqd.BackendOffset, int32, error) {
 	if c.nsqdCoord == nil {
+		// the duplicated messages are filtered by the topic while writing
 		id, offset, rawSize, _, _, err := topic.PutMessages(msgs)
 		return id, offset, rawSize, err
 	}
-	return c.nsqdCoord.PutMessagesToCluster(topic, msgs)
+	return c.nsqdCoord.PutMessagesToClusterWithAck(topic, msgs, ackMode)
 }
 
 func (c *context) FinishMessageForce(ch *nsqd.Channel, msgID nsqd.MessageID) error {
@@ -228,6 +266,41 @@ func (c *context) FinishMessage(ch *nsqd.Channel, clientID int64, clientAddr str
 	return c.nsqdCoord.FinishMessageToCluster(ch, clientID, clientAddr, msgID)
 }
 
+// FinishMessages finish the batch of messages, the error for each message is returned in the
+// same order as the message ids.
+func (c *context) FinishMessages(ch *nsqd.Channel, clientID int64, clientAddr string, msgIDs []nsqd.MessageID) ([]error, error) {
+	if c.nsqdCoord == nil {
+		msgErrs := make([]error, len(msgIDs))
+		finished := false
+		for i, msgID := range msgIDs {
+			_, _, _, _, err := ch.FinishMessage(clientID, clientAddr, msgID)
+			msgErrs[i] = err
+			if err == nil {
+				finished = true
+			}
+		}
+		if finished {
+			ch.ContinueConsumeForOrder()
+		}
+		return msgErrs, nil
+	}
+	return c.nsqdCoord.FinishMessagesToCluster(ch, clientID, clientAddr, msgIDs)
+}
+
+func (c *context) UpdateChannelDeadLetter(ch *nsqd.Channel, maxAttempts uint16, dlqTopic string) error {
+	if c.nsqdCoord == nil {
+		ch.SetDeadLetter(maxAttempts, dlqTopic)
+		return nil
+	}
+	err := c.nsqdCoord.UpdateChannelDeadLetterToCluster(ch, maxAttempts, dlqTopic)
+	if err != nil {
+		nsqd.NsqLogger().Logf("failed to update channel(%v) dead letter max attempts: %v, dlq topic: %v, topic %v, err: %v",
+			ch.GetName(), maxAttempts, dlqTopic, ch.GetTopicName(), err)
+		return err
+	}
+	return nil
+}
+
 func (c *context) SyncChannels(topic *nsqd.Topic) error {
 	if c.nsqdCoord == nil {
 		return nil
@@ -299,6 +372,27 @@ func (c *context) EmptyChannelDelayedQueue(ch *nsqd.Channel) error {
 	return nil
 }
 
+// UpdateDelayedMessage cancel (the new time is 0) or reschedule the delayed message of the channel
+// (or the scheduled pub message if the channel is empty), the update is written to the delayed
+// queue and replicated to the replicas as the delayed message.
+func (c *context) UpdateDelayedMessage(topic *nsqd.Topic, ch string, msgID nsqd.MessageID, newTs int64) (*nsqd.Message, error) {
+	dq := topic.GetDelayedQueue()
+	if dq == nil {
+		return nil, nsqd.ErrDelayedMessageNotFound
+	}
+	target, err := dq.FindDelayedMessage(ch, msgID, 0)
+	if err != nil {
+		return nil, err
+	}
+	_, _, _, _, err = c.PutMessageObj(topic, nsqd.NewDelayedUpdateMessage(target, newTs))
+	if err != nil {
+		nsqd.NsqLogger().Logf("topic %v failed to update delayed message %v of channel %v to %v: %v",
+			topic.GetFullName(), msgID, ch, newTs, err)
+		return nil, err
+	}
+	return target, nil
+}
+
 func (c *context) SetChannelOffset(ch *nsqd.Channel, startFrom *ConsumeOffset, force bool) (int64, int64, error) {
 	var l *consistence.CommitLogData
 	var queueOffset int64
@@ -308,7 +402,13 @@ func (c *context) SetChannelOffset(ch *nsqd.Channel, startFrom *ConsumeOffset, f
 		if c.nsqdCoord != nil {
 			l, queueOffset, cnt, err = c.nsqdCoord.SearchLogByMsgTimestamp(ch.GetTopicName(), ch.GetTopicPart(), startFrom.OffsetValue)
 		} else {
-			err = errors.New("Not supported while coordinator disabled")
+			var topic *nsqd.Topic
+			topic, err = c.getExistingTopic(ch.GetTopicName(), ch.GetTopicPart())
+			if err == nil {
+				var offset nsqd.BackendOffset
+				offset, cnt, err = topic.SearchMsgByTimestamp(startFrom.OffsetValue * 1000 * 1000 * 1000)
+				queueOffset = int64(offset)
+			}
 		}
 	} else if startFrom.OffsetType == offsetSpecialType {
 		if startFrom.OffsetValue == -1 {
@@ -440,7 +540,7 @@ func (c *context) internalPubLoop(topic *nsqd.Topic) {
 			var retErr error
 			if c.checkForMasterWrite(topicName, partition) {
 				s := time.Now()
-				_, _, _, err := c.PutMessages(topic, messages)
+				_, _, _, err := c.PutMessages(topic, messages, nsqd.PubAckAll)
 				if err != nil {
 					nsqd.NsqLogger().LogErrorf("topic %v put messages %v failed: %v", topic.GetFullName(), len(messages), err)
 					retErr = err
@@ -471,20 +571,74 @@ func (c *context) internalPubLoop(topic *nsqd.Topic) {
 
 func (c *context) internalRequeueToEnd(ch *nsqd.Channel,
 	oldMsg *nsqd.Message, timeoutDuration time.Duration) error {
+	toDeadLetter, err := c.putRequeueToEnd(ch, oldMsg, timeoutDuration)
+	if err != nil {
+		return err
+	}
+	err = c.FinishMessage(ch, oldMsg.GetClientID(), "", oldMsg.ID)
+	if err != nil {
+		return err
+	}
+	if toDeadLetter {
+		c.deadLetterFinished(ch, oldMsg)
+	}
+	return nil
+}
+
+// requeue the batch of messages from the same client to end, the messages are written to the
+// delayed queue (or the dead letter topic) and then finished together, so the channel offset
+// is synced only once. The error for each message is returned in the same order.
+func (c *context) internalRequeueToEndBatch(ch *nsqd.Channel, clientID int64,
+	oldMsgs []*nsqd.Message, timeoutDuration time.Duration) []error {
+	msgErrs := make([]error, len(oldMsgs))
+	toDeadLetter := make([]bool, len(oldMsgs))
+	finIDs := make([]nsqd.MessageID, 0, len(oldMsgs))
+	finIndexes := make([]int, 0, len(oldMsgs))
+	for i, oldMsg := range oldMsgs {
+		toDeadLetter[i], msgErrs[i] = c.putRequeueToEnd(ch, oldMsg, timeoutDuration)
+		if msgErrs[i] == nil {
+			finIDs = append(finIDs, oldMsg.ID)
+			finIndexes = append(finIndexes, i)
+		}
+	}
+	if len(finIDs) == 0 {
+		return msgErrs
+	}
+	finErrs, err := c.FinishMessages(ch, clientID, "", finIDs)
+	for j, i := range finIndexes {
+		if err != nil {
+			msgErrs[i] = err
+		} else {
+			msgErrs[i] = finErrs[j]
+		}
+		if msgErrs[i] == nil && toDeadLetter[i] {
+			c.deadLetterFinished(ch, oldMsgs[i])
+		}
+	}
+	return msgErrs
+}
+
+// write the requeued message to the delayed queue, or to the dead letter topic if attempted
+// too many times. The old message should be finished after written.
+func (c *context) putRequeueToEnd(ch *nsqd.Channel,
+	oldMsg *nsqd.Message, timeoutDuration time.Duration) (bool, error) {
 	topic, err := c.getExistingTopic(ch.GetTopicName(), ch.GetTopicPart())
 	if topic == nil || err != nil {
 		nsqd.NsqLogger().LogWarningf("req channel %v topic not found: %v", ch.GetName(), err)
-		return err
+		return false, err
 	}
 	if topic.IsOrdered() {
-		return errors.New("ordered topic can not requeue to end")
+		return false, errors.New("ordered topic can not requeue to end")
 	}
 	if ch.Exiting() {
-		return nsqd.ErrExiting
+		return false, nsqd.ErrExiting
 	}
 
 	if !c.checkConsumeForMasterWrite(topic.GetTopicName(), topic.GetTopicPart()) {
-		return consistence.ErrNotTopicLeader.ToErrorType()
+		return false, consistence.ErrNotTopicLeader.ToErrorType()
+	}
+	if ch.ShouldDeadLetter(oldMsg) {
+		return true, c.putDeadLetter(ch, oldMsg)
 	}
 
 	newMsg := oldMsg.GetCopy()
@@ -515,11 +669,111 @@ func (c *context) internalRequeueToEnd(ch *nsqd.Channel,
 	if putErr != nil {
 		nsqd.NsqLogger().Logf("req message %v to end failed, channel %v, put error: %v ",
 			oldMsg, ch.GetName(), putErr)
+		return false, putErr
+	}
+	return false, nil
+}
+
+// find the dead letter topic partition which can be written on this node, the shrinking
+// and mirror partitions are skipped since the dead letter messages are new to the topic.
+// The dead letter topic will be auto created if the coordinator is disabled.
+func (c *context) getDeadLetterTopic(name string) (*nsqd.Topic, error) {
+	for pid, t := range c.getPartitions(name) {
+		if c.checkForMasterWrite(name, pid) && (c.nsqdCoord == nil || c.nsqdCoord.IsTopicProducerWritable(name, pid)) {
+			return t, nil
+		}
+	}
+	if c.nsqdCoord == nil {
+		return c.getTopic(name, 0, true, false), nil
+	}
+	return nil, ErrDeadLetterTopicNotFound
+}
+
+func newDeadLetterMessage(dlqTopic *nsqd.Topic, ch *nsqd.Channel, oldMsg *nsqd.Message) (*nsqd.Message, error) {
+	body, err := oldMsg.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	if !dlqTopic.IsExt() {
+		nsqd.NsqLogger().Logf("dead letter topic %v is not ext, the ext header of message %v will be dropped",
+			dlqTopic.GetFullName(), oldMsg.ID)
+		msg := nsqd.NewMessage(0, body)
+		msg.TraceID = oldMsg.TraceID
+		return msg, nil
+	}
+	var jsonHeader *simpleJson.Json
+	switch oldMsg.ExtVer {
+	case ext.JSON_HEADER_EXT_VER:
+		jsonHeader, err = simpleJson.NewJson(oldMsg.ExtBytes)
+		if err != nil {
+			return nil, err
+		}
+	case ext.TAG_EXT_VER:
+		jsonHeader = simpleJson.New()
+		jsonHeader.Set(ext.CLIENT_DISPATCH_TAG_KEY, string(oldMsg.ExtBytes))
+	default:
+		jsonHeader = simpleJson.New()
+	}
+	jsonHeader.Set(ext.DLQ_ORIG_TOPIC_KEY, ch.GetTopicName())
+	jsonHeader.Set(ext.DLQ_ORIG_PARTITION_KEY, strconv.Itoa(ch.GetTopicPart()))
+	jsonHeader.Set(ext.DLQ_ORIG_CHANNEL_KEY, ch.GetName())
+	jsonHeader.Set(ext.DLQ_ORIG_MSGID_KEY, strconv.FormatUint(uint64(oldMsg.ID), 10))
+	jsonHeader.Set(ext.DLQ_ATTEMPTS_KEY, strconv.Itoa(int(oldMsg.Attempts)))
+	if oldMsg.TraceID != 0 {
+		jsonHeader.Set(ext.TRACE_ID_KEY, strconv.FormatUint(oldMsg.TraceID, 10))
+	}
+	extBytes, err := jsonHeader.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	if len(extBytes) > ext.MaxExtLen {
+		return nil, errors.New("dead letter message ext header too large")
+	}
+	msg := nsqd.NewMessageWithExt(0, body, ext.JSON_HEADER_EXT_VER, extBytes)
+	msg.TraceID = oldMsg.TraceID
+	return msg, nil
+}
+
+// write the message attempted too many times to the dead letter topic, it should be finished
+// on the origin channel after written, so the channel can move forward.
+func (c *context) putDeadLetter(ch *nsqd.Channel, oldMsg *nsqd.Message) error {
+	dlqName := ch.GetDeadLetterTopicOrDefault()
+	dlqTopic, err := c.getDeadLetterTopic(dlqName)
+	if err != nil {
+		nsqd.NsqLogger().LogWarningf("channel %v-%v message %v move to dead letter topic %v failed: %v",
+			ch.GetTopicName(), ch.GetName(), oldMsg.ID, dlqName, err)
+		return err
+	}
+	newMsg, err := newDeadLetterMessage(dlqTopic, ch, oldMsg)
+	if err != nil {
+		nsqd.NsqLogger().LogWarningf("channel %v-%v message %v failed to create dead letter message: %v",
+			ch.GetTopicName(), ch.GetName(), oldMsg.ID, err)
+		return err
+	}
+	var id nsqd.MessageID
+	var offset nsqd.BackendOffset
+	var putErr error
+	if c.nsqdCoord == nil {
+		id, offset, _, _, putErr = dlqTopic.PutMessage(newMsg)
+	} else {
+		// published to the dead letter topic as the producer
+		id, offset, _, _, putErr = c.nsqdCoord.PutMessageToClusterWithAck(dlqTopic, newMsg, nsqd.PubAckAll)
+	}
+	if putErr != nil {
+		nsqd.NsqLogger().Logf("message %v move to dead letter topic %v failed, channel %v, put error: %v ",
+			oldMsg.ID, dlqTopic.GetFullName(), ch.GetName(), putErr)
 		return putErr
 	}
+	nsqd.NsqLogger().Logf("channel %v-%v message %v attempted %v moved to dead letter topic %v as %v at %v",
+		ch.GetTopicName(), ch.GetName(), oldMsg.ID, oldMsg.Attempts, dlqTopic.GetFullName(), id, offset)
+	return nil
+}
 
-	err = c.FinishMessage(ch, oldMsg.GetClientID(), "", oldMsg.ID)
-	return err
+func (c *context) deadLetterFinished(ch *nsqd.Channel, oldMsg *nsqd.Message) {
+	ch.IncrDeadLetterCount()
+	if oldMsg.TraceID != 0 || ch.IsTraced() {
+		nsqd.GetMsgTracer().TraceSub(ch.GetTopicName(), ch.GetName(), "DEAD_LETTER", oldMsg.TraceID, oldMsg, "", 0)
+	}
 }
 
 func (c *context) GreedyCleanTopicOldData(topic *nsqd.Topic) error {
@@ -0,0 +1,128 @@
+package nsqdserver
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/youzan/nsq/internal/ext"
+	"github.com/youzan/nsq/internal/levellogger"
+	"github.com/youzan/nsq/nsqd"
+)
+
+const (
+	delayedPubReleaseInterval = time.Millisecond * 500
+	delayedPubReleaseBatch    = 100
+)
+
+// PutDelayedPubMessage put the scheduled message to the delayed queue of the topic, the message
+// will be published to the topic by the leader at the deliver time (unix nano).
+func (c *context) PutDelayedPubMessage(topic *nsqd.Topic, body []byte, extContent ext.IExtContent,
+	traceID uint64, deliverAt int64) (nsqd.MessageID, nsqd.BackendOffset, int32, nsqd.BackendQueueEnd, error) {
+	var msg *nsqd.Message
+	if !topic.IsExt() {
+		msg = nsqd.NewMessage(0, body)
+	} else {
+		msg = nsqd.NewMessageWithExt(0, body, extContent.ExtVersion(), extContent.GetBytes())
+	}
+	msg.TraceID = traceID
+	msg.SetDelayedPub(deliverAt)
+	return c.putDelayedPubMessageObj(topic, msg)
+}
+
+func (c *context) putDelayedPubMessageObj(topic *nsqd.Topic,
+	msg *nsqd.Message) (nsqd.MessageID, nsqd.BackendOffset, int32, nsqd.BackendQueueEnd, error) {
+	if topic.IsOrdered() {
+		return 0, 0, 0, nil, nsqd.ErrDelayedPubNotAllow
+	}
+	return c.PutMessageObj(topic, msg)
+}
+
+// putMessagesWithDelayedPub put the scheduled messages to the delayed queue one by one and
+// the others to the topic in batch, the id and offset of the last written message are returned.
+func (c *context) putMessagesWithDelayedPub(topic *nsqd.Topic, msgs []*nsqd.Message,
+	ackMode nsqd.PubAckMode) (nsqd.MessageID, nsqd.BackendOffset, int32, error) {
+	normalMsgs := make([]*nsqd.Message, 0, len(msgs))
+	var id nsqd.MessageID
+	var offset nsqd.BackendOffset
+	var rawSize int32
+	var err error
+	for _, msg := range msgs {
+		if msg.DelayedType != nsqd.PubDelayed {
+			normalMsgs = append(normalMsgs, msg)
+			continue
+		}
+		id, offset, rawSize, _, err = c.putDelayedPubMessageObj(topic, msg)
+		if err != nil {
+			return id, offset, rawSize, err
+		}
+	}
+	if len(normalMsgs) == 0 {
+		return id, offset, rawSize, nil
+	}
+	return c.PutMessages(topic, normalMsgs, ackMode)
+}
+
+// releaseDelayedPub publish the due scheduled messages in the delayed queue to the topic and
+// remove them from the delayed queue, only the leader of the topic partition will release.
+// The message may be published again if the leader changed before the removal synced to
+// the replicas.
+func (c *context) releaseDelayedPub(topic *nsqd.Topic, now int64, results []nsqd.Message) (int, error) {
+	dq := topic.GetDelayedQueue()
+	if dq == nil || !c.checkForMasterWrite(topic.GetTopicName(), topic.GetTopicPart()) {
+		return 0, nil
+	}
+	cnt, err := dq.PeekRecentDelayedPub(now, results)
+	if err != nil {
+		return 0, err
+	}
+	released := 0
+	for i := 0; i < cnt; i++ {
+		m := &results[i]
+		msg := nsqd.NewReleasedDelayedPubMessage(m)
+		var id nsqd.MessageID
+		var offset nsqd.BackendOffset
+		var dend nsqd.BackendQueueEnd
+		id, offset, _, dend, err = c.PutMessageObj(topic, msg)
+		if err != nil {
+			nsqd.NsqLogger().Logf("topic %v release delayed pub message %v failed: %v",
+				topic.GetFullName(), m.ID, err)
+			break
+		}
+		err = dq.ConfirmDelayedPub(m)
+		if err != nil {
+			nsqd.NsqLogger().LogWarningf("topic %v delayed pub message %v released as %v but confirm failed: %v",
+				topic.GetFullName(), m.ID, id, err)
+			break
+		}
+		released++
+		if m.TraceID != 0 || atomic.LoadInt32(&topic.EnableTrace) == 1 || nsqd.NsqLogger().Level() >= levellogger.LOG_DETAIL {
+			nsqd.GetMsgTracer().TracePub(topic.GetTopicName(), topic.GetTopicPart(), "DELAYED_PUB_RELEASE",
+				m.TraceID, msg, offset, dend.TotalMsgCnt())
+		}
+	}
+	topic.IncrDelayedPubReleased(int64(released))
+	return released, err
+}
+
+func (s *NsqdServer) delayedPubReleaseLoop() {
+	ticker := time.NewTicker(delayedPubReleaseInterval)
+	defer ticker.Stop()
+	results := make([]nsqd.Message, delayedPubReleaseBatch)
+	for {
+		select {
+		case <-s.exitChan:
+			return
+		case <-ticker.C:
+			for _, topic := range s.ctx.nsqd.GetTopicMapCopy() {
+				now := time.Now().UnixNano()
+				// continue releasing if there are more due messages than the batch
+				for {
+					n, err := s.ctx.releaseDelayedPub(topic, now, results)
+					if err != nil || n < len(results) {
+						break
+					}
+				}
+			}
+		}
+	}
+}
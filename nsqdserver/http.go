@@ -19,6 +19,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	simpleJson "github.com/bitly/go-simplejson"
 	"github.com/julienschmidt/httprouter"
 	"github.com/youzan/nsq/consistence"
 	"github.com/youzan/nsq/internal/clusterinfo"
@@ -65,6 +66,7 @@ func newHTTPServer(ctx *context, tlsEnabled bool, tlsRequired bool) *httpServer
 	router.Handle("POST", "/mpub", http_api.Decorate(s.doMPUB, http_api.NegotiateVersion))
 	router.Handle("GET", "/stats", http_api.Decorate(s.doStats, log, http_api.NegotiateVersion))
 	router.Handle("GET", "/serverstats", http_api.Decorate(s.doServerStats, log, http_api.V1))
+	router.Handle("GET", "/metrics", http_api.Decorate(s.doMetrics, http_api.PlainText))
 	router.Handle("GET", "/coordinator/stats", http_api.Decorate(s.doCoordStats, log, http_api.V1))
 	router.Handle("GET", "/message/stats", http_api.Decorate(s.doMessageStats, log, http_api.V1))
 	router.Handle("GET", "/message/get", http_api.Decorate(s.doMessageGet, log, http_api.V1))
@@ -85,10 +87,15 @@ func newHTTPServer(ctx *context, tlsEnabled bool, tlsRequired bool) *httpServer
 	router.Handle("POST", "/channel/emptydelayed", http_api.Decorate(s.doEmptyChannelDelayed, log, http_api.V1))
 	router.Handle("POST", "/channel/setoffset", http_api.Decorate(s.doSetChannelOffset, log, http_api.V1))
 	router.Handle("POST", "/channel/setorder", http_api.Decorate(s.doSetChannelOrder, log, http_api.V1))
+	router.Handle("POST", "/channel/setdeadletter", http_api.Decorate(s.doSetChannelDeadLetter, log, http_api.V1))
 	router.Handle("GET", "/config/:opt", http_api.Decorate(s.doConfig, log, http_api.V1))
 	router.Handle("PUT", "/config/:opt", http_api.Decorate(s.doConfig, log, http_api.V1))
 	router.Handle("PUT", "/delayqueue/enable", http_api.Decorate(s.doEnableDelayedQueue, log, http_api.V1))
 	router.Handle("GET", "/delayqueue/backupto", http_api.Decorate(s.doDelayedQueueBackupTo, log, http_api.V1Stream))
+	router.Handle("GET", "/delayqueue/list", http_api.Decorate(s.doDelayedMessageList, log, http_api.V1))
+	router.Handle("GET", "/delayqueue/get", http_api.Decorate(s.doDelayedMessageGet, log, http_api.V1))
+	router.Handle("POST", "/delayqueue/cancel", http_api.Decorate(s.doDelayedMessageUpdate, log, http_api.V1))
+	router.Handle("POST", "/delayqueue/reschedule", http_api.Decorate(s.doDelayedMessageUpdate, log, http_api.V1))
 
 	router.Handle("POST", "/topic/greedyclean", http_api.Decorate(s.doGreedyCleanTopic, log, http_api.V1))
 	router.Handle("POST", "/topic/fixdata", http_api.Decorate(s.doFixTopicData, log, http_api.V1))
@@ -351,6 +358,7 @@ func (s *httpServer) internalPUB(w http.ResponseWriter, req *http.Request, ps ht
 		var traceID uint64
 		var needTraceRsp bool
 		var extContent ext.IExtContent
+		var deliverAt int64
 		isExt := topic.IsExt()
 
 		traceIDStr = params.Get("trace_id")
@@ -410,6 +418,14 @@ func (s *httpServer) internalPUB(w http.ResponseWriter, req *http.Request, ps ht
 			if err != nil {
 				return nil, http_api.Err{400, ext.E_INVALID_JSON_HEADER}
 			}
+			jsonHeader, err := simpleJson.NewJson(jsonHeaderExtBytes)
+			if err != nil {
+				return nil, http_api.Err{400, ext.E_INVALID_JSON_HEADER}
+			}
+			deliverAt, err = nsqd.GetDelayedPubTs(jsonHeader, time.Now(), s.ctx.getOpts().MaxReqTimeout)
+			if err != nil {
+				return nil, http_api.Err{400, "INVALID_DEFER"}
+			}
 
 			jhe := ext.NewJsonHeaderExt()
 			jhe.SetJsonHeaderBytes(jsonHeaderExtBytes)
@@ -417,6 +433,18 @@ func (s *httpServer) internalPUB(w http.ResponseWriter, req *http.Request, ps ht
 		} else {
 			extContent = ext.NewNoExt()
 		}
+		// the defer parameter (in milliseconds) overrides the delay in the ext json header
+		if deferStr := params.Get("defer"); deferStr != "" {
+			deferMs, err := strconv.ParseInt(deferStr, 10, 64)
+			if err != nil {
+				return nil, http_api.Err{400, "INVALID_DEFER"}
+			}
+			deliverAt, err = nsqd.GetDelayedPubTsByDuration(time.Duration(deferMs)*time.Millisecond,
+				time.Now(), s.ctx.getOpts().MaxReqTimeout)
+			if err != nil {
+				return nil, http_api.Err{400, "INVALID_DEFER"}
+			}
+		}
 		if !isExt && extContent.ExtVersion() != ext.NO_EXT_VER {
 			canIgnoreExt := true
 			if jsonHeaderExt != nil {
@@ -437,7 +465,12 @@ func (s *httpServer) internalPUB(w http.ResponseWriter, req *http.Request, ps ht
 				return nil, http_api.Err{400, ext.E_EXT_NOT_SUPPORT}
 			}
 		}
-		if needTraceRsp || atomic.LoadInt32(&topic.EnableTrace) == 1 {
+		if needTraceRsp || atomic.LoadInt32(&topic.EnableTrace) == 1 || deliverAt > 0 {
+			asyncAction = false
+		}
+		if _, ok := jsonHeaderExt[ext.PRODUCER_ID_KEY]; ok {
+			asyncAction = false
+		} else if _, ok := jsonHeaderExt[ext.DEDUP_KEY]; ok {
 			asyncAction = false
 		}
 
@@ -446,8 +479,13 @@ func (s *httpServer) internalPUB(w http.ResponseWriter, req *http.Request, ps ht
 		rawSize := int32(0)
 		if asyncAction {
 			err = internalPubAsync(nil, body, topic, extContent)
+		} else if deliverAt > 0 {
+			id, offset, rawSize, _, err = s.ctx.PutDelayedPubMessage(topic, body, extContent, traceID, deliverAt)
 		} else {
-			id, offset, rawSize, _, err = s.ctx.PutMessage(topic, body, extContent, traceID)
+			id, offset, rawSize, _, err = s.ctx.PutMessage(topic, body, extContent, traceID, nsqd.PubAckAll)
+		}
+		if err == nsqd.ErrProducerSeqDuplicated {
+			return nil, http_api.Err{409, "DUPLICATED_SEQ"}
 		}
 		if err != nil {
 			nsqd.NsqLogger().LogErrorf("topic %v put message failed: %v", topic.GetFullName(), err)
@@ -554,7 +592,7 @@ func (s *httpServer) doMPUB(w http.ResponseWriter, req *http.Request, ps httprou
 	}
 
 	if s.ctx.checkForMasterWrite(topic.GetTopicName(), topic.GetTopicPart()) {
-		_, _, _, err := s.ctx.PutMessages(topic, msgs)
+		_, _, _, err := s.ctx.PutMessages(topic, msgs, nsqd.PubAckAll)
 		//s.ctx.setHealth(err)
 		if err != nil {
 			nsqd.NsqLogger().LogErrorf("topic %v put message failed: %v", topic.GetFullName(), err)
@@ -703,6 +741,54 @@ func (s *httpServer) doSetChannelOrder(w http.ResponseWriter, req *http.Request,
 	return nil, nil
 }
 
+func (s *httpServer) doSetChannelDeadLetter(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, channelName, err := s.getExistingTopicChannelFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
+	}
+	if channel.IsEphemeral() || topic.IsOrdered() {
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+
+	maxAttempts, err := strconv.ParseUint(reqParams.Get("max_attempts"), 10, 16)
+	if err != nil || maxAttempts >= nsqd.MaxAttempts {
+		return nil, http_api.Err{400, "INVALID_MAX_ATTEMPTS"}
+	}
+	dlqTopic := reqParams.Get("dlq_topic")
+	if dlqTopic != "" && !protocol.IsValidTopicName(dlqTopic) {
+		return nil, http_api.Err{400, "INVALID_DLQ_TOPIC"}
+	}
+	if dlqTopic == "" && !protocol.IsValidTopicName(nsqd.GetDefaultDeadLetterTopic(topic.GetTopicName(), channelName)) {
+		return nil, http_api.Err{400, "INVALID_DLQ_TOPIC"}
+	}
+	if dlqTopic == topic.GetTopicName() {
+		return nil, http_api.Err{400, "INVALID_DLQ_TOPIC"}
+	}
+
+	if s.ctx.checkConsumeForMasterWrite(topic.GetTopicName(), topic.GetTopicPart()) {
+		err = s.ctx.UpdateChannelDeadLetter(channel, uint16(maxAttempts), dlqTopic)
+		if err != nil {
+			nsqd.NsqLogger().LogErrorf("failure in %s - %s", req.URL.Path, err)
+			return nil, http_api.Err{500, "INTERNAL_ERROR"}
+		}
+		nsqd.NsqLogger().Logf("topic %v channel %v dead letter changed to max attempts: %v, dlq topic: %v, by client:%v",
+			topic.GetFullName(), channelName, maxAttempts, channel.GetDeadLetterTopicOrDefault(), req.RemoteAddr)
+	} else {
+		nsqd.NsqLogger().LogDebugf("should request to master: %v, from %v",
+			topic.GetFullName(), req.RemoteAddr)
+		return nil, http_api.Err{400, FailedOnNotLeader}
+	}
+
+	// pro-actively persist metadata so in case of process failure
+	topic.SaveChannelMeta()
+	return nil, nil
+}
+
 func (s *httpServer) doSetChannelOffset(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	_, topic, channelName, err := s.getExistingTopicChannelFromQuery(req)
 	if err != nil {
@@ -1381,6 +1467,20 @@ func (s *httpServer) doConfig(w http.ResponseWriter, req *http.Request, ps httpr
 				return nil, http_api.Err{400, "INVALID_VALUE"}
 			}
 			nsqd.NsqLogger().Logf("max conn for client set to : %v", opts.MaxConnForClient)
+		case "catchup_rate_limit":
+			err := json.Unmarshal(body, &opts.CatchupRateLimit)
+			if err != nil || opts.CatchupRateLimit < 0 {
+				nsqd.NsqLogger().Logf("invalid value : %v", string(body))
+				return nil, http_api.Err{400, "INVALID_VALUE"}
+			}
+			nsqd.NsqLogger().Logf("catchup rate limit set to : %v", opts.CatchupRateLimit)
+		case "catchup_topic_rate_limit":
+			err := json.Unmarshal(body, &opts.CatchupTopicRateLimit)
+			if err != nil || opts.CatchupTopicRateLimit < 0 {
+				nsqd.NsqLogger().Logf("invalid value : %v", string(body))
+				return nil, http_api.Err{400, "INVALID_VALUE"}
+			}
+			nsqd.NsqLogger().Logf("catchup topic rate limit set to : %v", opts.CatchupTopicRateLimit)
 		default:
 			return nil, http_api.Err{400, "INVALID_OPTION"}
 		}
@@ -1453,10 +1553,194 @@ func (s *httpServer) doDelayedQueueBackupTo(w http.ResponseWriter, req *http.Req
 	if dq == nil {
 		return nil, http_api.Err{400, "No delayed queue on this topic"}
 	}
-	_, err = dq.BackupKVStoreTo(w)
+	// the backup is pulled by the replica for the full sync, stream it under the catchup rate limits
+	var bw io.Writer = w
+	if s.ctx.nsqdCoord != nil {
+		bw, err = s.ctx.nsqdCoord.NewCatchupThrottledWriter(topicName, topicPart, w)
+		if err != nil {
+			nsqd.NsqLogger().Logf("failed to backup delayed queue for topic %v: %v", topicName, err)
+			return nil, http_api.Err{500, err.Error()}
+		}
+	}
+	_, err = dq.BackupKVStoreTo(bw)
 	if err != nil {
 		nsqd.NsqLogger().Logf("failed to backup delayed queue for topic %v: %v", topicName, err)
 		return nil, http_api.Err{500, err.Error()}
 	}
 	return nil, nil
 }
+
+type delayedMessageInfo struct {
+	ID        nsqd.MessageID `json:"id"`
+	DelayedID nsqd.MessageID `json:"delayed_id"`
+	TraceID   uint64         `json:"trace_id"`
+	DeliverAt int64          `json:"deliver_at"`
+	Timestamp int64          `json:"timestamp"`
+	Attempts  uint16         `json:"attempts"`
+	Ext       string         `json:"ext,omitempty"`
+	Body      string         `json:"body,omitempty"`
+}
+
+func newDelayedMessageInfo(m *nsqd.Message, withBody bool) delayedMessageInfo {
+	info := delayedMessageInfo{
+		ID:        nsqd.GetDelayedMessageClientID(m),
+		DelayedID: m.ID,
+		TraceID:   m.TraceID,
+		DeliverAt: m.DelayedTs / int64(time.Millisecond),
+		Timestamp: m.Timestamp,
+		Attempts:  m.Attempts,
+		Ext:       string(m.ExtBytes),
+	}
+	if withBody {
+		info.Body = string(m.Body)
+	}
+	return info
+}
+
+// getDelayedQueueFromQuery return the delayed queue of the topic and the channel (empty for the
+// scheduled pub messages) in the query.
+func (s *httpServer) getDelayedQueueFromQuery(req *http.Request) (url.Values, *nsqd.Topic, *nsqd.DelayQueue, string, error) {
+	reqParams, topic, err := s.getExistingTopicFromQuery(req)
+	if err != nil {
+		return nil, nil, nil, "", err
+	}
+	channelName := reqParams.Get("channel")
+	if channelName != "" && !protocol.IsValidChannelName(channelName) {
+		return nil, nil, nil, "", http_api.Err{400, "INVALID_ARG_CHANNEL"}
+	}
+	dq := topic.GetDelayedQueue()
+	if dq == nil {
+		return nil, nil, nil, "", http_api.Err{404, "No delayed queue on this topic"}
+	}
+	return reqParams, topic, dq, channelName, nil
+}
+
+func (s *httpServer) doDelayedMessageList(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, _, dq, channelName, err := s.getDelayedQueueFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+	var dueBefore int64
+	if str := reqParams.Get("due_before"); str != "" {
+		dueBeforeMs, err := strconv.ParseInt(str, 10, 64)
+		if err != nil || dueBeforeMs < 0 {
+			return nil, http_api.Err{400, "INVALID_DUE_BEFORE"}
+		}
+		dueBefore = dueBeforeMs * int64(time.Millisecond)
+	}
+	offset := 0
+	if str := reqParams.Get("offset"); str != "" {
+		offset, err = strconv.Atoi(str)
+		if err != nil || offset < 0 {
+			return nil, http_api.Err{400, "INVALID_OFFSET"}
+		}
+	}
+	limit := 100
+	if str := reqParams.Get("limit"); str != "" {
+		limit, err = strconv.Atoi(str)
+		if err != nil || limit <= 0 || limit > 1000 {
+			return nil, http_api.Err{400, "INVALID_LIMIT"}
+		}
+	}
+	msgs, err := dq.ListDelayedMessages(channelName, dueBefore, offset, limit)
+	if err != nil {
+		return nil, http_api.Err{500, err.Error()}
+	}
+	infos := make([]delayedMessageInfo, 0, len(msgs))
+	for _, m := range msgs {
+		infos = append(infos, newDelayedMessageInfo(m, false))
+	}
+	cnt, _ := dq.GetCurrentDelayedCnt(nsqd.ChannelDelayed, channelName)
+	if channelName == "" {
+		cnt, _ = dq.GetCurrentDelayedCnt(nsqd.PubDelayed, "")
+	}
+	return struct {
+		Total    uint64               `json:"total"`
+		Messages []delayedMessageInfo `json:"messages"`
+	}{cnt, infos}, nil
+}
+
+func (s *httpServer) doDelayedMessageGet(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, _, dq, channelName, err := s.getDelayedQueueFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+	var msgID uint64
+	var traceID uint64
+	if str := reqParams.Get("msgid"); str != "" {
+		msgID, err = strconv.ParseUint(str, 10, 64)
+		if err != nil || msgID == 0 {
+			return nil, http_api.Err{400, "INVALID_MSGID"}
+		}
+	} else {
+		traceID, err = strconv.ParseUint(reqParams.Get("trace_id"), 10, 64)
+		if err != nil {
+			return nil, http_api.Err{400, "INVALID_TRACE_ID"}
+		}
+	}
+	m, err := dq.FindDelayedMessage(channelName, nsqd.MessageID(msgID), traceID)
+	if err == nsqd.ErrDelayedMessageNotFound {
+		return nil, http_api.Err{404, "MESSAGE_NOT_FOUND"}
+	} else if err != nil {
+		return nil, http_api.Err{500, err.Error()}
+	}
+	return newDelayedMessageInfo(m, true), nil
+}
+
+func (s *httpServer) doDelayedMessageUpdate(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, _, channelName, err := s.getDelayedQueueFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+	msgID, err := strconv.ParseUint(reqParams.Get("msgid"), 10, 64)
+	if err != nil || msgID == 0 {
+		return nil, http_api.Err{400, "INVALID_MSGID"}
+	}
+	// the new time is 0 to cancel the delayed message
+	var newTs int64
+	if strings.HasSuffix(req.URL.Path, "/reschedule") {
+		now := time.Now()
+		maxDelay := s.ctx.getOpts().MaxReqTimeout
+		if str := reqParams.Get("deliver_at"); str != "" {
+			var deliverAtMs int64
+			deliverAtMs, err = strconv.ParseInt(str, 10, 64)
+			if err != nil || deliverAtMs < 0 {
+				return nil, http_api.Err{400, "INVALID_DELIVER_AT"}
+			}
+			delay := time.Unix(0, deliverAtMs*int64(time.Millisecond)).Sub(now)
+			if delay < 0 {
+				delay = 0
+			}
+			newTs, err = nsqd.GetDelayedPubTsByDuration(delay, now, maxDelay)
+		} else {
+			var delayMs int64
+			delayMs, err = strconv.ParseInt(reqParams.Get("delay"), 10, 64)
+			if err != nil {
+				return nil, http_api.Err{400, "INVALID_DELAY"}
+			}
+			newTs, err = nsqd.GetDelayedPubTsByDuration(time.Duration(delayMs)*time.Millisecond, now, maxDelay)
+		}
+		if err != nil {
+			return nil, http_api.Err{400, "INVALID_DELAY"}
+		}
+		// deliver as soon as possible if the time already passed
+		if newTs == 0 {
+			newTs = now.UnixNano()
+		}
+	}
+	if !s.ctx.checkForMasterWrite(topic.GetTopicName(), topic.GetTopicPart()) {
+		nsqd.NsqLogger().LogDebugf("should request to master: %v, from %v",
+			topic.GetFullName(), req.RemoteAddr)
+		return nil, http_api.Err{400, FailedOnNotLeader}
+	}
+	m, err := s.ctx.UpdateDelayedMessage(topic, channelName, nsqd.MessageID(msgID), newTs)
+	if err == nsqd.ErrDelayedMessageNotFound {
+		return nil, http_api.Err{404, "MESSAGE_NOT_FOUND"}
+	} else if err != nil {
+		return nil, http_api.Err{500, err.Error()}
+	}
+	nsqd.NsqLogger().Logf("topic %v delayed message %v of channel %v updated from %v to %v by client: %v",
+		topic.GetFullName(), msgID, channelName, m.DelayedTs, newTs, req.RemoteAddr)
+	m.DelayedTs = newTs
+	return newDelayedMessageInfo(m, false), nil
+}
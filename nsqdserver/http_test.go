@@ -75,6 +75,142 @@ func TestHTTPpub(t *testing.T) {
 	conn.Close()
 }
 
+func TestHTTPpubDefer(t *testing.T) {
+	opts := nsqd.NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.MaxReqTimeout = time.Minute
+	tcpAddr, httpAddr, nsqd, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
+
+	topicName := "test_http_pub_defer" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopicIgnPart(topicName)
+	topic.GetChannel("ch")
+
+	url := fmt.Sprintf("http://%s/pub?topic=%s&defer=%d", httpAddr, topicName, time.Minute/time.Millisecond+1)
+	resp, err := http.Post(url, "application/octet-stream", bytes.NewBuffer([]byte("test message")))
+	test.Equal(t, err, nil)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, true, strings.Contains(string(body), "INVALID_DEFER"))
+
+	start := time.Now()
+	url = fmt.Sprintf("http://%s/pub?topic=%s&defer=1000", httpAddr, topicName)
+	resp, err = http.Post(url, "application/octet-stream", bytes.NewBuffer([]byte("test message")))
+	test.Equal(t, err, nil)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, string(body), "OK")
+	test.Equal(t, uint64(0), topic.TotalMessageCnt())
+	stats := nsqd.GetTopicStats(false, topicName)
+	test.Equal(t, 1, len(stats))
+	test.Equal(t, uint64(1), stats[0].DelayedPubCount)
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Equal(t, err, nil)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+	_, err = nsq.Ready(1).WriteTo(conn)
+	test.Equal(t, err, nil)
+	msgOut := recvNextMsgAndCheck(t, conn, 0, 0, true)
+	test.Equal(t, []byte("test message"), msgOut.Body)
+	test.Equal(t, true, time.Since(start) >= time.Second)
+	time.Sleep(time.Millisecond * 100)
+	stats = nsqd.GetTopicStats(false, topicName)
+	test.Equal(t, uint64(0), stats[0].DelayedPubCount)
+	test.Equal(t, int64(1), stats[0].DelayedPubReleased)
+}
+
+func TestHTTPDelayedMessageUpdate(t *testing.T) {
+	opts := nsqd.NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.MaxReqTimeout = time.Minute
+	tcpAddr, httpAddr, nsqd, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
+
+	topicName := "test_http_delayed_update" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopicIgnPart(topicName)
+	topic.GetChannel("ch")
+
+	for i := 0; i < 3; i++ {
+		url := fmt.Sprintf("http://%s/pub?topic=%s&defer=%d", httpAddr, topicName, (i+1)*10000)
+		resp, err := http.Post(url, "application/octet-stream", bytes.NewBuffer([]byte("msg"+strconv.Itoa(i))))
+		test.Equal(t, err, nil)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		test.Equal(t, string(body), "OK")
+	}
+
+	type listResult struct {
+		Total    uint64               `json:"total"`
+		Messages []delayedMessageInfo `json:"messages"`
+	}
+	list := func() listResult {
+		url := fmt.Sprintf("http://%s/delayqueue/list?topic=%s&partition=0", httpAddr, topicName)
+		resp, err := http.Get(url)
+		test.Equal(t, err, nil)
+		defer resp.Body.Close()
+		test.Equal(t, 200, resp.StatusCode)
+		var ret listResult
+		err = json.NewDecoder(resp.Body).Decode(&ret)
+		test.Nil(t, err)
+		return ret
+	}
+	ret := list()
+	test.Equal(t, uint64(3), ret.Total)
+	test.Equal(t, 3, len(ret.Messages))
+	test.Equal(t, true, ret.Messages[0].DeliverAt < ret.Messages[1].DeliverAt)
+
+	url := fmt.Sprintf("http://%s/delayqueue/get?topic=%s&partition=0&msgid=%d", httpAddr, topicName, ret.Messages[1].ID)
+	resp, err := http.Get(url)
+	test.Equal(t, err, nil)
+	var info delayedMessageInfo
+	err = json.NewDecoder(resp.Body).Decode(&info)
+	resp.Body.Close()
+	test.Nil(t, err)
+	test.Equal(t, "msg1", info.Body)
+
+	url = fmt.Sprintf("http://%s/delayqueue/cancel?topic=%s&partition=0&msgid=%d", httpAddr, topicName, ret.Messages[0].ID)
+	resp, err = http.Post(url, "", nil)
+	test.Equal(t, err, nil)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	resp, err = http.Post(url, "", nil)
+	test.Equal(t, err, nil)
+	resp.Body.Close()
+	test.Equal(t, 404, resp.StatusCode)
+	test.Equal(t, uint64(2), list().Total)
+
+	url = fmt.Sprintf("http://%s/delayqueue/reschedule?topic=%s&partition=0&msgid=%d&delay=%d", httpAddr, topicName,
+		ret.Messages[2].ID, time.Minute/time.Millisecond+1)
+	resp, err = http.Post(url, "", nil)
+	test.Equal(t, err, nil)
+	resp.Body.Close()
+	test.Equal(t, 400, resp.StatusCode)
+	url = fmt.Sprintf("http://%s/delayqueue/reschedule?topic=%s&partition=0&msgid=%d&delay=0", httpAddr, topicName,
+		ret.Messages[2].ID)
+	resp, err = http.Post(url, "", nil)
+	test.Equal(t, err, nil)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Equal(t, err, nil)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+	_, err = nsq.Ready(1).WriteTo(conn)
+	test.Equal(t, err, nil)
+	msgOut := recvNextMsgAndCheck(t, conn, 0, 0, true)
+	test.Equal(t, []byte("msg2"), msgOut.Body)
+	time.Sleep(time.Millisecond * 100)
+	left := list()
+	test.Equal(t, uint64(1), left.Total)
+	test.Equal(t, ret.Messages[1].ID, left.Messages[0].ID)
+}
+
 func TestHTTPChangeConfig(t *testing.T) {
 	opts := nsqd.NewOptions()
 	opts.LogLevel = 2
@@ -143,6 +279,53 @@ func TestHTTPChangeConfig(t *testing.T) {
 	test.Equal(t, false, nsqd.GetOpts().AllowSubExtCompatible)
 }
 
+func TestHTTPChangeCatchupRateLimit(t *testing.T) {
+	opts := nsqd.NewOptions()
+	opts.LogLevel = 2
+	opts.Logger = newTestLogger(t)
+	_, httpAddr, nsqd, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
+
+	client := &http.Client{}
+	url := fmt.Sprintf("http://%s/config/catchup_rate_limit", httpAddr)
+	req, err := http.NewRequest("PUT", url, strings.NewReader("1048576"))
+	test.Nil(t, err)
+	resp, err := client.Do(req)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	test.Equal(t, int64(1048576), nsqd.GetOpts().CatchupRateLimit)
+
+	url = fmt.Sprintf("http://%s/config/catchup_topic_rate_limit", httpAddr)
+	req, err = http.NewRequest("PUT", url, strings.NewReader("4096"))
+	test.Nil(t, err)
+	resp, err = client.Do(req)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	test.Equal(t, int64(4096), nsqd.GetOpts().CatchupTopicRateLimit)
+
+	// negative limit is not allowed
+	req, err = http.NewRequest("PUT", url, strings.NewReader("-1"))
+	test.Nil(t, err)
+	resp, err = client.Do(req)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 400, resp.StatusCode)
+	test.Equal(t, int64(4096), nsqd.GetOpts().CatchupTopicRateLimit)
+
+	// 0 means no limit
+	req, err = http.NewRequest("PUT", url, strings.NewReader("0"))
+	test.Nil(t, err)
+	resp, err = client.Do(req)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	test.Equal(t, int64(0), nsqd.GetOpts().CatchupTopicRateLimit)
+	test.Equal(t, int64(1048576), nsqd.GetOpts().CatchupRateLimit)
+}
+
 func TestHTTPPubExt(t *testing.T) {
 	topicName := "test_json_header_tag_http" + strconv.Itoa(int(time.Now().Unix()))
 
@@ -684,6 +867,114 @@ func TestHTTPFinishMemDelayed(t *testing.T) {
 	conn.Close()
 }
 
+func TestHTTPSetChannelDeadLetter(t *testing.T) {
+	opts := nsqd.NewOptions()
+	opts.LogLevel = 2
+	opts.Logger = newTestLogger(t)
+	if testing.Verbose() {
+		opts.LogLevel = 4
+		nsqd.SetLogger(opts.Logger)
+	}
+
+	tcpAddr, httpAddr, nsqd, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
+
+	topicName := "test_http_dead_letter" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopicIgnPart(topicName)
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Equal(t, err, nil)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+
+	url := fmt.Sprintf("http://%s/channel/setdeadletter?topic=%s&partition=0&channel=%s&max_attempts=%s", httpAddr,
+		topicName, "ch", "invalid")
+	ret, err := http.Post(url, "", nil)
+	test.Equal(t, err, nil)
+	test.Equal(t, 400, ret.StatusCode)
+	ret.Body.Close()
+
+	url = fmt.Sprintf("http://%s/channel/setdeadletter?topic=%s&partition=0&channel=%s&max_attempts=2", httpAddr,
+		topicName, "ch")
+	ret, err = http.Post(url, "", nil)
+	test.Equal(t, err, nil)
+	test.Equal(t, 200, ret.StatusCode)
+	ret.Body.Close()
+	ch, err := topic.GetExistingChannel("ch")
+	test.Nil(t, err)
+	test.Equal(t, uint16(2), ch.GetMaxAttempts())
+
+	buf := bytes.NewBuffer([]byte("test message"))
+	url = fmt.Sprintf("http://%s/pub?topic=%s", httpAddr, topicName)
+	resp, err := http.Post(url, "application/octet-stream", buf)
+	test.Equal(t, err, nil)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, string(body), "OK")
+
+	_, err = nsq.Ready(1).WriteTo(conn)
+	test.Equal(t, err, nil)
+
+	for {
+		resp, _ := nsq.ReadResponse(conn)
+		frameType, data, err := nsq.UnpackResponse(resp)
+		test.Nil(t, err)
+		test.NotEqual(t, frameTypeError, frameType)
+		if frameType == frameTypeResponse {
+			t.Logf("got response data: %v", string(data))
+			continue
+		}
+		msgOut, err := nsq.DecodeMessage(data)
+		test.Equal(t, []byte("test message"), msgOut.Body)
+		nsq.Requeue(msgOut.ID, 0).WriteTo(conn)
+		if msgOut.Attempts >= 2 {
+			break
+		}
+	}
+	time.Sleep(time.Second)
+	test.Equal(t, uint64(1), ch.GetDeadLetterCount())
+	test.Equal(t, int64(0), ch.Depth())
+	dlqTopic, err := nsqd.GetExistingTopic(topicName+"_ch_dlq", 0)
+	test.Nil(t, err)
+	test.Equal(t, true, dlqTopic.IsExt())
+	test.Equal(t, uint64(1), dlqTopic.TotalMessageCnt())
+}
+
+func TestHTTPMetrics(t *testing.T) {
+	opts := nsqd.NewOptions()
+	opts.Logger = newTestLogger(t)
+	_, httpAddr, nsqd, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
+
+	topicName := "test_http_metrics" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopicIgnPart(topicName)
+	topic.GetChannel("ch")
+
+	buf := bytes.NewBuffer([]byte("test message"))
+	url := fmt.Sprintf("http://%s/pub?topic=%s", httpAddr, topicName)
+	resp, err := http.Post(url, "application/octet-stream", buf)
+	test.Equal(t, err, nil)
+	resp.Body.Close()
+
+	url = fmt.Sprintf("http://%s/metrics", httpAddr)
+	resp, err = http.Get(url)
+	test.Equal(t, err, nil)
+	defer resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	test.Equal(t, true, strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain"))
+	body, _ := ioutil.ReadAll(resp.Body)
+	t.Logf("%s", body)
+	metrics := string(body)
+	test.Equal(t, true, strings.Contains(metrics, "# TYPE nsq_channel_depth gauge\n"))
+	test.Equal(t, true, strings.Contains(metrics,
+		fmt.Sprintf("nsq_topic_messages_total{topic=\"%s\",partition=\"0\"} 1\n", topicName)))
+	test.Equal(t, true, strings.Contains(metrics,
+		fmt.Sprintf("nsq_channel_depth{topic=\"%s\",partition=\"0\",channel=\"ch\"} 1\n", topicName)))
+	test.Equal(t, true, strings.Contains(metrics, "nsq_up 1\n"))
+}
+
 func TestHTTPSRequire(t *testing.T) {
 	opts := nsqd.NewOptions()
 	opts.Logger = newTestLogger(t)
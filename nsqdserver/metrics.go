@@ -0,0 +1,162 @@
+package nsqdserver
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/youzan/nsq/internal/prometheus"
+	"github.com/youzan/nsq/internal/protocol"
+	"github.com/youzan/nsq/nsqd"
+)
+
+const metricsPrefix = "nsq_"
+
+// doMetrics export the stats in the prometheus text format, the metrics
+// are labeled by topic, partition and channel.
+func (s *httpServer) doMetrics(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	r := prometheus.NewRegistry(metricsPrefix)
+	stats := s.ctx.getStats(false, "", true)
+	for _, t := range stats {
+		writeTopicMetrics(r, &t)
+	}
+	s.writeCoordMetrics(r, stats)
+
+	r.Gauge("up", "whether the nsqd is healthy", prometheus.BoolToFloat(s.ctx.isHealthy()))
+	r.Gauge("start_time_seconds", "start time of the nsqd since unix epoch in seconds",
+		float64(s.ctx.getStartTime().Unix()))
+	r.Counter("server_pub_failed_total", "total failed pub on this nsqd", float64(getServerPubFailed()))
+
+	w.Header().Set("Content-Type", prometheus.ContentType)
+	return r.Bytes(), nil
+}
+
+func writeTopicMetrics(r *prometheus.Registry, t *nsqd.TopicStats) {
+	tl := []prometheus.Label{
+		prometheus.L("topic", t.TopicName),
+		prometheus.L("partition", t.TopicPartition),
+	}
+	r.Gauge("topic_is_leader", "whether this node is the leader of the topic partition",
+		prometheus.BoolToFloat(t.IsLeader), tl...)
+	r.Gauge("topic_depth", "total data size in bytes of the topic partition", float64(t.Depth), tl...)
+	r.Gauge("topic_backend_start", "oldest data offset in bytes of the topic disk queue", float64(t.BackendStart), tl...)
+	r.Gauge("topic_disk_queue_size_bytes", "data size in bytes of the topic disk queue",
+		float64(t.BackendDepth-t.BackendStart), tl...)
+	r.Counter("topic_messages_total", "total messages written to the topic partition", float64(t.MessageCount), tl...)
+	r.Gauge("topic_hourly_pub_size", "pub size in bytes during the past hour", float64(t.HourlyPubSize), tl...)
+	r.Counter("topic_pub_failed_total", "total failed pub on the topic partition", float64(t.PubFailedCnt), tl...)
+	r.Gauge("topic_delayed_queue_disk_size_bytes", "data size in bytes of the delayed queue log",
+		float64(t.DelayedQueueDataSize), tl...)
+	r.Gauge("topic_delayed_queue_db_size_bytes", "size in bytes of the delayed queue kv store",
+		float64(t.DelayedQueueDBSize), tl...)
+	if t.E2eProcessingLatency != nil {
+		for _, item := range t.E2eProcessingLatency.Percentiles {
+			r.SummaryQuantile("topic_e2e_processing_latency_seconds", "e2e processing latency of all channels",
+				item["quantile"], item["value"]/float64(time.Second), tl...)
+		}
+		r.SummaryCount("topic_e2e_processing_latency_seconds", "e2e processing latency of all channels",
+			float64(t.E2eProcessingLatency.Count), tl...)
+	}
+
+	for _, c := range t.Channels {
+		// ephemeral may be too much, so we just ignore them like statsd
+		if protocol.IsEphemeral(c.ChannelName) {
+			continue
+		}
+		cl := []prometheus.Label{
+			prometheus.L("topic", t.TopicName),
+			prometheus.L("partition", t.TopicPartition),
+			prometheus.L("channel", c.ChannelName),
+		}
+		r.Gauge("channel_depth", "messages waiting to be consumed", float64(c.Depth), cl...)
+		r.Gauge("channel_depth_size", "message bytes waiting to be consumed", float64(c.DepthSize), cl...)
+		r.Gauge("channel_backend_depth", "message bytes left in the disk queue", float64(c.BackendDepth), cl...)
+		r.Gauge("channel_in_flight_count", "messages in flight", float64(c.InFlightCount), cl...)
+		r.Gauge("channel_deferred_count", "messages deferred", float64(c.DeferredCount), cl...)
+		r.Gauge("channel_deferred_from_delay_count", "timeouted messages peeked from the delayed queue",
+			float64(c.DeferredFromDelayCount), cl...)
+		r.Gauge("channel_delayed_queue_count", "messages waiting in the delayed queue", float64(c.DelayedQueueCount), cl...)
+		r.Counter("channel_messages_total", "total messages of the channel", float64(c.MessageCount), cl...)
+		r.Counter("channel_requeue_total", "total requeued messages", float64(c.RequeueCount), cl...)
+		r.Counter("channel_timeout_total", "total timeouted messages", float64(c.TimeoutCount), cl...)
+		r.Counter("channel_dead_letter_total", "total messages moved to the dead letter topic",
+			float64(c.DeadLetterCount), cl...)
+		r.Counter("channel_expired_total", "total expired messages dropped", float64(c.ExpiredCount), cl...)
+		r.Gauge("channel_client_count", "consumers connected", float64(c.ClientNum), cl...)
+		r.Gauge("channel_paused", "whether the channel is paused", prometheus.BoolToFloat(c.Paused), cl...)
+		r.Gauge("channel_skipped", "whether the channel is skipped", prometheus.BoolToFloat(c.Skipped), cl...)
+		if c.E2eProcessingLatency != nil {
+			for _, item := range c.E2eProcessingLatency.Percentiles {
+				r.SummaryQuantile("channel_e2e_processing_latency_seconds", "e2e processing latency of the channel",
+					item["quantile"], item["value"]/float64(time.Second), cl...)
+			}
+			r.SummaryCount("channel_e2e_processing_latency_seconds", "e2e processing latency of the channel",
+				float64(c.E2eProcessingLatency.Count), cl...)
+		}
+	}
+}
+
+func (s *httpServer) writeCoordMetrics(r *prometheus.Registry, stats []nsqd.TopicStats) {
+	if s.ctx.nsqdCoord == nil {
+		return
+	}
+	for _, t := range stats {
+		part, err := strconv.Atoi(t.TopicPartition)
+		if err != nil {
+			continue
+		}
+		cs := s.ctx.nsqdCoord.Stats(t.TopicName, part)
+		for _, tc := range cs.TopicCoordStats {
+			tl := []prometheus.Label{
+				prometheus.L("topic", tc.Name),
+				prometheus.L("partition", strconv.Itoa(tc.Partition)),
+			}
+			r.Gauge("coord_topic_isr_count", "replicas in the isr of the topic partition", float64(len(tc.ISRStats)), tl...)
+			r.Gauge("coord_topic_catchup_count", "replicas catching up of the topic partition",
+				float64(len(tc.CatchupStats)), tl...)
+			r.Gauge("coord_topic_catchup_rate_bytes", "bytes per second of the catchup data sent for the topic partition",
+				float64(tc.CatchupRate), tl...)
+			for _, isr := range tc.ISRStats {
+				r.Gauge("coord_topic_isr_node", "the node in the isr of the topic partition", 1,
+					append(tl, prometheus.L("node", isr.NodeID))...)
+			}
+			for _, c := range tc.CatchupStats {
+				r.Gauge("coord_topic_catchup_node", "the node catching up of the topic partition", 1,
+					append(tl, prometheus.L("node", c.NodeID))...)
+			}
+			if tc.MirrorStat != nil {
+				r.Gauge("coord_topic_mirror_lag_msgs", "messages not mirrored from the source cluster yet",
+					float64(tc.MirrorStat.LagMsgs), tl...)
+				r.Gauge("coord_topic_mirror_last_sync_time_seconds", "last mirror sync time since unix epoch in seconds",
+					float64(tc.MirrorStat.LastSyncTime), tl...)
+			}
+		}
+	}
+	nodeStats := s.ctx.nsqdCoord.Stats("", -1)
+	if nodeStats.CatchupThrottle != nil {
+		r.Gauge("coord_catchup_rate_bytes", "bytes per second of the catchup data sent from this node",
+			float64(nodeStats.CatchupThrottle.CurrentRate))
+		r.Gauge("coord_catchup_rate_limit_bytes", "the limit of the catchup bytes per second sent from this node, 0 for no limit",
+			float64(nodeStats.CatchupThrottle.RateLimit))
+		r.Counter("coord_catchup_throttled_seconds_total", "total time in seconds waited for the catchup rate limit",
+			float64(nodeStats.CatchupThrottle.WaitedMs)/1000)
+	}
+	errStats := nodeStats.ErrStats
+	r.Counter("coord_write_epoch_errors_total", "total writes failed since the topic epoch changed",
+		float64(errStats.WriteEpochError))
+	r.Counter("coord_write_not_leader_errors_total", "total writes failed since this node is not the topic leader",
+		float64(errStats.WriteNotLeaderError))
+	r.Counter("coord_write_quorum_errors_total", "total writes failed since not enough replicas synced",
+		float64(errStats.WriteQuorumError))
+	r.Counter("coord_write_busy_errors_total", "total writes failed since the write is disabled on the topic partition (such as changing leader)",
+		float64(errStats.WriteBusyError))
+	r.Counter("coord_rpc_check_failed_total", "total rpc calls from the leader rejected for the mismatched epoch or leader of the topic partition",
+		float64(errStats.RpcCheckFailed))
+	r.Counter("coord_leadership_errors_total", "total errors while accessing the leadership store",
+		float64(errStats.LeadershipError))
+	r.Counter("coord_topic_coord_missing_errors_total", "total operations failed since the topic is not on this node",
+		float64(errStats.TopicCoordMissingError))
+	r.Counter("coord_local_errors_total", "total operations failed on the local data",
+		float64(errStats.LocalErr))
+}
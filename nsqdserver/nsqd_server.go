@@ -4,6 +4,7 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"net"
 	"os"
@@ -128,7 +129,17 @@ func NewNsqdServer(opts *nsqd.Options) (*nsqd.NSQD, *NsqdServer, error) {
 		}
 		coord := consistence.NewNsqdCoordinator(opts.ClusterID, ip, tcpPort, rpcport, httpPort,
 			strconv.FormatInt(opts.ID, 10), opts.DataPath, nsqdInstance)
-		l, err := consistence.NewNsqdEtcdMgr(opts.ClusterLeadershipAddresses, opts.ClusterLeadershipUsername, opts.ClusterLeadershipPassword)
+		coord.SetNodeZone(opts.Zone)
+		var l consistence.NSQDLeadership
+		var err error
+		switch opts.ClusterLeadershipBackend {
+		case consistence.LeadershipBackendEtcdV3:
+			l, err = consistence.NewNsqdEtcdV3Mgr(opts.ClusterLeadershipAddresses, opts.ClusterLeadershipUsername, opts.ClusterLeadershipPassword)
+		case consistence.LeadershipBackendEtcd, "":
+			l, err = consistence.NewNsqdEtcdMgr(opts.ClusterLeadershipAddresses, opts.ClusterLeadershipUsername, opts.ClusterLeadershipPassword)
+		default:
+			err = fmt.Errorf("unknown cluster leadership backend: %v", opts.ClusterLeadershipBackend)
+		}
 		if err != nil {
 			nsqd.NsqLogger().LogErrorf("FATAL: failed to init etcd leadership - %s", err)
 			return nil, nil, err
@@ -253,4 +264,5 @@ func (s *NsqdServer) Main() {
 	})
 
 	s.waitGroup.Wrap(s.statsdLoop)
+	s.waitGroup.Wrap(s.delayedPubReleaseLoop)
 }
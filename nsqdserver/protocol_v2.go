@@ -3,6 +3,7 @@ package nsqdserver
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -28,6 +29,7 @@ import (
 const (
 	E_INVALID         = "E_INVALID"
 	E_TOPIC_NOT_EXIST = "E_TOPIC_NOT_EXIST"
+	E_INVALID_DELAY   = "E_INVALID_DELAY"
 )
 
 const (
@@ -329,6 +331,7 @@ func (p *protocolV2) IOLoop(conn net.Conn) error {
 	if client.Channel != nil {
 		client.Channel.RequeueClientMessages(client.ID, client.String())
 		client.Channel.RemoveClient(client.ID, client.GetDesiredTag())
+		p.ctx.forgetSubscribedGroupOwner(client)
 	}
 	client.FinalClose()
 
@@ -381,6 +384,9 @@ func SendMessage(client *nsqd.ClientV2, msg *nsqd.Message, writeExt bool, buf *b
 	if err != nil {
 		return err
 	}
+	if msg.HasRawBody() {
+		return sendRawBodyMessage(client, msg, buf.Bytes(), needFlush)
+	}
 
 	err = internalSend(client, frameTypeMessage, buf.Bytes(), needFlush)
 	if err != nil {
@@ -390,6 +396,36 @@ func SendMessage(client *nsqd.ClientV2, msg *nsqd.Message, writeExt bool, buf *b
 	return nil
 }
 
+// send the message whose body is still in the topic segment file, only the
+// frame header and the message header are written from the memory.
+func sendRawBodyMessage(client *nsqd.ClientV2, msg *nsqd.Message, header []byte, needFlush bool) error {
+	client.LockWrite()
+	defer client.UnlockWrite()
+	if client.Writer == nil {
+		return errors.New("client closed")
+	}
+
+	var beBuf [8]byte
+	binary.BigEndian.PutUint32(beBuf[:4], uint32(4+int64(len(header))+msg.BodySize()))
+	binary.BigEndian.PutUint32(beBuf[4:], uint32(frameTypeMessage))
+	_, err := client.Writer.Write(beBuf[:])
+	if err != nil {
+		return err
+	}
+	_, err = client.Writer.Write(header)
+	if err != nil {
+		return err
+	}
+	err = client.WriteMessageBody(msg)
+	if err != nil {
+		return err
+	}
+	if needFlush {
+		err = client.Flush()
+	}
+	return err
+}
+
 func SendNow(client *nsqd.ClientV2, frameType int32, data []byte) error {
 	return internalSend(client, frameType, data, true)
 }
@@ -432,6 +468,10 @@ func (p *protocolV2) Exec(client *nsqd.ClientV2, params [][]byte) ([]byte, error
 		return p.RDY(client, params)
 	case bytes.Equal(params[0], []byte("REQ")):
 		return p.REQ(client, params)
+	case bytes.Equal(params[0], []byte("MFIN")):
+		return p.MFIN(client, params)
+	case bytes.Equal(params[0], []byte("MREQ")):
+		return p.MREQ(client, params)
 	case bytes.Equal(params[0], []byte("PUB")):
 		return p.PUB(client, params)
 	case bytes.Equal(params[0], []byte("PUB_TRACE")):
@@ -803,6 +843,7 @@ func (p *protocolV2) IDENTIFY(client *nsqd.ClientV2, params [][]byte) ([]byte, e
 		OutputBufferSize    int    `json:"output_buffer_size"`
 		OutputBufferTimeout int64  `json:"output_buffer_timeout"`
 		DesiredTag          string `json:"desired_tag,omitempty"`
+		AckMode             string `json:"ack_mode"`
 	}{
 		MaxRdyCount:         p.ctx.getOpts().MaxRdyCount,
 		Version:             version.Binary,
@@ -818,6 +859,7 @@ func (p *protocolV2) IDENTIFY(client *nsqd.ClientV2, params [][]byte) ([]byte, e
 		OutputBufferSize:    int(client.GetOutputBufferSize()),
 		OutputBufferTimeout: int64(client.GetOutputBufferTimeout() / time.Millisecond),
 		DesiredTag:          client.GetDesiredTag(),
+		AckMode:             client.GetPubAckMode().String(),
 	})
 	if err != nil {
 		return nil, protocol.NewFatalClientErr(err, "E_IDENTIFY_FAILED", "IDENTIFY failed "+err.Error())
@@ -1060,6 +1102,13 @@ func (p *protocolV2) internalSUB(client *nsqd.ClientV2, params [][]byte, enableT
 		topic.DisableForSlave()
 		return nil, protocol.NewFatalClientErr(nil, FailedOnNotLeader, "")
 	}
+	if ordered {
+		// the partition can only be consumed by the owner in the consumer group
+		if err = p.ctx.checkConsumerGroupOwner(topicName, partition, channelName, client); err != nil {
+			nsqd.NsqLogger().Logf("sub ordered failed on %v-%v-%v, remote is : %v, %v", topicName, partition, channelName, client.String(), err)
+			return nil, protocol.NewFatalClientErr(nil, "E_SUB_NOT_GROUP_OWNER", err.Error())
+		}
+	}
 	channel := topic.GetChannel(channelName)
 	// need sync channel after created
 	p.ctx.SyncChannels(topic)
@@ -1090,6 +1139,7 @@ func (p *protocolV2) internalSUB(client *nsqd.ClientV2, params [][]byte, enableT
 			return nil, protocol.NewFatalClientErr(nil, E_INVALID, ErrOrderChannelOnSampleRate.Error())
 		}
 		channel.SetOrdered(true)
+		closeStaleGroupSubscribers(channel, client)
 	} else {
 		if !topic.IsOrdered() && channel.IsOrdered() {
 			nsqd.NsqLogger().Infof("channel %v is in ordered state on non-order topic %v but with normal sub command, remote is : %v, should convert state to non-ordered with http api.",
@@ -1117,6 +1167,27 @@ func (p *protocolV2) internalSUB(client *nsqd.ClientV2, params [][]byte, enableT
 	return okBytes, nil
 }
 
+// closeStaleGroupSubscribers close the ordered subscribers of the other consumer group member or
+// the old generation, since the new owner has subscribed after the group rebalanced.
+func closeStaleGroupSubscribers(channel *nsqd.Channel, client *nsqd.ClientV2) {
+	memberID, gen := client.GetGroupMember()
+	if memberID == "" {
+		return
+	}
+	for id, c := range channel.GetClients() {
+		other, ok := c.(*nsqd.ClientV2)
+		if !ok || id == client.ID {
+			continue
+		}
+		otherMember, otherGen := other.GetGroupMember()
+		if otherMember != memberID || otherGen < gen {
+			nsqd.NsqLogger().Logf("close the stale consumer group subscriber %v (%v, %v) on channel %v since new owner %v (%v, %v) subscribed",
+				other, otherMember, otherGen, channel.GetName(), client, memberID, gen)
+			other.Exit()
+		}
+	}
+}
+
 func (p *protocolV2) RDY(client *nsqd.ClientV2, params [][]byte) ([]byte, error) {
 	state := atomic.LoadInt32(&client.State)
 
@@ -1149,6 +1220,12 @@ func (p *protocolV2) RDY(client *nsqd.ClientV2, params [][]byte) ([]byte, error)
 		return nil, protocol.NewFatalClientErr(nil, E_INVALID,
 			fmt.Sprintf("RDY count %d out of range 0-%d", count, p.ctx.getOpts().MaxRdyCount))
 	}
+	if count > 0 {
+		if err := p.ctx.checkSubscribedGroupOwner(client); err != nil {
+			nsqd.NsqLogger().Logf("[%s] RDY failed since not the consumer group owner: %v", client, err)
+			return nil, protocol.NewFatalClientErr(nil, "E_SUB_NOT_GROUP_OWNER", err.Error())
+		}
+	}
 
 	client.SetReadyCount(count)
 
@@ -1186,6 +1263,10 @@ func (p *protocolV2) FIN(client *nsqd.ClientV2, params [][]byte) ([]byte, error)
 		nsqd.NsqLogger().Logf("topic %v fin message failed for not leader", client.Channel.GetTopicName())
 		return nil, protocol.NewFatalClientErr(nil, FailedOnNotLeader, "")
 	}
+	if err = p.ctx.checkSubscribedGroupOwner(client); err != nil {
+		nsqd.NsqLogger().Logf("[%s] FIN failed since not the consumer group owner: %v", client, err)
+		return nil, protocol.NewFatalClientErr(nil, "E_SUB_NOT_GROUP_OWNER", err.Error())
+	}
 
 	err = p.ctx.FinishMessage(client.Channel, client.ID, client.String(), msgID)
 	if err != nil {
@@ -1236,8 +1317,24 @@ func (p *protocolV2) REQ(client *nsqd.ClientV2, params [][]byte) ([]byte, error)
 		return nil, protocol.NewFatalClientErr(err, E_INVALID,
 			fmt.Sprintf("REQ could not parse timeout %s, %s", params[1], params[2]))
 	}
-	timeoutDuration := time.Duration(timeoutMs) * time.Millisecond
+	timeoutDuration := p.clampReqTimeout(client, time.Duration(timeoutMs)*time.Millisecond)
+	if client.Channel == nil {
+		return nil, protocol.NewFatalClientErr(nil, E_INVALID, "No channel")
+	}
+	if err = p.ctx.checkSubscribedGroupOwner(client); err != nil {
+		nsqd.NsqLogger().Logf("[%s] REQ failed since not the consumer group owner: %v", client, err)
+		return nil, protocol.NewFatalClientErr(nil, "E_SUB_NOT_GROUP_OWNER", err.Error())
+	}
+	err = p.requeueMessage(client, nsqd.GetMessageIDFromFullMsgID(*id), timeoutDuration)
+	if err != nil {
+		return nil, protocol.NewClientErr(err, "E_REQ_FAILED",
+			fmt.Sprintf("REQ %v failed %s", *id, err.Error()))
+	}
 
+	return nil, nil
+}
+
+func (p *protocolV2) clampReqTimeout(client *nsqd.ClientV2, timeoutDuration time.Duration) time.Duration {
 	maxReqTimeout := p.ctx.getOpts().MaxReqTimeout
 	clampedTimeout := timeoutDuration
 
@@ -1249,11 +1346,12 @@ func (p *protocolV2) REQ(client *nsqd.ClientV2, params [][]byte) ([]byte, error)
 	if clampedTimeout != timeoutDuration {
 		nsqd.NsqLogger().Logf("[%s] REQ timeout %d out of range 0-%d. Setting to %d",
 			client, timeoutDuration, maxReqTimeout, clampedTimeout)
-		timeoutDuration = clampedTimeout
-	}
-	if client.Channel == nil {
-		return nil, protocol.NewFatalClientErr(nil, E_INVALID, "No channel")
 	}
+	return clampedTimeout
+}
+
+func (p *protocolV2) requeueMessage(client *nsqd.ClientV2, msgID nsqd.MessageID, timeoutDuration time.Duration) error {
+	var err error
 	// in the queue, we confirm the message as a fifo-alike queue,
 	// Too much req messages in memory will block the queue read from disk until the requeued message confirmed.
 	// To avoid block by req, we put some of the req messages to the end of queue of some conditions meet
@@ -1263,7 +1361,6 @@ func (p *protocolV2) REQ(client *nsqd.ClientV2, params [][]byte) ([]byte, error)
 	// to avoid delivery the delayed message early than required, we
 	// can update the inflight message to the new message put backed at the queue
 
-	msgID := nsqd.GetMessageIDFromFullMsgID(*id)
 	topic, _ := p.ctx.getExistingTopic(client.Channel.GetTopicName(), client.Channel.GetTopicPart())
 	oldMsg, toEnd := client.Channel.ShouldRequeueToEnd(client.ID, client.String(),
 		msgID, timeoutDuration, true)
@@ -1278,7 +1375,7 @@ func (p *protocolV2) REQ(client *nsqd.ClientV2, params [][]byte) ([]byte, error)
 		if timeoutDuration > 0 {
 			nsqd.NsqLogger().Logf("ignore delay for ordered topic: %v, %v, %v, %v",
 				client, client.Channel.GetTopicName(), client.Channel.GetName(), timeoutDuration)
-			return nil, nil
+			return nil
 		}
 	}
 	if toEnd {
@@ -1298,11 +1395,220 @@ func (p *protocolV2) REQ(client *nsqd.ClientV2, params [][]byte) ([]byte, error)
 
 		nsqd.NsqLogger().Logf("client %v req failed %v for topic: %v, %v, %v, %v",
 			client, err.Error(), client.Channel.GetTopicName(), client.Channel.GetName(), msgID, timeoutDuration)
-		return nil, protocol.NewClientErr(err, "E_REQ_FAILED",
-			fmt.Sprintf("REQ %v failed %s", *id, err.Error()))
 	}
+	return err
+}
 
-	return nil, nil
+// read the message id list for MFIN and MREQ, the body is: [4-byte size][16-byte id][16-byte id]...
+func (p *protocolV2) readMsgIDList(client *nsqd.ClientV2, cmd string) ([]nsqd.FullMessageID, error) {
+	bodyLen, err := readLen(client.Reader, client.LenSlice)
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_BAD_BODY", cmd+" failed to read body size")
+	}
+	if bodyLen <= 0 || bodyLen%nsqd.MsgIDLength != 0 {
+		return nil, protocol.NewFatalClientErr(nil, "E_BAD_BODY",
+			fmt.Sprintf("%s invalid body size %d", cmd, bodyLen))
+	}
+	if int64(bodyLen) > p.ctx.getOpts().MaxBodySize {
+		return nil, protocol.NewFatalClientErr(nil, "E_BAD_BODY",
+			fmt.Sprintf("%s body too big %d > %d", cmd, bodyLen, p.ctx.getOpts().MaxBodySize))
+	}
+	body := make([]byte, bodyLen)
+	_, err = io.ReadFull(client.Reader, body)
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_BAD_BODY", cmd+" failed to read body")
+	}
+	ids := make([]nsqd.FullMessageID, 0, int(bodyLen)/nsqd.MsgIDLength)
+	for pos := 0; pos < len(body); pos += nsqd.MsgIDLength {
+		var id nsqd.FullMessageID
+		copy(id[:], body[pos:pos+nsqd.MsgIDLength])
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+type msgIDError struct {
+	ID   string `json:"id"`
+	Code string `json:"code"`
+	Err  string `json:"err"`
+}
+
+// the batch response is OK if all the messages are handled successfully, otherwise
+// the json list of the failed message ids with the error.
+func getBatchAckResponse(ids []nsqd.FullMessageID, msgErrs []error, code string) ([]byte, error) {
+	var failed []msgIDError
+	for i, err := range msgErrs {
+		if err == nil {
+			continue
+		}
+		failed = append(failed, msgIDError{
+			ID:   hex.EncodeToString(ids[i][:]),
+			Code: code,
+			Err:  err.Error(),
+		})
+	}
+	if len(failed) == 0 {
+		return okBytes, nil
+	}
+	return json.Marshal(struct {
+		Failed []msgIDError `json:"failed"`
+	}{
+		Failed: failed,
+	})
+}
+
+// MFIN finish a batch of messages, and the channel offset will be synced to the replicas only once.
+// Unlike FIN, a response is always sent so the client can know the result of each message.
+// params: [MFIN], body: [4-byte size][16-byte id]...
+func (p *protocolV2) MFIN(client *nsqd.ClientV2, params [][]byte) ([]byte, error) {
+	state := atomic.LoadInt32(&client.State)
+	if state != stateSubscribed && state != stateClosing {
+		nsqd.NsqLogger().LogWarningf("[%s] command in wrong state: %v", client, state)
+		return nil, protocol.NewFatalClientErr(nil, E_INVALID, "cannot MFIN in current state")
+	}
+	ids, err := p.readMsgIDList(client, "MFIN")
+	if err != nil {
+		return nil, err
+	}
+	if client.Channel == nil {
+		return nil, protocol.NewFatalClientErr(nil, E_INVALID, "No channel")
+	}
+	if !p.ctx.checkConsumeForMasterWrite(client.Channel.GetTopicName(), client.Channel.GetTopicPart()) {
+		nsqd.NsqLogger().Logf("topic %v fin message failed for not leader", client.Channel.GetTopicName())
+		return nil, protocol.NewFatalClientErr(nil, FailedOnNotLeader, "")
+	}
+	if err = p.ctx.checkSubscribedGroupOwner(client); err != nil {
+		nsqd.NsqLogger().Logf("[%s] MFIN failed since not the consumer group owner: %v", client, err)
+		return nil, protocol.NewFatalClientErr(nil, "E_SUB_NOT_GROUP_OWNER", err.Error())
+	}
+
+	msgIDs := make([]nsqd.MessageID, len(ids))
+	msgErrs := make([]error, len(ids))
+	for i, id := range ids {
+		msgIDs[i] = nsqd.GetMessageIDFromFullMsgID(id)
+		if int64(msgIDs[i]) <= 0 {
+			msgErrs[i] = errors.New("Invalid Message ID")
+		}
+	}
+	finErrs, err := p.ctx.FinishMessages(client.Channel, client.ID, client.String(), msgIDs)
+	if err != nil {
+		client.IncrSubError(int64(len(ids)))
+		nsqd.NsqLogger().LogDebugf("MFIN error : %v, channel: %v, topic: %v", err,
+			client.Channel.GetName(), client.Channel.GetTopicName())
+		if clusterErr, ok := err.(*consistence.CommonCoordErr); ok {
+			if !clusterErr.IsLocalErr() {
+				return nil, protocol.NewFatalClientErr(err, FailedOnNotWritable, "")
+			}
+		}
+		return nil, protocol.NewClientErr(err, "E_FIN_FAILED",
+			fmt.Sprintf("MFIN failed %s", err.Error()))
+	}
+	failedCnt := 0
+	for i, finErr := range finErrs {
+		if msgErrs[i] == nil && finErr != nil {
+			msgErrs[i] = finErr
+		}
+		if msgErrs[i] != nil {
+			failedCnt++
+		}
+	}
+	if failedCnt > 0 {
+		client.IncrSubError(int64(failedCnt))
+	}
+	return getBatchAckResponse(ids, msgErrs, "E_FIN_FAILED")
+}
+
+// MREQ requeue a batch of messages with the same timeout, the messages requeued to end are finished
+// together. Unlike REQ, a response is always sent.
+// params: [MREQ timeout], body: [4-byte size][16-byte id]...
+func (p *protocolV2) MREQ(client *nsqd.ClientV2, params [][]byte) ([]byte, error) {
+	state := atomic.LoadInt32(&client.State)
+	if state != stateSubscribed && state != stateClosing {
+		nsqd.NsqLogger().LogWarningf("[%s] command in wrong state: %v", client, state)
+		return nil, protocol.NewFatalClientErr(nil, E_INVALID, "cannot MREQ in current state")
+	}
+	if len(params) < 2 {
+		return nil, protocol.NewFatalClientErr(nil, E_INVALID, "MREQ insufficient number of params")
+	}
+	timeoutMs, err := protocol.ByteToBase10(params[1])
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(err, E_INVALID,
+			fmt.Sprintf("MREQ could not parse timeout %s", params[1]))
+	}
+	// the params will be changed after reading the body
+	timeoutDuration := p.clampReqTimeout(client, time.Duration(timeoutMs)*time.Millisecond)
+	ids, err := p.readMsgIDList(client, "MREQ")
+	if err != nil {
+		return nil, err
+	}
+	if client.Channel == nil {
+		return nil, protocol.NewFatalClientErr(nil, E_INVALID, "No channel")
+	}
+	if err = p.ctx.checkSubscribedGroupOwner(client); err != nil {
+		nsqd.NsqLogger().Logf("[%s] MREQ failed since not the consumer group owner: %v", client, err)
+		return nil, protocol.NewFatalClientErr(nil, "E_SUB_NOT_GROUP_OWNER", err.Error())
+	}
+	msgIDs := make([]nsqd.MessageID, len(ids))
+	for i, id := range ids {
+		msgIDs[i] = nsqd.GetMessageIDFromFullMsgID(id)
+	}
+	msgErrs := p.requeueMessages(client, msgIDs, timeoutDuration)
+	return getBatchAckResponse(ids, msgErrs, "E_REQ_FAILED")
+}
+
+// requeueMessages is the batch version of requeueMessage, the messages requeued to end
+// will be finished together, so the channel offset is synced only once.
+func (p *protocolV2) requeueMessages(client *nsqd.ClientV2, msgIDs []nsqd.MessageID, timeoutDuration time.Duration) []error {
+	msgErrs := make([]error, len(msgIDs))
+	topic, _ := p.ctx.getExistingTopic(client.Channel.GetTopicName(), client.Channel.GetTopicPart())
+	// the channel under non-order topic may also sub with ordered
+	isOrderedCh := client.Channel.IsOrdered()
+	if topic != nil && topic.IsOrdered() {
+		isOrderedCh = true
+	}
+	if isOrderedCh && timeoutDuration > 0 {
+		// for ordered topic, disable defer since it may block the consume
+		nsqd.NsqLogger().Logf("ignore delay for ordered topic: %v, %v, %v, %v",
+			client, client.Channel.GetTopicName(), client.Channel.GetName(), timeoutDuration)
+		return msgErrs
+	}
+	var toEndMsgs []*nsqd.Message
+	var toEndIndexes []int
+	for i, msgID := range msgIDs {
+		oldMsg, toEnd := client.Channel.ShouldRequeueToEnd(client.ID, client.String(),
+			msgID, timeoutDuration, true)
+		if toEnd && !isOrderedCh {
+			toEndMsgs = append(toEndMsgs, oldMsg)
+			toEndIndexes = append(toEndIndexes, i)
+			continue
+		}
+		msgErrs[i] = client.Channel.RequeueMessage(client.ID, client.String(), msgID, timeoutDuration, true)
+	}
+	if len(toEndMsgs) > 0 {
+		toEndErrs := p.ctx.internalRequeueToEndBatch(client.Channel, client.ID, toEndMsgs, timeoutDuration)
+		// try to reduce timeout to requeue to memory if failed to requeue to end
+		memTimeout := timeoutDuration
+		if memTimeout > p.ctx.getOpts().ReqToEndThreshold {
+			memTimeout = p.ctx.getOpts().ReqToEndThreshold
+		}
+		for j, i := range toEndIndexes {
+			if toEndErrs[j] == nil {
+				continue
+			}
+			nsqd.NsqLogger().LogWarningf("[%s] req channel %v(%v) failed: %v", client,
+				client.Channel.GetName(), client.Channel.GetTopicName(), toEndErrs[j])
+			msgErrs[i] = client.Channel.RequeueMessage(client.ID, client.String(), msgIDs[i], memTimeout, true)
+		}
+	}
+	for i, err := range msgErrs {
+		if err == nil {
+			continue
+		}
+		client.IncrSubError(int64(1))
+		nsqd.NsqLogger().Logf("client %v req failed %v for topic: %v, %v, %v, %v",
+			client, err.Error(), client.Channel.GetTopicName(), client.Channel.GetName(), msgIDs[i], timeoutDuration)
+	}
+	return msgErrs
 }
 
 func (p *protocolV2) CLS(client *nsqd.ClientV2, params [][]byte) ([]byte, error) {
@@ -1562,6 +1868,8 @@ func (p *protocolV2) internalPubExtAndTrace(client *nsqd.ClientV2, params [][]by
 	var realBody []byte
 	var extContent ext.IExtContent
 	var jsonHeader *simpleJson.Json
+	var needDedup bool
+	var deliverAt int64
 	extContent = ext.NewNoExt()
 	if traceEnable && !pubExt {
 		traceID = binary.BigEndian.Uint64(messageBody[:nsqd.MsgTraceIDLength])
@@ -1595,6 +1903,13 @@ func (p *protocolV2) internalPubExtAndTrace(client *nsqd.ClientV2, params [][]by
 			}
 			needTraceRsp = true
 		}
+		_, hasProducer := jsonHeader.CheckGet(ext.PRODUCER_ID_KEY)
+		_, hasDedupKey := jsonHeader.CheckGet(ext.DEDUP_KEY)
+		needDedup = hasProducer || hasDedupKey
+		deliverAt, err = nsqd.GetDelayedPubTs(jsonHeader, time.Now(), p.ctx.getOpts().MaxReqTimeout)
+		if err != nil {
+			return nil, protocol.NewClientErr(err, E_INVALID_DELAY, err.Error())
+		}
 
 		jhe := ext.NewJsonHeaderExt()
 		jhe.SetJsonHeaderBytes(extJsonBytes)
@@ -1603,7 +1918,9 @@ func (p *protocolV2) internalPubExtAndTrace(client *nsqd.ClientV2, params [][]by
 	} else {
 		realBody = messageBody
 	}
-	if needTraceRsp || atomic.LoadInt32(&topic.EnableTrace) == 1 {
+	// the async pub is batched with other clients, so it only support the default ack mode,
+	// and the duplicated producer sequence should not fail the messages from other clients
+	if needTraceRsp || atomic.LoadInt32(&topic.EnableTrace) == 1 || client.GetPubAckMode() != nsqd.PubAckAll || needDedup || deliverAt > 0 {
 		asyncAction = false
 	}
 	if !topic.IsExt() && extContent.ExtVersion() != ext.NO_EXT_VER {
@@ -1625,10 +1942,15 @@ func (p *protocolV2) internalPubExtAndTrace(client *nsqd.ClientV2, params [][]by
 	rawSize := int32(0)
 	if asyncAction {
 		err = internalPubAsync(client.PubTimeout, realBody, topic, extContent)
+	} else if deliverAt > 0 {
+		id, offset, rawSize, _, err = p.ctx.PutDelayedPubMessage(topic, realBody, extContent, traceID, deliverAt)
 	} else {
-		id, offset, rawSize, _, err = p.ctx.PutMessage(topic, realBody, extContent, traceID)
+		id, offset, rawSize, _, err = p.ctx.PutMessage(topic, realBody, extContent, traceID, client.GetPubAckMode())
 	}
 	//p.ctx.setHealth(err)
+	if err == nsqd.ErrProducerSeqDuplicated {
+		return nil, protocol.NewClientErr(err, "E_DUPLICATED_SEQ", err.Error())
+	}
 	if err != nil {
 		if client.PubStats != nil {
 			client.PubStats.IncrCounter(1, true)
@@ -1667,8 +1989,9 @@ func (p *protocolV2) internalMPUBEXTAndTrace(client *nsqd.ClientV2, params [][]b
 		return nil, preErr
 	}
 
-	messages, buffers, preErr := readMPUBEXT(client.Reader, client.LenSlice, topic,
-		p.ctx.getOpts().MaxMsgSize, p.ctx.getOpts().MaxBodySize, traceEnable, mpubExt, p.ctx.getOpts().AllowExtCompatible)
+	messages, buffers, hasDelayedPub, preErr := readMPUBEXT(client.Reader, client.LenSlice, topic,
+		p.ctx.getOpts().MaxMsgSize, p.ctx.getOpts().MaxBodySize, traceEnable, mpubExt, p.ctx.getOpts().AllowExtCompatible,
+		p.ctx.getOpts().MaxReqTimeout)
 
 	defer func() {
 		for _, b := range buffers {
@@ -1682,8 +2005,19 @@ func (p *protocolV2) internalMPUBEXTAndTrace(client *nsqd.ClientV2, params [][]b
 	topicName := topic.GetTopicName()
 	partition := topic.GetTopicPart()
 	if p.ctx.checkForMasterWrite(topicName, partition) {
-		id, offset, rawSize, err := p.ctx.PutMessages(topic, messages)
+		var id nsqd.MessageID
+		var offset nsqd.BackendOffset
+		var rawSize int32
+		var err error
+		if hasDelayedPub {
+			id, offset, rawSize, err = p.ctx.putMessagesWithDelayedPub(topic, messages, client.GetPubAckMode())
+		} else {
+			id, offset, rawSize, err = p.ctx.PutMessages(topic, messages, client.GetPubAckMode())
+		}
 		//p.ctx.setHealth(err)
+		if err == nsqd.ErrProducerSeqDuplicated {
+			return nil, protocol.NewClientErr(err, "E_DUPLICATED_SEQ", err.Error())
+		}
 		if err != nil {
 			topic.IncrPubFailed()
 			incrServerPubFailed()
@@ -1754,21 +2088,25 @@ func (p *protocolV2) TOUCH(client *nsqd.ClientV2, params [][]byte) ([]byte, erro
 
 func readMPUB(r io.Reader, tmp []byte, topic *nsqd.Topic, maxMessageSize int64,
 	maxBodySize int64, traceEnable bool) ([]*nsqd.Message, []*bytes.Buffer, error) {
-	return readMPUBEXT(r, tmp, topic, maxMessageSize, maxBodySize, traceEnable, false, false)
+	msgs, buffers, _, err := readMPUBEXT(r, tmp, topic, maxMessageSize, maxBodySize, traceEnable, false, false, 0)
+	return msgs, buffers, err
 }
 
+// readMPUBEXT read the messages in batch, the scheduled messages in the batch (only in MPUB_EXT)
+// are marked as the delayed pub, and whether there is any scheduled message is returned.
 func readMPUBEXT(r io.Reader, tmp []byte, topic *nsqd.Topic, maxMessageSize int64,
-	maxBodySize int64, traceEnable bool, mpubExt bool, allowExtCompatible bool) ([]*nsqd.Message, []*bytes.Buffer, error) {
+	maxBodySize int64, traceEnable bool, mpubExt bool, allowExtCompatible bool,
+	maxDelay time.Duration) ([]*nsqd.Message, []*bytes.Buffer, bool, error) {
 	numMessages, err := readLen(r, tmp)
 	if err != nil {
-		return nil, nil, protocol.NewFatalClientErr(err, "E_BAD_BODY", "MPUB failed to read message count")
+		return nil, nil, false, protocol.NewFatalClientErr(err, "E_BAD_BODY", "MPUB failed to read message count")
 	}
 
 	// 4 == total num, 5 == length + min 1
 	maxMessages := (maxBodySize - 4) / 5
 
 	if numMessages <= 0 || int64(numMessages) > maxMessages {
-		return nil, nil, protocol.NewFatalClientErr(err, "E_BAD_BODY",
+		return nil, nil, false, protocol.NewFatalClientErr(err, "E_BAD_BODY",
 			fmt.Sprintf("MPUB invalid message count %d", numMessages))
 	}
 
@@ -1776,20 +2114,21 @@ func readMPUBEXT(r io.Reader, tmp []byte, topic *nsqd.Topic, maxMessageSize int6
 	buffers := make([]*bytes.Buffer, 0, numMessages)
 	topicName := topic.GetTopicName()
 	topicExt := topic.IsExt()
+	hasDelayedPub := false
 	for i := int32(0); i < numMessages; i++ {
 		messageSize, err := readLen(r, tmp)
 		if err != nil {
-			return nil, buffers, protocol.NewFatalClientErr(err, "E_BAD_MESSAGE",
+			return nil, buffers, false, protocol.NewFatalClientErr(err, "E_BAD_MESSAGE",
 				fmt.Sprintf("MPUB failed to read message(%d) body size", i))
 		}
 
 		if messageSize <= 0 {
-			return nil, buffers, protocol.NewFatalClientErr(nil, "E_BAD_MESSAGE",
+			return nil, buffers, false, protocol.NewFatalClientErr(nil, "E_BAD_MESSAGE",
 				fmt.Sprintf("MPUB invalid message(%d) body size %d", i, messageSize))
 		}
 
 		if int64(messageSize) > maxMessageSize {
-			return nil, buffers, protocol.NewFatalClientErr(nil, "E_BAD_MESSAGE",
+			return nil, buffers, false, protocol.NewFatalClientErr(nil, "E_BAD_MESSAGE",
 				fmt.Sprintf("MPUB message too big %d > %d", messageSize, maxMessageSize))
 		}
 
@@ -1797,7 +2136,7 @@ func readMPUBEXT(r io.Reader, tmp []byte, topic *nsqd.Topic, maxMessageSize int6
 		buffers = append(buffers, b)
 		_, err = io.CopyN(b, r, int64(messageSize))
 		if err != nil {
-			return nil, buffers, protocol.NewFatalClientErr(err, "E_BAD_MESSAGE", "MPUB failed to read message body")
+			return nil, buffers, false, protocol.NewFatalClientErr(err, "E_BAD_MESSAGE", "MPUB failed to read message body")
 		}
 
 		//parse ext header or trace
@@ -1808,9 +2147,10 @@ func readMPUBEXT(r io.Reader, tmp []byte, topic *nsqd.Topic, maxMessageSize int6
 		var realBody []byte
 		var extJsonLen uint16
 		var canIgnoreExt bool
+		var deliverAt int64
 		if traceEnable && !mpubExt {
 			if messageSize <= nsqd.MsgTraceIDLength {
-				return nil, buffers, protocol.NewFatalClientErr(nil, "E_BAD_MESSAGE",
+				return nil, buffers, false, protocol.NewFatalClientErr(nil, "E_BAD_MESSAGE",
 					fmt.Sprintf("MPUB invalid message(%d) body size %d for tracing", i, messageSize))
 			}
 			traceID = binary.BigEndian.Uint64(msgBody[:nsqd.MsgTraceIDLength])
@@ -1820,7 +2160,7 @@ func readMPUBEXT(r io.Reader, tmp []byte, topic *nsqd.Topic, maxMessageSize int6
 			extJsonLen = binary.BigEndian.Uint16(msgBody[:nsqd.MsgJsonHeaderLength])
 			//check json length, make sure it does not exceed slice length
 			if messageSize <= nsqd.MsgJsonHeaderLength+int32(extJsonLen) {
-				return nil, buffers, protocol.NewFatalClientErr(nil, "E_BAD_BODY",
+				return nil, buffers, false, protocol.NewFatalClientErr(nil, "E_BAD_BODY",
 					fmt.Sprintf("invalid body size %d in ext json header content length", messageSize))
 			}
 			extJsonBytes = msgBody[nsqd.MsgJsonHeaderLength : nsqd.MsgJsonHeaderLength+extJsonLen]
@@ -1828,7 +2168,7 @@ func readMPUBEXT(r io.Reader, tmp []byte, topic *nsqd.Topic, maxMessageSize int6
 			if extJsonLen > 0 {
 				jsonHeader, err := simpleJson.NewJson(extJsonBytes)
 				if err != nil {
-					return nil, buffers, protocol.NewClientErr(err, ext.E_INVALID_JSON_HEADER, "fail to parse json header")
+					return nil, buffers, false, protocol.NewClientErr(err, ext.E_INVALID_JSON_HEADER, "fail to parse json header")
 				}
 
 				//parse traceID, if there is any
@@ -1836,13 +2176,17 @@ func readMPUBEXT(r io.Reader, tmp []byte, topic *nsqd.Topic, maxMessageSize int6
 				if existInJsonHeader {
 					traceIDStr, err := traceIDJson.String()
 					if err != nil {
-						return nil, buffers, protocol.NewClientErr(err, "INVALID_TRACE_ID", "passin trace id should be string")
+						return nil, buffers, false, protocol.NewClientErr(err, "INVALID_TRACE_ID", "passin trace id should be string")
 					}
 					traceID, err = strconv.ParseUint(traceIDStr, 10, 0)
 					if err != nil {
-						return nil, buffers, protocol.NewClientErr(err, "INVALID_TRACE_ID", "invalid trace id")
+						return nil, buffers, false, protocol.NewClientErr(err, "INVALID_TRACE_ID", "invalid trace id")
 					}
 				}
+				deliverAt, err = nsqd.GetDelayedPubTs(jsonHeader, time.Now(), maxDelay)
+				if err != nil {
+					return nil, buffers, false, protocol.NewClientErr(err, E_INVALID_DELAY, err.Error())
+				}
 				//check compatibility when topic does not support ext
 				if !topicExt {
 					if allowExtCompatible {
@@ -1853,7 +2197,7 @@ func readMPUBEXT(r io.Reader, tmp []byte, topic *nsqd.Topic, maxMessageSize int6
 						nsqd.NsqLogger().Debugf("ext content ignored in topic: %v", topicName)
 					} else {
 						nsqd.NsqLogger().Infof("ext content not supported in topic: %v", topicName)
-						return nil, buffers, protocol.NewClientErr(nil, ext.E_EXT_NOT_SUPPORT,
+						return nil, buffers, false, protocol.NewClientErr(nil, ext.E_EXT_NOT_SUPPORT,
 							fmt.Sprintf("ext content not supported in topic %v", topicName))
 					}
 				}
@@ -1871,11 +2215,15 @@ func readMPUBEXT(r io.Reader, tmp []byte, topic *nsqd.Topic, maxMessageSize int6
 			msg = nsqd.NewMessage(0, realBody)
 		}
 		msg.TraceID = traceID
+		if deliverAt > 0 {
+			msg.SetDelayedPub(deliverAt)
+			hasDelayedPub = true
+		}
 		messages = append(messages, msg)
 		topic.GetDetailStats().UpdateTopicMsgStats(int64(len(realBody)), 0)
 	}
 
-	return messages, buffers, nil
+	return messages, buffers, hasDelayedPub, nil
 }
 
 //remove any zan_test header in json ext if value != true(bool, string)
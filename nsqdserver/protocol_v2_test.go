@@ -6,10 +6,12 @@ import (
 	"compress/flate"
 	"crypto/tls"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math"
 	"math/rand"
 	"net"
@@ -1089,6 +1091,117 @@ func TestPubJsonHeaderIgnored(t *testing.T) {
 	test.Equal(t, true, strings.Contains(string(data), ext.E_EXT_NOT_SUPPORT))
 }
 
+func TestPubExtProducerDedup(t *testing.T) {
+	topicName := "test_pub_ext_dedup" + strconv.Itoa(int(time.Now().Unix()))
+
+	opts := nsqdNs.NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.DedupWindowSize = 2
+	tcpAddr, _, nsqd, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
+	topic := nsqd.GetTopicWithExt(topicName, 0, false)
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Equal(t, err, nil)
+	defer conn.Close()
+	identify(t, conn, map[string]interface{}{"extend_support": true}, frameTypeResponse)
+	pubSeq := func(seq int) (int32, []byte) {
+		cmd, _ := nsq.PublishWithJsonExt(topicName, "0", []byte("body"),
+			[]byte(fmt.Sprintf(`{"##producer_id":"p1","##producer_seq":%v}`, seq)))
+		cmd.WriteTo(conn)
+		resp, _ := nsq.ReadResponse(conn)
+		frameType, data, _ := nsq.UnpackResponse(resp)
+		return frameType, data
+	}
+	// the retry on the standalone nsqd should be acked without writing again
+	frameType, data := pubSeq(1)
+	test.Equal(t, frameTypeResponse, frameType)
+	test.Equal(t, []byte("OK"), data)
+	frameType, _ = pubSeq(1)
+	test.Equal(t, frameTypeResponse, frameType)
+	test.Equal(t, uint64(1), topic.TotalMessageCnt())
+
+	cmd, err := nsq.MultiPublishWithJsonExt(topicName, "0", []*nsq.MsgExt{
+		&nsq.MsgExt{Custom: map[string]interface{}{ext.PRODUCER_ID_KEY: "p1", ext.PRODUCER_SEQ_KEY: "1"}},
+		&nsq.MsgExt{Custom: map[string]interface{}{ext.PRODUCER_ID_KEY: "p1", ext.PRODUCER_SEQ_KEY: "2"}},
+		&nsq.MsgExt{Custom: map[string]interface{}{ext.PRODUCER_ID_KEY: "p1", ext.PRODUCER_SEQ_KEY: "2"}},
+		&nsq.MsgExt{Custom: map[string]interface{}{ext.PRODUCER_ID_KEY: "p1", ext.PRODUCER_SEQ_KEY: "3"}},
+	}, [][]byte{[]byte("b1"), []byte("b2"), []byte("b2"), []byte("b3")})
+	test.Nil(t, err)
+	cmd.WriteTo(conn)
+	readValidate(t, conn, frameTypeResponse, "OK")
+	test.Equal(t, uint64(3), topic.TotalMessageCnt())
+
+	// the sequence out of the window should be rejected
+	frameType, data = pubSeq(1)
+	test.Equal(t, frameTypeError, frameType)
+	test.Equal(t, true, strings.Contains(string(data), "E_DUPLICATED_SEQ"))
+	test.Equal(t, uint64(3), topic.TotalMessageCnt())
+}
+
+func TestPubExtDelayedPub(t *testing.T) {
+	topicName := "test_pub_ext_delayed" + strconv.Itoa(int(time.Now().Unix()))
+
+	opts := nsqdNs.NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.MaxReqTimeout = time.Minute
+	tcpAddr, _, nsqd, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
+	topic := nsqd.GetTopicWithExt(topicName, 0, false)
+	topic.GetChannel("ch")
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Equal(t, err, nil)
+	defer conn.Close()
+	identify(t, conn, map[string]interface{}{"extend_support": true}, frameTypeResponse)
+	start := time.Now()
+	cmd, _ := nsq.PublishWithJsonExt(topicName, "0", []byte("delayed1"), []byte(`{"##delay_ms":"1000"}`))
+	cmd.WriteTo(conn)
+	readValidate(t, conn, frameTypeResponse, "OK")
+
+	// the delay exceed the max req timeout
+	cmd, _ = nsq.PublishWithJsonExt(topicName, "0", []byte("delayed2"), []byte(`{"##delay_ms":"120000"}`))
+	cmd.WriteTo(conn)
+	resp, _ := nsq.ReadResponse(conn)
+	frameType, data, _ := nsq.UnpackResponse(resp)
+	test.Equal(t, frameTypeError, frameType)
+	test.Equal(t, true, strings.Contains(string(data), E_INVALID_DELAY))
+
+	cmd, err = nsq.MultiPublishWithJsonExt(topicName, "0", []*nsq.MsgExt{
+		&nsq.MsgExt{Custom: map[string]interface{}{ext.DELAY_MS_KEY: "1000"}},
+		&nsq.MsgExt{},
+	}, [][]byte{[]byte("delayed3"), []byte("normal")})
+	test.Nil(t, err)
+	cmd.WriteTo(conn)
+	readValidate(t, conn, frameTypeResponse, "OK")
+
+	delayedCnt, _ := topic.GetDelayedQueue().GetCurrentDelayedCnt(nsqdNs.PubDelayed, "")
+	test.Equal(t, uint64(2), delayedCnt)
+	test.Equal(t, int64(1), int64(topic.TotalMessageCnt()))
+
+	sub(t, conn, topicName, "ch")
+	_, err = nsq.Ready(3).WriteTo(conn)
+	test.Equal(t, err, nil)
+	msgOut := recvNextMsgAndCheckExt(t, conn, 0, 0, true, true)
+	test.Equal(t, []byte("normal"), msgOut.Body)
+	test.Equal(t, true, time.Since(start) < time.Second)
+	delayedBodys := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		msgOut = recvNextMsgAndCheckExt(t, conn, 0, 0, true, true)
+		test.Equal(t, true, time.Since(start) >= time.Second)
+		delayedBodys[string(msgOut.Body)] = true
+	}
+	test.Equal(t, map[string]bool{"delayed1": true, "delayed3": true}, delayedBodys)
+	// the released message is removed from the delayed queue after published
+	time.Sleep(time.Millisecond * 100)
+	delayedCnt, _ = topic.GetDelayedQueue().GetCurrentDelayedCnt(nsqdNs.PubDelayed, "")
+	test.Equal(t, uint64(0), delayedCnt)
+	test.Equal(t, int64(2), topic.DelayedPubReleased())
+	test.Equal(t, int64(3), int64(topic.TotalMessageCnt()))
+}
+
 func TestConsumeMessageWhileUpgrade(t *testing.T) {
 	topicName := "test_ext_topic_upgrade" + strconv.Itoa(int(time.Now().Unix()))
 
@@ -5244,6 +5357,90 @@ func TestSnappy(t *testing.T) {
 	test.Equal(t, msgOut.Body, msg.Body)
 }
 
+func TestZeroCopyLargeMessage(t *testing.T) {
+	opts := nsqdNs.NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.LogLevel = 2
+	opts.SnappyEnabled = true
+	opts.ZeroCopyMinSize = 1024
+	if testing.Verbose() {
+		nsqdNs.SetLogger(opts.Logger)
+	}
+	tcpAddr, _, nsqd, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
+
+	topicName := "test_zero_copy" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopicIgnPart(topicName)
+	topic.GetChannel("ch")
+	topic.GetChannel("ch_snappy")
+	largeBody := make([]byte, 128000)
+	for i := range largeBody {
+		largeBody[i] = byte(i)
+	}
+	msgs := []*nsqdNs.Message{
+		nsqdNs.NewMessage(0, largeBody),
+		nsqdNs.NewMessage(0, []byte("small body")),
+	}
+	for _, msg := range msgs {
+		topic.PutMessage(msg)
+	}
+	topic.ForceFlush()
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Equal(t, err, nil)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+	_, err = nsq.Ready(1).WriteTo(conn)
+	test.Equal(t, err, nil)
+
+	// the requeued message should be sent from the segment file again
+	msgOut := recvNextMsgAndCheck(t, conn, len(largeBody), 0, false)
+	test.Equal(t, largeBody, msgOut.Body)
+	_, err = nsq.Requeue(nsq.MessageID(msgOut.GetFullMsgID()), 0).WriteTo(conn)
+	test.Equal(t, err, nil)
+	for i := 0; i < 2; i++ {
+		msgOut = recvNextMsgAndCheck(t, conn, 0, 0, true)
+		if len(msgOut.Body) == len(largeBody) {
+			test.Equal(t, largeBody, msgOut.Body)
+			test.Equal(t, uint16(2), msgOut.Attempts)
+		} else {
+			test.Equal(t, msgs[1].Body, msgOut.Body)
+		}
+	}
+
+	tstats := nsqd.GetTopicStats(true, topicName)
+	test.Equal(t, 1, len(tstats))
+	for _, chStats := range tstats[0].Channels {
+		if chStats.ChannelName == "ch" {
+			test.Equal(t, 1, len(chStats.Clients))
+			test.Equal(t, uint64(2), chStats.Clients[0].ZeroCopyCount)
+		}
+	}
+
+	// the body is copied from the segment file to the compressed writer
+	conn2, err := mustConnectNSQD(tcpAddr)
+	test.Equal(t, err, nil)
+	defer conn2.Close()
+	identify(t, conn2, map[string]interface{}{
+		"snappy": true,
+	}, frameTypeResponse)
+	compressConn := snappy.NewReader(conn2)
+	resp, _ := nsq.ReadResponse(compressConn)
+	frameType, data, _ := nsq.UnpackResponse(resp)
+	test.Equal(t, frameType, frameTypeResponse)
+	test.Equal(t, data, []byte("OK"))
+	rw := readWriter{compressConn, snappy.NewWriter(conn2)}
+	sub(t, rw, topicName, "ch_snappy")
+	_, err = nsq.Ready(1).WriteTo(rw)
+	test.Equal(t, err, nil)
+	msgOut = recvNextMsgAndCheck(t, rw, len(largeBody), 0, true)
+	test.Equal(t, largeBody, msgOut.Body)
+	msgOut = recvNextMsgAndCheck(t, rw, len(msgs[1].Body), 0, true)
+	test.Equal(t, msgs[1].Body, msgOut.Body)
+}
+
 func TestTLSDeflate(t *testing.T) {
 	opts := nsqdNs.NewOptions()
 	opts.Logger = newTestLogger(t)
@@ -5448,6 +5645,177 @@ func TestTLSSnappy(t *testing.T) {
 	test.Equal(t, data, []byte("OK"))
 }
 
+func readNonHeartbeatResponse(t *testing.T, conn io.ReadWriter) (int32, []byte) {
+	for {
+		resp, err := nsq.ReadResponse(conn)
+		test.Nil(t, err)
+		frameType, data, err := nsq.UnpackResponse(resp)
+		test.Nil(t, err)
+		if frameType == frameTypeResponse && string(data) == string(heartbeatBytes) {
+			nsq.Nop().WriteTo(conn)
+			continue
+		}
+		return frameType, data
+	}
+}
+
+func batchAckCmd(name string, params [][]byte, ids ...nsq.MessageID) *nsq.Command {
+	body := make([]byte, 0, len(ids)*nsqdNs.MsgIDLength)
+	for _, id := range ids {
+		body = append(body, id[:]...)
+	}
+	return &nsq.Command{Name: []byte(name), Params: params, Body: body}
+}
+
+func TestMFINAndMREQ(t *testing.T) {
+	opts := nsqdNs.NewOptions()
+	opts.Logger = newTestLogger(t)
+	tcpAddr, _, nsqd, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
+
+	topicName := "test_batch_ack" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopicIgnPart(topicName)
+	topic.GetChannel("ch")
+	for i := 0; i < 4; i++ {
+		topic.PutMessage(nsqdNs.NewMessage(0, make([]byte, 100)))
+	}
+	topic.ForceFlush()
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Equal(t, err, nil)
+	defer conn.Close()
+
+	identify(t, conn, nil, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+	_, err = nsq.Ready(4).WriteTo(conn)
+	test.Equal(t, err, nil)
+
+	msgIDs := make([]nsq.MessageID, 0, 4)
+	for i := 0; i < 4; i++ {
+		msgOut := recvNextMsgAndCheck(t, conn, 100, 0, false)
+		msgIDs = append(msgIDs, nsq.MessageID(msgOut.GetFullMsgID()))
+	}
+	_, err = nsq.Ready(0).WriteTo(conn)
+	test.Equal(t, err, nil)
+
+	// the duplicate id should fail without closing the connection
+	_, err = batchAckCmd("MFIN", nil, msgIDs[0], msgIDs[1], msgIDs[0]).WriteTo(conn)
+	test.Equal(t, err, nil)
+	frameType, data := readNonHeartbeatResponse(t, conn)
+	test.Equal(t, frameTypeResponse, frameType)
+	var ret struct {
+		Failed []struct {
+			ID   string `json:"id"`
+			Code string `json:"code"`
+			Err  string `json:"err"`
+		} `json:"failed"`
+	}
+	err = json.Unmarshal(data, &ret)
+	test.Nil(t, err)
+	test.Equal(t, 1, len(ret.Failed))
+	test.Equal(t, hex.EncodeToString(msgIDs[0][:]), ret.Failed[0].ID)
+	test.Equal(t, "E_FIN_FAILED", ret.Failed[0].Code)
+
+	_, err = batchAckCmd("MREQ", [][]byte{[]byte("0")}, msgIDs[2], msgIDs[3]).WriteTo(conn)
+	test.Equal(t, err, nil)
+	frameType, data = readNonHeartbeatResponse(t, conn)
+	test.Equal(t, frameTypeResponse, frameType)
+	test.Equal(t, okBytes, data)
+
+	chStats := nsqd.GetTopicStats(true, topicName)[0].Channels[0]
+	test.Equal(t, uint64(2), chStats.RequeueCount)
+	test.Equal(t, 0, chStats.InFlightCount)
+
+	_, err = nsq.Ready(2).WriteTo(conn)
+	test.Equal(t, err, nil)
+	msgIDs = msgIDs[:0]
+	for i := 0; i < 2; i++ {
+		msgOut := recvNextMsgAndCheck(t, conn, 100, 0, false)
+		msgIDs = append(msgIDs, nsq.MessageID(msgOut.GetFullMsgID()))
+	}
+	_, err = batchAckCmd("MFIN", nil, msgIDs...).WriteTo(conn)
+	test.Equal(t, err, nil)
+	frameType, data = readNonHeartbeatResponse(t, conn)
+	test.Equal(t, frameTypeResponse, frameType)
+	test.Equal(t, okBytes, data)
+
+	chStats = nsqd.GetTopicStats(true, topicName)[0].Channels[0]
+	test.Equal(t, 0, chStats.InFlightCount)
+	test.Equal(t, int64(0), chStats.Depth)
+
+	// invalid body should close the connection
+	_, err = (&nsq.Command{Name: []byte("MFIN"), Body: make([]byte, 10)}).WriteTo(conn)
+	test.Equal(t, err, nil)
+	frameType, data = readNonHeartbeatResponse(t, conn)
+	test.Equal(t, frameTypeError, frameType)
+	test.Equal(t, true, strings.HasPrefix(string(data), "E_BAD_BODY"))
+}
+
+func TestMREQToEnd(t *testing.T) {
+	opts := nsqdNs.NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.ReqToEndThreshold = time.Second
+	opts.MaxReqTimeout = opts.ReqToEndThreshold * 10
+	opts.QueueScanInterval = time.Millisecond * 100
+	tcpAddr, _, nsqd, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
+
+	topicName := "test_batch_req_end" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopicIgnPart(topicName)
+	ch := topic.GetChannel("ch")
+	ch.SetDeadLetter(2, "")
+	_, err := topic.GetOrCreateDelayedQueueNoLock(nil)
+	test.Nil(t, err)
+	for i := 0; i < 2; i++ {
+		topic.PutMessage(nsqdNs.NewMessage(0, make([]byte, 100)))
+	}
+	topic.ForceFlush()
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Equal(t, err, nil)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+	_, err = nsq.Ready(2).WriteTo(conn)
+	test.Equal(t, err, nil)
+
+	recvMsgIDs := func() []nsq.MessageID {
+		msgIDs := make([]nsq.MessageID, 0, 2)
+		for i := 0; i < 2; i++ {
+			msgOut := recvNextMsgAndCheck(t, conn, 100, 0, false)
+			msgIDs = append(msgIDs, nsq.MessageID(msgOut.GetFullMsgID()))
+		}
+		return msgIDs
+	}
+	// the req timeout larger than threshold should be requeued to the delayed queue
+	_, err = batchAckCmd("MREQ", [][]byte{[]byte(strconv.Itoa(int(opts.ReqToEndThreshold/time.Millisecond) * 2))},
+		recvMsgIDs()...).WriteTo(conn)
+	test.Equal(t, err, nil)
+	frameType, data := readNonHeartbeatResponse(t, conn)
+	test.Equal(t, frameTypeResponse, frameType)
+	test.Equal(t, okBytes, data)
+	chStats := nsqd.GetTopicStats(true, topicName)[0].Channels[0]
+	test.Equal(t, 0, chStats.InFlightCount)
+	test.Equal(t, int64(0), chStats.Depth)
+	test.Equal(t, uint64(2), chStats.DelayedQueueCount)
+
+	// the messages attempted too many times should be moved to the dead letter topic
+	_, err = batchAckCmd("MREQ", [][]byte{[]byte("0")}, recvMsgIDs()...).WriteTo(conn)
+	test.Equal(t, err, nil)
+	frameType, data = readNonHeartbeatResponse(t, conn)
+	test.Equal(t, frameTypeResponse, frameType)
+	test.Equal(t, okBytes, data)
+	test.Equal(t, uint64(2), ch.GetDeadLetterCount())
+	chStats = nsqd.GetTopicStats(true, topicName)[0].Channels[0]
+	test.Equal(t, 0, chStats.InFlightCount)
+	test.Equal(t, uint64(0), chStats.DelayedQueueCount)
+	dlqTopic, err := nsqd.GetExistingTopic(topicName+"_ch_dlq", 0)
+	test.Nil(t, err)
+	test.Equal(t, uint64(2), dlqTopic.TotalMessageCnt())
+}
+
 func TestClientMsgTimeoutReqCount(t *testing.T) {
 	opts := nsqdNs.NewOptions()
 	opts.Logger = newTestLogger(t)
@@ -6367,11 +6735,15 @@ func testIOLoopReturnsClientErr(t *testing.T, fakeConn test.FakeNetConn) {
 
 	opts := nsqdNs.NewOptions()
 	opts.Logger = newTestLogger(t)
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	opts.DataPath = tmpDir
 
 	prot := &protocolV2{ctx: &context{nsqd: nsqdNs.New(opts)}}
 	defer prot.ctx.nsqd.Exit()
 
-	err := prot.IOLoop(fakeConn)
+	err = prot.IOLoop(fakeConn)
 
 	test.NotNil(t, err)
 	test.Equal(t, strings.HasPrefix(err.Error(), "E_INVALID "), true)
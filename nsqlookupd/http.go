@@ -1,7 +1,11 @@
 package nsqlookupd
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/pprof"
 	"net/url"
@@ -24,6 +28,8 @@ const (
 	MAX_PARTITION_NUM = 255
 	MAX_REPLICATOR    = 5
 	MAX_LOAD_FACTOR   = 10000
+	// the max body size of the reassignment plan
+	MAX_REASSIGN_PLAN_SIZE = 10 * 1024 * 1024
 )
 
 func GetValidPartitionNum(numStr string) (int, error) {
@@ -108,6 +114,12 @@ func newHTTPServer(ctx *Context) *httpServer {
 	router.Handle("POST", "/cluster/upgrade/done", http_api.Decorate(s.doClusterFinishUpgrade, log, http_api.V1))
 	router.Handle("POST", "/cluster/lookupd/tombstone", http_api.Decorate(s.doClusterTombstoneLookupd, log, http_api.V1))
 	router.Handle("POST", "/cluster/balance/topn", http_api.Decorate(s.doClusterBalanceTopN, log, http_api.V1))
+	router.Handle("POST", "/cluster/leader/preferred/auto", http_api.Decorate(s.doClusterPreferredLeaderAuto, log, http_api.V1))
+	router.Handle("GET", "/cluster/reassign", http_api.Decorate(s.doGetReassignPlan, log, http_api.V1))
+	router.Handle("POST", "/cluster/reassign", http_api.Decorate(s.doSubmitReassignPlan, log, http_api.V1))
+	router.Handle("POST", "/cluster/reassign/pause", http_api.Decorate(s.doPauseReassignPlan, log, http_api.V1))
+	router.Handle("POST", "/cluster/reassign/resume", http_api.Decorate(s.doResumeReassignPlan, log, http_api.V1))
+	router.Handle("POST", "/cluster/reassign/cancel", http_api.Decorate(s.doCancelReassignPlan, log, http_api.V1))
 
 	// only v1
 	router.Handle("POST", "/loglevel/set", http_api.Decorate(s.doSetLogLevel, log, http_api.V1))
@@ -115,14 +127,23 @@ func newHTTPServer(ctx *Context) *httpServer {
 	router.Handle("PUT", "/topic/create", http_api.Decorate(s.doCreateTopic, log, http_api.V1))
 	router.Handle("POST", "/topic/delete", http_api.Decorate(s.doDeleteTopic, log, http_api.V1))
 	router.Handle("POST", "/topic/partition/expand", http_api.Decorate(s.doChangeTopicPartitionNum, log, http_api.V1))
+	router.Handle("POST", "/topic/partition/shrink", http_api.Decorate(s.doShrinkTopicPartition, log, http_api.V1))
+	router.Handle("POST", "/topic/partition/shrink/cancel", http_api.Decorate(s.doCancelTopicShrink, log, http_api.V1))
+	router.Handle("GET", "/topic/partition/shrink/status", http_api.Decorate(s.doTopicShrinkStatus, log, http_api.V1))
 	router.Handle("POST", "/topic/partition/move", http_api.Decorate(s.doMoveTopicParition, log, http_api.V1))
+	router.Handle("POST", "/topic/leader/preferred/restore", http_api.Decorate(s.doRestorePreferredLeader, log, http_api.V1))
 	router.Handle("POST", "/topic/meta/update", http_api.Decorate(s.doChangeTopicDynamicParam, log, http_api.V1))
 	//router.Handle("POST", "/channel/create", http_api.Decorate(s.doCreateChannel, log, http_api.V1))
 	//router.Handle("POST", "/channel/delete", http_api.Decorate(s.doDeleteChannel, log, http_api.V1))
 	router.Handle("POST", "/topic/tombstone", http_api.Decorate(s.doTombstoneTopicProducer, log, http_api.V1))
 	router.Handle("POST", "/disable/write", http_api.Decorate(s.doDisableClusterWrite, log, http_api.V1))
+	router.Handle("POST", "/consumer_group/join", http_api.Decorate(s.doJoinConsumerGroup, log, http_api.V1))
+	router.Handle("POST", "/consumer_group/heartbeat", http_api.Decorate(s.doHeartbeatConsumerGroup, debugLog, http_api.V1))
+	router.Handle("POST", "/consumer_group/leave", http_api.Decorate(s.doLeaveConsumerGroup, log, http_api.V1))
+	router.Handle("GET", "/consumer_group/info", http_api.Decorate(s.doConsumerGroupInfo, log, http_api.V1))
 
 	router.Handle("GET", "/info", http_api.Decorate(s.doInfo, log, http_api.NegotiateVersion))
+	router.Handle("GET", "/metrics", http_api.Decorate(s.doMetrics, http_api.PlainText))
 	// debug
 	router.HandlerFunc("GET", "/debug/pprof", pprof.Index)
 	router.HandlerFunc("GET", "/debug/pprof/cmdline", pprof.Cmdline)
@@ -153,6 +174,9 @@ func (s *httpServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 }
 
 func (s *httpServer) pingHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	if s.ctx.nsqlookupd.IsRaftStoreFailed() {
+		return nil, http_api.Err{500, "RAFT_STORE_FAILED"}
+	}
 	return "OK", nil
 }
 
@@ -315,6 +339,104 @@ func (s *httpServer) doDisableClusterWrite(w http.ResponseWriter, req *http.Requ
 	return nil, nil
 }
 
+func (s *httpServer) getConsumerGroupArgs(req *http.Request) (url.Values, string, string, error) {
+	reqParams, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		return nil, "", "", http_api.Err{400, "INVALID_REQUEST"}
+	}
+	topicName := reqParams.Get("topic")
+	if !protocol.IsValidTopicName(topicName) {
+		return nil, "", "", http_api.Err{400, "INVALID_ARG_TOPIC"}
+	}
+	channelName := reqParams.Get("channel")
+	if !protocol.IsValidChannelName(channelName) {
+		return nil, "", "", http_api.Err{400, "INVALID_ARG_CHANNEL"}
+	}
+	if s.ctx.nsqlookupd.coordinator == nil {
+		return nil, "", "", http_api.Err{500, "MISSING_COORDINATOR"}
+	}
+	if !s.ctx.nsqlookupd.coordinator.IsMineLeader() {
+		return nil, "", "", http_api.Err{400, consistence.ErrFailedOnNotLeader}
+	}
+	return reqParams, topicName, channelName, nil
+}
+
+func convertConsumerGroupErr(err error) error {
+	switch err {
+	case consistence.ErrConsumerGroupNotFound:
+		return http_api.Err{404, "GROUP_NOT_FOUND"}
+	case consistence.ErrConsumerGroupMemberNotFound:
+		return http_api.Err{404, "GROUP_MEMBER_NOT_FOUND"}
+	case consistence.ErrNotNsqLookupLeader:
+		return http_api.Err{400, consistence.ErrFailedOnNotLeader}
+	case consistence.ErrKeyNotFound:
+		return http_api.Err{404, "TOPIC_NOT_FOUND"}
+	}
+	return http_api.Err{500, err.Error()}
+}
+
+func (s *httpServer) doJoinConsumerGroup(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topicName, channelName, err := s.getConsumerGroupArgs(req)
+	if err != nil {
+		return nil, err
+	}
+	hostname := reqParams.Get("hostname")
+	if hostname == "" {
+		hostname, _, _ = net.SplitHostPort(req.RemoteAddr)
+	}
+	assignment, err := s.ctx.nsqlookupd.coordinator.JoinConsumerGroup(topicName, channelName,
+		reqParams.Get("member_id"), hostname)
+	if err != nil {
+		nsqlookupLog.Logf("join consumer group %v-%v failed: %v", topicName, channelName, err)
+		return nil, convertConsumerGroupErr(err)
+	}
+	return assignment, nil
+}
+
+func (s *httpServer) doHeartbeatConsumerGroup(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topicName, channelName, err := s.getConsumerGroupArgs(req)
+	if err != nil {
+		return nil, err
+	}
+	memberID := reqParams.Get("member_id")
+	if memberID == "" {
+		return nil, http_api.Err{400, "MISSING_ARG_MEMBER_ID"}
+	}
+	assignment, err := s.ctx.nsqlookupd.coordinator.HeartbeatConsumerGroup(topicName, channelName, memberID)
+	if err != nil {
+		return nil, convertConsumerGroupErr(err)
+	}
+	return assignment, nil
+}
+
+func (s *httpServer) doLeaveConsumerGroup(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topicName, channelName, err := s.getConsumerGroupArgs(req)
+	if err != nil {
+		return nil, err
+	}
+	memberID := reqParams.Get("member_id")
+	if memberID == "" {
+		return nil, http_api.Err{400, "MISSING_ARG_MEMBER_ID"}
+	}
+	err = s.ctx.nsqlookupd.coordinator.LeaveConsumerGroup(topicName, channelName, memberID)
+	if err != nil {
+		return nil, convertConsumerGroupErr(err)
+	}
+	return nil, nil
+}
+
+func (s *httpServer) doConsumerGroupInfo(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	_, topicName, channelName, err := s.getConsumerGroupArgs(req)
+	if err != nil {
+		return nil, err
+	}
+	info, err := s.ctx.nsqlookupd.coordinator.GetConsumerGroupInfo(topicName, channelName)
+	if err != nil {
+		return nil, convertConsumerGroupErr(err)
+	}
+	return info, nil
+}
+
 func (s *httpServer) doLookup(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	reqParams, err := url.ParseQuery(req.URL.RawQuery)
 	if err != nil {
@@ -401,10 +523,23 @@ func (s *httpServer) doLookup(w http.ResponseWriter, req *http.Request, ps httpr
 	registrations = registrations.FilterByActive(s.ctx.nsqlookupd.opts.InactiveProducerTimeout,
 		filterTomb)
 
+	// the partitions shrinking or mirroring should not be returned for writing
+	var shrinkingMeta *consistence.TopicMetaInfo
+	if accessMode == "w" && s.ctx.nsqlookupd.coordinator != nil {
+		meta, err := s.ctx.nsqlookupd.coordinator.GetTopicMetaInfo(topicName)
+		if err == nil && meta.MirrorFrom != "" {
+			registrations = nil
+		} else if err == nil && meta.ShrinkTo > 0 {
+			shrinkingMeta = &meta
+		}
+	}
 	emptyChanFiltered := false
 	for _, r := range registrations {
 		var leaderProducer *Producer
 		pid, _ := strconv.Atoi(r.PartitionID)
+		if shrinkingMeta != nil && shrinkingMeta.IsPartitionShrinking(pid) {
+			continue
+		}
 		if checkConsistent != "" && s.ctx.nsqlookupd.coordinator != nil {
 			// check leader only the client need consistent
 			if s.ctx.nsqlookupd.coordinator.IsTopicLeader(topicName, pid, r.ProducerNode.peerInfo.DistributedID) {
@@ -471,6 +606,7 @@ func (s *httpServer) doLookup(w http.ResponseWriter, req *http.Request, ps httpr
 				"extend_support": meta.Ext,
 				"ordered":        meta.OrderedMulti,
 				"multi_part":     meta.MultiPart,
+				"compact":        meta.Compact,
 			},
 			"producers":  peers,
 			"partitions": partitionProducers,
@@ -559,9 +695,28 @@ func (s *httpServer) doCreateTopic(w http.ResponseWriter, req *http.Request, ps
 		nsqlookupLog.Logf("error retention param: %v, %v", retentionDaysStr, err)
 		return nil, http_api.Err{400, err.Error()}
 	}
+	minInSync := 0
+	if minInSyncStr := reqParams.Get("min_insync"); minInSyncStr != "" {
+		minInSync, err = strconv.Atoi(minInSyncStr)
+		if err != nil || minInSync < 0 || minInSync > replicator {
+			nsqlookupLog.Logf("error min insync param: %v, %v", minInSyncStr, err)
+			return nil, http_api.Err{400, "INVALID_ARG_TOPIC_MIN_INSYNC"}
+		}
+	}
 	allowMultiOrdered := reqParams.Get("orderedmulti")
 	multiPart := reqParams.Get("multipart")
 	allowExt := reqParams.Get("extend")
+	compact := reqParams.Get("compact")
+	compression := reqParams.Get("compression")
+	if _, err := nsqd.ParseCompressCodec(compression); err != nil {
+		return nil, http_api.Err{400, "INVALID_ARG_TOPIC_COMPRESSION"}
+	}
+	mirrorFrom := reqParams.Get("mirror_from")
+	if mirrorFrom != "" {
+		if _, err := consistence.ParseMirrorLookupdAddrs(mirrorFrom); err != nil {
+			return nil, http_api.Err{400, "INVALID_ARG_TOPIC_MIRROR_FROM"}
+		}
+	}
 
 	if s.ctx.nsqlookupd.coordinator == nil {
 		return nil, http_api.Err{500, "MISSING_COORDINATOR"}
@@ -580,6 +735,8 @@ func (s *httpServer) doCreateTopic(w http.ResponseWriter, req *http.Request, ps
 	meta.SuggestLF = suggestLF
 	meta.SyncEvery = syncEvery
 	meta.RetentionDay = int32(retentionDays)
+	meta.MinInSync = minInSync
+	meta.Compression = compression
 	if allowMultiOrdered == "true" {
 		meta.OrderedMulti = true
 	}
@@ -589,6 +746,13 @@ func (s *httpServer) doCreateTopic(w http.ResponseWriter, req *http.Request, ps
 	if allowExt == "true" {
 		meta.Ext = true
 	}
+	if compact == "true" {
+		if !meta.Ext {
+			return nil, http_api.Err{400, "INVALID_ARG_TOPIC_COMPACT_NOT_EXT"}
+		}
+		meta.Compact = true
+	}
+	meta.MirrorFrom = mirrorFrom
 	err = s.ctx.nsqlookupd.coordinator.CreateTopic(topicName, meta)
 	if err != nil {
 		nsqlookupLog.LogErrorf("DB: adding topic(%s) failed: %v", topicName, err)
@@ -666,6 +830,123 @@ func (s *httpServer) doChangeTopicPartitionNum(w http.ResponseWriter, req *http.
 	return nil, nil
 }
 
+func (s *httpServer) doShrinkTopicPartition(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	if s.ctx.nsqlookupd.coordinator == nil {
+		return nil, http_api.Err{500, "MISSING_COORDINATOR"}
+	}
+	reqParams, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+
+	topicName := reqParams.Get("topic")
+	if topicName == "" {
+		return nil, http_api.Err{400, "MISSING_ARG_TOPIC"}
+	}
+	pnumStr := reqParams.Get("partition_num")
+	if pnumStr == "" {
+		return nil, http_api.Err{400, "MISSING_ARG_TOPIC_PARTITION_NUM"}
+	}
+	pnum, err := GetValidPartitionNum(pnumStr)
+	if err != nil {
+		nsqlookupLog.Logf("invalid partition num: %v, %v", pnumStr, err)
+		return nil, http_api.Err{400, "INVALID_ARG_TOPIC_PARTITION_NUM"}
+	}
+
+	// the ordered topic is not writable until the shrink is done
+	stopOrderedWrite := reqParams.Get("stop_ordered_write") == "true"
+	err = s.ctx.nsqlookupd.coordinator.ShrinkTopicPartition(topicName, pnum, stopOrderedWrite)
+	if err == consistence.ErrShrinkOrderedTopicStopWrite {
+		return nil, http_api.Err{400, err.Error()}
+	}
+	if err != nil {
+		return nil, http_api.Err{500, err.Error()}
+	}
+	return nil, nil
+}
+
+func (s *httpServer) doRestorePreferredLeader(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	if s.ctx.nsqlookupd.coordinator == nil {
+		return nil, http_api.Err{500, "MISSING_COORDINATOR"}
+	}
+	reqParams, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+
+	// empty topic means all the topics
+	topicName := reqParams.Get("topic")
+	dryRun := reqParams.Get("dryrun") == "true"
+	maxMoves := 0
+	maxMovesStr := reqParams.Get("max_moves")
+	if maxMovesStr != "" {
+		maxMoves, err = strconv.Atoi(maxMovesStr)
+		if err != nil || maxMoves <= 0 {
+			return nil, http_api.Err{400, "INVALID_ARG_MAX_MOVES"}
+		}
+	}
+
+	moves, err := s.ctx.nsqlookupd.coordinator.RestorePreferredLeaders(topicName, dryRun, maxMoves)
+	if err != nil {
+		return nil, http_api.Err{500, err.Error()}
+	}
+	return struct {
+		DryRun bool                              `json:"dryrun"`
+		Moves  []consistence.PreferredLeaderMove `json:"moves"`
+	}{
+		DryRun: dryRun,
+		Moves:  moves,
+	}, nil
+}
+
+func (s *httpServer) doCancelTopicShrink(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	if s.ctx.nsqlookupd.coordinator == nil {
+		return nil, http_api.Err{500, "MISSING_COORDINATOR"}
+	}
+	reqParams, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+
+	topicName := reqParams.Get("topic")
+	if topicName == "" {
+		return nil, http_api.Err{400, "MISSING_ARG_TOPIC"}
+	}
+	err = s.ctx.nsqlookupd.coordinator.CancelTopicShrink(topicName)
+	if err != nil {
+		return nil, http_api.Err{500, err.Error()}
+	}
+	return nil, nil
+}
+
+func (s *httpServer) doTopicShrinkStatus(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	if s.ctx.nsqlookupd.coordinator == nil {
+		return nil, http_api.Err{500, "MISSING_COORDINATOR"}
+	}
+	reqParams, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+
+	topicName := reqParams.Get("topic")
+	if topicName == "" {
+		return nil, http_api.Err{400, "MISSING_ARG_TOPIC"}
+	}
+	meta, pendings, err := s.ctx.nsqlookupd.coordinator.GetTopicShrinkPending(topicName)
+	if err != nil {
+		return nil, http_api.Err{500, err.Error()}
+	}
+	pendingList := make(map[string]int64, len(pendings))
+	for pid, pending := range pendings {
+		pendingList[strconv.Itoa(pid)] = pending
+	}
+	return struct {
+		PartitionNum int              `json:"partition_num"`
+		ShrinkTo     int              `json:"shrink_to"`
+		Pending      map[string]int64 `json:"pending"`
+	}{meta.PartitionNum, meta.ShrinkTo, pendingList}, nil
+}
+
 func (s *httpServer) doChangeTopicDynamicParam(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	if s.ctx.nsqlookupd.coordinator == nil {
 		return nil, http_api.Err{500, "MISSING_COORDINATOR"}
@@ -707,10 +988,29 @@ func (s *httpServer) doChangeTopicDynamicParam(w http.ResponseWriter, req *http.
 			return nil, http_api.Err{400, err.Error()}
 		}
 	}
+	minInSyncStr := reqParams.Get("min_insync")
+	minInSync := -1
+	if minInSyncStr != "" {
+		minInSync, err = strconv.Atoi(minInSyncStr)
+		if err != nil || minInSync < 0 {
+			nsqlookupLog.Logf("error min insync param: %v, %v", minInSyncStr, err)
+			return nil, http_api.Err{400, "INVALID_ARG_TOPIC_MIN_INSYNC"}
+		}
+	}
 	upgradeExtStr := reqParams.Get("upgradeext")
+	compression := reqParams.Get("compression")
+	if _, err := nsqd.ParseCompressCodec(compression); err != nil {
+		return nil, http_api.Err{400, "INVALID_ARG_TOPIC_COMPRESSION"}
+	}
+	mirrorFrom := reqParams.Get("mirror_from")
+	if mirrorFrom != "" && mirrorFrom != "none" {
+		if _, err := consistence.ParseMirrorLookupdAddrs(mirrorFrom); err != nil {
+			return nil, http_api.Err{400, "INVALID_ARG_TOPIC_MIRROR_FROM"}
+		}
+	}
 
 	err = s.ctx.nsqlookupd.coordinator.ChangeTopicMetaParam(topicName, syncEvery,
-		retentionDays, replicator, upgradeExtStr)
+		retentionDays, replicator, minInSync, upgradeExtStr, compression, mirrorFrom)
 	if err != nil {
 		return nil, http_api.Err{400, err.Error()}
 	}
@@ -774,6 +1074,107 @@ func (s *httpServer) doClusterBalanceTopN(w http.ResponseWriter, req *http.Reque
 	return nil, nil
 }
 
+func (s *httpServer) doClusterPreferredLeaderAuto(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	if s.ctx.nsqlookupd.coordinator == nil {
+		return nil, http_api.Err{500, "MISSING_COORDINATOR"}
+	}
+	reqParams, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+
+	enable := reqParams.Get("enable") == "true"
+	err = s.ctx.nsqlookupd.coordinator.SetPreferredLeaderRestore(enable)
+	if err != nil {
+		return nil, http_api.Err{400, err.Error()}
+	}
+	return nil, nil
+}
+
+func (s *httpServer) doGetReassignPlan(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	if s.ctx.nsqlookupd.coordinator == nil {
+		return nil, http_api.Err{500, "MISSING_COORDINATOR"}
+	}
+	plan, err := s.ctx.nsqlookupd.coordinator.GetReassignPlan()
+	if err != nil {
+		if err == consistence.ErrReassignPlanNotFound {
+			return nil, http_api.Err{404, err.Error()}
+		}
+		return nil, http_api.Err{500, err.Error()}
+	}
+	return plan, nil
+}
+
+func (s *httpServer) doSubmitReassignPlan(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	if s.ctx.nsqlookupd.coordinator == nil {
+		return nil, http_api.Err{500, "MISSING_COORDINATOR"}
+	}
+	reqParams, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+	dryRun := reqParams.Get("dryrun") == "true"
+
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, MAX_REASSIGN_PLAN_SIZE+1))
+	if err != nil {
+		return nil, http_api.Err{500, "INTERNAL_ERROR"}
+	}
+	if len(body) > MAX_REASSIGN_PLAN_SIZE {
+		return nil, http_api.Err{413, "BODY_TOO_BIG"}
+	}
+	var plan consistence.ReassignPlan
+	err = json.Unmarshal(body, &plan)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_BODY"}
+	}
+	loads, err := s.ctx.nsqlookupd.coordinator.SubmitReassignPlan(&plan, dryRun)
+	if err != nil {
+		return nil, http_api.Err{400, err.Error()}
+	}
+	return struct {
+		DryRun bool                           `json:"dryrun"`
+		Plan   *consistence.ReassignPlan      `json:"plan"`
+		Nodes  []consistence.ReassignNodeLoad `json:"nodes"`
+	}{
+		DryRun: dryRun,
+		Plan:   &plan,
+		Nodes:  loads,
+	}, nil
+}
+
+func (s *httpServer) doPauseReassignPlan(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	if s.ctx.nsqlookupd.coordinator == nil {
+		return nil, http_api.Err{500, "MISSING_COORDINATOR"}
+	}
+	err := s.ctx.nsqlookupd.coordinator.PauseReassignPlan()
+	if err != nil {
+		return nil, http_api.Err{400, err.Error()}
+	}
+	return nil, nil
+}
+
+func (s *httpServer) doResumeReassignPlan(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	if s.ctx.nsqlookupd.coordinator == nil {
+		return nil, http_api.Err{500, "MISSING_COORDINATOR"}
+	}
+	err := s.ctx.nsqlookupd.coordinator.ResumeReassignPlan()
+	if err != nil {
+		return nil, http_api.Err{400, err.Error()}
+	}
+	return nil, nil
+}
+
+func (s *httpServer) doCancelReassignPlan(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	if s.ctx.nsqlookupd.coordinator == nil {
+		return nil, http_api.Err{500, "MISSING_COORDINATOR"}
+	}
+	err := s.ctx.nsqlookupd.coordinator.CancelReassignPlan()
+	if err != nil {
+		return nil, http_api.Err{400, err.Error()}
+	}
+	return nil, nil
+}
+
 func (s *httpServer) doClusterBeginUpgrade(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	if s.ctx.nsqlookupd.coordinator == nil {
 		return nil, http_api.Err{500, "MISSING_COORDINATOR"}
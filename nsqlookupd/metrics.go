@@ -0,0 +1,67 @@
+package nsqlookupd
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/youzan/nsq/internal/prometheus"
+)
+
+const metricsPrefix = "nsqlookupd_"
+
+// doMetrics export the registration and the cluster topic replica state in
+// the prometheus text format. The cluster state is only exported by the
+// lookup leader to avoid the duplicate series.
+func (s *httpServer) doMetrics(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	r := prometheus.NewRegistry(metricsPrefix)
+	producers := s.ctx.nsqlookupd.DB.GetAllPeerClients().FilterByActive(
+		s.ctx.nsqlookupd.opts.InactiveProducerTimeout)
+	r.Gauge("producer_count", "active nsqd nodes registered", float64(len(producers)))
+
+	topics := s.ctx.nsqlookupd.DB.FindTopics()
+	r.Gauge("topic_count", "topics registered", float64(len(topics)))
+	for _, topic := range topics {
+		regs := s.ctx.nsqlookupd.DB.FindTopicProducers(topic, "*")
+		partCnt := make(map[string]int)
+		for _, reg := range regs {
+			partCnt[reg.PartitionID]++
+		}
+		for pid, cnt := range partCnt {
+			r.Gauge("topic_producer_count", "nsqd nodes registered for the topic partition", float64(cnt),
+				prometheus.L("topic", topic), prometheus.L("partition", pid))
+		}
+	}
+
+	coord := s.ctx.nsqlookupd.coordinator
+	if coord != nil {
+		r.Gauge("is_leader", "whether this lookupd is the cluster leader", prometheus.BoolToFloat(coord.IsMineLeader()))
+		if coord.IsMineLeader() {
+			s.writeClusterMetrics(r)
+		}
+	}
+
+	w.Header().Set("Content-Type", prometheus.ContentType)
+	return r.Bytes(), nil
+}
+
+func (s *httpServer) writeClusterMetrics(r *prometheus.Registry) {
+	coord := s.ctx.nsqlookupd.coordinator
+	r.Gauge("cluster_stable", "whether the cluster is stable", prometheus.BoolToFloat(coord.IsClusterStable()))
+	topicInfoList, err := coord.GetAllTopicPartitionsInfo()
+	if err != nil {
+		nsqlookupLog.Logf("failed to scan topics for metrics: %v", err)
+		return
+	}
+	for _, info := range topicInfoList {
+		tl := []prometheus.Label{
+			prometheus.L("topic", info.Name),
+			prometheus.L("partition", strconv.Itoa(info.Partition)),
+		}
+		r.Gauge("topic_replica", "expected replicas of the topic partition", float64(info.Replica), tl...)
+		r.Gauge("topic_isr_count", "replicas in the isr of the topic partition", float64(len(info.ISR)), tl...)
+		r.Gauge("topic_catchup_count", "replicas catching up of the topic partition", float64(len(info.CatchupList)), tl...)
+		r.Gauge("topic_leader", "the leader node of the topic partition", 1,
+			append(tl, prometheus.L("node", info.Leader))...)
+	}
+}
@@ -3,7 +3,9 @@ package nsqlookupd
 import (
 	"net"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -23,12 +25,16 @@ type NSQLookupd struct {
 	waitGroup    util.WaitGroupWrapper
 	DB           *RegistrationDB
 	coordinator  *consistence.NsqLookupCoordinator
+	raftStore    *consistence.RaftStore
+	stopCoord    sync.Once
+	exitChan     chan struct{}
 }
 
 func New(opts *Options) *NSQLookupd {
 	n := &NSQLookupd{
-		opts: opts,
-		DB:   NewRegistrationDB(),
+		opts:     opts,
+		DB:       NewRegistrationDB(),
+		exitChan: make(chan struct{}),
 	}
 	return n
 }
@@ -98,6 +104,7 @@ func (l *NSQLookupd) Main() {
 
 		nsqlookupLog.Logf("balance interval is: %v", l.opts.BalanceInterval)
 		coordOpts := &consistence.Options{}
+		coordOpts.PreferredLeaderRestore = l.opts.PreferredLeaderRestore
 
 		if len(l.opts.BalanceInterval) == 2 {
 			coordOpts.BalanceStart, err = strconv.Atoi(l.opts.BalanceInterval[0])
@@ -116,8 +123,29 @@ func (l *NSQLookupd) Main() {
 		consistence.SetCoordLogger(l.opts.Logger, l.opts.LogLevel)
 		l.coordinator = consistence.NewNsqLookupCoordinator(l.opts.ClusterID, &node, coordOpts)
 		l.Unlock()
-		// set etcd leader manager here
-		leadership, err := consistence.NewNsqLookupdEtcdMgr(l.opts.ClusterLeadershipAddresses, l.opts.ClusterLeadershipUsername, l.opts.ClusterLeadershipPassword)
+		leadershipAddresses := l.opts.ClusterLeadershipAddresses
+		if l.opts.ClusterLeadershipBackend == consistence.LeadershipBackendRaft {
+			raftStore, err := l.startRaftStore()
+			if err != nil {
+				nsqlookupLog.LogErrorf("FATAL: start raft leadership store failed - %s", err)
+				os.Exit(1)
+			}
+			l.Lock()
+			l.raftStore = raftStore
+			l.Unlock()
+			leadershipAddresses = raftStore.Addresses()
+		} else if l.opts.ClusterLeadershipBackend != consistence.LeadershipBackendEtcd &&
+			l.opts.ClusterLeadershipBackend != consistence.LeadershipBackendEtcdV3 {
+			nsqlookupLog.LogErrorf("FATAL: unknown cluster leadership backend: %v", l.opts.ClusterLeadershipBackend)
+			os.Exit(1)
+		}
+		// set etcd leader manager here, the raft store is also accessed by the etcd client
+		var leadership consistence.NSQLookupdLeadership
+		if l.opts.ClusterLeadershipBackend == consistence.LeadershipBackendEtcdV3 {
+			leadership, err = consistence.NewNsqLookupdEtcdV3Mgr(leadershipAddresses, l.opts.ClusterLeadershipUsername, l.opts.ClusterLeadershipPassword)
+		} else {
+			leadership, err = consistence.NewNsqLookupdEtcdMgr(leadershipAddresses, l.opts.ClusterLeadershipUsername, l.opts.ClusterLeadershipPassword)
+		}
 		if err != nil {
 			nsqlookupLog.LogErrorf("FATAL: start coordinator failed - %s", err)
 			os.Exit(1)
@@ -128,6 +156,9 @@ func (l *NSQLookupd) Main() {
 			nsqlookupLog.LogErrorf("FATAL: start coordinator failed - %s", err)
 			os.Exit(1)
 		}
+		if l.raftStore != nil {
+			l.waitGroup.Wrap(l.watchRaftStore)
+		}
 	} else {
 		nsqlookupLog.Logf("lookup start without the coordinator enabled.")
 		l.Lock()
@@ -151,6 +182,58 @@ func (l *NSQLookupd) Main() {
 	})
 }
 
+func (l *NSQLookupd) startRaftStore() (*consistence.RaftStore, error) {
+	dataPath := l.opts.RaftDataPath
+	if dataPath == "" {
+		dataPath = filepath.Join(".", "raft-leadership-"+strconv.Itoa(l.opts.RaftNodeID))
+	}
+	raftStore, err := consistence.NewRaftStore(consistence.RaftStoreConfig{
+		ID:      uint64(l.opts.RaftNodeID),
+		Peers:   strings.Split(l.opts.ClusterLeadershipAddresses, ","),
+		DataDir: dataPath,
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = raftStore.Start()
+	if err != nil {
+		return nil, err
+	}
+	// the other raft members may be not started yet
+	for {
+		err = raftStore.WaitLeader(time.Second * 10)
+		if err != consistence.ErrRaftNoLeader {
+			break
+		}
+		nsqlookupLog.Logf("waiting the leader of the raft leadership store elected")
+	}
+	return raftStore, err
+}
+
+// watchRaftStore stop the coordinator if the embedded raft store failed, so the
+// leadership of the lookup will be moved to the other nsqlookupd.
+func (l *NSQLookupd) watchRaftStore() {
+	select {
+	case <-l.raftStore.Failed():
+		nsqlookupLog.LogErrorf("raft leadership store failed, stopping the coordinator")
+		l.stopCoordinator()
+	case <-l.exitChan:
+	}
+}
+
+func (l *NSQLookupd) stopCoordinator() {
+	l.stopCoord.Do(func() {
+		if l.coordinator != nil {
+			l.coordinator.Stop()
+		}
+	})
+}
+
+// IsRaftStoreFailed return true if the embedded raft leadership store failed.
+func (l *NSQLookupd) IsRaftStoreFailed() bool {
+	return l.raftStore != nil && l.raftStore.IsFailed()
+}
+
 func (l *NSQLookupd) RealTCPAddr() *net.TCPAddr {
 	l.RLock()
 	defer l.RUnlock()
@@ -173,8 +256,10 @@ func (l *NSQLookupd) Exit() {
 	if l.tcpListener != nil {
 		l.tcpListener.Close()
 	}
-	if l.coordinator != nil {
-		l.coordinator.Stop()
+	close(l.exitChan)
+	l.stopCoordinator()
+	if l.raftStore != nil {
+		l.raftStore.Stop()
 	}
 	if l.httpListener != nil {
 		l.httpListener.Close()
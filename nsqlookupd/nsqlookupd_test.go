@@ -2,11 +2,14 @@ package nsqlookupd
 
 import (
 	"fmt"
+	"io/ioutil"
 	"net"
+	"net/http"
 	"path/filepath"
 	"reflect"
 	"runtime"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -245,6 +248,34 @@ func TestBasicLookupd(t *testing.T) {
 	equal(t, len(returnedProducers), 0)
 }
 
+func TestLookupdMetrics(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	tcpAddr, httpAddr, nsqlookupd := mustStartLookupd(opts)
+	defer nsqlookupd.Exit()
+
+	topicName := "metrics_topic"
+	conn := mustConnectLookupd(t, tcpAddr)
+	defer conn.Close()
+	identify(t, conn, "ip.address", 5000, 5555, "fake-version-HA")
+	nsq.Register(topicName, "0", "channel1").WriteTo(conn)
+	v, err := nsq.ReadResponse(conn)
+	equal(t, err, nil)
+	equal(t, v, []byte("OK"))
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/metrics", httpAddr))
+	equal(t, err, nil)
+	defer resp.Body.Close()
+	equal(t, resp.StatusCode, 200)
+	body, _ := ioutil.ReadAll(resp.Body)
+	t.Logf("got metrics: %s", body)
+	metrics := string(body)
+	equal(t, strings.Contains(metrics, "nsqlookupd_producer_count 1\n"), true)
+	equal(t, strings.Contains(metrics, "nsqlookupd_topic_count 1\n"), true)
+	equal(t, strings.Contains(metrics,
+		`nsqlookupd_topic_producer_count{topic="metrics_topic",partition="0"} 1`), true)
+}
+
 func TestChannelUnregister(t *testing.T) {
 	opts := NewOptions()
 	opts.Logger = newTestLogger(t)
@@ -1,6 +1,7 @@
 package nsqlookupd
 
 import (
+	"github.com/youzan/nsq/consistence"
 	"github.com/youzan/nsq/internal/levellogger"
 	"log"
 	"os"
@@ -23,11 +24,18 @@ type Options struct {
 	ClusterLeadershipUsername  string `flag:"cluster-leadership-username" cfg:"cluster_leadership_username"`
 	ClusterLeadershipPassword  string `flag:"cluster-leadership-password" cfg:"cluster_leadership_password"`
 	ClusterLeadershipRootDir   string `flag:"cluster-leadership-root-dir" cfg:"cluster_leadership_root_dir"`
+	// etcd, etcdv3 or raft, the raft backend is embedded in nsqlookupd and the
+	// cluster leadership addresses are the raft members
+	ClusterLeadershipBackend string `flag:"cluster-leadership-backend" cfg:"cluster_leadership_backend"`
+	RaftNodeID               int    `flag:"raft-node-id" cfg:"raft_node_id"`
+	RaftDataPath             string `flag:"raft-data-path" cfg:"raft_data_path"`
 
 	InactiveProducerTimeout  time.Duration `flag:"inactive-producer-timeout"`
 	NsqdPingTimeout          time.Duration `flag:"nsqd-ping-timeout"`
 	BalanceInterval          []string      `flag:"balance-interval"`
 	AllowWriteWithNoChannels bool          `flag:"allow-write-with-nochannels"`
+	// move the topic leaders back to the preferred leader in background
+	PreferredLeaderRestore bool `flag:"preferred-leader-restore" cfg:"preferred_leader_restore"`
 
 	LogLevel int32  `flag:"log-level" cfg:"log_level"`
 	LogDir   string `flag:"log-dir" cfg:"log_dir"`
@@ -48,6 +56,7 @@ func NewOptions() *Options {
 
 		ClusterLeadershipAddresses: "",
 		ClusterID:                  "nsq-clusterid-test-only",
+		ClusterLeadershipBackend:   consistence.LeadershipBackendEtcd,
 
 		InactiveProducerTimeout: 60 * time.Second,
 		NsqdPingTimeout:         15 * time.Second,